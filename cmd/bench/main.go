@@ -0,0 +1,365 @@
+// Package main implements a load-testing tool for the token flow and raw NATS throughput
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/auth"
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/secrets"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+	"github.com/nats-io/nats.go"
+)
+
+const tokenSubject = "token.request"
+
+// result captures the outcome of a single request or message
+type result struct {
+	latency  time.Duration
+	err      error
+	cacheHit bool
+}
+
+// requester sends the n-th request or message of the benchmark
+type requester func(n int) result
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file")
+	mode := flag.String("mode", "nats", "What to benchmark: nats (token workers), http (brain-app), pub (publish/subscribe) or req (request/reply)")
+	brainURL := flag.String("url", "http://localhost:8080/token", "brain-app token endpoint (http mode)")
+	apiKey := flag.String("api-key", os.Getenv("BRAIN_API_KEY"), "API key sent to brain-app in the X-API-Key header (http mode) (default $BRAIN_API_KEY)")
+	total := flag.Int("requests", 1000, "Total number of requests or messages to send")
+	concurrency := flag.Int("concurrency", 10, "Number of concurrent requesters or publishers")
+	clients := flag.Int("clients", 10, "Number of distinct client IDs to rotate through")
+	clientSecret := flag.String("client-secret", "bench-secret", "Client secret sent with every request")
+	timeout := flag.Int("timeout", 5, "Per-request timeout in seconds")
+	subject := flag.String("subject", "bench", "Subject to publish or send requests to (pub and req modes)")
+	size := flag.Int("size", 128, "Payload size in bytes (pub and req modes)")
+	conns := flag.Int("conns", 1, "Number of NATS connections to spread the publishers or requesters across (pub and req modes)")
+	echo := flag.Bool("echo", true, "Answer requests with a built-in echo responder; disable to benchmark the responders already on -subject (req mode)")
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	if *total <= 0 || *concurrency <= 0 || *clients <= 0 || *conns <= 0 {
+		fmt.Fprintln(os.Stderr, "-requests, -concurrency, -clients and -conns must be greater than zero")
+		os.Exit(2)
+	}
+	if *mode == "pub" && *size < timestampSize {
+		fmt.Fprintf(os.Stderr, "-size must be at least %d bytes in pub mode to carry the send time\n", timestampSize)
+		os.Exit(2)
+	}
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	log := logger.DefaultLogger("bench")
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("bench", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	// The client secret may be a reference such as vault://bench#client_secret
+	secret, err := secrets.New(appConfig.Secrets).Resolve(context.Background(), *clientSecret)
+	if err != nil {
+		log.Fatal("Failed to resolve -client-secret: %v", err)
+	}
+
+	requestTimeout := time.Duration(*timeout) * time.Second
+
+	var send requester
+	var receiver *latencyRecorder
+	switch *mode {
+	case "nats":
+		natsConn, err := natsutil.Connect(appConfig.NATS, "token-bench", log)
+		if err != nil {
+			log.Fatal("Failed to connect to NATS: %v", err)
+		}
+		defer natsConn.Close()
+		log.Info("Benchmarking token workers via NATS at %s", appConfig.NATS.URL)
+		send = natsRequester(natsConn, requestTimeout, *clients, secret)
+	case "http":
+		log.Info("Benchmarking brain-app at %s", *brainURL)
+		send = httpRequester(&http.Client{Timeout: requestTimeout}, *brainURL, *apiKey, *clients, secret)
+	case "pub", "req":
+		pool, err := connectPool(appConfig.NATS, *conns, log)
+		if err != nil {
+			log.Fatal("Failed to connect to NATS: %v", err)
+		}
+		defer pool.Close()
+
+		// Messages are received, or requests answered, on a connection of their own so the
+		// measured latency includes the trip through the server
+		listener, err := natsutil.Connect(appConfig.NATS, "bench-listener", log)
+		if err != nil {
+			log.Fatal("Failed to connect to NATS: %v", err)
+		}
+		defer listener.Close()
+
+		if *mode == "pub" {
+			if receiver, err = subscribeLatency(listener, *subject); err != nil {
+				log.Fatal("Failed to subscribe to %s: %v", *subject, err)
+			}
+			send = pubRequester(pool, *subject, *size)
+		} else {
+			if *echo {
+				if err := echoResponder(listener, *subject); err != nil {
+					log.Fatal("Failed to start the echo responder on %s: %v", *subject, err)
+				}
+			}
+			send = reqRequester(pool, *subject, *size, requestTimeout)
+		}
+		log.Info("Benchmarking %s on %s with %d byte payloads over %d connections", *mode, *subject, *size, *conns)
+	default:
+		log.Fatal("Unknown mode %q, expected nats, http, pub or req", *mode)
+	}
+
+	if *mode == "nats" || *mode == "http" {
+		log.Info("Sending %d requests with concurrency %d across %d clients", *total, *concurrency, *clients)
+	} else {
+		log.Info("Sending %d messages with concurrency %d", *total, *concurrency)
+	}
+
+	// Feed request numbers to a fixed pool of workers
+	jobs := make(chan int)
+	results := make(chan result, *total)
+
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				results <- send(n)
+			}
+		}()
+	}
+
+	// Interrupting the benchmark stops feeding requests and reports on the ones already sent
+	start := time.Now()
+	group := run.New(log)
+	group.Go("bench", func(ctx context.Context) error {
+		defer close(jobs)
+		for n := 0; n < *total; n++ {
+			select {
+			case jobs <- n:
+			case <-ctx.Done():
+				log.Warn("Interrupted after %d of %d requests", n, *total)
+				return nil
+			}
+		}
+		return nil
+	})
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+	wg.Wait()
+	close(results)
+
+	s := collect(results)
+	if receiver != nil {
+		// Published messages count once the subscriber has received them
+		receiver.wait(len(s.latencies), requestTimeout)
+		s.lost = len(s.latencies)
+		s.latencies = receiver.sorted()
+		s.lost -= len(s.latencies)
+	}
+	elapsed := time.Since(start)
+
+	opts := reportOptions{label: "Requests", unit: "req/s", showCache: *mode == "http"}
+	switch *mode {
+	case "pub":
+		opts = reportOptions{label: "Messages", unit: "msg/s", payloadSize: *size}
+	case "req":
+		opts.payloadSize = *size
+	}
+	printReport(s, elapsed, opts)
+}
+
+// clientID rotates the n-th token request through the given number of clients
+func clientID(n, clients int) string {
+	return fmt.Sprintf("bench-client-%d", n%clients)
+}
+
+// natsRequester sends token requests straight to the token workers
+func natsRequester(nc *nats.Conn, timeout time.Duration, clients int, clientSecret string) requester {
+	return func(n int) result {
+		reqData, err := json.Marshal(models.NewTokenRequest(clientID(n, clients), clientSecret))
+		if err != nil {
+			return result{err: err}
+		}
+
+		start := time.Now()
+		msg, err := nc.RequestMsg(pubsub.NewRequestMsg(nc, tokenSubject, models.NewRequestID(), reqData), timeout)
+		latency := time.Since(start)
+		if err != nil {
+			return result{latency: latency, err: err}
+		}
+
+		var response models.TokenResponse
+		if err := json.Unmarshal(msg.Data, &response); err != nil {
+			return result{latency: latency, err: err}
+		}
+		if response.Error != "" {
+			return result{latency: latency, err: errors.New(response.Error)}
+		}
+
+		return result{latency: latency}
+	}
+}
+
+// httpRequester sends token requests through the brain-app HTTP API, authenticated with
+// apiKey if it is set
+func httpRequester(client *http.Client, url, apiKey string, clients int, clientSecret string) requester {
+	return func(n int) result {
+		body, err := json.Marshal(map[string]string{
+			"client_id":     clientID(n, clients),
+			"client_secret": clientSecret,
+		})
+		if err != nil {
+			return result{err: err}
+		}
+
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return result{err: err}
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if apiKey != "" {
+			req.Header.Set(auth.APIKeyHeader, apiKey)
+		}
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			return result{latency: time.Since(start), err: err}
+		}
+		defer resp.Body.Close()
+
+		var payload map[string]string
+		decodeErr := json.NewDecoder(resp.Body).Decode(&payload)
+		latency := time.Since(start)
+
+		if resp.StatusCode != http.StatusOK {
+			return result{latency: latency, err: fmt.Errorf("HTTP %d", resp.StatusCode)}
+		}
+		if decodeErr != nil {
+			return result{latency: latency, err: decodeErr}
+		}
+
+		return result{latency: latency, cacheHit: payload["source"] == "cache"}
+	}
+}
+
+// summary aggregates benchmark results
+type summary struct {
+	latencies []time.Duration
+	errors    map[string]int
+	failed    int
+	cacheHits int
+	// lost counts published messages the subscriber never received (pub mode)
+	lost int
+}
+
+// collect drains the results channel into a summary with sorted latencies
+func collect(results <-chan result) *summary {
+	s := &summary{errors: make(map[string]int)}
+	for r := range results {
+		if r.err != nil {
+			s.failed++
+			s.errors[r.err.Error()]++
+			continue
+		}
+		s.latencies = append(s.latencies, r.latency)
+		if r.cacheHit {
+			s.cacheHits++
+		}
+	}
+
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	return s
+}
+
+// percentile returns the latency at the given percentile of the sorted latencies
+func (s *summary) percentile(p float64) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	idx := int(float64(len(s.latencies)-1) * p / 100)
+	return s.latencies[idx]
+}
+
+// reportOptions selects what the report shows for a mode
+type reportOptions struct {
+	label     string // what was sent, e.g. Requests
+	unit      string // the rate, e.g. req/s
+	showCache bool
+	// payloadSize adds the payload bandwidth of the succeeded requests or messages when set
+	payloadSize int
+}
+
+// printReport writes the benchmark report to stdout
+func printReport(s *summary, elapsed time.Duration, opts reportOptions) {
+	total := len(s.latencies) + s.failed + s.lost
+
+	fmt.Println()
+	fmt.Println("Benchmark results")
+	fmt.Println("-----------------")
+	fmt.Printf("%-13s %d in %s (%.1f %s)\n", opts.label+":", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds(), opts.unit)
+	fmt.Printf("Succeeded:    %d\n", len(s.latencies))
+	fmt.Printf("Failed:       %d (%.2f%%)\n", s.failed, 100*float64(s.failed)/float64(total))
+	if s.lost > 0 {
+		fmt.Printf("Lost:         %d (%.2f%%)\n", s.lost, 100*float64(s.lost)/float64(total))
+	}
+	if opts.payloadSize > 0 {
+		sent := float64(opts.payloadSize * len(s.latencies))
+		fmt.Printf("Bandwidth:    %.2f MB/s of payload\n", sent/elapsed.Seconds()/1e6)
+	}
+
+	if len(s.latencies) > 0 {
+		fmt.Printf("Latency p50:  %s\n", s.percentile(50))
+		fmt.Printf("Latency p95:  %s\n", s.percentile(95))
+		fmt.Printf("Latency p99:  %s\n", s.percentile(99))
+		fmt.Printf("Latency max:  %s\n", s.latencies[len(s.latencies)-1])
+	}
+
+	if opts.showCache && len(s.latencies) > 0 {
+		fmt.Printf("Cache hits:   %d (%.2f%%)\n", s.cacheHits, 100*float64(s.cacheHits)/float64(len(s.latencies)))
+	}
+
+	if len(s.errors) > 0 {
+		fmt.Println("Errors:")
+		for msg, count := range s.errors {
+			fmt.Printf("  %5d  %s\n", count, msg)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/nats-io/nats.go"
+)
+
+// timestampSize is the room a pub mode payload needs for its send time
+const timestampSize = 8
+
+// connPool spreads publishers and requesters across several connections, as a single
+// connection serializes its writes
+type connPool []*nats.Conn
+
+// connectPool opens n connections named bench-1 to bench-n
+func connectPool(cfg config.NATSConfig, n int, log *logger.Logger) (connPool, error) {
+	pool := make(connPool, 0, n)
+	for i := 1; i <= n; i++ {
+		nc, err := natsutil.Connect(cfg, fmt.Sprintf("bench-%d", i), log)
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+		pool = append(pool, nc)
+	}
+	return pool, nil
+}
+
+// conn returns the connection for the n-th message
+func (p connPool) conn(n int) *nats.Conn {
+	return p[n%len(p)]
+}
+
+// Close closes every connection
+func (p connPool) Close() {
+	for _, nc := range p {
+		nc.Close()
+	}
+}
+
+// pubRequester publishes payloads that start with their send time, so the subscriber can
+// measure how long each one took to arrive
+func pubRequester(pool connPool, subject string, size int) requester {
+	return func(n int) result {
+		payload := make([]byte, size)
+		binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+		return result{err: pool.conn(n).Publish(subject, payload)}
+	}
+}
+
+// reqRequester sends requests and measures the round trip until the reply arrives
+func reqRequester(pool connPool, subject string, size int, timeout time.Duration) requester {
+	payload := make([]byte, size)
+	return func(n int) result {
+		start := time.Now()
+		_, err := pool.conn(n).Request(subject, payload, timeout)
+		return result{latency: time.Since(start), err: err}
+	}
+}
+
+// echoResponder answers every request on subject with its own payload
+func echoResponder(nc *nats.Conn, subject string) error {
+	sub, err := nc.QueueSubscribe(subject, "bench", func(msg *nats.Msg) {
+		msg.Respond(msg.Data)
+	})
+	if err != nil {
+		return err
+	}
+	// Do not drop requests when the benchmark outpaces the responder for a moment
+	if err := sub.SetPendingLimits(-1, -1); err != nil {
+		return err
+	}
+	return nc.Flush()
+}
+
+// latencyRecorder collects the latencies of the messages received in pub mode
+type latencyRecorder struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+}
+
+// subscribeLatency records the time each message on subject took from its publisher
+func subscribeLatency(nc *nats.Conn, subject string) (*latencyRecorder, error) {
+	r := &latencyRecorder{}
+	sub, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+		if len(msg.Data) < timestampSize {
+			return
+		}
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(msg.Data)))
+		latency := time.Since(sent)
+
+		r.mu.Lock()
+		r.latencies = append(r.latencies, latency)
+		r.mu.Unlock()
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Messages dropped by the client would be reported as lost by the server instead
+	if err := sub.SetPendingLimits(-1, -1); err != nil {
+		return nil, err
+	}
+	return r, nc.Flush()
+}
+
+// received returns the number of messages received so far
+func (r *latencyRecorder) received() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.latencies)
+}
+
+// wait blocks until expected messages were received, or until none arrived for idle
+func (r *latencyRecorder) wait(expected int, idle time.Duration) {
+	last, lastChange := r.received(), time.Now()
+	for last < expected && time.Since(lastChange) < idle {
+		time.Sleep(10 * time.Millisecond)
+		if n := r.received(); n != last {
+			last, lastChange = n, time.Now()
+		}
+	}
+}
+
+// sorted returns the recorded latencies in ascending order
+func (r *latencyRecorder) sorted() []time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	latencies := append([]time.Duration(nil), r.latencies...)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/kiquetal/nats-go-examples/internal/cache"
+	"github.com/kiquetal/nats-go-examples/internal/tokenmanager"
+)
+
+// adminAPI manages the token cache over HTTP, so a poisoned token can be evicted without a
+// restart. Every endpoint needs the admin token as a bearer token; without one configured,
+// the endpoints answer 404 as if they did not exist.
+type adminAPI struct {
+	server  *TokenServer
+	store   cache.Store
+	backend string // described for the stats, e.g. "redis at localhost:6379"
+}
+
+// register adds the admin endpoints to mux
+func (a *adminAPI) register(mux *http.ServeMux) {
+	mux.Handle("GET /admin/cache/stats", a.authorize(a.handleStats))
+	mux.Handle("GET /admin/cache/keys", a.authorize(a.handleKeys))
+	mux.Handle("DELETE /admin/cache/{client_id}", a.authorize(a.handleDelete))
+	mux.Handle("DELETE /admin/cache", a.authorize(a.handleFlush))
+}
+
+// authorize runs handler for requests carrying the admin token
+func (a *adminAPI) authorize(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected, _ := a.server.adminToken.Load().(string)
+		if expected == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			a.server.log.Warn("Refused admin request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="brain-app admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// handleStats reports the cache backend and size, and the lookup and eviction counts of the
+// in-memory cache
+func (a *adminAPI) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]interface{}{
+		"backend": a.backend,
+		"entries": a.store.Len(),
+	}
+	if memory, ok := cache.Unwrap(a.store).(*cache.TokenCache); ok {
+		s := memory.Stats()
+		stats["hits"], stats["misses"], stats["evictions"] = s.Hits, s.Misses, s.Evictions
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// handleKeys lists the client IDs with a cached token; the tokens themselves are never returned
+func (a *adminAPI) handleKeys(w http.ResponseWriter, r *http.Request) {
+	keys := a.store.Keys()
+	if keys == nil {
+		keys = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"count": len(keys), "keys": keys})
+}
+
+// handleDelete evicts the tokens of one client, for every scope and audience, which the next
+// requests fetch anew
+func (a *adminAPI) handleDelete(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("client_id")
+	a.store.Delete(clientID)
+	for _, key := range a.store.Keys() {
+		if strings.HasPrefix(key, clientID+tokenmanager.KeySeparator) {
+			a.store.Delete(key)
+		}
+	}
+	a.server.log.Info("Evicted the cached tokens of %s on request from %s", clientID, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleFlush evicts every cached token
+func (a *adminAPI) handleFlush(w http.ResponseWriter, r *http.Request) {
+	a.store.Clear()
+	a.server.log.Info("Flushed the token cache on request from %s", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
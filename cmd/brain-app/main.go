@@ -2,40 +2,109 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
-	"os/signal"
-	"syscall"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/kiquetal/nats-go-examples/internal/audit"
+	"github.com/kiquetal/nats-go-examples/internal/auth"
 	"github.com/kiquetal/nats-go-examples/internal/cache"
+	"github.com/kiquetal/nats-go-examples/internal/chaos"
 	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/health"
+	"github.com/kiquetal/nats-go-examples/internal/idp"
+	"github.com/kiquetal/nats-go-examples/internal/idp/jwks"
 	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/metrics"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/ratelimit"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/tokenmanager"
+	"github.com/kiquetal/nats-go-examples/internal/tracing"
+	"github.com/kiquetal/nats-go-examples/internal/version"
 	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const (
-	tokenSubject    = "token.request"
-	defaultTokenTTL = 55 * time.Minute // Cache tokens for slightly less than their typical 1-hour expiry
-)
+const tokenSubject = "token.request"
 
 // TokenServer handles token requests via HTTP and NATS
 type TokenServer struct {
-	natsConn       *nats.Conn
-	tokenCache     *cache.TokenCache
+	requester      pubsub.Requester // sends token requests: the NATS connection, or a pubsub.MemoryBus in tests
+	conn           *nats.Conn       // sends signed token requests, which subscribe to a reply inbox of their own
+	clientName     string           // sent with token requests in the ClientNameHeader
+	tokens         *tokenmanager.Manager
+	keys           *jwks.KeySet // validates tokens for /validate, nil if disabled
 	log            *logger.Logger
-	requestTimeout time.Duration
+	requestTimeout atomic.Int64 // time.Duration, changed when the config is reloaded
+	adminToken     atomic.Value // string, bearer token of the /admin endpoints, changed when the config is reloaded
+	rateLimits     *ratelimit.Middleware
+	auth           *auth.Middleware
+	metrics        *serverMetrics
+	reference      bool                             // send requests without client secrets, see credentials.ModeReference
+	signer         nkeys.KeyPair                    // signs token requests, nil if unsigned
+	encrypter      atomic.Pointer[pubsub.Encrypter] // encrypts token requests, nil if disabled; changed when the config is reloaded
+}
+
+// serverMetrics are the token pipeline metrics exposed on /metrics
+type serverMetrics struct {
+	cacheLookups *metrics.Counter   // by result: hit or miss
+	natsRequests *metrics.Counter   // by result: ok, timeout, no_responders, canceled or error
+	natsLatency  *metrics.Histogram // round trip to the token workers
+	tokenErrors  *metrics.Counter   // failed token requests by reason
+	refreshes    *metrics.Counter   // background token refreshes by result: ok or error
+	validations  *metrics.Counter   // /validate requests by result: valid, invalid or error
+	rateLimited  *metrics.Counter   // /token requests refused by scope: ip or client
+}
+
+// newServerMetrics registers the token pipeline metrics
+func newServerMetrics(registry *metrics.Registry, tokenCache cache.Store) *serverMetrics {
+	registry.GaugeFunc("cached_tokens", "Tokens currently held in the cache", func() float64 {
+		return float64(tokenCache.Len())
+	})
+	if memory, ok := cache.Unwrap(tokenCache).(*cache.TokenCache); ok {
+		registry.CounterFunc("cache_evictions_total", "Tokens evicted from the full in-memory cache", func() float64 {
+			return float64(memory.Stats().Evictions)
+		})
+	}
+	return &serverMetrics{
+		cacheLookups: registry.Counter("cache_lookups_total", "Token cache lookups by result", "result"),
+		natsRequests: registry.Counter("nats_requests_total", "Token requests sent to the workers by result", "result"),
+		natsLatency:  registry.Histogram("nats_request_duration_seconds", "Token request round trip to the workers in seconds", nil),
+		tokenErrors:  registry.Counter("token_errors_total", "Failed token requests by reason", "reason"),
+		refreshes:    registry.Counter("token_refreshes_total", "Background refreshes of cached tokens by result", "result"),
+		validations:  registry.Counter("token_validations_total", "Local token validations by result", "result"),
+		rateLimited:  registry.Counter("rate_limited_total", "Token requests refused by a rate limit by scope", "scope"),
+	}
 }
 
 // ClientCredentialsRequest represents a request for client credentials
 type ClientCredentialsRequest struct {
 	ClientID     string `json:"client_id"`
 	ClientSecret string `json:"client_secret"`
+	Scope        string `json:"scope,omitempty"`    // space-separated, the workers' default if empty
+	Audience     string `json:"audience,omitempty"` // API the token is for, if the IDP supports it
+}
+
+// tokenRequest returns the token manager's request for the credentials
+func (c ClientCredentialsRequest) tokenRequest() tokenmanager.Request {
+	return tokenmanager.Request{ClientID: c.ClientID, ClientSecret: c.ClientSecret, Scope: c.Scope, Audience: c.Audience}
 }
 
 func main() {
@@ -43,6 +112,16 @@ func main() {
 	configPath := flag.String("config", "", "Path to config file")
 	port := flag.Int("port", 8080, "HTTP server port")
 	requestTimeout := flag.Int("request-timeout", 5, "Timeout for NATS requests in seconds")
+	ttlMargin := flag.Int("token-ttl-margin", 60, "Seconds before a token expires at which it is no longer served from the cache")
+	refreshAhead := flag.Float64("refresh-ahead", tokenmanager.DefaultRefreshAhead, "Fraction of a cached token's TTL left when it is refreshed in the background, 0 to disable")
+	refreshJitter := flag.Float64("refresh-jitter", tokenmanager.DefaultRefreshJitter, "Start refreshes earlier by a random part of the refresh window, up to this fraction of it")
+	jwksURL := flag.String("jwks-url", os.Getenv("JWKS_URL"), "IDP key set URL for validating tokens on /validate, disabled if empty (default $JWKS_URL)")
+	tokenIssuer := flag.String("token-issuer", "", "Issuer that validated tokens must have, any if empty")
+	tokenAudience := flag.String("token-audience", "", "Audience that validated tokens must include, any if empty")
+	readyMaxRTT := flag.Int("ready-max-rtt", 0, "Round trip to NATS in milliseconds above which /readyz reports NATS as down, 0 to only check that it answers")
+	shutdownTimeout := flag.Int("shutdown-timeout", 15, "Time to wait for in-flight HTTP requests and the NATS drain on shutdown in seconds")
+	chaosConfig := chaos.RegisterDisconnectFlags(flag.CommandLine)
+	version.RegisterFlag(flag.CommandLine)
 	flag.Parse()
 
 	// Load configuration
@@ -52,52 +131,290 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Create logger
-	log := logger.DefaultLogger("brain-app")
+	// Create a logger with the level and format from the config
+	log, err := logger.FromConfig("brain-app", appConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
 	log.Info("Starting brain-app server")
 
-	// Create token cache
-	tokenCache := cache.NewTokenCache()
-	log.Info("Token cache initialized")
+	if *ttlMargin < 0 {
+		log.Fatal("-token-ttl-margin must not be negative")
+	}
+	if *refreshAhead < 0 || *refreshAhead >= 1 || *refreshJitter < 0 {
+		log.Fatal("-refresh-ahead must be in [0, 1) and -refresh-jitter must not be negative")
+	}
 
-	// Connect to NATS
-	natsConn, err := nats.Connect(appConfig.NATS.URL)
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("brain-app", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	// Fault injection is a no-op unless -chaos-disconnect is set; brain-app only injects disconnects
+	injector := chaos.NewInjector(*chaosConfig, log)
+	if chaosConfig.Enabled() {
+		log.Warn("Chaos fault injection enabled: %+v", *chaosConfig)
+	}
+
+	// Connect to NATS, through WebSocket and proxies for edge deployments, waiting for it to come up
+	natsConn, err := natsutil.Connect(appConfig.NATS, "brain-app", log, injector.NATSOptions()...)
 	if err != nil {
 		log.Fatal("Failed to connect to NATS: %v", err)
 	}
-	defer natsConn.Close()
 	log.Info("Connected to NATS at %s", appConfig.NATS.URL)
 
+	// Requests need to publish to the workers and receive their replies on an inbox
+	perms := natsutil.Permissions{
+		Publish:   []string{tokenSubject},
+		Subscribe: []string{natsConn.NewInbox()},
+	}
+
+	// Record every token request, over NATS and/or in a JSONL file
+	auditLog, err := audit.New(appConfig.Audit, natsConn, func(err error) {
+		log.Warn("Audit error: %v", err)
+	})
+	if err != nil {
+		log.Fatal("Failed to create audit log: %v", err)
+	}
+	if subject := auditLog.Subject(); subject != "" {
+		perms.Publish = append(perms.Publish, subject)
+		log.Info("Publishing audit records to %s", subject)
+	}
+	if appConfig.Audit.File != "" {
+		log.Info("Writing audit records to %s", appConfig.Audit.File)
+	}
+	if err := natsutil.CheckPermissions(natsConn, perms, 5*time.Second); err != nil {
+		log.Fatal("%v", err)
+	}
+
+	// Create the token cache, shared with the other replicas when it is in Redis or a KV bucket
+	tokenCache, err := cache.New(appConfig.Cache, natsConn, func(err error) {
+		log.Warn("Token cache error: %v", err)
+	})
+	if err != nil {
+		log.Fatal("Failed to create token cache: %v", err)
+	}
+	log.Info("Token cache initialized (%s)", cacheBackend(appConfig.Cache))
+	if appConfig.Cache.EncryptionKey != "" {
+		log.Info("Cached tokens are encrypted")
+	}
+
+	// brainApp.requestTimeout, also set by REQUEST_TIMEOUT, overrides the flag
+	if appConfig.BrainApp.RequestTimeout > 0 {
+		*requestTimeout = appConfig.BrainApp.RequestTimeout
+	}
+
+	// In-flight token requests can take up to the request timeout, so shutting down any faster
+	// would cut them off
+	if *shutdownTimeout < *requestTimeout {
+		log.Warn("Shutdown timeout %ds is shorter than the request timeout %ds, in-flight requests may fail on shutdown",
+			*shutdownTimeout, *requestTimeout)
+	}
+	group := run.New(log)
+	group.SetStopTimeout(time.Duration(*shutdownTimeout) * time.Second)
+	group.AddConn("nats", natsConn)
+	group.Go("chaos", func(ctx context.Context) error {
+		injector.RunDisconnects(ctx.Done())
+		return nil
+	})
+
+	// Answer health requests on health.brain-app and serve them on /readyz: the connection must
+	// be up and answer a ping, and the cache backend must be reachable
+	checks := health.New("brain-app")
+	checks.Add("nats", health.NATSConnected(natsConn))
+	checks.Add("nats_rtt", health.NATSRoundTrip(natsConn, time.Duration(*readyMaxRTT)*time.Millisecond))
+	switch store := cache.Unwrap(tokenCache).(type) {
+	case *cache.KVStore:
+		js, err := natsConn.JetStream()
+		if err != nil {
+			log.Fatal("Failed to get JetStream context: %v", err)
+		}
+		checks.Add("cache", health.KeyValue(js, store.Bucket()))
+	case *cache.RedisStore:
+		checks.Add("cache", func(context.Context) error {
+			_, err := store.Do("PING")
+			return err
+		})
+	default:
+		// The in-memory cache cannot fail, but is still listed so the report shows the backend
+		checks.Add("cache", func(context.Context) error { return nil })
+	}
+	if _, err := checks.Respond(natsConn); err != nil {
+		log.Fatal("Failed to answer health requests: %v", err)
+	}
+
+	// Expose the token pipeline metrics for Prometheus on /metrics
+	registry := metrics.NewRegistry("brain_app")
+	httpMetrics := registry.NewHTTPMetrics()
+
 	// Create token server
 	server := &TokenServer{
-		natsConn:       natsConn,
-		tokenCache:     tokenCache,
-		log:            log,
-		requestTimeout: time.Duration(*requestTimeout) * time.Second,
+		requester:  natsConn,
+		conn:       natsConn,
+		clientName: natsConn.Opts.Name,
+		log:        log,
+		metrics:    newServerMetrics(registry, tokenCache),
+	}
+	server.requestTimeout.Store(int64(time.Duration(*requestTimeout) * time.Second))
+	server.adminToken.Store(appConfig.BrainApp.AdminToken)
+	if appConfig.BrainApp.AdminToken != "" {
+		log.Info("Serving the cache admin API on /admin/cache")
 	}
 
+	// Tokens are cached for their lifetime minus the margin, and refreshed by the workers in
+	// the background once a lookup finds them close to expiry. Concurrent fetches for a client
+	// are coalesced.
+	server.tokens = tokenmanager.New(tokenCache, server.fetchToken, tokenmanager.Options{
+		Margin:        time.Duration(*ttlMargin) * time.Second,
+		RefreshAhead:  *refreshAhead,
+		RefreshJitter: *refreshJitter,
+		FetchTimeout:  time.Duration(*requestTimeout) * time.Second,
+		OnRefresh: func(err error) {
+			if err != nil {
+				server.metrics.refreshes.Inc("error")
+				return
+			}
+			server.metrics.refreshes.Inc("ok")
+		},
+	}, log)
+	if *jwksURL != "" {
+		server.keys = jwks.New(*jwksURL, jwks.Options{Issuer: *tokenIssuer, Audience: *tokenAudience, Leeway: 30 * time.Second})
+		log.Info("Validating tokens on /validate with the keys at %s", *jwksURL)
+	}
+	if closer, ok := tokenCache.(io.Closer); ok {
+		group.OnStop("cache", func(context.Context) error { return closer.Close() })
+	}
+	group.OnStop("audit", func(context.Context) error { return auditLog.Close() })
+
+	// Limit /token requests per IP and client ID. The limiter is created even without limits,
+	// so a reloaded config can set them.
+	rateLimit := appConfig.BrainApp.RateLimit
+	limiter, err := ratelimit.New(rateLimit, appConfig.Cache.Redis)
+	if err != nil {
+		log.Fatal("Failed to create rate limiter: %v", err)
+	}
+	if closer, ok := limiter.(io.Closer); ok {
+		group.OnStop("rate limiter", func(context.Context) error { return closer.Close() })
+	}
+	server.rateLimits = ratelimit.NewMiddleware(limiter, rateLimit)
+	server.rateLimits.ClientID = requestClientID
+	server.rateLimits.OnLimited = func(r *http.Request, scope string) {
+		server.metrics.rateLimited.Inc(scope)
+		server.metrics.tokenErrors.Inc("rate_limited")
+		audit.FromContext(r.Context()).Reason = scope + " rate limit"
+	}
+	server.rateLimits.OnError = func(err error) {
+		log.Warn("Rate limiter error, allowing the request: %v", err)
+	}
+	if rateLimit.Enabled() {
+		log.Info("Rate limiting /token to %d requests per IP and %d per client ID every %s (0 is unlimited)",
+			rateLimit.PerIP, rateLimit.PerClient, rateLimit.WindowDuration())
+	}
+	// Authenticate /token callers with API keys or bearer JWTs. The per-IP limit runs first, so
+	// guessing keys is throttled, and each caller can have a limit of its own.
+	authConfig := appConfig.BrainApp.Auth
+	if err := authConfig.Validate(); err != nil {
+		log.Fatal("Invalid brainApp.auth: %v", err)
+	}
+	if authConfig.JWT && server.keys == nil {
+		log.Fatal("brainApp.auth.jwt needs -jwks-url to validate the tokens")
+	}
+	server.auth = auth.NewMiddleware(authConfig, server.keys, limiter)
+	server.auth.OnAuthenticated = func(r *http.Request, caller auth.Caller) {
+		rec := audit.FromContext(r.Context())
+		rec.Caller, rec.AuthMethod = caller.Name, caller.Method
+		log.Debug("Token request %s by %s (%s)", rec.RequestID, caller.Name, caller.Method)
+	}
+	server.auth.OnRejected = func(r *http.Request, err error) {
+		server.metrics.tokenErrors.Inc("unauthorized")
+		audit.FromContext(r.Context()).Reason = err.Error()
+		log.Warn("Refused unauthenticated token request from %s: %v", r.RemoteAddr, err)
+	}
+	server.auth.OnLimited = func(r *http.Request, caller auth.Caller) {
+		server.metrics.rateLimited.Inc(auth.ScopeCaller)
+		server.metrics.tokenErrors.Inc("rate_limited")
+		audit.FromContext(r.Context()).Reason = auth.ScopeCaller + " rate limit"
+		log.Warn("Refused token request by %s over its rate limit", caller.Name)
+	}
+	server.auth.OnError = server.rateLimits.OnError
+	if authConfig.Enabled() {
+		log.Info("Authenticating /token callers with %d API keys, bearer JWTs accepted: %t", len(authConfig.APIKeys), authConfig.JWT)
+	} else {
+		log.Warn("/token accepts unauthenticated requests, set brainApp.auth to require API keys or JWTs")
+	}
+
+	// In the reference mode the token workers hold the client secrets, so callers only name
+	// their client, and must be authenticated to do so
+	credentialsConfig := appConfig.Credentials
+	if err := credentialsConfig.Validate(); err != nil {
+		log.Fatal("Invalid credentials config: %v", err)
+	}
+	server.reference = credentialsConfig.Reference()
+	if server.reference && !authConfig.Enabled() {
+		log.Fatal("The reference credentials mode needs brainApp.auth, or anyone could obtain any client's token")
+	}
+	if server.signer, err = credentialsConfig.Signer(); err != nil {
+		log.Fatal("%v", err)
+	}
+	if server.reference {
+		log.Info("Sending token requests without client secrets, the token workers hold them")
+	}
+	if server.signer != nil {
+		signer, _ := server.signer.PublicKey()
+		log.Info("Signing token requests with %s", signer)
+	}
+
+	// Encrypt the token requests, which carry client secrets, on clusters shared with others
+	encrypter, err := natsutil.NewEncrypter(appConfig.NATS.Encryption)
+	if err != nil {
+		log.Fatal("Invalid nats.encryption: %v", err)
+	}
+	if encrypter != nil {
+		server.encrypter.Store(encrypter)
+		log.Info("Encrypting token requests with key %s", encrypter.KeyID())
+	}
+	group.OnStop("refresh", server.tokens.Stop)
+
+	// Apply log level and request timeout changes when the config file changes or on SIGHUP
+	current := appConfig
+	watcher := config.Watch(*configPath, func(cfg *config.AppConfig) {
+		server.reconfigure(cfg, current)
+		current = cfg
+	})
+	watcher.OnError(func(err error) {
+		log.Error("Failed to reload the configuration, keeping the current one: %v", err)
+	})
+	group.Go("config", watcher.Run)
+
 	// Set up HTTP routes
-	http.HandleFunc("/token", server.handleTokenRequest)
+	// Audit records cover the requests refused by the rate limits and authentication too
+	tokenHandler := server.rateLimits.Wrap(server.auth.Wrap(http.HandlerFunc(server.handleTokenRequest)))
+	http.Handle("/token", auditLog.Middleware(tokenHandler, requestClientID))
+	if server.keys != nil {
+		http.HandleFunc("/validate", server.handleValidate)
+	}
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
+	http.Handle("/healthz", version.Handler())
+	http.Handle("/readyz", checks.Handler())
+	http.Handle("/metrics", registry.Handler())
+	admin := &adminAPI{server: server, store: tokenCache, backend: cacheBackend(appConfig.Cache)}
+	admin.register(http.DefaultServeMux)
 
-	// Start HTTP server in a goroutine
-	go func() {
-		serverAddr := fmt.Sprintf(":%d", *port)
-		log.Info("Starting HTTP server on %s", serverAddr)
-		if err := http.ListenAndServe(serverAddr, nil); err != nil {
-			log.Fatal("HTTP server error: %v", err)
-		}
-	}()
-
-	// Wait for termination signal
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
-	<-signals
+	// The HTTP server stops first, finishing in-flight token requests before NATS is drained
+	group.AddServer("http", &http.Server{
+		Addr:    fmt.Sprintf(":%d", *port),
+		Handler: tracing.Handler(httpMetrics.Wrap(http.DefaultServeMux)),
+	})
 
-	log.Info("Received shutdown signal, exiting...")
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
 }
 
 // handleTokenRequest processes HTTP requests for tokens
@@ -106,6 +423,8 @@ func (s *TokenServer) handleTokenRequest(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	// Every line about the request carries the ID returned to the caller and sent to the workers
+	log := s.log.With("request_id", audit.RequestID(r.Context()))
 
 	// Check for query param to skip cache
 	skipCache := false
@@ -117,7 +436,8 @@ func (s *TokenServer) handleTokenRequest(w http.ResponseWriter, r *http.Request)
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		s.log.Error("Failed to read request body: %v", err)
+		log.Error("Failed to read request body: %v", err)
+		s.metrics.tokenErrors.Inc("invalid_request")
 		return
 	}
 	defer r.Body.Close()
@@ -126,20 +446,33 @@ func (s *TokenServer) handleTokenRequest(w http.ResponseWriter, r *http.Request)
 	var creds ClientCredentialsRequest
 	if err := json.Unmarshal(body, &creds); err != nil {
 		http.Error(w, "Invalid request format", http.StatusBadRequest)
-		s.log.Error("Failed to parse request: %v", err)
+		log.Error("Failed to parse request: %v", err)
+		s.metrics.tokenErrors.Inc("invalid_request")
 		return
 	}
 
-	// Validate client credentials
-	if creds.ClientID == "" || creds.ClientSecret == "" {
+	// Validate client credentials; in the reference mode the token workers hold the secret
+	if creds.ClientID == "" {
+		http.Error(w, "Client ID is required", http.StatusBadRequest)
+		s.metrics.tokenErrors.Inc("invalid_request")
+		return
+	}
+	if s.reference {
+		creds.ClientSecret = ""
+	} else if creds.ClientSecret == "" {
 		http.Error(w, "Client ID and Client Secret are required", http.StatusBadRequest)
+		s.metrics.tokenErrors.Inc("invalid_request")
 		return
 	}
 
-	// Check cache first, unless skipCache is set
+	// Check cache first, unless skipCache is set. Tokens close to expiry are refreshed in the
+	// background while the cached one is served.
 	if !skipCache {
-		if token, found := s.tokenCache.Get(creds.ClientID); found {
-			s.log.Info("Serving cached token for client ID: %s", creds.ClientID)
+		if token, found := s.tokens.Get(creds.tokenRequest()); found {
+			s.metrics.cacheLookups.Inc("hit")
+			audit.FromContext(r.Context()).Outcome = audit.OutcomeCached
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.Bool("token.cache_hit", true))
+			log.Info("Serving cached token for client ID: %s", creds.ClientID)
 
 			// Return cached token
 			w.Header().Set("Content-Type", "application/json")
@@ -150,62 +483,335 @@ func (s *TokenServer) handleTokenRequest(w http.ResponseWriter, r *http.Request)
 			})
 			return
 		}
+		s.metrics.cacheLookups.Inc("miss")
 	}
 
-	// Create token request
-	tokenReq := models.NewTokenRequest(creds.ClientID, creds.ClientSecret)
-
-	// Convert request to JSON
-	reqData, err := json.Marshal(tokenReq)
+	// Concurrent requests for the same client share one request to the workers, and the token
+	// is cached; skip_cache always asks the workers and leaves the cache alone
+	var response *models.TokenResponse
+	if skipCache {
+		response, err = s.fetchToken(r.Context(), creds.tokenRequest())
+	} else {
+		response, err = s.tokens.Fetch(r.Context(), creds.tokenRequest())
+	}
 	if err != nil {
-		http.Error(w, "Failed to process request", http.StatusInternalServerError)
-		s.log.Error("Failed to marshal token request: %v", err)
+		reason := failureReason(err)
+		s.metrics.tokenErrors.Inc(reason)
+		rec := audit.FromContext(r.Context())
+		rec.Reason = reason
+		var refused *idpError
+		switch {
+		case reason == "canceled":
+			rec.Outcome = audit.OutcomeFailed
+			log.Warn("Client went away before the token request completed: %v", err)
+		case reason == "timeout":
+			http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+			log.Error("Token request timed out: %v", err)
+		case errors.As(err, &refused):
+			http.Error(w, refused.message, refused.status())
+			log.Error("Token request failed: %s", refused.message)
+		case reason == "invalid_response":
+			http.Error(w, "Failed to process response", http.StatusInternalServerError)
+			log.Error("Failed to parse token response: %v", err)
+		default:
+			http.Error(w, "Failed to process request", http.StatusInternalServerError)
+			log.Error("Failed to send token request: %v", err)
+		}
 		return
 	}
 
-	// Send request to NATS and wait for response with timeout
-	s.log.Info("Sending token request for client ID: %s (Request ID: %s)",
-		creds.ClientID, tokenReq.RequestID)
+	// Return token to client
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": response.AccessToken,
+		"token_type":   response.TokenType,
+		"scope":        response.Scope,
+		"expires_in":   fmt.Sprintf("%d", response.ExpiresIn),
+	})
+}
 
-	msg, err := s.natsConn.Request(tokenSubject, reqData, s.requestTimeout)
-	if err != nil {
-		if err == nats.ErrTimeout {
-			http.Error(w, "Request timed out", http.StatusGatewayTimeout)
-			s.log.Error("Token request timed out for request ID: %s", tokenReq.RequestID)
+// reconfigure applies the settings that can change while brain-app runs. Other settings,
+// such as the NATS connection and the token cache, need a restart.
+func (s *TokenServer) reconfigure(cfg, previous *config.AppConfig) {
+	if cfg.LogLevel != previous.LogLevel {
+		if err := logger.SetLevel(cfg.LogLevel); err != nil {
+			s.log.Error("Keeping the log level: %v", err)
 		} else {
-			http.Error(w, "Failed to process request", http.StatusInternalServerError)
-			s.log.Error("Failed to send token request: %v", err)
+			s.log.Info("Log level changed to %s", cfg.LogLevel)
+		}
+	}
+
+	timeout := time.Duration(cfg.BrainApp.RequestTimeout) * time.Second
+	if timeout > 0 && timeout != time.Duration(s.requestTimeout.Load()) {
+		s.requestTimeout.Store(int64(timeout))
+		s.tokens.SetFetchTimeout(timeout)
+		s.log.Info("Request timeout changed to %s", timeout)
+	}
+
+	if limits, old := cfg.BrainApp.RateLimit, previous.BrainApp.RateLimit; limits != old {
+		if limits.Backend != old.Backend || limits.Window != old.Window {
+			s.log.Warn("Rate limit backend and window changes need a restart")
+		}
+		s.rateLimits.SetConfig(limits)
+		s.log.Info("Rate limits changed to %d requests per IP and %d per client ID", limits.PerIP, limits.PerClient)
+	}
+
+	if authConfig := cfg.BrainApp.Auth; !reflect.DeepEqual(authConfig, previous.BrainApp.Auth) {
+		switch err := authConfig.Validate(); {
+		case err != nil:
+			s.log.Error("Keeping the authentication settings: %v", err)
+		case authConfig.JWT && s.keys == nil:
+			s.log.Error("Keeping the authentication settings: brainApp.auth.jwt needs -jwks-url")
+		case s.reference && !authConfig.Enabled():
+			s.log.Error("Keeping the authentication settings: the reference credentials mode needs authenticated callers")
+		default:
+			s.auth.SetConfig(authConfig)
+			s.log.Info("Authentication changed to %d API keys, bearer JWTs accepted: %t", len(authConfig.APIKeys), authConfig.JWT)
+		}
+	}
+
+	if encryption := cfg.NATS.Encryption; !reflect.DeepEqual(encryption, previous.NATS.Encryption) {
+		if encrypter, err := natsutil.NewEncrypter(encryption); err != nil {
+			s.log.Error("Keeping the encryption keys: %v", err)
+		} else {
+			s.encrypter.Store(encrypter)
+			if encrypter != nil {
+				s.log.Info("Encrypting token requests with key %s", encrypter.KeyID())
+			} else {
+				s.log.Info("Token request encryption disabled")
+			}
+		}
+	}
+
+	if token := cfg.BrainApp.AdminToken; token != previous.BrainApp.AdminToken {
+		s.adminToken.Store(token)
+		if token == "" {
+			s.log.Info("Cache admin API disabled")
+		} else {
+			s.log.Info("Cache admin token changed")
 		}
+	}
+}
+
+// requestClientID returns the client_id of a token request, leaving the body for the handler
+func requestClientID(r *http.Request) string {
+	if r.Method != http.MethodPost {
+		return ""
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	var creds ClientCredentialsRequest
+	if json.Unmarshal(body, &creds) != nil {
+		return ""
+	}
+	return creds.ClientID
+}
+
+// handleValidate checks a bearer token locally, against the keys the IDP publishes, without
+// a request to the IDP. The token is read from the Authorization header, or from the "token"
+// field of a JSON body.
+func (s *TokenServer) handleValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found && r.Method == http.MethodPost {
+		var body struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&body); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		token = body.Token
+	}
+	if token == "" {
+		http.Error(w, "A bearer token is required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	claims, err := s.keys.ValidateTokenCtx(r.Context(), token)
+	switch {
+	case err == nil:
+		s.metrics.validations.Inc("valid")
+		json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "claims": claims.Raw})
+	case isValidationFailure(err):
+		s.metrics.validations.Inc("invalid")
+		s.log.Debug("Rejected token: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{"active": false, "error": err.Error()})
+	default:
+		// The keys could not be fetched, so the token's validity is unknown
+		s.metrics.validations.Inc("error")
+		s.log.Error("Failed to validate token: %v", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"active": false, "error": "signing keys unavailable"})
+	}
+}
+
+// isValidationFailure reports whether err rejects the token itself, rather than reporting
+// that the keys could not be fetched
+func isValidationFailure(err error) bool {
+	for _, target := range []error{
+		jwks.ErrMalformed, jwks.ErrUnsupportedAlgorithm, jwks.ErrUnknownKey, jwks.ErrInvalidSignature,
+		jwks.ErrExpired, jwks.ErrNotYetValid, jwks.ErrInvalidIssuer, jwks.ErrInvalidAudience,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// errInvalidResponse is a worker reply that is not a token response
+var errInvalidResponse = errors.New("invalid token response")
+
+// idpError is a token request the IDP refused; the message is returned to the caller
+type idpError struct {
+	code    string // a models.ErrCode code or OAuth error code, empty from workers that send none
+	message string
+}
+
+func (e *idpError) Error() string {
+	return "token request refused: " + e.message
+}
+
+// status maps the error code to the status returned to the caller: 401 for credentials the
+// IDP rejected, 503 when it is failing or unreachable, 429 when it throttled the request, 500
+// for failures of the worker and 400 for the other OAuth codes
+func (e *idpError) status() int {
+	switch e.code {
+	case models.ErrCodeInvalidClient, idp.ErrCodeUnauthorizedClient:
+		return http.StatusUnauthorized
+	case models.ErrCodeIDPUnavailable, idp.ErrCodeServerError, idp.ErrCodeTemporarilyUnavailable:
+		return http.StatusServiceUnavailable
+	case models.ErrCodeRateLimited:
+		return http.StatusTooManyRequests
+	case models.ErrCodeInternal, "":
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+// fetchToken asks the token workers for a new token over NATS, for at most the request
+// timeout. Workers learn the deadline from a header and give up with the requester.
+func (s *TokenServer) fetchToken(ctx context.Context, req tokenmanager.Request) (*models.TokenResponse, error) {
+	request := models.NewTokenRequest(req.ClientID, req.ClientSecret)
+	request.Scope, request.Audience = req.Scope, req.Audience
+	reqData, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal token request: %w", err)
+	}
+
+	// Send request to NATS and wait for response with timeout. The request ID, the one of the
+	// audit record if there is one, and brain-app's name travel in headers, next to the
+	// deadline and trace context.
+	requestID := audit.RequestID(ctx)
+	if requestID == "" {
+		requestID = models.NewRequestID()
+	}
+	s.log.Info("Sending token request for client ID: %s (Request ID: %s)", req.ClientID, requestID)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(s.requestTimeout.Load()))
+	defer cancel()
+	reqMsg := nats.NewMsg(tokenSubject)
+	reqMsg.Data = reqData
+	pubsub.SetRequestID(reqMsg, requestID)
+	pubsub.SetClientName(reqMsg, s.clientName)
+	pubsub.SetDeadline(ctx, reqMsg)
+	ctx, span := tracing.StartRequest(ctx, reqMsg)
+	defer span.End()
+	encrypter := s.encrypter.Load()
+	seal := func(msg *nats.Msg) error {
+		if encrypter == nil {
+			return nil
+		}
+		return encrypter.Encrypt(msg)
+	}
+
+	// Signed requests are signed once their reply inbox is known, then encrypted
+	start := time.Now()
+	var msg *nats.Msg
+	if s.signer != nil {
+		msg, err = pubsub.RequestSigned(ctx, s.conn, reqMsg, s.signer, seal)
+	} else if err = seal(reqMsg); err == nil {
+		msg, err = s.requester.RequestMsgWithContext(ctx, reqMsg)
+	}
+	s.metrics.natsLatency.ObserveSince(start)
+	if err != nil {
+		tracing.Fail(span, err)
+		s.metrics.natsRequests.Inc(failureReason(err))
+		return nil, fmt.Errorf("token request %s: %w", requestID, err)
+	}
+	s.metrics.natsRequests.Inc("ok")
+	if encrypter != nil {
+		if _, err := encrypter.Decrypt(msg); err != nil {
+			tracing.Fail(span, err)
+			return nil, fmt.Errorf("token request %s: %w: %v", requestID, errInvalidResponse, err)
+		}
+	}
+
 	// Parse the response
 	var response models.TokenResponse
 	if err := json.Unmarshal(msg.Data, &response); err != nil {
-		http.Error(w, "Failed to process response", http.StatusInternalServerError)
-		s.log.Error("Failed to parse token response: %v", err)
-		return
+		tracing.Fail(span, err)
+		return nil, fmt.Errorf("token request %s: %w: %v", requestID, errInvalidResponse, err)
 	}
 
 	// Check for error in response
 	if response.Error != "" {
-		http.Error(w, response.Error, http.StatusBadRequest)
-		s.log.Error("Token request failed: %s", response.Error)
-		return
+		err := &idpError{code: response.ErrorCode, message: response.Error}
+		tracing.Fail(span, err)
+		return nil, err
 	}
+	return &response, nil
+}
 
-	// Cache the token for future use, unless skipCache is set
-	if !skipCache {
-		s.tokenCache.Set(creds.ClientID, response.AccessToken, defaultTokenTTL)
-		s.log.Info("Token cached for client ID: %s", creds.ClientID)
+// failureReason classifies a failed token request for metrics
+func failureReason(err error) string {
+	var refused *idpError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, nats.ErrTimeout):
+		return "timeout"
+	case errors.Is(err, nats.ErrNoResponders):
+		return "no_responders"
+	case errors.Is(err, errInvalidResponse):
+		return "invalid_response"
+	case errors.As(err, &refused):
+		return "idp"
 	}
+	return "error"
+}
 
-	// Return token to client
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"access_token": response.AccessToken,
-		"token_type":   response.TokenType,
-		"scope":        response.Scope,
-		"expires_in":   fmt.Sprintf("%d", response.ExpiresIn),
-	})
+// cacheBackend names the configured cache backend for logs
+func cacheBackend(cfg cache.Config) string {
+	switch cfg.Backend {
+	case cache.BackendRedis:
+		if u, err := url.Parse(cfg.Redis.URL); err == nil {
+			return "redis at " + u.Redacted()
+		}
+		return cache.BackendRedis
+	case cache.BackendKV:
+		bucket := cfg.KV.Bucket
+		if bucket == "" {
+			bucket = cache.DefaultKVBucket
+		}
+		return "kv bucket " + bucket
+	}
+	switch {
+	case cfg.MaxEntries < 0:
+		return cache.BackendMemory + ", unbounded"
+	case cfg.MaxEntries == 0:
+		return fmt.Sprintf("%s, at most %d tokens", cache.BackendMemory, cache.DefaultMaxEntries)
+	}
+	return fmt.Sprintf("%s, at most %d tokens", cache.BackendMemory, cfg.MaxEntries)
 }
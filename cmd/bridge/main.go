@@ -0,0 +1,246 @@
+// Package main implements a generic HTTP-to-NATS gateway driven by a route table
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/health"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	modeRequest    = "request"
+	modePublish    = "publish"
+	defaultTimeout = 5 * time.Second
+	// maxBodySize bounds request bodies to the default NATS max payload
+	maxBodySize = 1024 * 1024
+)
+
+// placeholderPattern matches {name} placeholders in paths and subjects
+var placeholderPattern = regexp.MustCompile(`\{([a-zA-Z0-9_]+)\}`)
+
+// Bridge forwards HTTP requests to NATS according to its routes
+type Bridge struct {
+	natsConn *nats.Conn
+	log      *logger.Logger
+}
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "configs/bridge.json", "Path to config file with a bridge section")
+	port := flag.Int("port", 0, "HTTP server port (overrides the config file)")
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Create logger
+	log := logger.DefaultLogger("bridge")
+	log.Info("Starting HTTP-to-NATS bridge")
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("bridge", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	if appConfig.Bridge == nil || len(appConfig.Bridge.Routes) == 0 {
+		log.Fatal("No bridge routes configured in %s", *configPath)
+	}
+
+	natsConn, err := natsutil.Connect(appConfig.NATS, "http-bridge", log)
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+	log.Info("Connected to NATS at %s", appConfig.NATS.URL)
+
+	bridge := &Bridge{natsConn: natsConn, log: log}
+
+	// Answer health requests on health.bridge
+	checks := health.New("bridge")
+	checks.Add("nats", health.NATSConnected(natsConn))
+	if _, err := checks.Respond(natsConn); err != nil {
+		log.Fatal("Failed to answer health requests: %v", err)
+	}
+
+	// Register every route from the table
+	mux := http.NewServeMux()
+	for _, route := range appConfig.Bridge.Routes {
+		handler, err := bridge.routeHandler(route)
+		if err != nil {
+			log.Fatal("Invalid route %s %s: %v", route.Method, route.Path, err)
+		}
+		mux.Handle(fmt.Sprintf("%s %s", strings.ToUpper(route.Method), route.Path), handler)
+		log.Info("Route %s %s -> %s %s", strings.ToUpper(route.Method), route.Path, route.Mode, route.Subject)
+	}
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+	mux.Handle("/healthz", version.Handler())
+	mux.Handle("/readyz", checks.Handler())
+
+	serverPort := appConfig.Bridge.Port
+	if *port != 0 {
+		serverPort = *port
+	}
+	if serverPort == 0 {
+		serverPort = 8090
+	}
+
+	// The HTTP server stops first, finishing in-flight requests before NATS is drained
+	group := run.New(log)
+	group.AddConn("nats", natsConn)
+	group.AddServer("http", &http.Server{Addr: fmt.Sprintf(":%d", serverPort), Handler: mux})
+
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// routeHandler validates a route and returns the HTTP handler serving it
+func (b *Bridge) routeHandler(route config.RouteConfig) (http.Handler, error) {
+	if route.Method == "" || route.Path == "" || route.Subject == "" {
+		return nil, errors.New("method, path and subject are required")
+	}
+
+	mode := route.Mode
+	if mode == "" {
+		mode = modeRequest
+	}
+	if mode != modeRequest && mode != modePublish {
+		return nil, fmt.Errorf("unknown mode %q, expected request or publish", route.Mode)
+	}
+
+	// Every placeholder used in the subject must come from the path
+	pathParams := make(map[string]bool)
+	for _, match := range placeholderPattern.FindAllStringSubmatch(route.Path, -1) {
+		pathParams[match[1]] = true
+	}
+	for _, match := range placeholderPattern.FindAllStringSubmatch(route.Subject, -1) {
+		if !pathParams[match[1]] {
+			return nil, fmt.Errorf("subject placeholder {%s} is not defined in the path", match[1])
+		}
+	}
+
+	timeout := defaultTimeout
+	if route.Timeout > 0 {
+		timeout = time.Duration(route.Timeout) * time.Millisecond
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.forward(w, r, route.Subject, mode, timeout)
+	}), nil
+}
+
+// forward turns an HTTP request into a NATS publish or request
+func (b *Bridge) forward(w http.ResponseWriter, r *http.Request, subjectTemplate, mode string, timeout time.Duration) {
+	subject, err := resolveSubject(subjectTemplate, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		b.log.Error("Failed to read request body: %v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	msg := nats.NewMsg(subject)
+	msg.Data = body
+	copyHeaders(r.Header, msg.Header)
+
+	if mode == modePublish {
+		if err := b.natsConn.PublishMsg(msg); err != nil {
+			http.Error(w, "Failed to publish message", http.StatusBadGateway)
+			b.log.Error("Failed to publish to %s: %v", subject, err)
+			return
+		}
+		b.log.Debug("Published %d bytes to %s", len(body), subject)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	reply, err := b.natsConn.RequestMsg(msg, timeout)
+	switch {
+	case errors.Is(err, nats.ErrTimeout):
+		http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+		b.log.Warn("Request to %s timed out", subject)
+		return
+	case errors.Is(err, nats.ErrNoResponders):
+		http.Error(w, "No service available for this route", http.StatusServiceUnavailable)
+		b.log.Warn("No responders on %s", subject)
+		return
+	case err != nil:
+		http.Error(w, "Failed to process request", http.StatusBadGateway)
+		b.log.Error("Request to %s failed: %v", subject, err)
+		return
+	}
+
+	for key, values := range reply.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(reply.Data)
+	b.log.Debug("Forwarded reply from %s (%d bytes)", subject, len(reply.Data))
+}
+
+// resolveSubject fills subject placeholders with the matching path values
+func resolveSubject(subjectTemplate string, r *http.Request) (string, error) {
+	var resolveErr error
+	subject := placeholderPattern.ReplaceAllStringFunc(subjectTemplate, func(placeholder string) string {
+		value := r.PathValue(placeholder[1 : len(placeholder)-1])
+		// Path values must not introduce extra subject tokens or wildcards
+		if value == "" || strings.ContainsAny(value, ".*> \t") {
+			resolveErr = fmt.Errorf("invalid value %q for %s", value, placeholder)
+		}
+		return value
+	})
+	return subject, resolveErr
+}
+
+// copyHeaders forwards content and custom X- headers from HTTP to NATS
+func copyHeaders(from http.Header, to nats.Header) {
+	for key, values := range from {
+		if key != "Content-Type" && !strings.HasPrefix(key, "X-") {
+			continue
+		}
+		for _, value := range values {
+			to.Add(key, value)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+// Package main implements a CLI for inspecting and re-publishing dead-lettered messages
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	usage = `Usage: dlq-processor [flags] <command> [args]
+
+Commands:
+  list                  List dead letters with their original subject, retries and error
+  show <seq>            Print a dead letter with all headers and its payload
+  republish <seq|all>   Re-publish to the original subject (or -to) and remove from the queue
+  discard <seq|all>     Remove dead letters without re-publishing them
+  watch                 Print new dead letters as they arrive
+
+Dead letters are captured in a JetStream stream, created on first use. Messages
+dead-lettered before the stream existed are not available.
+
+Flags:
+`
+	flushTimeout = 2 * time.Second
+	// maxErrorWidth keeps the list output on one line per message
+	maxErrorWidth = 60
+)
+
+// Processor works on the dead-letter stream
+type Processor struct {
+	natsConn   *nats.Conn
+	js         nats.JetStreamContext
+	stream     string
+	maxRetries int
+	force      bool
+	to         string
+	log        *logger.Logger
+}
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file")
+	stream := flag.String("stream", "DEAD_LETTERS", "Stream that captures dead letters")
+	subjects := flag.String("subjects", "*.dlq.>", "Comma-separated dead-letter subjects to capture when creating the stream")
+	maxAge := flag.Duration("max-age", 7*24*time.Hour, "How long dead letters are kept when creating the stream")
+	maxRetries := flag.Int("max-retries", 3, "Refuse to re-publish messages that were already re-published this many times")
+	force := flag.Bool("force", false, "Re-publish even when -max-retries is exceeded")
+	to := flag.String("to", "", "Re-publish to this subject instead of the original one")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Logs go to stderr so listings on stdout can be piped
+	level, _ := logger.ParseLevel(appConfig.LogLevel)
+	log := logger.NewLogger("dlq-processor", level, os.Stderr)
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("dlq-processor", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	natsConn, err := natsutil.Connect(appConfig.NATS, "dlq-processor", log)
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+	defer natsConn.Close()
+
+	js, err := natsConn.JetStream()
+	if err != nil {
+		log.Fatal("Failed to get JetStream context: %v", err)
+	}
+
+	if err := ensureStream(js, *stream, strings.Split(*subjects, ","), *maxAge, log); err != nil {
+		log.Fatal("%v", err)
+	}
+
+	processor := &Processor{
+		natsConn:   natsConn,
+		js:         js,
+		stream:     *stream,
+		maxRetries: *maxRetries,
+		force:      *force,
+		to:         *to,
+		log:        log,
+	}
+
+	switch command := args[0]; command {
+	case "list":
+		err = processor.list()
+	case "show":
+		requireArgs(args, 2)
+		err = processor.show(parseSeq(args[1]))
+	case "republish":
+		requireArgs(args, 2)
+		err = processor.forEach(args[1], processor.republish)
+	case "discard":
+		requireArgs(args, 2)
+		err = processor.forEach(args[1], processor.discard)
+	case "watch":
+		err = processor.watch()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// requireArgs exits with usage information when too few positional arguments were given
+func requireArgs(args []string, n int) {
+	if len(args) < n {
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// parseSeq parses a stream sequence number argument
+func parseSeq(arg string) uint64 {
+	seq, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid sequence number %q\n", arg)
+		os.Exit(2)
+	}
+	return seq
+}
+
+// ensureStream creates the dead-letter stream if it does not exist yet
+func ensureStream(js nats.JetStreamContext, name string, subjects []string, maxAge time.Duration, log *logger.Logger) error {
+	_, err := js.StreamInfo(name)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		return fmt.Errorf("failed to look up stream %s: %w", name, err)
+	}
+
+	for i := range subjects {
+		subjects[i] = strings.TrimSpace(subjects[i])
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{
+		Name:        name,
+		Description: "Dead-lettered messages, managed with dlq-processor",
+		Subjects:    subjects,
+		Storage:     nats.FileStorage,
+		MaxAge:      maxAge,
+	}); err != nil {
+		return fmt.Errorf("failed to create stream %s: %w", name, err)
+	}
+	log.Info("Created stream %s capturing %s", name, strings.Join(subjects, ", "))
+	return nil
+}
+
+// forEach applies fn to a single sequence or, with "all", to every message in the stream
+func (p *Processor) forEach(arg string, fn func(*nats.RawStreamMsg) error) error {
+	if arg != "all" {
+		msg, err := p.js.GetMsg(p.stream, parseSeq(arg))
+		if err != nil {
+			return fmt.Errorf("failed to get message %s: %w", arg, err)
+		}
+		return fn(msg)
+	}
+
+	var failed int
+	err := p.scan(func(msg *nats.RawStreamMsg) {
+		if err := fn(msg); err != nil {
+			p.log.Error("Message %d: %v", msg.Sequence, err)
+			failed++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d messages could not be processed", failed)
+	}
+	return nil
+}
+
+// scan calls fn for every message currently in the stream, in sequence order
+func (p *Processor) scan(fn func(*nats.RawStreamMsg)) error {
+	info, err := p.js.StreamInfo(p.stream)
+	if err != nil {
+		return fmt.Errorf("failed to get stream info: %w", err)
+	}
+	if info.State.Msgs == 0 {
+		return nil
+	}
+
+	for seq := info.State.FirstSeq; seq <= info.State.LastSeq; seq++ {
+		msg, err := p.js.GetMsg(p.stream, seq)
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			// Already re-published or discarded
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get message %d: %w", seq, err)
+		}
+		fn(msg)
+	}
+	return nil
+}
+
+// list prints one line per dead letter
+func (p *Processor) list() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SEQ\tTIME\tDLQ SUBJECT\tORIGINAL SUBJECT\tATTEMPTS\tRETRIES\tERROR")
+
+	var count int
+	err := p.scan(func(msg *nats.RawStreamMsg) {
+		count++
+		errorText := info(msg, models.DeadLetterError, "error")
+		if len(errorText) > maxErrorWidth {
+			errorText = errorText[:maxErrorWidth-3] + "..."
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%s\n", msg.Sequence, msg.Time.Format(time.RFC3339), msg.Subject,
+			originalSubject(msg), info(msg, models.DeadLetterAttempts, "attempts"), retryCount(msg), errorText)
+	})
+	w.Flush()
+	if err != nil {
+		return err
+	}
+
+	p.log.Info("%d dead letters in %s", count, p.stream)
+	return nil
+}
+
+// show prints a dead letter in full
+func (p *Processor) show(seq uint64) error {
+	msg, err := p.js.GetMsg(p.stream, seq)
+	if err != nil {
+		return fmt.Errorf("failed to get message %d: %w", seq, err)
+	}
+
+	fmt.Printf("Sequence:         %d\n", msg.Sequence)
+	fmt.Printf("Time:             %s\n", msg.Time.Format(time.RFC3339))
+	fmt.Printf("Subject:          %s\n", msg.Subject)
+	fmt.Printf("Original subject: %s\n", originalSubject(msg))
+	fmt.Printf("Retries:          %d\n", retryCount(msg))
+	if len(msg.Header) > 0 {
+		fmt.Println("Headers:")
+		for key, values := range msg.Header {
+			fmt.Printf("  %s: %s\n", key, strings.Join(values, ", "))
+		}
+	}
+
+	fmt.Println("Payload:")
+	var pretty interface{}
+	if json.Unmarshal(msg.Data, &pretty) == nil {
+		formatted, _ := json.MarshalIndent(pretty, "", "  ")
+		fmt.Println(string(formatted))
+	} else {
+		fmt.Println(string(msg.Data))
+	}
+	return nil
+}
+
+// republish sends the message back to its original subject and removes it from the queue
+func (p *Processor) republish(msg *nats.RawStreamMsg) error {
+	retries := retryCount(msg)
+	if retries >= p.maxRetries && !p.force {
+		return fmt.Errorf("message %d was already re-published %d times, use -force to retry anyway", msg.Sequence, retries)
+	}
+
+	target := p.to
+	if target == "" {
+		target = originalSubject(msg)
+	}
+	if target == "" {
+		return fmt.Errorf("message %d has no original subject, use -to", msg.Sequence)
+	}
+
+	out := nats.NewMsg(target)
+	out.Data = restorePayload(msg, target)
+	for key, values := range msg.Header {
+		switch key {
+		case models.DeadLetterOriginalSubject, models.DeadLetterError, models.DeadLetterAttempts, models.DeadLetterSource:
+			// The failure details describe the previous delivery only
+		default:
+			out.Header[key] = values
+		}
+	}
+	// The retry count travels with the message, so it is still known if it fails again
+	out.Header.Set(models.DeadLetterRetryCount, strconv.Itoa(retries+1))
+
+	if err := p.natsConn.PublishMsg(out); err != nil {
+		return fmt.Errorf("failed to re-publish message %d: %w", msg.Sequence, err)
+	}
+	if err := p.natsConn.FlushTimeout(flushTimeout); err != nil {
+		return fmt.Errorf("failed to re-publish message %d: %w", msg.Sequence, err)
+	}
+
+	if err := p.js.DeleteMsg(p.stream, msg.Sequence); err != nil {
+		return fmt.Errorf("re-published message %d but failed to remove it: %w", msg.Sequence, err)
+	}
+	p.log.Info("Re-published message %d to %s (retry %d)", msg.Sequence, target, retries+1)
+	return nil
+}
+
+// discard removes a message from the queue
+func (p *Processor) discard(msg *nats.RawStreamMsg) error {
+	if err := p.js.DeleteMsg(p.stream, msg.Sequence); err != nil {
+		return fmt.Errorf("failed to discard message %d: %w", msg.Sequence, err)
+	}
+	p.log.Info("Discarded message %d from %s", msg.Sequence, msg.Subject)
+	return nil
+}
+
+// watch prints new dead letters until interrupted
+func (p *Processor) watch() error {
+	sub, err := p.js.Subscribe("", func(m *nats.Msg) {
+		meta, err := m.Metadata()
+		if err != nil {
+			return
+		}
+		msg := &nats.RawStreamMsg{Subject: m.Subject, Sequence: meta.Sequence.Stream, Header: m.Header, Data: m.Data, Time: meta.Timestamp}
+		fmt.Printf("%s [%d] %s <- %s: %s\n", msg.Time.Format(time.RFC3339), msg.Sequence, msg.Subject,
+			originalSubject(msg), info(msg, models.DeadLetterError, "error"))
+	}, nats.BindStream(p.stream), nats.OrderedConsumer(), nats.DeliverNew())
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %w", p.stream, err)
+	}
+
+	p.log.Info("Watching %s for new dead letters. Press Ctrl+C to exit.", p.stream)
+
+	group := run.New(p.log)
+	group.OnStop("watch", func(ctx context.Context) error {
+		return sub.Unsubscribe()
+	})
+	return group.Run()
+}
+
+// deadLetterMessage decodes the payload when it uses the shared message model
+func deadLetterMessage(msg *nats.RawStreamMsg) *models.Message {
+	var message models.Message
+	if json.Unmarshal(msg.Data, &message) != nil || message.ID == "" {
+		return nil
+	}
+	return &message
+}
+
+// info returns a dead-letter detail from the headers, falling back to the message metadata
+// used by producers that record failures in the payload
+func info(msg *nats.RawStreamMsg, header, metadataKey string) string {
+	if value := msg.Header.Get(header); value != "" {
+		return value
+	}
+	if message := deadLetterMessage(msg); message != nil {
+		return message.Metadata[metadataKey]
+	}
+	return ""
+}
+
+// originalSubject returns the subject the message was dead-lettered from
+func originalSubject(msg *nats.RawStreamMsg) string {
+	return info(msg, models.DeadLetterOriginalSubject, "original_subject")
+}
+
+// retryCount returns how many times the message was already re-published
+func retryCount(msg *nats.RawStreamMsg) int {
+	count, _ := strconv.Atoi(msg.Header.Get(models.DeadLetterRetryCount))
+	return count
+}
+
+// restorePayload returns the payload to re-publish. Messages in the shared model that were
+// rewritten for the dead-letter subject get their subject and metadata restored.
+func restorePayload(msg *nats.RawStreamMsg, target string) []byte {
+	message := deadLetterMessage(msg)
+	if message == nil || message.Subject != msg.Subject {
+		return msg.Data
+	}
+
+	message.Subject = target
+	for _, key := range []string{"original_subject", "error", "attempts"} {
+		delete(message.Metadata, key)
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return msg.Data
+	}
+	return data
+}
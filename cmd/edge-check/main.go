@@ -0,0 +1,135 @@
+// Package main checks connectivity to edge NATS deployments such as leaf nodes and WebSocket ports
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/nats-io/nats.go"
+)
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file")
+	natsURL := flag.String("url", "", "Server URL(s) to check, e.g. ws://localhost:8080 (overrides the config file)")
+	peerURL := flag.String("peer-url", "", "Second server URL, e.g. the hub behind a leaf node, to check that messages cross between them (optional)")
+	subject := flag.String("subject", "edge.ping", "Subject used for round trips")
+	count := flag.Int("count", 5, "Number of round trips")
+	timeout := flag.Duration("timeout", 2*time.Second, "Timeout per round trip")
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+	if *natsURL != "" {
+		appConfig.NATS.URL = *natsURL
+	}
+
+	// Create logger
+	log := logger.DefaultLogger("edge-check")
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("edge-check", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	conn := connect(appConfig.NATS, "edge-check", log)
+	defer conn.Close()
+
+	// Replies come from the peer when given, otherwise from a responder on the same connection
+	responder := conn
+	if *peerURL != "" {
+		peerConfig := appConfig.NATS
+		peerConfig.URL = *peerURL
+		responder = connect(peerConfig, "edge-check-peer", log)
+		defer responder.Close()
+	}
+
+	sub, err := responder.Subscribe(*subject, func(msg *nats.Msg) {
+		msg.Respond([]byte(responder.ConnectedServerName()))
+	})
+	if err != nil {
+		log.Fatal("Failed to subscribe to %s: %v", *subject, err)
+	}
+	defer sub.Unsubscribe()
+
+	// Interest has to propagate across the leaf node connection before requests can be answered
+	if err := responder.Flush(); err != nil {
+		log.Fatal("Failed to flush subscription: %v", err)
+	}
+	if responder != conn {
+		waitForInterest(conn, *subject, *timeout)
+	}
+
+	var failures int
+	var total time.Duration
+	for i := 1; i <= *count; i++ {
+		start := time.Now()
+		reply, err := conn.Request(*subject, []byte("ping"), *timeout)
+		elapsed := time.Since(start)
+		if err != nil {
+			failures++
+			log.Error("Round trip %d failed: %v", i, err)
+			continue
+		}
+		total += elapsed
+		log.Info("Round trip %d: answered by server %s in %s", i, string(reply.Data), elapsed.Round(time.Microsecond))
+	}
+
+	if succeeded := *count - failures; succeeded > 0 {
+		log.Info("%d/%d round trips succeeded, average %s", succeeded, *count, (total / time.Duration(succeeded)).Round(time.Microsecond))
+	}
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
+
+// connect opens a connection with the edge-aware options and reports what it connected to.
+// Unreachable servers are reported right away instead of being retried.
+func connect(cfg config.NATSConfig, name string, log *logger.Logger) *nats.Conn {
+	cfg.ConnectRetries = 0
+	conn, err := natsutil.Connect(cfg, name, log)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+
+	rtt, _ := conn.RTT()
+	log.Info("Connected to %s", conn.ConnectedUrlRedacted())
+	log.Info("  Server: %s (%s), cluster: %q, version %s", conn.ConnectedServerName(), conn.ConnectedServerId(),
+		conn.ConnectedClusterName(), conn.ConnectedServerVersion())
+	log.Info("  RTT: %s, max payload: %d bytes, headers: %t", rtt, conn.MaxPayload(), conn.HeadersSupported())
+	if proxy := cfg.ProxyURL; proxy != "" && proxy != "none" {
+		log.Info("  Proxy: %s", proxy)
+	}
+	return conn
+}
+
+// waitForInterest polls until a request on the subject is answered or the timeout expires,
+// since subscriptions made on the hub reach the leaf node asynchronously
+func waitForInterest(conn *nats.Conn, subject string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, err := conn.Request(subject, []byte("warmup"), 100*time.Millisecond); err == nil {
+			return
+		}
+	}
+}
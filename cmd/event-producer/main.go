@@ -0,0 +1,153 @@
+// Package main appends counter events to a JetStream stream for the event sourcing example
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file")
+	counter := flag.String("counter", "visits", "Counter the events apply to")
+	op := flag.String("op", "increment", "Event to append: increment, decrement or reset")
+	amount := flag.Int64("amount", 1, "Amount to increment or decrement by")
+	count := flag.Int("count", 1, "Number of events to append")
+	interval := flag.Int("interval", 0, "Delay between events in milliseconds")
+	duplicate := flag.Bool("duplicate", false, "Publish every event twice to show that the stream drops duplicates")
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Create logger
+	log := logger.DefaultLogger("event-producer")
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("event-producer", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	eventTypes := map[string]string{
+		"increment": models.CounterIncremented,
+		"decrement": models.CounterDecremented,
+		"reset":     models.CounterReset,
+	}
+	eventType, ok := eventTypes[*op]
+	if !ok {
+		log.Fatal("Unknown operation %q, expected increment, decrement or reset", *op)
+	}
+	if eventType == models.CounterReset {
+		*amount = 0
+	}
+	if strings.ContainsAny(*counter, ".*> \t") || *counter == "" {
+		log.Fatal("Invalid counter name %q: it becomes a subject token", *counter)
+	}
+
+	natsConn, err := natsutil.Connect(appConfig.NATS, "event-producer", log)
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+
+	js, err := natsConn.JetStream()
+	if err != nil {
+		log.Fatal("Failed to get JetStream context: %v", err)
+	}
+
+	if err := ensureStream(js, log); err != nil {
+		log.Fatal("%v", err)
+	}
+
+	group := run.New(log)
+	group.AddConn("nats", natsConn)
+	group.Go("producer", func(ctx context.Context) error {
+		for i := 0; i < *count; i++ {
+			if i > 0 && *interval > 0 {
+				select {
+				case <-time.After(time.Duration(*interval) * time.Millisecond):
+				case <-ctx.Done():
+					return nil
+				}
+			}
+
+			event := models.NewCounterEvent(*counter, eventType, *amount)
+			data, err := json.Marshal(event)
+			if err != nil {
+				return fmt.Errorf("failed to marshal event: %w", err)
+			}
+
+			attempts := 1
+			if *duplicate {
+				attempts = 2
+			}
+			for attempt := 0; attempt < attempts; attempt++ {
+				// The event ID becomes the Nats-Msg-Id header, so retried publishes are stored once
+				ack, err := js.Publish(event.Subject(), data, nats.MsgId(event.ID))
+				if err != nil {
+					return fmt.Errorf("failed to append event: %w", err)
+				}
+				if ack.Duplicate {
+					log.Info("Event %s was a duplicate, the stream kept sequence %d", event.ID, ack.Sequence)
+					continue
+				}
+				log.Info("Appended %s %s(%d) as sequence %d", event.Counter, event.Type, event.Amount, ack.Sequence)
+			}
+		}
+		return nil
+	})
+
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// ensureStream creates the event stream on first use. Events are the source of truth, so they never expire.
+func ensureStream(js nats.JetStreamContext, log *logger.Logger) error {
+	_, err := js.StreamInfo(models.CounterEventsStream)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		return fmt.Errorf("failed to look up stream %s: %w", models.CounterEventsStream, err)
+	}
+
+	if _, err := js.AddStream(&nats.StreamConfig{
+		Name:        models.CounterEventsStream,
+		Description: "Counter events for the event sourcing example",
+		Subjects:    []string{models.CounterEventsSubject + ".>"},
+		Storage:     nats.FileStorage,
+		Duplicates:  2 * time.Minute,
+	}); err != nil {
+		return fmt.Errorf("failed to create stream %s: %w", models.CounterEventsStream, err)
+	}
+	log.Info("Created stream %s", models.CounterEventsStream)
+	return nil
+}
@@ -0,0 +1,245 @@
+// Package main builds a KV projection of counter events for the event sourcing example
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/health"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/kvstore"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+// Projector applies counter events to their projected state in the KV bucket
+type Projector struct {
+	kv  nats.KeyValue
+	log *logger.Logger
+}
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file")
+	durable := flag.String("durable", "counter-projector", "Durable consumer name, which remembers the projection's position")
+	rebuild := flag.Bool("rebuild", false, "Discard the projection and replay all events from the start")
+	once := flag.Bool("once", false, "Exit once all stored events have been applied")
+	show := flag.Bool("show", false, "Print the projected counters and exit")
+	batch := flag.Int("batch", 100, "Number of events fetched at a time")
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Create logger
+	log := logger.DefaultLogger("event-projector")
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("event-projector", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	natsConn, err := natsutil.Connect(appConfig.NATS, "event-projector", log)
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+	defer natsConn.Close()
+
+	js, err := natsConn.JetStream()
+	if err != nil {
+		log.Fatal("Failed to get JetStream context: %v", err)
+	}
+
+	if _, err := js.StreamInfo(models.CounterEventsStream); err != nil {
+		log.Fatal("Stream %s not found, append events with event-producer first: %v", models.CounterEventsStream, err)
+	}
+
+	if *rebuild {
+		// The projection is disposable: dropping it and the consumer position replays every event
+		if err := js.DeleteConsumer(models.CounterEventsStream, *durable); err != nil && !errors.Is(err, nats.ErrConsumerNotFound) {
+			log.Fatal("Failed to delete consumer %s: %v", *durable, err)
+		}
+		if err := js.DeleteKeyValue(models.CounterProjectionBucket); err != nil && !errors.Is(err, nats.ErrBucketNotFound) {
+			log.Fatal("Failed to delete bucket %s: %v", models.CounterProjectionBucket, err)
+		}
+		log.Info("Discarded projection, replaying all events")
+	}
+
+	kv, err := kvstore.Open(js, nats.KeyValueConfig{
+		Bucket:      models.CounterProjectionBucket,
+		Description: "Counter values projected from " + models.CounterEventsStream,
+		History:     5,
+	})
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+
+	projector := &Projector{kv: kv, log: log}
+
+	if *show {
+		if err := projector.show(); err != nil {
+			log.Fatal("Failed to show projection: %v", err)
+		}
+		return
+	}
+
+	sub, err := js.PullSubscribe(models.CounterEventsSubject+".>", *durable,
+		nats.BindStream(models.CounterEventsStream), nats.DeliverAll(), nats.AckExplicit())
+	if err != nil {
+		log.Fatal("Failed to create consumer %s: %v", *durable, err)
+	}
+
+	// Answer health requests on health.event-projector
+	checks := health.New("event-projector")
+	checks.Add("nats", health.NATSConnected(natsConn))
+	checks.Add("consumer", health.SubscriptionValid(sub))
+	checks.Add("projection", health.KeyValue(js, models.CounterProjectionBucket))
+	if _, err := checks.Respond(natsConn); err != nil {
+		log.Fatal("Failed to answer health requests: %v", err)
+	}
+
+	log.Info("Projecting %s into bucket %s. Press Ctrl+C to exit.", models.CounterEventsStream, models.CounterProjectionBucket)
+
+	var applied int
+	group := run.New(log)
+	group.Go("projector", func(ctx context.Context) error {
+		for ctx.Err() == nil {
+			msgs, err := sub.Fetch(*batch, nats.MaxWait(time.Second))
+			if err != nil && !errors.Is(err, nats.ErrTimeout) {
+				log.Error("Failed to fetch events: %v", err)
+				select {
+				case <-time.After(time.Second):
+				case <-ctx.Done():
+				}
+				continue
+			}
+
+			for _, msg := range msgs {
+				if projector.handle(msg) {
+					applied++
+				}
+			}
+
+			if *once {
+				info, err := sub.ConsumerInfo()
+				if err == nil && info.NumPending == 0 && info.NumAckPending == 0 {
+					log.Info("Caught up after applying %d events", applied)
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// handle applies one event and acknowledges it, reporting whether the projection changed
+func (p *Projector) handle(msg *nats.Msg) bool {
+	meta, err := msg.Metadata()
+	if err != nil {
+		p.log.Error("Received a message without JetStream metadata on %s", msg.Subject)
+		return false
+	}
+
+	var event models.CounterEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil || event.Counter == "" {
+		// Retrying will not make a malformed event valid
+		p.log.Error("Skipping malformed event at sequence %d: %v", meta.Sequence.Stream, err)
+		msg.Term()
+		return false
+	}
+
+	applied, err := p.apply(&event, meta.Sequence.Stream)
+	if err != nil {
+		p.log.Warn("Failed to apply event %d, it will be redelivered: %v", meta.Sequence.Stream, err)
+		msg.Nak()
+		return false
+	}
+
+	// The KV write and the ack are not atomic; if the ack is lost the redelivered event is skipped by apply
+	if err := msg.Ack(); err != nil {
+		p.log.Warn("Failed to ack event %d: %v", meta.Sequence.Stream, err)
+	}
+	return applied
+}
+
+// apply updates the counter's state unless the event was already applied. The write is
+// conditional on the revision that was read, so concurrent projectors cannot lose updates.
+func (p *Projector) apply(event *models.CounterEvent, sequence uint64) (bool, error) {
+	var state models.CounterState
+	revision, err := kvstore.GetJSON(p.kv, event.Counter, &state)
+	if err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+		return false, err
+	}
+
+	if sequence <= state.LastSequence {
+		p.log.Debug("Event %d for %s was already applied, skipping", sequence, event.Counter)
+		return false, nil
+	}
+
+	state.Apply(event, sequence)
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return false, err
+	}
+
+	if revision == 0 {
+		_, err = p.kv.Create(event.Counter, data)
+	} else {
+		_, err = p.kv.Update(event.Counter, data, revision)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	p.log.Info("Applied %s %s(%d) at sequence %d: value %d", event.Counter, event.Type, event.Amount, sequence, state.Value)
+	return true, nil
+}
+
+// show prints every projected counter
+func (p *Projector) show() error {
+	keys, err := kvstore.Keys(p.kv)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		fmt.Println("No counters projected yet")
+		return nil
+	}
+
+	for _, key := range keys {
+		var state models.CounterState
+		if _, err := kvstore.GetJSON(p.kv, key, &state); err != nil {
+			return err
+		}
+		fmt.Printf("%-20s %8d  (%d events, last sequence %d, updated %s)\n", key, state.Value, state.Events,
+			state.LastSequence, state.UpdatedAt.Format(time.RFC3339))
+	}
+	return nil
+}
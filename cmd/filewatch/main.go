@@ -0,0 +1,251 @@
+// Package main implements a file watcher that publishes file change events to NATS
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/health"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/kiquetal/nats-go-examples/pkg/objectstore"
+	"github.com/nats-io/nats.go"
+)
+
+// eventPublisher turns detected changes into file events
+type eventPublisher struct {
+	natsConn   *nats.Conn
+	subject    string
+	content    bool
+	maxContent int64
+	objects    nats.ObjectStore
+	bucket     string
+	log        *logger.Logger
+}
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file")
+	dirs := flag.String("dirs", ".", "Comma-separated list of directories to watch")
+	pattern := flag.String("pattern", "*", "Only watch files whose name matches this glob, e.g. '*.csv'")
+	recursive := flag.Bool("recursive", true, "Watch subdirectories")
+	subject := flag.String("subject", "files", "Subject prefix; events go to <prefix>.created, .modified and .deleted")
+	interval := flag.Int("interval", 1000, "Scan interval in milliseconds")
+	initial := flag.Bool("initial", false, "Publish created events for files that exist at startup")
+	content := flag.Bool("content", false, "Include file content in created and modified events")
+	maxContent := flag.Int64("max-content", 512*1024, "Largest file in bytes whose content is included inline")
+	objectBucket := flag.String("object-store", "", "Upload files to this JetStream object store bucket and reference them in events (optional)")
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Create logger
+	log := logger.DefaultLogger("filewatch")
+	log.Info("Starting file watcher")
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("filewatch", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	var watchDirs []string
+	for _, dir := range strings.Split(*dirs, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			watchDirs = append(watchDirs, filepath.Clean(dir))
+		}
+	}
+
+	watcher, err := NewWatcher(watchDirs, *pattern, *recursive)
+	if err != nil {
+		log.Fatal("Invalid pattern %q: %v", *pattern, err)
+	}
+
+	natsConn, err := natsutil.Connect(appConfig.NATS, "filewatch", log)
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+	log.Info("Connected to NATS at %s", appConfig.NATS.URL)
+
+	publisher := &eventPublisher{
+		natsConn:   natsConn,
+		subject:    *subject,
+		content:    *content,
+		maxContent: *maxContent,
+		bucket:     *objectBucket,
+		log:        log,
+	}
+
+	// Large files travel through the object store instead of the message payload
+	if *objectBucket != "" {
+		js, err := natsConn.JetStream()
+		if err != nil {
+			log.Fatal("Failed to get JetStream context: %v", err)
+		}
+		publisher.objects, err = objectstore.Open(js, nats.ObjectStoreConfig{
+			Bucket:      *objectBucket,
+			Description: "Files uploaded by filewatch",
+		})
+		if err != nil {
+			log.Fatal("%v", err)
+		}
+		log.Info("Uploading files to object store %s", *objectBucket)
+	}
+
+	// Without -initial the first scan only establishes the baseline
+	if !*initial {
+		if _, err := watcher.Scan(); err != nil {
+			log.Fatal("Failed to scan directories: %v", err)
+		}
+	}
+
+	// Answer health requests on health.filewatch
+	checks := health.New("filewatch")
+	checks.Add("nats", health.NATSConnected(natsConn))
+	if _, err := checks.Respond(natsConn); err != nil {
+		log.Fatal("Failed to answer health requests: %v", err)
+	}
+
+	log.Info("Watching %s (pattern %s) every %dms, publishing to %s.*. Press Ctrl+C to exit.",
+		strings.Join(watchDirs, ", "), *pattern, *interval, *subject)
+
+	// Draining the connection flushes events that are still pending when the watcher stops
+	group := run.New(log)
+	group.AddConn("nats", natsConn)
+	group.Go("watcher", func(ctx context.Context) error {
+		ticker := time.NewTicker(time.Duration(*interval) * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			changes, err := watcher.Scan()
+			if err != nil {
+				log.Error("Failed to scan directories: %v", err)
+			}
+			for _, c := range changes {
+				if err := publisher.publish(c); err != nil {
+					log.Error("Failed to publish %s event for %s: %v", c.op, c.path, err)
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// publish builds the event for a change and publishes it on <prefix>.<op>
+func (p *eventPublisher) publish(c change) error {
+	event := models.NewFileEvent(c.op, filepath.ToSlash(c.path))
+	event.Size = c.state.size
+	event.ModTime = c.state.modTime
+
+	if c.op == models.FileDeleted {
+		if p.objects != nil {
+			// Keep the object store a mirror of the watched directories
+			if err := p.objects.Delete(event.Path); err != nil && err != nats.ErrObjectNotFound {
+				p.log.Warn("Failed to delete object %s: %v", event.Path, err)
+			}
+		}
+	} else if err := p.attach(event, c.path); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	subject := p.subject + "." + c.op
+	if err := p.natsConn.Publish(subject, data); err != nil {
+		return err
+	}
+
+	p.log.Info("Published %s event for %s (%d bytes) on %s", c.op, event.Path, event.Size, subject)
+	return nil
+}
+
+// attach adds the checksum and, if configured, the content or object reference to the event
+func (p *eventPublisher) attach(event *models.FileEvent, path string) error {
+	if !p.content && p.objects == nil {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if p.objects != nil {
+		info, err := p.objects.Put(&nats.ObjectMeta{Name: event.Path}, file)
+		if err != nil {
+			return fmt.Errorf("failed to upload to object store: %w", err)
+		}
+		event.Object = &models.ObjectRef{Bucket: p.bucket, Name: info.Name}
+		event.Size = int64(info.Size)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	if !p.content || event.Size > p.maxContent {
+		if p.content {
+			p.log.Warn("Not including content of %s: %d bytes exceeds -max-content", event.Path, event.Size)
+		}
+		return p.checksum(event, file)
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	event.Content = data
+	event.Size = int64(len(data))
+	event.Checksum = "sha256:" + hex.EncodeToString(sum[:])
+	return nil
+}
+
+// checksum sets the event checksum from the file without loading it into memory
+func (p *eventPublisher) checksum(event *models.FileEvent, file *os.File) error {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	event.Checksum = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
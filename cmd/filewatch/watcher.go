@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+)
+
+// fileState is what the watcher remembers about a file between scans
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// change is a detected file change
+type change struct {
+	op    string
+	path  string
+	state fileState
+}
+
+// Watcher detects file changes by periodically scanning directories and comparing
+// snapshots, which works everywhere without platform-specific notification APIs
+type Watcher struct {
+	dirs      []string
+	pattern   string
+	recursive bool
+	files     map[string]fileState
+}
+
+// NewWatcher creates a watcher for the given directories. Only files whose base name
+// matches pattern are reported; subdirectories are scanned when recursive is set.
+func NewWatcher(dirs []string, pattern string, recursive bool) (*Watcher, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return &Watcher{
+		dirs:      dirs,
+		pattern:   pattern,
+		recursive: recursive,
+		files:     make(map[string]fileState),
+	}, nil
+}
+
+// Scan walks the directories and returns the changes since the previous scan.
+// The first scan reports every existing file as created.
+func (w *Watcher) Scan() ([]change, error) {
+	current := make(map[string]fileState)
+	for _, dir := range w.dirs {
+		if err := w.walk(dir, current); err != nil {
+			return nil, err
+		}
+	}
+
+	var changes []change
+	for path, state := range current {
+		previous, found := w.files[path]
+		switch {
+		case !found:
+			changes = append(changes, change{op: models.FileCreated, path: path, state: state})
+		case previous != state:
+			changes = append(changes, change{op: models.FileModified, path: path, state: state})
+		}
+	}
+	for path, state := range w.files {
+		if _, found := current[path]; !found {
+			changes = append(changes, change{op: models.FileDeleted, path: path, state: state})
+		}
+	}
+	w.files = current
+
+	// Map iteration order is random, report changes in a stable order
+	sort.Slice(changes, func(i, j int) bool { return changes[i].path < changes[j].path })
+	return changes, nil
+}
+
+// walk records the state of every matching file below dir
+func (w *Watcher) walk(dir string, files map[string]fileState) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Files can disappear between listing and stat, they show up as deleted on the next scan
+			if path != dir {
+				return nil
+			}
+			return err
+		}
+
+		if entry.IsDir() {
+			if path != dir && !w.recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if matched, _ := filepath.Match(w.pattern, entry.Name()); !matched || !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		files[path] = fileState{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+}
@@ -0,0 +1,321 @@
+// Package main implements a forwarder that delivers NATS messages to HTTP endpoints
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/health"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+	// maxErrorBody bounds how much of a failed response is kept for logs and dead letters
+	maxErrorBody = 512
+)
+
+// permanentError marks a delivery failure that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+// templateData is what URL templates can refer to
+type templateData struct {
+	Subject  string
+	Tokens   []string // subject split on dots
+	ID       string
+	Body     string
+	Metadata map[string]string
+}
+
+// target is a configured forwarding rule with its parsed URL template
+type target struct {
+	config config.ForwardTargetConfig
+	url    *template.Template
+	client *http.Client
+}
+
+// Forwarder delivers messages to their targets, retrying transient failures
+type Forwarder struct {
+	natsConn   *nats.Conn
+	log        *logger.Logger
+	maxRetries int
+	retryWait  time.Duration
+}
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "configs/forwarder.json", "Path to config file with a forwarder section")
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Create logger
+	log := logger.DefaultLogger("forwarder")
+	log.Info("Starting NATS-to-HTTP forwarder")
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("forwarder", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	forwarderConfig := appConfig.Forwarder
+	if forwarderConfig == nil || len(forwarderConfig.Targets) == 0 {
+		log.Fatal("No forwarding targets configured in %s", *configPath)
+	}
+
+	natsConn, err := natsutil.Connect(appConfig.NATS, "forwarder", log)
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+	log.Info("Connected to NATS at %s", appConfig.NATS.URL)
+
+	forwarder := &Forwarder{
+		natsConn:   natsConn,
+		log:        log,
+		maxRetries: forwarderConfig.MaxRetries,
+		retryWait:  time.Duration(forwarderConfig.RetryWait) * time.Millisecond,
+	}
+
+	var subs []*nats.Subscription
+	for _, targetConfig := range forwarderConfig.Targets {
+		t, err := newTarget(targetConfig)
+		if err != nil {
+			log.Fatal("Invalid target %s: %v", targetConfig.Name, err)
+		}
+
+		// Each subscription handles its messages one at a time, so deliveries stay in order
+		handler := func(msg *nats.Msg) { forwarder.handle(t, msg) }
+		var sub *nats.Subscription
+		if targetConfig.Queue != "" {
+			sub, err = natsConn.QueueSubscribe(targetConfig.Subject, targetConfig.Queue, handler)
+		} else {
+			sub, err = natsConn.Subscribe(targetConfig.Subject, handler)
+		}
+		if err != nil {
+			log.Fatal("Failed to subscribe to %s: %v", targetConfig.Subject, err)
+		}
+		subs = append(subs, sub)
+		log.Info("Target %s: %s -> %s %s", targetConfig.Name, targetConfig.Subject, t.config.Method, targetConfig.URL)
+	}
+
+	// Answer health requests on health.forwarder
+	checks := health.New("forwarder")
+	checks.Add("nats", health.NATSConnected(natsConn))
+	for _, sub := range subs {
+		checks.Add("subscription "+sub.Subject, health.SubscriptionValid(sub))
+	}
+	if _, err := checks.Respond(natsConn); err != nil {
+		log.Fatal("Failed to answer health requests: %v", err)
+	}
+
+	// Draining finishes in-flight deliveries, whose retries can take a while
+	group := run.New(log)
+	group.SetStopTimeout(30 * time.Second)
+	group.AddConn("nats", natsConn)
+
+	log.Info("Forwarder running. Press Ctrl+C to exit.")
+
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// newTarget validates the target configuration and parses its URL template
+func newTarget(cfg config.ForwardTargetConfig) (*target, error) {
+	if cfg.Subject == "" || cfg.URL == "" {
+		return nil, errors.New("subject and url are required")
+	}
+	if cfg.Method == "" {
+		cfg.Method = http.MethodPost
+	}
+
+	tmpl, err := template.New(cfg.Name).
+		Funcs(template.FuncMap{"pathEscape": url.PathEscape, "queryEscape": url.QueryEscape}).
+		Option("missingkey=zero").
+		Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url template: %w", err)
+	}
+
+	timeout := defaultTimeout
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Millisecond
+	}
+
+	return &target{config: cfg, url: tmpl, client: &http.Client{Timeout: timeout}}, nil
+}
+
+// handle forwards a message, dead-lettering it when delivery fails for good
+func (f *Forwarder) handle(t *target, msg *nats.Msg) {
+	data := templateData{
+		Subject: msg.Subject,
+		Tokens:  strings.Split(msg.Subject, "."),
+	}
+
+	// Messages published with the shared model expose their fields to the URL template
+	var message models.Message
+	if json.Unmarshal(msg.Data, &message) == nil && message.ID != "" {
+		data.ID = message.ID
+		data.Body = message.Body
+		data.Metadata = message.Metadata
+	}
+
+	var endpoint strings.Builder
+	if err := t.url.Execute(&endpoint, data); err != nil {
+		f.log.Error("Failed to render URL for %s: %v", msg.Subject, err)
+		f.deadLetter(t, msg, 0, err)
+		return
+	}
+
+	response, attempts, err := f.deliverWithRetry(t, endpoint.String(), data.ID, msg)
+	if err != nil {
+		f.log.Error("Failed to forward %s to %s after %d attempts: %v", msg.Subject, endpoint.String(), attempts, err)
+		f.deadLetter(t, msg, attempts, err)
+		return
+	}
+
+	f.log.Info("Forwarded %s to %s %s", msg.Subject, t.config.Method, endpoint.String())
+
+	// Requests get the endpoint's response as their reply
+	if msg.Reply != "" {
+		if err := msg.Respond(response); err != nil {
+			f.log.Error("Failed to reply to %s: %v", msg.Subject, err)
+		}
+	}
+}
+
+// deliverWithRetry sends the message to the URL, retrying transient failures with backoff
+func (f *Forwarder) deliverWithRetry(t *target, targetURL, id string, msg *nats.Msg) ([]byte, int, error) {
+	var err error
+	wait := f.retryWait
+	for attempt := 1; attempt <= f.maxRetries+1; attempt++ {
+		var response []byte
+		if response, err = f.deliver(t, targetURL, id, msg); err == nil {
+			return response, attempt, nil
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return nil, attempt, err
+		}
+
+		if attempt <= f.maxRetries {
+			f.log.Warn("Delivery attempt %d of %s to %s failed: %v", attempt, msg.Subject, targetURL, err)
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	return nil, f.maxRetries + 1, err
+}
+
+// deliver performs a single HTTP request and returns the response body
+func (f *Forwarder) deliver(t *target, targetURL, id string, msg *nats.Msg) ([]byte, error) {
+	req, err := http.NewRequest(t.config.Method, targetURL, bytes.NewReader(msg.Data))
+	if err != nil {
+		return nil, &permanentError{err}
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Nats-Subject", msg.Subject)
+	if id != "" {
+		// Lets endpoints recognise redeliveries of the same message
+		req.Header.Set("Idempotency-Key", id)
+	}
+	for key, values := range msg.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	for key, value := range t.config.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return body, nil
+	}
+
+	if len(body) > maxErrorBody {
+		body = body[:maxErrorBody]
+	}
+	err = fmt.Errorf("endpoint returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+
+	// Client errors will not go away on retry, except timeouts and rate limiting
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return nil, &permanentError{err}
+	}
+	return nil, err
+}
+
+// deadLetter parks an undeliverable message on the target's dead-letter subject
+func (f *Forwarder) deadLetter(t *target, msg *nats.Msg, attempts int, cause error) {
+	if t.config.DeadLetterSubject == "" {
+		f.log.Warn("Dropping %s message: no dead-letter subject configured for %s", msg.Subject, t.config.Name)
+		return
+	}
+
+	// Keep the payload and headers as they were, so the message can be re-published unchanged
+	letter := nats.NewMsg(t.config.DeadLetterSubject)
+	letter.Data = msg.Data
+	for key, values := range msg.Header {
+		letter.Header[key] = values
+	}
+	letter.Header.Set(models.DeadLetterOriginalSubject, msg.Subject)
+	letter.Header.Set(models.DeadLetterError, cause.Error())
+	letter.Header.Set(models.DeadLetterAttempts, strconv.Itoa(attempts))
+	letter.Header.Set(models.DeadLetterSource, "forwarder/"+t.config.Name)
+
+	if err := f.natsConn.PublishMsg(letter); err != nil {
+		f.log.Error("Failed to dead-letter %s message: %v", msg.Subject, err)
+		return
+	}
+
+	f.log.Warn("Message on %s sent to dead-letter subject %s", msg.Subject, t.config.DeadLetterSubject)
+}
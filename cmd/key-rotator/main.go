@@ -0,0 +1,302 @@
+// Package main implements a service that generates and rotates message signing keys
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/health"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/kvstore"
+	"github.com/kiquetal/nats-go-examples/pkg/signing"
+	"github.com/nats-io/nats.go"
+)
+
+// keyHistory is how many revisions of each key the buckets keep
+const keyHistory = 10
+
+// Rotator owns the signing key buckets
+type Rotator struct {
+	publicKeys nats.KeyValue
+	secrets    nats.KeyValue
+	interval   time.Duration
+	grace      time.Duration
+	log        *logger.Logger
+}
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file")
+	interval := flag.Duration("interval", 24*time.Hour, "Rotate the signing key when it is older than this")
+	grace := flag.Duration("grace", time.Hour, "How long signatures made with a retired key stay valid")
+	check := flag.Duration("check", time.Minute, "How often to check whether a rotation is due")
+	once := flag.Bool("once", false, "Rotate immediately and exit")
+	list := flag.Bool("list", false, "List published keys and exit")
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Create logger
+	log := logger.DefaultLogger("key-rotator")
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("key-rotator", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	natsConn, err := natsutil.Connect(appConfig.NATS, "key-rotator", log)
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+	defer natsConn.Close()
+
+	js, err := natsConn.JetStream()
+	if err != nil {
+		log.Fatal("Failed to get JetStream context: %v", err)
+	}
+
+	rotator := &Rotator{interval: *interval, grace: *grace, log: log}
+	if rotator.publicKeys, err = kvstore.Open(js, nats.KeyValueConfig{Bucket: signing.PublicKeysBucket, Description: "Public message signing keys", History: keyHistory}); err != nil {
+		log.Fatal("%v", err)
+	}
+	if rotator.secrets, err = kvstore.Open(js, nats.KeyValueConfig{Bucket: signing.SecretsBucket, Description: "Active private message signing key", History: keyHistory}); err != nil {
+		log.Fatal("%v", err)
+	}
+
+	if *list {
+		if err := rotator.list(); err != nil {
+			log.Fatal("Failed to list keys: %v", err)
+		}
+		return
+	}
+
+	if *once {
+		if err := rotator.rotate(); err != nil {
+			log.Fatal("Failed to rotate key: %v", err)
+		}
+		return
+	}
+
+	// Answer health requests on health.key-rotator
+	checks := health.New("key-rotator")
+	checks.Add("nats", health.NATSConnected(natsConn))
+	checks.Add("public keys", health.KeyValue(js, signing.PublicKeysBucket))
+	checks.Add("secrets", health.KeyValue(js, signing.SecretsBucket))
+	if _, err := checks.Respond(natsConn); err != nil {
+		log.Fatal("Failed to answer health requests: %v", err)
+	}
+
+	log.Info("Starting key rotator (interval %s, grace %s)", *interval, *grace)
+
+	group := run.New(log)
+	group.Go("rotator", func(ctx context.Context) error {
+		ticker := time.NewTicker(*check)
+		defer ticker.Stop()
+
+		for {
+			if err := rotator.tick(); err != nil {
+				log.Error("Key maintenance failed: %v", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// tick rotates the active key when it is due and removes keys whose grace period is over
+func (r *Rotator) tick() error {
+	records, err := r.records()
+	if err != nil {
+		return err
+	}
+
+	active, err := r.activeSecret()
+	if err != nil {
+		return err
+	}
+
+	var activeRecord *signing.KeyRecord
+	if active != nil {
+		activeRecord = records[active.ID]
+	}
+	if activeRecord == nil || time.Since(activeRecord.CreatedAt) >= r.interval {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	for id, record := range records {
+		if !record.ValidAt(now) {
+			if err := r.publicKeys.Delete(id); err != nil {
+				return fmt.Errorf("failed to remove expired key %s: %w", id, err)
+			}
+			r.log.Info("Removed key %s, its grace period ended at %s", id, record.NotAfter.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// rotate generates a new key, publishes it and retires the previous one
+func (r *Rotator) rotate() error {
+	records, err := r.records()
+	if err != nil {
+		return err
+	}
+
+	version := 1
+	for _, record := range records {
+		if record.Version >= version {
+			version = record.Version + 1
+		}
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	now := time.Now()
+	record := &signing.KeyRecord{
+		ID:        signing.KeyID(version),
+		Version:   version,
+		PublicKey: publicKey,
+		CreatedAt: now,
+	}
+
+	// Publish the public key before anyone signs with it, so verifiers already know it
+	if _, err := kvstore.PutJSON(r.publicKeys, record.ID, record); err != nil {
+		return err
+	}
+
+	previous, err := r.activeSecret()
+	if err != nil {
+		return err
+	}
+	if _, err := kvstore.PutJSON(r.secrets, signing.ActiveKey, &signing.SecretRecord{ID: record.ID, PrivateKey: privateKey}); err != nil {
+		return err
+	}
+	r.log.Info("Activated signing key %s", record.ID)
+
+	// Messages signed just before the switch are still in flight, keep accepting the old key for a while
+	if previous != nil {
+		if old := records[previous.ID]; old != nil && old.NotAfter.IsZero() {
+			old.RetiredAt = now
+			old.NotAfter = now.Add(r.grace)
+			if _, err := kvstore.PutJSON(r.publicKeys, old.ID, old); err != nil {
+				return err
+			}
+			r.log.Info("Retired signing key %s, valid until %s", old.ID, old.NotAfter.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// list prints the published keys in version order
+func (r *Rotator) list() error {
+	records, err := r.records()
+	if err != nil {
+		return err
+	}
+	active, err := r.activeSecret()
+	if err != nil {
+		return err
+	}
+
+	sorted := make([]*signing.KeyRecord, 0, len(records))
+	for _, record := range records {
+		sorted = append(sorted, record)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	for _, record := range sorted {
+		status := "retired, valid until " + record.NotAfter.Format(time.RFC3339)
+		if record.NotAfter.IsZero() {
+			status = "published"
+			if active != nil && active.ID == record.ID {
+				status = "active"
+			}
+		}
+		fmt.Printf("%-6s created %s  %s\n", record.ID, record.CreatedAt.Format(time.RFC3339), status)
+	}
+	return nil
+}
+
+// records loads all published key records
+func (r *Rotator) records() (map[string]*signing.KeyRecord, error) {
+	records := make(map[string]*signing.KeyRecord)
+
+	keys, err := r.publicKeys.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys: %w", err)
+	}
+
+	for _, key := range keys {
+		entry, err := r.publicKeys.Get(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get key %s: %w", key, err)
+		}
+		var record signing.KeyRecord
+		if err := json.Unmarshal(entry.Value(), &record); err != nil {
+			r.log.Warn("Ignoring malformed key record %s: %v", key, err)
+			continue
+		}
+		records[key] = &record
+	}
+	return records, nil
+}
+
+// activeSecret returns the active private key, or nil before the first rotation
+func (r *Rotator) activeSecret() (*signing.SecretRecord, error) {
+	entry, err := r.secrets.Get(signing.ActiveKey)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active key: %w", err)
+	}
+
+	var secret signing.SecretRecord
+	if err := json.Unmarshal(entry.Value(), &secret); err != nil {
+		return nil, fmt.Errorf("malformed active key: %w", err)
+	}
+	return &secret, nil
+}
@@ -0,0 +1,209 @@
+// Package main implements a CLI for the JetStream key-value buckets used by the examples
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/kvstore"
+	"github.com/nats-io/nats.go"
+)
+
+const usage = `Usage: kv-cli [flags] <command> [args]
+
+Commands:
+  get <key>           Print the current value of a key
+  put <key> [value]   Set a key; the value is read from stdin when omitted
+  delete <key>        Delete a key, keeping its history
+  purge <key>         Delete a key and its history
+  keys                List all keys in the bucket
+  history <key>       Show all stored revisions of a key
+  watch [pattern]     Tail changes to keys matching the pattern (default: all keys)
+
+Buckets used by the examples: tokens (token cache), config (config distribution)
+
+Flags:
+`
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file")
+	bucket := flag.String("bucket", "tokens", "Key-value bucket name")
+	create := flag.Bool("create", false, "Create the bucket if it does not exist")
+	ttl := flag.Duration("ttl", 0, "Expiry for keys when creating the bucket, e.g. 1h (0 means no expiry)")
+	watch := flag.Bool("watch", false, "Tail changes instead of running a command, same as the watch command")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	args := flag.Args()
+	if *watch {
+		args = append([]string{"watch"}, args...)
+	}
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Logs go to stderr so values on stdout can be piped
+	level, _ := logger.ParseLevel(appConfig.LogLevel)
+	log := logger.NewLogger("kv-cli", level, os.Stderr)
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("kv-cli", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	natsConn, err := natsutil.Connect(appConfig.NATS, "kv-cli", log)
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+	defer natsConn.Close()
+
+	js, err := natsConn.JetStream()
+	if err != nil {
+		log.Fatal("Failed to get JetStream context: %v", err)
+	}
+
+	var kv nats.KeyValue
+	if *create {
+		kv, err = kvstore.Open(js, nats.KeyValueConfig{Bucket: *bucket, TTL: *ttl, History: 5})
+	} else {
+		kv, err = js.KeyValue(*bucket)
+	}
+	if err != nil {
+		log.Fatal("Failed to open bucket %s: %v", *bucket, err)
+	}
+
+	switch command := args[0]; command {
+	case "get":
+		requireArgs(args, 2)
+		entry, err := kv.Get(args[1])
+		if err != nil {
+			log.Fatal("Failed to get %s: %v", args[1], err)
+		}
+		fmt.Println(string(entry.Value()))
+
+	case "put":
+		requireArgs(args, 2)
+		var value []byte
+		if len(args) > 2 {
+			value = []byte(args[2])
+		} else if value, err = io.ReadAll(os.Stdin); err != nil {
+			log.Fatal("Failed to read value from stdin: %v", err)
+		}
+		revision, err := kv.Put(args[1], value)
+		if err != nil {
+			log.Fatal("Failed to put %s: %v", args[1], err)
+		}
+		log.Info("Stored %s at revision %d", args[1], revision)
+
+	case "delete":
+		requireArgs(args, 2)
+		if err := kv.Delete(args[1]); err != nil {
+			log.Fatal("Failed to delete %s: %v", args[1], err)
+		}
+		log.Info("Deleted %s", args[1])
+
+	case "purge":
+		requireArgs(args, 2)
+		if err := kv.Purge(args[1]); err != nil {
+			log.Fatal("Failed to purge %s: %v", args[1], err)
+		}
+		log.Info("Purged %s", args[1])
+
+	case "keys":
+		keys, err := kvstore.Keys(kv)
+		if err != nil {
+			log.Fatal("Failed to list keys: %v", err)
+		}
+		for _, key := range keys {
+			fmt.Println(key)
+		}
+
+	case "history":
+		requireArgs(args, 2)
+		entries, err := kv.History(args[1])
+		if err != nil {
+			log.Fatal("Failed to get history of %s: %v", args[1], err)
+		}
+		for _, entry := range entries {
+			printEntry(entry)
+		}
+
+	case "watch":
+		pattern := ">"
+		if len(args) > 1 {
+			pattern = args[1]
+		}
+		watchKeys(kv, pattern, log)
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// requireArgs exits with usage information when too few positional arguments were given
+func requireArgs(args []string, n int) {
+	if len(args) < n {
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// watchKeys prints every change to keys matching the pattern until interrupted
+func watchKeys(kv nats.KeyValue, pattern string, log *logger.Logger) {
+	log.Info("Watching %s in bucket %s. Press Ctrl+C to exit.", pattern, kv.Bucket())
+
+	group := run.New(log)
+	group.Go("watch", func(ctx context.Context) error {
+		return kvstore.Watch(ctx, kv, pattern, func() {
+			log.Info("Initial values received, waiting for changes...")
+		}, printEntry)
+	})
+
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// printEntry writes a single key-value entry on one line
+func printEntry(entry nats.KeyValueEntry) {
+	timestamp := entry.Created().Format(time.RFC3339)
+	switch entry.Operation() {
+	case nats.KeyValueDelete, nats.KeyValuePurge:
+		fmt.Printf("%s [%d] %s %s\n", timestamp, entry.Revision(), entry.Operation(), entry.Key())
+	default:
+		fmt.Printf("%s [%d] %s = %s\n", timestamp, entry.Revision(), entry.Key(), entry.Value())
+	}
+}
@@ -0,0 +1,120 @@
+// Package main implements a standalone fake identity provider for local development
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/health"
+	"github.com/kiquetal/nats-go-examples/internal/idp/idptest"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/secrets"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+)
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file, for telemetry settings (optional)")
+	port := flag.Int("port", 9000, "HTTP server port")
+	realm := flag.String("realm", idptest.DefaultRealm, "Realm name used in endpoint paths")
+	tokenTTL := flag.Int("token-ttl", 3600, "Access token lifetime in seconds")
+	refreshTTL := flag.Int("refresh-token-ttl", 0, "Refresh token lifetime in seconds; 0 for twice -token-ttl")
+	latency := flag.Int("latency", 0, "Artificial latency added to every request in milliseconds")
+	jitter := flag.Int("jitter", 0, "Random extra latency of up to this many milliseconds")
+	failureRate := flag.Float64("failure-rate", 0, "Fraction of token requests to fail, between 0 and 1")
+	failureCode := flag.Int("failure-status", http.StatusInternalServerError, "HTTP status returned for injected failures")
+	clientList := flag.String("clients", "", "Comma-separated id:secret pairs to accept; empty accepts any client")
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	log := logger.DefaultLogger("mock-idp")
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("mock-idp", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	if *failureRate < 0 || *failureRate > 1 {
+		log.Fatal("-failure-rate must be between 0 and 1")
+	}
+
+	// The client list may be kept in a secret manager, e.g. -clients vault://mock-idp#clients
+	clientPairs, err := secrets.New(appConfig.Secrets).Resolve(context.Background(), *clientList)
+	if err != nil {
+		log.Fatal("Failed to resolve -clients: %v", err)
+	}
+	clients, err := parseClients(clientPairs)
+	if err != nil {
+		log.Fatal("Invalid -clients value: %v", err)
+	}
+
+	idp, err := idptest.New(idptest.Config{
+		Realm:           *realm,
+		Issuer:          fmt.Sprintf("http://localhost:%d/realms/%s", *port, *realm),
+		TokenTTL:        time.Duration(*tokenTTL) * time.Second,
+		RefreshTokenTTL: time.Duration(*refreshTTL) * time.Second,
+		Latency:         time.Duration(*latency) * time.Millisecond,
+		Jitter:          time.Duration(*jitter) * time.Millisecond,
+		FailureRate:     *failureRate,
+		FailureStatus:   *failureCode,
+		Clients:         clients,
+		Log:             log,
+	})
+	if err != nil {
+		log.Fatal("Failed to initialize IDP: %v", err)
+	}
+
+	// The realm's endpoints mirror the Keycloak layout used by the token worker
+	mux := http.NewServeMux()
+	mux.Handle("/", idp.Handler())
+	mux.Handle("/healthz", version.Handler())
+	mux.Handle("/readyz", health.New("mock-idp").Handler())
+
+	log.Info("Serving realm %s", *realm)
+	group := run.New(log)
+	group.AddServer("http", &http.Server{Addr: fmt.Sprintf(":%d", *port), Handler: mux})
+
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// parseClients parses comma-separated id:secret pairs
+func parseClients(list string) (map[string]string, error) {
+	clients := make(map[string]string)
+	if list == "" {
+		return clients, nil
+	}
+
+	for _, pair := range strings.Split(list, ",") {
+		id, secret, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found || id == "" {
+			return nil, fmt.Errorf("expected id:secret, got %q", pair)
+		}
+		clients[id] = secret
+	}
+	return clients, nil
+}
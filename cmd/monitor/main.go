@@ -0,0 +1,327 @@
+// Package main implements a terminal dashboard for observing the NATS examples
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+const (
+	connectEvents    = "$SYS.ACCOUNT.*.CONNECT"
+	disconnectEvents = "$SYS.ACCOUNT.*.DISCONNECT"
+	heartbeatTimeout = 30 * time.Second
+)
+
+// clientEvent is the subset of a server connect/disconnect advisory the dashboard uses
+type clientEvent struct {
+	Client struct {
+		ID      uint64 `json:"cid"`
+		Name    string `json:"name"`
+		Host    string `json:"host"`
+		Account string `json:"acc"`
+		Server  string `json:"server"`
+	} `json:"client"`
+}
+
+// Dashboard collects live state from NATS and renders it to the terminal
+type Dashboard struct {
+	mu          sync.Mutex
+	connections map[uint64]clientEvent
+	heartbeats  map[string]*models.Heartbeat
+	counts      map[string]int
+	rates       map[string]float64
+	services    []micro.Stats
+	consumers   []*nats.ConsumerInfo
+	sysEnabled  bool
+	lastRefresh time.Time
+}
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file")
+	subjects := flag.String("subjects", ">", "Comma-separated subjects to measure message rates on")
+	refresh := flag.Int("refresh", 2, "Dashboard refresh interval in seconds")
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Logs go to stderr so they do not interfere with the dashboard
+	log := logger.NewLogger("monitor", logger.WARN, os.Stderr)
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("monitor", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	dashboard := &Dashboard{
+		connections: make(map[uint64]clientEvent),
+		heartbeats:  make(map[string]*models.Heartbeat),
+		counts:      make(map[string]int),
+		rates:       make(map[string]float64),
+		sysEnabled:  true,
+		lastRefresh: time.Now(),
+	}
+
+	// System account access usually requires credentials, which Connect takes from the config
+	natsConn, err := natsutil.Connect(appConfig.NATS, "nats-monitor", log,
+		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
+			// System events are only visible to users of the system account
+			if sub != nil && strings.HasPrefix(sub.Subject, "$SYS.") {
+				dashboard.disableSystemEvents()
+				return
+			}
+			log.Error("NATS error: %v", err)
+		}),
+	)
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+	defer natsConn.Close()
+
+	if _, err := natsConn.Subscribe(connectEvents, dashboard.handleConnect); err != nil {
+		dashboard.disableSystemEvents()
+	}
+	if _, err := natsConn.Subscribe(disconnectEvents, dashboard.handleDisconnect); err != nil {
+		dashboard.disableSystemEvents()
+	}
+
+	if _, err := natsConn.Subscribe(models.HeartbeatSubject, dashboard.handleHeartbeat); err != nil {
+		log.Fatal("Failed to subscribe to heartbeats: %v", err)
+	}
+
+	for _, subject := range strings.Split(*subjects, ",") {
+		if _, err := natsConn.Subscribe(strings.TrimSpace(subject), dashboard.handleTraffic); err != nil {
+			log.Fatal("Failed to subscribe to %s: %v", subject, err)
+		}
+	}
+
+	js, err := natsConn.JetStream()
+	if err != nil {
+		log.Warn("JetStream unavailable, consumer lag will not be shown: %v", err)
+	}
+
+	group := run.New(log)
+	group.Go("dashboard", func(ctx context.Context) error {
+		ticker := time.NewTicker(time.Duration(*refresh) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			dashboard.collect(natsConn, js)
+			dashboard.render(os.Stdout, natsConn.ConnectedUrl())
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// disableSystemEvents marks system account events as unavailable
+func (d *Dashboard) disableSystemEvents() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sysEnabled = false
+}
+
+// handleConnect records a client connection advisory
+func (d *Dashboard) handleConnect(msg *nats.Msg) {
+	var event clientEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.connections[event.Client.ID] = event
+}
+
+// handleDisconnect removes a client on a disconnect advisory
+func (d *Dashboard) handleDisconnect(msg *nats.Msg) {
+	var event clientEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.connections, event.Client.ID)
+}
+
+// handleHeartbeat records the latest heartbeat of a worker
+func (d *Dashboard) handleHeartbeat(msg *nats.Msg) {
+	var heartbeat models.Heartbeat
+	if err := json.Unmarshal(msg.Data, &heartbeat); err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.heartbeats[heartbeat.Worker] = &heartbeat
+}
+
+// handleTraffic counts messages per subject
+func (d *Dashboard) handleTraffic(msg *nats.Msg) {
+	// Inbox replies would flood the table with one-off subjects
+	if strings.HasPrefix(msg.Subject, "_INBOX.") {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.counts[msg.Subject]++
+}
+
+// collect computes message rates and polls service and consumer statistics
+func (d *Dashboard) collect(nc *nats.Conn, js nats.JetStreamContext) {
+	services := fetchServiceStats(nc, 500*time.Millisecond)
+
+	var consumers []*nats.ConsumerInfo
+	if js != nil {
+		for stream := range js.StreamNames() {
+			for info := range js.ConsumersInfo(stream) {
+				consumers = append(consumers, info)
+			}
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	elapsed := time.Since(d.lastRefresh).Seconds()
+	d.lastRefresh = time.Now()
+	d.rates = make(map[string]float64, len(d.counts))
+	if elapsed > 0 {
+		for subject, count := range d.counts {
+			d.rates[subject] = float64(count) / elapsed
+		}
+	}
+	d.counts = make(map[string]int)
+
+	d.services = services
+	d.consumers = consumers
+}
+
+// fetchServiceStats asks every micro service for its stats and gathers replies until the timeout
+func fetchServiceStats(nc *nats.Conn, timeout time.Duration) []micro.Stats {
+	replies, _ := pubsub.Gather(context.Background(), nc, "$SRV.STATS", nil, 0, timeout)
+
+	var stats []micro.Stats
+	for _, msg := range replies {
+		var s micro.Stats
+		if err := json.Unmarshal(msg.Data, &s); err == nil && s.Name != "" {
+			stats = append(stats, s)
+		}
+	}
+	return stats
+}
+
+// render redraws the dashboard
+func (d *Dashboard) render(w io.Writer, url string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Clear the screen and move the cursor home
+	fmt.Fprint(w, "\033[H\033[2J")
+	fmt.Fprintf(w, "NATS monitor - %s - %s\n\n", url, time.Now().Format("15:04:05"))
+
+	fmt.Fprintln(w, "Connections")
+	if !d.sysEnabled {
+		fmt.Fprintln(w, "  (system account events unavailable, connect with system account credentials)")
+	} else if len(d.connections) == 0 {
+		fmt.Fprintln(w, "  (no connection events seen yet, events require system account credentials)")
+	}
+	for _, event := range d.connections {
+		fmt.Fprintf(w, "  %-6d %-30s %-15s %s\n", event.Client.ID, event.Client.Name, event.Client.Host, event.Client.Account)
+	}
+
+	fmt.Fprintln(w, "\nWorkers")
+	if len(d.heartbeats) == 0 {
+		fmt.Fprintln(w, "  (no heartbeats received)")
+	}
+	for _, name := range sortedKeys(d.heartbeats) {
+		heartbeat := d.heartbeats[name]
+		status := "alive"
+		if time.Since(heartbeat.Timestamp) > heartbeatTimeout {
+			status = "stale"
+		}
+		fmt.Fprintf(w, "  %-30s %-15s %-6s processed=%d up=%s\n", heartbeat.Worker, heartbeat.Queue, status,
+			heartbeat.Processed, time.Since(heartbeat.StartedAt).Round(time.Second))
+	}
+
+	fmt.Fprintln(w, "\nServices")
+	if len(d.services) == 0 {
+		fmt.Fprintln(w, "  (no micro services responded)")
+	}
+	for _, service := range d.services {
+		for _, endpoint := range service.Endpoints {
+			fmt.Fprintf(w, "  %-20s %-10s %-20s requests=%d errors=%d avg=%s\n", service.Name, service.ID,
+				endpoint.Subject, endpoint.NumRequests, endpoint.NumErrors, endpoint.AverageProcessingTime)
+		}
+	}
+
+	fmt.Fprintln(w, "\nConsumers")
+	if len(d.consumers) == 0 {
+		fmt.Fprintln(w, "  (no JetStream consumers)")
+	}
+	for _, info := range d.consumers {
+		fmt.Fprintf(w, "  %-20s %-20s pending=%d ack_pending=%d redelivered=%d\n", info.Stream, info.Name,
+			info.NumPending, info.NumAckPending, info.NumRedelivered)
+	}
+
+	fmt.Fprintln(w, "\nSubjects (msgs/sec)")
+	if len(d.rates) == 0 {
+		fmt.Fprintln(w, "  (no traffic)")
+	}
+	for _, subject := range sortedKeys(d.rates) {
+		fmt.Fprintf(w, "  %-40s %8.1f\n", subject, d.rates[subject])
+	}
+}
+
+// sortedKeys returns the map keys in sorted order for stable rendering
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,339 @@
+// Package main ingests MQTT sensor data through the NATS MQTT port and republishes it to JetStream
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/health"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+// placeholderPattern matches {name} placeholders in the topic layout and subject template
+var placeholderPattern = regexp.MustCompile(`\{([a-zA-Z0-9_]+)\}`)
+
+// reading is a normalized sensor value
+type reading struct {
+	value     float64
+	unit      string
+	timestamp time.Time
+}
+
+// Ingester normalizes MQTT messages and stores them in the telemetry stream
+type Ingester struct {
+	natsConn   *nats.Conn
+	js         nats.JetStreamContext
+	layout     []string // topic levels, "{name}" for levels that are captured
+	subject    string
+	deadLetter string
+	log        *logger.Logger
+	ingested   atomic.Int64
+	rejected   atomic.Int64
+}
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file")
+	topic := flag.String("topic", "sensors/+/+", "MQTT topic filter to ingest")
+	layout := flag.String("layout", "sensors/{device}/{metric}", "Names for the topic levels, used in -subject and metadata")
+	subject := flag.String("subject", "telemetry.{device}.{metric}", "Subject template for normalized messages")
+	stream := flag.String("stream", "TELEMETRY", "Stream that retains normalized messages")
+	retention := flag.Duration("retention", 72*time.Hour, "How long the stream keeps telemetry when it is created")
+	queue := flag.String("queue", "mqtt-ingest", "Queue group, so several instances share the load")
+	deadLetter := flag.String("dead-letter", "mqtt.dlq.invalid", "Subject for payloads that cannot be normalized (empty to drop them)")
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Create logger
+	log := logger.DefaultLogger("mqtt-ingest")
+	log.Info("Starting MQTT ingestion")
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("mqtt-ingest", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	natsConn, err := natsutil.Connect(appConfig.NATS, "mqtt-ingest", log)
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+	log.Info("Connected to NATS at %s", appConfig.NATS.URL)
+
+	js, err := natsConn.JetStream()
+	if err != nil {
+		log.Fatal("Failed to get JetStream context: %v", err)
+	}
+
+	streamSubject := placeholderPattern.ReplaceAllString(*subject, "*")
+	if err := ensureStream(js, *stream, streamSubject, *retention, log); err != nil {
+		log.Fatal("%v", err)
+	}
+
+	ingester := &Ingester{
+		natsConn:   natsConn,
+		js:         js,
+		layout:     strings.Split(*layout, "/"),
+		subject:    *subject,
+		deadLetter: *deadLetter,
+		log:        log,
+	}
+
+	// The NATS server maps MQTT topics to subjects, so MQTT traffic is consumed with a plain subscription
+	filter := topicToSubject(*topic)
+	sub, err := natsConn.QueueSubscribe(filter, *queue, ingester.handle)
+	if err != nil {
+		log.Fatal("Failed to subscribe to %s: %v", filter, err)
+	}
+
+	// Answer health requests on health.mqtt-ingest
+	checks := health.New("mqtt-ingest")
+	checks.Add("nats", health.NATSConnected(natsConn))
+	checks.Add("subscription", health.SubscriptionValid(sub))
+	if _, err := checks.Respond(natsConn); err != nil {
+		log.Fatal("Failed to answer health requests: %v", err)
+	}
+
+	log.Info("Ingesting MQTT topic %s (subject %s) into %s as %s. Press Ctrl+C to exit.", *topic, filter, *stream, *subject)
+
+	// Draining finishes storing the readings that were already received
+	group := run.New(log)
+	group.AddConn("nats", natsConn)
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+	log.Info("Ingested %d readings, rejected %d", ingester.ingested.Load(), ingester.rejected.Load())
+}
+
+// ensureStream creates the telemetry stream on first use
+func ensureStream(js nats.JetStreamContext, name, subject string, retention time.Duration, log *logger.Logger) error {
+	_, err := js.StreamInfo(name)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		return fmt.Errorf("failed to look up stream %s: %w", name, err)
+	}
+
+	if _, err := js.AddStream(&nats.StreamConfig{
+		Name:        name,
+		Description: "Normalized sensor readings ingested from MQTT",
+		Subjects:    []string{subject},
+		Storage:     nats.FileStorage,
+		MaxAge:      retention,
+	}); err != nil {
+		return fmt.Errorf("failed to create stream %s: %w", name, err)
+	}
+	log.Info("Created stream %s for %s with %s retention", name, subject, retention)
+	return nil
+}
+
+// handle normalizes one MQTT message and stores it
+func (i *Ingester) handle(msg *nats.Msg) {
+	topic := subjectToTopic(msg.Subject)
+
+	fields, err := i.match(topic)
+	if err == nil {
+		var r *reading
+		if r, err = parseReading(msg.Data); err == nil {
+			err = i.store(topic, fields, r)
+		}
+	}
+
+	if err != nil {
+		i.rejected.Add(1)
+		i.log.Warn("Rejected message on %s: %v", topic, err)
+		i.reject(msg, topic, err)
+		return
+	}
+	i.ingested.Add(1)
+}
+
+// match extracts the named topic levels
+func (i *Ingester) match(topic string) (map[string]string, error) {
+	levels := strings.Split(topic, "/")
+	if len(levels) != len(i.layout) {
+		return nil, fmt.Errorf("topic does not match layout %s", strings.Join(i.layout, "/"))
+	}
+
+	fields := make(map[string]string)
+	for n, level := range levels {
+		name := i.layout[n]
+		if match := placeholderPattern.FindStringSubmatch(name); match != nil && match[0] == name {
+			if level == "" || strings.ContainsAny(level, ".*> ") {
+				return nil, fmt.Errorf("topic level %q cannot be used as a subject token", level)
+			}
+			fields[match[1]] = level
+		}
+	}
+	return fields, nil
+}
+
+// store publishes the normalized reading to the stream
+func (i *Ingester) store(topic string, fields map[string]string, r *reading) error {
+	var missing string
+	subject := placeholderPattern.ReplaceAllStringFunc(i.subject, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value, ok := fields[name]
+		if !ok {
+			missing = name
+		}
+		return value
+	})
+	if missing != "" {
+		return fmt.Errorf("subject template uses {%s}, which is not in the topic layout", missing)
+	}
+
+	msg := models.NewMessage(subject, strconv.FormatFloat(r.value, 'f', -1, 64))
+	msg.Timestamp = r.timestamp
+	msg.AddMetadata("source", "mqtt")
+	msg.AddMetadata("mqtt_topic", topic)
+	for name, value := range fields {
+		msg.AddMetadata(name, value)
+	}
+	if r.unit != "" {
+		msg.AddMetadata("unit", r.unit)
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	// Waiting for the stream's ack means a reading is only counted once it is retained
+	if _, err := i.js.Publish(subject, data, nats.MsgId(msg.ID)); err != nil {
+		return fmt.Errorf("failed to store reading: %w", err)
+	}
+	i.log.Debug("Stored %s = %s %s", subject, msg.Body, r.unit)
+	return nil
+}
+
+// reject sends a payload that cannot be ingested to the dead-letter subject
+func (i *Ingester) reject(msg *nats.Msg, topic string, cause error) {
+	if i.deadLetter == "" {
+		return
+	}
+
+	letter := nats.NewMsg(i.deadLetter)
+	letter.Data = msg.Data
+	letter.Header.Set(models.DeadLetterOriginalSubject, msg.Subject)
+	letter.Header.Set(models.DeadLetterError, cause.Error())
+	letter.Header.Set(models.DeadLetterAttempts, "1")
+	letter.Header.Set(models.DeadLetterSource, "mqtt-ingest")
+	letter.Header.Set("Mqtt-Topic", topic)
+	if err := i.natsConn.PublishMsg(letter); err != nil {
+		i.log.Error("Failed to dead-letter message from %s: %v", topic, err)
+	}
+}
+
+// parseReading accepts a bare number or a JSON object such as
+// {"value": 21.5, "unit": "C", "ts": "2024-01-01T12:00:00Z"} (ts may also be unix seconds or milliseconds)
+func parseReading(data []byte) (*reading, error) {
+	text := strings.TrimSpace(string(data))
+	if value, err := strconv.ParseFloat(text, 64); err == nil {
+		return &reading{value: value, timestamp: time.Now()}, nil
+	}
+
+	var payload struct {
+		Value     json.Number `json:"value"`
+		Unit      string      `json:"unit"`
+		TS        interface{} `json:"ts"`
+		Timestamp interface{} `json:"timestamp"`
+	}
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, errors.New("payload is neither a number nor a JSON object")
+	}
+
+	value, err := strconv.ParseFloat(payload.Value.String(), 64)
+	if err != nil {
+		return nil, errors.New("payload has no numeric value field")
+	}
+
+	r := &reading{value: value, unit: payload.Unit, timestamp: time.Now()}
+	ts := payload.TS
+	if ts == nil {
+		ts = payload.Timestamp
+	}
+	if ts != nil {
+		if r.timestamp, err = parseTimestamp(ts); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// parseTimestamp accepts RFC 3339 strings and unix timestamps in seconds or milliseconds
+func parseTimestamp(ts interface{}) (time.Time, error) {
+	switch v := ts.(type) {
+	case string:
+		return time.Parse(time.RFC3339, v)
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %s", v)
+		}
+		// Seconds would put millisecond timestamps thousands of years in the future
+		if n > 1e11 {
+			return time.UnixMilli(n), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %v", ts)
+}
+
+// topicToSubject converts an MQTT topic filter to the NATS subject the server maps it to:
+// levels become tokens, dots are escaped as "//", and + and # become * and >
+func topicToSubject(topic string) string {
+	var b strings.Builder
+	for _, r := range topic {
+		switch r {
+		case '/':
+			b.WriteByte('.')
+		case '.':
+			b.WriteString("//")
+		case '+':
+			b.WriteByte('*')
+		case '#':
+			b.WriteByte('>')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// subjectToTopic reverses the server's topic to subject mapping for a concrete subject
+func subjectToTopic(subject string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(strings.ReplaceAll(subject, "//", "\x00"), ".", "/"), "\x00", ".")
+}
@@ -0,0 +1,214 @@
+// Package main implements a command-line tool for ad-hoc NATS request/reply
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/cli"
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const defaultSubject = "token.request"
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file")
+	subject := flag.String("subject", defaultSubject, "Subject to send the request to")
+	data := flag.String("data", "", "JSON request body; read from stdin when set to '-', or from a file as @path")
+	clientID := flag.String("client-id", "", "Build a token request for this client ID when no -data is given")
+	clientSecret := flag.String("client-secret", "", "Client secret used with -client-id")
+	timeout := flag.Int("timeout", 5000, "Time to wait for replies in milliseconds")
+	retries := flag.Int("retries", 0, "Number of times to retry when no reply arrives")
+	replies := flag.Int("replies", 1, "Number of replies to collect; 0 collects all replies until the timeout")
+	count := flag.Int("count", 1, "Number of requests to send one after the other, each with a new request ID")
+	var headers cli.KeyValueFlag
+	flag.Var(&headers, "H", "NATS header to send as key=value (repeatable)")
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Logs go to stderr so replies on stdout can be piped
+	level, _ := logger.ParseLevel(appConfig.LogLevel)
+	log := logger.NewLogger("nats-req", level, os.Stderr)
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("nats-req", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	body, err := requestBody(*data, *clientID, *clientSecret)
+	if err != nil {
+		log.Fatal("Failed to build request body: %v", err)
+	}
+
+	// Connect to NATS
+	natsConn, err := natsutil.Connect(appConfig.NATS, "nats-req", log)
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+	defer natsConn.Close()
+
+	// Sign and encrypt the requests like brain-app does, for workers that require it
+	signer, err := appConfig.Credentials.Signer()
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+	encrypter, err := natsutil.NewEncrypter(appConfig.NATS.Encryption)
+	if err != nil {
+		log.Fatal("Invalid nats.encryption: %v", err)
+	}
+	publisher := pubsub.NewPublisherFromConn(natsConn)
+	publisher.SetSigner(sealer{kp: signer, encrypter: encrypter})
+
+	// Send the requests one after the other, each with its own request ID
+	var answered int
+	var total time.Duration
+	for n := 1; n <= *count; n++ {
+		// Requests carry a new request ID and nats-req's name, which -H can replace
+		msg := pubsub.NewRequestMsg(natsConn, *subject, models.NewRequestID(), body)
+		for key, values := range headers.Values() {
+			msg.Header[key] = values
+		}
+
+		start := time.Now()
+		received := request(log, publisher, msg, *replies, time.Duration(*timeout)*time.Millisecond, *retries)
+		elapsed := time.Since(start)
+		if *count > 1 {
+			fmt.Printf("# request %d/%d %s: %d replies in %s\n", n, *count, pubsub.RequestID(msg), len(received), elapsed.Round(time.Microsecond))
+		}
+		if len(received) == 0 {
+			log.Error("No reply received on %s after %d attempt(s)", *subject, *retries+1)
+			continue
+		}
+		answered++
+		total += elapsed
+
+		for i, reply := range received {
+			if encrypter != nil {
+				if _, err := encrypter.Decrypt(reply); err != nil {
+					log.Error("Failed to decrypt reply: %v", err)
+				}
+			}
+			if len(received) > 1 {
+				fmt.Printf("# reply %d/%d\n", i+1, len(received))
+			}
+			for key, values := range reply.Header {
+				fmt.Printf("# %s: %v\n", key, values)
+			}
+			fmt.Println(formatPayload(reply.Data))
+		}
+	}
+
+	if *count > 1 && answered > 0 {
+		log.Info("%d of %d requests answered, %s on average", answered, *count, (total / time.Duration(answered)).Round(time.Microsecond))
+	}
+	if answered < *count {
+		os.Exit(1)
+	}
+}
+
+// request sends msg and gathers up to replies replies within the timeout, retrying while
+// nothing answers
+func request(log *logger.Logger, publisher *pubsub.NATSPublisher, msg *nats.Msg, replies int, timeout time.Duration, retries int) []*nats.Msg {
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			log.Warn("No reply received, retrying (%d/%d)", attempt, retries)
+		}
+
+		// Each attempt has its own reply inbox and deadline, so it is signed and sealed anew
+		attemptMsg := &nats.Msg{Data: msg.Data, Header: nats.Header{}}
+		for key, values := range msg.Header {
+			attemptMsg.Header[key] = values
+		}
+		received, err := publisher.Gather(context.Background(), msg.Subject, attemptMsg, replies, timeout)
+		if errors.Is(err, nats.ErrNoResponders) {
+			log.Warn("No responders are subscribed to %s", msg.Subject)
+			continue
+		}
+		if err != nil {
+			log.Fatal("Request failed: %v", err)
+		}
+		if len(received) > 0 {
+			return received
+		}
+	}
+	return nil
+}
+
+// sealer signs requests once Gather has set their reply inbox and deadline, and then encrypts
+// them, with the signing key and the encrypter if configured
+type sealer struct {
+	kp        nkeys.KeyPair
+	encrypter *pubsub.Encrypter
+}
+
+// Sign implements pubsub.MessageSigner
+func (s sealer) Sign(msg *nats.Msg) error {
+	if s.kp != nil {
+		if err := pubsub.Sign(msg, s.kp); err != nil {
+			return err
+		}
+	}
+	if s.encrypter != nil {
+		if err := s.encrypter.Encrypt(msg); err != nil {
+			return fmt.Errorf("failed to encrypt the request: %w", err)
+		}
+	}
+	return nil
+}
+
+// requestBody returns the request payload from the -data flag, stdin, or token request flags
+func requestBody(data, clientID, clientSecret string) ([]byte, error) {
+	switch {
+	case data == "-":
+		return io.ReadAll(os.Stdin)
+	case strings.HasPrefix(data, "@"):
+		return os.ReadFile(data[1:])
+	case data != "":
+		return []byte(data), nil
+	case clientID != "":
+		return json.Marshal(models.NewTokenRequest(clientID, clientSecret))
+	default:
+		return nil, errors.New("provide -data, -data - for stdin, -data @file, or -client-id")
+	}
+}
+
+// formatPayload pretty-prints JSON payloads and returns anything else unchanged
+func formatPayload(data []byte) string {
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return string(data)
+	}
+	return out.String()
+}
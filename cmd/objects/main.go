@@ -0,0 +1,252 @@
+// Package main implements a CLI that moves files through JetStream object stores, the way to
+// hand over payloads too large for a NATS message
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/objectstore"
+	"github.com/nats-io/nats.go"
+)
+
+const usage = `Usage: objects [flags] <command> [args]
+
+Commands:
+  put <file> [name]   Upload a file, named after it unless a name is given; - reads stdin and needs a name
+  get <name> [file]   Download an object to a file, named after it unless given; - writes to stdout
+  ls                  List the objects in the bucket
+  info <name>         Show the size, chunks, digest and headers of an object
+  rm <name>           Delete an object
+
+Flags:
+`
+
+// progressInterval is the longest a transfer goes without a progress line
+const progressInterval = time.Second
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file")
+	bucket := flag.String("bucket", "files", "Object store bucket name")
+	create := flag.Bool("create", false, "Create the bucket if it does not exist")
+	ttl := flag.Duration("ttl", 0, "Expiry for objects when creating the bucket, e.g. 24h (0 means no expiry)")
+	chunkSize := flag.Int("chunk-size", 128*1024, "Size of the chunks uploaded objects are split into, in bytes; keep it below the server's max_payload")
+	description := flag.String("description", "", "Description stored with an uploaded object")
+	quiet := flag.Bool("quiet", false, "Do not report the progress of transfers")
+	timeout := flag.Duration("timeout", 10*time.Minute, "Longest a command may take")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Logs go to stderr so objects written to stdout can be piped
+	level, _ := logger.ParseLevel(appConfig.LogLevel)
+	log := logger.NewLogger("objects", level, os.Stderr)
+
+	if *chunkSize <= 0 {
+		log.Fatal("Chunk size must be greater than zero")
+	}
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("objects", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	natsConn, err := natsutil.Connect(appConfig.NATS, "objects", log)
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+	defer natsConn.Close()
+
+	js, err := natsConn.JetStream()
+	if err != nil {
+		log.Fatal("Failed to get JetStream context: %v", err)
+	}
+
+	var obs nats.ObjectStore
+	if *create {
+		obs, err = objectstore.Open(js, nats.ObjectStoreConfig{Bucket: *bucket, TTL: *ttl, Description: "Files uploaded with objects"})
+	} else {
+		obs, err = js.ObjectStore(*bucket)
+	}
+	if err != nil {
+		log.Fatal("Failed to open object store %s: %v", *bucket, err)
+	}
+
+	var progress func(verb, name string) objectstore.Progress
+	if *quiet {
+		progress = func(string, string) objectstore.Progress { return nil }
+	} else {
+		progress = func(verb, name string) objectstore.Progress { return progressLogger(log, verb, name) }
+	}
+
+	// Transfers run until they finish, time out or the process is interrupted
+	group := run.New(log)
+	group.Go(args[0], func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, *timeout)
+		defer cancel()
+
+		switch command := args[0]; command {
+		case "put":
+			requireArgs(args, 2)
+			path, name := args[1], filepath.Base(args[1])
+			if len(args) > 2 {
+				name = args[2]
+			} else if path == "-" {
+				flag.Usage()
+				os.Exit(2)
+			}
+			var info *nats.ObjectInfo
+			var err error
+			opts := objectstore.Options{Description: *description, ChunkSize: uint32(*chunkSize), Progress: progress("Uploaded", name)}
+			if path == "-" {
+				info, err = objectstore.Upload(ctx, obs, name, os.Stdin, 0, opts)
+			} else {
+				info, err = objectstore.UploadFile(ctx, obs, name, path, opts)
+			}
+			if err != nil {
+				return err
+			}
+			log.Info("Stored %s in %s: %d bytes in %d chunks", info.Name, info.Bucket, info.Size, info.Chunks)
+
+		case "get":
+			requireArgs(args, 2)
+			name, path := args[1], filepath.Base(args[1])
+			if len(args) > 2 {
+				path = args[2]
+			}
+			var info *nats.ObjectInfo
+			var err error
+			if path == "-" {
+				info, err = objectstore.Download(ctx, obs, name, os.Stdout, progress("Downloaded", name))
+			} else {
+				info, err = objectstore.DownloadFile(ctx, obs, name, path, progress("Downloaded", name))
+			}
+			if err != nil {
+				return err
+			}
+			if path != "-" {
+				log.Info("Wrote %s to %s: %d bytes, digest verified", info.Name, path, info.Size)
+			}
+
+		case "ls":
+			objects, err := obs.List(nats.Context(ctx))
+			if errors.Is(err, nats.ErrNoObjectsFound) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to list objects: %w", err)
+			}
+			for _, info := range objects {
+				fmt.Printf("%s\t%d\t%s\n", info.Name, info.Size, info.ModTime.Format(time.RFC3339))
+			}
+
+		case "info":
+			requireArgs(args, 2)
+			info, err := obs.GetInfo(args[1], nats.Context(ctx))
+			if err != nil {
+				return fmt.Errorf("failed to get %s: %w", args[1], err)
+			}
+			printInfo(info)
+
+		case "rm":
+			requireArgs(args, 2)
+			if err := obs.Delete(args[1]); err != nil {
+				return fmt.Errorf("failed to delete %s: %w", args[1], err)
+			}
+			log.Info("Deleted %s", args[1])
+
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+			flag.Usage()
+			os.Exit(2)
+		}
+		return nil
+	})
+
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// requireArgs exits with usage information when too few positional arguments were given
+func requireArgs(args []string, n int) {
+	if len(args) < n {
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// progressLogger logs how far a transfer got at most once per progressInterval, and when it
+// completes
+func progressLogger(log *logger.Logger, verb, name string) objectstore.Progress {
+	var last time.Time
+	return func(done, total int64) {
+		if done != total && time.Since(last) < progressInterval {
+			return
+		}
+		last = time.Now()
+		if total > 0 {
+			log.Info("%s %d of %d bytes of %s (%.0f%%)", verb, done, total, name, float64(done)*100/float64(total))
+			return
+		}
+		log.Info("%s %d bytes of %s", verb, done, name)
+	}
+}
+
+// printInfo writes the metadata of an object
+func printInfo(info *nats.ObjectInfo) {
+	w := os.Stdout
+	fmt.Fprintf(w, "Name:        %s\n", info.Name)
+	if info.Description != "" {
+		fmt.Fprintf(w, "Description: %s\n", info.Description)
+	}
+	fmt.Fprintf(w, "Bucket:      %s\n", info.Bucket)
+	fmt.Fprintf(w, "Size:        %d bytes\n", info.Size)
+	fmt.Fprintf(w, "Chunks:      %d\n", info.Chunks)
+	if info.Opts != nil && info.Opts.ChunkSize > 0 {
+		fmt.Fprintf(w, "Chunk size:  %d bytes\n", info.Opts.ChunkSize)
+	}
+	fmt.Fprintf(w, "Digest:      %s\n", info.Digest)
+	fmt.Fprintf(w, "Modified:    %s\n", info.ModTime.Format(time.RFC3339))
+	for key, values := range info.Headers {
+		for _, value := range values {
+			fmt.Fprintf(w, "Header:      %s: %s\n", key, value)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+)
+
+// maxBodyLine bounds the length of a body read from a file or stdin
+const maxBodyLine = 1 << 20
+
+// defaultBodyTemplate is the body of generated messages without -template or -body-file
+const defaultBodyTemplate = "Message #{{.Count}}"
+
+// bodyData is what body templates can refer to
+type bodyData struct {
+	Count       int    // number of the message, from 1
+	ID          string // message ID
+	Subject     string
+	Timestamp   string // time of publishing, RFC 3339
+	Unix        int64  // time of publishing, seconds since the epoch
+	UnixMilli   int64
+	Environment string
+}
+
+// bodySource produces the bodies of the messages to publish. It returns io.EOF once there
+// are no more.
+type bodySource interface {
+	next(ctx context.Context, count int, msg *models.Message) (string, error)
+}
+
+// newBodySource returns the lines of path, or of stdin for "-", when path is set, and the
+// template text executed for each message otherwise
+func newBodySource(path, text, environment string) (bodySource, error) {
+	if path != "" {
+		if text != "" {
+			return nil, fmt.Errorf("-template and -body-file cannot be combined")
+		}
+		in := os.Stdin
+		if path != "-" {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open body file: %w", err)
+			}
+			in = f
+		}
+		return newLineBodies(in), nil
+	}
+	if text == "" {
+		text = defaultBodyTemplate
+	}
+	tmpl, err := template.New("body").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body template: %w", err)
+	}
+	// Catch references to unknown fields before publishing anything
+	bodies := &templateBodies{tmpl: tmpl, environment: environment}
+	if _, err := bodies.next(context.Background(), 1, models.NewMessage("", "")); err != nil {
+		return nil, err
+	}
+	return bodies, nil
+}
+
+// templateBodies executes a template for each message
+type templateBodies struct {
+	tmpl        *template.Template
+	environment string
+}
+
+func (t *templateBodies) next(_ context.Context, count int, msg *models.Message) (string, error) {
+	var body strings.Builder
+	err := t.tmpl.Execute(&body, bodyData{
+		Count:       count,
+		ID:          msg.ID,
+		Subject:     msg.Subject,
+		Timestamp:   msg.Timestamp.Format(time.RFC3339),
+		Unix:        msg.Timestamp.Unix(),
+		UnixMilli:   msg.Timestamp.UnixMilli(),
+		Environment: t.environment,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to execute body template: %w", err)
+	}
+	return body.String(), nil
+}
+
+// lineBodies returns one body per non-empty line of a reader, e.g. one JSON document per
+// line. The lines are read in the background, so waiting on stdin does not hold up shutdown.
+type lineBodies struct {
+	lines chan string
+	err   error // set before lines is closed
+}
+
+func newLineBodies(in io.ReadCloser) *lineBodies {
+	l := &lineBodies{lines: make(chan string)}
+	go func() {
+		defer close(l.lines)
+		defer in.Close()
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 64*1024), maxBodyLine)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				l.lines <- line
+			}
+		}
+		l.err = scanner.Err()
+	}()
+	return l
+}
+
+func (l *lineBodies) next(ctx context.Context, _ int, _ *models.Message) (string, error) {
+	select {
+	case line, ok := <-l.lines:
+		if !ok {
+			if l.err != nil {
+				return "", fmt.Errorf("failed to read bodies: %w", l.err)
+			}
+			return "", io.EOF
+		}
+		return line, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
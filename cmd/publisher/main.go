@@ -2,25 +2,52 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"os/signal"
-	"syscall"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/kiquetal/nats-go-examples/internal/cli"
 	"github.com/kiquetal/nats-go-examples/internal/config"
 	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
 	"github.com/kiquetal/nats-go-examples/pkg/models"
 	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+	"github.com/kiquetal/nats-go-examples/pkg/signing"
+	"github.com/nats-io/nats.go"
 )
 
 func main() {
 	// Parse command-line flags
 	configPath := flag.String("config", "", "Path to config file")
 	subject := flag.String("subject", "messages", "Subject to publish to")
-	interval := flag.Int("interval", 1000, "Publish interval in milliseconds")
+	interval := flag.Int("interval", 1000, "Publish interval in milliseconds, 0 publishes as fast as possible")
+	confirm := flag.Bool("confirm", false, "Publish as requests and report which messages received a reply")
+	confirmTimeout := flag.Int("confirm-timeout", 2000, "Time to wait for a reply in confirm mode in milliseconds")
+	var headers, metadata cli.KeyValueFlag
+	flag.Var(&headers, "H", "NATS header to set on each message as key=value (repeatable)")
+	flag.Var(&metadata, "M", "Metadata entry to add to each message as key=value (repeatable)")
+	replayPath := flag.String("replay", "", "Replay messages from a recording file instead of generating them (optional)")
+	speed := flag.Float64("speed", 1.0, "Replay speed multiplier, e.g. 2 replays twice as fast")
+	sign := flag.Bool("sign", false, "Sign messages with the active key managed by key-rotator")
+	useJetStream := flag.Bool("jetstream", false, "Publish through JetStream and wait for the stream to acknowledge each message")
+	stream := flag.String("stream", "MESSAGES", "Stream to create for the subject in JetStream mode if it does not exist")
+	async := flag.Bool("async", false, "In JetStream mode, publish without waiting and collect the acks on shutdown")
+	batchSize := flag.Int("batch", 0, "Buffer messages and publish them in batches of this size, 0 publishes each message on its own")
+	batchInterval := flag.Int("batch-interval", 10, "In batch mode, the longest a message waits in the buffer in milliseconds")
+	bodyTemplate := flag.String("template", "", "Go template of the message body, e.g. '{\"n\":{{.Count}},\"at\":\"{{.Timestamp}}\"}' (default \""+defaultBodyTemplate+"\")")
+	bodyFile := flag.String("body-file", "", "Publish the lines of this file as message bodies, one per message, or of stdin for -")
+	maxCount := flag.Int("count", 0, "Stop after publishing this many messages, 0 publishes until interrupted")
+	version.RegisterFlag(flag.CommandLine)
 	flag.Parse()
 
 	// Load configuration
@@ -29,55 +56,342 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Create a logger
-	log := logger.DefaultLogger("publisher")
+	// Create a logger with the level and format from the config
+	log, err := logger.FromConfig("publisher", appConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
 	log.Info("Starting NATS publisher")
 
-	// Create a new publisher using the configuration
-	publisher, err := pubsub.NewPublisher(appConfig.NATS.URL)
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("publisher", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	// Create a new publisher using the configuration, waiting for NATS to come up
+	natsConn, err := natsutil.Connect(appConfig.NATS, "publisher", log, nats.Timeout(10*time.Second))
 	if err != nil {
 		log.Fatal("Failed to connect to NATS: %v", err)
 	}
-	defer publisher.Close()
+	publisher := pubsub.NewPublisherFromConn(natsConn)
+
+	log.Info("Connected to NATS at %s", natsConn.ConnectedUrl())
+
+	var jsPublisher *pubsub.JetStreamPublisher
+	var batcher *pubsub.BatchPublisher
+	var unacked []string
+	var failed atomic.Int64
+	group := run.New(log)
+	group.OnStop("publisher", func(ctx context.Context) error {
+		// Publish what is still buffered in batch mode
+		if batcher != nil {
+			if err := batcher.Close(); err != nil {
+				log.Warn("Final batch incomplete: %v", err)
+			}
+		}
+		// Collect outstanding async acks before the connection goes away
+		if jsPublisher != nil {
+			for _, result := range jsPublisher.WaitForAcks(ctx) {
+				if result.Err != nil {
+					unacked = append(unacked, result.ID)
+				}
+			}
+		}
+		publisher.Close()
+		return nil
+	})
+
+	// Sign with the key distributed by key-rotator, following rotations while running
+	if *sign {
+		js, err := publisher.Conn().JetStream()
+		if err != nil {
+			log.Fatal("Failed to get JetStream context: %v", err)
+		}
+		signer, err := signing.NewSigner(js)
+		if err != nil {
+			log.Fatal("Failed to load signing key: %v", err)
+		}
+		group.OnStop("signer", func(ctx context.Context) error {
+			signer.Stop()
+			return nil
+		})
+		publisher.SetSigner(signer)
+		log.Info("Signing messages with key %s", signer.KeyID())
+	}
+
+	// Compress payloads as nats.compression says, after signing and before encrypting them
+	compressor, err := natsutil.NewCompressor(appConfig.NATS.Compression)
+	if err != nil {
+		log.Fatal("Invalid nats.compression: %v", err)
+	}
+	if compressor != nil {
+		publisher.SetCompressor(compressor)
+		log.Info("Compressing messages with %s", compressor.Encoding())
+	}
+
+	// Encrypt payloads with the keys of nats.encryption, after signing them
+	encrypter, err := natsutil.NewEncrypter(appConfig.NATS.Encryption)
+	if err != nil {
+		log.Fatal("Invalid nats.encryption: %v", err)
+	}
+	if encrypter != nil {
+		publisher.SetEncrypter(encrypter)
+		log.Info("Encrypting messages with key %s", encrypter.KeyID())
+	}
+
+	// Store messages in a stream so they survive until a subscriber reads them
+	var out pubsub.Publisher = publisher
+	if *useJetStream {
+		jsPublisher, err = pubsub.NewJetStreamPublisher(publisher, pubsub.JetStreamOptions{
+			Stream:     *stream,
+			Subjects:   []string{*subject},
+			Storage:    nats.FileStorage,
+			MaxPending: 256,
+		})
+		if err != nil {
+			log.Fatal("Failed to set up JetStream publishing: %v", err)
+		}
+		out = jsPublisher
+		log.Info("Publishing through JetStream stream %s", *stream)
+	}
+
+	if *replayPath != "" {
+		if *speed <= 0 {
+			log.Fatal("Replay speed must be greater than zero")
+		}
+		group.Go("replay", func(ctx context.Context) error {
+			return replay(ctx, out, *replayPath, *speed, log)
+		})
+		if err := group.Run(); err != nil {
+			log.Fatal("%v", err)
+		}
+		return
+	}
 
-	log.Info("Connected to NATS at %s", appConfig.NATS.URL)
 	log.Info("Publishing to subject: %s", *subject)
 	log.Info("Publishing interval: %d ms", *interval)
+	if headers.Len() > 0 {
+		log.Info("Message headers: %s", headers.String())
+	}
+	if *confirm && *useJetStream {
+		log.Fatal("Confirm mode and JetStream mode cannot be combined, JetStream acks already confirm storage")
+	}
+	if *async && !*useJetStream {
+		log.Fatal("Async mode requires -jetstream")
+	}
+	if *interval < 0 {
+		log.Fatal("Publish interval cannot be negative")
+	}
+	if *batchSize > 0 && (*confirm || *useJetStream) {
+		log.Fatal("Batch mode cannot be combined with confirm or JetStream mode")
+	}
+	if *batchSize > 0 {
+		batcher = pubsub.NewBatchPublisher(publisher, pubsub.BatchOptions{
+			Size:     *batchSize,
+			Interval: time.Duration(*batchInterval) * time.Millisecond,
+			OnError: func(msg *models.Message, err error) {
+				failed.Add(1)
+				log.Error("Message %s not published: %v", msg.ID, err)
+			},
+		})
+		log.Info("Batch mode enabled, flushing every %d messages or %d ms", *batchSize, *batchInterval)
+	}
+	if *confirm {
+		log.Info("Confirm mode enabled, waiting up to %d ms for replies", *confirmTimeout)
+	}
+	if *maxCount < 0 {
+		log.Fatal("Message count cannot be negative")
+	}
+	bodies, err := newBodySource(*bodyFile, *bodyTemplate, appConfig.Environment)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
 
-	// Setup signal handling for graceful shutdown
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	count := 0
+	confirmed := 0
+	var unconfirmed []string
+	started := time.Now()
 
-	// Create ticker for regular publishing
-	ticker := time.NewTicker(time.Duration(*interval) * time.Millisecond)
-	defer ticker.Stop()
+	group.Go("publish", func(ctx context.Context) error {
+		// Create ticker for regular publishing, or publish back to back without an interval
+		tick := closedTick
+		if *interval > 0 {
+			ticker := time.NewTicker(time.Duration(*interval) * time.Millisecond)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
 
-	count := 0
-	running := true
-
-	for running {
-		select {
-		case <-ticker.C:
-			count++
-			// Create a message
-			msg := models.NewMessage(*subject, fmt.Sprintf("Message #%d", count))
-			msg.AddMetadata("publisher", "example")
-			msg.AddMetadata("timestamp", time.Now().Format(time.RFC3339))
-			msg.AddMetadata("environment", appConfig.Environment)
-
-			// Publish the message
-			if err := publisher.PublishMessage(msg); err != nil {
-				log.Error("Error publishing message: %v", err)
-				continue
+		for {
+			if *maxCount > 0 && count >= *maxCount {
+				log.Info("Published the requested %d messages", *maxCount)
+				return nil
 			}
 
-			log.Info("Published message #%d to %s", count, *subject)
+			select {
+			case <-tick:
+				count++
+				// Create a message with the next body, stopping once the body file is exhausted
+				msg := models.NewMessage(*subject, "")
+				body, err := bodies.next(ctx, count, msg)
+				if err != nil {
+					count--
+					switch {
+					case errors.Is(err, io.EOF):
+						log.Info("Reached the end of the body file")
+						return nil
+					case ctx.Err() != nil:
+						return nil
+					}
+					return err
+				}
+				msg.Body = body
+				msg.AddMetadata("publisher", "example")
+				msg.AddMetadata("timestamp", time.Now().Format(time.RFC3339))
+				msg.AddMetadata("environment", appConfig.Environment)
+				for key, values := range metadata.Values() {
+					msg.AddMetadata(key, values[len(values)-1])
+				}
+				for key, values := range headers.Values() {
+					for _, value := range values {
+						msg.SetHeader(key, value)
+					}
+				}
+
+				// Send as a request and wait for the reply in confirm mode
+				if *confirm {
+					reply, err := publisher.RequestMessage(msg, time.Duration(*confirmTimeout)*time.Millisecond)
+					if err != nil {
+						unconfirmed = append(unconfirmed, msg.ID)
+						log.Warn("Message #%d (%s) not confirmed: %v", count, msg.ID, err)
+						continue
+					}
+
+					confirmed++
+					log.Info("Message #%d (%s) confirmed: %s", count, msg.ID, reply.Body)
+					continue
+				}
+
+				// Hand the message to JetStream and collect its ack later in async mode
+				if *async {
+					if err := jsPublisher.PublishMessageAsync(msg); err != nil {
+						log.Error("Error publishing message: %v", err)
+						continue
+					}
+					log.Info("Published message #%d to %s, %d acks pending", count, *subject, jsPublisher.Pending())
+					continue
+				}
+
+				// Wait for the stream to store the message in JetStream mode
+				if *useJetStream {
+					ack, err := jsPublisher.PublishMessageAck(msg)
+					if err != nil {
+						log.Error("Message #%d (%s) not stored: %v", count, msg.ID, err)
+						continue
+					}
+					log.Info("Stored message #%d in %s at sequence %d", count, ack.Stream, ack.Sequence)
+					continue
+				}
+
+				// Buffer the message for the next batch in batch mode
+				if batcher != nil {
+					if err := batcher.PublishMessage(msg); err != nil {
+						failed.Add(1)
+						log.Error("Error publishing message: %v", err)
+						continue
+					}
+					log.Debug("Buffered message #%d for %s", count, *subject)
+					continue
+				}
 
-		case <-signals:
-			log.Info("Received shutdown signal, exiting...")
-			running = false
+				// Publish the message
+				if err := publisher.PublishMessage(msg); err != nil {
+					failed.Add(1)
+					log.Error("Error publishing message: %v", err)
+					continue
+				}
+
+				log.Info("Published message #%d to %s", count, *subject)
+
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+
+	if *confirm {
+		log.Info("Confirmation summary: %d of %d messages confirmed", confirmed, count)
+		if len(unconfirmed) > 0 {
+			log.Warn("Unconfirmed message IDs: %s", strings.Join(unconfirmed, ", "))
+		}
+	}
+
+	// Report the throughput of plain and batch publishing, the other modes wait on the server
+	if !*confirm && !*useJetStream {
+		published := count - int(failed.Load())
+		elapsed := time.Since(started)
+		log.Info("Published %d messages in %s (%.0f messages/s)", published, elapsed.Round(time.Millisecond), float64(published)/elapsed.Seconds())
+	}
+
+	if *async {
+		log.Info("Ack summary: %d of %d messages acknowledged", count-len(unacked), count)
+		if len(unacked) > 0 {
+			log.Warn("Unacknowledged message IDs: %s", strings.Join(unacked, ", "))
 		}
 	}
 
 	log.Info("Publisher shutdown complete")
 }
+
+// closedTick is ready at once, so the publish loop runs back to back when no interval is set
+var closedTick = func() <-chan time.Time {
+	tick := make(chan time.Time)
+	close(tick)
+	return tick
+}()
+
+// replay publishes recorded messages, preserving the original inter-message timing scaled by speed
+func replay(ctx context.Context, publisher pubsub.Publisher, path string, speed float64, log *logger.Logger) error {
+	messages, err := pubsub.ReadRecording(path)
+	if err != nil {
+		return fmt.Errorf("failed to load recording: %w", err)
+	}
+
+	log.Info("Replaying %d messages from %s at %.2fx speed", len(messages), path, speed)
+
+	for i, recorded := range messages {
+		// Wait for the same gap that separated the original messages
+		if i > 0 {
+			gap := recorded.Timestamp.Sub(messages[i-1].Timestamp)
+			if gap > 0 {
+				select {
+				case <-time.After(time.Duration(float64(gap) / speed)):
+				case <-ctx.Done():
+					log.Info("Stopping replay after %d messages", i)
+					return nil
+				}
+			}
+		}
+
+		msg := &nats.Msg{
+			Subject: recorded.Subject,
+			Header:  nats.Header(recorded.Headers),
+			Data:    recorded.Data,
+		}
+		if err := publisher.PublishMsg(msg); err != nil {
+			log.Error("Error replaying message #%d: %v", i+1, err)
+			continue
+		}
+
+		log.Debug("Replayed message #%d to %s", i+1, recorded.Subject)
+	}
+
+	log.Info("Replay complete: %d messages published", len(messages))
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule computes the next activation time after a given time
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// everySchedule fires at a fixed interval
+type everySchedule struct {
+	interval time.Duration
+}
+
+// Next returns the next interval boundary after the given time
+func (s everySchedule) Next(after time.Time) time.Time {
+	return after.Truncate(s.interval).Add(s.interval)
+}
+
+// cronSchedule fires on minutes matching a five-field cron expression
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bit sets of allowed values
+	domStar, dowStar              bool   // the field starts with *, e.g. * or */2
+}
+
+// cronField describes the bounds of a single cron field
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // 0 and 7 are both Sunday
+}
+
+// shorthands maps the common cron macros to their expressions
+var shorthands = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// ParseSchedule parses a five-field cron expression, a macro such as @hourly, or @every <duration>
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	if interval, found := strings.CutPrefix(spec, "@every "); found {
+		d, err := time.ParseDuration(strings.TrimSpace(interval))
+		if err != nil {
+			return nil, fmt.Errorf("invalid @every interval: %w", err)
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("@every interval must be at least one second")
+		}
+		return everySchedule{interval: d}, nil
+	}
+
+	if expanded, found := shorthands[spec]; found {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("expected 5 fields in cron expression %q, got %d", spec, len(fields))
+	}
+
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseField(field, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] = sets[4]&^(1<<7) | 1
+	}
+
+	return &cronSchedule{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parseField parses a comma-separated list of values, ranges and steps into a bit set
+func parseField(field string, bounds cronField) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		expr, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %s field", stepText, bounds.name)
+			}
+		}
+
+		low, high := bounds.min, bounds.max
+		if expr != "*" {
+			lowText, highText, isRange := strings.Cut(expr, "-")
+			var err error
+			if low, err = strconv.Atoi(lowText); err != nil {
+				return 0, fmt.Errorf("invalid value %q in %s field", expr, bounds.name)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(highText); err != nil {
+					return 0, fmt.Errorf("invalid range %q in %s field", expr, bounds.name)
+				}
+			} else if hasStep {
+				// "5/15" means every 15 starting at 5
+				high = bounds.max
+			}
+		}
+
+		if low < bounds.min || high > bounds.max || low > high {
+			return 0, fmt.Errorf("value %q out of range %d-%d in %s field", part, bounds.min, bounds.max, bounds.name)
+		}
+
+		for v := low; v <= high; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// Next returns the first matching minute strictly after the given time
+func (s *cronSchedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+
+	// Give up after five years, which only happens for impossible dates such as 31 February
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches applies the cron rule that a restricted day of month or day of week is enough to
+// match when both are restricted. Like in Vixie cron, a field starting with *, such as */2, is
+// not restricted, so "0 0 */2 * 1" fires on odd days that are Mondays.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// at returns a UTC time in 2024 or later; 1 January 2024 is a Monday
+func at(year int, month time.Month, day, hour, minute int) time.Time {
+	return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestScheduleNext(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  string
+		after time.Time
+		want  time.Time
+	}{
+		{"every minute", "* * * * *", at(2024, 1, 1, 10, 7), at(2024, 1, 1, 10, 8)},
+		{"strictly after", "0 10 * * *", at(2024, 1, 1, 10, 0), at(2024, 1, 2, 10, 0)},
+		{"stepped minutes", "*/15 * * * *", at(2024, 1, 1, 10, 7), at(2024, 1, 1, 10, 15)},
+		{"offset step", "5/20 * * * *", at(2024, 1, 1, 10, 30), at(2024, 1, 1, 10, 45)},
+		{"list and range", "0 8-9,17 * * *", at(2024, 1, 1, 9, 30), at(2024, 1, 1, 17, 0)},
+		{"sunday as 0", "0 0 * * 0", at(2024, 1, 1, 10, 0), at(2024, 1, 7, 0, 0)},
+		{"sunday as 7", "0 0 * * 7", at(2024, 1, 1, 10, 0), at(2024, 1, 7, 0, 0)},
+		{"range ending on 7", "0 0 * * 6-7", at(2024, 1, 1, 10, 0), at(2024, 1, 6, 0, 0)},
+		{"restricted days match either", "0 0 1,15 * 1", at(2024, 1, 1, 0, 0), at(2024, 1, 8, 0, 0)},
+		{"stepped day of month is a wildcard", "0 0 */2 * 1", at(2024, 1, 1, 0, 0), at(2024, 1, 15, 0, 0)},
+		{"stepped day of week is a wildcard", "0 0 13 * */2", at(2024, 1, 1, 0, 0), at(2024, 1, 13, 0, 0)},
+		{"across month end", "0 0 1 * *", at(2024, 1, 31, 23, 59), at(2024, 2, 1, 0, 0)},
+		{"skips short months", "30 12 31 * *", at(2024, 1, 31, 13, 0), at(2024, 3, 31, 12, 30)},
+		{"across year end", "* * * * *", at(2024, 12, 31, 23, 59), at(2025, 1, 1, 0, 0)},
+		{"yearly", "@yearly", at(2024, 6, 1, 0, 0), at(2025, 1, 1, 0, 0)},
+		{"leap day", "0 9 29 2 *", at(2024, 3, 1, 0, 0), at(2028, 2, 29, 9, 0)},
+		{"impossible date", "0 0 31 2 *", at(2024, 1, 1, 0, 0), time.Time{}},
+		{"weekly", "@weekly", at(2024, 1, 1, 0, 0), at(2024, 1, 7, 0, 0)},
+		{"every", "@every 1h", at(2024, 1, 1, 10, 30), at(2024, 1, 1, 11, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := ParseSchedule(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := schedule.Next(tt.after); !got.Equal(tt.want) {
+				t.Fatalf("Next(%s) = %s, want %s", tt.after, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		err  string // substring of the error
+	}{
+		{"empty", "", "expected 5 fields"},
+		{"too few fields", "* * * *", "expected 5 fields"},
+		{"unknown macro", "@fortnightly", "expected 5 fields"},
+		{"minute out of range", "60 * * * *", "out of range"},
+		{"day of week out of range", "* * * * 8", "out of range"},
+		{"day of month zero", "* * 0 * *", "out of range"},
+		{"reversed range", "5-1 * * * *", "out of range"},
+		{"zero step", "*/0 * * * *", "invalid step"},
+		{"not a number", "a * * * *", "invalid value"},
+		{"bad range", "1-x * * * *", "invalid range"},
+		{"short interval", "@every 500ms", "at least one second"},
+		{"bad interval", "@every soon", "invalid @every interval"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSchedule(tt.spec)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/pkg/kvstore"
+	"github.com/nats-io/nats.go"
+)
+
+// leaderKey is the key holding the current leader's identity
+const leaderKey = "leader"
+
+// LeaderElection elects a single active scheduler using a JetStream KV bucket.
+// The leader owns the key and refreshes it; when it stops, the bucket TTL expires the key
+// and another instance can create it.
+type LeaderElection struct {
+	kv       nats.KeyValue
+	id       string
+	ttl      time.Duration
+	log      *logger.Logger
+	leader   atomic.Bool
+	revision uint64
+}
+
+// NewLeaderElection opens or creates the leader bucket with the given TTL
+func NewLeaderElection(js nats.JetStreamContext, bucket, id string, ttl time.Duration, log *logger.Logger) (*LeaderElection, error) {
+	kv, err := kvstore.Open(js, nats.KeyValueConfig{
+		Bucket:      bucket,
+		Description: "Scheduler leader election",
+		TTL:         ttl,
+		History:     1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &LeaderElection{kv: kv, id: id, ttl: ttl, log: log}, nil
+}
+
+// IsLeader reports whether this instance currently holds leadership
+func (e *LeaderElection) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Run campaigns for and keeps leadership until stop is closed
+func (e *LeaderElection) Run(stop <-chan struct{}) {
+	// Refresh well before the TTL so a slow tick does not lose leadership
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		e.campaign()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			e.resign()
+			return
+		}
+	}
+}
+
+// campaign refreshes leadership when held, or tries to acquire it otherwise
+func (e *LeaderElection) campaign() {
+	if e.IsLeader() {
+		revision, err := e.kv.Update(leaderKey, []byte(e.id), e.revision)
+		if err != nil {
+			e.leader.Store(false)
+			e.log.Warn("Lost scheduler leadership: %v", err)
+			return
+		}
+		e.revision = revision
+		return
+	}
+
+	revision, err := e.kv.Create(leaderKey, []byte(e.id))
+	if err != nil {
+		if !errors.Is(err, nats.ErrKeyExists) {
+			e.log.Warn("Leader election failed: %v", err)
+		}
+		return
+	}
+
+	e.revision = revision
+	e.leader.Store(true)
+	e.log.Info("Acquired scheduler leadership as %s", e.id)
+}
+
+// resign releases leadership so another instance can take over immediately
+func (e *LeaderElection) resign() {
+	if !e.IsLeader() {
+		return
+	}
+
+	e.leader.Store(false)
+	if err := e.kv.Delete(leaderKey, nats.LastRevision(e.revision)); err != nil {
+		e.log.Warn("Failed to release scheduler leadership: %v", err)
+		return
+	}
+	e.log.Info("Released scheduler leadership")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/testutil"
+)
+
+func TestLeaderElection(t *testing.T) {
+	js := testutil.JetStream(t, testutil.Connect(t, testutil.StartServer(t)))
+	log := logger.NewLogger("test", logger.ERROR, io.Discard)
+
+	elect := func(id string) *LeaderElection {
+		e, err := NewLeaderElection(js, "leader-test", id, time.Minute, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	a, b := elect("a"), elect("b")
+
+	a.campaign()
+	b.campaign()
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatalf("expected only a to lead, got a=%v b=%v", a.IsLeader(), b.IsLeader())
+	}
+
+	// Refreshing keeps leadership
+	a.campaign()
+	if !a.IsLeader() {
+		t.Fatal("expected a to keep leadership after refreshing")
+	}
+
+	a.resign()
+	if a.IsLeader() {
+		t.Fatal("expected a to give up leadership when resigning")
+	}
+	b.campaign()
+	if !b.IsLeader() {
+		t.Fatal("expected b to take over once a resigned")
+	}
+
+	// A leader whose key was taken over loses leadership on its next refresh
+	a.leader.Store(true)
+	a.campaign()
+	if a.IsLeader() {
+		t.Fatal("expected a stale leader to lose leadership")
+	}
+	entry, err := b.kv.Get(leaderKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entry.Value()) != "b" {
+		t.Fatalf("expected b to hold the key, got %q", entry.Value())
+	}
+}
+
+func TestLeaderRunResignsOnStop(t *testing.T) {
+	js := testutil.JetStream(t, testutil.Connect(t, testutil.StartServer(t)))
+	e, err := NewLeaderElection(js, "leader-test", "a", time.Minute, logger.NewLogger("test", logger.ERROR, io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		e.Run(stop)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !e.IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected Run to acquire leadership")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(stop)
+	<-done
+	if e.IsLeader() {
+		t.Fatal("expected Run to resign when stopped")
+	}
+	if _, err := e.kv.Get(leaderKey); err == nil {
+		t.Fatal("expected the leader key to be released")
+	}
+}
@@ -0,0 +1,318 @@
+// Package main implements a scheduler that publishes messages on cron-style schedules
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/health"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultLeaderBucket = "scheduler-leader"
+	defaultLeaderTTL    = 15 * time.Second
+	tickInterval        = 250 * time.Millisecond
+)
+
+// job is a schedule together with its next activation time
+type job struct {
+	config   config.ScheduleConfig
+	schedule Schedule
+	next     time.Time
+}
+
+// Scheduler fires jobs on their schedule while this instance is the leader
+type Scheduler struct {
+	mu         sync.Mutex
+	staticJobs map[string]*job // from the config file
+	kvJobs     map[string]*job // from the KV bucket, overriding config jobs with the same name
+	natsConn   *nats.Conn
+	election   *LeaderElection
+	log        *logger.Logger
+}
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "configs/scheduler.json", "Path to config file with a scheduler section")
+	instanceID := flag.String("id", "", "Instance identifier used for leader election (default: hostname)")
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Create logger
+	log := logger.DefaultLogger("scheduler")
+	log.Info("Starting scheduler")
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("scheduler", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	schedulerConfig := appConfig.Scheduler
+	if schedulerConfig == nil {
+		schedulerConfig = &config.SchedulerConfig{}
+	}
+
+	id := *instanceID
+	if id == "" {
+		if hostname, err := os.Hostname(); err == nil {
+			id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+		} else {
+			id = fmt.Sprintf("scheduler-%d", os.Getpid())
+		}
+	}
+
+	natsConn, err := natsutil.Connect(appConfig.NATS, "scheduler-"+id, log)
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+	log.Info("Connected to NATS at %s", appConfig.NATS.URL)
+
+	js, err := natsConn.JetStream()
+	if err != nil {
+		log.Fatal("Failed to get JetStream context: %v", err)
+	}
+
+	leaderBucket := schedulerConfig.LeaderBucket
+	if leaderBucket == "" {
+		leaderBucket = defaultLeaderBucket
+	}
+	leaderTTL := defaultLeaderTTL
+	if schedulerConfig.LeaderTTL > 0 {
+		leaderTTL = time.Duration(schedulerConfig.LeaderTTL) * time.Second
+	}
+
+	election, err := NewLeaderElection(js, leaderBucket, id, leaderTTL, log)
+	if err != nil {
+		log.Fatal("Failed to set up leader election: %v", err)
+	}
+
+	scheduler := &Scheduler{
+		staticJobs: make(map[string]*job),
+		kvJobs:     make(map[string]*job),
+		natsConn:   natsConn,
+		election:   election,
+		log:        log,
+	}
+
+	for _, jobConfig := range schedulerConfig.Jobs {
+		j, err := newJob(jobConfig, time.Now())
+		if err != nil {
+			log.Fatal("Invalid job %s: %v", jobConfig.Name, err)
+		}
+		scheduler.staticJobs[jobConfig.Name] = j
+		log.Info("Loaded job %s (%s) -> %s, next run at %s", jobConfig.Name, jobConfig.Cron, jobConfig.Subject,
+			j.next.Format(time.RFC3339))
+	}
+
+	// Answer health requests on health.scheduler
+	checks := health.New("scheduler")
+	checks.Add("nats", health.NATSConnected(natsConn))
+	if schedulerConfig.Bucket != "" {
+		checks.Add("jobs", health.KeyValue(js, schedulerConfig.Bucket))
+	}
+	if _, err := checks.Respond(natsConn); err != nil {
+		log.Fatal("Failed to answer health requests: %v", err)
+	}
+
+	group := run.New(log)
+	group.AddConn("nats", natsConn)
+
+	// Jobs stored in the KV bucket are picked up and updated live
+	if schedulerConfig.Bucket != "" {
+		kv, err := js.KeyValue(schedulerConfig.Bucket)
+		if err != nil {
+			log.Fatal("Failed to open schedule bucket %s: %v", schedulerConfig.Bucket, err)
+		}
+		watcher, err := kv.WatchAll()
+		if err != nil {
+			log.Fatal("Failed to watch schedule bucket %s: %v", schedulerConfig.Bucket, err)
+		}
+		group.Add("schedule-watcher", func(ctx context.Context) error {
+			scheduler.watchBucket(watcher, ctx.Done())
+			return nil
+		}, func(ctx context.Context) error {
+			return watcher.Stop()
+		})
+		log.Info("Watching schedule bucket %s", schedulerConfig.Bucket)
+	}
+
+	// The election resigns when stopped, so leadership is released before the connection drains
+	group.Go("election", func(ctx context.Context) error {
+		election.Run(ctx.Done())
+		return nil
+	})
+	group.Go("scheduler", func(ctx context.Context) error {
+		scheduler.run(ctx.Done())
+		return nil
+	})
+
+	log.Info("Scheduler %s running. Press Ctrl+C to exit.", id)
+
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// newJob validates a job configuration and computes its first activation
+func newJob(jobConfig config.ScheduleConfig, now time.Time) (*job, error) {
+	if jobConfig.Name == "" || jobConfig.Subject == "" {
+		return nil, errors.New("name and subject are required")
+	}
+
+	schedule, err := ParseSchedule(jobConfig.Cron)
+	if err != nil {
+		return nil, err
+	}
+
+	next := schedule.Next(now)
+	if next.IsZero() {
+		return nil, fmt.Errorf("schedule %q never fires", jobConfig.Cron)
+	}
+
+	return &job{config: jobConfig, schedule: schedule, next: next}, nil
+}
+
+// run fires due jobs until stop is closed
+func (s *Scheduler) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.fireDue(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// fireDue publishes every job whose activation time has passed and schedules its next run.
+// Followers advance their schedules too, so a new leader does not replay missed runs.
+func (s *Scheduler) fireDue(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, j := range s.activeJobs() {
+		if now.Before(j.next) {
+			continue
+		}
+
+		scheduledAt := j.next
+		j.next = j.schedule.Next(now)
+
+		if !s.election.IsLeader() {
+			continue
+		}
+
+		if err := s.publish(j, scheduledAt); err != nil {
+			s.log.Error("Failed to publish job %s: %v", name, err)
+			continue
+		}
+		s.log.Info("Fired job %s to %s, next run at %s", name, j.config.Subject, j.next.Format(time.RFC3339))
+	}
+}
+
+// activeJobs merges config and KV jobs; callers must hold the lock
+func (s *Scheduler) activeJobs() map[string]*job {
+	jobs := make(map[string]*job, len(s.staticJobs)+len(s.kvJobs))
+	for name, j := range s.staticJobs {
+		jobs[name] = j
+	}
+	for name, j := range s.kvJobs {
+		jobs[name] = j
+	}
+	return jobs
+}
+
+// publish sends the job's message
+func (s *Scheduler) publish(j *job, scheduledAt time.Time) error {
+	msg := models.NewMessage(j.config.Subject, j.config.Body)
+	for key, value := range j.config.Metadata {
+		msg.AddMetadata(key, value)
+	}
+	msg.AddMetadata("schedule", j.config.Name)
+	msg.AddMetadata("scheduled_at", scheduledAt.Format(time.RFC3339))
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.natsConn.Publish(msg.Subject, data)
+}
+
+// watchBucket keeps the KV jobs in sync with the schedule bucket
+func (s *Scheduler) watchBucket(watcher nats.KeyWatcher, stop <-chan struct{}) {
+	for {
+		select {
+		case entry := <-watcher.Updates():
+			// A nil entry marks the end of the initial values
+			if entry == nil {
+				continue
+			}
+			s.applyEntry(entry)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// applyEntry adds, replaces or removes a KV job
+func (s *Scheduler) applyEntry(entry nats.KeyValueEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry.Operation() != nats.KeyValuePut {
+		delete(s.kvJobs, entry.Key())
+		s.log.Info("Removed job %s from bucket", entry.Key())
+		return
+	}
+
+	var jobConfig config.ScheduleConfig
+	if err := json.Unmarshal(entry.Value(), &jobConfig); err != nil {
+		s.log.Error("Ignoring job %s: invalid JSON: %v", entry.Key(), err)
+		return
+	}
+	if jobConfig.Name == "" {
+		jobConfig.Name = entry.Key()
+	}
+
+	j, err := newJob(jobConfig, time.Now())
+	if err != nil {
+		s.log.Error("Ignoring job %s: %v", entry.Key(), err)
+		return
+	}
+
+	s.kvJobs[entry.Key()] = j
+	s.log.Info("Loaded job %s from bucket (%s) -> %s, next run at %s", jobConfig.Name, jobConfig.Cron,
+		jobConfig.Subject, j.next.Format(time.RFC3339))
+}
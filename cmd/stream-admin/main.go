@@ -0,0 +1,409 @@
+// Package main implements a CLI for managing the JetStream streams and consumers used by the examples
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/nats-io/nats.go"
+	"gopkg.in/yaml.v3"
+)
+
+const usage = `Usage: stream-admin [flags] <command> [args]
+
+Commands:
+  diff                             Show the changes apply would make
+  apply                            Create or update streams and consumers to match the topology file
+  list                             List streams and consumers on the server
+  export                           Print the streams and durable consumers on the server as a topology file
+  purge <stream>                   Remove all messages from a stream
+  delete <stream>                  Delete a stream and its consumers
+  delete-consumer <stream> <name>  Delete a single consumer
+
+Flags:
+`
+
+// action is a single change needed to reconcile the server with the topology
+type action struct {
+	kind        string // create, update, recreate or delete
+	stream      string
+	consumer    string // empty for stream-level actions
+	details     []string
+	streamCfg   *nats.StreamConfig
+	consumerCfg *nats.ConsumerConfig
+}
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file")
+	topologyPath := flag.String("file", "configs/streams.yaml", "Topology definition file (YAML or JSON)")
+	prune := flag.Bool("prune", false, "Also delete streams and consumers that are not in the topology file")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	log := logger.DefaultLogger("stream-admin")
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("stream-admin", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	natsConn, err := natsutil.Connect(appConfig.NATS, "stream-admin", log)
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+	defer natsConn.Close()
+
+	js, err := natsConn.JetStream()
+	if err != nil {
+		log.Fatal("Failed to get JetStream context: %v", err)
+	}
+
+	args := flag.Args()
+	switch command := args[0]; command {
+	case "diff", "apply":
+		topology, err := LoadTopology(*topologyPath)
+		if err != nil {
+			log.Fatal("%v", err)
+		}
+
+		actions, err := plan(js, topology, *prune)
+		if err != nil {
+			log.Fatal("Failed to compute changes: %v", err)
+		}
+
+		printPlan(actions)
+		if command == "apply" {
+			for _, a := range actions {
+				if err := execute(js, a); err != nil {
+					log.Fatal("Failed to %s %s: %v", a.kind, a.target(), err)
+				}
+				log.Info("Applied: %s %s", a.kind, a.target())
+			}
+		}
+
+	case "list":
+		for info := range js.StreamsInfo() {
+			fmt.Printf("%s subjects=%v messages=%d bytes=%d\n", info.Config.Name, info.Config.Subjects,
+				info.State.Msgs, info.State.Bytes)
+			for consumer := range js.ConsumersInfo(info.Config.Name) {
+				fmt.Printf("  %s pending=%d ack_pending=%d\n", consumer.Name, consumer.NumPending, consumer.NumAckPending)
+			}
+		}
+
+	case "export":
+		topology, err := ExportTopology(js)
+		if err != nil {
+			log.Fatal("Failed to export the topology: %v", err)
+		}
+		out := yaml.NewEncoder(os.Stdout)
+		out.SetIndent(2)
+		if err := out.Encode(topology); err != nil {
+			log.Fatal("Failed to write the topology: %v", err)
+		}
+
+	case "purge":
+		requireArgs(args, 2)
+		if err := js.PurgeStream(args[1]); err != nil {
+			log.Fatal("Failed to purge stream %s: %v", args[1], err)
+		}
+		log.Info("Purged stream %s", args[1])
+
+	case "delete":
+		requireArgs(args, 2)
+		if err := js.DeleteStream(args[1]); err != nil {
+			log.Fatal("Failed to delete stream %s: %v", args[1], err)
+		}
+		log.Info("Deleted stream %s", args[1])
+
+	case "delete-consumer":
+		requireArgs(args, 3)
+		if err := js.DeleteConsumer(args[1], args[2]); err != nil {
+			log.Fatal("Failed to delete consumer %s on %s: %v", args[2], args[1], err)
+		}
+		log.Info("Deleted consumer %s on stream %s", args[2], args[1])
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// requireArgs exits with usage information when too few positional arguments were given
+func requireArgs(args []string, n int) {
+	if len(args) < n {
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// target returns a human readable name for the object an action touches
+func (a action) target() string {
+	if a.consumer != "" {
+		return fmt.Sprintf("consumer %s/%s", a.stream, a.consumer)
+	}
+	return fmt.Sprintf("stream %s", a.stream)
+}
+
+// plan compares the topology with the server state and returns the actions needed to reconcile them
+func plan(js nats.JetStreamContext, topology *Topology, prune bool) ([]action, error) {
+	var actions []action
+	defined := make(map[string]bool)
+
+	for _, def := range topology.Streams {
+		defined[def.Name] = true
+
+		desired, err := def.StreamConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := js.StreamInfo(def.Name)
+		switch {
+		case errors.Is(err, nats.ErrStreamNotFound):
+			actions = append(actions, action{kind: "create", stream: def.Name, streamCfg: desired})
+		case err != nil:
+			return nil, fmt.Errorf("failed to get stream %s: %w", def.Name, err)
+		default:
+			if details := diffStream(&info.Config, desired); len(details) > 0 {
+				merged := mergeStream(info.Config, desired)
+				actions = append(actions, action{kind: "update", stream: def.Name, details: details, streamCfg: &merged})
+			}
+		}
+
+		consumerActions, err := planConsumers(js, &def, info != nil, prune)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, consumerActions...)
+	}
+
+	if prune {
+		for name := range js.StreamNames() {
+			if !defined[name] {
+				actions = append(actions, action{kind: "delete", stream: name})
+			}
+		}
+	}
+
+	return actions, nil
+}
+
+// planConsumers computes the consumer actions for a single stream
+func planConsumers(js nats.JetStreamContext, def *StreamDefinition, streamExists, prune bool) ([]action, error) {
+	var actions []action
+	defined := make(map[string]bool)
+
+	for _, consumerDef := range def.Consumers {
+		defined[consumerDef.Name] = true
+
+		desired, err := consumerDef.ConsumerConfig()
+		if err != nil {
+			return nil, fmt.Errorf("stream %s: %w", def.Name, err)
+		}
+
+		if !streamExists {
+			actions = append(actions, action{kind: "create", stream: def.Name, consumer: consumerDef.Name, consumerCfg: desired})
+			continue
+		}
+
+		info, err := js.ConsumerInfo(def.Name, consumerDef.Name)
+		switch {
+		case errors.Is(err, nats.ErrConsumerNotFound):
+			actions = append(actions, action{kind: "create", stream: def.Name, consumer: consumerDef.Name, consumerCfg: desired})
+		case err != nil:
+			return nil, fmt.Errorf("failed to get consumer %s/%s: %w", def.Name, consumerDef.Name, err)
+		default:
+			details, immutable := diffConsumer(&info.Config, desired)
+			if len(details) == 0 {
+				continue
+			}
+			if immutable {
+				actions = append(actions, action{kind: "recreate", stream: def.Name, consumer: consumerDef.Name, details: details, consumerCfg: desired})
+				continue
+			}
+			merged := mergeConsumer(info.Config, desired)
+			actions = append(actions, action{kind: "update", stream: def.Name, consumer: consumerDef.Name, details: details, consumerCfg: &merged})
+		}
+	}
+
+	if prune && streamExists {
+		for name := range js.ConsumerNames(def.Name) {
+			if !defined[name] {
+				actions = append(actions, action{kind: "delete", stream: def.Name, consumer: name})
+			}
+		}
+	}
+
+	return actions, nil
+}
+
+// diffStream lists the managed fields that differ between the current and desired stream configuration
+func diffStream(current, desired *nats.StreamConfig) []string {
+	var details []string
+	add := func(field string, from, to interface{}) {
+		details = append(details, fmt.Sprintf("%s: %v -> %v", field, from, to))
+	}
+
+	if current.Description != desired.Description {
+		add("description", current.Description, desired.Description)
+	}
+	if !slices.Equal(current.Subjects, desired.Subjects) {
+		add("subjects", current.Subjects, desired.Subjects)
+	}
+	if current.Storage != desired.Storage {
+		add("storage", current.Storage, desired.Storage)
+	}
+	if current.Retention != desired.Retention {
+		add("retention", current.Retention, desired.Retention)
+	}
+	if current.Discard != desired.Discard {
+		add("discard", current.Discard, desired.Discard)
+	}
+	if current.MaxAge != desired.MaxAge {
+		add("max_age", current.MaxAge, desired.MaxAge)
+	}
+	if current.MaxMsgs != desired.MaxMsgs {
+		add("max_msgs", current.MaxMsgs, desired.MaxMsgs)
+	}
+	if current.MaxBytes != desired.MaxBytes {
+		add("max_bytes", current.MaxBytes, desired.MaxBytes)
+	}
+	if current.Replicas != desired.Replicas {
+		add("replicas", current.Replicas, desired.Replicas)
+	}
+
+	return details
+}
+
+// mergeStream overlays the managed fields onto the current stream configuration
+func mergeStream(current nats.StreamConfig, desired *nats.StreamConfig) nats.StreamConfig {
+	current.Description = desired.Description
+	current.Subjects = desired.Subjects
+	current.Storage = desired.Storage
+	current.Retention = desired.Retention
+	current.Discard = desired.Discard
+	current.MaxAge = desired.MaxAge
+	current.MaxMsgs = desired.MaxMsgs
+	current.MaxBytes = desired.MaxBytes
+	current.Replicas = desired.Replicas
+	return current
+}
+
+// diffConsumer lists the managed fields that differ and reports whether any of them cannot be updated in place
+func diffConsumer(current, desired *nats.ConsumerConfig) ([]string, bool) {
+	var details []string
+	immutable := false
+	add := func(field string, from, to interface{}) {
+		details = append(details, fmt.Sprintf("%s: %v -> %v", field, from, to))
+	}
+
+	if current.Description != desired.Description {
+		add("description", current.Description, desired.Description)
+	}
+	if current.FilterSubject != desired.FilterSubject {
+		add("filter_subject", current.FilterSubject, desired.FilterSubject)
+	}
+	if current.DeliverPolicy != desired.DeliverPolicy {
+		add("deliver_policy", current.DeliverPolicy, desired.DeliverPolicy)
+		immutable = true
+	}
+	if current.AckPolicy != desired.AckPolicy {
+		add("ack_policy", current.AckPolicy, desired.AckPolicy)
+		immutable = true
+	}
+	if current.AckWait != desired.AckWait {
+		add("ack_wait", current.AckWait, desired.AckWait)
+	}
+	if current.MaxDeliver != desired.MaxDeliver {
+		add("max_deliver", current.MaxDeliver, desired.MaxDeliver)
+	}
+	if current.MaxAckPending != desired.MaxAckPending {
+		add("max_ack_pending", current.MaxAckPending, desired.MaxAckPending)
+	}
+
+	return details, immutable
+}
+
+// mergeConsumer overlays the managed fields onto the current consumer configuration
+func mergeConsumer(current nats.ConsumerConfig, desired *nats.ConsumerConfig) nats.ConsumerConfig {
+	current.Description = desired.Description
+	current.FilterSubject = desired.FilterSubject
+	current.AckWait = desired.AckWait
+	current.MaxDeliver = desired.MaxDeliver
+	current.MaxAckPending = desired.MaxAckPending
+	return current
+}
+
+// printPlan writes the planned actions in a diff-like format
+func printPlan(actions []action) {
+	if len(actions) == 0 {
+		fmt.Println("No changes, server matches the topology")
+		return
+	}
+
+	symbols := map[string]string{"create": "+", "update": "~", "recreate": "!", "delete": "-"}
+	for _, a := range actions {
+		fmt.Printf("%s %s %s\n", symbols[a.kind], a.kind, a.target())
+		for _, detail := range a.details {
+			fmt.Printf("    %s\n", detail)
+		}
+	}
+}
+
+// execute performs a single planned action
+func execute(js nats.JetStreamContext, a action) error {
+	var err error
+	switch {
+	case a.consumer == "" && a.kind == "create":
+		_, err = js.AddStream(a.streamCfg)
+	case a.consumer == "" && a.kind == "update":
+		_, err = js.UpdateStream(a.streamCfg)
+	case a.consumer == "" && a.kind == "delete":
+		err = js.DeleteStream(a.stream)
+	case a.kind == "create":
+		_, err = js.AddConsumer(a.stream, a.consumerCfg)
+	case a.kind == "update":
+		_, err = js.UpdateConsumer(a.stream, a.consumerCfg)
+	case a.kind == "recreate":
+		if err = js.DeleteConsumer(a.stream, a.consumer); err == nil {
+			_, err = js.AddConsumer(a.stream, a.consumerCfg)
+		}
+	case a.kind == "delete":
+		err = js.DeleteConsumer(a.stream, a.consumer)
+	}
+	return err
+}
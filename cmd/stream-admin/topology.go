@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"gopkg.in/yaml.v3"
+)
+
+// Topology is the declarative description of the streams and consumers used by the examples
+type Topology struct {
+	Streams []StreamDefinition `yaml:"streams"`
+}
+
+// StreamDefinition describes a JetStream stream and its consumers
+type StreamDefinition struct {
+	Name        string               `yaml:"name"`
+	Description string               `yaml:"description,omitempty"`
+	Subjects    []string             `yaml:"subjects"`
+	Storage     string               `yaml:"storage,omitempty"`   // file or memory
+	Retention   string               `yaml:"retention,omitempty"` // limits, interest or workqueue
+	Discard     string               `yaml:"discard,omitempty"`   // old or new
+	MaxAge      time.Duration        `yaml:"max_age,omitempty"`
+	MaxMsgs     int64                `yaml:"max_msgs,omitempty"`
+	MaxBytes    int64                `yaml:"max_bytes,omitempty"`
+	Replicas    int                  `yaml:"replicas,omitempty"`
+	Consumers   []ConsumerDefinition `yaml:"consumers,omitempty"`
+}
+
+// ConsumerDefinition describes a durable JetStream consumer
+type ConsumerDefinition struct {
+	Name          string        `yaml:"name"`
+	Description   string        `yaml:"description,omitempty"`
+	FilterSubject string        `yaml:"filter_subject,omitempty"`
+	DeliverPolicy string        `yaml:"deliver_policy,omitempty"` // all, last, new or last_per_subject
+	AckPolicy     string        `yaml:"ack_policy,omitempty"`     // explicit, all or none
+	AckWait       time.Duration `yaml:"ack_wait,omitempty"`
+	MaxDeliver    int           `yaml:"max_deliver,omitempty"`
+	MaxAckPending int           `yaml:"max_ack_pending,omitempty"`
+}
+
+// LoadTopology reads a topology from a YAML or JSON file
+func LoadTopology(path string) (*Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read topology file: %w", err)
+	}
+
+	// JSON is a subset of YAML, so one decoder handles both formats
+	var topology Topology
+	if err := yaml.Unmarshal(data, &topology); err != nil {
+		return nil, fmt.Errorf("failed to parse topology file: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, stream := range topology.Streams {
+		if stream.Name == "" {
+			return nil, fmt.Errorf("stream definition without a name")
+		}
+		if seen[stream.Name] {
+			return nil, fmt.Errorf("stream %s is defined more than once", stream.Name)
+		}
+		seen[stream.Name] = true
+	}
+
+	return &topology, nil
+}
+
+// StreamConfig converts the definition into a NATS stream configuration, applying server defaults
+func (d *StreamDefinition) StreamConfig() (*nats.StreamConfig, error) {
+	cfg := &nats.StreamConfig{
+		Name:        d.Name,
+		Description: d.Description,
+		Subjects:    d.Subjects,
+		MaxAge:      d.MaxAge,
+		MaxMsgs:     d.MaxMsgs,
+		MaxBytes:    d.MaxBytes,
+		Replicas:    d.Replicas,
+	}
+
+	if cfg.MaxMsgs == 0 {
+		cfg.MaxMsgs = -1
+	}
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = -1
+	}
+	if cfg.Replicas == 0 {
+		cfg.Replicas = 1
+	}
+
+	if err := parseEnum(d.Storage, "file", &cfg.Storage); err != nil {
+		return nil, fmt.Errorf("stream %s: invalid storage: %w", d.Name, err)
+	}
+	if err := parseEnum(d.Retention, "limits", &cfg.Retention); err != nil {
+		return nil, fmt.Errorf("stream %s: invalid retention: %w", d.Name, err)
+	}
+	if err := parseEnum(d.Discard, "old", &cfg.Discard); err != nil {
+		return nil, fmt.Errorf("stream %s: invalid discard policy: %w", d.Name, err)
+	}
+
+	return cfg, nil
+}
+
+// ConsumerConfig converts the definition into a durable NATS consumer configuration
+func (d *ConsumerDefinition) ConsumerConfig() (*nats.ConsumerConfig, error) {
+	cfg := &nats.ConsumerConfig{
+		Durable:       d.Name,
+		Description:   d.Description,
+		FilterSubject: d.FilterSubject,
+		AckWait:       d.AckWait,
+		MaxDeliver:    d.MaxDeliver,
+		MaxAckPending: d.MaxAckPending,
+	}
+
+	if cfg.AckWait == 0 {
+		cfg.AckWait = 30 * time.Second
+	}
+	if cfg.MaxDeliver == 0 {
+		cfg.MaxDeliver = -1
+	}
+	if cfg.MaxAckPending == 0 {
+		cfg.MaxAckPending = 1000
+	}
+
+	switch d.DeliverPolicy {
+	case "", "all", "last", "new", "last_per_subject":
+		if err := parseEnum(d.DeliverPolicy, "all", &cfg.DeliverPolicy); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("consumer %s: invalid deliver policy %q", d.Name, d.DeliverPolicy)
+	}
+	if err := parseEnum(d.AckPolicy, "explicit", &cfg.AckPolicy); err != nil {
+		return nil, fmt.Errorf("consumer %s: invalid ack policy: %w", d.Name, err)
+	}
+
+	return cfg, nil
+}
+
+// ExportTopology describes the streams on the server and their durable consumers as a topology,
+// leaving out the values StreamConfig and ConsumerConfig would default to, so a server set up by
+// hand can be brought under apply
+func ExportTopology(js nats.JetStreamContext) (*Topology, error) {
+	topology := &Topology{}
+	for info := range js.StreamsInfo() {
+		def, err := streamDefinition(&info.Config)
+		if err != nil {
+			return nil, err
+		}
+		for consumer := range js.ConsumersInfo(info.Config.Name) {
+			// Ephemeral consumers come and go with their subscribers
+			if consumer.Config.Durable == "" {
+				continue
+			}
+			consumerDef, err := consumerDefinition(&consumer.Config)
+			if err != nil {
+				return nil, err
+			}
+			def.Consumers = append(def.Consumers, *consumerDef)
+		}
+		topology.Streams = append(topology.Streams, *def)
+	}
+	return topology, nil
+}
+
+// streamDefinition converts a stream configuration back into a definition
+func streamDefinition(cfg *nats.StreamConfig) (*StreamDefinition, error) {
+	def := &StreamDefinition{
+		Name:        cfg.Name,
+		Description: cfg.Description,
+		Subjects:    cfg.Subjects,
+		MaxAge:      cfg.MaxAge,
+	}
+	if cfg.MaxMsgs > 0 {
+		def.MaxMsgs = cfg.MaxMsgs
+	}
+	if cfg.MaxBytes > 0 {
+		def.MaxBytes = cfg.MaxBytes
+	}
+	if cfg.Replicas > 1 {
+		def.Replicas = cfg.Replicas
+	}
+
+	var err error
+	if def.Storage, err = formatEnum(cfg.Storage, "file"); err != nil {
+		return nil, fmt.Errorf("stream %s: %w", cfg.Name, err)
+	}
+	if def.Retention, err = formatEnum(cfg.Retention, "limits"); err != nil {
+		return nil, fmt.Errorf("stream %s: %w", cfg.Name, err)
+	}
+	if def.Discard, err = formatEnum(cfg.Discard, "old"); err != nil {
+		return nil, fmt.Errorf("stream %s: %w", cfg.Name, err)
+	}
+	return def, nil
+}
+
+// consumerDefinition converts a durable consumer configuration back into a definition
+func consumerDefinition(cfg *nats.ConsumerConfig) (*ConsumerDefinition, error) {
+	def := &ConsumerDefinition{
+		Name:          cfg.Durable,
+		Description:   cfg.Description,
+		FilterSubject: cfg.FilterSubject,
+	}
+	if cfg.AckWait != 30*time.Second {
+		def.AckWait = cfg.AckWait
+	}
+	if cfg.MaxDeliver > 0 {
+		def.MaxDeliver = cfg.MaxDeliver
+	}
+	if cfg.MaxAckPending != 1000 {
+		def.MaxAckPending = cfg.MaxAckPending
+	}
+
+	var err error
+	if def.DeliverPolicy, err = formatEnum(cfg.DeliverPolicy, "all"); err != nil {
+		return nil, fmt.Errorf("consumer %s: %w", cfg.Durable, err)
+	}
+	if def.AckPolicy, err = formatEnum(cfg.AckPolicy, "explicit"); err != nil {
+		return nil, fmt.Errorf("consumer %s: %w", cfg.Durable, err)
+	}
+	return def, nil
+}
+
+// formatEnum encodes a policy with the name parseEnum reads, empty for the fallback
+func formatEnum(value json.Marshaler, fallback string) (string, error) {
+	data, err := value.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return "", err
+	}
+	if name == fallback {
+		return "", nil
+	}
+	return name, nil
+}
+
+// parseEnum decodes a policy name using the JSON representation understood by nats.go
+func parseEnum(value, fallback string, target json.Unmarshaler) error {
+	if value == "" {
+		value = fallback
+	}
+	return target.UnmarshalJSON([]byte(fmt.Sprintf("%q", value)))
+}
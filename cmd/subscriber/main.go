@@ -2,16 +2,30 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"text/template"
 	"time"
 
+	"github.com/kiquetal/nats-go-examples/internal/cli"
 	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/health"
 	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/metrics"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/tracing"
+	"github.com/kiquetal/nats-go-examples/internal/version"
 	"github.com/kiquetal/nats-go-examples/pkg/models"
 	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+	"github.com/kiquetal/nats-go-examples/pkg/signing"
 	"github.com/nats-io/nats.go"
 )
 
@@ -20,6 +34,32 @@ func main() {
 	configPath := flag.String("config", "", "Path to config file")
 	subject := flag.String("subject", "messages", "Subject to subscribe to")
 	queue := flag.String("queue", "", "Queue group name (optional)")
+	replyTemplate := flag.String("reply-template", "", "Reply to request messages with this template, e.g. 'ack {{.ID}}: {{.Body}}' (optional)")
+	showHeaders := flag.Bool("show-headers", false, "Display NATS headers of received messages")
+	output := flag.String("output", outputLog, "How received messages are printed: log, json (one object per line), pretty (indented JSON) or raw (the body only)")
+	saveDir := flag.String("save-dir", "", "Write each received message to a file in this directory, in the -output format (optional)")
+	execCommand := flag.String("exec", "", "Shell command run for each received message with the message on stdin; a failing command fails the message (optional)")
+	execTimeout := flag.Int("exec-timeout", 30, "Time after which the -exec command is killed in seconds")
+	var headerFilters cli.KeyValueFlag
+	flag.Var(&headerFilters, "filter-header", "Only handle messages carrying this header as key=value (repeatable)")
+	recordPath := flag.String("record", "", "Record received messages to this file for later replay (optional)")
+	drainTimeout := flag.Int("drain-timeout", 10, "Time to wait for buffered messages on shutdown in seconds")
+	verify := flag.Bool("verify", false, "Drop messages without a valid signature from a key published by key-rotator")
+	durable := flag.String("durable", "", "Consume through this durable JetStream consumer, resuming after the last acked message on restart (optional)")
+	stream := flag.String("stream", "MESSAGES", "Stream holding the subject in durable mode")
+	ackWait := flag.Int("ack-wait", 30, "Time before an unacknowledged message is redelivered in durable mode in seconds")
+	maxDeliver := flag.Int("max-deliver", 5, "Delivery attempts per message in durable mode, -1 for no limit")
+	pull := flag.Bool("pull", false, "In durable mode, fetch messages in batches from a pull consumer instead of having them pushed, for slow handlers")
+	batch := flag.Int("batch", pubsub.DefaultFetchBatch, "Messages fetched at a time with -pull, and the most in flight")
+	since := flag.String("since", "", "Replay the messages stored for the subject since a time ago, e.g. 2h, or an RFC 3339 time, then follow new ones (optional)")
+	fromSeq := flag.Uint64("from-seq", 0, "Replay the messages stored for the subject from this stream sequence, then follow new ones (optional)")
+	schemaPath := flag.String("schema", "", "JSON Schema file that message payloads must match (optional)")
+	deadLetter := flag.String("dead-letter", "", "Subject for messages that fail the schema, cannot be decoded or fail in the handler (optional)")
+	dlq := flag.Bool("dlq", false, "Send failed messages to their subject plus .dlq, unless -dead-letter is set")
+	metricsAddr := flag.String("metrics-addr", "", "Address serving Prometheus metrics on /metrics, e.g. :9103 (optional)")
+	pendingMsgs := flag.Int("pending-msgs", nats.DefaultSubPendingMsgsLimit, "Messages buffered while the handler is busy before further ones are dropped, -1 for no limit")
+	pendingBytes := flag.Int("pending-bytes", nats.DefaultSubPendingBytesLimit, "Bytes buffered while the handler is busy before further messages are dropped, -1 for no limit")
+	version.RegisterFlag(flag.CommandLine)
 	flag.Parse()
 
 	// Load configuration
@@ -28,33 +68,268 @@ func main() {
 		panic("Failed to load configuration: " + err.Error())
 	}
 
-	// Create a logger
-	log := logger.DefaultLogger("subscriber")
+	// Create a logger with the level and format from the config
+	log, err := logger.FromConfig("subscriber", appConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if *output != outputLog {
+		// Messages go to stdout so they can be piped, and the logs to stderr
+		level, _ := logger.ParseLevel(appConfig.LogLevel)
+		log = logger.NewLogger("subscriber", level, os.Stderr)
+	}
 	log.Info("Starting NATS subscriber")
 
-	// Create a new subscriber using the configuration
-	subscriber, err := pubsub.NewSubscriber(appConfig.NATS.URL)
+	// Print, save and pipe received messages as the flags ask
+	sink := &messageSink{
+		format:      *output,
+		showHeaders: *showHeaders,
+		log:         log,
+		out:         os.Stdout,
+		saveDir:     *saveDir,
+		command:     *execCommand,
+		execTimeout: time.Duration(*execTimeout) * time.Second,
+	}
+	if err := sink.validate(); err != nil {
+		log.Fatal("%v", err)
+	}
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("subscriber", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	// Create a new subscriber using the configuration, waiting for NATS to come up
+	natsConn, err := natsutil.Connect(appConfig.NATS, "subscriber", log, nats.Timeout(10*time.Second))
 	if err != nil {
 		log.Fatal("Failed to connect to NATS: %v", err)
 	}
-	defer subscriber.Close()
 
-	log.Info("Connected to NATS at %s", appConfig.NATS.URL)
+	// Metrics are collected from the start and served with -metrics-addr
+	registry := metrics.NewRegistry("subscriber")
+	slowConsumers := registry.Counter("slow_consumer_events_total", "Times the subscription fell behind and messages were dropped")
+
+	// Failed messages are logged, and forwarded to a dead-letter subject with -dlq or -dead-letter.
+	// A panicking handler fails its message instead of taking the process down, and a handler
+	// too slow for the pending limits is reported rather than silently losing messages.
+	opts := []pubsub.SubscriberOption{
+		pubsub.WithPendingLimits(*pendingMsgs, *pendingBytes),
+		pubsub.WithSlowConsumerHandler(func(sub *nats.Subscription, dropped int) {
+			slowConsumers.Inc()
+			log.Warn("Slow consumer on %s: %d messages dropped so far; speed up the handler or raise -pending-msgs and -pending-bytes", sub.Subject, dropped)
+		}),
+		pubsub.WithErrorHandler(func(msg *nats.Msg, err error) {
+			log.Warn("Failed to handle message on %s: %v", msg.Subject, err)
+		}),
+		pubsub.WithPanicHandler(func(msg *nats.Msg, err *pubsub.PanicError) {
+			log.Error("Recovered from panic handling message on %s: %v\n%s", msg.Subject, err.Value, err.Stack)
+		}),
+		pubsub.WithMiddleware(tracing.Middleware(), pubsub.Logging(log.Debug)),
+	}
+	if *deadLetter != "" || *dlq {
+		opts = append(opts, pubsub.WithDeadLetter(*deadLetter))
+	}
+	subscriber := pubsub.NewSubscriberFromConn(natsConn, opts...)
+
+	log.Info("Connected to NATS at %s", natsConn.ConnectedUrl())
+
+	// The drain timeout bounds the whole shutdown, which starts with draining the subscription
+	group := run.New(log)
+	group.SetStopTimeout(time.Duration(*drainTimeout)*time.Second + time.Second)
+	group.OnStop("subscriber", func(ctx context.Context) error {
+		subscriber.Close()
+		return nil
+	})
+
+	// Capture traffic to a file if requested
+	if *recordPath != "" {
+		recorder, err := pubsub.NewRecorder(*recordPath)
+		if err != nil {
+			log.Fatal("Failed to create recorder: %v", err)
+		}
+		group.OnStop("recorder", func(ctx context.Context) error {
+			return recorder.Close()
+		})
+		subscriber.SetRecorder(recorder)
+		log.Info("Recording messages to %s", *recordPath)
+	}
+
+	// Check signatures against the public keys distributed by key-rotator
+	if *verify {
+		js, err := subscriber.Conn().JetStream()
+		if err != nil {
+			log.Fatal("Failed to get JetStream context: %v", err)
+		}
+		verifier, err := signing.NewVerifier(js)
+		if err != nil {
+			log.Fatal("Failed to load signing keys: %v", err)
+		}
+		group.OnStop("verifier", func(ctx context.Context) error {
+			verifier.Stop()
+			return nil
+		})
+		subscriber.SetVerifier(verifier)
+		log.Info("Verifying message signatures")
+	}
+
+	// Decrypt payloads with the keys of nats.encryption, before checking their signatures
+	encrypter, err := natsutil.NewEncrypter(appConfig.NATS.Encryption)
+	if err != nil {
+		log.Fatal("Invalid nats.encryption: %v", err)
+	}
+	if encrypter != nil {
+		subscriber.SetEncrypter(encrypter)
+		log.Info("Decrypting messages with keys %v", encrypter.KeyIDs())
+	}
+
+	// Decompress payloads after decrypting them; nats.compression also compresses dead letters
+	compressor, err := natsutil.NewCompressor(appConfig.NATS.Compression)
+	if err != nil {
+		log.Fatal("Invalid nats.compression: %v", err)
+	}
+	if compressor == nil {
+		// Compressed messages are read whatever the setting, only dead letters stay as they are
+		compressor, _ = pubsub.NewCompressor("", 0)
+	} else {
+		log.Info("Compressing dead letters with %s", compressor.Encoding())
+	}
+	subscriber.SetCompressor(compressor)
+
+	// Reject payloads that do not match the schema
+	if *schemaPath != "" {
+		schema, err := pubsub.LoadSchema(*schemaPath)
+		if err != nil {
+			log.Fatal("Failed to load schema: %v", err)
+		}
+		subscriber.SetValidator(schema)
+		log.Info("Validating messages against %s", *schemaPath)
+	}
 	log.Info("Subscribing to subject: %s", *subject)
 
+	// Count handled messages so shutdown can report what was drained
+	var processed atomic.Int64
+
+	// Messages whose headers do not match the filter are skipped, and not counted
+	matches := func(msg *models.Message) bool {
+		if !matchesHeaders(msg, headerFilters.Values()) {
+			log.Debug("Skipping message %s: headers do not match filter", msg.ID)
+			return false
+		}
+		return true
+	}
+
 	// Create message handler
 	handler := func(msg *models.Message) error {
-		log.Info("Received message on subject %s:", msg.Subject)
-		log.Info("  ID: %s", msg.ID)
-		log.Info("  Body: %s", msg.Body)
-		log.Info("  Timestamp: %s", msg.Timestamp.Format(time.RFC3339))
-		log.Info("  Metadata: %v", msg.Metadata)
-		return nil
+		if !matches(msg) {
+			return nil
+		}
+		defer processed.Add(1)
+		return sink.write(msg)
+	}
+
+	if *durable != "" && (*queue != "" || *replyTemplate != "") {
+		log.Fatal("Durable mode cannot be combined with -queue or -reply-template")
+	}
+	if *pull && *durable == "" {
+		log.Fatal("-pull needs a -durable consumer")
+	}
+	replaying := *since != "" || *fromSeq > 0
+	if replaying && (*durable != "" || *queue != "" || *replyTemplate != "") {
+		log.Fatal("Replay cannot be combined with -durable, -queue or -reply-template")
+	}
+
+	// Fail fast when the account may not subscribe, rather than never receiving a message.
+	// Durable consumers and replays are delivered through JetStream, not a subscription on the
+	// subject.
+	if *durable == "" && !replaying {
+		perms := natsutil.Permissions{Subscribe: []string{strings.TrimSpace(*subject + " " + *queue)}}
+		if err := natsutil.CheckPermissions(natsConn, perms, 5*time.Second); err != nil {
+			log.Fatal("%v", err)
+		}
 	}
 
 	// Subscribe to messages
 	var sub *nats.Subscription
-	if *queue != "" {
+	if *durable != "" {
+		// Durable mode: the consumer keeps its position in the stream across restarts
+		subscriber.SetDurableOptions(pubsub.DurableOptions{
+			FilterSubject: *subject,
+			AckWait:       time.Duration(*ackWait) * time.Second,
+			MaxDeliver:    *maxDeliver,
+		})
+		if *pull {
+			// Pull mode: the next batch is fetched once the previous one is handled
+			log.Info("Using pull consumer %s on stream %s, fetching %d messages at a time", *durable, *stream, *batch)
+			var consumer *pubsub.PullConsumer
+			if consumer, err = subscriber.PullSubscribe(*stream, *durable); err == nil {
+				sub = consumer.Subscription()
+				group.Go("consumer", func(ctx context.Context) error {
+					return consumer.Run(ctx, *batch, func(m *pubsub.AckableMessage) pubsub.AckDecision {
+						if err := handler(m.Message); err != nil {
+							return pubsub.Nak(err, 0)
+						}
+						return pubsub.Ack()
+					})
+				})
+			}
+		} else {
+			log.Info("Using durable consumer %s on stream %s", *durable, *stream)
+			sub, err = subscriber.SubscribeDurable(*stream, *durable, handler)
+		}
+	} else if replaying {
+		// Replay mode: an ephemeral ordered consumer delivers the history, then new messages
+		opts := pubsub.ReplayOptions{StartSeq: *fromSeq}
+		if *since != "" {
+			if opts.Since, err = parseSince(*since, time.Now()); err != nil {
+				log.Fatal("%v", err)
+			}
+			log.Info("Replaying messages stored since %s", opts.Since.Format(time.RFC3339))
+		} else {
+			log.Info("Replaying messages from stream sequence %d", *fromSeq)
+		}
+		opts.OnCaughtUp = func() {
+			log.Info("Replay caught up after %d messages, following new ones", processed.Load())
+		}
+		sub, err = subscriber.Replay(*subject, opts, handler)
+	} else if *replyTemplate != "" {
+		// Reply mode: answer each request with a message rendered from the template
+		tmpl, err := template.New("reply").Parse(*replyTemplate)
+		if err != nil {
+			log.Fatal("Invalid reply template: %v", err)
+		}
+		log.Info("Reply mode enabled with template: %s", *replyTemplate)
+
+		replyHandler := func(msg *models.Message) (*models.Message, error) {
+			// Skipped requests get no reply, so they time out like unanswered ones
+			if !matches(msg) {
+				return nil, nil
+			}
+			if err := handler(msg); err != nil {
+				return nil, err
+			}
+
+			var body strings.Builder
+			if err := tmpl.Execute(&body, msg); err != nil {
+				log.Error("Failed to render reply for message %s: %v", msg.ID, err)
+				return nil, err
+			}
+
+			reply := models.NewMessage("", body.String())
+			reply.AddMetadata("in_reply_to", msg.ID)
+			log.Info("Replying to message %s", msg.ID)
+			return reply, nil
+		}
+
+		if *queue != "" {
+			log.Info("Using queue group: %s", *queue)
+			sub, err = subscriber.QueueSubscribeReply(*subject, *queue, replyHandler)
+		} else {
+			sub, err = subscriber.SubscribeReply(*subject, replyHandler)
+		}
+	} else if *queue != "" {
 		log.Info("Using queue group: %s", *queue)
 		sub, err = subscriber.QueueSubscribeMessage(*subject, *queue, handler)
 	} else {
@@ -64,15 +339,108 @@ func main() {
 	if err != nil {
 		log.Fatal("Failed to subscribe: %v", err)
 	}
-	defer sub.Unsubscribe()
+
+	// Answer health requests on health.subscriber
+	checks := health.New("subscriber")
+	checks.Add("nats", health.NATSConnected(natsConn))
+	checks.Add("subscription", health.SubscriptionValid(sub))
+	if _, err := checks.Respond(natsConn); err != nil {
+		log.Fatal("Failed to answer health requests: %v", err)
+	}
+
+	// Expose how well the subscription keeps up for Prometheus
+	if *metricsAddr != "" {
+		registerSubscriptionMetrics(registry, sub, &processed, log)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry.Handler())
+		group.AddServer("metrics", &http.Server{Addr: *metricsAddr, Handler: mux})
+		log.Info("Serving metrics on %s/metrics", *metricsAddr)
+	}
+
+	group.OnStop("subscription", func(ctx context.Context) error {
+		log.Info("Draining subscription...")
+		drained, dropped := drainSubscription(sub, &processed, time.Duration(*drainTimeout)*time.Second)
+		log.Info("Subscription drained: %d messages processed in total, %d processed during drain, %d dropped",
+			processed.Load(), drained, dropped)
+		return nil
+	})
 
 	log.Info("Subscriber started. Press Ctrl+C to exit.")
 
-	// Setup signal handling for graceful shutdown
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// matchesHeaders reports whether the message carries every filter header with one of the given values
+func matchesHeaders(msg *models.Message, filters map[string][]string) bool {
+	for key, wanted := range filters {
+		// NATS keeps header names as the publisher sent them, so compare them case-insensitively
+		var values []string
+		for name, v := range msg.Headers {
+			if strings.EqualFold(name, key) {
+				values = v
+				break
+			}
+		}
+
+		if !slices.ContainsFunc(wanted, func(w string) bool { return slices.Contains(values, w) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSince reads -since as a duration before now, e.g. 2h or 90m, or an RFC 3339 time
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("-since must be a positive duration, got %s", value)
+		}
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("-since must be a duration such as 2h or an RFC 3339 time, got %q", value)
+	}
+	return t, nil
+}
+
+// drainSubscription stops the subscription from receiving new messages and waits for
+// buffered messages to be handled. It returns how many messages were processed during
+// the drain and how many were dropped (slow consumer drops plus anything left when the timeout expired).
+func drainSubscription(sub *nats.Subscription, processed *atomic.Int64, timeout time.Duration) (int64, int64) {
+	before := processed.Load()
+
+	pending, _, err := sub.Pending()
+	if err != nil {
+		return 0, 0
+	}
+
+	var dropped int64
+	if n, err := sub.Dropped(); err == nil {
+		dropped = int64(n)
+	}
+
+	if err := sub.Drain(); err != nil {
+		sub.Unsubscribe()
+		return 0, dropped + int64(pending)
+	}
+
+	// The subscription becomes invalid once all buffered messages have been handled
+	deadline := time.Now().Add(timeout)
+	for sub.IsValid() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	drained := processed.Load() - before
+	if sub.IsValid() {
+		// Drain timed out, whatever is still buffered will never be handled
+		sub.Unsubscribe()
+		if left := int64(pending) - drained; left > 0 {
+			dropped += left
+		}
+	}
 
-	// Wait for termination signal
-	<-signals
-	log.Info("Received shutdown signal, exiting...")
+	return drained, dropped
 }
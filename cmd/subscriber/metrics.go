@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/metrics"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+	"github.com/nats-io/nats.go"
+)
+
+// statsMaxAge is how long a snapshot of the subscription's statistics is reused, so one
+// scrape asks the server for the consumer's state once rather than once per gauge
+const statsMaxAge = time.Second
+
+// subscriptionStats caches the statistics of the subscription between scrapes
+type subscriptionStats struct {
+	sub *nats.Subscription
+	log *logger.Logger
+
+	mu      sync.Mutex
+	stats   pubsub.SubscriptionStats
+	fetched time.Time
+}
+
+// get returns the statistics, read again once they are older than statsMaxAge. Failures are
+// logged and leave the previous values.
+func (s *subscriptionStats) get() pubsub.SubscriptionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.fetched) < statsMaxAge {
+		return s.stats
+	}
+	s.fetched = time.Now()
+	stats, err := pubsub.Stats(s.sub)
+	if err != nil {
+		s.log.Warn("Failed to read subscription statistics: %v", err)
+		return s.stats
+	}
+	s.stats = stats
+	return stats
+}
+
+// registerSubscriptionMetrics exposes whether the subscription keeps up with its messages
+func registerSubscriptionMetrics(registry *metrics.Registry, sub *nats.Subscription, processed *atomic.Int64, log *logger.Logger) {
+	stats := &subscriptionStats{sub: sub, log: log}
+	registry.CounterFunc("messages_processed_total", "Messages handled by the subscriber", func() float64 {
+		return float64(processed.Load())
+	})
+	registry.CounterFunc("messages_delivered_total", "Messages handed to the handler by the client", func() float64 {
+		return float64(stats.get().Delivered)
+	})
+	registry.GaugeFunc("messages_pending", "Messages received and not yet handled", func() float64 {
+		return float64(stats.get().Pending)
+	})
+	registry.GaugeFunc("pending_bytes", "Bytes of the messages received and not yet handled", func() float64 {
+		return float64(stats.get().PendingBytes)
+	})
+	registry.CounterFunc("messages_dropped_total", "Messages dropped by the client as a slow consumer", func() float64 {
+		return float64(stats.get().Dropped)
+	})
+	registry.GaugeFunc("consumer_pending", "Messages in the stream not yet delivered to the JetStream consumer", func() float64 {
+		return float64(stats.get().ConsumerPending)
+	})
+	registry.GaugeFunc("consumer_ack_pending", "Messages delivered by the JetStream consumer and not yet acked", func() float64 {
+		return float64(stats.get().AckPending)
+	})
+	registry.GaugeFunc("consumer_redelivered", "Messages redelivered by the JetStream consumer and not yet acked", func() float64 {
+		return float64(stats.get().Redelivered)
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+)
+
+// Output formats of received messages
+const (
+	outputLog    = "log"    // log lines, the default
+	outputJSON   = "json"   // one JSON object per line
+	outputPretty = "pretty" // indented JSON
+	outputRaw    = "raw"    // the body only
+)
+
+// unsafeFileChars are replaced in message IDs used as file names
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// printedMessage is a received message as it is printed, saved and piped: the message and,
+// with -show-headers, its NATS headers
+type printedMessage struct {
+	*models.Message
+	Headers map[string][]string `json:"headers,omitempty"`
+}
+
+// messageSink writes received messages to stdout, to files in a directory and to the stdin of
+// an external command
+type messageSink struct {
+	format      string
+	showHeaders bool
+	log         *logger.Logger
+	out         io.Writer
+
+	saveDir     string        // write each message to a file here, if set
+	command     string        // run this shell command for each message, if set
+	execTimeout time.Duration // after which the command is killed
+}
+
+// validate checks the format and creates the save directory
+func (s *messageSink) validate() error {
+	switch s.format {
+	case outputLog, outputJSON, outputPretty, outputRaw:
+	default:
+		return fmt.Errorf("unknown output format %q, expected %s, %s, %s or %s", s.format, outputLog, outputJSON, outputPretty, outputRaw)
+	}
+	if s.saveDir != "" {
+		if err := os.MkdirAll(s.saveDir, 0755); err != nil {
+			return fmt.Errorf("failed to create the save directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// write prints the message in the output format, then saves it and pipes it to the command
+// in the same format, JSON for log output. A failing command fails the message.
+func (s *messageSink) write(msg *models.Message) error {
+	if s.format == outputLog {
+		s.log.Info("Received message on subject %s:", msg.Subject)
+		s.log.Info("  ID: %s", msg.ID)
+		s.log.Info("  Body: %s", msg.Body)
+		s.log.Info("  Timestamp: %s", msg.Timestamp.Format(time.RFC3339))
+		s.log.Info("  Metadata: %v", msg.Metadata)
+		if s.showHeaders {
+			s.log.Info("  Headers: %v", msg.Headers)
+		}
+	}
+	if s.format != outputLog || s.saveDir != "" || s.command != "" {
+		data, err := s.encode(msg)
+		if err != nil {
+			return fmt.Errorf("failed to encode message: %w", err)
+		}
+		if s.format != outputLog {
+			s.out.Write(data)
+		}
+		if s.saveDir != "" {
+			if err := s.save(msg, data); err != nil {
+				return err
+			}
+		}
+		if s.command != "" {
+			return s.exec(msg, data)
+		}
+	}
+	return nil
+}
+
+// encode returns the message in the output format, followed by a newline
+func (s *messageSink) encode(msg *models.Message) ([]byte, error) {
+	if s.format == outputRaw {
+		return []byte(msg.Body + "\n"), nil
+	}
+	printed := printedMessage{Message: msg}
+	if s.showHeaders {
+		printed.Headers = msg.Headers
+	}
+	var data []byte
+	var err error
+	if s.format == outputPretty {
+		data, err = json.MarshalIndent(printed, "", "  ")
+	} else {
+		data, err = json.Marshal(printed)
+	}
+	return append(data, '\n'), err
+}
+
+// save writes the message to a file named after its receive time and ID, so the files sort
+// in the order the messages arrived
+func (s *messageSink) save(msg *models.Message, data []byte) error {
+	ext := ".json"
+	if s.format == outputRaw {
+		ext = ".txt"
+	}
+	name := fmt.Sprintf("%d-%s%s", time.Now().UnixNano(), unsafeFileChars.ReplaceAllString(msg.ID, "_"), ext)
+	if err := os.WriteFile(filepath.Join(s.saveDir, name), data, 0644); err != nil {
+		return fmt.Errorf("failed to save message: %w", err)
+	}
+	return nil
+}
+
+// exec runs the command with the message on stdin and its subject and ID in NATS_SUBJECT and
+// NATS_MSG_ID. The command's output goes to the subscriber's.
+func (s *messageSink) exec(msg *models.Message, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.execTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", s.command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout, cmd.Stderr = s.out, os.Stderr
+	cmd.Env = append(os.Environ(), "NATS_SUBJECT="+msg.Subject, "NATS_MSG_ID="+msg.ID)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("command failed for message %s: %w", msg.ID, err)
+	}
+	return nil
+}
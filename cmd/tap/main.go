@@ -0,0 +1,230 @@
+// Package main implements a wiretap that inspects NATS traffic
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	redacted = "[REDACTED]"
+	// requestExpiry bounds how long a request waits for its reply before it is forgotten
+	requestExpiry = time.Minute
+)
+
+// secretFields are JSON keys whose values are never shown or captured
+var secretFields = map[string]bool{
+	"client_secret": true,
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token":      true,
+	"password":      true,
+	"subject_token": true,
+	"actor_token":   true,
+	"token":         true,
+	"secret":        true,
+}
+
+// pendingRequest tracks a request until its reply is seen
+type pendingRequest struct {
+	subject string
+	sentAt  time.Time
+}
+
+// Tap prints and optionally captures the messages it observes
+type Tap struct {
+	mu       sync.Mutex
+	pending  map[string]pendingRequest
+	recorder *pubsub.Recorder
+	redact   bool
+	raw      bool
+}
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file")
+	subject := flag.String("subject", ">", "Subject or wildcard to tap")
+	capturePath := flag.String("capture", "", "Write observed messages to this file for replay with the publisher (optional)")
+	noRedact := flag.Bool("no-redact", false, "Show and capture secrets such as client_secret and access_token")
+	raw := flag.Bool("raw", false, "Print payloads as received instead of pretty-printed")
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Logs go to stderr so the traffic on stdout can be piped
+	level, _ := logger.ParseLevel(appConfig.LogLevel)
+	log := logger.NewLogger("tap", level, os.Stderr)
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("tap", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	tap := &Tap{
+		pending: make(map[string]pendingRequest),
+		redact:  !*noRedact,
+		raw:     *raw,
+	}
+
+	group := run.New(log)
+	if *capturePath != "" {
+		tap.recorder, err = pubsub.NewRecorder(*capturePath)
+		if err != nil {
+			log.Fatal("Failed to create capture file: %v", err)
+		}
+		group.OnStop("capture", func(ctx context.Context) error {
+			return tap.recorder.Close()
+		})
+		log.Info("Capturing messages to %s", *capturePath)
+	}
+
+	natsConn, err := natsutil.Connect(appConfig.NATS, "nats-tap", log)
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+	group.AddConn("nats", natsConn)
+
+	sub, err := natsConn.Subscribe(*subject, tap.handle)
+	if err != nil {
+		log.Fatal("Failed to subscribe to %s: %v", *subject, err)
+	}
+	// Taps see a lot of traffic, so never drop messages silently
+	sub.SetPendingLimits(-1, -1)
+
+	if !tap.redact {
+		log.Warn("Secret redaction is disabled")
+	}
+	log.Info("Tapping %s on %s. Press Ctrl+C to exit.", *subject, natsConn.ConnectedUrl())
+
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// handle prints a single observed message
+func (t *Tap) handle(msg *nats.Msg) {
+	now := time.Now()
+	data := msg.Data
+	kind := "raw"
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &payload); err == nil {
+		kind = classify(payload)
+		if t.redact {
+			redactFields(payload)
+			if redactedData, err := json.Marshal(payload); err == nil {
+				data = redactedData
+			}
+		}
+		if !t.raw {
+			if pretty, err := json.MarshalIndent(payload, "    ", "  "); err == nil {
+				data = pretty
+			}
+		}
+	}
+
+	var line strings.Builder
+	fmt.Fprintf(&line, "%s %s [%s]", now.Format("15:04:05.000"), msg.Subject, kind)
+
+	t.mu.Lock()
+	if msg.Reply != "" {
+		t.pending[msg.Reply] = pendingRequest{subject: msg.Subject, sentAt: now}
+		fmt.Fprintf(&line, " reply-to=%s", msg.Reply)
+	}
+	if request, found := t.pending[msg.Subject]; found {
+		delete(t.pending, msg.Subject)
+		fmt.Fprintf(&line, " reply to %s after %s", request.subject, now.Sub(request.sentAt).Round(time.Microsecond))
+	}
+	t.expire(now)
+	t.mu.Unlock()
+
+	for key, values := range msg.Header {
+		fmt.Fprintf(&line, "\n    %s: %s", key, strings.Join(values, ", "))
+	}
+	fmt.Fprintf(&line, "\n    %s", data)
+	fmt.Println(line.String())
+
+	if t.recorder != nil {
+		captured := &nats.Msg{Subject: msg.Subject, Header: msg.Header, Data: msg.Data}
+		if t.redact && kind != "raw" {
+			captured.Data, _ = json.Marshal(payload)
+		}
+		t.recorder.Record(captured)
+	}
+}
+
+// expire forgets requests whose reply never arrived; callers must hold the lock
+func (t *Tap) expire(now time.Time) {
+	for inbox, request := range t.pending {
+		if now.Sub(request.sentAt) > requestExpiry {
+			delete(t.pending, inbox)
+		}
+	}
+}
+
+// classify guesses the model type of a decoded JSON payload
+func classify(payload map[string]interface{}) string {
+	has := func(key string) bool {
+		_, found := payload[key]
+		return found
+	}
+
+	switch {
+	case has("client_id") && (has("client_secret") || has("request_id")):
+		// Token requests carry their request ID in a header, older requesters in the body
+		return "TokenRequest"
+	case has("request_id") && (has("access_token") || has("error")):
+		return "TokenResponse"
+	case has("worker") && has("started_at"):
+		return "Heartbeat"
+	case has("subject") && has("body"):
+		return "Message"
+	default:
+		return "json"
+	}
+}
+
+// redactFields replaces secret values in a decoded JSON payload, recursing into nested objects
+func redactFields(payload map[string]interface{}) {
+	for key, value := range payload {
+		if secretFields[strings.ToLower(key)] {
+			if s, ok := value.(string); ok && s == "" {
+				continue
+			}
+			payload[key] = redacted
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			redactFields(nested)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cachedToken is a token stored on disk between invocations
+type cachedToken struct {
+	AccessToken string    `json:"access_token"`
+	TokenType   string    `json:"token_type"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// valid reports whether the token is still usable, keeping a safety margin before expiry
+func (t *cachedToken) valid() bool {
+	return t.AccessToken != "" && time.Until(t.ExpiresAt) > 30*time.Second
+}
+
+// tokenStore persists tokens per client ID under the user's config directory
+type tokenStore struct {
+	path string
+}
+
+// newTokenStore returns the store at ~/.config/nats-go-examples/tokens.json (or the OS equivalent)
+func newTokenStore() (*tokenStore, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate config directory: %w", err)
+	}
+	return &tokenStore{path: filepath.Join(dir, "nats-go-examples", "tokens.json")}, nil
+}
+
+// load reads all cached tokens; a missing file is an empty cache
+func (s *tokenStore) load() (map[string]*cachedToken, error) {
+	tokens := make(map[string]*cachedToken)
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token cache: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse token cache: %w", err)
+	}
+	return tokens, nil
+}
+
+// get returns the cached token for the client if it is still valid
+func (s *tokenStore) get(clientID string) (*cachedToken, bool) {
+	tokens, err := s.load()
+	if err != nil {
+		return nil, false
+	}
+	token, found := tokens[clientID]
+	if !found || !token.valid() {
+		return nil, false
+	}
+	return token, true
+}
+
+// put stores the token for the client, readable only by the current user
+func (s *tokenStore) put(clientID string, token *cachedToken) error {
+	tokens, err := s.load()
+	if err != nil {
+		return err
+	}
+	tokens[clientID] = token
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create token cache directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal token cache: %w", err)
+	}
+
+	if err := os.WriteFile(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write token cache: %w", err)
+	}
+	return nil
+}
+
+// clear removes the cache file
+func (s *tokenStore) clear() error {
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove token cache: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+// Package main implements a developer utility for obtaining and inspecting tokens
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/auth"
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/health"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/secrets"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	tokenSubject = "token.request"
+	usage        = `Usage: token-cli [flags] <command> [args]
+
+Commands:
+  get             Print an access token, using the local cache when possible
+  decode [token]  Decode the JWT header and claims (defaults to the cached or a new token)
+  header          Print an Authorization header, e.g. curl -H "$(token-cli header)" ...
+  clear           Remove all cached tokens
+  status [count]  Ask every token worker for its health, waiting -timeout or until count answered
+
+Flags:
+`
+)
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "", "Path to config file")
+	mode := flag.String("mode", "nats", "How to obtain tokens: nats (token workers) or http (brain-app)")
+	brainURL := flag.String("url", "http://localhost:8080/token", "brain-app token endpoint (http mode)")
+	apiKey := flag.String("api-key", os.Getenv("BRAIN_API_KEY"), "API key sent to brain-app in the X-API-Key header (http mode) (default $BRAIN_API_KEY)")
+	clientID := flag.String("client-id", os.Getenv("TOKEN_CLI_CLIENT_ID"), "Client ID (default $TOKEN_CLI_CLIENT_ID)")
+	clientSecret := flag.String("client-secret", os.Getenv("TOKEN_CLI_CLIENT_SECRET"), "Client secret (default $TOKEN_CLI_CLIENT_SECRET)")
+	realm := flag.String("realm", "", "IDP realm configured on the token workers, the default IDP if empty (nats mode)")
+	refresh := flag.Bool("refresh", false, "Ignore the cached token and request a new one")
+	timeout := flag.Int("timeout", 5, "Request timeout in seconds")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	store, err := newTokenStore()
+	if err != nil {
+		fail("%v", err)
+	}
+
+	fetch := func() *cachedToken {
+		if *clientID == "" || *clientSecret == "" {
+			fail("-client-id and -client-secret are required")
+		}
+		if *realm != "" && *mode != "nats" {
+			fail("-realm needs -mode nats")
+		}
+		// Tokens of other realms are cached apart
+		cacheKey := *clientID
+		if *realm != "" {
+			cacheKey = *realm + "/" + *clientID
+		}
+		if !*refresh {
+			if token, found := store.get(cacheKey); found {
+				return token
+			}
+		}
+
+		appConfig, err := config.LoadConfig(*configPath)
+		if err != nil {
+			fail("Failed to load configuration: %v", err)
+		}
+
+		// Log level and format come from the config
+		if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+			fail("Invalid logging configuration: %v", err)
+		}
+
+		// Export traces and metrics when a collector is configured; stdout only carries the token
+		log := logger.NewLogger("token-cli", logger.WARN, os.Stderr)
+		tel, err := telemetry.Setup("token-cli", appConfig, log)
+		if err != nil {
+			fail("Failed to set up telemetry: %v", err)
+		}
+		defer tel.Shutdown()
+
+		// The client secret may be a reference such as env://CLIENT_SECRET or aws://token-cli#secret
+		secret, err := secrets.New(appConfig.Secrets).Resolve(context.Background(), *clientSecret)
+		if err != nil {
+			fail("Failed to resolve -client-secret: %v", err)
+		}
+
+		requestTimeout := time.Duration(*timeout) * time.Second
+		var token *cachedToken
+		switch *mode {
+		case "nats":
+			token, err = requestViaNATS(appConfig.NATS, log, *realm, *clientID, secret, requestTimeout)
+		case "http":
+			token, err = requestViaHTTP(*brainURL, *apiKey, *clientID, secret, requestTimeout)
+		default:
+			err = fmt.Errorf("unknown mode %q, expected nats or http", *mode)
+		}
+		if err != nil {
+			fail("Failed to obtain token: %v", err)
+		}
+
+		if err := store.put(cacheKey, token); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+		return token
+	}
+
+	args := flag.Args()
+	switch args[0] {
+	case "get":
+		fmt.Println(fetch().AccessToken)
+
+	case "header":
+		token := fetch()
+		tokenType := token.TokenType
+		if tokenType == "" {
+			tokenType = "Bearer"
+		}
+		fmt.Printf("Authorization: %s %s\n", tokenType, token.AccessToken)
+
+	case "decode":
+		var raw string
+		if len(args) > 1 {
+			raw = args[1]
+		} else {
+			raw = fetch().AccessToken
+		}
+		decoded, err := decodeJWT(raw)
+		if err != nil {
+			fail("Failed to decode token: %v", err)
+		}
+		fmt.Println(decoded)
+
+	case "clear":
+		if err := store.clear(); err != nil {
+			fail("%v", err)
+		}
+		fmt.Fprintln(os.Stderr, "Token cache cleared")
+
+	case "status":
+		count := 0
+		if len(args) > 1 {
+			if count, err = strconv.Atoi(args[1]); err != nil || count < 0 {
+				fail("Invalid worker count %q", args[1])
+			}
+		}
+		appConfig, err := config.LoadConfig(*configPath)
+		if err != nil {
+			fail("Failed to load configuration: %v", err)
+		}
+		log := logger.NewLogger("token-cli", logger.WARN, os.Stderr)
+
+		reports, err := workerStatus(appConfig.NATS, log, count, time.Duration(*timeout)*time.Second)
+		if err != nil && !errors.Is(err, nats.ErrNoResponders) {
+			fail("Failed to query token workers: %v", err)
+		}
+		if !printStatus(reports) {
+			os.Exit(1)
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// fail prints an error to stderr and exits
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+// requestViaNATS asks the token workers directly, for a token of the realm's IDP
+func requestViaNATS(cfg config.NATSConfig, log *logger.Logger, realm, clientID, clientSecret string, timeout time.Duration) (*cachedToken, error) {
+	nc, err := natsutil.Connect(cfg, "token-cli", log)
+	if err != nil {
+		return nil, err
+	}
+	defer nc.Close()
+
+	request := models.NewTokenRequest(clientID, clientSecret)
+	request.Realm = realm
+	reqData, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := nc.RequestMsg(pubsub.NewRequestMsg(nc, tokenSubject, models.NewRequestID(), reqData), timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var response models.TokenResponse
+	if err := json.Unmarshal(msg.Data, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse token response: %w", err)
+	}
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+
+	return &cachedToken{
+		AccessToken: response.AccessToken,
+		TokenType:   response.TokenType,
+		ExpiresAt:   time.Now().Add(time.Duration(response.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// workerStatus collects the health report of every token worker that answers within the window
+func workerStatus(cfg config.NATSConfig, log *logger.Logger, count int, window time.Duration) ([]health.Report, error) {
+	nc, err := natsutil.Connect(cfg, "token-cli", log)
+	if err != nil {
+		return nil, err
+	}
+	defer nc.Close()
+
+	replies, err := pubsub.Gather(context.Background(), nc, health.SubjectPrefix+"token-worker", nil, count, window)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]health.Report, 0, len(replies))
+	for _, reply := range replies {
+		var report health.Report
+		if err := json.Unmarshal(reply.Data, &report); err != nil {
+			log.Warn("Ignoring malformed health report: %v", err)
+			continue
+		}
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Host < reports[j].Host })
+	return reports, nil
+}
+
+// printStatus prints a line per worker with its failing checks and reports whether all are up
+func printStatus(reports []health.Report) bool {
+	if len(reports) == 0 {
+		fmt.Fprintln(os.Stderr, "No token worker answered")
+		return false
+	}
+
+	healthy := true
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tVERSION\tSTATUS\tFAILING CHECKS")
+	for _, report := range reports {
+		var failing []string
+		for name, result := range report.Checks {
+			if result.Status != health.StatusUp {
+				failing = append(failing, fmt.Sprintf("%s (%s)", name, result.Error))
+			}
+		}
+		sort.Strings(failing)
+		if report.Status != health.StatusUp {
+			healthy = false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", report.Host, report.Version, report.Status, strings.Join(failing, ", "))
+	}
+	w.Flush()
+	return healthy
+}
+
+// requestViaHTTP asks the brain-app, which may answer from its own cache. apiKey, if set,
+// authenticates the request.
+func requestViaHTTP(url, apiKey, clientID, clientSecret string, timeout time.Duration) (*cachedToken, error) {
+	body, err := json.Marshal(map[string]string{"client_id": clientID, "client_secret": clientSecret})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set(auth.APIKeyHeader, apiKey)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var message bytes.Buffer
+		message.ReadFrom(resp.Body)
+		return nil, fmt.Errorf("brain-app returned %d: %s", resp.StatusCode, strings.TrimSpace(message.String()))
+	}
+
+	var payload map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, fmt.Errorf("failed to parse token response: %w", err)
+	}
+
+	token := &cachedToken{AccessToken: payload["access_token"], TokenType: payload["token_type"]}
+	if expiresIn, err := strconv.Atoi(payload["expires_in"]); err == nil {
+		token.ExpiresAt = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	} else if exp, ok := jwtExpiry(token.AccessToken); ok {
+		// Cached responses from the brain-app carry no expiry, fall back to the JWT claim
+		token.ExpiresAt = exp
+	}
+	return token, nil
+}
+
+// decodeJWT returns the header and claims of a JWT as indented JSON, without verifying the signature
+func decodeJWT(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("not a JWT (expected three dot-separated parts)")
+	}
+
+	var decoded [2]map[string]interface{}
+	for i := range decoded {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			return "", fmt.Errorf("malformed segment %d: %w", i+1, err)
+		}
+		if err := json.Unmarshal(data, &decoded[i]); err != nil {
+			return "", fmt.Errorf("malformed JSON in segment %d: %w", i+1, err)
+		}
+	}
+
+	// Add readable timestamps next to the numeric claims
+	for _, claim := range []string{"exp", "iat", "nbf"} {
+		if seconds, ok := decoded[1][claim].(float64); ok {
+			decoded[1][claim+"_time"] = time.Unix(int64(seconds), 0).Format(time.RFC3339)
+		}
+	}
+
+	out, err := json.MarshalIndent(map[string]interface{}{"header": decoded[0], "claims": decoded[1]}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// jwtExpiry extracts the exp claim from a JWT
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(data, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
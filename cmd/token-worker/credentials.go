@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/kiquetal/nats-go-examples/internal/credentials"
+	"github.com/kiquetal/nats-go-examples/internal/idp"
+	"github.com/kiquetal/nats-go-examples/internal/secrets"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+	"github.com/nats-io/nats.go"
+)
+
+// requestCredentials checks the signatures of token requests and holds the store of the client
+// secrets requesters leave out, which the worker.Service reads
+type requestCredentials struct {
+	trusted []string
+	replays *pubsub.ReplayGuard // shared by every config, so reloads do not forget served requests
+	store   *credentials.Store
+}
+
+// newRequestCredentials creates the checks for the credentials config, resolving the stored
+// secrets with resolver and refusing signed requests already seen by replays
+func newRequestCredentials(cfg credentials.Config, resolver *secrets.Resolver, replays *pubsub.ReplayGuard) *requestCredentials {
+	return &requestCredentials{
+		trusted: cfg.TrustedKeys,
+		replays: replays,
+		store:   credentials.NewStore(cfg.Clients, resolver),
+	}
+}
+
+// verify checks that the request is signed by a trusted key, when trusted keys are configured,
+// and returns the signer. Signed requests must carry a request ID and a deadline, and are
+// served once, so a copy sent again with another reply subject gets nothing. Failures are
+// refused with unauthorized_client.
+func (c *requestCredentials) verify(msg *nats.Msg) (string, error) {
+	if len(c.trusted) == 0 {
+		return "", nil
+	}
+	signer, err := pubsub.Verify(msg, c.trusted)
+	if err == nil {
+		err = c.replays.Check(msg)
+	}
+	if err != nil {
+		return signer, &idp.Error{Code: idp.ErrCodeUnauthorizedClient, Description: err.Error()}
+	}
+	return signer, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+	"github.com/nats-io/nats.go"
+)
+
+// replySender sends a reply built by a responder. A non-empty code marks the request as failed.
+type replySender func(reply *nats.Msg, code, description string) error
+
+// serveEncrypted decrypts a request in place before handle sees it, with enc if encryption is
+// configured, and has handle's replies encrypted under the key of the request, which the
+// requester is sure to hold. Requests that cannot be decrypted are refused with
+// invalid_request, in plain text, and the reason is returned.
+func serveEncrypted(enc *pubsub.Encrypter, msg *nats.Msg, send replySender, handle requestHandler) error {
+	var keyID string
+	var err error
+	if enc != nil {
+		keyID, err = enc.Decrypt(msg)
+	}
+	if err != nil {
+		keyID = ""
+	}
+	respond := func(data []byte, code, description string) error {
+		reply := pubsub.NewReplyMsg(msg, data)
+		if keyID != "" {
+			// The request was decrypted with this key, so it is known
+			enc.EncryptWithKey(reply, keyID)
+		}
+		return send(reply, code, description)
+	}
+	if err != nil {
+		sendErrorResponse(respond, pubsub.RequestID(msg), models.ErrCodeInvalidRequest,
+			fmt.Sprintf("Failed to decrypt the request: %v", err), errCodeBadRequest)
+		return err
+	}
+	handle(msg, respond)
+	return nil
+}
@@ -2,82 +2,181 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
-	"os/signal"
-	"sync"
-	"syscall"
+	"reflect"
+	"runtime/debug"
+	"sync/atomic"
 	"time"
 
+	"github.com/kiquetal/nats-go-examples/internal/chaos"
 	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/health"
 	"github.com/kiquetal/nats-go-examples/internal/idp"
 	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/metrics"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/pool"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/secrets"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/tracing"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/internal/worker"
 	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
 )
 
 const (
-	tokenSubject = "token.request"
-	defaultQueue = "token-workers"
+	tokenSubject      = "token.request"
+	defaultQueue      = "token-workers"
+	heartbeatInterval = 10 * time.Second
 )
 
-// createTokenRequestHandler returns a callback function for processing token requests
-func createTokenRequestHandler(idpClient *idp.Client, log *logger.Logger) nats.MsgHandler {
-	return func(msg *nats.Msg) {
+// workerMetrics are the token pipeline metrics exposed on /metrics
+type workerMetrics struct {
+	requests    *metrics.Counter   // by result: ok, error, expired, dropped or rejected
+	idpLatency  *metrics.Histogram // by result: ok or error
+	tokenErrors *metrics.Counter   // failed token requests by reason
+	panics      *metrics.Counter   // recovered handler panics by subject
+}
+
+// newWorkerMetrics registers the token pipeline metrics, including the load of the worker
+// pool and of the IDP
+func newWorkerMetrics(registry *metrics.Registry, inFlight, idpInFlight *atomic.Int64, workers *pool.Pool) *workerMetrics {
+	registry.GaugeFunc("requests_in_flight", "Token requests being handled", func() float64 {
+		return float64(inFlight.Load())
+	})
+	registry.GaugeFunc("queue_depth", "Requests waiting for a free worker", func() float64 {
+		return float64(workers.Queued())
+	})
+	registry.GaugeFunc("idp_requests_in_flight", "IDP calls waiting for a response", func() float64 {
+		return float64(idpInFlight.Load())
+	})
+	return &workerMetrics{
+		requests:    registry.Counter("requests_total", "Token requests handled by result", "result"),
+		idpLatency:  registry.Histogram("idp_request_duration_seconds", "IDP token call latency in seconds", nil, "result"),
+		tokenErrors: registry.Counter("token_errors_total", "Failed token requests by reason", "reason"),
+		panics:      registry.Counter("panics_total", "Requests whose handler panicked by subject", "subject"),
+	}
+}
+
+// createTokenRequestHandler returns a callback function for processing token requests, which
+// replies through respond so it serves both the plain subscription and the micro service. The
+// service obtains the tokens; the handler checks signatures, tracks deadlines and replies.
+func createTokenRequestHandler(ctx context.Context, service *worker.Service, creds *atomic.Pointer[requestCredentials], log *logger.Logger, processed *atomic.Int64, injector *chaos.Injector, m *workerMetrics) requestHandler {
+	return func(msg *nats.Msg, respond responder) {
+		// Permission probes from clients starting up carry no request
+		if natsutil.IsProbe(msg) {
+			return
+		}
+		defer processed.Add(1)
+
+		// Continue the requester's trace, so the IDP call shows up under brain-app's request
+		ctx, span := tracing.StartHandler(ctx, msg)
+		defer span.End()
+
 		// Parse the token request
 		var request models.TokenRequest
 		if err := json.Unmarshal(msg.Data, &request); err != nil {
 			log.Error("Failed to parse token request: %v", err)
-			sendErrorResponse(msg, "", "Invalid request format")
+			tracing.Fail(span, err)
+			sendErrorResponse(respond, "", models.ErrCodeInvalidRequest, "Invalid request format", errCodeBadRequest)
+			m.requests.Inc("error")
+			m.tokenErrors.Inc("invalid_request")
 			return
 		}
 
+		// With trusted keys configured, only signed requests are served
+		signer, err := creds.Load().verify(msg)
+		if err != nil {
+			log.Warn("Refusing token request %s for client ID %s: %v", pubsub.RequestID(msg), request.ClientID, err)
+			tracing.Fail(span, err)
+			sendIDPError(respond, pubsub.RequestID(msg), err)
+			m.requests.Inc("error")
+			m.tokenErrors.Inc("signature")
+			return
+		}
+
+		// The request ID travels in a header; older requesters put it in the body. Every line
+		// about this request carries its IDs, so aggregators can group them.
+		if id := pubsub.RequestID(msg); id != "" {
+			request.RequestID = id
+		}
+		log := log.With("request_id", request.RequestID, "client_id", request.ClientID)
+		if request.Realm != "" {
+			log = log.With("realm", request.Realm)
+		}
+		if client := pubsub.ClientName(msg); client != "" {
+			log = log.With("client", client)
+		}
+		if signer != "" {
+			log = log.With("signer", signer)
+		}
 		log.Info("Received token request for client ID: %s (Request ID: %s)",
 			request.ClientID, request.RequestID)
 
-		// Create credentials from the request
-		credentials := &idp.ClientCredentials{
-			ClientID:     request.ClientID,
-			ClientSecret: request.ClientSecret,
-			Scope:        "openid profile",
+		// Stop working on the request once the requester has given up on it. The IDP is sent
+		// the request ID too.
+		ctx, cancel := pubsub.ContextFromMsg(idp.WithRequestID(ctx, request.RequestID), msg)
+		defer cancel()
+		if signer != "" {
+			// Only verified requests are given the stored client secrets
+			ctx = worker.WithSigner(ctx, signer)
+		}
+		if ctx.Err() != nil {
+			log.Warn("Dropping token request %s: requester deadline already passed", request.RequestID)
+			m.requests.Inc("expired")
+			return
 		}
 
-		var response *models.TokenResponse
-
-		// Obtain token from IDP
-		// For development/testing, use the simulation method
-		// In production, use the real method: idpClient.GetTokenWithClientCredentials
-		tokenResp, err := idpClient.GetTokenWithClientCredentials(credentials)
+		// Obtain token from IDP with the requested grant
+		response, err := service.ProcessRequest(ctx, &request)
 		if err != nil {
-			log.Error("Failed to obtain token: %v", err)
-			sendErrorResponse(msg, request.RequestID, err.Error())
+			tracing.Fail(span, err)
+			sendIDPError(respond, request.RequestID, err)
+			m.requests.Inc("error")
+			var failed *worker.Error
+			if errors.As(err, &failed) {
+				m.tokenErrors.Inc(failed.Stage)
+			}
 			return
 		}
 
-		log.Info("Token obtained for client ID: %s", request.ClientID)
-		response = models.NewTokenResponse(
-			request.RequestID,
-			tokenResp.AccessToken,
-			tokenResp.TokenType,
-			tokenResp.Scope,
-			tokenResp.ExpiresIn,
-		)
-
 		// Marshal the response
 		respData, err := json.Marshal(response)
 		if err != nil {
 			log.Error("Failed to marshal token response: %v", err)
-			sendErrorResponse(msg, request.RequestID, "Internal server error")
+			tracing.Fail(span, err)
+			sendErrorResponse(respond, request.RequestID, models.ErrCodeInternal, "Internal server error", errCodeInternal)
+			m.requests.Inc("error")
+			m.tokenErrors.Inc("internal")
 			return
 		}
 
+		// Fault injection: lose or corrupt the reply
+		if injector.ShouldDrop() {
+			m.requests.Inc("dropped")
+			return
+		}
+		respData = injector.Malform(respData)
+
 		// Reply to the request
-		if err := msg.Respond(respData); err != nil {
+		if err := respond(respData, "", ""); err != nil {
 			log.Error("Failed to send response: %v", err)
+			tracing.Fail(span, err)
+			m.requests.Inc("error")
+			m.tokenErrors.Inc("reply")
 			return
 		}
+		m.requests.Inc("ok")
 
 		log.Info("Sent token response for request ID: %s", request.RequestID)
 	}
@@ -88,8 +187,17 @@ func main() {
 	configPath := flag.String("config", "", "Path to config file")
 	idpURL := flag.String("idp-url", idp.DefaultBaseURL, "IDP base URL")
 	idpTokenPath := flag.String("idp-token-path", idp.DefaultTokenEndpoint, "IDP token endpoint path")
+	idpIssuer := flag.String("idp-issuer", "", "OpenID issuer URL whose discovery document provides the token endpoint, replacing -idp-url and -idp-token-path (default $IDP_ISSUER_URL)")
 	queueName := flag.String("queue", defaultQueue, "Queue group name for load balancing")
+	serviceMode := flag.Bool("service", os.Getenv("TOKEN_SERVICE") == "true", "Register as the token-service micro service, adding introspect and revoke endpoints (default $TOKEN_SERVICE)")
 	nameSuffix := flag.String("name-suffix", "", "Suffix to append to the client name (e.g. pod name)")
+	drainTimeout := flag.Int("drain-timeout", 10, "Time to wait for in-flight token requests on shutdown in seconds")
+	maxConcurrent := flag.Int("max-concurrent", 16, "Requests handled at once, i.e. concurrent IDP calls")
+	maxQueued := flag.Int("max-queued", 64, "Requests waiting for a free worker; further requests are refused as temporarily_unavailable")
+	maxPending := flag.Int("max-pending", 1024, "Messages the NATS client buffers for the subscription before dropping them as a slow consumer")
+	metricsAddr := flag.String("metrics-addr", ":9102", "Address serving Prometheus metrics on /metrics, empty to disable")
+	chaosConfig := chaos.RegisterFlags(flag.CommandLine)
+	version.RegisterFlag(flag.CommandLine)
 	flag.Parse()
 
 	// Load configuration
@@ -99,17 +207,60 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Create logger
-	log := logger.DefaultLogger("token-worker")
+	// Create a logger with the level and format from the config
+	log, err := logger.FromConfig("token-worker", appConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
 	log.Info("Starting token worker")
 
-	// Create IDP client with custom token endpoint (env vars are handled within the idp package)
-	idpClient := idp.NewClient(*idpURL, idp.WithTokenEndpoint(*idpTokenPath))
-	log.Info("IDP client created")
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("token-worker", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	// Fault injection is a no-op unless one of the -chaos flags is set
+	injector := chaos.NewInjector(*chaosConfig, log)
+	if chaosConfig.Enabled() {
+		log.Warn("Chaos fault injection enabled: %+v", *chaosConfig)
+	}
+
+	// Create IDP client with custom token endpoint (env vars are handled within the idp package).
+	// The idp section of the config overrides the flags, and replaces the client when the
+	// config is reloaded.
+	idpFlags := config.IDPConfig{URL: *idpURL, TokenPath: *idpTokenPath, Issuer: *idpIssuer}
+	var idpInFlight atomic.Int64
+	idpTransport := countingTransport{next: injector.Transport(nil), inFlight: &idpInFlight}
+	newClients := func(cfg config.IDPConfig) *worker.Realms {
+		return newIDPClients(cfg, idpFlags, idpTransport, log)
+	}
+	realms := newClients(appConfig.IDP)
+	log.Info("IDP clients created for the default IDP and realms %v", realms.Names())
+
+	// The credential store supplies the secrets of requests sent in the reference mode, and
+	// the trusted keys, when set, restrict the workers to signed requests
+	if err := appConfig.Credentials.ValidateWorker(); err != nil {
+		log.Fatal("Invalid credentials config: %v", err)
+	}
+	resolver := secrets.New(appConfig.Secrets)
 
-	// Create a WaitGroup to track when connection is ready
-	var wg sync.WaitGroup
-	wg.Add(1)
+	// Payloads encrypted by the requesters are decrypted with the configured keys, and the
+	// replies encrypted under the request's key
+	var encrypter atomic.Pointer[pubsub.Encrypter]
+	if enc, err := natsutil.NewEncrypter(appConfig.NATS.Encryption); err != nil {
+		log.Fatal("Invalid nats.encryption: %v", err)
+	} else if enc != nil {
+		encrypter.Store(enc)
+		log.Info("Decrypting requests with keys %v", enc.KeyIDs())
+	}
+	var creds atomic.Pointer[requestCredentials]
+	replays := pubsub.NewReplayGuard(0)
+	creds.Store(newRequestCredentials(appConfig.Credentials, resolver, replays))
+	log.Info("Credential store holds %d clients, %d trusted signing keys",
+		creds.Load().store.Len(), len(appConfig.Credentials.TrustedKeys))
 
 	// Create a client name that includes the pod name if available
 	clientName := "Token Worker"
@@ -125,69 +276,294 @@ func main() {
 		}
 	}
 
-	// Configure connection options
-	opts := []nats.Option{
-		nats.Name(clientName),               // Set client name with unique identifier
-		nats.ReconnectWait(5 * time.Second), // Wait 5 seconds between reconnect attempts
-		nats.MaxReconnects(10),              // Try to reconnect up to 10 times
-		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
-			log.Warn("Disconnected from NATS: %v", err)
-		}),
-		nats.ReconnectHandler(func(nc *nats.Conn) {
-			log.Info("Reconnected to NATS server at %s", nc.ConnectedUrl())
-		}),
-		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
-			log.Error("NATS error: %v", err)
-		}),
-		nats.ClosedHandler(func(nc *nats.Conn) {
-			log.Warn("NATS connection closed")
-		}),
-		// The most important handler - signals when the connection is established
-		nats.ConnectHandler(func(nc *nats.Conn) {
-			log.Info("Connected to NATS at %s", nc.ConnectedUrl())
-			// Signal that we're connected
-			wg.Done()
-		}),
-	}
-
-	// Connect to NATS with options
+	// Connect to NATS, through WebSocket and proxies for edge deployments; Connect waits
+	// for servers that are still starting, e.g. when started together by docker-compose,
+	// reconnects as configured and logs connection events
 	log.Info("Connecting to NATS at %s...", appConfig.NATS.URL)
-	natsConn, err := nats.Connect(appConfig.NATS.URL, opts...)
+	natsConn, err := natsutil.Connect(appConfig.NATS, clientName, log, injector.NATSOptions()...)
 	if err != nil {
 		log.Fatal("Failed to connect to NATS: %v", err)
 	}
-	defer natsConn.Close()
+	log.Info("Connected to NATS at %s", natsConn.ConnectedUrl())
 
-	// Wait for the connection to be established
-	wg.Wait()
-	log.Info("NATS connection established successfully")
+	// Fail fast when the account lacks a permission, rather than never seeing a request
+	perms := natsutil.Permissions{
+		Publish:   []string{models.HeartbeatSubject},
+		Subscribe: []string{tokenSubject + " " + *queueName},
+	}
+	if *serviceMode {
+		perms.Subscribe = append(perms.Subscribe,
+			introspectSubject+" "+*queueName, revokeSubject+" "+*queueName, micro.APIPrefix+".>")
+	}
+	if err := natsutil.CheckPermissions(natsConn, perms, 5*time.Second); err != nil {
+		log.Fatal("%v", err)
+	}
 
 	log.Info("Subscribing to token requests on %s with queue group %s", tokenSubject, *queueName)
 
-	// Create the token request handler and subscribe to the token subject with queue group
-	handler := createTokenRequestHandler(idpClient, log)
-	_, err = natsConn.QueueSubscribe(tokenSubject, *queueName, handler)
-	if err != nil {
-		log.Fatal("Failed to subscribe to token requests: %v", err)
+	// Create the token request handler and subscribe to the token subject with queue group.
+	// Requests are handled by a pool of -max-concurrent workers, and refused once -max-queued
+	// of them wait, so the requester hears back quickly instead of timing out. Handlers still
+	// running when the drain times out are cancelled through handlerCtx.
+	var processed, inFlight atomic.Int64
+	handlerCtx, cancelHandlers := context.WithCancel(context.Background())
+	defer cancelHandlers()
+	workers := pool.New(*maxConcurrent, *maxQueued)
+	registry := metrics.NewRegistry("token_worker")
+	m := newWorkerMetrics(registry, &inFlight, &idpInFlight, workers)
+	service := worker.NewService(worker.Config{
+		Realms:      realms,
+		Credentials: creds.Load().store,
+		Log:         log,
+		OnIDPCall: func(start time.Time, err error) {
+			if err != nil {
+				m.idpLatency.ObserveSince(start, "error")
+			} else {
+				m.idpLatency.ObserveSince(start, "ok")
+			}
+		},
+	})
+	handler := createTokenRequestHandler(handlerCtx, service, &creds, log, &processed, injector, m)
+	pooled := func(handle requestHandler) requestHandler {
+		return func(msg *nats.Msg, respond responder) {
+			accepted := workers.Submit(func() {
+				inFlight.Add(1)
+				defer inFlight.Add(-1)
+				defer recoverRequest(log, m, msg, respond)
+				handle(msg, respond)
+			})
+			if !accepted {
+				log.Warn("Refusing request on %s: %d requests already queued", msg.Subject, workers.Queued())
+				m.requests.Inc("rejected")
+				sendResponse(respond, models.NewOAuthErrorResponse(pubsub.RequestID(msg), idp.ErrCodeTemporarilyUnavailable, "token worker overloaded"), errCodeOverloaded)
+			}
+		}
+	}
+	// Answer health requests on health.token-worker
+	checks := health.New("token-worker")
+	checks.Add("nats", health.NATSConnected(natsConn))
+
+	// As a micro service, the worker also answers introspection and revocation requests and
+	// shows up in `nats micro ls`. On shutdown, the subscriptions are drained before the
+	// pool, which is drained before the connection closes, so queued requests are answered.
+	var stopReceiving run.Func
+	if *serviceMode {
+		svc, err := addTokenService(natsConn, *queueName, &encrypter, log, pooled(handler),
+			pooled(createIntrospectHandler(handlerCtx, service, log)),
+			pooled(createRevokeHandler(handlerCtx, service, log)))
+		if err != nil {
+			log.Fatal("Failed to register the %s service: %v", serviceName, err)
+		}
+		log.Info("Registered as %s %s with ID %s", serviceName, svc.Info().Version, svc.Info().ID)
+		checks.Add("service", func(ctx context.Context) error {
+			if svc.Stopped() {
+				return errors.New("service stopped")
+			}
+			return nil
+		})
+		stopReceiving = func(ctx context.Context) error {
+			return svc.Stop()
+		}
+	} else {
+		handle := pooled(handler)
+		sub, err := natsConn.QueueSubscribe(tokenSubject, *queueName, func(msg *nats.Msg) {
+			if err := serveEncrypted(encrypter.Load(), msg, msgSender(msg), handle); err != nil {
+				log.Warn("Refused token request %s: %v", pubsub.RequestID(msg), err)
+			}
+		})
+		if err != nil {
+			log.Fatal("Failed to subscribe to token requests: %v", err)
+		}
+		if err := sub.SetPendingLimits(*maxPending, nats.DefaultSubPendingBytesLimit); err != nil {
+			log.Fatal("Failed to set the pending limits: %v", err)
+		}
+		checks.Add("subscription", health.SubscriptionValid(sub))
+		stopReceiving = func(ctx context.Context) error {
+			return drainSubscription(ctx, sub)
+		}
+	}
+
+	checks.Add("idp", func(ctx context.Context) error {
+		return reachable(ctx, service.Realms())
+	})
+	if _, err := checks.Respond(natsConn); err != nil {
+		log.Fatal("Failed to answer health requests: %v", err)
+	}
+
+	// Draining stops new requests from arriving and lets the worker answer the ones it already
+	// received before it exits; whatever is left when the drain timeout expires is abandoned
+	group := run.New(log)
+	group.SetStopTimeout(time.Duration(*drainTimeout) * time.Second)
+	group.OnStop("handlers", func(ctx context.Context) error {
+		if n := inFlight.Load(); n > 0 {
+			log.Warn("Abandoning %d token requests still in flight after the drain timeout", n)
+		}
+		cancelHandlers()
+		return nil
+	})
+	group.AddConn("nats", natsConn)
+	group.OnStop("pool", workers.Close)
+	group.OnStop("subscriptions", stopReceiving)
+	group.OnStop("drain", func(ctx context.Context) error {
+		log.Info("Draining token requests, %d in flight and %d queued", inFlight.Load(), workers.Queued())
+		return nil
+	})
+
+	// Publish heartbeats so monitors can see this worker is alive
+	group.Go("heartbeats", func(ctx context.Context) error {
+		publishHeartbeats(ctx, natsConn, clientName, *queueName, &processed, log)
+		return nil
+	})
+	group.Go("chaos", func(ctx context.Context) error {
+		injector.RunDisconnects(ctx.Done())
+		return nil
+	})
+
+	// Apply log level, IDP, encryption and credentials changes when the config file changes or
+	// on SIGHUP; requests already sent to the previous IDP finish there
+	current := appConfig
+	watcher := config.Watch(*configPath, func(cfg *config.AppConfig) {
+		if cfg.LogLevel != current.LogLevel {
+			if err := logger.SetLevel(cfg.LogLevel); err != nil {
+				log.Error("Keeping the log level: %v", err)
+			} else {
+				log.Info("Log level changed to %s", cfg.LogLevel)
+			}
+		}
+		if !reflect.DeepEqual(cfg.IDP, current.IDP) {
+			realms := newClients(cfg.IDP)
+			service.SetRealms(realms)
+			log.Info("Switched to the IDP at %s with realms %v", realms.Default.BaseURL(), realms.Names())
+		}
+		if !reflect.DeepEqual(cfg.NATS.Encryption, current.NATS.Encryption) {
+			if enc, err := natsutil.NewEncrypter(cfg.NATS.Encryption); err != nil {
+				log.Error("Keeping the encryption keys: %v", err)
+			} else {
+				encrypter.Store(enc)
+				if enc != nil {
+					log.Info("Decrypting requests with keys %v", enc.KeyIDs())
+				} else {
+					log.Info("Request encryption disabled")
+				}
+			}
+		}
+		if !reflect.DeepEqual(cfg.Credentials, current.Credentials) {
+			if err := cfg.Credentials.ValidateWorker(); err != nil {
+				log.Error("Keeping the credentials config: %v", err)
+			} else {
+				creds.Store(newRequestCredentials(cfg.Credentials, resolver, replays))
+				service.SetCredentials(creds.Load().store)
+				log.Info("Credential store reloaded with %d clients, %d trusted signing keys",
+					creds.Load().store.Len(), len(cfg.Credentials.TrustedKeys))
+			}
+		}
+		current = cfg
+	})
+	watcher.OnError(func(err error) {
+		log.Error("Failed to reload the configuration, keeping the current one: %v", err)
+	})
+	group.Go("config", watcher.Run)
+
+	// Expose the token pipeline metrics for Prometheus
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry.Handler())
+		group.AddServer("metrics", &http.Server{Addr: *metricsAddr, Handler: mux})
 	}
 
 	log.Info("Token worker is running in queue group %s. Press Ctrl+C to exit.", *queueName)
 
-	// Wait for termination signal
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
-	<-signals
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+	log.Info("Token worker stopped after processing %d requests", processed.Load())
+}
+
+// countingTransport counts the HTTP requests waiting for a response
+type countingTransport struct {
+	next     http.RoundTripper
+	inFlight *atomic.Int64
+}
+
+func (t countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.inFlight.Add(1)
+	defer t.inFlight.Add(-1)
+	return t.next.RoundTrip(req)
+}
+
+// drainSubscription stops the subscription and waits until the messages it had buffered have
+// been passed to its handler, or until ctx is done
+func drainSubscription(ctx context.Context, sub *nats.Subscription) error {
+	if err := sub.Drain(); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for sub.IsValid() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// publishHeartbeats periodically announces the worker on the heartbeat subject until ctx is cancelled
+func publishHeartbeats(ctx context.Context, nc *nats.Conn, worker, queue string, processed *atomic.Int64, log *logger.Logger) {
+	startedAt := time.Now()
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		data, err := json.Marshal(models.NewHeartbeat(worker, queue, processed.Load(), startedAt))
+		if err != nil {
+			log.Error("Failed to marshal heartbeat: %v", err)
+			continue
+		}
+		if err := nc.Publish(models.HeartbeatSubject, data); err != nil {
+			log.Warn("Failed to publish heartbeat: %v", err)
+		}
+	}
+}
+
+// recoverRequest is deferred around every request handler. A panic is logged with its stack,
+// counted and answered with an internal error, so one malformed request cannot take the
+// worker down.
+func recoverRequest(log *logger.Logger, m *workerMetrics, msg *nats.Msg, respond responder) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	log.With("request_id", pubsub.RequestID(msg)).Error("Recovered from panic handling request %s on %s: %v\n%s",
+		pubsub.RequestID(msg), msg.Subject, r, debug.Stack())
+	m.panics.Inc(msg.Subject)
+	sendErrorResponse(respond, pubsub.RequestID(msg), models.ErrCodeInternal, "Internal server error", errCodeInternal)
+}
+
+// sendErrorResponse sends an error response with one of the models.ErrCode codes back to the
+// requester; code is the service API status
+func sendErrorResponse(respond responder, requestID, errorCode, errorMessage, code string) {
+	sendResponse(respond, models.NewOAuthErrorResponse(requestID, errorCode, errorMessage), code)
+}
 
-	log.Info("Received shutdown signal, exiting...")
+// sendIDPError sends a failed IDP request back to the requester with its error code
+func sendIDPError(respond responder, requestID string, err error) {
+	sendResponse(respond, models.NewOAuthErrorResponse(requestID, worker.ErrorCode(err), err.Error()), errCodeIDP)
 }
 
-// sendErrorResponse sends an error response back to the requester
-func sendErrorResponse(msg *nats.Msg, requestID, errorMessage string) {
-	response := models.NewErrorResponse(requestID, errorMessage)
+// sendResponse marshals an error response and sends it back to the requester
+func sendResponse(respond responder, response *models.TokenResponse, code string) {
 	respData, err := json.Marshal(response)
 	if err != nil {
 		// Just log, can't do much else here
 		return
 	}
-	msg.Respond(respData)
+	respond(respData, code, response.Error)
 }
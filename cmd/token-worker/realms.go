@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/health"
+	"github.com/kiquetal/nats-go-examples/internal/idp"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/worker"
+)
+
+// reachable checks that the default IDP and every realm's IDP answer over HTTP
+func reachable(ctx context.Context, r *worker.Realms) error {
+	httpClient := &http.Client{}
+	err := health.HTTPReachable(httpClient, r.Default.BaseURL())(ctx)
+	for _, name := range r.Names() {
+		if realmErr := health.HTTPReachable(httpClient, r.ByName[name].BaseURL())(ctx); realmErr != nil {
+			err = errors.Join(err, fmt.Errorf("realm %s: %w", name, realmErr))
+		}
+	}
+	return err
+}
+
+// newIDPClients creates the IDP clients for the config, with the flags for the empty fields of
+// the default IDP, and discovers the endpoints up front so a wrong issuer shows right away.
+// Token requests retry the discovery, so an IDP may still be starting.
+func newIDPClients(cfg, flags config.IDPConfig, transport http.RoundTripper, log *logger.Logger) *worker.Realms {
+	if cfg.URL == "" {
+		cfg.URL = flags.URL
+	}
+	if cfg.TokenPath == "" {
+		cfg.TokenPath = flags.TokenPath
+	}
+	if cfg.Issuer == "" {
+		cfg.Issuer = flags.Issuer
+	}
+
+	// The default IDP's URL gives way to IDP_URL, like the flags do
+	options := idpOptions(cfg.Timeout, transport, idp.WithTokenEndpoint(cfg.TokenPath))
+	if cfg.Issuer != "" {
+		options = append(options, idp.WithDiscovery(cfg.Issuer))
+	}
+	realms := &worker.Realms{
+		Default: discover(idp.NewClient(cfg.URL, options...), log),
+		ByName:  make(map[string]worker.IDPClient, len(cfg.Realms)),
+	}
+
+	// A realm's own settings win over the environment, which describes the default IDP
+	for name, realm := range cfg.Realms {
+		if realm.Timeout == 0 {
+			realm.Timeout = cfg.Timeout
+		}
+		var options []idp.ClientOption
+		if realm.Issuer != "" {
+			options = idpOptions(realm.Timeout, transport, idp.WithDiscovery(realm.Issuer))
+		} else {
+			if realm.URL == "" {
+				realm.URL = cfg.URL
+			}
+			if realm.TokenPath == "" {
+				realm.TokenPath = cfg.TokenPath
+			}
+			options = idpOptions(realm.Timeout, transport, idp.WithBaseURL(realm.URL), idp.WithTokenEndpoint(realm.TokenPath))
+		}
+		realms.ByName[name] = discover(idp.NewClient(realm.URL, options...), log.With("realm", name))
+	}
+	return realms
+}
+
+// idpOptions returns the options shared by every IDP client, followed by extra
+func idpOptions(timeout int, transport http.RoundTripper, extra ...idp.ClientOption) []idp.ClientOption {
+	options := []idp.ClientOption{
+		idp.WithTransport(transport),
+		idp.WithLogger(logger.DefaultLogger("idp")),
+	}
+	if timeout > 0 {
+		options = append(options, idp.WithTimeout(time.Duration(timeout)*time.Second))
+	}
+	return append(options, extra...)
+}
+
+// discover fetches the discovery document of a client using one, logging the outcome
+func discover(client *idp.Client, log *logger.Logger) *idp.Client {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if doc, err := client.Discovery(ctx); err == nil {
+		log.Info("Using token endpoint %s from the discovery document of %s", doc.TokenEndpoint, doc.Issuer)
+	} else if !errors.Is(err, idp.ErrDiscoveryDisabled) {
+		log.Warn("Failed to discover the IDP endpoints: %v", err)
+	}
+	return client
+}
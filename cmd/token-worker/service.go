@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/idp"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/tracing"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/internal/worker"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// The token service registered with -service, listed by `nats micro ls`
+const (
+	serviceName       = "token-service"
+	introspectSubject = "token.introspect"
+	revokeSubject     = "token.revoke"
+)
+
+// Error codes of failed service requests, which the service stats count and report in the
+// Nats-Service-Error-Code header; the reply body still carries the error
+const (
+	errCodeBadRequest = "400"
+	errCodeInternal   = "500"
+	errCodeIDP        = "502"
+	errCodeOverloaded = "503"
+)
+
+// semver matches the versions the service API accepts, and invalidPrerelease the characters
+// a pre-release version cannot have
+var (
+	semver            = regexp.MustCompile(`^\d+\.\d+\.\d+(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+	invalidPrerelease = regexp.MustCompile(`[^0-9A-Za-z.-]`)
+)
+
+// responder sends the reply to a request. A non-empty code marks the request as failed.
+type responder func(data []byte, code, description string) error
+
+// requestHandler handles a request received over a plain subscription or the service API
+type requestHandler func(msg *nats.Msg, respond responder)
+
+// msgSender replies on the message's reply subject
+func msgSender(msg *nats.Msg) replySender {
+	return func(reply *nats.Msg, code, description string) error {
+		return msg.RespondMsg(reply)
+	}
+}
+
+// microHandler adapts a handler to the service API, decrypting requests with the current
+// encrypter. Failed requests are answered with Request.Error, so they show up in the
+// endpoint's stats.
+func microHandler(handle requestHandler, encrypter *atomic.Pointer[pubsub.Encrypter], log *logger.Logger) micro.Handler {
+	return micro.HandlerFunc(func(req micro.Request) {
+		msg := &nats.Msg{
+			Subject: req.Subject(),
+			Header:  nats.Header(req.Headers()),
+			Data:    req.Data(),
+		}
+		err := serveEncrypted(encrypter.Load(), msg, func(reply *nats.Msg, code, description string) error {
+			headers := micro.WithHeaders(micro.Headers(reply.Header))
+			if code != "" {
+				return req.Error(code, description, reply.Data, headers)
+			}
+			return req.Respond(reply.Data, headers)
+		}, handle)
+		if err != nil {
+			log.Warn("Refused request %s on %s: %v", pubsub.RequestID(msg), msg.Subject, err)
+		}
+	})
+}
+
+// addTokenService registers the worker as token-service with request, introspect and revoke
+// endpoints in the queue group, so `nats micro info` and `nats micro stats` show every worker
+func addTokenService(nc *nats.Conn, queue string, encrypter *atomic.Pointer[pubsub.Encrypter], log *logger.Logger, request, introspect, revoke requestHandler) (micro.Service, error) {
+	svc, err := micro.AddService(nc, micro.Config{
+		Name:        serviceName,
+		Version:     serviceVersion(),
+		Description: "Obtains, introspects and revokes tokens at the IDP",
+		Metadata:    version.Metadata(),
+		QueueGroup:  queue,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a schema verb in the service API, the metadata names the message types
+	for _, endpoint := range []struct {
+		name, subject     string
+		handler           requestHandler
+		request, response string
+	}{
+		{"request", tokenSubject, request, "TokenRequest", "TokenResponse"},
+		{"introspect", introspectSubject, introspect, "IntrospectionRequest", "IntrospectionResponse"},
+		{"revoke", revokeSubject, revoke, "RevocationRequest", "RevocationResponse"},
+	} {
+		err := svc.AddEndpoint(endpoint.name, microHandler(endpoint.handler, encrypter, log),
+			micro.WithEndpointSubject(endpoint.subject),
+			micro.WithEndpointMetadata(map[string]string{
+				"format":   "application/json",
+				"request":  "github.com/kiquetal/nats-go-examples/pkg/models." + endpoint.request,
+				"response": "github.com/kiquetal/nats-go-examples/pkg/models." + endpoint.response,
+			}))
+		if err != nil {
+			svc.Stop()
+			return nil, err
+		}
+	}
+	return svc, nil
+}
+
+// serviceVersion returns the build version in the semantic version format the service API
+// requires, e.g. 1.2.0 for v1.2.0 and 0.0.0-dev for development builds
+func serviceVersion() string {
+	v := strings.TrimPrefix(version.Version, "v")
+	if semver.MatchString(v) {
+		return v
+	}
+	return "0.0.0-" + invalidPrerelease.ReplaceAllString(v, "-")
+}
+
+// createIntrospectHandler returns the handler of the introspect endpoint
+func createIntrospectHandler(ctx context.Context, service *worker.Service, log *logger.Logger) requestHandler {
+	return func(msg *nats.Msg, respond responder) {
+		request, ctx, done := startTokenOperation(ctx, msg, respond, log)
+		if request == nil {
+			return
+		}
+		defer done()
+		log := log.With("request_id", request.RequestID, "client_id", request.ClientID)
+
+		var result *idp.Introspection
+		client, err := service.Realms().Client(request.Realm)
+		if err == nil {
+			result, err = client.Introspect(ctx, credentialsOf(request), request.Token, request.TokenTypeHint)
+		}
+		if err != nil {
+			log.Error("Failed to introspect token for client ID %s: %v", request.ClientID, err)
+			reply(respond, &models.IntrospectionResponse{
+				RequestID: request.RequestID, Error: err.Error(), ErrorCode: worker.ErrorCode(err), Timestamp: time.Now(),
+			}, errCodeIDP, err.Error())
+			return
+		}
+		response := &models.IntrospectionResponse{RequestID: request.RequestID, Active: result.Active, Timestamp: time.Now()}
+		if result.Active {
+			response.Claims = result.Claims
+		}
+		reply(respond, response, "", "")
+	}
+}
+
+// createRevokeHandler returns the handler of the revoke endpoint
+func createRevokeHandler(ctx context.Context, service *worker.Service, log *logger.Logger) requestHandler {
+	return func(msg *nats.Msg, respond responder) {
+		request, ctx, done := startTokenOperation(ctx, msg, respond, log)
+		if request == nil {
+			return
+		}
+		defer done()
+		log := log.With("request_id", request.RequestID, "client_id", request.ClientID)
+
+		client, err := service.Realms().Client(request.Realm)
+		if err == nil {
+			err = client.Revoke(ctx, credentialsOf(request), request.Token, request.TokenTypeHint)
+		}
+		if err != nil {
+			log.Error("Failed to revoke token for client ID %s: %v", request.ClientID, err)
+			reply(respond, &models.RevocationResponse{
+				RequestID: request.RequestID, Error: err.Error(), ErrorCode: worker.ErrorCode(err), Timestamp: time.Now(),
+			}, errCodeIDP, err.Error())
+			return
+		}
+		log.Info("Revoked token for client ID: %s", request.ClientID)
+		reply(respond, &models.RevocationResponse{RequestID: request.RequestID, Revoked: true, Timestamp: time.Now()}, "", "")
+	}
+}
+
+// startTokenOperation parses an introspection or revocation request and starts its span and
+// deadline. It answers invalid requests itself and then returns a nil request.
+func startTokenOperation(ctx context.Context, msg *nats.Msg, respond responder, log *logger.Logger) (*models.IntrospectionRequest, context.Context, func()) {
+	ctx, span := tracing.StartHandler(ctx, msg)
+	var request models.IntrospectionRequest
+	err := json.Unmarshal(msg.Data, &request)
+	if err == nil && request.Token == "" {
+		err = errors.New("missing token")
+	}
+	if err != nil {
+		log.Error("Invalid %s request: %v", msg.Subject, err)
+		tracing.Fail(span, err)
+		span.End()
+		reply(respond, &models.IntrospectionResponse{Error: "Invalid request format", ErrorCode: idp.ErrCodeInvalidRequest, Timestamp: time.Now()},
+			errCodeBadRequest, "Invalid request format")
+		return nil, nil, nil
+	}
+
+	if id := pubsub.RequestID(msg); id != "" {
+		request.RequestID = id
+	}
+	ctx, cancel := pubsub.ContextFromMsg(idp.WithRequestID(ctx, request.RequestID), msg)
+	return &request, ctx, func() {
+		cancel()
+		span.End()
+	}
+}
+
+// credentialsOf returns the client credentials of a request
+func credentialsOf(request *models.IntrospectionRequest) *idp.ClientCredentials {
+	return &idp.ClientCredentials{ClientID: request.ClientID, ClientSecret: request.ClientSecret}
+}
+
+// reply marshals a response and sends it
+func reply(respond responder, response interface{}, code, description string) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return
+	}
+	respond(data, code, description)
+}
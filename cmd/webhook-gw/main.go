@@ -0,0 +1,302 @@
+// Package main implements a gateway that ingests webhooks and republishes them on NATS
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/health"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/natsutil"
+	"github.com/kiquetal/nats-go-examples/internal/run"
+	"github.com/kiquetal/nats-go-examples/internal/secrets"
+	"github.com/kiquetal/nats-go-examples/internal/telemetry"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// maxBodySize bounds webhook payloads to the default NATS max payload
+	maxBodySize  = 1024 * 1024
+	flushTimeout = 2 * time.Second
+)
+
+// Gateway verifies incoming webhooks and publishes them as messages
+type Gateway struct {
+	publisher  *pubsub.NATSPublisher
+	secrets    *secrets.Resolver
+	log        *logger.Logger
+	maxRetries int
+	retryWait  time.Duration
+}
+
+func main() {
+	// Parse command-line flags
+	configPath := flag.String("config", "configs/webhooks.json", "Path to config file with a webhooks section")
+	port := flag.Int("port", 0, "HTTP server port (overrides the config file)")
+	version.RegisterFlag(flag.CommandLine)
+	flag.Parse()
+
+	// Load configuration
+	appConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Log level and format come from the config
+	if err := logger.Configure(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Create logger
+	log := logger.DefaultLogger("webhook-gw")
+	log.Info("Starting webhook ingestion gateway")
+
+	// Export traces and metrics when a collector is configured
+	tel, err := telemetry.Setup("webhook-gw", appConfig, log)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry: %v", err)
+	}
+	defer tel.Shutdown()
+
+	webhooks := appConfig.Webhooks
+	if webhooks == nil || len(webhooks.Sources) == 0 {
+		log.Fatal("No webhook sources configured in %s", *configPath)
+	}
+
+	natsConn, err := natsutil.Connect(appConfig.NATS, "webhook-gw", log, nats.Timeout(10*time.Second))
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: %v", err)
+	}
+	publisher := pubsub.NewPublisherFromConn(natsConn)
+	log.Info("Connected to NATS at %s", natsConn.ConnectedUrl())
+
+	gateway := &Gateway{
+		publisher:  publisher,
+		secrets:    secrets.New(appConfig.Secrets),
+		log:        log,
+		maxRetries: webhooks.MaxRetries,
+		retryWait:  time.Duration(webhooks.RetryWait) * time.Millisecond,
+	}
+
+	// Answer health requests on health.webhook-gw
+	checks := health.New("webhook-gw")
+	checks.Add("nats", health.NATSConnected(natsConn))
+	if _, err := checks.Respond(natsConn); err != nil {
+		log.Fatal("Failed to answer health requests: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	for _, source := range webhooks.Sources {
+		// Secrets can be kept out of the config file, e.g. WEBHOOK_GITHUB_SECRET, or stored in
+		// a secret manager with a reference such as vault://webhooks/github#secret
+		if source.Secret == "" {
+			source.Secret = os.Getenv(fmt.Sprintf("WEBHOOK_%s_SECRET", strings.ToUpper(source.Name)))
+		}
+		if source.Signature != "" && source.Signature != "none" {
+			secret, err := gateway.secrets.Resolve(context.Background(), source.Secret)
+			if err != nil {
+				log.Fatal("Webhook source %s: %v", source.Name, err)
+			}
+			if secret == "" {
+				log.Fatal("Webhook source %s requires a secret for %s signatures", source.Name, source.Signature)
+			}
+		}
+
+		mux.Handle("POST "+source.Path, gateway.sourceHandler(source))
+		log.Info("Webhook %s: POST %s -> %s (signature: %s)", source.Name, source.Path, source.Subject, source.Signature)
+	}
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+	mux.Handle("/healthz", version.Handler())
+	mux.Handle("/readyz", checks.Handler())
+
+	serverPort := webhooks.Port
+	if *port != 0 {
+		serverPort = *port
+	}
+	if serverPort == 0 {
+		serverPort = 8091
+	}
+
+	// The HTTP server stops first, finishing in-flight webhooks before the publisher is closed
+	group := run.New(log)
+	group.OnStop("publisher", func(ctx context.Context) error {
+		publisher.Close()
+		return nil
+	})
+	group.AddServer("http", &http.Server{Addr: fmt.Sprintf(":%d", serverPort), Handler: mux})
+
+	if err := group.Run(); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// sourceHandler returns the HTTP handler for a single webhook source
+func (g *Gateway) sourceHandler(source config.WebhookSourceConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			g.log.Error("Failed to read %s webhook body: %v", source.Name, err)
+			return
+		}
+		defer r.Body.Close()
+
+		// Referenced secrets are cached, and fetched again once the cache expires after a rotation
+		secret, err := g.secrets.Resolve(r.Context(), source.Secret)
+		if err != nil {
+			http.Error(w, "Failed to verify signature", http.StatusInternalServerError)
+			g.log.Error("Failed to resolve the %s webhook secret: %v", source.Name, err)
+			return
+		}
+		if err := verifySignature(source.Signature, secret, r.Header, body); err != nil {
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			g.log.Warn("Rejected %s webhook: %v", source.Name, err)
+			return
+		}
+
+		event := eventType(source.Signature, r.Header, body)
+		subject := strings.ReplaceAll(source.Subject, "{event}", event)
+
+		msg := models.NewMessage(subject, string(body))
+		msg.AddMetadata("source", source.Name)
+		msg.AddMetadata("event", event)
+		// The provider's delivery ID, or the message ID, is the Nats-Msg-Id, so streams store a
+		// webhook once when a publish is retried after the server already received it
+		msgID := msg.ID
+		if delivery := deliveryID(r.Header); delivery != "" {
+			msg.AddMetadata("delivery_id", delivery)
+			msgID = source.Name + "-" + delivery
+		}
+		msg.SetHeader(nats.MsgIdHdr, msgID)
+
+		attempts, err := g.publishWithRetry(msg)
+		if err == nil {
+			g.log.Info("Published %s webhook %s to %s", source.Name, msg.ID, subject)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		g.log.Error("Failed to publish %s webhook %s after %d attempts: %v", source.Name, msg.ID, attempts, err)
+		if g.deadLetter(source, msg, attempts, err) {
+			// The event is parked on the dead-letter subject, so the sender does not need to retry
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		// Let the sender retry the delivery later
+		http.Error(w, "Failed to accept webhook", http.StatusServiceUnavailable)
+	}
+}
+
+// publishWithRetry publishes the message and waits for the server to acknowledge it, retrying with
+// backoff. Once the message is published only the flush is retried, so it is not sent twice.
+func (g *Gateway) publishWithRetry(msg *models.Message) (int, error) {
+	var err error
+	published := false
+	wait := g.retryWait
+	for attempt := 1; attempt <= g.maxRetries+1; attempt++ {
+		if !published {
+			err = g.publisher.PublishMessage(msg)
+			published = err == nil
+		}
+		if published {
+			if err = g.publisher.Flush(flushTimeout); err == nil {
+				return attempt, nil
+			}
+		}
+
+		if attempt <= g.maxRetries {
+			g.log.Warn("Publish attempt %d for %s failed: %v", attempt, msg.ID, err)
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	return g.maxRetries + 1, err
+}
+
+// deadLetter parks an undeliverable message on the source's dead-letter subject
+func (g *Gateway) deadLetter(source config.WebhookSourceConfig, msg *models.Message, attempts int, cause error) bool {
+	if source.DeadLetterSubject == "" {
+		return false
+	}
+
+	originalSubject := msg.Subject
+	msg.Subject = source.DeadLetterSubject
+	msg.AddMetadata("original_subject", originalSubject)
+	msg.AddMetadata("error", cause.Error())
+	msg.AddMetadata("attempts", strconv.Itoa(attempts))
+	msg.SetHeader(models.DeadLetterOriginalSubject, originalSubject)
+	msg.SetHeader(models.DeadLetterError, cause.Error())
+	msg.SetHeader(models.DeadLetterAttempts, strconv.Itoa(attempts))
+	msg.SetHeader(models.DeadLetterSource, "webhook-gw/"+source.Name)
+
+	if err := g.publisher.PublishMessage(msg); err != nil {
+		g.log.Error("Failed to dead-letter webhook %s: %v", msg.ID, err)
+		return false
+	}
+	if err := g.publisher.Flush(flushTimeout); err != nil {
+		g.log.Error("Failed to dead-letter webhook %s: %v", msg.ID, err)
+		return false
+	}
+
+	g.log.Warn("Webhook %s sent to dead-letter subject %s", msg.ID, source.DeadLetterSubject)
+	return true
+}
+
+// eventType extracts the event type from the provider-specific location, falling back to "unknown"
+func eventType(scheme string, header http.Header, body []byte) string {
+	var event string
+	switch scheme {
+	case "github":
+		event = header.Get("X-GitHub-Event")
+	case "stripe":
+		var payload struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(body, &payload) == nil {
+			event = payload.Type
+		}
+	default:
+		event = header.Get("X-Event-Type")
+	}
+
+	// Event types become subject tokens, so strip wildcards and whitespace
+	event = strings.Map(func(r rune) rune {
+		if r == '*' || r == '>' || r == ' ' || r == '\t' {
+			return '_'
+		}
+		return r
+	}, event)
+	event = strings.Trim(event, ".")
+	if event == "" {
+		return "unknown"
+	}
+	return event
+}
+
+// deliveryID returns the provider's unique delivery identifier when present
+func deliveryID(header http.Header) string {
+	for _, key := range []string{"X-GitHub-Delivery", "Idempotency-Key", "X-Request-Id"} {
+		if value := header.Get(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
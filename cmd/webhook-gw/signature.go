@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stripeTolerance is how old a Stripe signature timestamp may be before it is rejected
+const stripeTolerance = 5 * time.Minute
+
+// verifySignature checks the webhook signature using the scheme of the given provider
+func verifySignature(scheme, secret string, header http.Header, body []byte) error {
+	switch scheme {
+	case "github":
+		return verifyGitHub(secret, header.Get("X-Hub-Signature-256"), body)
+	case "stripe":
+		return verifyStripe(secret, header.Get("Stripe-Signature"), body, time.Now())
+	case "", "none":
+		return nil
+	default:
+		return errors.New("unknown signature scheme " + scheme)
+	}
+}
+
+// verifyGitHub validates an X-Hub-Signature-256 header of the form sha256=<hex hmac>
+func verifyGitHub(secret, signature string, body []byte) error {
+	digest, found := strings.CutPrefix(signature, "sha256=")
+	if !found {
+		return errors.New("missing or malformed X-Hub-Signature-256 header")
+	}
+
+	expected, err := hex.DecodeString(digest)
+	if err != nil {
+		return errors.New("malformed signature digest")
+	}
+	if !hmac.Equal(expected, computeHMAC(secret, body)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// verifyStripe validates a Stripe-Signature header of the form t=<unix>,v1=<hex hmac>[,v1=...]
+func verifyStripe(secret, signature string, body []byte, now time.Time) error {
+	var timestamp string
+	var candidates []string
+	for _, part := range strings.Split(signature, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			candidates = append(candidates, value)
+		}
+	}
+	if timestamp == "" || len(candidates) == 0 {
+		return errors.New("missing or malformed Stripe-Signature header")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("malformed signature timestamp")
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > stripeTolerance || age < -stripeTolerance {
+		return errors.New("signature timestamp outside tolerance")
+	}
+
+	// Stripe signs the timestamp and the raw body joined by a dot
+	expected := computeHMAC(secret, append([]byte(timestamp+"."), body...))
+	for _, candidate := range candidates {
+		if digest, err := hex.DecodeString(candidate); err == nil && hmac.Equal(expected, digest) {
+			return nil
+		}
+	}
+	return errors.New("signature mismatch")
+}
+
+// computeHMAC returns the HMAC-SHA256 of the payload
+func computeHMAC(secret string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The example delivery of GitHub's webhook documentation
+const (
+	githubSecret    = "It's a Secret to Everybody"
+	githubBody      = "Hello, World!"
+	githubSignature = "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"
+)
+
+// A Stripe delivery signed at 1700000000, with the HMAC computed independently of the gateway
+const (
+	stripeSecret    = "whsec_test_secret"
+	stripeBody      = `{"id":"evt_1","type":"charge.succeeded"}`
+	stripeTimestamp = 1700000000
+	stripeDigest    = "c0475716eb2200f1fe97fcf35a3c05d1fd4f8ba9a07a596730c8d18bb87c0672"
+)
+
+func TestVerifyGitHub(t *testing.T) {
+	if err := verifyGitHub(githubSecret, githubSignature, []byte(githubBody)); err != nil {
+		t.Fatalf("expected the documented signature to verify, got %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		signature string
+		body      string
+		err       string // substring of the error
+	}{
+		{"tampered body", githubSecret, githubSignature, "Hello, World?", "signature mismatch"},
+		{"wrong secret", "other", githubSignature, githubBody, "signature mismatch"},
+		{"missing header", githubSecret, "", githubBody, "missing or malformed"},
+		{"sha1 header", githubSecret, "sha1=7d38cdd689735b008b3c702edd92eea23791c5f6", githubBody, "missing or malformed"},
+		{"malformed digest", githubSecret, "sha256=not-hex", githubBody, "malformed signature digest"},
+		{"truncated digest", githubSecret, githubSignature[:21], githubBody, "signature mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyGitHub(tt.secret, tt.signature, []byte(tt.body))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestVerifyStripe(t *testing.T) {
+	signedAt := time.Unix(stripeTimestamp, 0)
+	header := "t=1700000000,v1=" + stripeDigest
+	if err := verifyStripe(stripeSecret, header, []byte(stripeBody), signedAt.Add(time.Minute)); err != nil {
+		t.Fatalf("expected the signature to verify, got %v", err)
+	}
+
+	// During secret rolls Stripe sends a v1 signature per secret, and v0 test signatures
+	rolled := "t=1700000000, v0=" + strings.Repeat("0", 64) + ", v1=" + strings.Repeat("ab", 32) + ", v1=" + stripeDigest
+	if err := verifyStripe(stripeSecret, rolled, []byte(stripeBody), signedAt); err != nil {
+		t.Fatalf("expected one of several v1 signatures to verify, got %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		body   string
+		now    time.Time
+		err    string // substring of the error
+	}{
+		{"tampered body", header, `{"id":"evt_2","type":"charge.succeeded"}`, signedAt, "signature mismatch"},
+		{"other timestamp", "t=1700000001,v1=" + stripeDigest, stripeBody, signedAt, "signature mismatch"},
+		{"no matching v1", "t=1700000000,v1=" + strings.Repeat("ab", 32) + ",v1=zz", stripeBody, signedAt, "signature mismatch"},
+		{"missing header", "", stripeBody, signedAt, "missing or malformed"},
+		{"no timestamp", "v1=" + stripeDigest, stripeBody, signedAt, "missing or malformed"},
+		{"only v0", "t=1700000000,v0=" + stripeDigest, stripeBody, signedAt, "missing or malformed"},
+		{"malformed timestamp", "t=yesterday,v1=" + stripeDigest, stripeBody, signedAt, "malformed signature timestamp"},
+		{"too old", header, stripeBody, signedAt.Add(stripeTolerance + time.Second), "outside tolerance"},
+		{"from the future", header, stripeBody, signedAt.Add(-stripeTolerance - time.Second), "outside tolerance"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyStripe(stripeSecret, tt.header, []byte(tt.body), tt.now)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Hub-Signature-256", githubSignature)
+	if err := verifySignature("github", githubSecret, header, []byte(githubBody)); err != nil {
+		t.Fatalf("expected the GitHub header to be checked, got %v", err)
+	}
+	if err := verifySignature("stripe", stripeSecret, header, []byte(githubBody)); err == nil {
+		t.Fatal("expected a Stripe source without Stripe-Signature to be refused")
+	}
+	if err := verifySignature("none", "", http.Header{}, []byte("anything")); err != nil {
+		t.Fatalf("expected unsigned sources to pass, got %v", err)
+	}
+	if err := verifySignature("gitlab", "secret", header, nil); err == nil {
+		t.Fatal("expected an unknown scheme to be refused")
+	}
+}
@@ -0,0 +1,221 @@
+// Package audit records every token request as a structured record: who asked, for which
+// client, the outcome and how long it took. Records are published to a NATS subject and/or
+// appended to a JSONL file, so security can trace token usage.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/httputil"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultSubject is the subject token records are published to
+const DefaultSubject = "audit.token"
+
+// RequestIDHeader carries a request ID from the caller, and back in the response
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the request IDs taken from callers; longer ones are replaced
+const maxRequestIDLength = 128
+
+// Outcomes of a token request
+const (
+	OutcomeIssued       = "issued"       // a new token from the workers
+	OutcomeCached       = "cached"       // a token served from the cache
+	OutcomeInvalid      = "invalid"      // a malformed request
+	OutcomeUnauthorized = "unauthorized" // refused by authentication, or by the IDP
+	OutcomeRateLimited  = "rate_limited" // refused by a rate limit
+	OutcomeFailed       = "failed"       // the token could not be obtained
+)
+
+// Config selects where records go. Auditing is off when neither is set.
+type Config struct {
+	NATS    bool   `json:"nats,omitempty"`    // publish records over NATS
+	Subject string `json:"subject,omitempty"` // subject to publish to, DefaultSubject if empty
+	File    string `json:"file,omitempty"`    // JSONL file records are appended to
+}
+
+// Enabled reports whether records are written anywhere
+func (c Config) Enabled() bool {
+	return c.NATS || c.File != ""
+}
+
+// Record describes one token request
+type Record struct {
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"request_id"`
+	Caller       string    `json:"caller,omitempty"`      // authenticated caller, empty without authentication
+	AuthMethod   string    `json:"auth_method,omitempty"` // how the caller authenticated
+	ClientID     string    `json:"client_id,omitempty"`
+	Outcome      string    `json:"outcome"`
+	Reason       string    `json:"reason,omitempty"` // why no token was issued, e.g. timeout
+	Status       int       `json:"status"`
+	LatencyMS    float64   `json:"latency_ms"`
+	SourceIP     string    `json:"source_ip"`
+	ForwardedFor string    `json:"forwarded_for,omitempty"` // as sent, since callers can set it themselves
+	Host         string    `json:"host,omitempty"`          // instance that handled the request
+}
+
+// recordKey is the context key of the Record of a request
+type recordKey struct{}
+
+// FromContext returns the record of the request with ctx, for handlers to fill in. Outside
+// the middleware it returns a record that is never logged, so handlers need not check.
+func FromContext(ctx context.Context) *Record {
+	if rec, ok := ctx.Value(recordKey{}).(*Record); ok {
+		return rec
+	}
+	return &Record{}
+}
+
+// RequestID returns the ID of the audited request with ctx, or "" outside the middleware
+func RequestID(ctx context.Context) string {
+	return FromContext(ctx).RequestID
+}
+
+// Logger writes records to the configured destinations. Failures to write are passed to
+// onError and do not fail the request.
+type Logger struct {
+	nc      *nats.Conn
+	subject string
+	host    string
+	onError func(error)
+
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// New creates a logger writing as cfg says, publishing with nc. A disabled config gives a
+// logger that drops every record. onError, if not nil, receives the errors of later writes.
+func New(cfg Config, nc *nats.Conn, onError func(error)) (*Logger, error) {
+	host, _ := os.Hostname()
+	l := &Logger{host: host, onError: onError}
+	if l.onError == nil {
+		l.onError = func(error) {}
+	}
+	if cfg.NATS {
+		if nc == nil {
+			return nil, fmt.Errorf("publishing audit records needs a NATS connection")
+		}
+		l.nc, l.subject = nc, cfg.Subject
+		if l.subject == "" {
+			l.subject = DefaultSubject
+		}
+	}
+	if cfg.File != "" {
+		file, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit file: %w", err)
+		}
+		l.file, l.enc = file, json.NewEncoder(file)
+	}
+	return l, nil
+}
+
+// Subject returns the subject records are published to, or "" if they are not
+func (l *Logger) Subject() string {
+	return l.subject
+}
+
+// Log writes a record
+func (l *Logger) Log(rec Record) {
+	if rec.Host == "" {
+		rec.Host = l.host
+	}
+	if l.nc != nil {
+		data, err := json.Marshal(rec)
+		if err == nil {
+			err = l.nc.Publish(l.subject, data)
+		}
+		if err != nil {
+			l.onError(fmt.Errorf("failed to publish audit record %s: %w", rec.RequestID, err))
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.enc != nil {
+		if err := l.enc.Encode(rec); err != nil {
+			l.onError(fmt.Errorf("failed to write audit record %s: %w", rec.RequestID, err))
+		}
+	}
+}
+
+// Close closes the file; records logged afterwards are only published
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file, l.enc = nil, nil
+	return err
+}
+
+// Middleware records every request to next. The request ID is taken from the X-Request-ID
+// header or generated, and returned in the response. clientID, if not nil, reads the client
+// a request is for, so refused requests are recorded with it too. Handlers fill in the rest
+// through FromContext; an outcome they leave empty is derived from the status code.
+func (l *Logger) Middleware(next http.Handler, clientID func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &Record{
+			Time:         start.UTC(),
+			RequestID:    r.Header.Get(RequestIDHeader),
+			SourceIP:     remoteIP(r),
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		}
+		if rec.RequestID == "" || len(rec.RequestID) > maxRequestIDLength {
+			rec.RequestID = models.NewRequestID()
+		}
+		if clientID != nil {
+			rec.ClientID = clientID(r)
+		}
+		w.Header().Set(RequestIDHeader, rec.RequestID)
+
+		status := httputil.NewStatusRecorder(w)
+		next.ServeHTTP(status, r.WithContext(context.WithValue(r.Context(), recordKey{}, rec)))
+
+		rec.Status = status.Status()
+		rec.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+		if rec.Outcome == "" {
+			rec.Outcome = outcomeOf(rec.Status)
+		}
+		l.Log(*rec)
+	})
+}
+
+// outcomeOf derives the outcome of a request from its status code
+func outcomeOf(status int) string {
+	switch {
+	case status < http.StatusBadRequest:
+		return OutcomeIssued
+	case status == http.StatusUnauthorized, status == http.StatusForbidden:
+		return OutcomeUnauthorized
+	case status == http.StatusTooManyRequests:
+		return OutcomeRateLimited
+	case status < http.StatusInternalServerError:
+		return OutcomeInvalid
+	}
+	return OutcomeFailed
+}
+
+// remoteIP returns the address of the connection a request came on
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
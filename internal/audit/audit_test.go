@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/testutil"
+	"github.com/nats-io/nats.go"
+)
+
+// connect runs an embedded NATS server and connects to it
+func connect(t *testing.T) *nats.Conn {
+	t.Helper()
+	return testutil.Connect(t, testutil.StartServer(t, testutil.WithoutJetStream()))
+}
+
+func TestMiddlewareRecordsRequests(t *testing.T) {
+	nc := connect(t)
+	published, err := nc.SubscribeSync(DefaultSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := New(Config{NATS: true, File: path}, nc, func(err error) { t.Errorf("unexpected error: %v", err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := FromContext(r.Context())
+		switch r.URL.Query().Get("case") {
+		case "cached":
+			rec.Caller, rec.AuthMethod = "billing", "api_key"
+			rec.Outcome = OutcomeCached
+		case "refused":
+			rec.Reason = "invalid API key"
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		case "timeout":
+			http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+		}
+	}), func(r *http.Request) string { return "client-" + r.URL.Query().Get("case") })
+
+	for _, c := range []string{"cached", "refused", "timeout", "issued"} {
+		req := httptest.NewRequest(http.MethodPost, "/token?case="+c, nil)
+		req.RemoteAddr = "10.0.0.7:51234"
+		if c == "issued" {
+			req.Header.Set(RequestIDHeader, "req-42")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Header().Get(RequestIDHeader) == "" {
+			t.Errorf("%s: expected a request ID in the response", c)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file holds one record per line, in order
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []Record
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+	for i, want := range []struct{ outcome, clientID, caller, reason string }{
+		{OutcomeCached, "client-cached", "billing", ""},
+		{OutcomeUnauthorized, "client-refused", "", "invalid API key"},
+		{OutcomeFailed, "client-timeout", "", ""},
+		{OutcomeIssued, "client-issued", "", ""},
+	} {
+		rec := records[i]
+		if rec.Outcome != want.outcome || rec.ClientID != want.clientID || rec.Caller != want.caller || rec.Reason != want.reason {
+			t.Errorf("record %d: expected %+v, got %+v", i, want, rec)
+		}
+		if rec.SourceIP != "10.0.0.7" || rec.RequestID == "" || rec.Time.IsZero() || rec.Host == "" {
+			t.Errorf("record %d: missing request details %+v", i, rec)
+		}
+	}
+	if records[3].RequestID != "req-42" || records[3].Status != http.StatusOK {
+		t.Errorf("expected the caller's request ID and status 200, got %+v", records[3])
+	}
+
+	// The same records were published
+	for i := range records {
+		msg, err := published.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("expected record %d to be published: %v", i, err)
+		}
+		if !strings.Contains(string(msg.Data), `"request_id":"`+records[i].RequestID+`"`) {
+			t.Errorf("record %d: expected %s, got %s", i, records[i].RequestID, msg.Data)
+		}
+	}
+}
+
+func TestNewNeedsConnectionToPublish(t *testing.T) {
+	if _, err := New(Config{NATS: true}, nil, nil); err == nil {
+		t.Fatal("expected publishing without a connection to fail")
+	}
+	l, err := New(Config{}, nil, nil)
+	if err != nil || l.Subject() != "" {
+		t.Fatalf("expected a disabled logger, got %v", err)
+	}
+	l.Log(Record{RequestID: "dropped"})
+}
@@ -0,0 +1,202 @@
+// Package auth authenticates the callers of an HTTP endpoint, with static API keys or with
+// bearer JWTs validated against the IDP's key set, and limits how many requests each caller
+// makes per rate limit window
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kiquetal/nats-go-examples/internal/idp/jwks"
+	"github.com/kiquetal/nats-go-examples/internal/ratelimit"
+)
+
+// APIKeyHeader carries a static API key
+const APIKeyHeader = "X-API-Key"
+
+// Methods a caller authenticated with, reported in Caller.Method
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+)
+
+// ScopeCaller is the rate limit scope of the per-caller limits, passed to OnLimited
+const ScopeCaller = "caller"
+
+// Authentication failures, passed to OnRejected
+var (
+	ErrMissingCredentials = errors.New("no API key or bearer token")
+	ErrInvalidAPIKey      = errors.New("invalid API key")
+	ErrJWTDisabled        = errors.New("bearer tokens are not accepted")
+)
+
+// Config selects how callers authenticate. Requests pass without authentication when no API
+// key is set and JWTs are not accepted.
+type Config struct {
+	APIKeys []APIKey `json:"apiKeys,omitempty"`
+	JWT     bool     `json:"jwt,omitempty"` // accept bearer JWTs signed by the IDP, identified by their subject
+
+	// RateLimit is the requests per rate limit window of each caller whose key sets no limit of
+	// its own, including every JWT subject; unlimited if 0
+	RateLimit int `json:"rateLimit,omitempty"`
+}
+
+// APIKey is a static key given to one caller
+type APIKey struct {
+	Name      string `json:"name"`                // identifies the caller in logs and rate limits
+	Key       string `json:"key"`                 // sent in the X-API-Key header, may be a secret reference
+	RateLimit int    `json:"rateLimit,omitempty"` // requests per window, Config.RateLimit if 0
+}
+
+// Enabled reports whether callers have to authenticate
+func (c Config) Enabled() bool {
+	return len(c.APIKeys) > 0 || c.JWT
+}
+
+// Validate checks that every API key has a name and a key, and that the names are unique
+func (c Config) Validate() error {
+	names := make(map[string]bool, len(c.APIKeys))
+	for i, key := range c.APIKeys {
+		if key.Name == "" || key.Key == "" {
+			return fmt.Errorf("API key %d needs a name and a key", i+1)
+		}
+		if names[key.Name] {
+			return fmt.Errorf("API key name %q is used twice", key.Name)
+		}
+		names[key.Name] = true
+	}
+	return nil
+}
+
+// Caller is an authenticated caller
+type Caller struct {
+	Name      string // the API key's name or the JWT's subject
+	Method    string // MethodAPIKey or MethodJWT
+	RateLimit int    // requests per window, unlimited if 0
+}
+
+// callerKey is the context key of the Caller
+type callerKey struct{}
+
+// CallerFrom returns the caller that authenticated the request with ctx, if any
+func CallerFrom(ctx context.Context) (Caller, bool) {
+	caller, ok := ctx.Value(callerKey{}).(Caller)
+	return caller, ok
+}
+
+// Middleware rejects requests without a valid API key or bearer JWT with 401 Unauthorized,
+// and those over their caller's limit with 429 Too Many Requests. Requests are allowed when
+// the limiter fails, like with the ratelimit middleware.
+type Middleware struct {
+	keys    *jwks.KeySet
+	limiter ratelimit.Limiter
+	config  atomic.Pointer[Config]
+
+	// OnAuthenticated, if not nil, is called with the caller of every authenticated request,
+	// e.g. to write an audit log
+	OnAuthenticated func(r *http.Request, caller Caller)
+	// OnRejected, if not nil, is called with the reason of every rejected request
+	OnRejected func(r *http.Request, err error)
+	// OnLimited, if not nil, is called with the caller of every request over its limit
+	OnLimited func(r *http.Request, caller Caller)
+	// OnError, if not nil, receives the limiter's errors
+	OnError func(error)
+}
+
+// NewMiddleware creates a middleware authenticating callers as cfg says. keys validates bearer
+// JWTs and may be nil if they are not accepted; limiter enforces the per-caller limits.
+func NewMiddleware(cfg Config, keys *jwks.KeySet, limiter ratelimit.Limiter) *Middleware {
+	m := &Middleware{keys: keys, limiter: limiter}
+	m.config.Store(&cfg)
+	return m
+}
+
+// SetConfig changes the keys and limits, e.g. when the configuration is reloaded
+func (m *Middleware) SetConfig(cfg Config) {
+	m.config.Store(&cfg)
+}
+
+// Wrap authenticates the requests to next, which finds the caller with CallerFrom
+func (m *Middleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := m.config.Load()
+		if !cfg.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		caller, err := m.authenticate(r, cfg)
+		if err != nil {
+			if m.OnRejected != nil {
+				m.OnRejected(r, err)
+			}
+			if cfg.JWT {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="brain-app"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if m.OnAuthenticated != nil {
+			m.OnAuthenticated(r, caller)
+		}
+
+		if caller.RateLimit > 0 && m.limiter != nil {
+			allowed, retryAfter, err := m.limiter.Allow(ScopeCaller+":"+caller.Method+":"+caller.Name, caller.RateLimit)
+			if err != nil && m.OnError != nil {
+				m.OnError(err)
+			}
+			if err == nil && !allowed {
+				if m.OnLimited != nil {
+					m.OnLimited(r, caller)
+				}
+				ratelimit.TooManyRequests(w, retryAfter)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, caller)))
+	})
+}
+
+// authenticate identifies the caller by the API key header, or else by the bearer token
+func (m *Middleware) authenticate(r *http.Request, cfg *Config) (Caller, error) {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		// Every key is compared, so the time taken does not tell which one came close
+		var match *APIKey
+		for i := range cfg.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(cfg.APIKeys[i].Key)) == 1 && match == nil {
+				match = &cfg.APIKeys[i]
+			}
+		}
+		if match == nil {
+			return Caller{}, ErrInvalidAPIKey
+		}
+		limit := match.RateLimit
+		if limit == 0 {
+			limit = cfg.RateLimit
+		}
+		return Caller{Name: match.Name, Method: MethodAPIKey, RateLimit: limit}, nil
+	}
+
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return Caller{}, ErrMissingCredentials
+	}
+	if !cfg.JWT || m.keys == nil {
+		return Caller{}, ErrJWTDisabled
+	}
+	claims, err := m.keys.ValidateTokenCtx(r.Context(), token)
+	if err != nil {
+		return Caller{}, err
+	}
+	// Client credentials tokens of some IDPs carry no subject, only the client in azp
+	name := claims.Subject
+	if name == "" {
+		name = claims.ClientID
+	}
+	return Caller{Name: name, Method: MethodJWT, RateLimit: cfg.RateLimit}, nil
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/idp/jwks"
+	"github.com/kiquetal/nats-go-examples/internal/ratelimit"
+)
+
+// serve sends a request with the given headers through the middleware and returns the status
+// and the caller the handler saw
+func serve(m *Middleware, headers map[string]string) (int, Caller) {
+	var seen Caller
+	handler := m.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = CallerFrom(r.Context())
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/token", nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code, seen
+}
+
+func TestMiddlewareAPIKeys(t *testing.T) {
+	cfg := Config{
+		APIKeys: []APIKey{
+			{Name: "billing", Key: "billing-key", RateLimit: 2},
+			{Name: "reports", Key: "reports-key"},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMiddleware(cfg, nil, ratelimit.NewMemoryLimiter(time.Minute))
+	var rejected []error
+	m.OnRejected = func(r *http.Request, err error) { rejected = append(rejected, err) }
+	var limited []string
+	m.OnLimited = func(r *http.Request, caller Caller) { limited = append(limited, caller.Name) }
+
+	code, caller := serve(m, map[string]string{APIKeyHeader: "reports-key"})
+	if code != http.StatusOK || caller != (Caller{Name: "reports", Method: MethodAPIKey}) {
+		t.Fatalf("expected the reports caller, got %d and %+v", code, caller)
+	}
+
+	for _, headers := range []map[string]string{
+		nil,
+		{APIKeyHeader: "guessed"},
+		{"Authorization": "Bearer eyJ.x.y"},
+	} {
+		if code, _ := serve(m, headers); code != http.StatusUnauthorized {
+			t.Errorf("%v: expected 401, got %d", headers, code)
+		}
+	}
+	if len(rejected) != 3 || !errors.Is(rejected[0], ErrMissingCredentials) || !errors.Is(rejected[1], ErrInvalidAPIKey) || !errors.Is(rejected[2], ErrJWTDisabled) {
+		t.Fatalf("unexpected rejections %v", rejected)
+	}
+
+	// The billing key has a limit of its own, the reports key none
+	for i := 0; i < 3; i++ {
+		serve(m, map[string]string{APIKeyHeader: "billing-key"})
+		serve(m, map[string]string{APIKeyHeader: "reports-key"})
+	}
+	if len(limited) != 1 || limited[0] != "billing" {
+		t.Fatalf("expected the third billing request to be limited, got %v", limited)
+	}
+
+	// Without keys or JWTs, requests pass unauthenticated
+	m.SetConfig(Config{})
+	if code, caller := serve(m, nil); code != http.StatusOK || caller != (Caller{}) {
+		t.Fatalf("expected an anonymous request to pass, got %d and %+v", code, caller)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, keys := range [][]APIKey{
+		{{Name: "billing"}},
+		{{Key: "key"}},
+		{{Name: "billing", Key: "a"}, {Name: "billing", Key: "b"}},
+	} {
+		if err := (Config{APIKeys: keys}).Validate(); err == nil {
+			t.Errorf("%+v: expected an error", keys)
+		}
+	}
+}
+
+func TestMiddlewareJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer idp.Close()
+
+	m := NewMiddleware(Config{JWT: true, RateLimit: 10}, jwks.New(idp.URL, jwks.Options{}), nil)
+	exp := time.Now().Add(time.Hour).Unix()
+	for claims, want := range map[string]string{
+		`{"sub":"svc-orders","exp":` + strconv.FormatInt(exp, 10) + `}`:  "svc-orders",
+		`{"azp":"svc-reports","exp":` + strconv.FormatInt(exp, 10) + `}`: "svc-reports",
+	} {
+		code, caller := serve(m, map[string]string{"Authorization": "Bearer " + signRS256(t, key, claims)})
+		if code != http.StatusOK || caller != (Caller{Name: want, Method: MethodJWT, RateLimit: 10}) {
+			t.Errorf("expected %s, got %d and %+v", want, code, caller)
+		}
+	}
+
+	expired := signRS256(t, key, `{"sub":"svc-orders","exp":`+strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)+`}`)
+	if code, _ := serve(m, map[string]string{"Authorization": "Bearer " + expired}); code != http.StatusUnauthorized {
+		t.Fatalf("expected an expired token to be refused, got %d", code)
+	}
+}
+
+// signRS256 builds a compact JWT with key ID k1
+func signRS256(t *testing.T, key *rsa.PrivateKey, claims string) string {
+	t.Helper()
+	input := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"k1","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(claims))
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// EncryptedStore encrypts tokens with AES-GCM before they reach the store it wraps, so a heap
+// dump of the in-memory cache or a snapshot of Redis or the KV bucket holds no bearer tokens.
+// Client IDs, the keys of the store, are not encrypted. Each token is sealed with a random
+// nonce and bound to its client ID, so a ciphertext copied to another client's key fails to
+// decrypt.
+type EncryptedStore struct {
+	Store
+	aead    cipher.AEAD
+	onError func(error)
+}
+
+// NewEncryptedStore wraps s, encrypting with key, which must be 16, 24 or 32 bytes long for
+// AES-128, AES-192 or AES-256. onError, if not nil, receives the errors of tokens that cannot
+// be decrypted, e.g. because they were stored with another key; they are treated as misses.
+func NewEncryptedStore(s Store, key []byte, onError func(error)) (*EncryptedStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if onError == nil {
+		onError = func(error) {}
+	}
+	return &EncryptedStore{Store: s, aead: aead, onError: onError}, nil
+}
+
+// ParseKey decodes a base64 encryption key, as generated by `openssl rand -base64 32`
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("cache encryption key is not valid base64: %w", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("cache encryption key has %d bytes, expected 16, 24 or 32", len(key))
+}
+
+// Get returns the decrypted token if it is cached
+func (s *EncryptedStore) Get(clientID string) (string, bool) {
+	entry, ok := s.Lookup(clientID)
+	return entry.Token, ok
+}
+
+// Lookup returns the decrypted token with its storage and expiry times
+func (s *EncryptedStore) Lookup(clientID string) (Entry, bool) {
+	entry, ok := s.Store.Lookup(clientID)
+	if !ok {
+		return Entry{}, false
+	}
+	token, err := s.open(clientID, entry.Token)
+	if err != nil {
+		s.onError(fmt.Errorf("cached token of %s: %w", clientID, err))
+		return Entry{}, false
+	}
+	entry.Token = token
+	return entry, true
+}
+
+// Set encrypts the token and caches it for ttl
+func (s *EncryptedStore) Set(clientID, token string, ttl time.Duration) {
+	s.Store.Set(clientID, s.seal(clientID, token), ttl)
+}
+
+// Unwrap returns the store holding the encrypted tokens
+func (s *EncryptedStore) Unwrap() Store {
+	return s.Store
+}
+
+// Close closes the wrapped store if it holds connections
+func (s *EncryptedStore) Close() error {
+	if closer, ok := s.Store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// seal encrypts a token into base64(nonce || ciphertext), with the client ID as additional data
+func (s *EncryptedStore) seal(clientID, token string) string {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(token)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	return base64.RawStdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, []byte(token), []byte(clientID)))
+}
+
+// open reverses seal
+func (s *EncryptedStore) open(clientID, sealed string) (string, error) {
+	data, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < s.aead.NonceSize() {
+		return "", errors.New("not an encrypted token")
+	}
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	token, err := s.aead.Open(nil, nonce, ciphertext, []byte(clientID))
+	if err != nil {
+		return "", errors.New("decryption failed, was it stored with another key?")
+	}
+	return string(token), nil
+}
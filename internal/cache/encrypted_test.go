@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = bytes.Repeat([]byte{7}, 32)
+
+func TestEncryptedStoreRoundTrip(t *testing.T) {
+	inner := NewTokenCache()
+	s, err := NewEncryptedStore(inner, testKey, func(err error) { t.Errorf("unexpected error: %v", err) })
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	s.Set("client-a", "bearer-token-a", time.Hour)
+	if token, ok := s.Get("client-a"); !ok || token != "bearer-token-a" {
+		t.Fatalf("expected the decrypted token, got %q, %v", token, ok)
+	}
+	entry, ok := s.Lookup("client-a")
+	if !ok || entry.Token != "bearer-token-a" || entry.ExpiresAt.Sub(entry.StoredAt) != time.Hour {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	stored, _ := inner.Get("client-a")
+	if strings.Contains(stored, "bearer-token-a") {
+		t.Fatalf("the wrapped store holds the token in plain text: %q", stored)
+	}
+	// Random nonces make every ciphertext different
+	s.Set("client-a", "bearer-token-a", time.Hour)
+	if again, _ := inner.Get("client-a"); again == stored {
+		t.Fatal("expected a fresh ciphertext for each Set")
+	}
+
+	s.Delete("client-a")
+	if _, ok := s.Get("client-a"); ok || s.Len() != 0 {
+		t.Fatal("expected Delete to reach the wrapped store")
+	}
+}
+
+func TestEncryptedStoreRejectsForeignCiphertexts(t *testing.T) {
+	inner := NewTokenCache()
+	var errs []error
+	s, _ := NewEncryptedStore(inner, testKey, func(err error) { errs = append(errs, err) })
+	other, _ := NewEncryptedStore(inner, bytes.Repeat([]byte{8}, 32), nil)
+
+	// Stored with another key
+	other.Set("client-a", "token-a", time.Hour)
+	if _, ok := s.Get("client-a"); ok {
+		t.Fatal("expected a miss for a token encrypted with another key")
+	}
+
+	// Copied from another client
+	s.Set("client-b", "token-b", time.Hour)
+	sealed, _ := inner.Get("client-b")
+	inner.Set("client-c", sealed, time.Hour)
+	if _, ok := s.Get("client-c"); ok {
+		t.Fatal("expected a miss for a ciphertext moved to another client")
+	}
+
+	// Plain text from before encryption was enabled
+	inner.Set("client-d", "plain", time.Hour)
+	if _, ok := s.Get("client-d"); ok {
+		t.Fatal("expected a miss for a plain text token")
+	}
+
+	if len(errs) != 3 {
+		t.Fatalf("expected 3 reported errors, got %v", errs)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	for _, size := range []int{16, 24, 32} {
+		encoded := base64.StdEncoding.EncodeToString(make([]byte, size))
+		if key, err := ParseKey(encoded + "\n"); err != nil || len(key) != size {
+			t.Fatalf("ParseKey of a %d byte key: %v", size, err)
+		}
+	}
+	for _, encoded := range []string{"not base64!", base64.StdEncoding.EncodeToString(make([]byte, 20))} {
+		if _, err := ParseKey(encoded); err == nil {
+			t.Fatalf("expected an error for %q", encoded)
+		}
+	}
+}
+
+func TestNewWrapsBackendWhenKeyIsSet(t *testing.T) {
+	s, err := New(Config{EncryptionKey: base64.StdEncoding.EncodeToString(testKey)}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	if _, ok := s.(*EncryptedStore); !ok {
+		t.Fatalf("expected an EncryptedStore, got %T", s)
+	}
+	if _, ok := Unwrap(s).(*TokenCache); !ok {
+		t.Fatalf("expected the in-memory cache underneath, got %T", Unwrap(s))
+	}
+	if _, err := New(Config{EncryptionKey: "short"}, nil, nil); err == nil {
+		t.Fatal("expected an error for an invalid key")
+	}
+}
@@ -0,0 +1,221 @@
+package cache
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/kvstore"
+	"github.com/nats-io/nats.go"
+)
+
+// KV defaults
+const (
+	DefaultKVBucket  = "tokens"
+	DefaultKVTTL     = 3600 // seconds
+	DefaultKVTimeout = 500  // milliseconds
+)
+
+// kvWriteAttempts bounds how often Set retries after losing a race with another writer
+const kvWriteAttempts = 3
+
+// KVConfig configures the JetStream Key-Value store
+type KVConfig struct {
+	Bucket   string `json:"bucket,omitempty"`   // created if missing
+	TTL      int    `json:"ttl,omitempty"`      // bucket TTL in seconds, the longest a token is kept
+	Replicas int    `json:"replicas,omitempty"` // of a created bucket
+	Timeout  int    `json:"timeout,omitempty"`  // per operation, in milliseconds
+}
+
+// KVStore keeps tokens in a JetStream Key-Value bucket, so every replica connected to the same
+// NATS cluster shares them. The bucket's TTL removes old entries; each entry also records when
+// its token expires, so tokens with shorter lifetimes are not served after they expire.
+//
+// Writers race through revisions: a token replaces the stored one only if it expires later,
+// and a write based on a stale revision is retried against the new one.
+type KVStore struct {
+	kv      nats.KeyValue
+	maxTTL  time.Duration
+	onError func(error)
+}
+
+// NewKVStore opens the bucket, creating it if needed. onError, if not nil, receives the errors
+// of operations that fail later.
+func NewKVStore(nc *nats.Conn, cfg KVConfig, onError func(error)) (*KVStore, error) {
+	if cfg.Bucket == "" {
+		cfg.Bucket = DefaultKVBucket
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultKVTTL
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultKVTimeout
+	}
+
+	js, err := nc.JetStream(nats.MaxWait(time.Duration(cfg.Timeout) * time.Millisecond))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JetStream context: %w", err)
+	}
+	kv, err := js.KeyValue(cfg.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      cfg.Bucket,
+			Description: "Shared token cache",
+			TTL:         time.Duration(cfg.TTL) * time.Second,
+			History:     1,
+			Replicas:    cfg.Replicas,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open KV bucket %s: %w", cfg.Bucket, err)
+	}
+
+	s := &KVStore{kv: kv, maxTTL: time.Duration(cfg.TTL) * time.Second, onError: onError}
+	if status, err := kv.Status(); err == nil && status.TTL() > 0 {
+		// An existing bucket keeps its own TTL
+		s.maxTTL = status.TTL()
+	}
+	if s.onError == nil {
+		s.onError = func(error) {}
+	}
+	return s, nil
+}
+
+// Bucket returns the name of the bucket
+func (s *KVStore) Bucket() string {
+	return s.kv.Bucket()
+}
+
+// Get returns the token if it is cached
+func (s *KVStore) Get(clientID string) (string, bool) {
+	entry, ok := s.Lookup(clientID)
+	return entry.Token, ok
+}
+
+// Lookup returns the token with its storage and expiry times
+func (s *KVStore) Lookup(clientID string) (Entry, bool) {
+	entry, _, err := s.load(clientID)
+	if err != nil {
+		if !errors.Is(err, nats.ErrKeyNotFound) {
+			s.onError(fmt.Errorf("kv get %s: %w", clientID, err))
+		}
+		return Entry{}, false
+	}
+	if time.Now().After(entry.ExpiresAt) {
+		return Entry{}, false
+	}
+	return entry, true
+}
+
+// Set caches the token for ttl, capped at the bucket TTL. If another replica stored a token
+// that expires later, that token is kept.
+func (s *KVStore) Set(clientID, token string, ttl time.Duration) {
+	if ttl < time.Millisecond {
+		s.Delete(clientID)
+		return
+	}
+	if ttl > s.maxTTL {
+		ttl = s.maxTTL
+	}
+	entry := newEntry(token, ttl)
+	data := encodeEntry(entry)
+	key := kvKey(clientID)
+
+	var err error
+	for attempt := 0; attempt < kvWriteAttempts; attempt++ {
+		var current Entry
+		var revision uint64
+		current, revision, err = s.load(clientID)
+		switch {
+		case errors.Is(err, nats.ErrKeyNotFound):
+			_, err = s.kv.Create(key, data)
+		case err != nil && revision == 0:
+			// The bucket could not be read; the error is reported below
+		case err == nil && current.ExpiresAt.After(entry.ExpiresAt):
+			return
+		default:
+			// Replaces an older or unreadable entry, unless it changed since it was read
+			_, err = s.kv.Update(key, data, revision)
+		}
+		if !kvstore.IsConflict(err) {
+			break
+		}
+	}
+	if err != nil {
+		s.onError(fmt.Errorf("kv put %s: %w", clientID, err))
+	}
+}
+
+// Delete removes the client's token
+func (s *KVStore) Delete(clientID string) {
+	if err := s.kv.Delete(kvKey(clientID)); err != nil {
+		s.onError(fmt.Errorf("kv delete %s: %w", clientID, err))
+	}
+}
+
+// Clear removes every token in the bucket
+func (s *KVStore) Clear() {
+	keys, err := s.keys()
+	for _, key := range keys {
+		if err = s.kv.Delete(key); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		s.onError(fmt.Errorf("kv clear: %w", err))
+	}
+}
+
+// Len counts the keys in the bucket, including tokens that expired before the bucket TTL
+// removed them. It lists the bucket, so it suits metrics scrapes rather than request paths.
+func (s *KVStore) Len() int {
+	keys, err := s.keys()
+	if err != nil {
+		s.onError(fmt.Errorf("kv count: %w", err))
+	}
+	return len(keys)
+}
+
+// Keys returns the client IDs of the tokens in the bucket, sorted. Like Len, it lists the bucket.
+func (s *KVStore) Keys() []string {
+	keys, err := s.keys()
+	if err != nil {
+		s.onError(fmt.Errorf("kv keys: %w", err))
+	}
+	clientIDs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if clientID, err := base64.RawURLEncoding.DecodeString(key); err == nil {
+			clientIDs = append(clientIDs, string(clientID))
+		}
+	}
+	sort.Strings(clientIDs)
+	return clientIDs
+}
+
+// load reads the client's entry and its revision. For an entry that cannot be decoded, the
+// revision is returned with the error so the entry can be overwritten.
+func (s *KVStore) load(clientID string) (Entry, uint64, error) {
+	kve, err := s.kv.Get(kvKey(clientID))
+	if err != nil {
+		return Entry{}, 0, err
+	}
+	entry, err := decodeEntry(kve.Value())
+	return entry, kve.Revision(), err
+}
+
+// keys lists the bucket's keys; an empty bucket has none
+func (s *KVStore) keys() ([]string, error) {
+	keys, err := s.kv.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return nil, nil
+	}
+	return keys, err
+}
+
+// kvKey encodes a client ID as a valid key, since client IDs may hold characters such as
+// spaces or '*' that keys may not
+func kvKey(clientID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(clientID))
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/testutil"
+	"github.com/nats-io/nats.go"
+)
+
+// connectJetStream runs an embedded NATS server with JetStream and connects to it
+func connectJetStream(t *testing.T) *nats.Conn {
+	t.Helper()
+	return testutil.Connect(t, testutil.StartServer(t))
+}
+
+func TestKVStoreRoundTrip(t *testing.T) {
+	nc := connectJetStream(t)
+	s, err := NewKVStore(nc, KVConfig{}, func(err error) { t.Errorf("unexpected error: %v", err) })
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	if _, ok := s.Get("client a"); ok {
+		t.Fatal("expected a miss on an empty store")
+	}
+
+	s.Set("client a", "token-a", 30*time.Minute)
+	if token, ok := s.Get("client a"); !ok || token != "token-a" {
+		t.Fatalf("expected token-a, got %q, %v", token, ok)
+	}
+	entry, ok := s.Lookup("client a")
+	if !ok || entry.ExpiresAt.Sub(entry.StoredAt) != 30*time.Minute {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	// Another replica sees the token
+	other, err := NewKVStore(nc, KVConfig{}, nil)
+	if err != nil {
+		t.Fatalf("failed to open the bucket again: %v", err)
+	}
+	if token, ok := other.Get("client a"); !ok || token != "token-a" {
+		t.Fatalf("expected the token to be shared, got %q, %v", token, ok)
+	}
+
+	s.Delete("client a")
+	if _, ok := other.Get("client a"); ok {
+		t.Fatal("expected a miss after Delete")
+	}
+	// A deleted key can be stored again
+	s.Set("client a", "token-b", time.Minute)
+	if token, _ := s.Get("client a"); token != "token-b" {
+		t.Fatalf("expected token-b, got %q", token)
+	}
+}
+
+func TestKVStoreCapsTTLAtBucketTTL(t *testing.T) {
+	nc := connectJetStream(t)
+	s, err := NewKVStore(nc, KVConfig{Bucket: "short", TTL: 60}, nil)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	s.Set("client-a", "token-a", time.Hour)
+	entry, ok := s.Lookup("client-a")
+	if !ok || entry.ExpiresAt.Sub(entry.StoredAt) != time.Minute {
+		t.Fatalf("expected the TTL to be capped at the bucket TTL, got %+v", entry)
+	}
+
+	s.Set("client-b", "token-b", 50*time.Millisecond)
+	s.Set("client-c", "token-c", -time.Second)
+	time.Sleep(80 * time.Millisecond)
+	if _, ok := s.Get("client-b"); ok {
+		t.Fatal("expected the token to expire before the bucket TTL")
+	}
+	if _, ok := s.Get("client-c"); ok {
+		t.Fatal("a token set with a negative TTL must not be cached")
+	}
+}
+
+func TestKVStoreConcurrentWritersKeepLatestExpiry(t *testing.T) {
+	nc := connectJetStream(t)
+	s, err := NewKVStore(nc, KVConfig{}, func(err error) { t.Errorf("unexpected error: %v", err) })
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.Set("client-a", fmt.Sprintf("token-%d", i), time.Duration(i)*time.Minute)
+		}(i)
+	}
+	wg.Wait()
+
+	if token, _ := s.Get("client-a"); token != "token-10" {
+		t.Fatalf("expected the token expiring last to win, got %q", token)
+	}
+	// A token expiring sooner does not replace it
+	s.Set("client-a", "token-short", time.Minute)
+	if token, _ := s.Get("client-a"); token != "token-10" {
+		t.Fatalf("expected token-10 to be kept, got %q", token)
+	}
+}
+
+func TestKVStoreClear(t *testing.T) {
+	nc := connectJetStream(t)
+	s, err := NewKVStore(nc, KVConfig{}, func(err error) { t.Errorf("unexpected error: %v", err) })
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	if n := s.Len(); n != 0 {
+		t.Fatalf("expected an empty bucket, got %d tokens", n)
+	}
+	for _, clientID := range []string{"client b", "client*a", "client-c"} {
+		s.Set(clientID, "token", time.Hour)
+	}
+	if n := s.Len(); n != 3 {
+		t.Fatalf("expected 3 tokens, got %d", n)
+	}
+	// Keys decodes the client IDs that are not valid keys themselves
+	if keys := strings.Join(s.Keys(), ","); keys != "client b,client*a,client-c" {
+		t.Fatalf("expected the sorted client IDs, got %s", keys)
+	}
+	s.Clear()
+	if n := s.Len(); n != 0 {
+		t.Fatalf("expected 0 tokens after Clear, got %d", n)
+	}
+}
+
+func TestNewKVStoreNeedsConnection(t *testing.T) {
+	if _, err := New(Config{Backend: BackendKV}, nil, nil); err == nil {
+		t.Fatal("expected an error without a NATS connection")
+	}
+}
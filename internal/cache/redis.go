@@ -0,0 +1,373 @@
+package cache
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redis defaults
+const (
+	DefaultRedisKeyPrefix = "tokens:"
+	DefaultRedisTimeout   = 500 // milliseconds
+	DefaultRedisPoolSize  = 10
+)
+
+// RedisConfig configures the Redis store
+type RedisConfig struct {
+	URL       string `json:"url"`                 // redis://[user[:password]@]host:port[/db], rediss:// for TLS
+	Password  string `json:"password,omitempty"`  // overrides the URL's password, may be a secret reference
+	KeyPrefix string `json:"keyPrefix,omitempty"` // namespace of the token keys
+	Timeout   int    `json:"timeout,omitempty"`   // per command, in milliseconds
+	PoolSize  int    `json:"poolSize,omitempty"`  // idle connections kept open
+}
+
+// RedisStore keeps tokens in Redis, so every replica shares them. Keys expire in Redis with
+// the token's TTL. It speaks RESP directly, which keeps a Redis client library out of the module.
+type RedisStore struct {
+	addr     string
+	tlsCfg   *tls.Config
+	username string
+	password string
+	db       int
+	prefix   string
+	timeout  time.Duration
+	onError  func(error)
+
+	idle chan *redisConn
+}
+
+// NewRedisStore connects to Redis and checks that it answers. onError, if not nil, receives
+// the errors of commands that fail later.
+func NewRedisStore(cfg RedisConfig, onError func(error)) (*RedisStore, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Redis URL %q, expected redis://host:port[/db]", cfg.URL)
+	}
+
+	s := &RedisStore{
+		addr:    u.Host,
+		prefix:  cfg.KeyPrefix,
+		timeout: time.Duration(cfg.Timeout) * time.Millisecond,
+		onError: onError,
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.Scheme == "rediss" {
+		s.tlsCfg = &tls.Config{ServerName: u.Hostname()}
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if cfg.Password != "" {
+		s.password = cfg.Password
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+	if s.prefix == "" {
+		s.prefix = DefaultRedisKeyPrefix
+	}
+	if s.timeout <= 0 {
+		s.timeout = DefaultRedisTimeout * time.Millisecond
+	}
+	poolSize := cfg.PoolSize
+	if poolSize <= 0 {
+		poolSize = DefaultRedisPoolSize
+	}
+	s.idle = make(chan *redisConn, poolSize)
+	if s.onError == nil {
+		s.onError = func(error) {}
+	}
+
+	if _, err := s.do("PING"); err != nil {
+		return nil, fmt.Errorf("failed to reach Redis at %s: %w", s.addr, err)
+	}
+	return s, nil
+}
+
+// Get returns the token if it is cached
+func (s *RedisStore) Get(clientID string) (string, bool) {
+	entry, ok := s.Lookup(clientID)
+	return entry.Token, ok
+}
+
+// Lookup returns the token with its storage and expiry times
+func (s *RedisStore) Lookup(clientID string) (Entry, bool) {
+	reply, err := s.do("GET", s.prefix+clientID)
+	if err != nil {
+		s.onError(fmt.Errorf("redis GET: %w", err))
+		return Entry{}, false
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return Entry{}, false
+	}
+
+	entry, err := decodeEntry(data)
+	if err != nil {
+		s.onError(fmt.Errorf("redis GET %s: %w", clientID, err))
+		return Entry{}, false
+	}
+	if time.Now().After(entry.ExpiresAt) {
+		return Entry{}, false
+	}
+	return entry, true
+}
+
+// Set caches the token; Redis removes it once ttl has passed
+func (s *RedisStore) Set(clientID, token string, ttl time.Duration) {
+	// Redis rejects non-positive expiries, and such a token would be expired anyway
+	if ttl < time.Millisecond {
+		s.Delete(clientID)
+		return
+	}
+	data := encodeEntry(newEntry(token, ttl))
+	if _, err := s.do("SET", s.prefix+clientID, string(data), "PX", strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+		s.onError(fmt.Errorf("redis SET: %w", err))
+	}
+}
+
+// Delete removes the client's token
+func (s *RedisStore) Delete(clientID string) {
+	if _, err := s.do("DEL", s.prefix+clientID); err != nil {
+		s.onError(fmt.Errorf("redis DEL: %w", err))
+	}
+}
+
+// Clear removes every token under the key prefix
+func (s *RedisStore) Clear() {
+	err := s.scan(func(keys []string) error {
+		if len(keys) == 0 {
+			return nil
+		}
+		_, err := s.do(append([]string{"DEL"}, keys...)...)
+		return err
+	})
+	if err != nil {
+		s.onError(fmt.Errorf("redis clear: %w", err))
+	}
+}
+
+// Len counts the tokens under the key prefix. It scans the keyspace, so it suits metrics
+// scrapes rather than request paths.
+func (s *RedisStore) Len() int {
+	n := 0
+	err := s.scan(func(keys []string) error {
+		n += len(keys)
+		return nil
+	})
+	if err != nil {
+		s.onError(fmt.Errorf("redis count: %w", err))
+	}
+	return n
+}
+
+// Keys returns the client IDs of the tokens under the key prefix, sorted. Like Len, it scans
+// the keyspace.
+func (s *RedisStore) Keys() []string {
+	var clientIDs []string
+	err := s.scan(func(keys []string) error {
+		for _, key := range keys {
+			clientIDs = append(clientIDs, strings.TrimPrefix(key, s.prefix))
+		}
+		return nil
+	})
+	if err != nil {
+		s.onError(fmt.Errorf("redis keys: %w", err))
+	}
+	sort.Strings(clientIDs)
+	return clientIDs
+}
+
+// Close closes the idle connections
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// scan calls fn with each batch of token keys
+func (s *RedisStore) scan(fn func(keys []string) error) error {
+	cursor := "0"
+	for {
+		reply, err := s.do("SCAN", cursor, "MATCH", s.prefix+"*", "COUNT", "100")
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return fmt.Errorf("unexpected SCAN reply %v", reply)
+		}
+		next, _ := parts[0].([]byte)
+		items, _ := parts[1].([]interface{})
+		keys := make([]string, 0, len(items))
+		for _, item := range items {
+			if key, ok := item.([]byte); ok {
+				keys = append(keys, string(key))
+			}
+		}
+		if err := fn(keys); err != nil {
+			return err
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// Do runs a command on the store's connections and returns its reply: strings as []byte,
+// integers as int64 and arrays as []interface{}. Keys are not prefixed, which lets other
+// users of the same Redis, such as rate limiters, keep their keys apart from the tokens.
+func (s *RedisStore) Do(args ...string) (interface{}, error) {
+	return s.do(args...)
+}
+
+// do runs a command on a pooled connection. Connections that fail are discarded.
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	c, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(s.timeout, args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		c.Close()
+		return nil, err
+	}
+
+	select {
+	case s.idle <- c:
+	default:
+		c.Close()
+	}
+	return reply, err
+}
+
+// conn returns an idle connection, or dials, authenticates and selects the database
+func (s *RedisStore) conn() (*redisConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+	}
+
+	dialer := &net.Dialer{Timeout: s.timeout}
+	var nc net.Conn
+	var err error
+	if s.tlsCfg != nil {
+		nc, err = tls.DialWithDialer(dialer, "tcp", s.addr, s.tlsCfg)
+	} else {
+		nc, err = dialer.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+
+	if s.password != "" {
+		args := []string{"AUTH", s.password}
+		if s.username != "" {
+			args = []string{"AUTH", s.username, s.password}
+		}
+		if _, err := c.do(s.timeout, args...); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+	if s.db != 0 {
+		if _, err := c.do(s.timeout, "SELECT", strconv.Itoa(s.db)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// redisError is an error reply from the server; the connection remains usable
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisConn is one connection speaking RESP
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends a command as an array of bulk strings and reads the reply
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	c.SetDeadline(time.Now().Add(timeout))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read parses one reply: strings and bulk strings as []byte, integers as int64, nil for
+// null replies, arrays as []interface{} and error replies as redisError
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
@@ -0,0 +1,292 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis speaks enough RESP to exercise RedisStore: PING, AUTH, SELECT, GET, SET with PX,
+// DEL and SCAN with MATCH on a trailing wildcard
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu      sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	f := &fakeRedis{ln: ln, password: password, values: map[string]string{}, expires: map[string]time.Time{}}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) url() string {
+	return "redis://" + f.ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		if !authed && cmd != "AUTH" {
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		switch cmd {
+		case "AUTH":
+			if args[len(args)-1] != f.password {
+				io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authed = true
+			io.WriteString(conn, "+OK\r\n")
+		case "PING":
+			io.WriteString(conn, "+PONG\r\n")
+		case "SELECT":
+			io.WriteString(conn, "+OK\r\n")
+		default:
+			io.WriteString(conn, f.apply(cmd, args[1:]))
+		}
+	}
+}
+
+// apply runs a data command and returns its encoded reply
+func (f *fakeRedis) apply(cmd string, args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key, at := range f.expires {
+		if time.Now().After(at) {
+			delete(f.values, key)
+			delete(f.expires, key)
+		}
+	}
+
+	switch cmd {
+	case "GET":
+		v, ok := f.values[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		f.values[args[0]] = args[1]
+		delete(f.expires, args[0])
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			ms, _ := strconv.Atoi(args[3])
+			f.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args {
+			if _, ok := f.values[key]; ok {
+				delete(f.values, key)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SCAN":
+		prefix := strings.TrimSuffix(args[2], "*")
+		var b strings.Builder
+		var keys []string
+		for key := range f.values {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		fmt.Fprintf(&b, "*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+		for _, key := range keys {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(key), key)
+		}
+		return b.String()
+	}
+	return "-ERR unknown command '" + cmd + "'\r\n"
+}
+
+// readCommand reads a RESP array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisStoreRoundTrip(t *testing.T) {
+	f := startFakeRedis(t, "")
+	s, err := NewRedisStore(RedisConfig{URL: f.url()}, func(err error) { t.Errorf("unexpected error: %v", err) })
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	if _, ok := s.Get("client-a"); ok {
+		t.Fatal("expected a miss on an empty store")
+	}
+
+	s.Set("client-a", "token-a", time.Hour)
+	if token, ok := s.Get("client-a"); !ok || token != "token-a" {
+		t.Fatalf("expected token-a, got %q, %v", token, ok)
+	}
+	entry, ok := s.Lookup("client-a")
+	if !ok || time.Until(entry.ExpiresAt) <= 59*time.Minute || entry.ExpiresAt.Sub(entry.StoredAt) != time.Hour {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	s.Delete("client-a")
+	if _, ok := s.Get("client-a"); ok {
+		t.Fatal("expected a miss after Delete")
+	}
+}
+
+func TestRedisStoreExpiresTokens(t *testing.T) {
+	f := startFakeRedis(t, "")
+	s, err := NewRedisStore(RedisConfig{URL: f.url()}, nil)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	s.Set("client-a", "token-a", 50*time.Millisecond)
+	s.Set("client-b", "token-b", -time.Second)
+	time.Sleep(80 * time.Millisecond)
+	if _, ok := s.Get("client-a"); ok {
+		t.Fatal("expected the token to expire")
+	}
+	if _, ok := s.Get("client-b"); ok {
+		t.Fatal("a token set with a negative TTL must not be cached")
+	}
+}
+
+func TestRedisStoreClearKeepsOtherKeys(t *testing.T) {
+	f := startFakeRedis(t, "")
+	f.values["other:key"] = "untouched"
+	s, err := NewRedisStore(RedisConfig{URL: f.url(), KeyPrefix: "brain:"}, nil)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		s.Set(fmt.Sprintf("client-%d", i), "token", time.Hour)
+	}
+	if n := s.Len(); n != 3 {
+		t.Fatalf("expected 3 tokens, got %d", n)
+	}
+	if keys := strings.Join(s.Keys(), ","); keys != "client-0,client-1,client-2" {
+		t.Fatalf("expected the client IDs without the prefix, got %s", keys)
+	}
+	s.Clear()
+	if n := s.Len(); n != 0 {
+		t.Fatalf("expected 0 tokens after Clear, got %d", n)
+	}
+	if f.values["other:key"] != "untouched" {
+		t.Fatal("Clear removed a key outside the prefix")
+	}
+}
+
+func TestRedisStoreAuthenticates(t *testing.T) {
+	f := startFakeRedis(t, "s3cret")
+
+	if _, err := NewRedisStore(RedisConfig{URL: f.url()}, nil); err == nil {
+		t.Fatal("expected an error without the password")
+	}
+	if _, err := NewRedisStore(RedisConfig{URL: "redis://:wrong@" + f.ln.Addr().String()}, nil); err == nil {
+		t.Fatal("expected an error with the wrong password")
+	}
+	s, err := NewRedisStore(RedisConfig{URL: "redis://:wrong@" + f.ln.Addr().String(), Password: "s3cret"}, nil)
+	if err != nil {
+		t.Fatalf("the configured password should override the URL's: %v", err)
+	}
+	s.Set("client-a", "token-a", time.Hour)
+	if token, _ := s.Get("client-a"); token != "token-a" {
+		t.Fatalf("expected token-a, got %q", token)
+	}
+}
+
+func TestRedisStoreUnavailableIsAMiss(t *testing.T) {
+	f := startFakeRedis(t, "")
+	var mu sync.Mutex
+	var errs []error
+	s, err := NewRedisStore(RedisConfig{URL: f.url(), Timeout: 100}, func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	s.Close()
+	f.ln.Close()
+
+	s.Set("client-a", "token-a", time.Hour)
+	if _, ok := s.Get("client-a"); ok {
+		t.Fatal("expected a miss while Redis is down")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 2 {
+		t.Fatalf("expected the Set and Get errors to be reported, got %v", errs)
+	}
+}
+
+func TestNewStoreSelectsBackend(t *testing.T) {
+	if s, err := New(Config{}, nil, nil); err != nil {
+		t.Fatalf("default backend: %v", err)
+	} else if _, ok := s.(*TokenCache); !ok {
+		t.Fatalf("expected the in-memory cache by default, got %T", s)
+	}
+	if _, err := New(Config{Backend: "memcached"}, nil, nil); err == nil {
+		t.Fatal("expected an error for an unknown backend")
+	}
+	if _, err := New(Config{Backend: BackendRedis, Redis: RedisConfig{URL: "http://localhost"}}, nil, nil); err == nil {
+		t.Fatal("expected an error for a non-Redis URL")
+	}
+}
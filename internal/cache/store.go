@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Backends selectable with Config.Backend
+const (
+	BackendMemory = "memory"
+	BackendRedis  = "redis"
+	BackendKV     = "kv"
+)
+
+// Store holds tokens by client ID until their TTL expires. A store that cannot be reached
+// behaves like an empty one: lookups miss and writes are dropped, after reporting the error.
+type Store interface {
+	// Get returns the token if it is cached and not expired
+	Get(clientID string) (string, bool)
+	// Lookup is Get that also reports when the token was stored and when it expires
+	Lookup(clientID string) (Entry, bool)
+	// Set caches the token for ttl
+	Set(clientID, token string, ttl time.Duration)
+	// Delete removes the client's token
+	Delete(clientID string)
+	// Clear removes every token
+	Clear()
+	// Len returns the number of cached tokens
+	Len() int
+	// Keys returns the client IDs of the cached tokens, sorted
+	Keys() []string
+}
+
+// The stores satisfy Store
+var (
+	_ Store = (*TokenCache)(nil)
+	_ Store = (*RedisStore)(nil)
+	_ Store = (*KVStore)(nil)
+	_ Store = (*EncryptedStore)(nil)
+)
+
+// storedEntry is how shared stores serialize an Entry
+type storedEntry struct {
+	Token     string `json:"token"`
+	StoredAt  int64  `json:"stored_at"` // Unix nanoseconds
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// newEntry describes a token stored now for ttl
+func newEntry(token string, ttl time.Duration) Entry {
+	now := time.Now()
+	return Entry{Token: token, StoredAt: now, ExpiresAt: now.Add(ttl)}
+}
+
+// encodeEntry serializes an entry for a shared store
+func encodeEntry(e Entry) []byte {
+	data, _ := json.Marshal(storedEntry{Token: e.Token, StoredAt: e.StoredAt.UnixNano(), ExpiresAt: e.ExpiresAt.UnixNano()})
+	return data
+}
+
+// decodeEntry parses an entry written by encodeEntry
+func decodeEntry(data []byte) (Entry, error) {
+	var stored storedEntry
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return Entry{}, fmt.Errorf("invalid entry: %w", err)
+	}
+	return Entry{Token: stored.Token, StoredAt: time.Unix(0, stored.StoredAt), ExpiresAt: time.Unix(0, stored.ExpiresAt)}, nil
+}
+
+// Config selects and configures the store shared by a binary's replicas
+type Config struct {
+	Backend    string      `json:"backend,omitempty"`    // memory (default), redis or kv
+	MaxEntries int         `json:"maxEntries,omitempty"` // of the memory store, DefaultMaxEntries if 0, unbounded if negative
+	Redis      RedisConfig `json:"redis"`
+	KV         KVConfig    `json:"kv"`
+
+	// EncryptionKey, if set, is a base64 AES key encrypting the tokens in any backend. It may be
+	// a secret reference.
+	EncryptionKey string `json:"encryptionKey,omitempty"`
+}
+
+// New creates the store selected by cfg, wrapped in an EncryptedStore if cfg has an encryption
+// key. The KV store uses nc, which the other stores ignore. onError, if not nil, receives the
+// errors of stores that can fail, such as Redis.
+func New(cfg Config, nc *nats.Conn, onError func(error)) (Store, error) {
+	if cfg.EncryptionKey == "" {
+		return newBackend(cfg, nc, onError)
+	}
+	key, err := ParseKey(cfg.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newBackend(cfg, nc, onError)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptedStore(s, key, onError)
+}
+
+// Unwrap returns the store at the bottom of wrappers such as EncryptedStore, or s itself
+func Unwrap(s Store) Store {
+	for {
+		w, ok := s.(interface{ Unwrap() Store })
+		if !ok {
+			return s
+		}
+		s = w.Unwrap()
+	}
+}
+
+// newBackend creates the store selected by cfg.Backend
+func newBackend(cfg Config, nc *nats.Conn, onError func(error)) (Store, error) {
+	switch cfg.Backend {
+	case "", BackendMemory:
+		maxEntries := cfg.MaxEntries
+		if maxEntries == 0 {
+			maxEntries = DefaultMaxEntries
+		}
+		return NewBoundedTokenCache(maxEntries), nil
+	case BackendRedis:
+		return NewRedisStore(cfg.Redis, onError)
+	case BackendKV:
+		if nc == nil {
+			return nil, fmt.Errorf("the %s cache backend needs a NATS connection", BackendKV)
+		}
+		return NewKVStore(nc, cfg.KV, onError)
+	}
+	return nil, fmt.Errorf("unknown cache backend %q", cfg.Backend)
+}
@@ -2,26 +2,63 @@
 package cache
 
 import (
+	"container/list"
+	"sort"
 	"sync"
 	"time"
 )
 
-// TokenCache provides a thread-safe cache for storing tokens with expiration
+// DefaultMaxEntries bounds the in-memory cache created by New when no limit is configured
+const DefaultMaxEntries = 10000
+
+// TokenCache provides a thread-safe cache for storing tokens with expiration. A bounded cache
+// evicts the least recently used token when it is full.
 type TokenCache struct {
-	mu    sync.RWMutex
-	items map[string]*cacheItem
+	mu         sync.Mutex
+	items      map[string]*list.Element // of *cacheItem
+	order      *list.List               // most recently used first
+	maxEntries int
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
 }
 
 type cacheItem struct {
+	clientID   string
 	token      string
+	stored     time.Time
 	expiration time.Time
 }
 
-// NewTokenCache creates a new TokenCache
+// Stats reports the size and use of a TokenCache
+type Stats struct {
+	Entries   int    // tokens held, including expired ones not yet cleaned up
+	Hits      uint64 // lookups that found a token
+	Misses    uint64 // lookups that found none, or an expired one
+	Evictions uint64 // tokens removed to make room for others
+}
+
+// Entry describes a cached token and its lifetime in the cache
+type Entry struct {
+	Token     string
+	StoredAt  time.Time
+	ExpiresAt time.Time
+}
+
+// NewTokenCache creates a new TokenCache without a size limit
 func NewTokenCache() *TokenCache {
+	return NewBoundedTokenCache(0)
+}
+
+// NewBoundedTokenCache creates a TokenCache holding at most maxEntries tokens; 0 or less
+// means no limit
+func NewBoundedTokenCache(maxEntries int) *TokenCache {
 	// Initialize a new cache
 	cache := &TokenCache{
-		items: make(map[string]*cacheItem),
+		items:      make(map[string]*list.Element),
+		order:      list.New(),
+		maxEntries: maxEntries,
 	}
 
 	// Start a goroutine to clean expired items periodically
@@ -46,40 +83,63 @@ func (c *TokenCache) removeExpired() {
 	defer c.mu.Unlock()
 
 	now := time.Now()
-	for key, item := range c.items {
-		if item.expiration.Before(now) {
-			delete(c.items, key)
+	for _, elem := range c.items {
+		if elem.Value.(*cacheItem).expiration.Before(now) {
+			c.remove(elem)
 		}
 	}
 }
 
-// Set adds or updates a token in the cache with a specified TTL
+// Set adds or updates a token in the cache with a specified TTL. If the cache is full, the
+// least recently used token is evicted.
 func (c *TokenCache) Set(clientID string, token string, ttl time.Duration) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.items[clientID] = &cacheItem{
+	now := time.Now()
+	item := &cacheItem{
+		clientID:   clientID,
 		token:      token,
-		expiration: time.Now().Add(ttl),
+		stored:     now,
+		expiration: now.Add(ttl),
+	}
+	if elem, exists := c.items[clientID]; exists {
+		elem.Value = item
+		c.order.MoveToFront(elem)
+		return
 	}
+
+	if c.maxEntries > 0 && len(c.items) >= c.maxEntries {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+	c.items[clientID] = c.order.PushFront(item)
 }
 
 // Get retrieves a token from the cache if it exists and is not expired
 func (c *TokenCache) Get(clientID string) (string, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	entry, found := c.Lookup(clientID)
+	return entry.Token, found
+}
+
+// Lookup is Get that also reports when the token was stored and when it expires from the cache
+func (c *TokenCache) Lookup(clientID string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	item, exists := c.items[clientID]
+	elem, exists := c.items[clientID]
 	if !exists {
-		return "", false
+		c.misses++
+		return Entry{}, false
 	}
-
-	// Check if the item has expired
+	item := elem.Value.(*cacheItem)
 	if time.Now().After(item.expiration) {
-		return "", false
+		c.misses++
+		return Entry{}, false
 	}
-
-	return item.token, true
+	c.hits++
+	c.order.MoveToFront(elem)
+	return Entry{Token: item.token, StoredAt: item.stored, ExpiresAt: item.expiration}, true
 }
 
 // Delete removes a token from the cache
@@ -87,7 +147,29 @@ func (c *TokenCache) Delete(clientID string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	delete(c.items, clientID)
+	if elem, exists := c.items[clientID]; exists {
+		c.remove(elem)
+	}
+}
+
+// Len returns the number of cached tokens, including expired ones not yet cleaned up
+func (c *TokenCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+// Keys returns the client IDs of the cached tokens, sorted, including expired ones not yet
+// cleaned up
+func (c *TokenCache) Keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.items))
+	for clientID := range c.items {
+		keys = append(keys, clientID)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 // Clear removes all items from the cache
@@ -95,5 +177,19 @@ func (c *TokenCache) Clear() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.items = make(map[string]*cacheItem)
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// Stats returns the number of cached tokens and the lookup and eviction counts so far
+func (c *TokenCache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{Entries: len(c.items), Hits: c.hits, Misses: c.misses, Evictions: c.evictions}
+}
+
+// remove drops an element from the map and the recency list; the caller holds mu
+func (c *TokenCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.items, elem.Value.(*cacheItem).clientID)
 }
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// op is one step of a random sequence of cache operations
+type op struct {
+	Kind    uint8 // set, delete, clear or evict
+	Key     uint8 // a handful of keys, so operations hit the same entries
+	Expired bool  // set an entry whose TTL has already passed
+}
+
+// entry is the model's view of a cached token
+type entry struct {
+	token string
+	live  bool
+}
+
+// TestTokenCacheMatchesModel applies random operations to the cache and to a plain map,
+// and checks after every step that both agree on which tokens are returned
+func TestTokenCacheMatchesModel(t *testing.T) {
+	property := func(ops []op) bool {
+		c := NewTokenCache()
+		model := make(map[string]entry)
+
+		for i, o := range ops {
+			key := fmt.Sprintf("client-%d", o.Key%4)
+			switch o.Kind % 4 {
+			case 0:
+				token := fmt.Sprintf("token-%d", i)
+				ttl := time.Hour
+				if o.Expired {
+					ttl = -time.Second
+				}
+				c.Set(key, token, ttl)
+				model[key] = entry{token: token, live: !o.Expired}
+			case 1:
+				c.Delete(key)
+				delete(model, key)
+			case 2:
+				c.Clear()
+				model = make(map[string]entry)
+			case 3:
+				// Eviction only drops expired entries, which Get already hides
+				c.removeExpired()
+				for k, e := range model {
+					if !e.live {
+						delete(model, k)
+					}
+				}
+				if len(c.items) != len(model) {
+					t.Logf("after eviction the cache holds %d entries, expected %d", len(c.items), len(model))
+					return false
+				}
+			}
+
+			for k := 0; k < 4; k++ {
+				key := fmt.Sprintf("client-%d", k)
+				token, found := c.Get(key)
+				want, ok := model[key]
+				if found != (ok && want.live) || (found && token != want.token) {
+					t.Logf("step %d: Get(%s) = %q, %t; expected %+v", i, key, token, found, want)
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTokenCacheExpiresAfterTTL checks that a token is served until its TTL passes, and not after
+func TestTokenCacheExpiresAfterTTL(t *testing.T) {
+	c := NewTokenCache()
+	c.Set("client", "token", 50*time.Millisecond)
+
+	if token, found := c.Get("client"); !found || token != "token" {
+		t.Fatalf("Get before expiry = %q, %t", token, found)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if token, found := c.Get("client"); found {
+		t.Fatalf("Get after expiry = %q, expected no token", token)
+	}
+
+	c.removeExpired()
+	if len(c.items) != 0 {
+		t.Fatalf("eviction left %d expired entries", len(c.items))
+	}
+}
+
+// TestTokenCacheEvictsLeastRecentlyUsed fills a bounded cache and checks that the token not
+// looked up for longest makes room, and that the stats count it
+func TestTokenCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewBoundedTokenCache(2)
+	c.Set("a", "token-a", time.Hour)
+	c.Set("b", "token-b", time.Hour)
+	c.Get("a") // b is now the least recently used
+	c.Set("c", "token-c", time.Hour)
+
+	if _, found := c.Get("b"); found {
+		t.Fatal("expected b to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, found := c.Get(key); !found {
+			t.Fatalf("expected %s to be kept", key)
+		}
+	}
+
+	// Updating a cached token does not evict another
+	c.Set("a", "token-a2", time.Hour)
+	if c.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", c.Len())
+	}
+
+	want := Stats{Entries: 2, Hits: 3, Misses: 1, Evictions: 1}
+	if got := c.Stats(); got != want {
+		t.Fatalf("Stats() = %+v, expected %+v", got, want)
+	}
+}
+
+// TestTokenCacheUnboundedByDefault checks that NewTokenCache never evicts
+func TestTokenCacheUnboundedByDefault(t *testing.T) {
+	c := NewTokenCache()
+	for i := 0; i < 1000; i++ {
+		c.Set(fmt.Sprintf("client-%d", i), "token", time.Hour)
+	}
+	if stats := c.Stats(); stats.Entries != 1000 || stats.Evictions != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
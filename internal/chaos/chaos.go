@@ -0,0 +1,182 @@
+// Package chaos provides fault injection for exercising the resilience of the examples
+package chaos
+
+import (
+	"flag"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Config holds the probabilities (0 to 1) of each injected fault
+type Config struct {
+	DisconnectRate     float64       // chance of dropping the NATS connection at each interval
+	DisconnectInterval time.Duration // how often a disconnect is considered
+	DelayRate          float64       // chance of delaying an outgoing HTTP call
+	Delay              time.Duration // how long delayed HTTP calls wait
+	DropRate           float64       // chance of not sending a reply
+	MalformRate        float64       // chance of corrupting a payload
+}
+
+// RegisterFlags adds the chaos flags to the flag set and returns the config they populate
+func RegisterFlags(fs *flag.FlagSet) *Config {
+	cfg := RegisterDisconnectFlags(fs)
+	fs.Float64Var(&cfg.DelayRate, "chaos-delay-rate", 0, "Probability of delaying an IDP call")
+	fs.DurationVar(&cfg.Delay, "chaos-delay", 2*time.Second, "Delay added to IDP calls selected by -chaos-delay-rate")
+	fs.Float64Var(&cfg.DropRate, "chaos-drop", 0, "Probability of dropping a reply")
+	fs.Float64Var(&cfg.MalformRate, "chaos-malform", 0, "Probability of sending a malformed payload")
+	return cfg
+}
+
+// RegisterDisconnectFlags adds only the NATS disconnect flags, for services that make no IDP
+// calls and send no replies of their own, and returns the config they populate
+func RegisterDisconnectFlags(fs *flag.FlagSet) *Config {
+	cfg := &Config{}
+	fs.Float64Var(&cfg.DisconnectRate, "chaos-disconnect", 0, "Probability of forcing a NATS disconnect at each chaos interval")
+	fs.DurationVar(&cfg.DisconnectInterval, "chaos-interval", 10*time.Second, "How often a forced disconnect is considered")
+	return cfg
+}
+
+// Enabled reports whether any fault is configured
+func (c *Config) Enabled() bool {
+	return c.DisconnectRate > 0 || c.DelayRate > 0 || c.DropRate > 0 || c.MalformRate > 0
+}
+
+// Logger interface for dependency injection of any logger
+type Logger interface {
+	Warn(format string, args ...interface{})
+}
+
+// Injector decides when faults fire and applies them
+type Injector struct {
+	cfg Config
+	log Logger
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	conn net.Conn // current NATS connection, tracked by the dialer
+}
+
+// NewInjector creates an injector for the given configuration
+func NewInjector(cfg Config, log Logger) *Injector {
+	return &Injector{
+		cfg:  cfg,
+		log:  log,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// roll returns true with the given probability
+func (i *Injector) roll(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rand.Float64() < probability
+}
+
+// ShouldDrop reports whether the current reply should be dropped
+func (i *Injector) ShouldDrop() bool {
+	if i.roll(i.cfg.DropRate) {
+		i.log.Warn("Chaos: dropping reply")
+		return true
+	}
+	return false
+}
+
+// Malform returns the payload, corrupted when the malform fault fires
+func (i *Injector) Malform(data []byte) []byte {
+	if !i.roll(i.cfg.MalformRate) {
+		return data
+	}
+
+	i.log.Warn("Chaos: sending malformed payload")
+	// Truncating JSON keeps it recognisable in traces while making it unparsable
+	if len(data) > 1 {
+		return append([]byte{}, data[:len(data)/2]...)
+	}
+	return []byte("{")
+}
+
+// Transport wraps an HTTP transport so that calls are delayed when the delay fault fires
+func (i *Injector) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if i.roll(i.cfg.DelayRate) {
+			i.log.Warn("Chaos: delaying %s %s by %s", req.Method, req.URL.Host, i.cfg.Delay)
+			select {
+			case <-time.After(i.cfg.Delay):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
+		return base.RoundTrip(req)
+	})
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip calls the function
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Dial implements nats.CustomDialer and remembers the connection so it can be dropped later
+func (i *Injector) Dial(network, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{Timeout: 5 * time.Second}).Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	i.mu.Lock()
+	i.conn = conn
+	i.mu.Unlock()
+	return conn, nil
+}
+
+// NATSOptions returns the connection options needed for disconnect injection
+func (i *Injector) NATSOptions() []nats.Option {
+	if i.cfg.DisconnectRate <= 0 {
+		return nil
+	}
+	return []nats.Option{nats.SetCustomDialer(i)}
+}
+
+// RunDisconnects drops the NATS connection at random until stop is closed; the client then reconnects
+func (i *Injector) RunDisconnects(stop <-chan struct{}) {
+	if i.cfg.DisconnectRate <= 0 || i.cfg.DisconnectInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(i.cfg.DisconnectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !i.roll(i.cfg.DisconnectRate) {
+				continue
+			}
+
+			i.mu.Lock()
+			conn := i.conn
+			i.mu.Unlock()
+
+			if conn != nil {
+				i.log.Warn("Chaos: forcing NATS disconnect")
+				conn.Close()
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Package cli provides helpers shared by the command-line tools
+package cli
+
+import (
+	"fmt"
+	"strings"
+)
+
+// KeyValueFlag collects repeatable key=value command-line flags
+type KeyValueFlag struct {
+	keys   []string
+	values map[string][]string
+}
+
+// String returns the flag values in key=value form
+func (f *KeyValueFlag) String() string {
+	if f == nil {
+		return ""
+	}
+
+	var pairs []string
+	for _, key := range f.keys {
+		for _, value := range f.values[key] {
+			pairs = append(pairs, key+"="+value)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set parses a key=value pair and adds it to the collected values
+func (f *KeyValueFlag) Set(s string) error {
+	key, value, found := strings.Cut(s, "=")
+	key = strings.TrimSpace(key)
+	if !found || key == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+
+	if f.values == nil {
+		f.values = make(map[string][]string)
+	}
+	if _, exists := f.values[key]; !exists {
+		f.keys = append(f.keys, key)
+	}
+	f.values[key] = append(f.values[key], value)
+	return nil
+}
+
+// Values returns the collected values keyed by name
+func (f *KeyValueFlag) Values() map[string][]string {
+	return f.values
+}
+
+// Len returns the number of distinct keys collected
+func (f *KeyValueFlag) Len() int {
+	return len(f.keys)
+}
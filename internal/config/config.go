@@ -2,30 +2,225 @@
 package config
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/audit"
+	"github.com/kiquetal/nats-go-examples/internal/auth"
+	"github.com/kiquetal/nats-go-examples/internal/cache"
+	"github.com/kiquetal/nats-go-examples/internal/credentials"
+	"github.com/kiquetal/nats-go-examples/internal/ratelimit"
+	"github.com/kiquetal/nats-go-examples/internal/secrets"
+	"gopkg.in/yaml.v3"
 )
 
+// secretsTimeout bounds resolving the secret references in a config file
+const secretsTimeout = 30 * time.Second
+
 // NATSConfig represents NATS-specific configuration options
 type NATSConfig struct {
-	URL            string `json:"url"`
-	Username       string `json:"username,omitempty"`
-	Password       string `json:"password,omitempty"`
-	Token          string `json:"token,omitempty"`
-	AllowReconnect bool   `json:"allowReconnect"`
-	MaxReconnect   int    `json:"maxReconnect"`
-	ReconnectWait  int    `json:"reconnectWait"` // in seconds
+	URL            string    `json:"url"`
+	Username       string    `json:"username,omitempty"`
+	Password       string    `json:"password,omitempty"`
+	PasswordFile   string    `json:"passwordFile,omitempty"` // file holding the password, e.g. a mounted Kubernetes secret
+	Token          string    `json:"token,omitempty"`
+	TokenFile      string    `json:"tokenFile,omitempty"` // file holding the token
+	CredsFile      string    `json:"credsFile,omitempty"` // user JWT and NKey seed file, for decentralized auth
+	AllowReconnect bool      `json:"allowReconnect"`
+	MaxReconnect   int       `json:"maxReconnect"`
+	ReconnectWait  int       `json:"reconnectWait"`       // in seconds
+	ProxyURL       string    `json:"proxyUrl,omitempty"`  // HTTP proxy for ws:// and wss:// URLs, "none" to ignore HTTPS_PROXY
+	ProxyPath      string    `json:"proxyPath,omitempty"` // WebSocket path prefix when the server sits behind a reverse proxy
+	TLS            TLSConfig `json:"tls"`
+
+	// Encryption of the payloads of token requests and pubsub messages
+	Encryption EncryptionConfig `json:"encryption"`
+
+	// Compression of the payloads of pubsub messages
+	Compression CompressionConfig `json:"compression"`
+
+	// Startup retries for servers that are not up yet, e.g. when started together by docker-compose
+	ConnectRetries      int `json:"connectRetries"`      // 0 fails immediately
+	ConnectRetryWait    int `json:"connectRetryWait"`    // first delay in milliseconds, doubled after every attempt
+	ConnectRetryMaxWait int `json:"connectRetryMaxWait"` // in milliseconds
+}
+
+// TLSConfig holds the TLS settings for NATS connections. TLS is used for tls:// and wss://
+// URLs, and for all servers once any field is set.
+type TLSConfig struct {
+	CA                 string `json:"ca,omitempty"`   // PEM file with the CAs that sign the server certificate, system roots if empty
+	Cert               string `json:"cert,omitempty"` // PEM client certificate, for servers that verify clients
+	Key                string `json:"key,omitempty"`  // PEM private key of Cert
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// Enabled reports whether any TLS setting is configured
+func (c TLSConfig) Enabled() bool {
+	return c.CA != "" || c.Cert != "" || c.Key != "" || c.InsecureSkipVerify
+}
+
+// EncryptionConfig holds the shared keys that encrypt message payloads, for NATS clusters
+// shared with other teams, see pubsub.Encrypter
+type EncryptionConfig struct {
+	KeyID    string          `json:"keyId,omitempty"`    // ID of the key new messages are encrypted with, no encryption if empty
+	Keys     []EncryptionKey `json:"keys,omitempty"`     // the current key and those still accepted after a rotation
+	Required bool            `json:"required,omitempty"` // refuse unencrypted messages
+}
+
+// EncryptionKey is a base64 AES key of 16, 24 or 32 bytes, e.g. from `openssl rand -base64 32`
+type EncryptionKey struct {
+	ID  string `json:"id"`
+	Key string `json:"key"` // may be a secret reference
+}
+
+// Enabled reports whether messages are encrypted
+func (c EncryptionConfig) Enabled() bool {
+	return c.KeyID != ""
+}
+
+// CompressionConfig selects the compression of outgoing message payloads, see
+// pubsub.Compressor. Received payloads are decompressed whatever the setting.
+type CompressionConfig struct {
+	Encoding  string `json:"encoding,omitempty"`  // gzip or s2, no compression if empty
+	Threshold int    `json:"threshold,omitempty"` // smallest payload compressed, in bytes, 1024 if 0
+}
+
+// Enabled reports whether messages are compressed
+func (c CompressionConfig) Enabled() bool {
+	return c.Encoding != ""
+}
+
+// RouteConfig maps an HTTP route to a NATS subject
+type RouteConfig struct {
+	Method  string `json:"method"`
+	Path    string `json:"path"`    // may contain {name} placeholders
+	Subject string `json:"subject"` // may reference path placeholders as {name}
+	Mode    string `json:"mode"`    // request or publish
+	Timeout int    `json:"timeout"` // in milliseconds, request mode only
+}
+
+// BridgeConfig represents the HTTP-to-NATS bridge configuration
+type BridgeConfig struct {
+	Port   int           `json:"port"`
+	Routes []RouteConfig `json:"routes"`
+}
+
+// WebhookSourceConfig describes a webhook sender and where its events are published
+type WebhookSourceConfig struct {
+	Name              string `json:"name"`
+	Path              string `json:"path"`
+	Subject           string `json:"subject"`   // may contain {event} for the event type
+	Signature         string `json:"signature"` // github, stripe or none
+	Secret            string `json:"secret,omitempty"`
+	DeadLetterSubject string `json:"deadLetterSubject,omitempty"`
+}
+
+// WebhookConfig represents the webhook ingestion gateway configuration
+type WebhookConfig struct {
+	Port       int                   `json:"port"`
+	MaxRetries int                   `json:"maxRetries"`
+	RetryWait  int                   `json:"retryWait"` // in milliseconds
+	Sources    []WebhookSourceConfig `json:"sources"`
+}
+
+// ScheduleConfig describes a message published on a cron-style schedule
+type ScheduleConfig struct {
+	Name     string            `json:"name"`
+	Cron     string            `json:"cron"` // five-field cron, @hourly style macro or @every <duration>
+	Subject  string            `json:"subject"`
+	Body     string            `json:"body"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// SchedulerConfig represents the scheduler service configuration
+type SchedulerConfig struct {
+	Jobs         []ScheduleConfig `json:"jobs"`
+	Bucket       string           `json:"bucket,omitempty"` // KV bucket with additional jobs, one per key
+	LeaderBucket string           `json:"leaderBucket"`
+	LeaderTTL    int              `json:"leaderTTL"` // in seconds
+}
+
+// ForwardTargetConfig maps a NATS subject to the HTTP endpoint its messages are forwarded to
+type ForwardTargetConfig struct {
+	Name              string            `json:"name"`
+	Subject           string            `json:"subject"` // may contain wildcards
+	Queue             string            `json:"queue,omitempty"`
+	URL               string            `json:"url"`    // text/template, e.g. http://host/orders/{{index .Tokens 2}}
+	Method            string            `json:"method"` // defaults to POST
+	Headers           map[string]string `json:"headers,omitempty"`
+	Timeout           int               `json:"timeout"` // in milliseconds
+	DeadLetterSubject string            `json:"deadLetterSubject,omitempty"`
+}
+
+// ForwarderConfig represents the NATS-to-HTTP forwarder configuration
+type ForwarderConfig struct {
+	MaxRetries int                   `json:"maxRetries"`
+	RetryWait  int                   `json:"retryWait"` // in milliseconds
+	Targets    []ForwardTargetConfig `json:"targets"`
+}
+
+// BrainAppConfig holds brain-app settings, which are applied again when the config is reloaded
+// except for the rate limit backend and window
+type BrainAppConfig struct {
+	RequestTimeout int              `json:"requestTimeout,omitempty"` // NATS request timeout in seconds, -request-timeout if 0
+	RateLimit      ratelimit.Config `json:"rateLimit"`                // limits of /token requests per IP and client ID
+	AdminToken     string           `json:"adminToken,omitempty"`     // bearer token of the /admin endpoints, disabled if empty; may be a secret reference
+	Auth           auth.Config      `json:"auth"`                     // authentication of /token callers
+}
+
+// IDPConfig locates the token workers' identity provider, which they switch to when the
+// config is reloaded. Empty fields fall back to the worker's flags.
+type IDPConfig struct {
+	URL       string `json:"url,omitempty"`       // base URL
+	TokenPath string `json:"tokenPath,omitempty"` // token endpoint path
+	Issuer    string `json:"issuer,omitempty"`    // OpenID issuer whose discovery document replaces URL and TokenPath
+	Timeout   int    `json:"timeout,omitempty"`   // IDP request timeout in seconds, 10 if 0
+
+	// Realms are further identity providers, picked by the realm of a token request
+	Realms map[string]IDPRealm `json:"realms,omitempty"`
+}
+
+// IDPRealm is an identity provider selected by name, e.g. another Keycloak realm. Without an
+// issuer, its empty URL and TokenPath are the default IDP's; an empty Timeout always is.
+type IDPRealm struct {
+	URL       string `json:"url,omitempty"`
+	TokenPath string `json:"tokenPath,omitempty"`
+	Issuer    string `json:"issuer,omitempty"`
+	Timeout   int    `json:"timeout,omitempty"` // in seconds
+}
+
+// TelemetryConfig configures OpenTelemetry trace and metric export over OTLP/HTTP
+type TelemetryConfig struct {
+	Endpoint           string            `json:"endpoint,omitempty"` // collector URL, e.g. http://localhost:4318; telemetry is off when empty
+	SampleRatio        float64           `json:"sampleRatio"`        // fraction of new traces that are sampled
+	MetricInterval     int               `json:"metricInterval"`     // in seconds
+	ResourceAttributes map[string]string `json:"resourceAttributes,omitempty"`
 }
 
 // AppConfig represents the application configuration
 type AppConfig struct {
-	Environment string     `json:"environment"` // dev, test, prod
-	LogLevel    string     `json:"logLevel"`
-	NATS        NATSConfig `json:"nats"`
+	Environment string             `json:"environment"` // dev, test, prod
+	LogLevel    string             `json:"logLevel"`    // debug, info, warn, error
+	LogFormat   string             `json:"logFormat"`   // text or json
+	NATS        NATSConfig         `json:"nats"`
+	Bridge      *BridgeConfig      `json:"bridge,omitempty"`
+	Webhooks    *WebhookConfig     `json:"webhooks,omitempty"`
+	Scheduler   *SchedulerConfig   `json:"scheduler,omitempty"`
+	Forwarder   *ForwarderConfig   `json:"forwarder,omitempty"`
+	BrainApp    BrainAppConfig     `json:"brainApp"`
+	IDP         IDPConfig          `json:"idp"`
+	Telemetry   TelemetryConfig    `json:"telemetry"`
+	Secrets     secrets.Config     `json:"secrets"`
+	Cache       cache.Config       `json:"cache"`
+	Audit       audit.Config       `json:"audit"`
+	Credentials credentials.Config `json:"credentials"`
+
+	fileSecrets []string // the secret settings as read from the file, written back by SaveConfig
 }
 
 // DefaultConfig returns a default configuration
@@ -33,92 +228,200 @@ func DefaultConfig() *AppConfig {
 	return &AppConfig{
 		Environment: "dev",
 		LogLevel:    "info",
+		LogFormat:   "text",
 		NATS: NATSConfig{
 			URL:            "nats://localhost:4222",
 			AllowReconnect: true,
 			MaxReconnect:   10,
 			ReconnectWait:  5,
+
+			ConnectRetries:      5,
+			ConnectRetryWait:    1000,
+			ConnectRetryMaxWait: 30000,
+		},
+		Telemetry: TelemetryConfig{
+			SampleRatio:    1,
+			MetricInterval: 30,
 		},
 	}
 }
 
-// LoadConfig loads configuration from the specified file path
+// LoadConfig loads configuration from the specified file path, or from APP_CONFIG if the
+// path is empty. Files ending in .yaml or .yml are parsed as YAML, others as JSON; both use
+// the JSON field names.
 func LoadConfig(configPath string) (*AppConfig, error) {
 	// Start with default config
 	config := DefaultConfig()
 
-	// If no config path is provided, return default
 	if configPath == "" {
-		return config, nil
+		configPath = os.Getenv("APP_CONFIG")
 	}
 
-	// Read the config file
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+	// Without a config path, only the environment overrides the defaults
+	if configPath != "" {
+		// Read the config file
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+
+		// Parse the config
+		if err := parseConfig(configPath, data, config); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
 	}
 
-	// Parse the config
-	if err := json.Unmarshal(data, config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	// Keep the references, so saving the config never writes resolved secrets or the ones
+	// set by the environment
+	for _, field := range secretFields(config) {
+		config.fileSecrets = append(config.fileSecrets, *field)
 	}
 
 	// Apply environment variables overrides
-	applyEnvironmentOverrides(config)
+	if err := applyEnvironmentOverrides(config); err != nil {
+		return nil, err
+	}
+
+	// Credentials may be references to a secret store, e.g. "vault://nats#password"
+	if err := resolveSecrets(config); err != nil {
+		return nil, err
+	}
 
 	return config, nil
 }
 
-// applyEnvironmentOverrides applies configuration overrides from environment variables
-func applyEnvironmentOverrides(config *AppConfig) {
-	// Override environment if specified
-	if env := os.Getenv("APP_ENV"); env != "" {
-		config.Environment = env
+// parseConfig parses data, in the format given by the extension of path, over config
+func parseConfig(path string, data []byte, config *AppConfig) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// The struct tags are JSON ones, so the YAML document is converted to JSON first
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		converted, err := json.Marshal(doc)
+		if err != nil {
+			return fmt.Errorf("unsupported YAML value: %w", err)
+		}
+		data = converted
+	case ".toml":
+		return fmt.Errorf("TOML is not supported, use JSON or YAML")
 	}
+	return json.Unmarshal(data, config)
+}
 
-	// Override log level if specified
-	if logLevel := os.Getenv("APP_LOG_LEVEL"); logLevel != "" {
-		config.LogLevel = logLevel
+// secretFields returns the settings that may hold secrets or references to them
+func secretFields(config *AppConfig) []*string {
+	fields := []*string{
+		&config.NATS.Username, &config.NATS.Password, &config.NATS.Token,
+		&config.Cache.Redis.Password, &config.Cache.EncryptionKey, &config.BrainApp.AdminToken,
+		&config.Credentials.SigningKey,
+	}
+	for i := range config.BrainApp.Auth.APIKeys {
+		fields = append(fields, &config.BrainApp.Auth.APIKeys[i].Key)
+	}
+	for i := range config.NATS.Encryption.Keys {
+		fields = append(fields, &config.NATS.Encryption.Keys[i].Key)
 	}
+	return fields
+}
+
+// resolveSecrets replaces secret references in the NATS and Redis credentials, the cache and
+// message encryption keys, the brain-app admin token and API keys and the request signing key
+// with their values, after reading the NATS password and token files. Webhook secrets and the
+// workers' client secrets are resolved on use, so that rotations are picked up.
+func resolveSecrets(config *AppConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), secretsTimeout)
+	defer cancel()
 
-	// Override NATS URL if specified
-	if natsURL := os.Getenv("NATS_URL"); natsURL != "" {
-		config.NATS.URL = natsURL
-	} else if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
-		// Special case for Docker Desktop: if we're running on macOS or Windows,
-		// and connecting from the host to a container, replace localhost with host.docker.internal
-		if strings.Contains(config.NATS.URL, "localhost") {
-			config.NATS.URL = strings.Replace(config.NATS.URL, "localhost", "host.docker.internal", 1)
+	// The files are read like file:// references, so trailing newlines are removed
+	for _, secret := range []struct {
+		name  string
+		file  string
+		value *string
+	}{
+		{"nats.password", config.NATS.PasswordFile, &config.NATS.Password},
+		{"nats.token", config.NATS.TokenFile, &config.NATS.Token},
+	} {
+		if secret.file == "" {
+			continue
+		}
+		if *secret.value != "" {
+			return fmt.Errorf("%s is set both directly and from the file %s", secret.name, secret.file)
 		}
+		path, err := filepath.Abs(secret.file)
+		if err != nil {
+			return fmt.Errorf("invalid %s file: %w", secret.name, err)
+		}
+		*secret.value = "file://" + path
 	}
 
-	// Override NATS credentials if specified
-	if natsUser := os.Getenv("NATS_USER"); natsUser != "" {
-		config.NATS.Username = natsUser
+	resolver := secrets.New(config.Secrets)
+	if err := resolver.ResolveAll(ctx, &config.NATS.Username, &config.NATS.Password, &config.NATS.Token); err != nil {
+		return fmt.Errorf("failed to resolve NATS credentials: %w", err)
 	}
-
-	if natsPass := os.Getenv("NATS_PASS"); natsPass != "" {
-		config.NATS.Password = natsPass
+	if err := resolver.ResolveAll(ctx, &config.Cache.Redis.Password); err != nil {
+		return fmt.Errorf("failed to resolve the Redis password: %w", err)
 	}
-
-	if natsToken := os.Getenv("NATS_TOKEN"); natsToken != "" {
-		config.NATS.Token = natsToken
+	if err := resolver.ResolveAll(ctx, &config.Cache.EncryptionKey); err != nil {
+		return fmt.Errorf("failed to resolve the cache encryption key: %w", err)
+	}
+	if err := resolver.ResolveAll(ctx, &config.BrainApp.AdminToken); err != nil {
+		return fmt.Errorf("failed to resolve the admin token: %w", err)
+	}
+	for i := range config.BrainApp.Auth.APIKeys {
+		key := &config.BrainApp.Auth.APIKeys[i]
+		if err := resolver.ResolveAll(ctx, &key.Key); err != nil {
+			return fmt.Errorf("failed to resolve the API key %s: %w", key.Name, err)
+		}
+	}
+	if err := resolver.ResolveAll(ctx, &config.Credentials.SigningKey); err != nil {
+		return fmt.Errorf("failed to resolve the signing key: %w", err)
 	}
+	for i := range config.NATS.Encryption.Keys {
+		key := &config.NATS.Encryption.Keys[i]
+		if err := resolver.ResolveAll(ctx, &key.Key); err != nil {
+			return fmt.Errorf("failed to resolve the encryption key %s: %w", key.ID, err)
+		}
+	}
+	return nil
 }
 
-// SaveConfig saves the configuration to the specified file path
+// SaveConfig saves the configuration to the specified file path. Secrets of a loaded config
+// are written as they were in its file, i.e. as references, never with their resolved values.
 func SaveConfig(config *AppConfig, configPath string) error {
+	if config.fileSecrets != nil {
+		// The API and encryption keys are copied, so restoring their references leaves
+		// config's slices alone
+		unresolved := *config
+		unresolved.BrainApp.Auth.APIKeys = append([]auth.APIKey(nil), config.BrainApp.Auth.APIKeys...)
+		unresolved.NATS.Encryption.Keys = append([]EncryptionKey(nil), config.NATS.Encryption.Keys...)
+		for i, field := range secretFields(&unresolved) {
+			*field = config.fileSecrets[i]
+		}
+		config = &unresolved
+	}
+
 	// Create directory if it doesn't exist
 	dir := filepath.Dir(configPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("failed to create config directory: %w", err)
 	}
 
-	// Marshal config to JSON
+	// Marshal config to JSON, or to YAML for .yaml and .yml paths
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
+	if ext := strings.ToLower(filepath.Ext(configPath)); ext == ".yaml" || ext == ".yml" {
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("failed to marshal config: %w", err)
+		}
+		if data, err = yaml.Marshal(doc); err != nil {
+			return fmt.Errorf("failed to marshal config: %w", err)
+		}
+	}
 
 	// Write config to file
 	if err := os.WriteFile(configPath, data, 0644); err != nil {
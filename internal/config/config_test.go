@@ -0,0 +1,201 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const yamlConfig = `
+logLevel: debug
+nats:
+  url: nats://nats:4222
+  maxReconnect: -1
+  tls:
+    insecureSkipVerify: true
+cache:
+  backend: redis
+  redis:
+    url: redis://redis:6379/0
+telemetry:
+  sampleRatio: 0.25
+  resourceAttributes:
+    team: platform
+`
+
+func TestLoadYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.yaml")
+	if err := os.WriteFile(path, []byte(yamlConfig), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	t.Setenv("NATS_URL", "")
+	t.Setenv("APP_CONFIG", path)
+
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if cfg.LogLevel != "debug" || cfg.NATS.URL != "nats://nats:4222" || cfg.NATS.MaxReconnect != -1 || !cfg.NATS.TLS.InsecureSkipVerify {
+		t.Fatalf("unexpected NATS settings %+v", cfg.NATS)
+	}
+	if cfg.Cache.Redis.URL != "redis://redis:6379/0" || cfg.Telemetry.SampleRatio != 0.25 || cfg.Telemetry.ResourceAttributes["team"] != "platform" {
+		t.Fatalf("unexpected settings %+v", cfg)
+	}
+	// Settings missing from the file keep their defaults
+	if !cfg.NATS.AllowReconnect || cfg.NATS.ReconnectWait != 5 {
+		t.Fatalf("expected defaults for missing settings, got %+v", cfg.NATS)
+	}
+
+	// Writing it back and loading it again keeps the settings
+	saved := filepath.Join(t.TempDir(), "saved.yml")
+	if err := SaveConfig(cfg, saved); err != nil {
+		t.Fatalf("failed to save config: %v", err)
+	}
+	reloaded, err := LoadConfig(saved)
+	if err != nil || reloaded.NATS.MaxReconnect != -1 || reloaded.Cache.Backend != "redis" {
+		t.Fatalf("unexpected reloaded config %+v: %v", reloaded, err)
+	}
+}
+
+func TestEnvironmentOnly(t *testing.T) {
+	t.Setenv("APP_CONFIG", "")
+	t.Setenv("NATS_URL", "nats://a:4222,nats://b:4222")
+	t.Setenv("NATS_MAX_RECONNECT", "-1")
+	t.Setenv("NATS_RECONNECT_WAIT", "2")
+	t.Setenv("NATS_ALLOW_RECONNECT", "false")
+	t.Setenv("CACHE_KV_TTL", "600")
+	t.Setenv("OTEL_METRIC_EXPORT_INTERVAL", "1500")
+
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if cfg.NATS.URL != "nats://a:4222,nats://b:4222" || cfg.NATS.MaxReconnect != -1 || cfg.NATS.ReconnectWait != 2 || cfg.NATS.AllowReconnect {
+		t.Fatalf("unexpected NATS settings %+v", cfg.NATS)
+	}
+	if cfg.Cache.KV.TTL != 600 || cfg.Telemetry.MetricInterval != 2 {
+		t.Fatalf("unexpected settings %+v", cfg)
+	}
+}
+
+func TestInvalidEnvironment(t *testing.T) {
+	t.Setenv("APP_CONFIG", "")
+	t.Setenv("NATS_MAX_RECONNECT", "forever")
+	t.Setenv("NATS_ALLOW_RECONNECT", "maybe")
+
+	_, err := LoadConfig("")
+	if err == nil || !strings.Contains(err.Error(), "NATS_MAX_RECONNECT") || !strings.Contains(err.Error(), "NATS_ALLOW_RECONNECT") {
+		t.Fatalf("expected both invalid variables to be reported, got %v", err)
+	}
+}
+
+func TestWatchReloadsChangedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.yaml")
+	if err := os.WriteFile(path, []byte("logLevel: info\n"), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	t.Setenv("APP_LOG_LEVEL", "")
+
+	levels := make(chan string, 1)
+	errs := make(chan error, 1)
+	w := Watch(path, func(cfg *AppConfig) { levels <- cfg.LogLevel })
+	w.OnError(func(err error) { errs <- err })
+	w.interval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	// A different size is detected even where the modification time is coarse
+	replaceFile(t, path, "logLevel: debug\nbrainApp:\n  requestTimeout: 3\n")
+	select {
+	case level := <-levels:
+		if level != "debug" {
+			t.Fatalf("expected the new log level, got %q", level)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the changed file to be reloaded")
+	}
+
+	// An invalid file is reported and not passed on
+	replaceFile(t, path, "logLevel: [\n")
+	select {
+	case <-errs:
+	case level := <-levels:
+		t.Fatalf("expected the invalid file to be reported, got level %q", level)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the invalid file to be reported")
+	}
+}
+
+// replaceFile swaps in new content with a rename, so the watcher never polls a truncated file
+func replaceFile(t *testing.T, path, content string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("failed to replace config: %v", err)
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	natsPassword := filepath.Join(dir, "nats-password")
+	redisPassword := filepath.Join(dir, "redis-password")
+	apiKey := filepath.Join(dir, "api-key")
+	encryptionKey := filepath.Join(dir, "encryption-key")
+	os.WriteFile(natsPassword, []byte("n4ts\n"), 0600)
+	os.WriteFile(redisPassword, []byte("r3dis"), 0600)
+	os.WriteFile(apiKey, []byte("k3y"), 0600)
+	os.WriteFile(encryptionKey, []byte("ZW5jcnlwdGlvbg=="), 0600)
+
+	path := filepath.Join(dir, "app.json")
+	os.WriteFile(path, []byte(`{"nats": {"username": "app", "passwordFile": "`+natsPassword+`",
+			"encryption": {"keyId": "k1", "keys": [{"id": "k1", "key": "file://`+encryptionKey+`"}]}},
+		"brainApp": {"auth": {"apiKeys": [{"name": "billing", "key": "file://`+apiKey+`"}]}}}`), 0600)
+	t.Setenv("REDIS_PASSWORD_FILE", redisPassword)
+	t.Setenv("NATS_TOKEN", "env-token")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if cfg.NATS.Password != "n4ts" || cfg.Cache.Redis.Password != "r3dis" {
+		t.Fatalf("expected the passwords from the files, got %q and %q", cfg.NATS.Password, cfg.Cache.Redis.Password)
+	}
+	if key := cfg.BrainApp.Auth.APIKeys[0].Key; key != "k3y" {
+		t.Fatalf("expected the API key from its reference, got %q", key)
+	}
+	if key := cfg.NATS.Encryption.Keys[0].Key; key != "ZW5jcnlwdGlvbg==" {
+		t.Fatalf("expected the encryption key from its reference, got %q", key)
+	}
+
+	// Saving keeps the file reference and leaves out the secrets
+	saved := filepath.Join(dir, "saved.json")
+	if err := SaveConfig(cfg, saved); err != nil {
+		t.Fatalf("failed to save config: %v", err)
+	}
+	data, _ := os.ReadFile(saved)
+	for _, secret := range []string{"n4ts", "r3dis", "env-token", "k3y", "ZW5jcnlwdGlvbg=="} {
+		if strings.Contains(string(data), secret) {
+			t.Fatalf("expected %q not to be written, got %s", secret, data)
+		}
+	}
+	if !strings.Contains(string(data), natsPassword) || !strings.Contains(string(data), "file://"+apiKey) {
+		t.Fatalf("expected the password file and API key reference to be kept, got %s", data)
+	}
+	if key := cfg.BrainApp.Auth.APIKeys[0].Key; key != "k3y" {
+		t.Fatalf("expected saving to leave the loaded API key alone, got %q", key)
+	}
+
+	// A password set both ways is ambiguous
+	os.WriteFile(path, []byte(`{"nats": {"password": "plain", "passwordFile": "`+natsPassword+`"}}`), 0600)
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected a password set both directly and from a file to be rejected")
+	}
+}
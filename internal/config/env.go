@@ -0,0 +1,178 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// envOverrides collects the overrides of the environment and the variables that could not
+// be parsed
+type envOverrides struct {
+	errs []error
+}
+
+// string overrides field with the variable, if set
+func (e *envOverrides) string(name string, field *string) {
+	if value := os.Getenv(name); value != "" {
+		*field = value
+	}
+}
+
+// secretFile overrides field with a file:// reference to the file the variable names, if set,
+// following the _FILE convention of Docker images for secrets mounted as files
+func (e *envOverrides) secretFile(name string, field *string) {
+	if value := os.Getenv(name); value != "" {
+		path, err := filepath.Abs(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		*field = "file://" + path
+	}
+}
+
+// int overrides field with the variable, if set to an integer
+func (e *envOverrides) int(name string, field *int) {
+	if value := os.Getenv(name); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %q is not an integer", name, value))
+			return
+		}
+		*field = n
+	}
+}
+
+// float overrides field with the variable, if set to a number
+func (e *envOverrides) float(name string, field *float64) {
+	if value := os.Getenv(name); value != "" {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %q is not a number", name, value))
+			return
+		}
+		*field = f
+	}
+}
+
+// bool overrides field with the variable, if set to a boolean such as true, false, 1 or 0
+func (e *envOverrides) bool(name string, field *bool) {
+	if value := os.Getenv(name); value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %q is not a boolean", name, value))
+			return
+		}
+		*field = b
+	}
+}
+
+// applyEnvironmentOverrides applies configuration overrides from environment variables, so
+// that every setting except the lists of the individual tools can be configured without a
+// config file. Variables with invalid values are reported together.
+func applyEnvironmentOverrides(config *AppConfig) error {
+	env := &envOverrides{}
+
+	env.string("APP_ENV", &config.Environment)
+	env.string("APP_LOG_LEVEL", &config.LogLevel)
+	env.string("APP_LOG_FORMAT", &config.LogFormat)
+
+	// NATS server, falling back to Docker Desktop's host name on macOS and Windows below
+	env.string("NATS_URL", &config.NATS.URL)
+	if os.Getenv("NATS_URL") == "" && (runtime.GOOS == "darwin" || runtime.GOOS == "windows") {
+		// Special case for Docker Desktop: if we're running on macOS or Windows,
+		// and connecting from the host to a container, replace localhost with host.docker.internal
+		if strings.Contains(config.NATS.URL, "localhost") {
+			config.NATS.URL = strings.Replace(config.NATS.URL, "localhost", "host.docker.internal", 1)
+		}
+	}
+
+	// NATS credentials, and TLS files with the names the nats CLI uses
+	env.string("NATS_USER", &config.NATS.Username)
+	env.string("NATS_PASS", &config.NATS.Password)
+	env.string("NATS_TOKEN", &config.NATS.Token)
+	env.secretFile("NATS_PASS_FILE", &config.NATS.Password)
+	env.secretFile("NATS_TOKEN_FILE", &config.NATS.Token)
+	env.string("NATS_CREDS", &config.NATS.CredsFile)
+	env.string("NATS_CA", &config.NATS.TLS.CA)
+	env.string("NATS_CERT", &config.NATS.TLS.Cert)
+	env.string("NATS_KEY", &config.NATS.TLS.Key)
+	env.bool("NATS_TLS_INSECURE", &config.NATS.TLS.InsecureSkipVerify)
+
+	// NATS connection behaviour
+	env.bool("NATS_ALLOW_RECONNECT", &config.NATS.AllowReconnect)
+	env.int("NATS_MAX_RECONNECT", &config.NATS.MaxReconnect)
+	env.int("NATS_RECONNECT_WAIT", &config.NATS.ReconnectWait)
+	env.int("NATS_CONNECT_RETRIES", &config.NATS.ConnectRetries)
+	env.int("NATS_CONNECT_RETRY_WAIT", &config.NATS.ConnectRetryWait)
+	env.int("NATS_CONNECT_RETRY_MAX_WAIT", &config.NATS.ConnectRetryMaxWait)
+	env.string("NATS_PROXY_URL", &config.NATS.ProxyURL)
+	env.string("NATS_PROXY_PATH", &config.NATS.ProxyPath)
+	env.string("NATS_ENCRYPTION_KEY_ID", &config.NATS.Encryption.KeyID)
+	env.bool("NATS_ENCRYPTION_REQUIRED", &config.NATS.Encryption.Required)
+	env.string("NATS_COMPRESSION", &config.NATS.Compression.Encoding)
+	env.int("NATS_COMPRESSION_THRESHOLD", &config.NATS.Compression.Threshold)
+
+	// brain-app
+	env.int("REQUEST_TIMEOUT", &config.BrainApp.RequestTimeout)
+	env.string("RATE_LIMIT_BACKEND", &config.BrainApp.RateLimit.Backend)
+	env.int("RATE_LIMIT_PER_IP", &config.BrainApp.RateLimit.PerIP)
+	env.int("RATE_LIMIT_PER_CLIENT", &config.BrainApp.RateLimit.PerClient)
+	env.int("RATE_LIMIT_WINDOW", &config.BrainApp.RateLimit.Window)
+	env.bool("RATE_LIMIT_TRUST_FORWARDED_FOR", &config.BrainApp.RateLimit.TrustForwardedFor)
+	env.string("ADMIN_TOKEN", &config.BrainApp.AdminToken)
+	env.secretFile("ADMIN_TOKEN_FILE", &config.BrainApp.AdminToken)
+	env.bool("AUTH_JWT", &config.BrainApp.Auth.JWT)
+	env.int("AUTH_RATE_LIMIT", &config.BrainApp.Auth.RateLimit)
+
+	// Client secrets and request signing
+	env.string("CREDENTIALS_MODE", &config.Credentials.Mode)
+	env.string("SIGNING_KEY", &config.Credentials.SigningKey)
+	env.secretFile("SIGNING_KEY_FILE", &config.Credentials.SigningKey)
+
+	// Audit records of token requests
+	env.bool("AUDIT_NATS", &config.Audit.NATS)
+	env.string("AUDIT_SUBJECT", &config.Audit.Subject)
+	env.string("AUDIT_FILE", &config.Audit.File)
+
+	// Token cache
+	env.string("CACHE_BACKEND", &config.Cache.Backend)
+	env.int("CACHE_MAX_ENTRIES", &config.Cache.MaxEntries)
+	env.string("CACHE_ENCRYPTION_KEY", &config.Cache.EncryptionKey)
+	env.secretFile("CACHE_ENCRYPTION_KEY_FILE", &config.Cache.EncryptionKey)
+	env.string("REDIS_URL", &config.Cache.Redis.URL)
+	env.string("REDIS_PASSWORD", &config.Cache.Redis.Password)
+	env.secretFile("REDIS_PASSWORD_FILE", &config.Cache.Redis.Password)
+	env.string("REDIS_KEY_PREFIX", &config.Cache.Redis.KeyPrefix)
+	env.int("REDIS_TIMEOUT", &config.Cache.Redis.Timeout)
+	env.int("REDIS_POOL_SIZE", &config.Cache.Redis.PoolSize)
+	env.string("CACHE_KV_BUCKET", &config.Cache.KV.Bucket)
+	env.int("CACHE_KV_TTL", &config.Cache.KV.TTL)
+	env.int("CACHE_KV_REPLICAS", &config.Cache.KV.Replicas)
+	env.int("CACHE_KV_TIMEOUT", &config.Cache.KV.Timeout)
+
+	// Secret stores; Vault, AWS and GCP also read their standard variables themselves
+	env.int("SECRETS_CACHE_TTL", &config.Secrets.CacheTTL)
+	env.string("SECRETS_FILE_DIR", &config.Secrets.FileDir)
+	env.string("VAULT_MOUNT", &config.Secrets.Vault.Mount)
+	env.string("AWS_SECRETS_ENDPOINT", &config.Secrets.AWS.Endpoint)
+
+	// Telemetry, with the standard OpenTelemetry variables
+	env.string("OTEL_EXPORTER_OTLP_ENDPOINT", &config.Telemetry.Endpoint)
+	env.float("OTEL_TRACES_SAMPLER_ARG", &config.Telemetry.SampleRatio)
+	var metricIntervalMillis int
+	env.int("OTEL_METRIC_EXPORT_INTERVAL", &metricIntervalMillis)
+	if metricIntervalMillis > 0 {
+		config.Telemetry.MetricInterval = (metricIntervalMillis + 999) / 1000
+	}
+
+	if len(env.errs) > 0 {
+		return fmt.Errorf("invalid environment variables: %w", errors.Join(env.errs...))
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultWatchInterval is how often a Watcher checks its file for changes
+const DefaultWatchInterval = 2 * time.Second
+
+// fileStamp is what a Watcher compares to detect a changed file
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// Watcher reloads the configuration when its file changes or the process receives SIGHUP,
+// and passes the new configuration to its subscribers. A configuration that fails to load
+// is reported to the error handler and the subscribers keep the previous one.
+type Watcher struct {
+	path     string
+	interval time.Duration
+	reloadMu sync.Mutex // serializes reloads, so subscribers see them in order
+
+	mu          sync.Mutex
+	stamp       fileStamp
+	subscribers []func(*AppConfig)
+	onError     func(error)
+}
+
+// Watch creates a watcher for the config file at path, or at APP_CONFIG if path is empty,
+// that calls onChange with every reloaded configuration. Without a file, only SIGHUP reloads
+// it. The watcher does nothing until Run is called, e.g. with run.Group.Go.
+func Watch(path string, onChange func(*AppConfig)) *Watcher {
+	if path == "" {
+		path = os.Getenv("APP_CONFIG")
+	}
+	w := &Watcher{path: path, interval: DefaultWatchInterval}
+	w.stamp, _ = w.stat()
+	if onChange != nil {
+		w.subscribers = append(w.subscribers, onChange)
+	}
+	return w
+}
+
+// Subscribe adds a function called with every reloaded configuration
+func (w *Watcher) Subscribe(onChange func(*AppConfig)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subscribers = append(w.subscribers, onChange)
+}
+
+// OnError sets the function that receives reload errors, e.g. to log them
+func (w *Watcher) OnError(fn func(error)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onError = fn
+}
+
+// Run checks the file every DefaultWatchInterval and reloads on changes and SIGHUP until ctx
+// is done
+func (w *Watcher) Run(ctx context.Context) error {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hangups:
+			w.report(w.Reload())
+		case <-ticker.C:
+			if w.changed() {
+				w.report(w.Reload())
+			}
+		}
+	}
+}
+
+// Reload loads the configuration and passes it to the subscribers
+func (w *Watcher) Reload() error {
+	w.reloadMu.Lock()
+	defer w.reloadMu.Unlock()
+
+	// Remember the file as loaded even if it is invalid, so a broken file is reported once
+	stamp, _ := w.stat()
+	w.mu.Lock()
+	w.stamp = stamp
+	subscribers := append([]func(*AppConfig){}, w.subscribers...)
+	w.mu.Unlock()
+
+	cfg, err := LoadConfig(w.path)
+	if err != nil {
+		return err
+	}
+	for _, onChange := range subscribers {
+		onChange(cfg)
+	}
+	return nil
+}
+
+// changed reports whether the file differs from when it was last loaded. Files that are
+// replaced, e.g. Kubernetes ConfigMaps swapping a symlink, are detected as well.
+func (w *Watcher) changed() bool {
+	if w.path == "" {
+		return false
+	}
+	stamp, err := w.stat()
+	if err != nil {
+		// A missing file is reported when it comes back; editors briefly remove it on save
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return stamp != w.stamp
+}
+
+func (w *Watcher) stat() (fileStamp, error) {
+	if w.path == "" {
+		return fileStamp{}, nil
+	}
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+func (w *Watcher) report(err error) {
+	w.mu.Lock()
+	onError := w.onError
+	w.mu.Unlock()
+	if err != nil && onError != nil {
+		onError(err)
+	}
+}
@@ -0,0 +1,115 @@
+// Package credentials keeps client secrets off NATS. In the reference mode, brain-app sends
+// token requests with the client ID only, and the token workers look the secret up in a store
+// of their own, backed by the secret providers: env, file, Vault and the cloud secret managers.
+// Requests can also be signed with an NKey, so the workers only serve trusted requesters.
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/kiquetal/nats-go-examples/internal/secrets"
+	"github.com/nats-io/nkeys"
+)
+
+// Modes of sending client secrets
+const (
+	ModeInline    = "inline"    // requests carry the client secret
+	ModeReference = "reference" // requests carry the client ID, the workers hold the secrets
+)
+
+// ErrUnknownClient is returned for clients without a secret in the store
+var ErrUnknownClient = errors.New("no credentials stored for the client")
+
+// Config selects how client secrets reach the token workers
+type Config struct {
+	Mode string `json:"mode,omitempty"` // ModeInline if empty, or ModeReference
+
+	// Clients holds the secret of each client, as a secret reference such as
+	// vault://idp/clients#billing, by client ID or by the credential reference of requests.
+	// Read by the token workers.
+	Clients map[string]string `json:"clients,omitempty"`
+
+	// SigningKey is the NKey seed brain-app signs its token requests with; may be a secret
+	// reference
+	SigningKey string `json:"signingKey,omitempty"`
+	// TrustedKeys are the public NKeys whose signatures the token workers accept. When set,
+	// unsigned token requests are refused.
+	TrustedKeys []string `json:"trustedKeys,omitempty"`
+}
+
+// Validate checks the mode and the keys
+func (c Config) Validate() error {
+	switch c.Mode {
+	case "", ModeInline, ModeReference:
+	default:
+		return fmt.Errorf("unknown credentials mode %q, expected %s or %s", c.Mode, ModeInline, ModeReference)
+	}
+	for _, key := range c.TrustedKeys {
+		if !nkeys.IsValidPublicKey(key) {
+			return fmt.Errorf("trusted key %q is not a public NKey", key)
+		}
+	}
+	return nil
+}
+
+// ValidateWorker checks the config of a token worker. On top of Validate, stored client secrets
+// need trusted keys: without them anyone who can publish a token request could obtain the token
+// of any stored client by naming it.
+func (c Config) ValidateWorker() error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if len(c.Clients) > 0 && len(c.TrustedKeys) == 0 {
+		return errors.New("credentials.clients needs credentials.trustedKeys, or anyone who can publish token requests could obtain any stored client's token")
+	}
+	return nil
+}
+
+// Reference reports whether requests are sent without the client secret
+func (c Config) Reference() bool {
+	return c.Mode == ModeReference
+}
+
+// Signer returns the key pair to sign requests with, or nil when no signing key is set
+func (c Config) Signer() (nkeys.KeyPair, error) {
+	if c.SigningKey == "" {
+		return nil, nil
+	}
+	kp, err := nkeys.FromSeed([]byte(c.SigningKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key: %w", err)
+	}
+	return kp, nil
+}
+
+// Store looks up client secrets by name. The secrets are resolved on use, and cached by the
+// resolver for a while, so rotations are picked up without a restart.
+type Store struct {
+	clients  map[string]string
+	resolver *secrets.Resolver
+}
+
+// NewStore creates a store of the clients' secret references, resolved with resolver
+func NewStore(clients map[string]string, resolver *secrets.Resolver) *Store {
+	return &Store{clients: clients, resolver: resolver}
+}
+
+// Secret returns the secret stored under the name, a client ID or a credential reference
+func (s *Store) Secret(ctx context.Context, name string) (string, error) {
+	ref, ok := s.clients[name]
+	if !ok || name == "" {
+		return "", fmt.Errorf("%w: %q", ErrUnknownClient, name)
+	}
+	secret, err := s.resolver.Resolve(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the secret of %q: %w", name, err)
+	}
+	return secret, nil
+}
+
+// Len returns the number of stored clients
+func (s *Store) Len() int {
+	return len(s.clients)
+}
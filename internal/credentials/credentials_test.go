@@ -0,0 +1,71 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kiquetal/nats-go-examples/internal/secrets"
+	"github.com/nats-io/nkeys"
+)
+
+func TestStoreResolvesReferences(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "billing")
+	if err := os.WriteFile(path, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REPORTS_SECRET", "r3ports")
+
+	store := NewStore(map[string]string{
+		"billing":        "file://" + path,
+		"reports-legacy": "env://REPORTS_SECRET",
+	}, secrets.New(secrets.Config{}))
+
+	ctx := context.Background()
+	for name, want := range map[string]string{"billing": "s3cret", "reports-legacy": "r3ports"} {
+		if secret, err := store.Secret(ctx, name); err != nil || secret != want {
+			t.Errorf("%s: expected %q, got %q: %v", name, want, secret, err)
+		}
+	}
+	if _, err := store.Secret(ctx, "unknown"); !errors.Is(err, ErrUnknownClient) {
+		t.Fatalf("expected an unknown client, got %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	kp, _ := nkeys.CreateUser()
+	public, _ := kp.PublicKey()
+	seed, _ := kp.Seed()
+
+	valid := Config{Mode: ModeReference, SigningKey: string(seed), TrustedKeys: []string{public}}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if signer, err := valid.Signer(); err != nil || signer == nil {
+		t.Fatalf("expected a signer, got %v", err)
+	}
+	if signer, err := (Config{}).Signer(); err != nil || signer != nil {
+		t.Fatalf("expected no signer without a key, got %v", err)
+	}
+
+	for _, cfg := range []Config{
+		{Mode: "vault"},
+		{TrustedKeys: []string{string(seed)}},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", cfg)
+		}
+	}
+	// Workers only hand out stored secrets to signed requests
+	if err := (Config{Clients: map[string]string{"billing": "env://SECRET"}}).ValidateWorker(); err == nil {
+		t.Fatal("expected stored clients without trusted keys to be refused")
+	}
+	if err := (Config{Clients: map[string]string{"billing": "env://SECRET"}, TrustedKeys: []string{public}}).ValidateWorker(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (Config{SigningKey: public}).Signer(); err == nil {
+		t.Fatal("expected a public key to be refused as a seed")
+	}
+}
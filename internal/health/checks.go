@@ -0,0 +1,80 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATSConnected checks that the connection is up. A connection that is reconnecting is
+// reported as down, since requests and publishes wait or fail until it is back.
+func NATSConnected(nc *nats.Conn) Check {
+	return func(ctx context.Context) error {
+		if status := nc.Status(); status != nats.CONNECTED {
+			return fmt.Errorf("connection is %s", status)
+		}
+		return nil
+	}
+}
+
+// NATSRoundTrip checks that the server answers a ping, which a connection that looks up but
+// has stalled does not. A positive max also fails the check when the round trip takes longer.
+func NATSRoundTrip(nc *nats.Conn, max time.Duration) Check {
+	return func(ctx context.Context) error {
+		start := time.Now()
+		if err := nc.FlushWithContext(ctx); err != nil {
+			return fmt.Errorf("ping failed: %w", err)
+		}
+		if rtt := time.Since(start); max > 0 && rtt > max {
+			return fmt.Errorf("round trip took %s, more than %s", rtt.Round(time.Microsecond), max)
+		}
+		return nil
+	}
+}
+
+// SubscriptionValid checks that a subscription is still active. The server removes
+// subscriptions it rejects, e.g. after a permission change, without closing the connection.
+func SubscriptionValid(sub *nats.Subscription) Check {
+	return func(ctx context.Context) error {
+		if !sub.IsValid() {
+			return fmt.Errorf("subscription to %s is no longer valid", sub.Subject)
+		}
+		return nil
+	}
+}
+
+// HTTPReachable checks that a server answers at url. Any response below 500 counts, so the
+// check can point at an API root, e.g. an identity provider, that has no health endpoint.
+func HTTPReachable(client *http.Client, url string) Check {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("%s answered %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+// KeyValue checks that a JetStream key-value bucket, e.g. a cache backend, is available
+func KeyValue(js nats.JetStreamContext, bucket string) Check {
+	return func(ctx context.Context) error {
+		_, err := js.StreamInfo("KV_"+bucket, nats.Context(ctx))
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			return fmt.Errorf("bucket %s does not exist", bucket)
+		}
+		return err
+	}
+}
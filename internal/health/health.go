@@ -0,0 +1,185 @@
+// Package health runs a service's health checks and reports the outcome as JSON, both to
+// HTTP probes and to NATS requests on health.<service>, so every service answers the same way
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultTimeout bounds each check
+const DefaultTimeout = 2 * time.Second
+
+// SubjectPrefix is followed by the service name on the subject a service answers health requests on
+const SubjectPrefix = "health."
+
+// Status is the outcome of a check, or of the whole report
+type Status string
+
+const (
+	// StatusUp means the check passed, or that all checks passed
+	StatusUp Status = "up"
+	// StatusDown means the check failed, or that at least one check failed
+	StatusDown Status = "down"
+)
+
+// Check verifies one dependency and returns why it is unhealthy, or nil
+type Check func(ctx context.Context) error
+
+// Result is the outcome of a single check
+type Result struct {
+	Status   Status `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the JSON document served to probes and health requests
+type Report struct {
+	Service   string            `json:"service"`
+	Status    Status            `json:"status"`
+	Version   string            `json:"version"`
+	Host      string            `json:"host,omitempty"`
+	Checks    map[string]Result `json:"checks,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// namedCheck is a registered check
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Health holds the checks of one service. Create it with New; a service without checks is
+// always up, which still tells a probe that the process is serving.
+type Health struct {
+	service string
+	timeout time.Duration
+	host    string
+
+	mu     sync.RWMutex
+	checks []namedCheck
+}
+
+// New creates an empty set of checks for the named service
+func New(service string) *Health {
+	host, _ := os.Hostname()
+	return &Health{service: service, timeout: DefaultTimeout, host: host}
+}
+
+// SetTimeout changes how long each check may take
+func (h *Health) SetTimeout(timeout time.Duration) {
+	h.timeout = timeout
+}
+
+// Add registers a check under the name it is reported as
+func (h *Health) Add(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, namedCheck{name: name, check: check})
+}
+
+// Subject returns the subject the service answers health requests on
+func (h *Health) Subject() string {
+	return SubjectPrefix + h.service
+}
+
+// Report runs all checks concurrently and reports the service as down if any of them fails
+func (h *Health) Report(ctx context.Context) Report {
+	h.mu.RLock()
+	checks := append([]namedCheck(nil), h.checks...)
+	h.mu.RUnlock()
+
+	report := Report{
+		Service:   h.service,
+		Status:    StatusUp,
+		Version:   version.Version,
+		Host:      h.host,
+		Checks:    make(map[string]Result, len(checks)),
+		Timestamp: time.Now().UTC(),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c namedCheck) {
+			defer wg.Done()
+			result := h.run(ctx, c.check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[c.name] = result
+			if result.Status != StatusUp {
+				report.Status = StatusDown
+			}
+		}(c)
+	}
+	wg.Wait()
+	return report
+}
+
+// run executes one check within the timeout. A check that ignores its context is reported
+// as down once the timeout expires, and left to finish in the background.
+func (h *Health) run(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", h.timeout)
+	}
+
+	result := Result{Status: StatusUp, Duration: time.Since(start).Round(time.Microsecond).String()}
+	if err != nil {
+		result.Status = StatusDown
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Handler serves the report, with status 503 while the service is down so probes fail
+func (h *Health) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := h.Report(r.Context())
+
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != StatusUp {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// Respond answers health requests on the service's health subject. Every instance answers,
+// so a request collecting all replies shows the health of each one.
+func (h *Health) Respond(nc *nats.Conn) (*nats.Subscription, error) {
+	return nc.Subscribe(h.Subject(), func(msg *nats.Msg) {
+		if msg.Reply == "" {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+		data, err := json.Marshal(h.Report(ctx))
+		if err != nil {
+			return
+		}
+		msg.Respond(data)
+	})
+}
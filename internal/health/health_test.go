@@ -0,0 +1,148 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/testutil"
+)
+
+func TestReport(t *testing.T) {
+	h := New("test")
+	if report := h.Report(context.Background()); report.Status != StatusUp || len(report.Checks) != 0 {
+		t.Fatalf("expected a service without checks up, got %+v", report)
+	}
+
+	h.Add("nats", func(ctx context.Context) error { return nil })
+	h.Add("idp", func(ctx context.Context) error { return errors.New("connection refused") })
+	report := h.Report(context.Background())
+	if report.Status != StatusDown || report.Service != "test" {
+		t.Fatalf("expected the service down, got %+v", report)
+	}
+	if result := report.Checks["nats"]; result.Status != StatusUp || result.Error != "" {
+		t.Fatalf("expected nats up, got %+v", result)
+	}
+	if result := report.Checks["idp"]; result.Status != StatusDown || result.Error != "connection refused" {
+		t.Fatalf("expected idp down, got %+v", result)
+	}
+}
+
+func TestReportTimeout(t *testing.T) {
+	h := New("test")
+	h.SetTimeout(20 * time.Millisecond)
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	// Checks run concurrently, and those ignoring their context are abandoned
+	h.Add("stuck", func(ctx context.Context) error {
+		<-stuck
+		return nil
+	})
+	h.Add("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	start := time.Now()
+	report := h.Report(context.Background())
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected the checks abandoned after the timeout, took %v", elapsed)
+	}
+	if result := report.Checks["stuck"]; result.Status != StatusDown || !strings.Contains(result.Error, "timed out") {
+		t.Fatalf("expected stuck to time out, got %+v", result)
+	}
+	if report.Checks["slow"].Status != StatusDown {
+		t.Fatalf("expected slow down, got %+v", report.Checks["slow"])
+	}
+}
+
+func TestHandler(t *testing.T) {
+	h := New("test")
+	healthy := true
+	h.Add("dependency", func(ctx context.Context) error {
+		if !healthy {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+
+	for _, tt := range []struct {
+		healthy bool
+		status  int
+	}{{true, http.StatusOK}, {false, http.StatusServiceUnavailable}} {
+		healthy = tt.healthy
+		rec := httptest.NewRecorder()
+		h.Handler()(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if rec.Code != tt.status {
+			t.Fatalf("expected status %d, got %d", tt.status, rec.Code)
+		}
+		var report Report
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil || report.Service != "test" {
+			t.Fatalf("expected a JSON report, got %+v: %v", report, err)
+		}
+	}
+}
+
+func TestRespond(t *testing.T) {
+	srv := testutil.StartServer(t)
+	nc := testutil.Connect(t, srv)
+	h := New("token-worker")
+	h.Add("nats", NATSConnected(nc))
+	h.Add("roundtrip", NATSRoundTrip(nc, 0))
+	h.Add("cache", KeyValue(testutil.JetStream(t, nc), "missing"))
+
+	sub, err := h.Respond(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Add("subscription", SubscriptionValid(sub))
+
+	msg, err := nc.Request(SubjectPrefix+"token-worker", nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report Report
+	if err := json.Unmarshal(msg.Data, &report); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"nats", "roundtrip", "subscription"} {
+		if report.Checks[name].Status != StatusUp {
+			t.Fatalf("expected %s up, got %+v", name, report.Checks[name])
+		}
+	}
+	if result := report.Checks["cache"]; result.Status != StatusDown || !strings.Contains(result.Error, "does not exist") {
+		t.Fatalf("expected the missing bucket down, got %+v", result)
+	}
+
+	sub.Unsubscribe()
+	if err := SubscriptionValid(sub)(context.Background()); err == nil {
+		t.Fatal("expected the closed subscription invalid")
+	}
+}
+
+func TestHTTPReachable(t *testing.T) {
+	status := http.StatusNotFound
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	check := HTTPReachable(srv.Client(), srv.URL)
+
+	if err := check(context.Background()); err != nil {
+		t.Fatalf("expected responses below 500 to count, got %v", err)
+	}
+	status = http.StatusBadGateway
+	if err := check(context.Background()); err == nil {
+		t.Fatal("expected a server error to fail the check")
+	}
+	srv.Close()
+	if err := check(context.Background()); err == nil {
+		t.Fatal("expected an unreachable server to fail the check")
+	}
+}
@@ -0,0 +1,32 @@
+// Package httputil holds helpers shared by the HTTP middleware of the internal packages
+package httputil
+
+import "net/http"
+
+// StatusRecorder remembers the status code a handler writes, for middleware that logs,
+// counts or traces responses. Handlers that never call WriteHeader answer 200.
+type StatusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// NewStatusRecorder wraps w
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+// Status returns the status code written so far
+func (r *StatusRecorder) Status() int {
+	return r.status
+}
+
+// WriteHeader records the status code before passing it on
+func (r *StatusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (r *StatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
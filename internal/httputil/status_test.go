@@ -0,0 +1,27 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusRecorder(t *testing.T) {
+	rec := NewStatusRecorder(httptest.NewRecorder())
+	rec.Write([]byte("ok"))
+	if rec.Status() != http.StatusOK {
+		t.Fatalf("expected 200 without WriteHeader, got %d", rec.Status())
+	}
+
+	w := httptest.NewRecorder()
+	rec = NewStatusRecorder(w)
+	rec.WriteHeader(http.StatusTeapot)
+	if rec.Status() != http.StatusTeapot || w.Code != http.StatusTeapot {
+		t.Fatalf("expected 418 recorded and passed on, got %d and %d", rec.Status(), w.Code)
+	}
+
+	// http.ResponseController reaches the wrapped writer's Flush
+	if err := http.NewResponseController(rec).Flush(); err != nil || !w.Flushed {
+		t.Fatalf("expected the wrapped writer flushed, got %v", err)
+	}
+}
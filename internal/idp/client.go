@@ -11,6 +11,8 @@ import (
 	"os"
 	"strings"
 	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/tracing"
 )
 
 // TokenResponse represents a response from the IDP with token information
@@ -20,12 +22,15 @@ type TokenResponse struct {
 	ExpiresIn    int    `json:"expires_in"`
 	RefreshToken string `json:"refresh_token,omitempty"`
 	Scope        string `json:"scope,omitempty"`
+	// IssuedTokenType is the type of token issued by a token exchange
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
 }
 
 // Client represents an IDP client for obtaining tokens
 type Client struct {
 	baseURL       string
 	tokenEndpoint string
+	discovery     *discoverer // nil unless endpoints are discovered
 	httpClient    *http.Client
 	logger        Logger
 }
@@ -62,11 +67,23 @@ type ClientCredentials struct {
 	ClientID     string `json:"client_id"`
 	ClientSecret string `json:"client_secret"`
 	Scope        string `json:"scope,omitempty"` // Added scope field
+	// Audience names the API the token is for, sent as the audience parameter that IDPs such
+	// as Auth0 and Keycloak's token exchange read
+	Audience string `json:"audience,omitempty"`
 }
 
 // ClientOption represents a function that modifies a Client
 type ClientOption func(*Client)
 
+// WithBaseURL sets the base URL, taking precedence over IDP_URL and turning off the discovery
+// IDP_ISSUER_URL turns on, e.g. for a client of another realm than the environment's
+func WithBaseURL(baseURL string) ClientOption {
+	return func(c *Client) {
+		c.baseURL = baseURL
+		c.discovery = nil
+	}
+}
+
 // WithTokenEndpoint sets a custom token endpoint path
 func WithTokenEndpoint(path string) ClientOption {
 	return func(c *Client) {
@@ -81,6 +98,13 @@ func WithTimeout(timeout time.Duration) ClientOption {
 	}
 }
 
+// WithTransport sets a custom HTTP transport, e.g. for proxies or fault injection
+func WithTransport(transport http.RoundTripper) ClientOption {
+	return func(c *Client) {
+		c.httpClient.Transport = transport
+	}
+}
+
 // WithLogger sets a custom logger
 func WithLogger(logger Logger) ClientOption {
 	return func(c *Client) {
@@ -88,6 +112,27 @@ func WithLogger(logger Logger) ClientOption {
 	}
 }
 
+// RequestIDHeader carries the ID of the request a call to the IDP is made for, so the IDP's
+// logs can be matched with ours
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// WithRequestID returns a context whose calls to the IDP send and log the request ID
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	if requestID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFrom returns the request ID set with WithRequestID, or ""
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
 // Configuration constants
 const (
 	DefaultBaseURL       = "https://idp.example.com"
@@ -114,44 +159,96 @@ func NewClient(baseURL string, options ...ClientOption) *Client {
 		},
 		logger: &DefaultLogger{},
 	}
+	if envIssuer := os.Getenv("IDP_ISSUER_URL"); envIssuer != "" {
+		WithDiscovery(envIssuer)(client)
+	}
 
 	// Apply options
 	for _, option := range options {
 		option(client)
 	}
 
+	// Calls to the IDP become spans of the trace that caused them
+	client.httpClient.Transport = tracing.Transport(client.httpClient.Transport)
+
 	return client
 }
 
+// BaseURL returns the identity provider's base URL, after environment overrides, or its
+// issuer URL with discovery
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
 // GetTokenWithClientCredentials obtains a token using client credentials
 func (c *Client) GetTokenWithClientCredentials(credentials *ClientCredentials) (*TokenResponse, error) {
-	// Create form data
-	formData := url.Values{}
-	formData.Set("grant_type", "client_credentials")
+	return c.GetTokenWithClientCredentialsCtx(context.Background(), credentials)
+}
+
+// GetTokenWithClientCredentialsCtx obtains a token using client credentials, giving up when
+// ctx is done or the client timeout expires, whichever comes first. When the IDP answers with
+// an error status, the error is an *Error.
+func (c *Client) GetTokenWithClientCredentialsCtx(ctx context.Context, credentials *ClientCredentials) (*TokenResponse, error) {
+	return c.requestToken(ctx, GrantClientCredentials, credentials, url.Values{})
+}
+
+// requestToken posts a token request for the grant type to the token endpoint. The form holds
+// the grant's parameters; the grant type, client credentials and scope are added to it.
+func (c *Client) requestToken(ctx context.Context, grantType string, credentials *ClientCredentials, formData url.Values) (*TokenResponse, error) {
+	formData.Set("grant_type", grantType)
 	formData.Set("client_id", credentials.ClientID)
-	formData.Set("client_secret", credentials.ClientSecret)
+	if credentials.ClientSecret != "" {
+		formData.Set("client_secret", credentials.ClientSecret)
+	}
 
-	// Add scope if provided
+	// Add scope and audience if provided
 	if credentials.Scope != "" {
 		formData.Set("scope", credentials.Scope)
 	}
-
-	// Create full token endpoint URL
-	tokenURL := fmt.Sprintf("%s%s", c.baseURL, c.tokenEndpoint)
+	if credentials.Audience != "" {
+		formData.Set("audience", credentials.Audience)
+	}
 
 	// Create request with context and timeout
-	ctx, cancel := context.WithTimeout(context.Background(), c.httpClient.Timeout)
+	ctx, cancel := context.WithTimeout(ctx, c.httpClient.Timeout)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(formData.Encode()))
+	// Resolve the token endpoint, from the discovery document if enabled
+	tokenURL, err := c.tokenURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := c.postForm(ctx, tokenURL, formData, grantType)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse response
+	var tokenResp TokenResponse
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return nil, fmt.Errorf("failed to parse token response: %w", err)
+	}
+
+	return &tokenResp, nil
+}
+
+// postForm posts a form to an IDP endpoint and returns the body of a 200 response. Other
+// statuses are returned as an *Error. The kind names the request in the debug logs.
+func (c *Client) postForm(ctx context.Context, endpoint string, formData url.Values, kind string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(formData.Encode()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	requestID := RequestIDFrom(ctx)
+	if requestID != "" {
+		req.Header.Set(RequestIDHeader, requestID)
+	}
 
 	// Log the request
-	c.logger.Debug("Sending request to IDP: %s %s", req.Method, req.URL.String())
+	c.logger.Debug("Sending %s request to IDP: %s %s (Request ID: %s)", kind, req.Method, req.URL.String(), requestID)
 
 	// Send request
 	resp, err := c.httpClient.Do(req)
@@ -167,20 +264,13 @@ func (c *Client) GetTokenWithClientCredentials(credentials *ClientCredentials) (
 	}
 
 	// Log the response
-	c.logger.Debug("Received response from IDP: %d %s", resp.StatusCode, string(body))
+	c.logger.Debug("Received response from IDP: %d %s (Request ID: %s)", resp.StatusCode, string(body), requestID)
 
-	// Check for error response
+	// Check for error response, usually an RFC 6749 error body
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("IDP returned error status: %d, body: %s", resp.StatusCode, string(body))
-	}
-
-	// Parse response
-	var tokenResp TokenResponse
-	if err := json.Unmarshal(body, &tokenResp); err != nil {
-		return nil, fmt.Errorf("failed to parse token response: %w", err)
+		return nil, parseError(resp.StatusCode, body)
 	}
-
-	return &tokenResp, nil
+	return body, nil
 }
 
 // SimulateTokenRetrieval is a mock function that simulates retrieving a token
@@ -0,0 +1,144 @@
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiscoveryPath is where an OpenID provider publishes its metadata, relative to the issuer
+const DiscoveryPath = "/.well-known/openid-configuration"
+
+// Discovery refresh timing: a document is used for DiscoveryRefreshInterval, and while the
+// IDP fails to serve a new one, the old one is kept and fetching is retried every
+// discoveryRetryInterval
+const (
+	DiscoveryRefreshInterval = time.Hour
+	discoveryRetryInterval   = time.Minute
+)
+
+// Discovery is the part of an OpenID provider's metadata the client uses, see OpenID
+// Connect Discovery 1.0 section 3
+type Discovery struct {
+	Issuer                            string   `json:"issuer"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint,omitempty"`
+	RevocationEndpoint                string   `json:"revocation_endpoint,omitempty"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	GrantTypesSupported               []string `json:"grant_types_supported,omitempty"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported,omitempty"`
+}
+
+// ErrDiscoveryDisabled is returned by Discovery for clients created without WithDiscovery
+var ErrDiscoveryDisabled = errors.New("discovery is not enabled")
+
+// discoverer fetches and caches the discovery document of an issuer
+type discoverer struct {
+	issuer string
+
+	mu        sync.Mutex
+	doc       *Discovery
+	refreshAt time.Time
+}
+
+// WithDiscovery looks up the token endpoint, and the other endpoints returned by Discovery,
+// in the discovery document of the OpenID issuer instead of using a fixed path. It replaces
+// the base URL and WithTokenEndpoint. The document is fetched on first use and refreshed
+// every DiscoveryRefreshInterval.
+func WithDiscovery(issuerURL string) ClientOption {
+	return func(c *Client) {
+		issuerURL = strings.TrimSuffix(issuerURL, "/")
+		c.baseURL = issuerURL
+		c.discovery = &discoverer{issuer: issuerURL}
+	}
+}
+
+// Discovery returns the issuer's discovery document, fetching it if it is missing or due for
+// a refresh. If a refresh fails, the previous document is returned.
+func (c *Client) Discovery(ctx context.Context) (*Discovery, error) {
+	d := c.discovery
+	if d == nil {
+		return nil, ErrDiscoveryDisabled
+	}
+
+	// Holding the lock while fetching makes concurrent callers share one request
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.doc != nil && time.Now().Before(d.refreshAt) {
+		return d.doc, nil
+	}
+
+	doc, err := c.fetchDiscovery(ctx, d.issuer)
+	if err != nil {
+		if d.doc == nil {
+			return nil, err
+		}
+		c.logger.Warn("Keeping the discovery document of %s: %v", d.issuer, err)
+		d.refreshAt = time.Now().Add(discoveryRetryInterval)
+		return d.doc, nil
+	}
+	if d.doc == nil || d.doc.TokenEndpoint != doc.TokenEndpoint {
+		c.logger.Info("Discovered token endpoint %s", doc.TokenEndpoint)
+	}
+	d.doc = doc
+	d.refreshAt = time.Now().Add(DiscoveryRefreshInterval)
+	return doc, nil
+}
+
+// fetchDiscovery reads and checks the discovery document of issuer
+func (c *Client) fetchDiscovery(ctx context.Context, issuer string) (*Discovery, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.httpClient.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+DiscoveryPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create discovery request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read discovery document: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery document of %s returned status %d", issuer, resp.StatusCode)
+	}
+
+	var doc Discovery
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse discovery document: %w", err)
+	}
+	// The document must describe the issuer it was fetched from, so a misrouted request
+	// cannot point the client at another IDP
+	if strings.TrimSuffix(doc.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery document of %s is for issuer %q", issuer, doc.Issuer)
+	}
+	if doc.TokenEndpoint == "" {
+		return nil, fmt.Errorf("discovery document of %s has no token_endpoint", issuer)
+	}
+	return &doc, nil
+}
+
+// tokenURL returns the URL token requests are posted to
+func (c *Client) tokenURL(ctx context.Context) (string, error) {
+	if c.discovery == nil {
+		return c.baseURL + c.tokenEndpoint, nil
+	}
+	doc, err := c.Discovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	return doc.TokenEndpoint, nil
+}
@@ -0,0 +1,82 @@
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newDiscoveryIDP serves a discovery document pointing at a token endpoint at an unusual
+// path, so requests only reach it through discovery
+func newDiscoveryIDP(t *testing.T, issuer func(base string) string) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var fetches atomic.Int64
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	mux.HandleFunc("/realms/test"+DiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(Discovery{
+			Issuer:        issuer(server.URL),
+			TokenEndpoint: server.URL + "/oauth2/v9/token",
+			JWKSURI:       server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/oauth2/v9/token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(TokenResponse{AccessToken: "discovered", TokenType: "Bearer", ExpiresIn: 60})
+	})
+	return server, &fetches
+}
+
+func TestDiscoveredTokenEndpoint(t *testing.T) {
+	server, fetches := newDiscoveryIDP(t, func(base string) string { return base + "/realms/test" })
+	client := NewClient("http://unused.invalid", WithDiscovery(server.URL+"/realms/test/"))
+
+	for i := 0; i < 3; i++ {
+		token, err := client.GetTokenWithClientCredentialsCtx(context.Background(), &ClientCredentials{ClientID: "a", ClientSecret: "b"})
+		if err != nil {
+			t.Fatalf("expected a token: %v", err)
+		}
+		if token.AccessToken != "discovered" {
+			t.Fatalf("unexpected token %+v", token)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("expected the discovery document to be fetched once, got %d", n)
+	}
+
+	doc, err := client.Discovery(context.Background())
+	if err != nil || doc.JWKSURI != server.URL+"/keys" {
+		t.Fatalf("unexpected discovery document %+v: %v", doc, err)
+	}
+	if client.BaseURL() != server.URL+"/realms/test" {
+		t.Fatalf("expected the issuer as base URL, got %s", client.BaseURL())
+	}
+}
+
+func TestDiscoveryRejectsAnotherIssuer(t *testing.T) {
+	server, _ := newDiscoveryIDP(t, func(string) string { return "https://evil.test/realms/test" })
+	client := NewClient("", WithDiscovery(server.URL+"/realms/test"))
+
+	_, err := client.GetTokenWithClientCredentialsCtx(context.Background(), &ClientCredentials{ClientID: "a"})
+	if err == nil || !strings.Contains(err.Error(), "is for issuer") {
+		t.Fatalf("expected an issuer mismatch, got %v", err)
+	}
+	if code := ErrorCode(err); code != ErrCodeTemporarilyUnavailable {
+		t.Fatalf("expected a failed discovery to be temporary, got %s", code)
+	}
+}
+
+func TestDiscoveryDisabled(t *testing.T) {
+	t.Setenv("IDP_ISSUER_URL", "")
+	client := NewClient("http://idp.test")
+	if _, err := client.Discovery(context.Background()); !errors.Is(err, ErrDiscoveryDisabled) {
+		t.Fatalf("expected ErrDiscoveryDisabled, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package idp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// OAuth error codes, RFC 6749 sections 4.1.2.1 and 5.2
+const (
+	ErrCodeInvalidRequest         = "invalid_request"
+	ErrCodeInvalidClient          = "invalid_client"
+	ErrCodeInvalidGrant           = "invalid_grant"
+	ErrCodeUnauthorizedClient     = "unauthorized_client"
+	ErrCodeUnsupportedGrantType   = "unsupported_grant_type"
+	ErrCodeInvalidScope           = "invalid_scope"
+	ErrCodeServerError            = "server_error"
+	ErrCodeTemporarilyUnavailable = "temporarily_unavailable"
+)
+
+// maxErrorBody bounds how much of a body that is not an OAuth error is kept as its description
+const maxErrorBody = 512
+
+// Error is a token request the IDP answered with an error status. Code and Description come
+// from an RFC 6749 error body; for other bodies, Code is derived from the status and
+// Description holds the start of the body. Requests rejected before they are sent, e.g. for
+// a missing parameter, have no StatusCode.
+type Error struct {
+	StatusCode  int    // HTTP status of the IDP response
+	Code        string // OAuth error code, e.g. invalid_client
+	Description string // error_description, if any
+	URI         string // error_uri, if any
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s: %s", e.Code, e.Description)
+	}
+	if e.Description == "" {
+		return fmt.Sprintf("IDP returned %s (status %d)", e.Code, e.StatusCode)
+	}
+	return fmt.Sprintf("IDP returned %s (status %d): %s", e.Code, e.StatusCode, e.Description)
+}
+
+// Temporary reports whether the request may succeed if retried later
+func (e *Error) Temporary() bool {
+	return e.Code == ErrCodeServerError || e.Code == ErrCodeTemporarilyUnavailable
+}
+
+// parseError builds the Error for a non-200 response
+func parseError(status int, body []byte) *Error {
+	var oauth struct {
+		Code        string `json:"error"`
+		Description string `json:"error_description"`
+		URI         string `json:"error_uri"`
+	}
+	if err := json.Unmarshal(body, &oauth); err == nil && oauth.Code != "" {
+		return &Error{StatusCode: status, Code: oauth.Code, Description: oauth.Description, URI: oauth.URI}
+	}
+
+	description := strings.TrimSpace(string(body))
+	if len(description) > maxErrorBody {
+		description = description[:maxErrorBody] + "..."
+	}
+	return &Error{StatusCode: status, Code: codeForStatus(status), Description: description}
+}
+
+// codeForStatus picks the OAuth error code closest to a status without an OAuth body
+func codeForStatus(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return ErrCodeInvalidClient
+	case status == http.StatusServiceUnavailable, status == http.StatusTooManyRequests:
+		return ErrCodeTemporarilyUnavailable
+	case status >= 500:
+		return ErrCodeServerError
+	}
+	return ErrCodeInvalidRequest
+}
+
+// ErrorCode returns the OAuth error code describing err: the code of an *Error, or
+// temporarily_unavailable for failures to reach the IDP at all
+func ErrorCode(err error) string {
+	var idpErr *Error
+	if errors.As(err, &idpErr) {
+		return idpErr.Code
+	}
+	return ErrCodeTemporarilyUnavailable
+}
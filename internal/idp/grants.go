@@ -0,0 +1,93 @@
+package idp
+
+import (
+	"context"
+	"net/url"
+)
+
+// Grant types accepted by the token endpoint
+const (
+	GrantClientCredentials = "client_credentials"
+	GrantPassword          = "password"
+	GrantRefreshToken      = "refresh_token"
+	GrantTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// Token type identifiers for token exchange, RFC 8693 section 3
+const (
+	TokenTypeAccessToken  = "urn:ietf:params:oauth:token-type:access_token"
+	TokenTypeRefreshToken = "urn:ietf:params:oauth:token-type:refresh_token"
+	TokenTypeIDToken      = "urn:ietf:params:oauth:token-type:id_token"
+	TokenTypeJWT          = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// TokenExchange describes an RFC 8693 token exchange: a token for the subject, and optionally
+// an actor, is exchanged for a token for another audience or of another type
+type TokenExchange struct {
+	SubjectToken       string
+	SubjectTokenType   string // TokenTypeAccessToken if empty
+	ActorToken         string
+	ActorTokenType     string // TokenTypeAccessToken if empty and ActorToken is set
+	Audience           string
+	Resource           string
+	RequestedTokenType string
+}
+
+// GetTokenWithPassword obtains a token for a user with the resource owner password grant.
+// The client secret may be empty for public clients.
+func (c *Client) GetTokenWithPassword(ctx context.Context, credentials *ClientCredentials, username, password string) (*TokenResponse, error) {
+	if username == "" {
+		return nil, invalidRequest("the password grant needs a username")
+	}
+	formData := url.Values{}
+	formData.Set("username", username)
+	formData.Set("password", password)
+	return c.requestToken(ctx, GrantPassword, credentials, formData)
+}
+
+// GetTokenWithRefreshToken obtains a new token with a refresh token issued earlier. The
+// scope of credentials, if set, must not exceed the original one.
+func (c *Client) GetTokenWithRefreshToken(ctx context.Context, credentials *ClientCredentials, refreshToken string) (*TokenResponse, error) {
+	if refreshToken == "" {
+		return nil, invalidRequest("the refresh_token grant needs a refresh token")
+	}
+	formData := url.Values{}
+	formData.Set("refresh_token", refreshToken)
+	return c.requestToken(ctx, GrantRefreshToken, credentials, formData)
+}
+
+// ExchangeToken exchanges a token with the RFC 8693 token exchange grant
+func (c *Client) ExchangeToken(ctx context.Context, credentials *ClientCredentials, exchange *TokenExchange) (*TokenResponse, error) {
+	if exchange.SubjectToken == "" {
+		return nil, invalidRequest("token exchange needs a subject token")
+	}
+	formData := url.Values{}
+	formData.Set("subject_token", exchange.SubjectToken)
+	formData.Set("subject_token_type", orDefault(exchange.SubjectTokenType, TokenTypeAccessToken))
+	if exchange.ActorToken != "" {
+		formData.Set("actor_token", exchange.ActorToken)
+		formData.Set("actor_token_type", orDefault(exchange.ActorTokenType, TokenTypeAccessToken))
+	}
+	for name, value := range map[string]string{
+		"audience":             exchange.Audience,
+		"resource":             exchange.Resource,
+		"requested_token_type": exchange.RequestedTokenType,
+	} {
+		if value != "" {
+			formData.Set(name, value)
+		}
+	}
+	return c.requestToken(ctx, GrantTokenExchange, credentials, formData)
+}
+
+// invalidRequest is the error for a request missing a parameter, caught before it is sent
+func invalidRequest(description string) *Error {
+	return &Error{Code: ErrCodeInvalidRequest, Description: description}
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,458 @@
+// Package idptest provides a fake identity provider with the Keycloak endpoint layout the
+// token workers use: client credentials and refresh token grants issuing RS256 JWTs,
+// introspection, revocation, JWKS and OpenID discovery. Latency and failures can be
+// simulated, and clients registered, to test the workers' retries and error mapping
+// without running Keycloak. cmd/mock-idp serves it for local development.
+package idptest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/idp"
+)
+
+// Defaults of Config
+const (
+	DefaultRealm    = "phoenix"
+	DefaultTokenTTL = time.Hour
+)
+
+// Config configures a fake IDP
+type Config struct {
+	Realm           string        // realm in the endpoint paths, DefaultRealm if empty
+	Issuer          string        // iss claim of the tokens, the realm URL each request was sent to if empty
+	TokenTTL        time.Duration // access token lifetime, DefaultTokenTTL if zero
+	RefreshTokenTTL time.Duration // refresh token lifetime, twice TokenTTL if zero, so expired tokens can be refreshed
+
+	Latency       time.Duration // added to every token request
+	Jitter        time.Duration // random extra latency of up to Jitter
+	FailureRate   float64       // fraction of token requests to fail, between 0 and 1
+	FailureStatus int           // HTTP status of injected failures, 500 if zero
+
+	Clients map[string]string // client ID -> secret, empty accepts any client
+	Log     idp.Logger        // nil discards the log
+}
+
+// IDP is a fake identity provider. Its settings can be changed while it serves requests.
+type IDP struct {
+	signer     *signer
+	log        idp.Logger
+	realmPath  string
+	issuer     string
+	tokenTTL   time.Duration
+	refreshTTL time.Duration
+	requests   atomic.Int64
+
+	mu            sync.Mutex
+	latency       time.Duration
+	jitter        time.Duration
+	failureRate   float64
+	failureStatus int
+	clients       map[string]string
+	refreshTokens map[string]*refreshToken // unused refresh tokens, until they expire
+	nextSweep     time.Time                // when expired refresh tokens are next removed
+	revoked       map[string]bool          // revoked access tokens, reported inactive by introspection
+}
+
+// refreshToken is a one-time refresh token, redeemed for a token with the claims it was
+// issued with
+type refreshToken struct {
+	claims  *claims
+	expires time.Time
+}
+
+// New creates a fake IDP with a freshly generated signing key
+func New(cfg Config) (*IDP, error) {
+	if cfg.FailureRate < 0 || cfg.FailureRate > 1 {
+		return nil, errors.New("failure rate must be between 0 and 1")
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = DefaultRealm
+	}
+	if cfg.TokenTTL <= 0 {
+		cfg.TokenTTL = DefaultTokenTTL
+	}
+	if cfg.RefreshTokenTTL <= 0 {
+		cfg.RefreshTokenTTL = 2 * cfg.TokenTTL
+	}
+	if cfg.FailureStatus == 0 {
+		cfg.FailureStatus = http.StatusInternalServerError
+	}
+	if cfg.Log == nil {
+		cfg.Log = nopLogger{}
+	}
+
+	signer, err := newSigner()
+	if err != nil {
+		return nil, err
+	}
+	clients := make(map[string]string, len(cfg.Clients))
+	for id, secret := range cfg.Clients {
+		clients[id] = secret
+	}
+	return &IDP{
+		signer:        signer,
+		log:           cfg.Log,
+		realmPath:     "/realms/" + cfg.Realm,
+		issuer:        cfg.Issuer,
+		tokenTTL:      cfg.TokenTTL,
+		refreshTTL:    cfg.RefreshTokenTTL,
+		latency:       cfg.Latency,
+		jitter:        cfg.Jitter,
+		failureRate:   cfg.FailureRate,
+		failureStatus: cfg.FailureStatus,
+		clients:       clients,
+		refreshTokens: make(map[string]*refreshToken),
+		revoked:       make(map[string]bool),
+	}, nil
+}
+
+// Handler serves the realm's endpoints under RealmPath, and /health
+func (m *IDP) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(m.TokenPath(), m.handleToken)
+	mux.HandleFunc(m.realmPath+"/protocol/openid-connect/token/introspect", m.handleIntrospect)
+	mux.HandleFunc(m.realmPath+"/protocol/openid-connect/revoke", m.handleRevoke)
+	mux.HandleFunc(m.JWKSPath(), m.handleJWKS)
+	mux.HandleFunc(m.realmPath+idp.DiscoveryPath, m.handleDiscovery)
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+	return mux
+}
+
+// RealmPath returns the path the realm's endpoints are under, e.g. /realms/phoenix
+func (m *IDP) RealmPath() string {
+	return m.realmPath
+}
+
+// TokenPath returns the path of the token endpoint, for idp.WithTokenEndpoint
+func (m *IDP) TokenPath() string {
+	return m.realmPath + "/protocol/openid-connect/token"
+}
+
+// JWKSPath returns the path of the key set that validates the issued tokens
+func (m *IDP) JWKSPath() string {
+	return m.realmPath + "/protocol/openid-connect/certs"
+}
+
+// SetLatency changes the latency added to token requests
+func (m *IDP) SetLatency(latency, jitter time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency, m.jitter = latency, jitter
+}
+
+// SetFailures changes the fraction of token requests answered with an error of the given
+// status, 500 if zero. A rate of 1 fails every request and 0 none.
+func (m *IDP) SetFailures(rate float64, status int) {
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failureRate, m.failureStatus = rate, status
+}
+
+// RegisterClient accepts the client with the secret, and from then on only registered
+// clients
+func (m *IDP) RegisterClient(clientID, secret string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clients[clientID] = secret
+}
+
+// RemoveClient stops accepting the client. Once no client is registered, any is accepted.
+func (m *IDP) RemoveClient(clientID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.clients, clientID)
+}
+
+// TokenRequests returns the number of requests to the token endpoint, failed ones included
+func (m *IDP) TokenRequests() int64 {
+	return m.requests.Load()
+}
+
+// IssueToken signs an access token for the client without a request, e.g. to call an API
+// that validates tokens. Its issuer is Config.Issuer.
+func (m *IDP) IssueToken(clientID, scope string) (string, error) {
+	token, _, err := m.sign(m.issuer, clientID, scope)
+	return token, err
+}
+
+// simulateConditions applies artificial latency and returns the status of a failure to
+// inject, or 0
+func (m *IDP) simulateConditions() int {
+	m.mu.Lock()
+	delay, jitter, rate, status := m.latency, m.jitter, m.failureRate, m.failureStatus
+	m.mu.Unlock()
+
+	if jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if rate > 0 && rand.Float64() < rate {
+		return status
+	}
+	return 0
+}
+
+// handleToken issues tokens for the client_credentials and refresh_token grants
+func (m *IDP) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m.requests.Add(1)
+
+	if status := m.simulateConditions(); status != 0 {
+		m.log.Warn("Injecting failure with status %d", status)
+		writeOAuthError(w, status, idp.ErrCodeServerError, "Injected failure")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, idp.ErrCodeInvalidRequest, "Malformed form body")
+		return
+	}
+
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+	case idp.GrantClientCredentials:
+		clientID := r.PostForm.Get("client_id")
+		if !m.authenticate(clientID, r.PostForm.Get("client_secret")) {
+			m.log.Warn("Rejected credentials for client ID: %s", clientID)
+			writeOAuthError(w, http.StatusUnauthorized, idp.ErrCodeInvalidClient, "Invalid client credentials")
+			return
+		}
+		m.issueTokens(w, m.issuerOf(r), clientID, r.PostForm.Get("scope"))
+
+	case idp.GrantRefreshToken:
+		refreshToken := r.PostForm.Get("refresh_token")
+
+		m.mu.Lock()
+		previous, found := m.refreshTokens[refreshToken]
+		delete(m.refreshTokens, refreshToken)
+		m.mu.Unlock()
+
+		if !found {
+			writeOAuthError(w, http.StatusBadRequest, idp.ErrCodeInvalidGrant, "Unknown or already used refresh token")
+			return
+		}
+		if !time.Now().Before(previous.expires) {
+			writeOAuthError(w, http.StatusBadRequest, idp.ErrCodeInvalidGrant, "Refresh token expired")
+			return
+		}
+		m.issueTokens(w, previous.claims.Issuer, previous.claims.ClientID, previous.claims.Scope)
+
+	default:
+		writeOAuthError(w, http.StatusBadRequest, idp.ErrCodeUnsupportedGrantType,
+			fmt.Sprintf("Grant type %q is not supported", grantType))
+	}
+}
+
+// authenticate checks the client credentials against the registered clients
+func (m *IDP) authenticate(clientID, clientSecret string) bool {
+	if clientID == "" {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.clients) == 0 {
+		return true
+	}
+	secret, found := m.clients[clientID]
+	return found && secret == clientSecret
+}
+
+// issuerOf returns the issuer of the tokens requested with r
+func (m *IDP) issuerOf(r *http.Request) string {
+	if m.issuer != "" {
+		return m.issuer
+	}
+	return "http://" + r.Host + m.realmPath
+}
+
+// sign signs a new access token
+func (m *IDP) sign(issuer, clientID, scope string) (string, *claims, error) {
+	now := time.Now()
+	accessClaims := &claims{
+		Issuer:    issuer,
+		Subject:   clientID,
+		ClientID:  clientID,
+		Scope:     scope,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(m.tokenTTL).Unix(),
+		ID:        randomToken(12),
+	}
+	token, err := m.signer.sign(accessClaims)
+	return token, accessClaims, err
+}
+
+// issueTokens signs a new access token, stores a one-time refresh token and writes the response.
+// Refresh tokens expire after RefreshTokenTTL, so load tests only keep the tokens issued
+// within the last RefreshTokenTTL.
+func (m *IDP) issueTokens(w http.ResponseWriter, issuer, clientID, scope string) {
+	accessToken, accessClaims, err := m.sign(issuer, clientID, scope)
+	if err != nil {
+		m.log.Error("Failed to sign token: %v", err)
+		writeOAuthError(w, http.StatusInternalServerError, idp.ErrCodeServerError, "Failed to sign token")
+		return
+	}
+
+	refresh := randomToken(32)
+	now := time.Now()
+	m.mu.Lock()
+	m.refreshTokens[refresh] = &refreshToken{claims: accessClaims, expires: now.Add(m.refreshTTL)}
+	m.sweepRefreshTokens(now)
+	m.mu.Unlock()
+
+	m.log.Info("Issued token for client ID: %s", clientID)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":       accessToken,
+		"token_type":         "Bearer",
+		"expires_in":         int(m.tokenTTL.Seconds()),
+		"refresh_token":      refresh,
+		"refresh_expires_in": int(m.refreshTTL.Seconds()),
+		"scope":              scope,
+	})
+}
+
+// handleIntrospect reports whether a token is active, following RFC 7662
+func (m *IDP) handleIntrospect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, idp.ErrCodeInvalidRequest, "Malformed form body")
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	c, err := m.signer.verify(token)
+	if err != nil {
+		m.log.Debug("Introspected inactive token: %v", err)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"active": false})
+		return
+	}
+	m.mu.Lock()
+	revoked := m.revoked[token]
+	m.mu.Unlock()
+	if revoked {
+		m.log.Debug("Introspected revoked token")
+		writeJSON(w, http.StatusOK, map[string]interface{}{"active": false})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"active":     true,
+		"sub":        c.Subject,
+		"client_id":  c.ClientID,
+		"scope":      c.Scope,
+		"iss":        c.Issuer,
+		"iat":        c.IssuedAt,
+		"exp":        c.ExpiresAt,
+		"token_type": "Bearer",
+	})
+}
+
+// handleRevoke revokes an access or refresh token as in RFC 7009. Unknown and invalid tokens
+// are accepted too, so the response does not tell whether a token was valid.
+func (m *IDP) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, idp.ErrCodeInvalidRequest, "Malformed form body")
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, idp.ErrCodeInvalidRequest, "Missing token")
+		return
+	}
+
+	m.mu.Lock()
+	if _, found := m.refreshTokens[token]; found {
+		delete(m.refreshTokens, token)
+	} else if _, err := m.signer.verify(token); err == nil {
+		m.revoked[token] = true
+	}
+	m.mu.Unlock()
+
+	m.log.Info("Revoked token for client ID: %s", r.PostForm.Get("client_id"))
+	w.WriteHeader(http.StatusOK)
+}
+
+// sweepRefreshTokens removes the expired refresh tokens, at most once per RefreshTokenTTL.
+// It must be called with m.mu held.
+func (m *IDP) sweepRefreshTokens(now time.Time) {
+	if now.Before(m.nextSweep) {
+		return
+	}
+	m.nextSweep = now.Add(m.refreshTTL)
+	for token, refresh := range m.refreshTokens {
+		if !now.Before(refresh.expires) {
+			delete(m.refreshTokens, token)
+		}
+	}
+}
+
+// handleJWKS publishes the signing key so clients can validate tokens locally
+func (m *IDP) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, m.signer.jwks())
+}
+
+// handleDiscovery publishes the realm's endpoints. Like Keycloak, it builds them from the
+// host the request was sent to, so they also resolve from other containers.
+func (m *IDP) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	issuer := "http://" + r.Host + m.realmPath
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                issuer,
+		"token_endpoint":                        issuer + "/protocol/openid-connect/token",
+		"introspection_endpoint":                issuer + "/protocol/openid-connect/token/introspect",
+		"revocation_endpoint":                   issuer + "/protocol/openid-connect/revoke",
+		"jwks_uri":                              issuer + "/protocol/openid-connect/certs",
+		"grant_types_supported":                 []string{idp.GrantClientCredentials, idp.GrantRefreshToken},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_post"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+// writeOAuthError writes an OAuth2 error response
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// writeJSON writes a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// nopLogger discards the log of an IDP created without one
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
@@ -0,0 +1,167 @@
+package idptest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/idp"
+	"github.com/kiquetal/nats-go-examples/internal/idp/jwks"
+)
+
+func newClient(srv *Server) *idp.Client {
+	return idp.NewClient(srv.URL, idp.WithTokenEndpoint(srv.TokenPath()), idp.WithLogger(nopLogger{}))
+}
+
+func TestTokensAreSignedJWTs(t *testing.T) {
+	srv := NewServer(t, Config{Realm: "test", Clients: map[string]string{"app": "secret"}})
+	client := newClient(srv)
+	ctx := context.Background()
+	credentials := &idp.ClientCredentials{ClientID: "app", ClientSecret: "secret", Scope: "read"}
+
+	token, err := client.GetTokenWithClientCredentialsCtx(ctx, credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.ExpiresIn != int(DefaultTokenTTL.Seconds()) || token.RefreshToken == "" {
+		t.Fatalf("unexpected token response %+v", token)
+	}
+
+	// The tokens validate against the published key set, with the realm URL as issuer
+	keys := jwks.New(srv.JWKSURL(), jwks.Options{Issuer: srv.IssuerURL()})
+	claims, err := keys.ValidateToken(token.AccessToken)
+	if err != nil || claims.ClientID != "app" || claims.Scope != "read" {
+		t.Fatalf("expected a valid token for app, got %+v: %v", claims, err)
+	}
+	issued, err := srv.IssueToken("other", "write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := keys.ValidateToken(issued); err != nil || claims.Subject != "other" {
+		t.Fatalf("expected the issued token to validate, got %+v: %v", claims, err)
+	}
+
+	// Refresh tokens are used once
+	refreshed, err := client.GetTokenWithRefreshToken(ctx, credentials, token.RefreshToken)
+	if err != nil || refreshed.AccessToken == "" {
+		t.Fatalf("expected a refreshed token, got %v", err)
+	}
+	var idpErr *idp.Error
+	if _, err := client.GetTokenWithRefreshToken(ctx, credentials, token.RefreshToken); !errors.As(err, &idpErr) || idpErr.Code != idp.ErrCodeInvalidGrant {
+		t.Fatalf("expected a used refresh token refused, got %v", err)
+	}
+
+	// Revoked tokens are inactive
+	if result, err := client.Introspect(ctx, credentials, refreshed.AccessToken, ""); err != nil || !result.Active || result.ClientID != "app" {
+		t.Fatalf("expected an active token, got %+v: %v", result, err)
+	}
+	if err := client.Revoke(ctx, credentials, refreshed.AccessToken, ""); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := client.Introspect(ctx, credentials, refreshed.AccessToken, ""); err != nil || result.Active {
+		t.Fatalf("expected the revoked token inactive, got %+v: %v", result, err)
+	}
+
+	// Discovery points at the same endpoints
+	discovered := idp.NewClient("", idp.WithDiscovery(srv.IssuerURL()), idp.WithLogger(nopLogger{}))
+	if _, err := discovered.GetTokenWithClientCredentialsCtx(ctx, credentials); err != nil {
+		t.Fatalf("expected a token through discovery, got %v", err)
+	}
+}
+
+func TestRefreshTokensExpire(t *testing.T) {
+	srv := NewServer(t, Config{TokenTTL: time.Millisecond, RefreshTokenTTL: 50 * time.Millisecond})
+	client := newClient(srv)
+	ctx := context.Background()
+	credentials := &idp.ClientCredentials{ClientID: "app", ClientSecret: "secret"}
+	issue := func() *idp.TokenResponse {
+		t.Helper()
+		token, err := client.GetTokenWithClientCredentialsCtx(ctx, credentials)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	// Refresh tokens outlive the access token they came with
+	time.Sleep(5 * time.Millisecond)
+	if _, err := client.GetTokenWithRefreshToken(ctx, credentials, issue().RefreshToken); err != nil {
+		t.Fatalf("expected a refresh after the access token expired, got %v", err)
+	}
+
+	// Until their own lifetime ends
+	token := issue()
+	time.Sleep(60 * time.Millisecond)
+	var idpErr *idp.Error
+	if _, err := client.GetTokenWithRefreshToken(ctx, credentials, token.RefreshToken); !errors.As(err, &idpErr) || idpErr.Code != idp.ErrCodeInvalidGrant {
+		t.Fatalf("expected an expired refresh token refused, got %v", err)
+	}
+
+	// Issuing tokens drops the expired refresh tokens that were never used
+	issue()
+	time.Sleep(60 * time.Millisecond)
+	issue()
+	srv.mu.Lock()
+	stored := len(srv.refreshTokens)
+	srv.mu.Unlock()
+	if stored != 1 {
+		t.Fatalf("expected only the live refresh token stored, got %d", stored)
+	}
+}
+
+func TestClientRegistrations(t *testing.T) {
+	srv := NewServer(t, Config{})
+	client := newClient(srv)
+	ctx := context.Background()
+
+	// Without registrations any client is accepted
+	if _, err := client.GetTokenWithClientCredentialsCtx(ctx, &idp.ClientCredentials{ClientID: "anyone"}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.RegisterClient("app", "secret")
+	var idpErr *idp.Error
+	_, err := client.GetTokenWithClientCredentialsCtx(ctx, &idp.ClientCredentials{ClientID: "anyone"})
+	if !errors.As(err, &idpErr) || idpErr.StatusCode != http.StatusUnauthorized || idpErr.Code != idp.ErrCodeInvalidClient {
+		t.Fatalf("expected unregistered clients refused, got %v", err)
+	}
+	if _, err := client.GetTokenWithClientCredentialsCtx(ctx, &idp.ClientCredentials{ClientID: "app", ClientSecret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.RemoveClient("app")
+	if _, err := client.GetTokenWithClientCredentialsCtx(ctx, &idp.ClientCredentials{ClientID: "anyone"}); err != nil {
+		t.Fatalf("expected any client accepted again, got %v", err)
+	}
+}
+
+func TestSimulatedConditions(t *testing.T) {
+	if _, err := New(Config{FailureRate: 2}); err == nil {
+		t.Fatal("expected a failure rate above 1 refused")
+	}
+
+	srv := NewServer(t, Config{FailureRate: 1, FailureStatus: http.StatusServiceUnavailable})
+	client := newClient(srv)
+	credentials := &idp.ClientCredentials{ClientID: "app"}
+
+	var idpErr *idp.Error
+	_, err := client.GetTokenWithClientCredentialsCtx(context.Background(), credentials)
+	if !errors.As(err, &idpErr) || idpErr.StatusCode != http.StatusServiceUnavailable || !idpErr.Temporary() {
+		t.Fatalf("expected an injected failure, got %v", err)
+	}
+
+	srv.SetFailures(0, 0)
+	srv.SetLatency(50*time.Millisecond, 0)
+	start := time.Now()
+	if _, err := client.GetTokenWithClientCredentialsCtx(context.Background(), credentials); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected the latency applied, took %v", elapsed)
+	}
+	if srv.TokenRequests() != 2 {
+		t.Fatalf("expected 2 token requests, got %d", srv.TokenRequests())
+	}
+}
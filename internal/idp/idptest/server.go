@@ -0,0 +1,45 @@
+package idptest
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// Server is a fake IDP listening on a random port of 127.0.0.1
+type Server struct {
+	*IDP
+	*httptest.Server
+}
+
+// NewServer starts a fake IDP and closes it when the test ends. Unless cfg sets one, the
+// issuer of its tokens is its realm URL.
+func NewServer(t testing.TB, cfg Config) *Server {
+	t.Helper()
+
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create IDP: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(m.Handler())
+	if m.issuer == "" {
+		m.issuer = "http://" + srv.Listener.Addr().String() + m.realmPath
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return &Server{IDP: m, Server: srv}
+}
+
+// IssuerURL returns the realm URL, the issuer for discovery
+func (s *Server) IssuerURL() string {
+	return s.URL + s.realmPath
+}
+
+// TokenURL returns the URL of the token endpoint
+func (s *Server) TokenURL() string {
+	return s.URL + s.TokenPath()
+}
+
+// JWKSURL returns the URL of the key set that validates the issued tokens
+func (s *Server) JWKSURL() string {
+	return s.URL + s.JWKSPath()
+}
@@ -0,0 +1,111 @@
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Introspection is an RFC 7662 introspection response. Only Active is always set; an
+// inactive token carries no other information.
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Subject   string `json:"sub,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+
+	// Claims holds every member of the response, including the ones above
+	Claims map[string]interface{} `json:"-"`
+}
+
+// Introspect asks the IDP whether a token is active, authenticating with the client's
+// credentials. The hint, e.g. "access_token", may be empty.
+func (c *Client) Introspect(ctx context.Context, credentials *ClientCredentials, token, hint string) (*Introspection, error) {
+	if token == "" {
+		return nil, invalidRequest("introspection needs a token")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.httpClient.Timeout)
+	defer cancel()
+	// Without discovery, the endpoints are derived from the token endpoint the way Keycloak
+	// lays them out
+	derived := c.baseURL + c.tokenEndpoint + "/introspect"
+	endpoint, err := c.endpointURL(ctx, "introspection", derived, func(doc *Discovery) string {
+		return doc.IntrospectionEndpoint
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := c.postForm(ctx, endpoint, tokenForm(credentials, token, hint), "introspection")
+	if err != nil {
+		return nil, err
+	}
+	var result Introspection
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse introspection response: %w", err)
+	}
+	if err := json.Unmarshal(body, &result.Claims); err != nil {
+		return nil, fmt.Errorf("failed to parse introspection response: %w", err)
+	}
+	return &result, nil
+}
+
+// Revoke revokes an access or refresh token as in RFC 7009. The IDP also accepts tokens that
+// are unknown or already invalid, so success does not mean the token was valid.
+func (c *Client) Revoke(ctx context.Context, credentials *ClientCredentials, token, hint string) error {
+	if token == "" {
+		return invalidRequest("revocation needs a token")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.httpClient.Timeout)
+	defer cancel()
+	derived := c.baseURL + strings.TrimSuffix(c.tokenEndpoint, "/token") + "/revoke"
+	endpoint, err := c.endpointURL(ctx, "revocation", derived, func(doc *Discovery) string {
+		return doc.RevocationEndpoint
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.postForm(ctx, endpoint, tokenForm(credentials, token, hint), "revocation")
+	return err
+}
+
+// endpointURL returns the URL of an endpoint from the discovery document if enabled, or the
+// derived URL otherwise
+func (c *Client) endpointURL(ctx context.Context, name, derived string, discovered func(*Discovery) string) (string, error) {
+	if c.discovery == nil {
+		return derived, nil
+	}
+	doc, err := c.Discovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	endpoint := discovered(doc)
+	if endpoint == "" {
+		return "", fmt.Errorf("discovery document of %s has no %s_endpoint", doc.Issuer, name)
+	}
+	return endpoint, nil
+}
+
+// tokenForm is the form of introspection and revocation requests
+func tokenForm(credentials *ClientCredentials, token, hint string) url.Values {
+	formData := url.Values{}
+	formData.Set("token", token)
+	if hint != "" {
+		formData.Set("token_type_hint", hint)
+	}
+	formData.Set("client_id", credentials.ClientID)
+	if credentials.ClientSecret != "" {
+		formData.Set("client_secret", credentials.ClientSecret)
+	}
+	return formData
+}
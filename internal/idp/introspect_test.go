@@ -0,0 +1,90 @@
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIntrospectAndRevoke(t *testing.T) {
+	revoked := map[string]bool{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realms/test/protocol/openid-connect/token/introspect", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("client_id") != "a" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		if token := r.PostForm.Get("token"); revoked[token] {
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "sub": "a", "scope": "openid", "exp": 1700000000, "tenant": "blue"})
+	})
+	mux.HandleFunc("/realms/test/protocol/openid-connect/revoke", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		revoked[r.PostForm.Get("token")] = true
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// Without discovery, the endpoints sit next to the token endpoint like Keycloak's
+	client := NewClient(server.URL, WithTokenEndpoint("/realms/test/protocol/openid-connect/token"))
+	credentials := &ClientCredentials{ClientID: "a", ClientSecret: "b"}
+	ctx := context.Background()
+
+	result, err := client.Introspect(ctx, credentials, "t1", "access_token")
+	if err != nil {
+		t.Fatalf("failed to introspect: %v", err)
+	}
+	if !result.Active || result.Subject != "a" || result.ExpiresAt != 1700000000 || result.Claims["tenant"] != "blue" {
+		t.Fatalf("unexpected introspection %+v", result)
+	}
+
+	if err := client.Revoke(ctx, credentials, "t1", ""); err != nil {
+		t.Fatalf("failed to revoke: %v", err)
+	}
+	if result, err := client.Introspect(ctx, credentials, "t1", ""); err != nil || result.Active {
+		t.Fatalf("expected the revoked token to be inactive, got %+v: %v", result, err)
+	}
+
+	// The IDP's errors come back as *Error
+	var idpErr *Error
+	if _, err := client.Introspect(ctx, &ClientCredentials{ClientID: "x"}, "t1", ""); !errors.As(err, &idpErr) || idpErr.Code != "invalid_client" {
+		t.Fatalf("expected invalid_client, got %v", err)
+	}
+}
+
+func TestDiscoveryWithoutRevocationEndpoint(t *testing.T) {
+	server, _ := newDiscoveryIDP(t, func(base string) string { return base + "/realms/test" })
+	client := NewClient("http://unused.invalid", WithDiscovery(server.URL+"/realms/test"))
+
+	if err := client.Revoke(context.Background(), &ClientCredentials{ClientID: "a"}, "t1", ""); err == nil {
+		t.Fatal("expected revocation to fail without a revocation_endpoint")
+	}
+}
+
+func TestRequestIDSentToIDP(t *testing.T) {
+	var seen []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Get(RequestIDHeader))
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "t", "token_type": "Bearer", "expires_in": 60})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithTokenEndpoint("/token"))
+	credentials := &ClientCredentials{ClientID: "a", ClientSecret: "b"}
+	if _, err := client.GetTokenWithClientCredentialsCtx(WithRequestID(context.Background(), "req-42"), credentials); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetTokenWithClientCredentialsCtx(context.Background(), credentials); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || seen[0] != "req-42" || seen[1] != "" {
+		t.Fatalf("expected the request ID only on the first call, got %q", seen)
+	}
+}
@@ -0,0 +1,459 @@
+// Package jwks validates JWTs issued by the IDP locally, with the public keys it publishes as
+// a JSON Web Key Set. The key set is fetched on first use and cached; it is fetched again
+// periodically, and when a token names a key the cache does not hold yet, which is how key
+// rotations are picked up.
+package jwks
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // SHA-256 for RS256, ES256 and PS256
+	_ "crypto/sha512" // SHA-384 and SHA-512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/tracing"
+)
+
+// Defaults for Options
+const (
+	DefaultRefreshInterval    = time.Hour
+	DefaultMinRefreshInterval = 30 * time.Second
+	DefaultTimeout            = 5 * time.Second
+)
+
+// Validation failures; the errors returned by ValidateToken wrap one of these
+var (
+	ErrMalformed            = errors.New("malformed token")
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	ErrUnknownKey           = errors.New("unknown signing key")
+	ErrInvalidSignature     = errors.New("invalid signature")
+	ErrExpired              = errors.New("token expired")
+	ErrNotYetValid          = errors.New("token not valid yet")
+	ErrInvalidIssuer        = errors.New("unexpected issuer")
+	ErrInvalidAudience      = errors.New("unexpected audience")
+)
+
+// Options controls how keys are refreshed and which claims are required
+type Options struct {
+	// RefreshInterval is how long a fetched key set is used before it is fetched again,
+	// DefaultRefreshInterval if zero
+	RefreshInterval time.Duration
+	// MinRefreshInterval bounds how often tokens with unknown key IDs can trigger a fetch,
+	// DefaultMinRefreshInterval if zero
+	MinRefreshInterval time.Duration
+	// Issuer, if set, must equal the iss claim
+	Issuer string
+	// Audience, if set, must be one of the aud claim's values
+	Audience string
+	// Leeway is the clock skew allowed when checking exp and nbf
+	Leeway time.Duration
+	// HTTPClient fetches the key set; a client with DefaultTimeout if nil
+	HTTPClient *http.Client
+}
+
+// Claims are the registered claims of a validated token, plus the common azp and scope.
+// Raw holds every claim.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+	ClientID  string   `json:"azp,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+
+	Raw map[string]interface{} `json:"-"`
+}
+
+// Audience is the aud claim, which may be a string or an array of strings
+type Audience []string
+
+// UnmarshalJSON accepts both forms of the claim
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// Contains reports whether aud is one of the audiences
+func (a Audience) Contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// KeySet validates tokens with the keys published at a JWKS URL. It is safe for concurrent use.
+type KeySet struct {
+	url  string
+	opts Options
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey // by key ID
+	fetchedAt time.Time
+	fetching  chan struct{} // closed when the fetch in progress ends, nil if none
+	fetchErr  error
+}
+
+// New returns a key set fetching its keys from url, e.g.
+// https://idp.example.com/realms/phoenix/protocol/openid-connect/certs. Nothing is fetched
+// until the first token is validated or Refresh is called.
+func New(url string, opts Options) *KeySet {
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = DefaultRefreshInterval
+	}
+	if opts.MinRefreshInterval <= 0 {
+		opts.MinRefreshInterval = DefaultMinRefreshInterval
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: DefaultTimeout, Transport: tracing.Transport(nil)}
+	}
+	return &KeySet{url: url, opts: opts}
+}
+
+// URL returns the address the keys are fetched from
+func (s *KeySet) URL() string {
+	return s.url
+}
+
+// ValidateToken checks the token's signature against the IDP's keys, and its expiry, issuer
+// and audience, and returns its claims
+func (s *KeySet) ValidateToken(tokenString string) (*Claims, error) {
+	return s.ValidateTokenCtx(context.Background(), tokenString)
+}
+
+// ValidateTokenCtx is ValidateToken with a context for the key set fetches it may need
+func (s *KeySet) ValidateTokenCtx(ctx context.Context, tokenString string) (*Claims, error) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 parts, got %d", ErrMalformed, len(parts))
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrMalformed, err)
+	}
+	alg, ok := algorithms[header.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedAlgorithm, header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrMalformed, err)
+	}
+
+	key, err := s.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := alg.verify(key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrMalformed, err)
+	}
+	if err := decodeSegment(parts[1], &claims.Raw); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrMalformed, err)
+	}
+	if err := s.checkClaims(&claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// checkClaims verifies the time and, if configured, issuer and audience claims
+func (s *KeySet) checkClaims(c *Claims) error {
+	now := time.Now()
+	if c.ExpiresAt != 0 && !now.Before(time.Unix(c.ExpiresAt, 0).Add(s.opts.Leeway)) {
+		return ErrExpired
+	}
+	if c.NotBefore != 0 && now.Add(s.opts.Leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return ErrNotYetValid
+	}
+	if s.opts.Issuer != "" && c.Issuer != s.opts.Issuer {
+		return fmt.Errorf("%w %q", ErrInvalidIssuer, c.Issuer)
+	}
+	if s.opts.Audience != "" && !c.Audience.Contains(s.opts.Audience) {
+		return fmt.Errorf("%w %v", ErrInvalidAudience, []string(c.Audience))
+	}
+	return nil
+}
+
+// key returns the public key with the ID, fetching the key set when it is stale or does not
+// hold the key. An empty ID matches the only key of a single-key set.
+func (s *KeySet) key(ctx context.Context, keyID string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	key, found := s.lookup(keyID)
+	fetchedAt, lastErr := s.fetchedAt, s.fetchErr
+	s.mu.Unlock()
+
+	age := time.Since(fetchedAt)
+	if found && age < s.opts.RefreshInterval {
+		return key, nil
+	}
+	if !found && !fetchedAt.IsZero() && age < s.opts.MinRefreshInterval {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+
+	if err := s.Refresh(ctx); err != nil {
+		if found {
+			// The IDP is unreachable: keep using the key rather than rejecting every token
+			return key, nil
+		}
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, found = s.lookup(keyID); !found {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	return key, nil
+}
+
+// lookup finds a key in the cached set; the caller holds mu
+func (s *KeySet) lookup(keyID string) (crypto.PublicKey, bool) {
+	if keyID == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, found := s.keys[keyID]
+	return key, found
+}
+
+// Refresh fetches the key set now. Concurrent calls share one fetch. A failed fetch keeps
+// the keys fetched before.
+func (s *KeySet) Refresh(ctx context.Context) error {
+	s.mu.Lock()
+	if s.fetching != nil {
+		done := s.fetching
+		s.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.fetchErr
+	}
+	done := make(chan struct{})
+	s.fetching = done
+	s.mu.Unlock()
+
+	keys, err := s.fetch(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetching = nil
+	s.fetchErr = err
+	// Failed fetches count too, so an unreachable IDP is not asked for every token
+	s.fetchedAt = time.Now()
+	if err == nil {
+		s.keys = keys
+	}
+	close(done)
+	return err
+}
+
+// jsonWebKey holds the fields of the RSA and EC keys in a key set
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	Use     string `json:"use"`
+	KeyID   string `json:"kid"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// fetch downloads and parses the key set. Keys that are not for signatures or of unknown
+// types are skipped.
+func (s *KeySet) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JWKS request: %w", err)
+	}
+	resp, err := s.opts.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS holds no usable signing keys")
+	}
+	return keys, nil
+}
+
+// publicKey converts the JWK into an RSA or ECDSA public key
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+}
+
+// algorithm verifies one JWS signing algorithm
+type algorithm struct {
+	hash crypto.Hash
+	kind string // rsa, pss or ecdsa
+}
+
+// algorithms are the asymmetric JWS algorithms accepted. "none" and the HMAC algorithms are
+// not: their tokens could be forged by anyone knowing the public keys.
+var algorithms = map[string]algorithm{
+	"RS256": {crypto.SHA256, "rsa"},
+	"RS384": {crypto.SHA384, "rsa"},
+	"RS512": {crypto.SHA512, "rsa"},
+	"PS256": {crypto.SHA256, "pss"},
+	"PS384": {crypto.SHA384, "pss"},
+	"PS512": {crypto.SHA512, "pss"},
+	"ES256": {crypto.SHA256, "ecdsa"},
+	"ES384": {crypto.SHA384, "ecdsa"},
+	"ES512": {crypto.SHA512, "ecdsa"},
+}
+
+// verify checks the signature of the signing input with the key
+func (a algorithm) verify(key crypto.PublicKey, signingInput, signature []byte) error {
+	h := a.hash.New()
+	h.Write(signingInput)
+	digest := h.Sum(nil)
+
+	switch a.kind {
+	case "rsa", "pss":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: key type does not match the algorithm", ErrInvalidSignature)
+		}
+		var err error
+		if a.kind == "rsa" {
+			err = rsa.VerifyPKCS1v15(pub, a.hash, digest, signature)
+		} else {
+			err = rsa.VerifyPSS(pub, a.hash, digest, signature, nil)
+		}
+		if err != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	case "ecdsa":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: key type does not match the algorithm", ErrInvalidSignature)
+		}
+		// JWS ECDSA signatures are r || s, each the size of the curve
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		sig := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, sig) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return ErrUnsupportedAlgorithm
+}
+
+// decodeSegment decodes a base64url JSON segment of a token
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,224 @@
+package jwks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIDP serves a key set that tests can rotate, and counts how often it is fetched
+type testIDP struct {
+	*httptest.Server
+	fetches atomic.Int64
+
+	mu   sync.Mutex
+	keys []map[string]string
+}
+
+func newTestIDP(t *testing.T) *testIDP {
+	t.Helper()
+	idp := &testIDP{}
+	idp.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idp.fetches.Add(1)
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": idp.keys})
+	}))
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// publish replaces the served keys
+func (idp *testIDP) publish(keys ...map[string]string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.keys = keys
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA", "use": "sig", "kid": kid,
+		"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "EC", "kid": kid, "crv": "P-256",
+		"x": base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y": base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// sign builds a compact JWT with the given header algorithm, key ID and claims
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss": "https://idp.test/realms/phoenix", "sub": "client-a", "azp": "client-a",
+		"aud": []string{"orders", "account"}, "scope": "openid", "exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+var (
+	keyOnce sync.Once
+	rsaKey  *rsa.PrivateKey
+	rsaKey2 *rsa.PrivateKey
+)
+
+func rsaKeys(t *testing.T) (*rsa.PrivateKey, *rsa.PrivateKey) {
+	keyOnce.Do(func() {
+		rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+		rsaKey2, _ = rsa.GenerateKey(rand.Reader, 2048)
+	})
+	return rsaKey, rsaKey2
+}
+
+func TestValidateToken(t *testing.T) {
+	idp := newTestIDP(t)
+	key, _ := rsaKeys(t)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	idp.publish(rsaJWK("rsa-1", key), ecJWK("ec-1", ecKey), map[string]string{"kty": "oct", "kid": "hmac"})
+
+	s := New(idp.URL, Options{Issuer: "https://idp.test/realms/phoenix", Audience: "orders"})
+
+	for _, token := range []string{
+		sign(t, "RS256", "rsa-1", key, validClaims()),
+		sign(t, "ES256", "ec-1", ecKey, validClaims()),
+	} {
+		claims, err := s.ValidateToken(token)
+		if err != nil {
+			t.Fatalf("expected a valid token: %v", err)
+		}
+		if claims.Subject != "client-a" || claims.ClientID != "client-a" || !claims.Audience.Contains("orders") || claims.Raw["scope"] != "openid" {
+			t.Fatalf("unexpected claims %+v", claims)
+		}
+	}
+	if n := idp.fetches.Load(); n != 1 {
+		t.Fatalf("expected the key set to be fetched once, got %d", n)
+	}
+}
+
+func TestValidateTokenRejects(t *testing.T) {
+	idp := newTestIDP(t)
+	key, other := rsaKeys(t)
+	idp.publish(rsaJWK("rsa-1", key))
+	s := New(idp.URL, Options{Issuer: "https://idp.test/realms/phoenix", Audience: "orders"})
+
+	with := func(name string, value interface{}) map[string]interface{} {
+		c := validClaims()
+		c[name] = value
+		return c
+	}
+	valid := sign(t, "RS256", "rsa-1", key, validClaims())
+	parts := strings.Split(valid, ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"garbage", "not-a-token", ErrMalformed},
+		{"alg none", none, ErrUnsupportedAlgorithm},
+		{"HMAC", sign(t, "HS256", "rsa-1", key, validClaims()), ErrUnsupportedAlgorithm},
+		{"other key", sign(t, "RS256", "rsa-1", other, validClaims()), ErrInvalidSignature},
+		{"tampered claims", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`)) + "." + parts[2], ErrInvalidSignature},
+		{"expired", sign(t, "RS256", "rsa-1", key, with("exp", time.Now().Add(-time.Minute).Unix())), ErrExpired},
+		{"not yet valid", sign(t, "RS256", "rsa-1", key, with("nbf", time.Now().Add(time.Hour).Unix())), ErrNotYetValid},
+		{"issuer", sign(t, "RS256", "rsa-1", key, with("iss", "https://evil.test")), ErrInvalidIssuer},
+		{"audience", sign(t, "RS256", "rsa-1", key, with("aud", "billing")), ErrInvalidAudience},
+	} {
+		if _, err := s.ValidateToken(tc.token); !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestKeyRotationIsPickedUp(t *testing.T) {
+	idp := newTestIDP(t)
+	key, next := rsaKeys(t)
+	idp.publish(rsaJWK("rsa-1", key))
+	s := New(idp.URL, Options{MinRefreshInterval: time.Millisecond})
+
+	if _, err := s.ValidateToken(sign(t, "RS256", "rsa-1", key, validClaims())); err != nil {
+		t.Fatalf("expected a valid token: %v", err)
+	}
+
+	// The IDP rotates to a new key; its first token triggers a fetch
+	idp.publish(rsaJWK("rsa-1", key), rsaJWK("rsa-2", next))
+	time.Sleep(5 * time.Millisecond)
+	if _, err := s.ValidateToken(sign(t, "RS256", "rsa-2", next, validClaims())); err != nil {
+		t.Fatalf("expected the rotated key to be fetched: %v", err)
+	}
+	if n := idp.fetches.Load(); n != 2 {
+		t.Fatalf("expected 2 fetches, got %d", n)
+	}
+}
+
+func TestUnknownKeysDoNotHammerTheIDP(t *testing.T) {
+	idp := newTestIDP(t)
+	key, other := rsaKeys(t)
+	idp.publish(rsaJWK("rsa-1", key))
+	s := New(idp.URL, Options{MinRefreshInterval: time.Hour})
+
+	for i := 0; i < 20; i++ {
+		if _, err := s.ValidateToken(sign(t, "RS256", "forged", other, validClaims())); !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("expected ErrUnknownKey, got %v", err)
+		}
+	}
+	if n := idp.fetches.Load(); n != 1 {
+		t.Fatalf("expected unknown keys to be rate limited to 1 fetch, got %d", n)
+	}
+}
+
+func TestStaleKeysAreKeptWhenTheIDPIsDown(t *testing.T) {
+	idp := newTestIDP(t)
+	key, _ := rsaKeys(t)
+	idp.publish(rsaJWK("rsa-1", key))
+	s := New(idp.URL, Options{RefreshInterval: time.Millisecond})
+
+	token := sign(t, "RS256", "rsa-1", key, validClaims())
+	if _, err := s.ValidateToken(token); err != nil {
+		t.Fatalf("expected a valid token: %v", err)
+	}
+	idp.Close()
+	time.Sleep(5 * time.Millisecond)
+	if _, err := s.ValidateToken(token); err != nil {
+		t.Fatalf("expected the cached key to be used while the IDP is down: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeFormat is the timestamp layout of text lines
+const timeFormat = "2006-01-02 15:04:05.000"
+
+// Field is a structured key-value pair attached to log lines with Logger.With
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Entry is one log line before formatting
+type Entry struct {
+	Time      time.Time
+	Level     Level
+	Component string
+	Message   string
+	Fields    []Field
+}
+
+// Formatter renders an entry as a single line, without the trailing newline
+type Formatter interface {
+	Format(e Entry) string
+}
+
+// ParseFormat returns the formatter for "text" or "json"; an empty name is text
+func ParseFormat(name string) (Formatter, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "text":
+		return TextFormatter{}, nil
+	case "json":
+		return JSONFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", name)
+}
+
+// TextFormatter writes the human-readable lines the binaries have always written, with
+// fields appended as key=value:
+//
+//	[2024-01-02 15:04:05.000] [INFO] [token-worker] Sent token response request_id=abc
+type TextFormatter struct{}
+
+// Format implements Formatter
+func (TextFormatter) Format(e Entry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] [%s] [%s] %s", e.Time.Format(timeFormat), e.Level, e.Component, e.Message)
+	for _, f := range e.Fields {
+		b.WriteString(" " + f.Key + "=" + quoteIfNeeded(fmt.Sprint(f.Value)))
+	}
+	return b.String()
+}
+
+// quoteIfNeeded quotes values that would otherwise be ambiguous in key=value output
+func quoteIfNeeded(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// JSONFormatter writes one JSON object per line for log aggregators:
+//
+//	{"time":"2024-01-02T15:04:05.000Z","level":"INFO","component":"token-worker","msg":"...","request_id":"abc"}
+//
+// Fields that collide with the built-in keys are written as field.<key>.
+type JSONFormatter struct{}
+
+// reservedKeys are the keys written by JSONFormatter for every entry
+var reservedKeys = map[string]bool{"time": true, "level": true, "component": true, "msg": true}
+
+// Format implements Formatter
+func (JSONFormatter) Format(e Entry) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	writeJSON(&b, "time", e.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	b.WriteByte(',')
+	writeJSON(&b, "level", e.Level.String())
+	b.WriteByte(',')
+	writeJSON(&b, "component", e.Component)
+	b.WriteByte(',')
+	writeJSON(&b, "msg", e.Message)
+	for _, f := range e.Fields {
+		key := f.Key
+		if reservedKeys[key] {
+			key = "field." + key
+		}
+		b.WriteByte(',')
+		writeJSON(&b, key, jsonValue(f.Value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// writeJSON writes "key":value, falling back to the value's string form if it cannot be
+// marshalled. Unlike json.Marshal, it leaves <, > and & readable.
+func writeJSON(b *strings.Builder, key string, value interface{}) {
+	b.WriteString(marshal(key))
+	b.WriteByte(':')
+	b.WriteString(marshal(value))
+}
+
+// marshal encodes v as compact JSON without HTML escaping
+func marshal(v interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		buf.Reset()
+		enc.Encode(fmt.Sprint(v))
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// jsonValue converts values that marshal poorly, such as errors (which become {}) and
+// durations (which become nanoseconds), to strings
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// pairs turns alternating keys and values into fields. Non-string keys are formatted with
+// fmt.Sprint and a trailing key without a value gets the value "!MISSING".
+func pairs(keyvals []interface{}) []Field {
+	fields := make([]Field, 0, (len(keyvals)+1)/2)
+	for i := 0; i < len(keyvals); i += 2 {
+		key, ok := keyvals[i].(string)
+		if !ok {
+			key = fmt.Sprint(keyvals[i])
+		}
+		var value interface{} = "!MISSING"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		fields = append(fields, Field{Key: key, Value: value})
+	}
+	return fields
+}
@@ -6,7 +6,11 @@ import (
 	"io"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
 )
 
 // Level represents the logging level
@@ -33,11 +37,86 @@ var levelNames = map[Level]string{
 	FATAL: "FATAL",
 }
 
+// String returns the level name, e.g. INFO
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// ParseLevel parses a level name such as "info" or "WARN"; an empty name is INFO
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToUpper(strings.TrimSpace(name)) {
+	case "DEBUG":
+		return DEBUG, nil
+	case "", "INFO":
+		return INFO, nil
+	case "WARN", "WARNING":
+		return WARN, nil
+	case "ERROR":
+		return ERROR, nil
+	case "FATAL":
+		return FATAL, nil
+	}
+	return INFO, fmt.Errorf("unknown log level %q", name)
+}
+
+// Package defaults, set from the application config with Configure
+var (
+	defaultsMu       sync.RWMutex
+	defaultLevel     Level     = INFO
+	defaultFormatter Formatter = TextFormatter{}
+)
+
+// Configure sets the default level and the format ("text" or "json") of loggers created
+// afterwards, typically from AppConfig.LogLevel and AppConfig.LogFormat right after loading
+// the config. NewLogger keeps its explicit level but uses the configured format.
+func Configure(level, format string) error {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	formatter, err := ParseFormat(format)
+	if err != nil {
+		return err
+	}
+
+	defaultsMu.Lock()
+	defer defaultsMu.Unlock()
+	defaultLevel = lvl
+	defaultFormatter = formatter
+	return nil
+}
+
+// SetLevel changes the default level, which also applies to the existing loggers created with
+// DefaultLogger or FromConfig, e.g. when the config is reloaded
+func SetLevel(level string) error {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	defaultsMu.Lock()
+	defer defaultsMu.Unlock()
+	defaultLevel = lvl
+	return nil
+}
+
+// defaults returns the configured level and formatter
+func defaults() (Level, Formatter) {
+	defaultsMu.RLock()
+	defer defaultsMu.RUnlock()
+	return defaultLevel, defaultFormatter
+}
+
 // Logger represents a custom logger instance
 type Logger struct {
 	level     Level
+	dynamic   bool // follows the default level instead of level
 	logger    *log.Logger
 	component string
+	formatter Formatter
+	fields    []Field
 }
 
 // NewLogger creates a new logger instance
@@ -45,29 +124,63 @@ func NewLogger(component string, level Level, output io.Writer) *Logger {
 	if output == nil {
 		output = os.Stdout
 	}
+	_, formatter := defaults()
 
 	return &Logger{
 		level:     level,
 		logger:    log.New(output, "", 0),
 		component: component,
+		formatter: formatter,
+	}
+}
+
+// FromConfig applies the level and format of the application config with Configure and
+// creates a logger for the component, so APP_LOG_LEVEL and APP_LOG_FORMAT take effect
+func FromConfig(component string, cfg *config.AppConfig) (*Logger, error) {
+	if err := Configure(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return nil, fmt.Errorf("invalid logging configuration: %w", err)
 	}
+	return DefaultLogger(component), nil
 }
 
 // DefaultLogger creates a new logger with default settings
 func DefaultLogger(component string) *Logger {
-	return NewLogger(component, INFO, os.Stdout)
+	level, _ := defaults()
+	l := NewLogger(component, level, os.Stdout)
+	l.dynamic = true
+	return l
+}
+
+// SetFormatter changes how the logger writes its lines
+func (l *Logger) SetFormatter(formatter Formatter) {
+	l.formatter = formatter
+}
+
+// With returns a logger that adds the key-value pairs to every line, e.g.
+// log.With("request_id", id). The original logger is unchanged.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]Field(nil), l.fields...), pairs(keyvals)...)
+	return &child
 }
 
 func (l *Logger) log(level Level, format string, args ...interface{}) {
-	if level < l.level {
+	minLevel := l.level
+	if l.dynamic {
+		minLevel, _ = defaults()
+	}
+	if level < minLevel {
 		return
 	}
 
-	msg := fmt.Sprintf(format, args...)
-	timestamp := time.Now().Format("2006-01-02 15:04:05.000")
-	levelName := levelNames[level]
-
-	l.logger.Printf("[%s] [%s] [%s] %s", timestamp, levelName, l.component, msg)
+	line := l.formatter.Format(Entry{
+		Time:      time.Now(),
+		Level:     level,
+		Component: l.component,
+		Message:   fmt.Sprintf(format, args...),
+		Fields:    l.fields,
+	})
+	l.logger.Print(line)
 
 	if level == FATAL {
 		os.Exit(1)
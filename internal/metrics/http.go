@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/httputil"
+)
+
+// HTTPMetrics counts and times the requests served by a handler
+type HTTPMetrics struct {
+	requests *Counter
+	duration *Histogram
+}
+
+// NewHTTPMetrics registers http_requests_total and http_request_duration_seconds, labelled
+// by method, route and, for the counter, status code
+func (r *Registry) NewHTTPMetrics() *HTTPMetrics {
+	return &HTTPMetrics{
+		requests: r.Counter("http_requests_total", "HTTP requests served", "method", "route", "code"),
+		duration: r.Histogram("http_request_duration_seconds", "HTTP request latency in seconds", nil, "method", "route"),
+	}
+}
+
+// Wrap instruments next. Requests are labelled with the ServeMux pattern that matched them,
+// so arbitrary paths cannot create unbounded series; unmatched requests share one route.
+func (m *HTTPMetrics) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := httputil.NewStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		m.requests.Inc(r.Method, route, strconv.Itoa(rec.Status()))
+		m.duration.ObserveSince(start, r.Method, route)
+	})
+}
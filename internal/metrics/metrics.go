@@ -0,0 +1,353 @@
+// Package metrics collects counters, gauges and histograms and serves them on /metrics in the
+// Prometheus text exposition format. Each binary creates its own registry, prefixed with its
+// name, and registers the metrics of its part of the pipeline; there is no global registry.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/version"
+)
+
+// DefaultBuckets are histogram upper bounds in seconds, suited to HTTP and NATS latencies
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ContentType is the Prometheus text exposition format served by Handler
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// collector is a metric family that can write itself in the exposition format
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics of one binary
+type Registry struct {
+	namespace string
+
+	mu         sync.Mutex
+	collectors []collector
+	names      map[string]bool
+}
+
+// NewRegistry creates a registry whose metric names start with namespace, e.g. brain_app.
+// It includes <namespace>_build_info, go_goroutines and process_start_time_seconds.
+func NewRegistry(namespace string) *Registry {
+	r := &Registry{namespace: namespace, names: make(map[string]bool)}
+
+	info := version.Get()
+	build := r.Gauge("build_info", "Build information, always 1", "version", "commit", "go_version")
+	build.Set(1, info.Version, info.Commit, info.GoVersion)
+
+	started := float64(time.Now().Unix())
+	r.register("process_start_time_seconds", &valueFunc{
+		name: "process_start_time_seconds", help: "Start time of the process since the Unix epoch in seconds", kind: "gauge",
+		fn: func() float64 { return started },
+	})
+	r.register("go_goroutines", &valueFunc{
+		name: "go_goroutines", help: "Number of goroutines that currently exist", kind: "gauge",
+		fn: func() float64 { return float64(runtime.NumGoroutine()) },
+	})
+	return r
+}
+
+// register adds a collector, panicking on duplicate names like other registration mistakes
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// fullName prefixes a metric name with the registry's namespace
+func (r *Registry) fullName(name string) string {
+	if r.namespace == "" {
+		return name
+	}
+	return r.namespace + "_" + name
+}
+
+// Counter registers a counter, conventionally named with a _total suffix
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{family: newFamily(r.fullName(name), help, "counter", labels)}
+	r.register(c.name, c)
+	return c
+}
+
+// Gauge registers a gauge that is set explicitly
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{family: newFamily(r.fullName(name), help, "gauge", labels)}
+	r.register(g.name, g)
+	return g
+}
+
+// GaugeFunc registers a gauge whose value is read from fn on every scrape
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	full := r.fullName(name)
+	r.register(full, &valueFunc{name: full, help: help, kind: "gauge", fn: fn})
+}
+
+// CounterFunc registers a counter whose value is read from fn on every scrape, for totals
+// another package already keeps
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	full := r.fullName(name)
+	r.register(full, &valueFunc{name: full, help: help, kind: "counter", fn: fn})
+}
+
+// Histogram registers a histogram with the given bucket upper bounds, DefaultBuckets if nil
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{family: newFamily(r.fullName(name), help, "histogram", labels), buckets: buckets}
+	r.register(h.name, h)
+	return h
+}
+
+// Handler serves the registered metrics to Prometheus
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		buf := bufio.NewWriter(w)
+		r.mu.Lock()
+		collectors := append([]collector(nil), r.collectors...)
+		r.mu.Unlock()
+		for _, c := range collectors {
+			c.write(buf)
+		}
+		buf.Flush()
+	})
+}
+
+// family is the state shared by labelled metrics: one series per combination of label values
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is one labelled time series
+type series struct {
+	labels  []string
+	value   float64
+	buckets []uint64 // histograms only, non-cumulative counts
+	count   uint64
+}
+
+// newFamily creates a family; unlabelled metrics are exported as zero before their first use
+func newFamily(name, help, kind string, labels []string) *family {
+	f := &family{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+	if len(labels) == 0 {
+		f.series[""] = &series{}
+	}
+	return f
+}
+
+// get returns the series for the label values, creating it on first use
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), values...)}
+		f.series[key] = s
+	}
+	return s
+}
+
+// sorted returns the series ordered by label values, for stable output
+func (f *family) sorted() []*series {
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := make([]*series, len(keys))
+	for i, key := range keys {
+		out[i] = f.series[key]
+	}
+	return out
+}
+
+// header writes the HELP and TYPE lines
+func (f *family) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.kind)
+}
+
+// writeValues writes one sample per series
+func (f *family) writeValues(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.header(w)
+	for _, s := range f.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", f.name, labelString(f.labels, s.labels, "", ""), formatFloat(s.value))
+	}
+}
+
+// Counter only goes up
+type Counter struct {
+	*family
+}
+
+// Inc adds one to the series with the label values
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add adds a non-negative amount to the series with the label values
+func (c *Counter) Add(v float64, labels ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: counter %s cannot decrease", c.name))
+	}
+	c.mu.Lock()
+	c.get(labels).value += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeValues(w)
+}
+
+// Gauge goes up and down
+type Gauge struct {
+	*family
+}
+
+// Set sets the series with the label values
+func (g *Gauge) Set(v float64, labels ...string) {
+	g.mu.Lock()
+	g.get(labels).value = v
+	g.mu.Unlock()
+}
+
+// Add changes the series with the label values by v, which may be negative
+func (g *Gauge) Add(v float64, labels ...string) {
+	g.mu.Lock()
+	g.get(labels).value += v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.writeValues(w)
+}
+
+// valueFunc is an unlabelled gauge or counter read on every scrape
+type valueFunc struct {
+	name string
+	help string
+	kind string
+	fn   func() float64
+}
+
+func (v *valueFunc) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", v.name, escapeHelp(v.help), v.name, v.kind, v.name, formatFloat(v.fn()))
+}
+
+// Histogram counts observations in buckets, e.g. request durations in seconds
+type Histogram struct {
+	*family
+	buckets []float64
+}
+
+// Observe records a value in the series with the label values
+func (h *Histogram) Observe(v float64, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.get(labels)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.buckets))
+	}
+	// Values above the last bound only appear in the +Inf bucket, which equals the count
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.buckets[i]++
+	}
+	s.count++
+	s.value += v
+}
+
+// ObserveSince records the seconds elapsed since start
+func (h *Histogram) ObserveSince(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	for _, s := range h.sorted() {
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			if s.buckets != nil {
+				cumulative += s.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, s.labels, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, s.labels, "", ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, s.labels, "", ""), s.count)
+	}
+}
+
+// labelString formats {name="value",...}, with an extra label such as le appended if set
+func labelString(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name + `="` + escapeLabel(values[i]) + `"`)
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extraName + `="` + extraValue + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func escapeHelp(s string) string { return helpEscaper.Replace(s) }
+
+// formatFloat writes values the way Prometheus parses them
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
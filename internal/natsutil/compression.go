@@ -0,0 +1,15 @@
+package natsutil
+
+import (
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+)
+
+// NewCompressor creates the compressor of message payloads configured in cfg, or returns nil
+// when compression is not enabled
+func NewCompressor(cfg config.CompressionConfig) (*pubsub.Compressor, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	return pubsub.NewCompressor(cfg.Encoding, cfg.Threshold)
+}
@@ -0,0 +1,26 @@
+package natsutil
+
+import (
+	"testing"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+)
+
+func TestNewCompressor(t *testing.T) {
+	if c, err := NewCompressor(config.CompressionConfig{}); c != nil || err != nil {
+		t.Fatalf("expected no compressor without an encoding, got %v: %v", c, err)
+	}
+
+	c, err := NewCompressor(config.CompressionConfig{Encoding: "s2", Threshold: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Encoding() != pubsub.EncodingS2 {
+		t.Fatalf("expected s2, got %s", c.Encoding())
+	}
+
+	if _, err := NewCompressor(config.CompressionConfig{Encoding: "zstd"}); err == nil {
+		t.Fatal("expected an unsupported encoding to fail")
+	}
+}
@@ -0,0 +1,191 @@
+// Package natsutil builds NATS connections and their options from the application configuration
+package natsutil
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"github.com/nats-io/nats.go"
+)
+
+// Options returns the connection options needed to reach the servers in cfg: the configured
+// credentials, TLS settings and reconnect policy, and for ws:// and wss:// URLs (WebSocket ports of edge
+// deployments) the configured path prefix and a tunnel through an HTTP proxy when one is
+// configured or set in HTTPS_PROXY / HTTP_PROXY.
+func Options(cfg config.NATSConfig) ([]nats.Option, error) {
+	opts, err := authOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tlsOpts, err := tlsOptions(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, tlsOpts...)
+	opts = append(opts, reconnectOptions(cfg)...)
+
+	servers := strings.Split(cfg.URL, ",")
+	if !usesWebSocket(servers) {
+		return opts, nil
+	}
+
+	if cfg.ProxyPath != "" {
+		opts = append(opts, nats.ProxyPath(cfg.ProxyPath))
+	}
+
+	proxyURL, err := resolveProxy(cfg.ProxyURL, strings.TrimSpace(servers[0]))
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != nil {
+		opts = append(opts, nats.SetCustomDialer(NewProxyDialer(proxyURL)))
+	}
+	return opts, nil
+}
+
+// Connect connects to the servers in cfg as the client name, which is reported to the server
+// with the build version. It uses the options from Options, handlers that log connection
+// events to log, and then opts, which may replace them. Servers that are not reachable yet
+// are retried with exponential backoff, up to cfg.ConnectRetries times, and Connect only
+// returns once the connection is up.
+func Connect(cfg config.NATSConfig, name string, log *logger.Logger, opts ...nats.Option) (*nats.Conn, error) {
+	base, err := Options(cfg)
+	if err != nil {
+		return nil, err
+	}
+	base = append(base, nats.Name(version.ClientName(name)))
+	base = append(base, logHandlers(log)...)
+	opts = append(base, opts...)
+
+	// Startup retries are separate from reconnects, so they also work for connections that
+	// must not reconnect once they were up
+	servers := strings.Join(ServerURLs(cfg), ", ")
+	for attempt := 1; ; attempt++ {
+		nc, err := nats.Connect(cfg.URL, opts...)
+		if err == nil {
+			return nc, nil
+		}
+		if cfg.ConnectRetries <= 0 {
+			return nil, fmt.Errorf("failed to connect to %s: %w", servers, err)
+		}
+		if attempt > cfg.ConnectRetries {
+			return nil, fmt.Errorf("failed to connect to %s after %d retries: %w", servers, cfg.ConnectRetries, err)
+		}
+		wait := backoff(cfg, attempt)
+		log.Warn("NATS server %s not reachable yet, retry %d of %d in %s", servers, attempt, cfg.ConnectRetries, wait)
+		time.Sleep(wait)
+	}
+}
+
+// reconnectOptions returns the reconnect policy of cfg: reconnects are off unless
+// AllowReconnect is set, and MaxReconnect rounds are made ReconnectWait apart, forever if it
+// is negative
+func reconnectOptions(cfg config.NATSConfig) []nats.Option {
+	if !cfg.AllowReconnect {
+		return []nats.Option{nats.NoReconnect()}
+	}
+	return []nats.Option{nats.MaxReconnects(cfg.MaxReconnect), nats.ReconnectWait(reconnectWait(cfg))}
+}
+
+// logHandlers returns the handlers that log connection events
+func logHandlers(log *logger.Logger) []nats.Option {
+	return []nats.Option{
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			// Closing the connection also disconnects it, without an error
+			if err != nil {
+				log.Warn("Disconnected from NATS: %v", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Info("Reconnected to NATS server at %s", nc.ConnectedUrl())
+		}),
+		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
+			if sub != nil {
+				log.Error("NATS error on %s: %v", sub.Subject, err)
+				return
+			}
+			log.Error("NATS error: %v", err)
+		}),
+		nats.LameDuckModeHandler(func(nc *nats.Conn) {
+			log.Warn("NATS server %s is shutting down, connections will move to another server", nc.ConnectedUrl())
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			log.Debug("NATS connection closed")
+		}),
+	}
+}
+
+// backoff returns the delay before startup retry n (counting from 1)
+func backoff(cfg config.NATSConfig, n int) time.Duration {
+	wait := time.Duration(cfg.ConnectRetryWait) * time.Millisecond
+	if wait <= 0 {
+		wait = time.Second
+	}
+	maxWait := time.Duration(cfg.ConnectRetryMaxWait) * time.Millisecond
+	for i := 1; i < n && (maxWait <= 0 || wait < maxWait); i++ {
+		wait *= 2
+	}
+	if maxWait > 0 && wait > maxWait {
+		wait = maxWait
+	}
+	return wait
+}
+
+// reconnectWait returns the delay between reconnect rounds, the library default if unset
+func reconnectWait(cfg config.NATSConfig) time.Duration {
+	if cfg.ReconnectWait > 0 {
+		return time.Duration(cfg.ReconnectWait) * time.Second
+	}
+	return nats.DefaultReconnectWait
+}
+
+// ServerURLs returns the configured server URLs, e.g. for logging
+func ServerURLs(cfg config.NATSConfig) []string {
+	var servers []string
+	for _, server := range strings.Split(cfg.URL, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// usesWebSocket reports whether the servers are reached over WebSocket. nats.go
+// requires all URLs in a server list to use the same kind of transport.
+func usesWebSocket(servers []string) bool {
+	for _, server := range servers {
+		server = strings.ToLower(strings.TrimSpace(server))
+		if strings.HasPrefix(server, "ws://") || strings.HasPrefix(server, "wss://") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveProxy returns the proxy to use: the explicit setting, or the standard proxy
+// environment variables for the first server URL. An explicit "none" disables proxying.
+func resolveProxy(explicit, server string) (*url.URL, error) {
+	if explicit == "none" {
+		return nil, nil
+	}
+	if explicit != "" {
+		proxyURL, err := url.Parse(explicit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		return proxyURL, nil
+	}
+
+	// Reuse net/http's interpretation of HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+	target, err := url.Parse(strings.Replace(server, "ws", "http", 1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL %q: %w", server, err)
+	}
+	return http.ProxyFromEnvironment(&http.Request{URL: target})
+}
@@ -0,0 +1,75 @@
+package natsutil
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestReconnectPolicyFromConfig(t *testing.T) {
+	for _, tc := range []struct {
+		cfg       config.NATSConfig
+		reconnect bool
+		max       int
+		wait      time.Duration
+	}{
+		{config.NATSConfig{AllowReconnect: true, MaxReconnect: 10, ReconnectWait: 5}, true, 10, 5 * time.Second},
+		{config.NATSConfig{AllowReconnect: true, MaxReconnect: -1}, true, -1, nats.DefaultReconnectWait},
+		{config.NATSConfig{AllowReconnect: false, MaxReconnect: 10}, false, 10, nats.DefaultReconnectWait},
+	} {
+		opts, err := Options(tc.cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		o := nats.GetDefaultOptions()
+		for _, opt := range opts {
+			opt(&o)
+		}
+		if o.AllowReconnect != tc.reconnect || (tc.reconnect && (o.MaxReconnect != tc.max || o.ReconnectWait != tc.wait)) {
+			t.Errorf("%+v: got reconnect=%v max=%d wait=%s", tc.cfg, o.AllowReconnect, o.MaxReconnect, o.ReconnectWait)
+		}
+	}
+}
+
+func TestConnectWaitsForServer(t *testing.T) {
+	// Reserve a port for a server that only starts after the first attempts failed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a port: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	cfg := config.NATSConfig{
+		URL:              fmt.Sprintf("nats://127.0.0.1:%d", port),
+		ConnectRetries:   10,
+		ConnectRetryWait: 20, ConnectRetryMaxWait: 100,
+	}
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		srv, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: port, NoLog: true, NoSigs: true})
+		if err != nil {
+			return
+		}
+		go srv.Start()
+		t.Cleanup(srv.Shutdown)
+	}()
+
+	nc, err := Connect(cfg, "test", logger.DefaultLogger("test"))
+	if err != nil {
+		t.Fatalf("expected Connect to wait for the server: %v", err)
+	}
+	nc.Close()
+
+	cfg.ConnectRetries = 2
+	cfg.URL = "nats://127.0.0.1:1"
+	if _, err := Connect(cfg, "test", logger.DefaultLogger("test")); err == nil {
+		t.Fatal("expected Connect to give up after its retries")
+	}
+}
@@ -0,0 +1,34 @@
+package natsutil
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+)
+
+// NewEncrypter creates the encrypter of message payloads configured in cfg, or returns nil
+// when encryption is not enabled
+func NewEncrypter(cfg config.EncryptionConfig) (*pubsub.Encrypter, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	keys := make(map[string][]byte, len(cfg.Keys))
+	for _, key := range cfg.Keys {
+		if key.ID == "" {
+			return nil, errors.New("encryption key without an ID")
+		}
+		if _, ok := keys[key.ID]; ok {
+			return nil, fmt.Errorf("encryption key %s is set twice", key.ID)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key.Key))
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s is not valid base64: %w", key.ID, err)
+		}
+		keys[key.ID] = decoded
+	}
+	return pubsub.NewEncrypter(cfg.KeyID, keys, cfg.Required)
+}
@@ -0,0 +1,35 @@
+package natsutil
+
+import (
+	"testing"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+)
+
+func TestNewEncrypter(t *testing.T) {
+	if e, err := NewEncrypter(config.EncryptionConfig{}); e != nil || err != nil {
+		t.Fatalf("expected no encrypter without a key ID, got %v: %v", e, err)
+	}
+
+	key := "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=" // 32 bytes
+	e, err := NewEncrypter(config.EncryptionConfig{KeyID: "new", Keys: []config.EncryptionKey{
+		{ID: "old", Key: key}, {ID: "new", Key: key + "\n"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.KeyID() != "new" || len(e.KeyIDs()) != 2 {
+		t.Fatalf("expected keys old and new encrypting with new, got %v and %s", e.KeyIDs(), e.KeyID())
+	}
+
+	for name, cfg := range map[string]config.EncryptionConfig{
+		"missing current key": {KeyID: "new", Keys: []config.EncryptionKey{{ID: "old", Key: key}}},
+		"duplicate ID":        {KeyID: "new", Keys: []config.EncryptionKey{{ID: "new", Key: key}, {ID: "new", Key: key}}},
+		"invalid base64":      {KeyID: "new", Keys: []config.EncryptionKey{{ID: "new", Key: "not base64!"}}},
+		"short key":           {KeyID: "new", Keys: []config.EncryptionKey{{ID: "new", Key: "c2hvcnQ="}}},
+	} {
+		if _, err := NewEncrypter(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package natsutil
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ProbeHeader marks the empty messages CheckPermissions publishes, so handlers can skip them
+const ProbeHeader = "Nats-Permission-Probe"
+
+// Permissions lists the subjects a binary needs. Subscribe entries may name a queue group
+// after the subject ("token.request token-workers"), as in the server's permission config.
+type Permissions struct {
+	Publish   []string
+	Subscribe []string
+}
+
+// CheckPermissions verifies that the connection may publish and subscribe to the subjects
+// in perms. The server reports violations asynchronously and otherwise drops the traffic,
+// so a binary missing a permission would silently never receive messages; checking at
+// startup turns that into an error naming every denied subject.
+//
+// Each subject is probed by subscribing to it, or publishing an empty message carrying
+// ProbeHeader, and flushing: the server answers the flush only after rejecting the probe.
+func CheckPermissions(nc *nats.Conn, perms Permissions, timeout time.Duration) error {
+	var denied []string
+
+	for _, entry := range perms.Subscribe {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		err := probe(nc, timeout, func() (*nats.Subscription, error) {
+			if len(fields) > 1 {
+				return nc.QueueSubscribeSync(fields[0], fields[1])
+			}
+			return nc.SubscribeSync(fields[0])
+		})
+		if err != nil {
+			denied = append(denied, err.Error())
+		}
+	}
+
+	for _, subject := range perms.Publish {
+		err := probe(nc, timeout, func() (*nats.Subscription, error) {
+			msg := nats.NewMsg(subject)
+			msg.Header.Set(ProbeHeader, "true")
+			return nil, nc.PublishMsg(msg)
+		})
+		if err != nil {
+			denied = append(denied, err.Error())
+		}
+	}
+
+	if len(denied) > 0 {
+		return fmt.Errorf("missing NATS permissions: %s", strings.Join(denied, "; "))
+	}
+	return nil
+}
+
+// IsProbe reports whether msg was published by CheckPermissions
+func IsProbe(msg *nats.Msg) bool {
+	return msg.Header.Get(ProbeHeader) != ""
+}
+
+// probe runs one publish or subscribe attempt and returns the violation it caused, if any.
+// The connection's last error changes when the server rejects the attempt.
+func probe(nc *nats.Conn, timeout time.Duration, attempt func() (*nats.Subscription, error)) error {
+	before := nc.LastError()
+
+	sub, err := attempt()
+	if err != nil {
+		return err
+	}
+	if sub != nil {
+		defer sub.Unsubscribe()
+	}
+	if err := nc.FlushTimeout(timeout); err != nil {
+		return fmt.Errorf("permission probe: %w", err)
+	}
+
+	err = nc.LastError()
+	if err == nil || err == before {
+		return nil
+	}
+
+	// The server's wording is kept, e.g. "Permissions Violation for Publish to "foo""
+	prefix := nats.PERMISSIONS_ERR + " for "
+	msg := err.Error()
+	i := strings.Index(strings.ToLower(msg), prefix)
+	if i < 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", msg[i+len(prefix):])
+}
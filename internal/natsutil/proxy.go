@@ -0,0 +1,81 @@
+package natsutil
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ProxyDialer opens connections through an HTTP proxy using CONNECT tunnels. TLS to
+// the NATS server (wss://) is negotiated by nats.go on top of the tunnel.
+type ProxyDialer struct {
+	proxy   *url.URL
+	timeout time.Duration
+}
+
+// NewProxyDialer creates a dialer that tunnels through the given http:// or https:// proxy
+func NewProxyDialer(proxy *url.URL) *ProxyDialer {
+	return &ProxyDialer{proxy: proxy, timeout: 10 * time.Second}
+}
+
+// Dial connects to the proxy and asks it to open a tunnel to address
+func (d *ProxyDialer) Dial(network, address string) (net.Conn, error) {
+	proxyAddr := d.proxy.Host
+	if d.proxy.Port() == "" {
+		if d.proxy.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(d.proxy.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(d.proxy.Hostname(), "80")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: d.timeout}
+	var conn net.Conn
+	var err error
+	if d.proxy.Scheme == "https" {
+		conn, err = tls.DialWithDialer(dialer, network, proxyAddr, &tls.Config{ServerName: d.proxy.Hostname()})
+	} else {
+		conn, err = dialer.Dial(network, proxyAddr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %w", proxyAddr, err)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	conn.SetDeadline(time.Now().Add(d.timeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to proxy: %w", err)
+	}
+
+	// The server only speaks after the client does, so nothing beyond the response is buffered
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read proxy response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused tunnel to %s: %s", address, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,141 @@
+package natsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// startServer runs an embedded server with the given options and returns its client URL
+func startServer(t *testing.T, opts *server.Options) string {
+	t.Helper()
+	opts.Host, opts.Port, opts.NoLog, opts.NoSigs = "127.0.0.1", -1, true, true
+	srv, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	go srv.Start()
+	t.Cleanup(srv.Shutdown)
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("server not ready")
+	}
+	return srv.ClientURL()
+}
+
+func TestConfiguredCredentialsAreSent(t *testing.T) {
+	log := logger.DefaultLogger("test")
+	for _, tc := range []struct {
+		name   string
+		server server.Options
+		cfg    config.NATSConfig
+	}{
+		{"user", server.Options{Username: "app", Password: "s3cret"}, config.NATSConfig{Username: "app", Password: "s3cret"}},
+		{"token", server.Options{Authorization: "t0ken"}, config.NATSConfig{Token: "t0ken"}},
+	} {
+		cfg := tc.cfg
+		cfg.URL = startServer(t, &tc.server)
+		nc, err := Connect(cfg, "test", log)
+		if err != nil {
+			t.Fatalf("%s: expected to connect with the configured credentials: %v", tc.name, err)
+		}
+		nc.Close()
+
+		if nc, err := Connect(config.NATSConfig{URL: cfg.URL}, "test", log); err == nil {
+			nc.Close()
+			t.Fatalf("%s: expected the server to refuse a connection without credentials", tc.name)
+		}
+	}
+}
+
+func TestTLSWithConfiguredCA(t *testing.T) {
+	dir := t.TempDir()
+	caFile, serverCert := writeTestCA(t, dir)
+
+	url := startServer(t, &server.Options{
+		TLS:       true,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{serverCert}, MinVersion: tls.VersionTLS12},
+	})
+	log := logger.DefaultLogger("test")
+
+	nc, err := Connect(config.NATSConfig{URL: url, TLS: config.TLSConfig{CA: caFile}}, "test", log)
+	if err != nil {
+		t.Fatalf("expected a TLS connection trusting the configured CA: %v", err)
+	}
+	if _, err := nc.TLSConnectionState(); err != nil {
+		t.Fatalf("expected the connection to use TLS: %v", err)
+	}
+	nc.Close()
+
+	// Without the CA the server certificate is not trusted
+	if nc, err := Connect(config.NATSConfig{URL: "tls://" + url[len("nats://"):]}, "test", log); err == nil {
+		nc.Close()
+		t.Fatal("expected the server certificate to be rejected without the CA")
+	}
+}
+
+func TestInvalidSecuritySettings(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	for _, cfg := range []config.NATSConfig{
+		{CredsFile: missing},
+		{TLS: config.TLSConfig{CA: missing}},
+		{TLS: config.TLSConfig{Cert: missing}},
+	} {
+		if _, err := Options(cfg); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
+
+// writeTestCA creates a CA, writes it to dir and returns its path and a server certificate
+// for 127.0.0.1 signed by it
+func writeTestCA(t *testing.T, dir string) (string, tls.Certificate) {
+	t.Helper()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serverDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "nats"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, &serverKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create server certificate: %v", err)
+	}
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600); err != nil {
+		t.Fatalf("failed to write CA: %v", err)
+	}
+	return caFile, tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}
+}
@@ -0,0 +1,108 @@
+// Package pool runs jobs on a fixed number of goroutines fed by a bounded queue, so a
+// message handler can work on several messages at once without starting one goroutine per
+// message. When the queue is full, jobs are refused rather than queued, which lets the
+// caller shed load, e.g. by answering a request with an error, instead of piling up work
+// whose requesters will have given up by the time it runs.
+package pool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Pool runs submitted jobs concurrently. The zero value is not usable, create pools with New.
+type Pool struct {
+	jobs        chan func()
+	limit       int64 // workers plus queued jobs
+	wg          sync.WaitGroup
+	outstanding atomic.Int64 // accepted jobs that have not finished
+	running     atomic.Int64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// New starts a pool of workers goroutines with room for queued jobs waiting for one of them.
+// Values below 1 worker are raised to 1; a queue of 0 only accepts jobs a worker is free for.
+func New(workers, queued int) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queued < 0 {
+		queued = 0
+	}
+	limit := workers + queued
+	p := &Pool{jobs: make(chan func(), limit), limit: int64(limit)}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// work runs jobs until the pool is closed and its queue is empty
+func (p *Pool) work() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		p.running.Add(1)
+		job()
+		p.running.Add(-1)
+		p.outstanding.Add(-1)
+	}
+}
+
+// Submit queues job and reports whether it was accepted. It never blocks: jobs are refused
+// when the queue is full or the pool is closed.
+func (p *Pool) Submit(job func()) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return false
+	}
+	for {
+		n := p.outstanding.Load()
+		if n >= p.limit {
+			return false
+		}
+		if p.outstanding.CompareAndSwap(n, n+1) {
+			break
+		}
+	}
+	// The channel has room for every outstanding job, so this does not block
+	p.jobs <- job
+	return true
+}
+
+// Queued returns the number of jobs waiting for a worker
+func (p *Pool) Queued() int {
+	return int(p.outstanding.Load() - p.running.Load())
+}
+
+// Running returns the number of jobs being run
+func (p *Pool) Running() int {
+	return int(p.running.Load())
+}
+
+// Close stops accepting jobs and waits for the queued and running ones to finish, or for ctx
+// to be done. It can be used as a run.Group stop hook.
+func (p *Pool) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,71 @@
+package pool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolBoundsConcurrencyAndQueue(t *testing.T) {
+	p := New(2, 1)
+	release := make(chan struct{})
+	var running, peak atomic.Int64
+	var started sync.WaitGroup
+	started.Add(2)
+	job := func() {
+		n := running.Add(1)
+		for {
+			old := peak.Load()
+			if n <= old || peak.CompareAndSwap(old, n) {
+				break
+			}
+		}
+		started.Done()
+		<-release
+		running.Add(-1)
+	}
+
+	// Two workers take a job each, the third waits in the queue and the fourth is refused
+	if !p.Submit(job) || !p.Submit(job) {
+		t.Fatal("expected the workers to accept a job each")
+	}
+	started.Wait()
+	started.Add(1)
+	if !p.Submit(job) {
+		t.Fatal("expected a job to be queued")
+	}
+	if p.Queued() != 1 || p.Running() != 2 {
+		t.Fatalf("expected 1 queued and 2 running jobs, got %d and %d", p.Queued(), p.Running())
+	}
+	if p.Submit(job) {
+		t.Fatal("expected a job to be refused with a full queue")
+	}
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Close(ctx); err != nil {
+		t.Fatalf("expected the queued job to finish: %v", err)
+	}
+	if peak.Load() != 2 {
+		t.Fatalf("expected at most 2 jobs at once, got %d", peak.Load())
+	}
+	if p.Submit(func() {}) {
+		t.Fatal("expected a closed pool to refuse jobs")
+	}
+}
+
+func TestCloseGivesUpWithContext(t *testing.T) {
+	p := New(1, 0)
+	release := make(chan struct{})
+	defer close(release)
+	p.Submit(func() { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.Close(ctx); err == nil {
+		t.Fatal("expected Close to give up on a job that does not finish")
+	}
+}
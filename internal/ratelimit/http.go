@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Scopes of the limits, passed to Middleware.OnLimited
+const (
+	ScopeIP     = "ip"
+	ScopeClient = "client"
+)
+
+// Middleware rejects HTTP requests over the per-IP or per-client limits with 429 Too Many
+// Requests and a Retry-After header. Requests are allowed when the limiter fails, so an
+// unreachable Redis does not take the server down with it.
+type Middleware struct {
+	limiter Limiter
+	config  atomic.Pointer[Config]
+
+	// ClientID returns the client of a request, or "" to skip the per-client limit
+	ClientID func(r *http.Request) string
+	// OnLimited, if not nil, is called with the scope of every rejected request
+	OnLimited func(r *http.Request, scope string)
+	// OnError, if not nil, receives the limiter's errors
+	OnError func(error)
+}
+
+// NewMiddleware creates a middleware enforcing the limits of cfg with limiter
+func NewMiddleware(limiter Limiter, cfg Config) *Middleware {
+	m := &Middleware{limiter: limiter}
+	m.config.Store(&cfg)
+	return m
+}
+
+// SetConfig changes the limits, e.g. when the configuration is reloaded. The backend and
+// window stay those the limiter was created with.
+func (m *Middleware) SetConfig(cfg Config) {
+	m.config.Store(&cfg)
+}
+
+// Wrap limits the requests to next
+func (m *Middleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := m.config.Load()
+		if cfg.PerIP > 0 && !m.allow(w, r, ScopeIP, clientIP(r, cfg.TrustForwardedFor), cfg.PerIP) {
+			return
+		}
+		if cfg.PerClient > 0 && m.ClientID != nil {
+			if id := m.ClientID(r); id != "" && !m.allow(w, r, ScopeClient, id, cfg.PerClient) {
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allow counts the request against the scope's limit, and rejects it if it is over
+func (m *Middleware) allow(w http.ResponseWriter, r *http.Request, scope, key string, limit int) bool {
+	allowed, retryAfter, err := m.limiter.Allow(scope+":"+key, limit)
+	if err != nil {
+		if m.OnError != nil {
+			m.OnError(err)
+		}
+		return true
+	}
+	if allowed {
+		return true
+	}
+
+	if m.OnLimited != nil {
+		m.OnLimited(r, scope)
+	}
+	TooManyRequests(w, retryAfter)
+	return false
+}
+
+// TooManyRequests rejects a request over a limit with 429 and a Retry-After header announcing
+// when the next window starts
+func TooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// clientIP returns the IP address a request came from: the first address of X-Forwarded-For
+// if it is trusted and set, the connection's remote address otherwise
+func clientIP(r *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// retryAfterSeconds returns the seconds a Retry-After header announces, rounded up so clients
+// do not retry before the window ends
+func retryAfterSeconds(d time.Duration) int {
+	return max(1, int(math.Ceil(d.Seconds())))
+}
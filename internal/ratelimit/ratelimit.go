@@ -0,0 +1,157 @@
+// Package ratelimit counts requests per key, such as a client IP address or client ID, in
+// fixed windows and rejects those over a limit. Counters are kept in memory, which limits each
+// replica on its own, or in Redis, which shares the limits between replicas.
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/cache"
+)
+
+// Backends selectable with Config.Backend
+const (
+	BackendMemory = "memory"
+	BackendRedis  = "redis"
+)
+
+// Defaults
+const (
+	DefaultWindow         = 60 // seconds
+	DefaultRedisKeyPrefix = "ratelimit:"
+)
+
+// Config sets the limits. Requests are allowed without limit when both are 0.
+type Config struct {
+	Backend   string `json:"backend,omitempty"`   // memory (default) or redis, with the cache's Redis settings
+	PerIP     int    `json:"perIp,omitempty"`     // requests per window from one IP address, unlimited if 0
+	PerClient int    `json:"perClient,omitempty"` // requests per window for one client ID, unlimited if 0
+	Window    int    `json:"window,omitempty"`    // in seconds, DefaultWindow if 0
+
+	// TrustForwardedFor takes the client IP from the X-Forwarded-For header, for servers that
+	// only receive requests through a reverse proxy
+	TrustForwardedFor bool `json:"trustForwardedFor,omitempty"`
+}
+
+// Enabled reports whether any limit is set
+func (c Config) Enabled() bool {
+	return c.PerIP > 0 || c.PerClient > 0
+}
+
+// WindowDuration returns the window the limits apply to
+func (c Config) WindowDuration() time.Duration {
+	if c.Window <= 0 {
+		return DefaultWindow * time.Second
+	}
+	return time.Duration(c.Window) * time.Second
+}
+
+// Limiter counts requests per key. Allow counts a request and reports whether it is within
+// limit for the current window, and if not, how long until the next window starts.
+type Limiter interface {
+	Allow(key string, limit int) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// New creates the limiter selected by cfg.Backend. The Redis limiter connects with redis, the
+// settings of the Redis token cache.
+func New(cfg Config, redis cache.RedisConfig) (Limiter, error) {
+	switch cfg.Backend {
+	case "", BackendMemory:
+		return NewMemoryLimiter(cfg.WindowDuration()), nil
+	case BackendRedis:
+		store, err := cache.NewRedisStore(redis, nil)
+		if err != nil {
+			return nil, err
+		}
+		return NewRedisLimiter(store, cfg.WindowDuration()), nil
+	}
+	return nil, fmt.Errorf("unknown rate limit backend %q", cfg.Backend)
+}
+
+// windowAt returns the number of the window now falls in and when that window ends. Windows
+// are aligned to the Unix epoch, so every replica agrees on them.
+func windowAt(now time.Time, window time.Duration) (int64, time.Time) {
+	n := now.UnixNano() / int64(window)
+	return n, time.Unix(0, (n+1)*int64(window))
+}
+
+// MemoryLimiter keeps the counters of the current window in memory
+type MemoryLimiter struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	current int64
+	counts  map[string]int
+}
+
+// NewMemoryLimiter creates a limiter counting requests per window
+func NewMemoryLimiter(window time.Duration) *MemoryLimiter {
+	return &MemoryLimiter{window: window, now: time.Now, counts: make(map[string]int)}
+}
+
+// Allow counts a request for key. The counters are dropped when a new window starts, so they
+// take memory only for the keys seen in the current one.
+func (l *MemoryLimiter) Allow(key string, limit int) (bool, time.Duration, error) {
+	n, end := windowAt(l.now(), l.window)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n != l.current {
+		l.current = n
+		l.counts = make(map[string]int)
+	}
+	l.counts[key]++
+	if l.counts[key] > limit {
+		return false, end.Sub(l.now()), nil
+	}
+	return true, 0, nil
+}
+
+// RedisLimiter keeps the counters in Redis, with one key per key and window that expires
+// with the window
+type RedisLimiter struct {
+	store  *cache.RedisStore
+	window time.Duration
+	prefix string
+}
+
+// NewRedisLimiter creates a limiter counting requests per window in store
+func NewRedisLimiter(store *cache.RedisStore, window time.Duration) *RedisLimiter {
+	return &RedisLimiter{store: store, window: window, prefix: DefaultRedisKeyPrefix}
+}
+
+// Allow counts a request for key
+func (l *RedisLimiter) Allow(key string, limit int) (bool, time.Duration, error) {
+	n, end := windowAt(time.Now(), l.window)
+	redisKey := l.prefix + key + ":" + strconv.FormatInt(n, 10)
+
+	reply, err := l.store.Do("INCR", redisKey)
+	if err != nil {
+		return true, 0, fmt.Errorf("redis INCR: %w", err)
+	}
+	count, ok := reply.(int64)
+	if !ok {
+		return true, 0, fmt.Errorf("unexpected INCR reply %v", reply)
+	}
+	// The first request of a window sets the expiry, with a second to spare for clock skew
+	// between the replicas
+	if count == 1 {
+		ttl := time.Until(end) + time.Second
+		if _, err := l.store.Do("PEXPIRE", redisKey, strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+			return true, 0, fmt.Errorf("redis PEXPIRE: %w", err)
+		}
+	}
+	if count > int64(limit) {
+		return false, time.Until(end), nil
+	}
+	return true, 0, nil
+}
+
+// Close closes the Redis connections
+func (l *RedisLimiter) Close() error {
+	return l.store.Close()
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryLimiterResetsEachWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewMemoryLimiter(time.Minute)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if allowed, _, _ := l.Allow("a", 2); !allowed {
+			t.Fatalf("expected request %d to be allowed", i+1)
+		}
+	}
+	allowed, retryAfter, _ := l.Allow("a", 2)
+	if allowed {
+		t.Fatal("expected the third request to be refused")
+	}
+	// 1000s is 40s into the window starting at 960s
+	if retryAfter != 20*time.Second {
+		t.Fatalf("expected to retry after 20s, got %s", retryAfter)
+	}
+	if allowed, _, _ := l.Allow("b", 2); !allowed {
+		t.Fatal("expected another key to have its own limit")
+	}
+
+	now = now.Add(20 * time.Second)
+	if allowed, _, _ := l.Allow("a", 2); !allowed {
+		t.Fatal("expected the limit to reset in the next window")
+	}
+}
+
+func TestMiddlewareLimitsByIPAndClient(t *testing.T) {
+	m := NewMiddleware(NewMemoryLimiter(time.Minute), Config{PerIP: 3, PerClient: 1})
+	m.ClientID = func(r *http.Request) string { return r.URL.Query().Get("client_id") }
+	var limited []string
+	m.OnLimited = func(r *http.Request, scope string) { limited = append(limited, scope) }
+	handler := m.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(remoteAddr, clientID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/token?client_id="+clientID, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("10.0.0.1:1000", "a"); w.Code != http.StatusOK {
+		t.Fatalf("expected the first request to pass, got %d", w.Code)
+	}
+	w := serve("10.0.0.1:1001", "a")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After for the client's second request, got %d", w.Code)
+	}
+	if w := serve("10.0.0.1:1002", "b"); w.Code != http.StatusOK {
+		t.Fatalf("expected another client to pass, got %d", w.Code)
+	}
+	if w := serve("10.0.0.1:1003", "c"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the IP's fourth request to be refused, got %d", w.Code)
+	}
+	if w := serve("10.0.0.2:1000", "c"); w.Code != http.StatusOK {
+		t.Fatalf("expected another IP to pass, got %d", w.Code)
+	}
+	if len(limited) != 2 || limited[0] != ScopeClient || limited[1] != ScopeIP {
+		t.Fatalf("expected a client and an IP rejection, got %v", limited)
+	}
+}
@@ -0,0 +1,244 @@
+// Package run manages the lifecycle of the long-running binaries: it starts their actors,
+// waits for a shutdown signal, a failure or for the work to finish, then stops everything
+// in the reverse order it was added, giving each stop hook a bounded amount of time
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultStopTimeout bounds each stop hook, and the wait for actors to return
+const DefaultStopTimeout = 10 * time.Second
+
+// Func is a start or stop hook. Start hooks run until their context is cancelled;
+// stop hooks should give up when their context expires.
+type Func func(ctx context.Context) error
+
+// actor is a named pair of hooks, either of which may be nil
+type actor struct {
+	name  string
+	start Func
+	stop  Func
+}
+
+// result is what a start hook returned
+type result struct {
+	name string
+	err  error
+}
+
+// Group runs a set of actors until one of them fails, all of them finish, or the process
+// receives SIGINT or SIGTERM. The zero value is not usable, create groups with New.
+type Group struct {
+	log         *logger.Logger
+	stopTimeout time.Duration
+	actors      []actor
+}
+
+// New creates an empty group that logs its lifecycle to log
+func New(log *logger.Logger) *Group {
+	return &Group{log: log, stopTimeout: DefaultStopTimeout}
+}
+
+// SetStopTimeout changes how long each stop hook may take
+func (g *Group) SetStopTimeout(timeout time.Duration) {
+	g.stopTimeout = timeout
+}
+
+// Add registers an actor. start runs in its own goroutine when the group runs; stop is
+// called during shutdown, after the start hooks' context has been cancelled.
+func (g *Group) Add(name string, start, stop Func) {
+	g.actors = append(g.actors, actor{name: name, start: start, stop: stop})
+}
+
+// Go registers an actor that only needs its context cancelled to stop
+func (g *Group) Go(name string, start Func) {
+	g.Add(name, start, nil)
+}
+
+// OnStop registers a stop hook, e.g. to close a resource opened before the group runs
+func (g *Group) OnStop(name string, stop Func) {
+	g.Add(name, nil, stop)
+}
+
+// AddServer runs an HTTP server and shuts it down gracefully, letting in-flight requests finish
+func (g *Group) AddServer(name string, srv *http.Server) {
+	g.Add(name, func(ctx context.Context) error {
+		g.log.Info("Starting HTTP server on %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}, srv.Shutdown)
+}
+
+// AddConn drains a NATS connection on shutdown, so subscriptions finish the messages they
+// already received and pending publishes are flushed. The connection is closed outright if
+// draining takes longer than the stop timeout.
+func (g *Group) AddConn(name string, nc *nats.Conn) {
+	g.OnStop(name, func(ctx context.Context) error {
+		if nc.IsClosed() {
+			return nil
+		}
+		if err := nc.Drain(); err != nil {
+			nc.Close()
+			return err
+		}
+
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for !nc.IsClosed() {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				nc.Close()
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+}
+
+// Run starts the actors and blocks until the group shuts down. Shutdown begins on the first
+// signal, the first start hook to fail, or once every start hook has returned; a group without
+// start hooks waits for a signal. A second signal exits immediately. Run returns the error
+// that caused the shutdown, or the first stop hook error.
+func (g *Group) Run() error {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan result, len(g.actors))
+	returned := make([]chan struct{}, len(g.actors))
+	var running sync.WaitGroup
+	for i, a := range g.actors {
+		if a.start == nil {
+			continue
+		}
+		returned[i] = make(chan struct{})
+		running.Add(1)
+		go func(a actor, done chan struct{}) {
+			defer running.Done()
+			defer close(done)
+			results <- result{name: a.name, err: a.start(ctx)}
+		}(a, returned[i])
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(finished)
+	}()
+
+	err := g.wait(signals, results, finished)
+	cancel()
+
+	// Waiting on a stuck stop hook should not make the process impossible to interrupt
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case sig := <-signals:
+			g.log.Warn("Received %s again, exiting immediately", sig)
+			os.Exit(1)
+		case <-stopped:
+		}
+	}()
+
+	// Actors added later may depend on earlier ones, e.g. a loop publishing on a connection,
+	// so each actor is stopped and has returned before the ones added before it are stopped
+	for i := len(g.actors) - 1; i >= 0; i-- {
+		a := g.actors[i]
+		if a.stop != nil {
+			if stopErr := g.stop(a); stopErr != nil {
+				g.log.Warn("Failed to stop %s: %v", a.name, stopErr)
+				if err == nil {
+					err = fmt.Errorf("stopping %s: %w", a.name, stopErr)
+				}
+			}
+		}
+		if returned[i] != nil {
+			select {
+			case <-returned[i]:
+			case <-time.After(g.stopTimeout):
+				g.log.Warn("Timed out after %s waiting for %s to return", g.stopTimeout, a.name)
+			}
+		}
+	}
+	return err
+}
+
+// wait blocks until the group should shut down and returns the error that caused it
+func (g *Group) wait(signals <-chan os.Signal, results <-chan result, finished <-chan struct{}) error {
+	hasActors := false
+	for _, a := range g.actors {
+		hasActors = hasActors || a.start != nil
+	}
+	if !hasActors {
+		finished = nil
+	}
+
+	for {
+		select {
+		case sig := <-signals:
+			g.log.Info("Received %s, shutting down...", sig)
+			return nil
+		case r := <-results:
+			if err := g.check(r); err != nil {
+				return err
+			}
+		case <-finished:
+			// Every result is sent before finished closes, but select may pick finished first
+			for len(results) > 0 {
+				if err := g.check(<-results); err != nil {
+					return err
+				}
+			}
+			g.log.Debug("All work finished, shutting down")
+			return nil
+		}
+	}
+}
+
+// check returns a start hook's error, if any, naming the actor that failed
+func (g *Group) check(r result) error {
+	if r.err != nil {
+		g.log.Debug("%s failed, shutting down", r.name)
+		return fmt.Errorf("%s: %w", r.name, r.err)
+	}
+	g.log.Debug("%s finished", r.name)
+	return nil
+}
+
+// stop calls an actor's stop hook, abandoning it once the stop timeout expires
+func (g *Group) stop(a actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), g.stopTimeout)
+	defer cancel()
+
+	g.log.Debug("Stopping %s", a.name)
+	done := make(chan error, 1)
+	go func() {
+		done <- a.stop(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out after %s", g.stopTimeout)
+	}
+}
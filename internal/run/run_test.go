@@ -0,0 +1,193 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/testutil"
+	"github.com/nats-io/nats.go"
+)
+
+func newGroup() *Group {
+	return New(logger.NewLogger("test", logger.ERROR, io.Discard))
+}
+
+// events records the order hooks ran in
+type events struct {
+	mu   sync.Mutex
+	list []string
+}
+
+func (e *events) add(event string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.list = append(e.list, event)
+}
+
+func (e *events) String() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return strings.Join(e.list, ",")
+}
+
+// waitDone runs until its context is cancelled
+func waitDone(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func TestRunStopsInReverseOrder(t *testing.T) {
+	g := newGroup()
+	var got events
+	for _, name := range []string{"conn", "consumer", "server"} {
+		name := name
+		g.Add(name, func(ctx context.Context) error {
+			return nil
+		}, func(ctx context.Context) error {
+			got.add(name)
+			return nil
+		})
+	}
+
+	// Once every start hook has returned, the group shuts down
+	if err := g.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != "server,consumer,conn" {
+		t.Fatalf("expected stop hooks in reverse order, got %s", got.String())
+	}
+}
+
+func TestRunWaitsForActorsBeforeStoppingEarlierOnes(t *testing.T) {
+	g := newGroup()
+	var got events
+	g.OnStop("conn", func(ctx context.Context) error {
+		got.add("conn stopped")
+		return nil
+	})
+	g.Go("loop", func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond)
+		got.add("loop returned")
+		return nil
+	})
+	g.Go("failing", func(ctx context.Context) error {
+		return errors.New("boom")
+	})
+
+	if err := g.Run(); err == nil {
+		t.Fatal("expected the failure returned")
+	}
+	if got.String() != "loop returned,conn stopped" {
+		t.Fatalf("expected the loop to return before the connection stopped, got %s", got.String())
+	}
+}
+
+func TestRunReturnsFirstError(t *testing.T) {
+	g := newGroup()
+	errStart := errors.New("listen failed")
+	g.Add("server", func(ctx context.Context) error {
+		return errStart
+	}, func(ctx context.Context) error {
+		return errors.New("close failed")
+	})
+	g.Go("worker", waitDone)
+
+	err := g.Run()
+	if !errors.Is(err, errStart) || !strings.HasPrefix(err.Error(), "server: ") {
+		t.Fatalf("expected the start error of server, got %v", err)
+	}
+
+	// Without a failure, the first stop hook error is returned
+	g = newGroup()
+	errStop := errors.New("close failed")
+	g.Add("first", func(ctx context.Context) error { return nil }, func(ctx context.Context) error {
+		return errors.New("not returned")
+	})
+	g.Add("second", func(ctx context.Context) error { return nil }, func(ctx context.Context) error {
+		return errStop
+	})
+	if err := g.Run(); !errors.Is(err, errStop) || !strings.HasPrefix(err.Error(), "stopping second: ") {
+		t.Fatalf("expected the stop error of second, got %v", err)
+	}
+}
+
+func TestRunStopTimeout(t *testing.T) {
+	g := newGroup()
+	g.SetStopTimeout(50 * time.Millisecond)
+
+	var got events
+	stuck := make(chan struct{})
+	defer close(stuck)
+	g.OnStop("first", func(ctx context.Context) error {
+		got.add("first")
+		return nil
+	})
+	g.Add("stuck", func(ctx context.Context) error {
+		// Ignores its context, so the group gives up waiting for it
+		<-stuck
+		return nil
+	}, func(ctx context.Context) error {
+		// Ignores its deadline, so the group abandons it
+		<-stuck
+		return nil
+	})
+	g.Go("failing", func(ctx context.Context) error {
+		return errors.New("boom")
+	})
+
+	start := time.Now()
+	if err := g.Run(); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("expected the failure returned, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the stuck hooks abandoned after the stop timeout, took %v", elapsed)
+	}
+	if got.String() != "first" {
+		t.Fatalf("expected the hooks after the stuck one to run, got %s", got.String())
+	}
+
+	// A stop hook that times out is reported when nothing else failed
+	g = newGroup()
+	g.SetStopTimeout(20 * time.Millisecond)
+	g.Add("stuck", func(ctx context.Context) error { return nil }, func(ctx context.Context) error {
+		<-stuck
+		return nil
+	})
+	if err := g.Run(); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected a stop timeout, got %v", err)
+	}
+}
+
+func TestAddConnDrains(t *testing.T) {
+	nc := testutil.Connect(t, testutil.StartServer(t, testutil.WithoutJetStream()))
+	received := make(chan struct{}, 1)
+	if _, err := nc.Subscribe("jobs", func(msg *nats.Msg) {
+		received <- struct{}{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	g := newGroup()
+	g.AddConn("nats", nc)
+	g.Go("publish", func(ctx context.Context) error {
+		return nc.Publish("jobs", []byte("job"))
+	})
+	if err := g.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !nc.IsClosed() {
+		t.Fatal("expected the connection closed")
+	}
+	select {
+	case <-received:
+	default:
+		t.Fatal("expected the published message delivered before the connection closed")
+	}
+}
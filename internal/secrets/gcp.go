@@ -0,0 +1,124 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	gcpSecretManagerURL = "https://secretmanager.googleapis.com/v1"
+	gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// GCPConfig configures Google Secret Manager. GOOGLE_CLOUD_PROJECT is used when no project is
+// set. Requests are authorized with GOOGLE_OAUTH_ACCESS_TOKEN when set, e.g. from
+// `gcloud auth print-access-token`, or with the service account from the metadata server.
+type GCPConfig struct {
+	Project  string `json:"project,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"` // e.g. an emulator URL, the Secret Manager API by default
+}
+
+// GCP reads secrets from Secret Manager: gcp://name#field for the latest version, or
+// gcp://name@version#field for a specific one
+type GCP struct {
+	cfg    GCPConfig
+	client *http.Client
+}
+
+// NewGCP creates a Secret Manager provider, filling in the project from the environment
+func NewGCP(cfg GCPConfig) *GCP {
+	if cfg.Project == "" {
+		cfg.Project = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = gcpSecretManagerURL
+	}
+	return &GCP{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Get accesses a version of the secret
+func (g *GCP) Get(ctx context.Context, key string) (string, error) {
+	if g.cfg.Project == "" {
+		return "", fmt.Errorf("gcp project not configured")
+	}
+	name, field := splitField(key)
+	name, secretVersion, found := strings.Cut(name, "@")
+	if !found {
+		secretVersion = "latest"
+	}
+
+	token, err := g.accessToken(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to obtain gcp access token: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/projects/%s/secrets/%s/versions/%s:access", strings.TrimSuffix(g.cfg.Endpoint, "/"), g.cfg.Project, name, secretVersion)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", fmt.Errorf("gcp secret %s: %w", name, ErrNotFound)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("secret manager returned %s for %s", resp.Status, name)
+	}
+
+	var payload struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", fmt.Errorf("failed to parse secret manager response: %w", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(payload.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode secret %s: %w", name, err)
+	}
+	return jsonField(string(data), field)
+}
+
+// accessToken returns an OAuth access token for the Secret Manager API
+func (g *GCP) accessToken(ctx context.Context) (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s", resp.Status)
+	}
+
+	var payload struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", err
+	}
+	return payload.AccessToken, nil
+}
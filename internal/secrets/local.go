@@ -0,0 +1,54 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultFileDir is where Docker and Kubernetes mount secrets as files
+const DefaultFileDir = "/run/secrets"
+
+// Env reads secrets from environment variables: env://NAME
+type Env struct{}
+
+// Get returns the variable named by key
+func (Env) Get(ctx context.Context, key string) (string, error) {
+	name, field := splitField(key)
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s: %w", name, ErrNotFound)
+	}
+	return jsonField(value, field)
+}
+
+// File reads secrets from files: file:///abs/path, or file://name relative to Dir.
+// Trailing newlines, which editors and echo add, are removed.
+type File struct {
+	Dir string
+}
+
+// Get returns the contents of the file named by key
+func (f File) Get(ctx context.Context, key string) (string, error) {
+	path, field := splitField(key)
+	if !filepath.IsAbs(path) {
+		dir := f.Dir
+		if dir == "" {
+			dir = DefaultFileDir
+		}
+		path = filepath.Join(dir, path)
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("file %s: %w", path, ErrNotFound)
+	}
+	if err != nil {
+		return "", err
+	}
+	return jsonField(strings.TrimRight(string(data), "\r\n"), field)
+}
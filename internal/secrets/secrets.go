@@ -0,0 +1,211 @@
+// Package secrets resolves secret references such as vault://nats#password in configuration
+// values and flags. A reference names a provider (env, file, vault, aws or gcp) and a key,
+// optionally followed by #field to pick one field of a JSON secret. Values without a known
+// scheme are used as they are, so plain secrets keep working.
+//
+// Resolved values are cached for a while and fetched again afterwards, so rotated secrets are
+// picked up by long-running binaries without a restart.
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheTTL is how long a resolved secret is reused before it is fetched again
+const DefaultCacheTTL = 5 * time.Minute
+
+// ErrNotFound is returned when a provider has no secret under the key
+var ErrNotFound = errors.New("secret not found")
+
+// Provider looks up secrets in one backend. The key is the part of the reference after the
+// scheme, including any #field suffix.
+type Provider interface {
+	Get(ctx context.Context, key string) (string, error)
+}
+
+// Config selects and configures the secret backends
+type Config struct {
+	CacheTTL int         `json:"cacheTtl"`          // in seconds, negative disables caching
+	FileDir  string      `json:"fileDir,omitempty"` // base directory for relative file:// keys, /run/secrets by default
+	Vault    VaultConfig `json:"vault"`
+	AWS      AWSConfig   `json:"aws"`
+	GCP      GCPConfig   `json:"gcp"`
+}
+
+// cached is a resolved secret and when it has to be fetched again
+type cached struct {
+	value   string
+	expires time.Time
+}
+
+// Resolver resolves references with the registered providers and caches the values
+type Resolver struct {
+	ttl       time.Duration
+	providers map[string]Provider
+
+	mu    sync.Mutex
+	cache map[string]cached
+}
+
+// New creates a resolver with the env, file, vault, aws and gcp providers. Backends that are
+// not configured only fail when a reference to them is resolved.
+func New(cfg Config) *Resolver {
+	ttl := time.Duration(cfg.CacheTTL) * time.Second
+	if cfg.CacheTTL == 0 {
+		ttl = DefaultCacheTTL
+	}
+
+	r := &Resolver{ttl: ttl, providers: make(map[string]Provider), cache: make(map[string]cached)}
+	r.Register("env", Env{})
+	r.Register("file", File{Dir: cfg.FileDir})
+	r.Register("vault", NewVault(cfg.Vault))
+	r.Register("aws", NewAWS(cfg.AWS))
+	r.Register("gcp", NewGCP(cfg.GCP))
+	return r
+}
+
+// Register adds or replaces the provider for a scheme
+func (r *Resolver) Register(scheme string, provider Provider) {
+	r.providers[scheme] = provider
+}
+
+// IsReference reports whether value refers to a secret of a registered provider
+func (r *Resolver) IsReference(value string) bool {
+	_, _, ok := r.parse(value)
+	return ok
+}
+
+// Resolve returns the secret value refers to, or value itself when it is not a reference
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	provider, key, ok := r.parse(value)
+	if !ok {
+		return value, nil
+	}
+
+	r.mu.Lock()
+	entry, found := r.cache[value]
+	r.mu.Unlock()
+	if found && time.Now().Before(entry.expires) {
+		return entry.value, nil
+	}
+
+	secret, err := provider.Get(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", redact(value), err)
+	}
+
+	if r.ttl > 0 {
+		r.mu.Lock()
+		r.cache[value] = cached{value: secret, expires: time.Now().Add(r.ttl)}
+		r.mu.Unlock()
+	}
+	return secret, nil
+}
+
+// ResolveAll resolves each of the values in place, stopping at the first failure
+func (r *Resolver) ResolveAll(ctx context.Context, values ...*string) error {
+	for _, value := range values {
+		resolved, err := r.Resolve(ctx, *value)
+		if err != nil {
+			return err
+		}
+		*value = resolved
+	}
+	return nil
+}
+
+// Watch fetches the referenced secret every interval, bypassing the cache, and calls onChange
+// with the new value whenever it differs from the previous one. It returns when ctx is done;
+// failed lookups are passed to onError, if set, and retried on the next tick.
+func (r *Resolver) Watch(ctx context.Context, value string, interval time.Duration, onChange func(string), onError func(error)) {
+	provider, key, ok := r.parse(value)
+	if !ok {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var current string
+	for first := true; ; first = false {
+		secret, err := provider.Get(ctx, key)
+		switch {
+		case err != nil:
+			if onError != nil && ctx.Err() == nil {
+				onError(fmt.Errorf("failed to resolve %s: %w", redact(value), err))
+			}
+		case first || secret != current:
+			current = secret
+			r.mu.Lock()
+			r.cache[value] = cached{value: secret, expires: time.Now().Add(r.ttl)}
+			r.mu.Unlock()
+			if !first {
+				onChange(secret)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// parse splits a reference into its provider and key
+func (r *Resolver) parse(value string) (Provider, string, bool) {
+	scheme, key, found := strings.Cut(value, "://")
+	if !found || key == "" {
+		return nil, "", false
+	}
+	provider, ok := r.providers[scheme]
+	return provider, key, ok
+}
+
+// splitField separates the #field suffix from a key
+func splitField(key string) (string, string) {
+	name, field, _ := strings.Cut(key, "#")
+	return name, field
+}
+
+// jsonField picks a field out of a secret stored as a JSON object, or returns the secret
+// unchanged when no field is requested
+func jsonField(secret, field string) (string, error) {
+	if field == "" {
+		return secret, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object, cannot select field %s", field)
+	}
+	return stringField(fields, field)
+}
+
+// stringField returns a field of a decoded JSON object as a string
+func stringField(fields map[string]interface{}, field string) (string, error) {
+	value, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("field %s: %w", field, ErrNotFound)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+// redact shortens a reference for error messages; references hold no secret material, but
+// literal values passed by mistake might
+func redact(value string) string {
+	if len(value) > 64 {
+		return value[:64] + "..."
+	}
+	return value
+}
@@ -0,0 +1,381 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// staticProvider returns the current value of a secret and counts the lookups
+type staticProvider struct {
+	mu      sync.Mutex
+	value   string
+	err     error
+	lookups int
+}
+
+func (p *staticProvider) Get(ctx context.Context, key string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lookups++
+	return p.value, p.err
+}
+
+func (p *staticProvider) set(value string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.value, p.err = value, err
+}
+
+func (p *staticProvider) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lookups
+}
+
+// The credentials of AWS's Signature Version 4 test suite
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+func TestSignV4(t *testing.T) {
+	// Vectors from the AWS Signature Version 4 test suite, signed at 20150830T123600Z
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		method, url string
+		contentType string
+		body        string
+		service     string
+		want        string
+	}{
+		{
+			name: "get-vanilla", method: http.MethodGet, url: "https://example.amazonaws.com/", service: "service",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name: "get-vanilla-query-order-key-case", method: http.MethodGet, url: "https://example.amazonaws.com/?Param2=value2&Param1=value1", service: "service",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name: "post-vanilla", method: http.MethodPost, url: "https://example.amazonaws.com/", service: "service",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name: "post-x-www-form-urlencoded", method: http.MethodPost, url: "https://example.amazonaws.com/", service: "service",
+			contentType: "application/x-www-form-urlencoded", body: "Param1=value1",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+		{
+			// The IAM ListUsers example of the signing documentation
+			name: "iam-list-users", method: http.MethodGet, url: "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", service: "iam",
+			contentType: "application/x-www-form-urlencoded; charset=utf-8",
+			want:        "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			signV4(req, []byte(tt.body), testAccessKey, testSecretKey, "us-east-1", tt.service, now)
+			if got := req.Header.Get("Authorization"); got != tt.want {
+				t.Fatalf("unexpected signature\n got: %s\nwant: %s", got, tt.want)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Fatalf("expected X-Amz-Date 20150830T123600Z, got %s", got)
+			}
+		})
+	}
+}
+
+func TestEnvAndFile(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("TEST_SECRET", "s3cret")
+	t.Setenv("TEST_JSON_SECRET", `{"user":"app","password":"pw","port":4222}`)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "nats"), []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r := New(Config{FileDir: dir})
+
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"env://TEST_SECRET", "s3cret"},
+		{"env://TEST_JSON_SECRET#password", "pw"},
+		{"env://TEST_JSON_SECRET#port", "4222"},
+		{"file://nats", "from-file"},
+		{"file://" + filepath.Join(dir, "nats"), "from-file"},
+		{"plain-value", "plain-value"},
+		{"unknown://scheme", "unknown://scheme"},
+	}
+	for _, tt := range tests {
+		if got, err := r.Resolve(ctx, tt.ref); err != nil || got != tt.want {
+			t.Fatalf("%s: expected %q, got %q: %v", tt.ref, tt.want, got, err)
+		}
+	}
+
+	for _, ref := range []string{"env://TEST_MISSING", "env://TEST_JSON_SECRET#missing", "file://missing"} {
+		if _, err := r.Resolve(ctx, ref); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%s: expected %v, got %v", ref, ErrNotFound, err)
+		}
+	}
+	if _, err := r.Resolve(ctx, "env://TEST_SECRET#field"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected a field of a plain secret refused, got %v", err)
+	}
+}
+
+func TestVault(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/v1/kv/data/apps/nats" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"data": map[string]string{"value": "default", "password": "pw"}},
+		})
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	vault := NewVault(VaultConfig{Address: srv.URL + "/", Token: "root", Mount: "kv"})
+
+	if got, err := vault.Get(ctx, "apps/nats"); err != nil || got != "default" {
+		t.Fatalf("expected the value field, got %q: %v", got, err)
+	}
+	if got, err := vault.Get(ctx, "/apps/nats#password"); err != nil || got != "pw" {
+		t.Fatalf("expected the password field, got %q: %v", got, err)
+	}
+	if _, err := vault.Get(ctx, "apps/nats#missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v for a missing field, got %v", ErrNotFound, err)
+	}
+	if _, err := vault.Get(ctx, "apps/other"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v for a missing path, got %v", ErrNotFound, err)
+	}
+	forbidden := NewVault(VaultConfig{Address: srv.URL, Token: "wrong", Mount: "kv"})
+	if _, err := forbidden.Get(ctx, "apps/nats"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected a permission error, got %v", err)
+	}
+}
+
+func TestAWS(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", testAccessKey)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", testSecretKey)
+	t.Setenv("AWS_SESSION_TOKEN", "session")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential="+testAccessKey+"/") ||
+			!strings.Contains(auth, "/eu-west-1/secretsmanager/aws4_request") ||
+			!strings.Contains(auth, "x-amz-security-token") ||
+			r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "AccessDeniedException", "message": "bad signature"})
+			return
+		}
+
+		var body struct{ SecretId string }
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &body)
+		if body.SecretId != "prod/nats" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "com.amazonaws.secretsmanager#ResourceNotFoundException"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"SecretString": `{"password":"pw"}`})
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	aws := NewAWS(AWSConfig{Region: "eu-west-1", Endpoint: srv.URL})
+
+	if got, err := aws.Get(ctx, "prod/nats"); err != nil || got != `{"password":"pw"}` {
+		t.Fatalf("expected the secret string, got %q: %v", got, err)
+	}
+	if got, err := aws.Get(ctx, "prod/nats#password"); err != nil || got != "pw" {
+		t.Fatalf("expected the password field, got %q: %v", got, err)
+	}
+	if _, err := aws.Get(ctx, "prod/other"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	if _, err := aws.Get(ctx, "prod/nats"); err == nil {
+		t.Fatal("expected missing credentials refused")
+	}
+}
+
+func TestGCP(t *testing.T) {
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "token")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/projects/my-project/secrets/nats/versions/latest:access":
+			w.Write([]byte(`{"payload":{"data":"` + base64.StdEncoding.EncodeToString([]byte(`{"password":"latest"}`)) + `"}}`))
+		case "/projects/my-project/secrets/nats/versions/3:access":
+			w.Write([]byte(`{"payload":{"data":"` + base64.StdEncoding.EncodeToString([]byte("third")) + `"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	gcp := NewGCP(GCPConfig{Project: "my-project", Endpoint: srv.URL})
+
+	if got, err := gcp.Get(ctx, "nats#password"); err != nil || got != "latest" {
+		t.Fatalf("expected the password field of the latest version, got %q: %v", got, err)
+	}
+	if got, err := gcp.Get(ctx, "nats@3"); err != nil || got != "third" {
+		t.Fatalf("expected version 3, got %q: %v", got, err)
+	}
+	if _, err := gcp.Get(ctx, "other"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "")
+	if _, err := NewGCP(GCPConfig{Endpoint: srv.URL}).Get(ctx, "nats"); err == nil {
+		t.Fatal("expected a missing project refused")
+	}
+}
+
+func TestResolveCache(t *testing.T) {
+	ctx := context.Background()
+	provider := &staticProvider{value: "v1"}
+	r := New(Config{})
+	r.ttl = 50 * time.Millisecond
+	r.Register("test", provider)
+
+	for i := 0; i < 3; i++ {
+		if got, err := r.Resolve(ctx, "test://key"); err != nil || got != "v1" {
+			t.Fatalf("expected v1, got %q: %v", got, err)
+		}
+	}
+	if provider.count() != 1 {
+		t.Fatalf("expected one lookup while cached, got %d", provider.count())
+	}
+
+	// Once the entry expires, the rotated value is fetched
+	provider.set("v2", nil)
+	time.Sleep(60 * time.Millisecond)
+	if got, err := r.Resolve(ctx, "test://key"); err != nil || got != "v2" {
+		t.Fatalf("expected v2 after expiry, got %q: %v", got, err)
+	}
+
+	// Failed lookups are not cached
+	provider.set("", errors.New("backend down"))
+	time.Sleep(60 * time.Millisecond)
+	if _, err := r.Resolve(ctx, "test://key"); err == nil {
+		t.Fatal("expected the failure returned")
+	}
+	provider.set("v3", nil)
+	if got, err := r.Resolve(ctx, "test://key"); err != nil || got != "v3" {
+		t.Fatalf("expected v3, got %q: %v", got, err)
+	}
+
+	// A negative TTL disables caching
+	uncached := New(Config{CacheTTL: -1})
+	uncached.Register("test", provider)
+	before := provider.count()
+	uncached.Resolve(ctx, "test://key")
+	uncached.Resolve(ctx, "test://key")
+	if provider.count()-before != 2 {
+		t.Fatalf("expected every resolve to look up, got %d lookups", provider.count()-before)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	provider := &staticProvider{value: "v1"}
+	r := New(Config{})
+	r.Register("test", provider)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan string, 4)
+	failures := make(chan error, 4)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Watch(ctx, "test://key", 10*time.Millisecond, func(value string) {
+			changes <- value
+		}, func(err error) {
+			select {
+			case failures <- err:
+			default:
+			}
+		})
+	}()
+
+	// The first value is not a change, but it is cached
+	waitFor(t, func() bool { return provider.count() > 1 })
+	select {
+	case value := <-changes:
+		t.Fatalf("expected no change for the first value, got %s", value)
+	default:
+	}
+
+	provider.set("", errors.New("backend down"))
+	select {
+	case err := <-failures:
+		if !strings.Contains(err.Error(), "backend down") {
+			t.Fatalf("unexpected failure %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the failure reported")
+	}
+
+	provider.set("v2", nil)
+	select {
+	case value := <-changes:
+		if value != "v2" {
+			t.Fatalf("expected v2, got %s", value)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the change reported")
+	}
+
+	// The watcher refreshes the cache, so resolving does not wait for the TTL
+	if got, _ := r.Resolve(context.Background(), "test://key"); got != "v2" {
+		t.Fatalf("expected the cached value updated, got %s", got)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Watch to return when the context is done")
+	}
+}
+
+// waitFor polls until the condition holds, failing the test after a second
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
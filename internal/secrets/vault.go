@@ -0,0 +1,80 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// VaultConfig configures HashiCorp Vault's KV version 2 engine. VAULT_ADDR and VAULT_TOKEN
+// are used when the address or token is not set.
+type VaultConfig struct {
+	Address string `json:"address,omitempty"`
+	Token   string `json:"token,omitempty"`
+	Mount   string `json:"mount,omitempty"` // KV engine mount, "secret" by default
+}
+
+// Vault reads secrets from Vault: vault://path#field, with the field defaulting to "value"
+type Vault struct {
+	cfg    VaultConfig
+	client *http.Client
+}
+
+// NewVault creates a Vault provider, filling in the address and token from the environment
+func NewVault(cfg VaultConfig) *Vault {
+	if cfg.Address == "" {
+		cfg.Address = os.Getenv("VAULT_ADDR")
+	}
+	if cfg.Token == "" {
+		cfg.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if cfg.Mount == "" {
+		cfg.Mount = "secret"
+	}
+	return &Vault{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Get reads the latest version of the secret at the key's path
+func (v *Vault) Get(ctx context.Context, key string) (string, error) {
+	if v.cfg.Address == "" {
+		return "", fmt.Errorf("vault address not configured")
+	}
+	path, field := splitField(key)
+	if field == "" {
+		field = "value"
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/data/%s", strings.TrimSuffix(v.cfg.Address, "/"), v.cfg.Mount, strings.TrimPrefix(path, "/"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.cfg.Token)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", fmt.Errorf("vault path %s: %w", path, ErrNotFound)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+
+	var payload struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", fmt.Errorf("failed to parse vault response: %w", err)
+	}
+	return stringField(payload.Data.Data, field)
+}
@@ -0,0 +1,128 @@
+// Package telemetry bootstraps OpenTelemetry for the binaries: it installs the global tracer
+// and meter providers, exporting over OTLP/HTTP to the collector in the telemetry config.
+// Instrumented code uses otel.Tracer and otel.Meter, which are no-ops while telemetry is off.
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/config"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// shutdownTimeout bounds flushing the last spans and metrics on exit
+const shutdownTimeout = 5 * time.Second
+
+// Telemetry holds the providers installed by Setup
+type Telemetry struct {
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+}
+
+// Setup installs the global providers for the named service. Without an endpoint it only
+// installs the W3C propagators, so trace context still flows through the binary.
+func Setup(service string, appConfig *config.AppConfig, log *logger.Logger) (*Telemetry, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	cfg := appConfig.Telemetry
+	if cfg.Endpoint == "" {
+		return &Telemetry{}, nil
+	}
+
+	ctx := context.Background()
+	res, err := newResource(ctx, service, appConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build telemetry resource: %w", err)
+	}
+
+	// An http:// endpoint URL makes the exporters skip TLS
+	traceExporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(cfg.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric exporter: %w", err)
+	}
+
+	// Spans of sampled callers are always kept, so traces crossing NATS stay complete
+	sampler := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))
+
+	interval := time.Duration(cfg.MetricInterval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	t := &Telemetry{
+		tracerProvider: sdktrace.NewTracerProvider(
+			sdktrace.WithResource(res),
+			sdktrace.WithSampler(sampler),
+			sdktrace.WithBatcher(traceExporter),
+		),
+		meterProvider: sdkmetric.NewMeterProvider(
+			sdkmetric.WithResource(res),
+			sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter, sdkmetric.WithInterval(interval))),
+		),
+	}
+	otel.SetTracerProvider(t.tracerProvider)
+	otel.SetMeterProvider(t.meterProvider)
+
+	// Export failures are reported but never stop the binary
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warn("Telemetry: %v", err)
+	}))
+
+	log.Info("Exporting traces and metrics to %s (sample ratio %g)", cfg.Endpoint, cfg.SampleRatio)
+	return t, nil
+}
+
+// newResource describes the process: service name and version, environment, host and the
+// configured attributes. OTEL_RESOURCE_ATTRIBUTES and OTEL_SERVICE_NAME take precedence.
+func newResource(ctx context.Context, service string, appConfig *config.AppConfig) (*resource.Resource, error) {
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(service),
+		semconv.ServiceVersion(version.Version),
+		semconv.DeploymentEnvironmentName(appConfig.Environment),
+	}
+	for key, value := range appConfig.Telemetry.ResourceAttributes {
+		attrs = append(attrs, attribute.String(key, value))
+	}
+
+	return resource.New(ctx,
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(attrs...),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithProcessPID(),
+		resource.WithFromEnv(),
+	)
+}
+
+// Enabled reports whether traces and metrics are exported
+func (t *Telemetry) Enabled() bool {
+	return t.tracerProvider != nil
+}
+
+// Shutdown flushes pending spans and metrics and stops the exporters
+func (t *Telemetry) Shutdown() error {
+	if !t.Enabled() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return errors.Join(t.tracerProvider.Shutdown(ctx), t.meterProvider.Shutdown(ctx))
+}
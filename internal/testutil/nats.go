@@ -0,0 +1,99 @@
+// Package testutil runs embedded NATS servers for tests that need real NATS behavior:
+// subjects, queue groups, request/reply and JetStream. Every server and connection is shut
+// down when the test ends.
+package testutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// serverReadyTimeout bounds how long StartServer waits for the server to accept connections
+const serverReadyTimeout = 5 * time.Second
+
+// Option changes the options of the server StartServer runs
+type Option func(*server.Options)
+
+// WithoutJetStream runs a core NATS server
+func WithoutJetStream() Option {
+	return func(opts *server.Options) {
+		opts.JetStream = false
+	}
+}
+
+// WithMaxPayload limits the size of messages, e.g. to test chunking
+func WithMaxPayload(size int32) Option {
+	return func(opts *server.Options) {
+		opts.MaxPayload = size
+	}
+}
+
+// WithServerOptions changes any other server option, e.g. to require authentication
+func WithServerOptions(change func(*server.Options)) Option {
+	return change
+}
+
+// StartServer runs an embedded NATS server with JetStream on a random port of 127.0.0.1,
+// storing streams in a temporary directory, and shuts it down when the test ends
+func StartServer(t testing.TB, options ...Option) *server.Server {
+	t.Helper()
+
+	opts := &server.Options{
+		Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true,
+		JetStream: true, StoreDir: t.TempDir(),
+	}
+	for _, option := range options {
+		option(opts)
+	}
+	srv, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatalf("failed to create NATS server: %v", err)
+	}
+	srv.Start()
+	t.Cleanup(srv.Shutdown)
+	if !srv.ReadyForConnections(serverReadyTimeout) {
+		t.Fatal("NATS server did not become ready")
+	}
+	return srv
+}
+
+// Connect connects to the server and closes the connection when the test ends
+func Connect(t testing.TB, srv *server.Server, options ...nats.Option) *nats.Conn {
+	t.Helper()
+
+	nc, err := nats.Connect(srv.ClientURL(), options...)
+	if err != nil {
+		t.Fatalf("failed to connect to NATS: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+// JetStream returns the JetStream context of the connection
+func JetStream(t testing.TB, nc *nats.Conn) nats.JetStreamContext {
+	t.Helper()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("failed to get JetStream context: %v", err)
+	}
+	return js
+}
+
+// AddStream creates a stream storing the subjects in memory
+func AddStream(t testing.TB, nc *nats.Conn, name string, subjects ...string) *nats.StreamInfo {
+	t.Helper()
+
+	info, err := JetStream(t, nc).AddStream(&nats.StreamConfig{
+		Name:     name,
+		Subjects: subjects,
+		Storage:  nats.MemoryStorage,
+	})
+	if err != nil {
+		t.Fatalf("failed to add stream %s: %v", name, err)
+	}
+	return info
+}
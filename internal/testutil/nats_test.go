@@ -0,0 +1,75 @@
+package testutil
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestStartServerWithJetStream(t *testing.T) {
+	srv := StartServer(t)
+	nc := Connect(t, srv, nats.Name("testutil"))
+
+	AddStream(t, nc, "ORDERS", "orders.>")
+	js := JetStream(t, nc)
+	if _, err := js.Publish("orders.new", []byte("order")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := js.StreamInfo("ORDERS")
+	if err != nil || info.State.Msgs != 1 {
+		t.Fatalf("expected the order stored, got %+v: %v", info, err)
+	}
+}
+
+func TestStartServerOptions(t *testing.T) {
+	srv := StartServer(t, WithoutJetStream(), WithMaxPayload(1024), WithServerOptions(func(opts *server.Options) {
+		opts.Authorization = "t0ken"
+	}))
+	if _, err := nats.Connect(srv.ClientURL()); err == nil {
+		t.Fatal("expected the server to require the token")
+	}
+	nc := Connect(t, srv, nats.Token("t0ken"))
+	if nc.MaxPayload() != 1024 {
+		t.Fatalf("expected a max payload of 1024, got %d", nc.MaxPayload())
+	}
+	if _, err := JetStream(t, nc).AccountInfo(); err == nil {
+		t.Fatal("expected JetStream to be disabled")
+	}
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	srv := StartServer(t, WithoutJetStream())
+	worker, client := Connect(t, srv), Connect(t, srv)
+
+	ServeTokens(t, worker, func(req *models.TokenRequest) *models.TokenResponse {
+		if req.ClientSecret != "secret" {
+			return models.NewOAuthErrorResponse("", models.ErrCodeInvalidClient, "bad credentials")
+		}
+		return models.NewTokenResponse("", "token-"+req.ClientID, "Bearer", req.Scope, 3600)
+	})
+
+	req := models.NewTokenRequest("app", "secret")
+	req.RequestID, req.Scope = "req-1", "read"
+	resp := RequestToken(t, client, req, time.Second)
+	if resp.AccessToken != "token-app" || resp.RequestID != "req-1" || resp.Scope != "read" {
+		t.Fatalf("expected a token for app, got %+v", resp)
+	}
+
+	resp = RequestToken(t, client, models.NewTokenRequest("app", "wrong"), time.Second)
+	if resp.ErrorCode != models.ErrCodeInvalidClient || resp.AccessToken != "" {
+		t.Fatalf("expected the credentials refused, got %+v", resp)
+	}
+
+	msg, err := client.Request(TokenSubject, []byte("ping"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refused models.TokenResponse
+	if err := json.Unmarshal(msg.Data, &refused); err != nil || refused.ErrorCode != models.ErrCodeInvalidRequest {
+		t.Fatalf("expected an invalid request error, got %s: %v", msg.Data, err)
+	}
+}
@@ -0,0 +1,74 @@
+package testutil
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+// Subject and queue group the token workers serve token requests on
+const (
+	TokenSubject = "token.request"
+	TokenQueue   = "token-workers"
+)
+
+// TokenIssuer answers a token request in place of a token worker and its IDP
+type TokenIssuer func(req *models.TokenRequest) *models.TokenResponse
+
+// ServeTokens answers the plain JSON token requests on TokenSubject with issue, as a member
+// of TokenQueue, until the test ends. Requests that are not valid JSON are answered with an
+// invalid_request error, like the workers do. Responses without a request ID get the one of
+// the request.
+func ServeTokens(t testing.TB, nc *nats.Conn, issue TokenIssuer) *nats.Subscription {
+	t.Helper()
+
+	sub, err := nc.QueueSubscribe(TokenSubject, TokenQueue, func(msg *nats.Msg) {
+		var req models.TokenRequest
+		var resp *models.TokenResponse
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			resp = models.NewOAuthErrorResponse("", models.ErrCodeInvalidRequest, "Invalid request format")
+		} else {
+			resp = issue(&req)
+		}
+		if resp.RequestID == "" {
+			resp.RequestID = req.RequestID
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			t.Errorf("failed to marshal token response: %v", err)
+			return
+		}
+		msg.Respond(data)
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe to %s: %v", TokenSubject, err)
+	}
+	t.Cleanup(func() { sub.Unsubscribe() })
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("failed to flush the subscription: %v", err)
+	}
+	return sub
+}
+
+// RequestToken sends a plain JSON token request on TokenSubject and returns the decoded
+// response, failing the test if none arrives within the timeout
+func RequestToken(t testing.TB, nc *nats.Conn, req *models.TokenRequest, timeout time.Duration) *models.TokenResponse {
+	t.Helper()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("failed to marshal token request: %v", err)
+	}
+	msg, err := nc.Request(TokenSubject, data, timeout)
+	if err != nil {
+		t.Fatalf("token request failed: %v", err)
+	}
+	var resp models.TokenResponse
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		t.Fatalf("invalid token response %q: %v", msg.Data, err)
+	}
+	return &resp
+}
@@ -0,0 +1,325 @@
+// Package tokenmanager serves tokens from the cache and refreshes them ahead of expiry. When a
+// cached token is looked up close to the end of its time in the cache, a background request
+// fetches its replacement, so callers keep receiving cached tokens instead of waiting for the
+// IDP. Only clients that keep asking for tokens are refreshed.
+//
+// Fetches are coalesced: concurrent cache misses and refreshes for the same credentials, scope
+// and audience share a single upstream request.
+//
+// Cached tokens are only served to callers presenting the secret they were fetched with. The
+// manager remembers a hash of that secret in memory; a token it did not fetch itself, e.g. one
+// cached in Redis by another instance, is fetched anew once, which checks the secret.
+package tokenmanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/cache"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+)
+
+// Defaults for Options
+const (
+	DefaultTTL           = 55 * time.Minute // for tokens whose response has no expires_in
+	DefaultRefreshAhead  = 0.2
+	DefaultRefreshJitter = 0.5
+	DefaultFetchTimeout  = 10 * time.Second
+)
+
+// FetchFunc obtains a new token for a request, e.g. with a NATS request to the token workers.
+// It returns an error for responses carrying an error.
+type FetchFunc func(ctx context.Context, req Request) (*models.TokenResponse, error)
+
+// Request identifies the token a client asks for. Tokens of other scopes or audiences are
+// cached apart.
+type Request struct {
+	ClientID     string
+	ClientSecret string
+	Scope        string // space-separated, the IDP's default if empty
+	Audience     string
+}
+
+// CacheKey returns the cache key of the request's token: the client ID, followed by the scope
+// and audience if either is set. Scopes are sorted, so their order does not matter.
+func (r Request) CacheKey() string {
+	if r.Scope == "" && r.Audience == "" {
+		return r.ClientID
+	}
+	scopes := strings.Fields(r.Scope)
+	sort.Strings(scopes)
+	return r.ClientID + KeySeparator + strings.Join(scopes, " ") + KeySeparator + r.Audience
+}
+
+// KeySeparator separates the client ID, scope and audience in cache keys
+const KeySeparator = "|"
+
+// Options controls how long tokens are cached and when they are refreshed
+type Options struct {
+	// Margin is subtracted from a token's lifetime when caching it; tokens expiring within
+	// the margin are not cached
+	Margin time.Duration
+	// RefreshAhead is the fraction of a token's cache TTL left when a lookup starts a
+	// background refresh, e.g. 0.2 refreshes during the last fifth; 0 disables refreshing
+	RefreshAhead float64
+	// RefreshJitter starts the refresh of each token earlier by up to this fraction of the
+	// refresh window, so tokens cached at the same time are not all refreshed at once
+	RefreshJitter float64
+	// FetchTimeout bounds each upstream fetch, DefaultFetchTimeout if zero
+	FetchTimeout time.Duration
+	// OnRefresh, if set, is called after each background refresh with its error, if any
+	OnRefresh func(err error)
+}
+
+// Manager caches tokens and refreshes them in the background. The zero value is not usable,
+// create managers with New.
+type Manager struct {
+	cache cache.Store
+	fetch FetchFunc
+	opts  Options
+	log   *logger.Logger
+
+	fetchTimeout atomic.Int64 // opts.FetchTimeout, changed by SetFetchTimeout
+
+	// ctx is cancelled by Stop, abandoning fetches in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	flights map[string]*flight // fetches in flight by flightKey
+	secrets map[string]string  // fingerprint of the secret each cached token was fetched with, by cache key
+}
+
+// flight is one upstream fetch shared by every caller asking for the same credentials
+type flight struct {
+	done     chan struct{} // closed once response and err are set
+	response *models.TokenResponse
+	err      error
+}
+
+// New creates a manager that stores tokens in c and refreshes them with fetch
+func New(c cache.Store, fetch FetchFunc, opts Options, log *logger.Logger) *Manager {
+	if opts.FetchTimeout <= 0 {
+		opts.FetchTimeout = DefaultFetchTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		cache:   c,
+		fetch:   fetch,
+		opts:    opts,
+		log:     log,
+		ctx:     ctx,
+		cancel:  cancel,
+		flights: make(map[string]*flight),
+		secrets: make(map[string]string),
+	}
+	m.fetchTimeout.Store(int64(opts.FetchTimeout))
+	return m
+}
+
+// SetFetchTimeout changes FetchTimeout for the fetches started afterwards
+func (m *Manager) SetFetchTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultFetchTimeout
+	}
+	m.fetchTimeout.Store(int64(timeout))
+}
+
+// Get returns the cached token for the request, if it was fetched with the request's secret.
+// If the token is due for a refresh, a background refresh is started with that secret; the
+// cached token is still returned.
+func (m *Manager) Get(req Request) (string, bool) {
+	key := req.CacheKey()
+	entry, found := m.cache.Lookup(key)
+
+	m.mu.Lock()
+	secret, known := m.secrets[key]
+	if !found {
+		delete(m.secrets, key)
+	}
+	m.mu.Unlock()
+	if !found || !known || secret != fingerprint(req.ClientSecret) {
+		return "", false
+	}
+	if m.due(key, entry) {
+		m.refresh(req)
+	}
+	return entry.Token, true
+}
+
+// Store caches the token of a response to the request for its lifetime minus the margin, for
+// callers with the request's secret. It returns the cache TTL, and false if the token expires
+// too soon to be cached.
+func (m *Manager) Store(req Request, response *models.TokenResponse) (time.Duration, bool) {
+	ttl := m.TTL(response)
+	if ttl <= 0 {
+		return ttl, false
+	}
+	m.set(req, response.AccessToken, ttl)
+	return ttl, true
+}
+
+// set caches the token and remembers the secret it was fetched with
+func (m *Manager) set(req Request, token string, ttl time.Duration) {
+	key := req.CacheKey()
+	m.mu.Lock()
+	m.secrets[key] = fingerprint(req.ClientSecret)
+	m.mu.Unlock()
+	m.cache.Set(key, token, ttl)
+}
+
+// TTL is how long a token may be served from the cache: its lifetime minus the margin, so
+// callers never receive a token that is about to expire, or DefaultTTL if the lifetime is unknown
+func (m *Manager) TTL(response *models.TokenResponse) time.Duration {
+	lifetime := response.Lifetime()
+	if lifetime == 0 {
+		return DefaultTTL
+	}
+	return lifetime - m.opts.Margin
+}
+
+// Stop abandons the fetches in flight and waits for them to return, or for ctx to expire.
+// Fetches after Stop fail.
+func (m *Manager) Stop(ctx context.Context) error {
+	// Under the lock, so no fetch starts once the wait below has begun
+	m.mu.Lock()
+	m.cancel()
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// due reports whether the entry has entered its refresh window. The window is RefreshAhead of
+// the cache TTL, widened by a jitter that is fixed for each stored token.
+func (m *Manager) due(key string, entry cache.Entry) bool {
+	if m.opts.RefreshAhead <= 0 {
+		return false
+	}
+	ttl := entry.ExpiresAt.Sub(entry.StoredAt)
+	window := float64(ttl) * m.opts.RefreshAhead * (1 + m.opts.RefreshJitter*jitter(key, entry.StoredAt))
+	return time.Until(entry.ExpiresAt) <= time.Duration(window)
+}
+
+// jitter returns a number in [0, 1) derived from the cache key and the time its token was
+// stored, so it is stable across lookups but differs between clients
+func jitter(key string, stored time.Time) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	h.Write([]byte(strconv.FormatInt(stored.UnixNano(), 10)))
+	return float64(h.Sum32()) / (math.MaxUint32 + 1)
+}
+
+// Fetch obtains a new token for the request and caches it. Concurrent calls for the same
+// request share one upstream request, which runs on after a caller gives up so the others, and
+// the cache, still get its token. Each caller waits until its own ctx is done.
+func (m *Manager) Fetch(ctx context.Context, req Request) (*models.TokenResponse, error) {
+	f := m.start(ctx, req)
+	select {
+	case <-f.done:
+		return f.response, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// refresh fetches a new token for the request in the background, unless a fetch for it is
+// already in flight or the manager is stopping
+func (m *Manager) refresh(req Request) {
+	m.mu.Lock()
+	_, inFlight := m.flights[flightKey(req)]
+	m.mu.Unlock()
+	if inFlight || m.ctx.Err() != nil {
+		return
+	}
+
+	m.log.Debug("Refreshing token for client ID: %s", req.ClientID)
+	f := m.start(context.Background(), req)
+	go func() {
+		<-f.done
+		if f.err != nil {
+			// The current token stays cached until it expires; the next lookup tries again
+			m.log.Warn("Failed to refresh token for client ID %s: %v", req.ClientID, f.err)
+		}
+		if m.opts.OnRefresh != nil {
+			m.opts.OnRefresh(f.err)
+		}
+	}()
+}
+
+// start joins the fetch in flight for the request, or starts one. The fetch keeps the values
+// of ctx, such as the trace, but not its cancellation: it ends with FetchTimeout or Stop.
+func (m *Manager) start(ctx context.Context, req Request) *flight {
+	key := flightKey(req)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.flights[key]; ok {
+		return f
+	}
+	f := &flight{done: make(chan struct{})}
+	if err := m.ctx.Err(); err != nil {
+		f.err = err
+		close(f.done)
+		return f
+	}
+	m.flights[key] = f
+	m.wg.Add(1)
+
+	go func() {
+		defer m.wg.Done()
+
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Duration(m.fetchTimeout.Load()))
+		defer cancel()
+		stop := context.AfterFunc(m.ctx, cancel)
+		defer stop()
+
+		f.response, f.err = m.fetch(fetchCtx, req)
+		if f.err == nil {
+			if ttl, ok := m.Store(req, f.response); ok {
+				m.log.Info("Token cached for client ID: %s for %s", req.ClientID, ttl)
+			} else {
+				m.log.Warn("Not caching token for client ID %s: it expires in %ds, within the cache margin",
+					req.ClientID, f.response.ExpiresIn)
+			}
+		}
+
+		m.mu.Lock()
+		delete(m.flights, key)
+		m.mu.Unlock()
+		close(f.done)
+	}()
+	return f
+}
+
+// flightKey identifies fetches that may be shared. The secret is part of it, so a caller with
+// the wrong secret never joins the fetch of the right one; Get checks it for cached tokens.
+func flightKey(req Request) string {
+	return req.CacheKey() + "\x00" + fingerprint(req.ClientSecret)
+}
+
+// fingerprint hashes a client secret, so the manager does not keep secrets in memory
+func fingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
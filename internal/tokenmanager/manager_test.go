@@ -0,0 +1,244 @@
+package tokenmanager
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/cache"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+)
+
+// clientA asks for a token of the IDP's default scope
+var clientA = Request{ClientID: "client-a", ClientSecret: "secret"}
+
+// newTestManager returns a manager whose fetches block until release is closed
+func newTestManager(t *testing.T, opts Options) (*Manager, *atomic.Int64, chan struct{}) {
+	t.Helper()
+
+	var fetches atomic.Int64
+	release := make(chan struct{})
+	fetch := func(ctx context.Context, req Request) (*models.TokenResponse, error) {
+		fetches.Add(1)
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return models.NewTokenResponse("", "refreshed-"+req.CacheKey(), "Bearer", "", 3600), nil
+	}
+
+	m := New(cache.NewTokenCache(), fetch, opts, logger.NewLogger("test", logger.ERROR, io.Discard))
+	t.Cleanup(func() { m.Stop(context.Background()) })
+	return m, &fetches, release
+}
+
+func TestConcurrentLookupsStartOneRefresh(t *testing.T) {
+	m, fetches, release := newTestManager(t, Options{RefreshAhead: 1})
+	m.set(clientA, "old", time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, ok := m.Get(clientA); !ok || token != "old" {
+				t.Errorf("expected the cached token while refreshing, got %q, %v", token, ok)
+			}
+		}()
+	}
+	wg.Wait()
+	close(release)
+	m.Stop(context.Background())
+
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("expected 1 refresh, got %d", n)
+	}
+	if token, _ := m.Get(clientA); token != "refreshed-client-a" {
+		t.Fatalf("expected the refreshed token, got %q", token)
+	}
+}
+
+func TestConcurrentFetchesShareOneRequest(t *testing.T) {
+	m, fetches, release := newTestManager(t, Options{})
+
+	const n = 50
+	tokens := make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			response, err := m.Fetch(context.Background(), clientA)
+			if err != nil {
+				t.Errorf("fetch %d failed: %v", i, err)
+				return
+			}
+			tokens[i] = response.AccessToken
+		}(i)
+	}
+	// Let every caller join before the fetch completes
+	for fetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("expected 1 upstream fetch for %d callers, got %d", n, got)
+	}
+	for i, token := range tokens {
+		if token != "refreshed-client-a" {
+			t.Fatalf("caller %d got %q", i, token)
+		}
+	}
+	if token, ok := m.Get(clientA); !ok || token != "refreshed-client-a" {
+		t.Fatalf("expected the fetched token to be cached, got %q, %v", token, ok)
+	}
+}
+
+func TestFetchesWithDifferentSecretsAreNotShared(t *testing.T) {
+	m, fetches, release := newTestManager(t, Options{})
+	close(release)
+
+	var wg sync.WaitGroup
+	for _, secret := range []string{"right", "wrong"} {
+		wg.Add(1)
+		go func(secret string) {
+			defer wg.Done()
+			m.Fetch(context.Background(), Request{ClientID: "client-a", ClientSecret: secret})
+		}(secret)
+	}
+	wg.Wait()
+
+	if got := fetches.Load(); got != 2 {
+		t.Fatalf("expected a fetch per secret, got %d", got)
+	}
+}
+
+func TestCallerGivingUpDoesNotAbortSharedFetch(t *testing.T) {
+	m, fetches, release := newTestManager(t, Options{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := m.Fetch(ctx, clientA)
+		first <- err
+	}()
+	for fetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan error, 1)
+	go func() {
+		_, err := m.Fetch(context.Background(), clientA)
+		second <- err
+	}()
+
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Fatalf("expected the first caller to give up, got %v", err)
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Fatalf("expected the second caller to get the token, got %v", err)
+	}
+}
+
+func TestScopesAndAudiencesAreCachedApart(t *testing.T) {
+	m, fetches, release := newTestManager(t, Options{})
+	close(release)
+
+	scoped := Request{ClientID: "client-a", ClientSecret: "secret", Scope: "orders:write orders:read"}
+	for _, req := range []Request{clientA, scoped, {ClientID: "client-a", ClientSecret: "secret", Audience: "billing"}} {
+		if _, err := m.Fetch(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := fetches.Load(); got != 3 {
+		t.Fatalf("expected a fetch per scope and audience, got %d", got)
+	}
+
+	// The order of the scopes does not matter
+	reordered := scoped
+	reordered.Scope = "orders:read  orders:write"
+	if reordered.CacheKey() != scoped.CacheKey() {
+		t.Fatalf("expected %q and %q to share a key", reordered.CacheKey(), scoped.CacheKey())
+	}
+	if token, ok := m.Get(reordered); !ok || token != "refreshed-client-a|orders:read orders:write|" {
+		t.Fatalf("expected the scoped token, got %q, %v", token, ok)
+	}
+	if token, ok := m.Get(clientA); !ok || token != "refreshed-client-a" {
+		t.Fatalf("expected the default scope's token under the client ID, got %q, %v", token, ok)
+	}
+}
+
+func TestCachedTokensNeedTheirSecret(t *testing.T) {
+	m, fetches, release := newTestManager(t, Options{RefreshAhead: 1})
+	close(release)
+	m.set(clientA, "cached", time.Hour)
+
+	wrongSecret := Request{ClientID: "client-a", ClientSecret: "guess"}
+	if token, ok := m.Get(wrongSecret); ok {
+		t.Fatalf("expected a miss with the wrong secret, got %q", token)
+	}
+
+	// Tokens cached by someone else, e.g. another instance sharing Redis, are fetched anew
+	m.cache.Set("client-b", "shared", time.Hour)
+	if token, ok := m.Get(Request{ClientID: "client-b", ClientSecret: "secret"}); ok {
+		t.Fatalf("expected a miss for a token this manager did not fetch, got %q", token)
+	}
+	m.Stop(context.Background())
+	if n := fetches.Load(); n != 0 {
+		t.Fatalf("expected misses not to refresh, got %d refreshes", n)
+	}
+	if token, ok := m.Get(clientA); !ok || token != "cached" {
+		t.Fatalf("expected the cached token with the right secret, got %q, %v", token, ok)
+	}
+}
+
+func TestNoRefreshOutsideWindow(t *testing.T) {
+	m, fetches, release := newTestManager(t, Options{RefreshAhead: 0.2, RefreshJitter: 0.5})
+	close(release)
+	m.set(clientA, "fresh", time.Hour)
+
+	m.Get(clientA)
+	m.Stop(context.Background())
+	if n := fetches.Load(); n != 0 {
+		t.Fatalf("a fresh token must not be refreshed, got %d refreshes", n)
+	}
+}
+
+func TestTTLSubtractsMargin(t *testing.T) {
+	m, _, _ := newTestManager(t, Options{Margin: time.Minute})
+
+	for _, tc := range []struct {
+		expiresIn int
+		want      time.Duration
+	}{
+		{3600, 59 * time.Minute},
+		{30, -30 * time.Second},
+		{0, DefaultTTL},
+	} {
+		if got := m.TTL(&models.TokenResponse{ExpiresIn: tc.expiresIn}); got != tc.want {
+			t.Errorf("TTL(expires_in=%d) = %s, want %s", tc.expiresIn, got, tc.want)
+		}
+	}
+}
+
+func TestJitterIsStableAndInRange(t *testing.T) {
+	stored := time.Now()
+	for _, client := range []string{"a", "b", "client-c", ""} {
+		j := jitter(client, stored)
+		if j < 0 || j >= 1 {
+			t.Fatalf("jitter(%q) = %f, want [0, 1)", client, j)
+		}
+		if j != jitter(client, stored) {
+			t.Fatalf("jitter(%q) changed between calls", client)
+		}
+	}
+}
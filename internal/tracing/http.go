@@ -0,0 +1,88 @@
+package tracing
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/kiquetal/nats-go-examples/internal/httputil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Handler wraps next with a server span per request, continuing the caller's trace. Spans
+// are named after the ServeMux pattern that matched, e.g. "POST /token".
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := Tracer().Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		rec := httputil.NewStatusRecorder(w)
+		r = r.WithContext(ctx)
+		next.ServeHTTP(rec, r)
+
+		if r.Pattern != "" {
+			span.SetName(r.Method + " " + r.Pattern)
+			span.SetAttributes(semconv.HTTPRoute(r.Pattern))
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.Status()))
+		if rec.Status() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.Status()))
+		}
+	})
+}
+
+// Transport wraps base, http.DefaultTransport if nil, with a client span per outbound
+// request and injects the trace context into the request headers
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return roundTripper{base: base}
+}
+
+type roundTripper struct {
+	base http.RoundTripper
+}
+
+// RoundTrip sends the request inside a client span
+func (t roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	attrs := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLFull(req.URL.Redacted()),
+			semconv.ServerAddress(req.URL.Hostname()),
+		),
+	}
+	if port, err := strconv.Atoi(req.URL.Port()); err == nil {
+		attrs = append(attrs, trace.WithAttributes(semconv.ServerPort(port)))
+	}
+	ctx, span := Tracer().Start(req.Context(), req.Method, attrs...)
+	defer span.End()
+
+	// RoundTrippers must not modify the caller's request
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		Fail(span, err)
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", resp.StatusCode))
+	}
+	return resp, nil
+}
@@ -0,0 +1,129 @@
+// Package tracing follows a request across the binaries with OpenTelemetry spans: from an
+// HTTP handler through NATS requests into the handlers of other services and their outbound
+// HTTP calls. Trace context travels as W3C traceparent in HTTP and NATS message headers,
+// using the propagators installed by telemetry.Setup. Spans are no-ops unless telemetry
+// exports to a collector.
+package tracing
+
+import (
+	"context"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the spans created by this module
+const instrumentationName = "github.com/kiquetal/nats-go-examples"
+
+// Tracer returns the tracer used for the module's spans
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// HeaderCarrier lets the propagators read and write trace context in NATS headers
+type HeaderCarrier nats.Header
+
+// Get returns the first value of the header
+func (c HeaderCarrier) Get(key string) string {
+	return nats.Header(c).Get(key)
+}
+
+// Set replaces the header
+func (c HeaderCarrier) Set(key, value string) {
+	nats.Header(c).Set(key, value)
+}
+
+// Keys lists the header names
+func (c HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Inject writes the trace context of ctx into the message headers
+func Inject(ctx context.Context, msg *nats.Msg) {
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, HeaderCarrier(msg.Header))
+}
+
+// Extract returns ctx carrying the trace context found in the message headers
+func Extract(ctx context.Context, msg *nats.Msg) context.Context {
+	if msg.Header == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, HeaderCarrier(msg.Header))
+}
+
+// StartRequest starts a client span for a NATS request and injects it into the message, so
+// the responder's span becomes its child. End the span once the reply arrives.
+func StartRequest(ctx context.Context, msg *nats.Msg) (context.Context, trace.Span) {
+	ctx, span := Tracer().Start(ctx, "send "+msg.Subject,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("nats"),
+			semconv.MessagingDestinationName(msg.Subject),
+			semconv.MessagingOperationTypeSend,
+			semconv.MessagingMessageBodySize(len(msg.Data)),
+		),
+	)
+	Inject(ctx, msg)
+	return ctx, span
+}
+
+// StartHandler starts a server span for handling a NATS request, continuing the trace of
+// the requester when the message carries one
+func StartHandler(ctx context.Context, msg *nats.Msg) (context.Context, trace.Span) {
+	return Tracer().Start(Extract(ctx, msg), "process "+msg.Subject,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("nats"),
+			semconv.MessagingDestinationName(msg.Subject),
+			semconv.MessagingOperationTypeProcess,
+			semconv.MessagingMessageBodySize(len(msg.Data)),
+		),
+	)
+}
+
+// Fail records err on the span and marks it failed
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Middleware starts a server span around each message a subscriber handles, continuing the
+// trace of its publisher. The span's context replaces the trace context in the message
+// headers, so requests the handler sends with them become its children.
+func Middleware() pubsub.Middleware {
+	return func(next pubsub.MessageHandler) pubsub.MessageHandler {
+		return func(msg *models.Message) error {
+			carrier := &nats.Msg{Subject: msg.Subject, Header: nats.Header(msg.Headers)}
+			ctx, span := Tracer().Start(Extract(context.Background(), carrier), "process "+msg.Subject,
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithAttributes(
+					semconv.MessagingSystemKey.String("nats"),
+					semconv.MessagingDestinationName(msg.Subject),
+					semconv.MessagingOperationTypeProcess,
+					semconv.MessagingMessageID(msg.ID),
+				),
+			)
+			defer span.End()
+			Inject(ctx, carrier)
+			msg.Headers = carrier.Header
+
+			err := next(msg)
+			if err != nil {
+				Fail(span, err)
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Package version exposes build information set at link time, e.g.
+//
+//	go build -ldflags "-X github.com/kiquetal/nats-go-examples/internal/version.Version=v1.2.0 \
+//	  -X github.com/kiquetal/nats-go-examples/internal/version.Commit=$(git rev-parse --short HEAD) \
+//	  -X github.com/kiquetal/nats-go-examples/internal/version.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+package version
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, overridden with -ldflags "-X ..."
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// Info is the build information of the running binary
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build information, falling back to the VCS details the Go toolchain
+// embeds when the binary was built without ldflags
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" && len(setting.Value) >= 7 {
+					info.Commit = setting.Value[:7]
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			}
+		}
+	}
+
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+// String returns a one-line description of the build
+func String() string {
+	info := Get()
+	return fmt.Sprintf("%s (commit %s, built %s, %s)", info.Version, info.Commit, info.BuildDate, info.GoVersion)
+}
+
+// ClientName returns a NATS client name that includes the version, so connections
+// listed by the server or the monitor show what is running
+func ClientName(name string) string {
+	return name + "/" + Version
+}
+
+// Metadata returns the build information as string pairs, e.g. for micro service metadata
+func Metadata() map[string]string {
+	info := Get()
+	return map[string]string{
+		"version":    info.Version,
+		"commit":     info.Commit,
+		"build_date": info.BuildDate,
+		"go_version": info.GoVersion,
+	}
+}
+
+// Handler serves the build information as JSON, for /healthz endpoints
+func Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Status string `json:"status"`
+			Info
+		}{Status: "ok", Info: Get()})
+	}
+}
+
+// versionFlag prints the version and exits as soon as it is set, like -help
+type versionFlag struct{}
+
+func (versionFlag) String() string   { return "false" }
+func (versionFlag) IsBoolFlag() bool { return true }
+
+func (versionFlag) Set(value string) error {
+	if value != "true" {
+		return nil
+	}
+	fmt.Printf("%s %s\n", filepath.Base(os.Args[0]), String())
+	os.Exit(0)
+	return nil
+}
+
+// RegisterFlag adds a -version flag to the flag set
+func RegisterFlag(fs *flag.FlagSet) {
+	fs.Var(versionFlag{}, "version", "Print version information and exit")
+}
@@ -0,0 +1,55 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/kiquetal/nats-go-examples/internal/idp"
+)
+
+// IDPClient is the part of *idp.Client the worker uses, so tests can stand in for an IDP
+type IDPClient interface {
+	BaseURL() string
+	GetTokenWithClientCredentialsCtx(ctx context.Context, credentials *idp.ClientCredentials) (*idp.TokenResponse, error)
+	GetTokenWithPassword(ctx context.Context, credentials *idp.ClientCredentials, username, password string) (*idp.TokenResponse, error)
+	GetTokenWithRefreshToken(ctx context.Context, credentials *idp.ClientCredentials, refreshToken string) (*idp.TokenResponse, error)
+	ExchangeToken(ctx context.Context, credentials *idp.ClientCredentials, exchange *idp.TokenExchange) (*idp.TokenResponse, error)
+	Introspect(ctx context.Context, credentials *idp.ClientCredentials, token, hint string) (*idp.Introspection, error)
+	Revoke(ctx context.Context, credentials *idp.ClientCredentials, token, hint string) error
+}
+
+var _ IDPClient = (*idp.Client)(nil)
+
+// Realms holds the client of the default IDP and those of the configured realms, which
+// requests pick by name
+type Realms struct {
+	Default IDPClient
+	ByName  map[string]IDPClient
+}
+
+// Client returns the client of a realm, the default IDP's for the empty realm. Unknown realms
+// are refused with invalid_request, without calling any IDP.
+func (r *Realms) Client(realm string) (IDPClient, error) {
+	if realm == "" {
+		return r.Default, nil
+	}
+	client, ok := r.ByName[realm]
+	if !ok {
+		return nil, &idp.Error{
+			Code:        idp.ErrCodeInvalidRequest,
+			Description: fmt.Sprintf("realm %q is not configured", realm),
+		}
+	}
+	return client, nil
+}
+
+// Names returns the configured realm names, sorted
+func (r *Realms) Names() []string {
+	names := make([]string, 0, len(r.ByName))
+	for name := range r.ByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,214 @@
+// Package worker obtains tokens from identity providers for token requests. It is the token
+// worker without NATS: cmd/token-worker receives the requests, checks their signatures and
+// sends the replies, and a Service does the rest, so it can be tested against a fake IDP.
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/credentials"
+	"github.com/kiquetal/nats-go-examples/internal/idp"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+)
+
+// DefaultScope is requested for client credentials when the request names no scope
+const DefaultScope = "openid profile"
+
+// Stages of a token request an Error reports
+const (
+	StageCredentials = "credentials" // looking up the client's secret
+	StageIDP         = "idp"         // calling the IDP
+)
+
+// Error is a token request that failed at Stage. Err is usually an *idp.Error, whose code
+// ErrorCode returns for the requester.
+type Error struct {
+	Stage string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// signerKey is the context key of the key a request's signature was verified with
+type signerKey struct{}
+
+// WithSigner returns a context for a request whose signature was verified with the public key
+// signer. Only such requests are given stored client secrets.
+func WithSigner(ctx context.Context, signer string) context.Context {
+	return context.WithValue(ctx, signerKey{}, signer)
+}
+
+// Config configures a Service
+type Config struct {
+	Realms *Realms
+	// Credentials supplies the secrets of signed requests sent without one, e.g. by brain-app in
+	// the reference mode; without it, or with no stored client, requests go to the IDP as they are
+	Credentials *credentials.Store
+	Log         *logger.Logger
+	// OnIDPCall, if set, is called after every IDP token call, e.g. to observe its latency
+	OnIDPCall func(start time.Time, err error)
+}
+
+// Service handles token requests. Its realms and credentials can be replaced while it
+// serves requests, e.g. when the config is reloaded; requests already started finish with
+// the previous ones.
+type Service struct {
+	realms    atomic.Pointer[Realms]
+	store     atomic.Pointer[credentials.Store]
+	log       *logger.Logger
+	onIDPCall func(start time.Time, err error)
+}
+
+// NewService creates a service for the config
+func NewService(cfg Config) *Service {
+	s := &Service{log: cfg.Log, onIDPCall: cfg.OnIDPCall}
+	s.realms.Store(cfg.Realms)
+	s.store.Store(cfg.Credentials)
+	return s
+}
+
+// Realms returns the current IDP clients, e.g. for introspection requests
+func (s *Service) Realms() *Realms {
+	return s.realms.Load()
+}
+
+// SetRealms replaces the IDP clients
+func (s *Service) SetRealms(realms *Realms) {
+	s.realms.Store(realms)
+}
+
+// SetCredentials replaces the credential store, nil to send requests as they are
+func (s *Service) SetCredentials(store *credentials.Store) {
+	s.store.Store(store)
+}
+
+// ProcessRequest obtains a token from the IDP of the request's realm with the request's grant,
+// client credentials by default, and returns the response for the requester. Failures are
+// returned as an *Error; the request's RequestID is the one of the response.
+func (s *Service) ProcessRequest(ctx context.Context, request *models.TokenRequest) (*models.TokenResponse, error) {
+	log := s.log.With("request_id", request.RequestID, "client_id", request.ClientID)
+	if request.Realm != "" {
+		log = log.With("realm", request.Realm)
+	}
+
+	// Requests in the reference mode leave the secret to the workers' credential store
+	if err := s.complete(ctx, request); err != nil {
+		log.Error("Failed to look up the client's credentials: %v", err)
+		return nil, &Error{Stage: StageCredentials, Err: err}
+	}
+
+	start := time.Now()
+	tokenResp, err := s.obtainToken(ctx, request)
+	if s.onIDPCall != nil {
+		s.onIDPCall(start, err)
+	}
+	if err != nil {
+		log.Error("Failed to obtain token: %v", err)
+		return nil, &Error{Stage: StageIDP, Err: err}
+	}
+	log.Info("Token obtained for client ID: %s", request.ClientID)
+
+	response := models.NewTokenResponse(
+		request.RequestID,
+		tokenResp.AccessToken,
+		tokenResp.TokenType,
+		tokenResp.Scope,
+		tokenResp.ExpiresIn,
+	)
+	response.RefreshToken = tokenResp.RefreshToken
+	response.IssuedTokenType = tokenResp.IssuedTokenType
+	return response, nil
+}
+
+// complete fills in the client secret of a signed request sent without one, from the secret
+// stored under its credential reference or client ID. Unsigned requests are refused with
+// unauthorized_client and clients without a stored secret with invalid_client; without any
+// stored client, requests go to the IDP as they are.
+func (s *Service) complete(ctx context.Context, request *models.TokenRequest) error {
+	store := s.store.Load()
+	if request.ClientSecret != "" || store == nil || store.Len() == 0 {
+		return nil
+	}
+	if signer, _ := ctx.Value(signerKey{}).(string); signer == "" {
+		return &idp.Error{
+			Code:        idp.ErrCodeUnauthorizedClient,
+			Description: "stored client secrets are only used for signed requests",
+		}
+	}
+	name := request.CredentialRef
+	if name == "" {
+		name = request.ClientID
+	}
+	secret, err := store.Secret(ctx, name)
+	if errors.Is(err, credentials.ErrUnknownClient) {
+		return &idp.Error{Code: idp.ErrCodeInvalidClient, Description: err.Error()}
+	}
+	if err != nil {
+		return &idp.Error{Code: models.ErrCodeInternal, Description: err.Error()}
+	}
+	request.ClientSecret = secret
+	return nil
+}
+
+// obtainToken asks the IDP of the request's realm for a token with the request's grant
+func (s *Service) obtainToken(ctx context.Context, request *models.TokenRequest) (*idp.TokenResponse, error) {
+	idpClient, err := s.realms.Load().Client(request.Realm)
+	if err != nil {
+		return nil, err
+	}
+	credentials := &idp.ClientCredentials{
+		ClientID:     request.ClientID,
+		ClientSecret: request.ClientSecret,
+		Scope:        request.Scope,
+		Audience:     request.Audience,
+	}
+
+	switch request.GrantType {
+	case "", models.GrantClientCredentials:
+		if credentials.Scope == "" {
+			credentials.Scope = DefaultScope
+		}
+		return idpClient.GetTokenWithClientCredentialsCtx(ctx, credentials)
+	case models.GrantPassword:
+		return idpClient.GetTokenWithPassword(ctx, credentials, request.Username, request.Password)
+	case models.GrantRefreshToken:
+		return idpClient.GetTokenWithRefreshToken(ctx, credentials, request.RefreshToken)
+	case models.GrantTokenExchange:
+		return idpClient.ExchangeToken(ctx, credentials, &idp.TokenExchange{
+			SubjectToken:       request.SubjectToken,
+			SubjectTokenType:   request.SubjectTokenType,
+			Audience:           request.Audience,
+			RequestedTokenType: request.RequestedTokenType,
+		})
+	}
+	return nil, &idp.Error{
+		Code:        idp.ErrCodeUnsupportedGrantType,
+		Description: fmt.Sprintf("grant type %q is not supported", request.GrantType),
+	}
+}
+
+// ErrorCode returns the code of a failed IDP request for the requester: rate_limited when the
+// IDP throttled it, idp_unavailable when the IDP could not be reached, and the IDP's OAuth
+// code otherwise
+func ErrorCode(err error) string {
+	var idpErr *idp.Error
+	switch {
+	case !errors.As(err, &idpErr):
+		return models.ErrCodeIDPUnavailable
+	case idpErr.StatusCode == http.StatusTooManyRequests:
+		return models.ErrCodeRateLimited
+	}
+	return idpErr.Code
+}
@@ -0,0 +1,123 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/credentials"
+	"github.com/kiquetal/nats-go-examples/internal/idp"
+	"github.com/kiquetal/nats-go-examples/internal/idp/idptest"
+	"github.com/kiquetal/nats-go-examples/internal/logger"
+	"github.com/kiquetal/nats-go-examples/internal/secrets"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+)
+
+func newTestService(t *testing.T, cfg idptest.Config) (*Service, *idptest.Server) {
+	t.Helper()
+	srv := idptest.NewServer(t, cfg)
+	client := idp.NewClient(srv.URL, idp.WithTokenEndpoint(srv.TokenPath()))
+	service := NewService(Config{
+		Realms: &Realms{Default: client, ByName: map[string]IDPClient{"test": client}},
+		Log:    logger.NewLogger("test", logger.ERROR, io.Discard),
+	})
+	return service, srv
+}
+
+func TestProcessRequest(t *testing.T) {
+	service, _ := newTestService(t, idptest.Config{Clients: map[string]string{"app": "secret"}})
+	ctx := context.Background()
+
+	request := models.NewTokenRequest("app", "secret")
+	response, err := service.ProcessRequest(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.RequestID != request.RequestID || response.AccessToken == "" || response.Scope != DefaultScope {
+		t.Fatalf("unexpected response %+v", response)
+	}
+
+	// The refresh token of the response gets a new token from the realm's IDP
+	refresh := models.NewTokenRequest("app", "secret")
+	refresh.GrantType = models.GrantRefreshToken
+	refresh.RefreshToken = response.RefreshToken
+	refresh.Realm = "test"
+	if refreshed, err := service.ProcessRequest(ctx, refresh); err != nil || refreshed.AccessToken == "" {
+		t.Fatalf("expected a refreshed token, got %+v: %v", refreshed, err)
+	}
+}
+
+func TestProcessRequestFailures(t *testing.T) {
+	service, srv := newTestService(t, idptest.Config{})
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		request func(*models.TokenRequest)
+		stage   string
+		code    string
+	}{
+		{"unknown realm", func(r *models.TokenRequest) { r.Realm = "other" }, StageIDP, idp.ErrCodeInvalidRequest},
+		{"unsupported grant", func(r *models.TokenRequest) { r.GrantType = "implicit" }, StageIDP, idp.ErrCodeUnsupportedGrantType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := models.NewTokenRequest("app", "secret")
+			tt.request(request)
+			_, err := service.ProcessRequest(ctx, request)
+			var failed *Error
+			if !errors.As(err, &failed) || failed.Stage != tt.stage || ErrorCode(err) != tt.code {
+				t.Fatalf("expected %s at stage %s, got %v", tt.code, tt.stage, err)
+			}
+		})
+	}
+	if srv.TokenRequests() != 0 {
+		t.Fatalf("expected no token requests, got %d", srv.TokenRequests())
+	}
+
+	// Throttled and failing IDPs are reported with the worker's codes
+	srv.SetFailures(1, http.StatusTooManyRequests)
+	if _, err := service.ProcessRequest(ctx, models.NewTokenRequest("app", "secret")); ErrorCode(err) != models.ErrCodeRateLimited {
+		t.Fatalf("expected %s, got %v", models.ErrCodeRateLimited, err)
+	}
+	srv.Close()
+	if _, err := service.ProcessRequest(ctx, models.NewTokenRequest("app", "secret")); ErrorCode(err) != models.ErrCodeIDPUnavailable {
+		t.Fatalf("expected %s, got %v", models.ErrCodeIDPUnavailable, err)
+	}
+}
+
+func TestProcessRequestCredentials(t *testing.T) {
+	service, _ := newTestService(t, idptest.Config{Clients: map[string]string{"app": "secret"}})
+	ctx := context.Background()
+
+	var calls int
+	service.onIDPCall = func(start time.Time, err error) {
+		calls++
+	}
+	service.SetCredentials(credentials.NewStore(map[string]string{"app": "secret"}, secrets.New(secrets.Config{})))
+
+	// Unsigned requests are not given stored secrets
+	_, err := service.ProcessRequest(ctx, models.NewTokenRequest("app", ""))
+	var failed *Error
+	if !errors.As(err, &failed) || failed.Stage != StageCredentials || ErrorCode(err) != idp.ErrCodeUnauthorizedClient {
+		t.Fatalf("expected unauthorized_client at the credentials stage, got %v", err)
+	}
+
+	// Signed requests without a secret get the stored one
+	signed := WithSigner(ctx, "UCCNUYYHYD4S6B6IQQ2CHX3RAGYIYELNKWBR3BOWZ5HGPSGTIB2OJKHZ")
+	if _, err := service.ProcessRequest(signed, models.NewTokenRequest("app", "")); err != nil {
+		t.Fatalf("expected the stored secret used, got %v", err)
+	}
+
+	// Clients without a stored secret are refused before calling the IDP
+	_, err = service.ProcessRequest(signed, models.NewTokenRequest("other", ""))
+	if !errors.As(err, &failed) || failed.Stage != StageCredentials || ErrorCode(err) != idp.ErrCodeInvalidClient {
+		t.Fatalf("expected invalid_client at the credentials stage, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 IDP call, got %d", calls)
+	}
+}
@@ -0,0 +1,146 @@
+// Package kvstore wraps JetStream key-value buckets with the operations the examples share:
+// opening a bucket that may not exist yet, storing JSON values, read-modify-write updates that
+// hold up against concurrent writers, and watching keys until a context ends
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultUpdateAttempts is how often Update tries to write before giving up on a busy key
+const DefaultUpdateAttempts = 5
+
+// ErrConflict is returned by Update when other writers kept changing the key
+var ErrConflict = errors.New("key kept changing during the update")
+
+// Open binds to a bucket, creating it with cfg on first use. An existing bucket keeps its
+// own configuration.
+func Open(js nats.JetStreamContext, cfg nats.KeyValueConfig) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(cfg.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bucket %s: %w", cfg.Bucket, err)
+	}
+	return kv, nil
+}
+
+// GetJSON decodes the value of a key into value and returns its revision. Missing and deleted
+// keys return nats.ErrKeyNotFound.
+func GetJSON(kv nats.KeyValue, key string, value interface{}) (uint64, error) {
+	entry, err := kv.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(entry.Value(), value); err != nil {
+		return entry.Revision(), fmt.Errorf("malformed value of %s: %w", key, err)
+	}
+	return entry.Revision(), nil
+}
+
+// PutJSON stores value as JSON and returns the new revision
+func PutJSON(kv nats.KeyValue, key string, value interface{}) (uint64, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return 0, err
+	}
+	revision, err := kv.Put(key, data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store %s in %s: %w", key, kv.Bucket(), err)
+	}
+	return revision, nil
+}
+
+// Update replaces the value of a key with what change makes of it, nil for a missing key. The
+// write only succeeds if nobody changed the key since it was read; otherwise change runs again
+// on the new value, up to attempts times. An error from change is returned without writing.
+func Update(kv nats.KeyValue, key string, attempts int, change func(current []byte) ([]byte, error)) (uint64, error) {
+	if attempts <= 0 {
+		attempts = DefaultUpdateAttempts
+	}
+	for attempt := 0; attempt < attempts; attempt++ {
+		var current []byte
+		var revision uint64
+		entry, err := kv.Get(key)
+		switch {
+		case err == nil:
+			current, revision = entry.Value(), entry.Revision()
+		case !errors.Is(err, nats.ErrKeyNotFound):
+			return 0, err
+		}
+
+		data, err := change(current)
+		if err != nil {
+			return 0, err
+		}
+
+		if revision == 0 {
+			revision, err = kv.Create(key, data)
+		} else {
+			revision, err = kv.Update(key, data, revision)
+		}
+		if !IsConflict(err) {
+			return revision, err
+		}
+	}
+	return 0, fmt.Errorf("%w: %s after %d attempts", ErrConflict, key, attempts)
+}
+
+// IsConflict reports whether a write failed because another writer changed the key first:
+// Create found the key exists, or Update expected an older revision
+func IsConflict(err error) bool {
+	if errors.Is(err, nats.ErrKeyExists) {
+		return true
+	}
+	var apiErr *nats.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == nats.JSErrCodeStreamWrongLastSequence
+}
+
+// Keys returns the keys in the bucket, sorted; an empty bucket has none
+func Keys(kv nats.KeyValue) ([]string, error) {
+	keys, err := kv.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Watch passes the current values of the keys matching pattern, then every change to them, to
+// onEntry until ctx is done. onReady, if not nil, is called once the current values are through.
+func Watch(ctx context.Context, kv nats.KeyValue, pattern string, onReady func(), onEntry func(nats.KeyValueEntry)) error {
+	watcher, err := kv.Watch(pattern)
+	if err != nil {
+		return fmt.Errorf("failed to watch %s in %s: %w", pattern, kv.Bucket(), err)
+	}
+	defer watcher.Stop()
+
+	for {
+		select {
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				return nil
+			}
+			// A nil entry marks the end of the current values
+			if entry == nil {
+				if onReady != nil {
+					onReady()
+				}
+				continue
+			}
+			onEntry(entry)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/testutil"
+	"github.com/nats-io/nats.go"
+)
+
+// openTestBucket runs an embedded NATS server with JetStream and opens a bucket on it
+func openTestBucket(t *testing.T) nats.KeyValue {
+	t.Helper()
+	js := testutil.JetStream(t, testutil.Connect(t, testutil.StartServer(t)))
+
+	kv, err := Open(js, nats.KeyValueConfig{Bucket: "test", History: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Opening again binds to the same bucket
+	if _, err := Open(js, nats.KeyValueConfig{Bucket: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+func TestJSONValues(t *testing.T) {
+	kv := openTestBucket(t)
+
+	type record struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	revision, err := PutJSON(kv, "a", record{Name: "a", Count: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got record
+	if read, err := GetJSON(kv, "a", &got); err != nil || read != revision || got != (record{Name: "a", Count: 1}) {
+		t.Fatalf("expected the record at revision %d, got %+v at %d: %v", revision, got, read, err)
+	}
+
+	if _, err := GetJSON(kv, "missing", &got); !errors.Is(err, nats.ErrKeyNotFound) {
+		t.Fatalf("expected a missing key, got %v", err)
+	}
+	if _, err := kv.Put("b", []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetJSON(kv, "b", &got); err == nil {
+		t.Fatal("expected a malformed value to fail")
+	}
+
+	keys, err := Keys(kv)
+	if err != nil || fmt.Sprint(keys) != "[a b]" {
+		t.Fatalf("expected keys [a b], got %v: %v", keys, err)
+	}
+}
+
+func TestUpdateWithConcurrentWriters(t *testing.T) {
+	kv := openTestBucket(t)
+
+	increment := func(current []byte) ([]byte, error) {
+		n := 0
+		if current != nil {
+			var err error
+			if n, err = strconv.Atoi(string(current)); err != nil {
+				return nil, err
+			}
+		}
+		return []byte(strconv.Itoa(n + 1)), nil
+	}
+
+	// Every increment lands although the writers race for the key
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := Update(kv, "counter", 50, increment); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	entry, err := kv.Get("counter")
+	if err != nil || string(entry.Value()) != "8" {
+		t.Fatalf("expected 8 increments, got %v: %v", entry, err)
+	}
+
+	// Errors of the change are returned without writing
+	refused := errors.New("refused")
+	if _, err := Update(kv, "counter", 0, func([]byte) ([]byte, error) { return nil, refused }); !errors.Is(err, refused) {
+		t.Fatalf("expected the change's error, got %v", err)
+	}
+
+	// A writer that always loses the race gives up
+	_, err = Update(kv, "counter", 2, func(current []byte) ([]byte, error) {
+		if _, err := kv.Put("counter", []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+		return increment(current)
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	kv := openTestBucket(t)
+	if _, err := kv.Put("orders.1", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan struct{})
+	entries := make(chan nats.KeyValueEntry, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- Watch(ctx, kv, "orders.>", func() { close(ready) }, func(entry nats.KeyValueEntry) {
+			entries <- entry
+		})
+	}()
+
+	next := func() nats.KeyValueEntry {
+		t.Helper()
+		select {
+		case entry := <-entries:
+			return entry
+		case <-time.After(5 * time.Second):
+			t.Fatal("no update")
+			return nil
+		}
+	}
+
+	if entry := next(); entry.Key() != "orders.1" || string(entry.Value()) != "new" {
+		t.Fatalf("expected the current value first, got %s=%s", entry.Key(), entry.Value())
+	}
+	<-ready
+	if _, err := kv.Put("other", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Delete("orders.1"); err != nil {
+		t.Fatal(err)
+	}
+	if entry := next(); entry.Key() != "orders.1" || entry.Operation() != nats.KeyValueDelete {
+		t.Fatalf("expected the delete of orders.1, got %s %s", entry.Operation(), entry.Key())
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
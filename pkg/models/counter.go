@@ -0,0 +1,72 @@
+// Package models contains data structures for the event-sourced counter example
+package models
+
+import "time"
+
+const (
+	// CounterEventsStream is the stream that stores counter events, the source of truth
+	CounterEventsStream = "COUNTER_EVENTS"
+	// CounterEventsSubject prefixes the per-counter event subjects, e.g. counters.events.visits
+	CounterEventsSubject = "counters.events"
+	// CounterProjectionBucket is the KV bucket holding the projected counter values
+	CounterProjectionBucket = "counters"
+)
+
+// Counter event types
+const (
+	CounterIncremented = "incremented"
+	CounterDecremented = "decremented"
+	CounterReset       = "reset"
+)
+
+// CounterEvent records a change to a counter
+type CounterEvent struct {
+	ID        string    `json:"id"`
+	Counter   string    `json:"counter"`
+	Type      string    `json:"type"`
+	Amount    int64     `json:"amount,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NewCounterEvent creates a new event with a unique ID, which JetStream uses for deduplication
+func NewCounterEvent(counter, eventType string, amount int64) *CounterEvent {
+	return &CounterEvent{
+		ID:        generateID(),
+		Counter:   counter,
+		Type:      eventType,
+		Amount:    amount,
+		Timestamp: time.Now(),
+	}
+}
+
+// Subject returns the subject the event is stored under
+func (e *CounterEvent) Subject() string {
+	return CounterEventsSubject + "." + e.Counter
+}
+
+// CounterState is the projected value of a counter
+type CounterState struct {
+	Counter string `json:"counter"`
+	Value   int64  `json:"value"`
+	Events  int64  `json:"events"`
+	// LastSequence is the stream sequence of the last applied event; events at or
+	// below it were already applied and are skipped when redelivered
+	LastSequence uint64    `json:"last_sequence"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Apply updates the state with an event stored at the given stream sequence
+func (s *CounterState) Apply(event *CounterEvent, sequence uint64) {
+	switch event.Type {
+	case CounterIncremented:
+		s.Value += event.Amount
+	case CounterDecremented:
+		s.Value -= event.Amount
+	case CounterReset:
+		s.Value = 0
+	}
+	s.Counter = event.Counter
+	s.Events++
+	s.LastSequence = sequence
+	s.UpdatedAt = event.Timestamp
+}
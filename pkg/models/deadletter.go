@@ -0,0 +1,17 @@
+// Package models contains the header conventions for dead-lettered messages
+package models
+
+// Headers describing why a message was dead-lettered. The payload of a dead letter is left
+// as it was, so tools such as cmd/dlq-processor can re-publish it to its original subject.
+const (
+	// DeadLetterOriginalSubject is the subject the message was originally published on
+	DeadLetterOriginalSubject = "Dlq-Original-Subject"
+	// DeadLetterError is the last error that made delivery fail
+	DeadLetterError = "Dlq-Error"
+	// DeadLetterAttempts is how many delivery attempts were made
+	DeadLetterAttempts = "Dlq-Attempts"
+	// DeadLetterSource names the component that dead-lettered the message
+	DeadLetterSource = "Dlq-Source"
+	// DeadLetterRetryCount is how many times the message has been re-published from a dead-letter queue
+	DeadLetterRetryCount = "Dlq-Retry-Count"
+)
@@ -0,0 +1,38 @@
+// Package models contains data structures for file change events
+package models
+
+import "time"
+
+// File event operations
+const (
+	FileCreated  = "created"
+	FileModified = "modified"
+	FileDeleted  = "deleted"
+)
+
+// ObjectRef points to a copy of a file stored in a JetStream object store
+type ObjectRef struct {
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+}
+
+// FileEvent represents a change to a file in a watched directory
+type FileEvent struct {
+	Op        string     `json:"op"`
+	Path      string     `json:"path"`
+	Size      int64      `json:"size,omitempty"`
+	ModTime   time.Time  `json:"mod_time,omitempty"`
+	Checksum  string     `json:"checksum,omitempty"`
+	Content   []byte     `json:"content,omitempty"`
+	Object    *ObjectRef `json:"object,omitempty"`
+	Timestamp time.Time  `json:"timestamp"`
+}
+
+// NewFileEvent creates a new file event for the given operation and path
+func NewFileEvent(op, path string) *FileEvent {
+	return &FileEvent{
+		Op:        op,
+		Path:      path,
+		Timestamp: time.Now(),
+	}
+}
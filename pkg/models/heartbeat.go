@@ -0,0 +1,27 @@
+// Package models contains data structures for worker liveness reporting
+package models
+
+import "time"
+
+// HeartbeatSubject is the subject workers publish their heartbeats on
+const HeartbeatSubject = "workers.heartbeat"
+
+// Heartbeat represents a periodic liveness signal published by a worker
+type Heartbeat struct {
+	Worker    string    `json:"worker"`
+	Queue     string    `json:"queue"`
+	Processed int64     `json:"processed"`
+	StartedAt time.Time `json:"started_at"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NewHeartbeat creates a new heartbeat for the given worker
+func NewHeartbeat(worker, queue string, processed int64, startedAt time.Time) *Heartbeat {
+	return &Heartbeat{
+		Worker:    worker,
+		Queue:     queue,
+		Processed: processed,
+		StartedAt: startedAt,
+		Timestamp: time.Now(),
+	}
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+)
+
+// IDGenerator creates the IDs of messages and requests
+type IDGenerator interface {
+	NewID() string
+}
+
+// IDGeneratorFunc adapts a function to an IDGenerator
+type IDGeneratorFunc func() string
+
+// NewID calls f
+func (f IDGeneratorFunc) NewID() string {
+	return f()
+}
+
+// idGenerator holds the generator used by NewMessage, NewRequestID and the other constructors
+var idGenerator atomic.Pointer[IDGenerator]
+
+func init() {
+	SetIDGenerator(IDGeneratorFunc(NewUUIDv7))
+}
+
+// SetIDGenerator replaces the generator of new IDs, e.g. with a predictable one in tests, and
+// returns the previous one so it can be restored
+func SetIDGenerator(g IDGenerator) IDGenerator {
+	previous := idGenerator.Swap(&g)
+	if previous == nil {
+		return nil
+	}
+	return *previous
+}
+
+// NewUUIDv7 returns a random RFC 9562 version 7 UUID. The first 48 bits are the Unix time in
+// milliseconds, so IDs sort by creation time; the other 74 come from crypto/rand, so IDs
+// created in the same millisecond do not collide.
+func NewUUIDv7() string {
+	var u [16]byte
+	rand.Read(u[6:]) // never fails since Go 1.24
+	ms := uint64(time.Now().UnixMilli())
+	for i := 0; i < 6; i++ {
+		u[i] = byte(ms >> (40 - 8*i))
+	}
+	u[6] = u[6]&0x0f | 0x70 // version 7
+	u[8] = u[8]&0x3f | 0x80 // RFC 9562 variant
+
+	var s [36]byte
+	hex.Encode(s[0:8], u[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], u[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], u[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], u[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], u[10:])
+	return string(s[:])
+}
+
+// generateID returns a new ID from the current generator
+func generateID() string {
+	return (*idGenerator.Load()).NewID()
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"regexp"
+	"testing"
+)
+
+var uuidV7 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestNewUUIDv7(t *testing.T) {
+	seen := make(map[string]bool)
+	previous := ""
+	for i := 0; i < 10000; i++ {
+		id := NewUUIDv7()
+		if !uuidV7.MatchString(id) {
+			t.Fatalf("%q is not a version 7 UUID", id)
+		}
+		if seen[id] {
+			t.Fatalf("%q was generated twice", id)
+		}
+		seen[id] = true
+		// The timestamp prefix never goes back
+		if id[:13] < previous {
+			t.Fatalf("%q sorts before %q", id, previous)
+		}
+		previous = id[:13]
+	}
+}
+
+func TestSetIDGenerator(t *testing.T) {
+	previous := SetIDGenerator(IDGeneratorFunc(func() string { return "fixed" }))
+	t.Cleanup(func() { SetIDGenerator(previous) })
+
+	if id := NewRequestID(); id != "fixed" {
+		t.Fatalf("expected the stubbed ID, got %q", id)
+	}
+	if msg := NewMessage("a", "b"); msg.ID != "fixed" {
+		t.Fatalf("expected the stubbed message ID, got %q", msg.ID)
+	}
+
+	SetIDGenerator(previous)
+	if id := NewRequestID(); !uuidV7.MatchString(id) {
+		t.Fatalf("expected a UUID after restoring the generator, got %q", id)
+	}
+}
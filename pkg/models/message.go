@@ -10,6 +10,9 @@ type Message struct {
 	Body      string            `json:"body"`
 	Timestamp time.Time         `json:"timestamp"`
 	Metadata  map[string]string `json:"metadata,omitempty"`
+
+	// Headers are carried as NATS message headers rather than in the JSON payload
+	Headers map[string][]string `json:"-"`
 }
 
 // NewMessage creates a new Message with the given subject and body
@@ -31,17 +34,24 @@ func (m *Message) AddMetadata(key, value string) {
 	m.Metadata[key] = value
 }
 
-// Helper function to generate a simple unique ID
-func generateID() string {
-	return time.Now().Format("20060102150405.000") + "-" + randomString(8)
+// SetHeader adds a value to the message headers sent alongside the payload
+func (m *Message) SetHeader(key, value string) {
+	if m.Headers == nil {
+		m.Headers = make(map[string][]string)
+	}
+	m.Headers[key] = append(m.Headers[key], value)
 }
 
-// Helper function to generate a random string
-func randomString(length int) string {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[time.Now().UnixNano()%int64(len(charset))]
+// Header returns the first value of the named header, or an empty string
+func (m *Message) Header(key string) string {
+	if values := m.Headers[key]; len(values) > 0 {
+		return values[0]
 	}
-	return string(b)
+	return ""
+}
+
+// NewRequestID returns a new ID for a request, e.g. for its Request-Id header, from the
+// generator set with SetIDGenerator; a UUIDv7 by default
+func NewRequestID() string {
+	return generateID()
 }
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// roundTrip checks that a payload that decodes into T encodes to JSON that decodes and
+// encodes back to the same bytes, so relaying a decoded payload never changes it
+func roundTrip[T any](t *testing.T, data []byte) {
+	var first T
+	if err := json.Unmarshal(data, &first); err != nil {
+		return
+	}
+	encoded, err := json.Marshal(&first)
+	if err != nil {
+		t.Fatalf("decoded payload %q does not encode: %v", data, err)
+	}
+
+	var second T
+	if err := json.Unmarshal(encoded, &second); err != nil {
+		t.Fatalf("encoded payload %q does not decode: %v", encoded, err)
+	}
+	reencoded, err := json.Marshal(&second)
+	if err != nil {
+		t.Fatalf("decoded payload %q does not encode: %v", encoded, err)
+	}
+	if !bytes.Equal(encoded, reencoded) {
+		t.Fatalf("round trip changed the payload:\n%s\n%s", encoded, reencoded)
+	}
+}
+
+// seed adds the JSON encoding of v and a few malformed variants to the corpus
+func seed(f *testing.F, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Add(data[:len(data)/2])
+	f.Add([]byte(`{"timestamp":"not a time"}`))
+	f.Add([]byte(`{"id":"\ud800","subject":"\xff"}`))
+	f.Add([]byte(`null`))
+}
+
+func FuzzMessageJSON(f *testing.F) {
+	msg := NewMessage("orders.new", `{"order":1}`)
+	msg.AddMetadata("source", "fuzz")
+	seed(f, msg)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		roundTrip[Message](t, data)
+	})
+}
+
+func FuzzTokenRequestJSON(f *testing.F) {
+	seed(f, NewTokenRequest("client", "secret"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		roundTrip[TokenRequest](t, data)
+	})
+}
+
+func FuzzTokenResponseJSON(f *testing.F) {
+	seed(f, NewTokenResponse("req-1", "token", "Bearer", "openid", 300))
+	seed(f, NewErrorResponse("req-2", "invalid_client"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		roundTrip[TokenResponse](t, data)
+	})
+}
@@ -0,0 +1,12 @@
+// Package models contains data structures for recorded NATS traffic
+package models
+
+import "time"
+
+// RecordedMessage represents a captured NATS message that can be replayed later
+type RecordedMessage struct {
+	Subject   string              `json:"subject"`
+	Headers   map[string][]string `json:"headers,omitempty"`
+	Data      []byte              `json:"data"`
+	Timestamp time.Time           `json:"timestamp"`
+}
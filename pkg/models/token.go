@@ -3,18 +3,56 @@ package models
 
 import "time"
 
-// TokenRequest represents a request for a token
+// Grant types a TokenRequest may ask for; an empty GrantType means client credentials
+const (
+	GrantClientCredentials = "client_credentials"
+	GrantPassword          = "password"
+	GrantRefreshToken      = "refresh_token"
+	GrantTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// Error codes of failed responses. Requests the IDP refused carry its OAuth error code, such as
+// invalid_client or invalid_scope; the other codes describe failures of the token service.
+const (
+	ErrCodeInvalidRequest = "invalid_request" // the request is malformed or misses parameters
+	ErrCodeInvalidClient  = "invalid_client"  // the IDP rejected the client's credentials
+	ErrCodeIDPUnavailable = "idp_unavailable" // the IDP could not be reached
+	ErrCodeRateLimited    = "rate_limited"    // the IDP throttled the request
+	ErrCodeInternal       = "internal"        // the worker failed to handle the request
+)
+
+// TokenRequest represents a request for a token. Its request ID travels in the Request-Id
+// header; RequestID is read only from requesters that cannot send headers.
 type TokenRequest struct {
-	RequestID    string    `json:"request_id"`
+	RequestID    string    `json:"request_id,omitempty"`
+	GrantType    string    `json:"grant_type,omitempty"`
+	Realm        string    `json:"realm,omitempty"` // IDP realm configured on the workers, the default IDP if empty
 	ClientID     string    `json:"client_id"`
 	ClientSecret string    `json:"client_secret"`
+	Scope        string    `json:"scope,omitempty"`
 	Timestamp    time.Time `json:"timestamp"`
+
+	// CredentialRef names the client's secret in the workers' credential store, for requests
+	// sent without ClientSecret; the client ID names it if empty
+	CredentialRef string `json:"credential_ref,omitempty"`
+
+	// Username and Password are the resource owner's, for the password grant
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// RefreshToken is the token to redeem with the refresh_token grant
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// Audience names the API the token is for, with any grant
+	Audience string `json:"audience,omitempty"`
+	// SubjectToken, SubjectTokenType and RequestedTokenType describe a token exchange
+	SubjectToken       string `json:"subject_token,omitempty"`
+	SubjectTokenType   string `json:"subject_token_type,omitempty"`
+	RequestedTokenType string `json:"requested_token_type,omitempty"`
 }
 
-// NewTokenRequest creates a new token request
+// NewTokenRequest creates a new token request, to be sent with a request ID from NewRequestID
+// in the Request-Id header
 func NewTokenRequest(clientID, clientSecret string) *TokenRequest {
 	return &TokenRequest{
-		RequestID:    generateID(),
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
 		Timestamp:    time.Now(),
@@ -28,8 +66,14 @@ type TokenResponse struct {
 	TokenType   string    `json:"token_type"`
 	ExpiresIn   int       `json:"expires_in"`
 	Error       string    `json:"error,omitempty"`
+	ErrorCode   string    `json:"error_code,omitempty"` // one of the ErrCode constants or an OAuth error code
 	Timestamp   time.Time `json:"timestamp"`
 	Scope       string    `json:"scope,omitempty"`
+
+	// RefreshToken and IssuedTokenType are set when the IDP returns them, e.g. for the
+	// password grant and token exchange
+	RefreshToken    string `json:"refresh_token,omitempty"`
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
 }
 
 // NewTokenResponse creates a new token response
@@ -44,6 +88,15 @@ func NewTokenResponse(requestID, accessToken, tokenType, scope string, expiresIn
 	}
 }
 
+// Lifetime returns how long the token is valid after it was issued, from expires_in.
+// It is zero when the IDP did not say.
+func (r *TokenResponse) Lifetime() time.Duration {
+	if r.ExpiresIn <= 0 {
+		return 0
+	}
+	return time.Duration(r.ExpiresIn) * time.Second
+}
+
 // NewErrorResponse creates a new error response
 func NewErrorResponse(requestID, errorMessage string) *TokenResponse {
 	return &TokenResponse{
@@ -52,3 +105,46 @@ func NewErrorResponse(requestID, errorMessage string) *TokenResponse {
 		Timestamp: time.Now(),
 	}
 }
+
+// NewOAuthErrorResponse creates an error response carrying an error code, e.g. the OAuth code
+// of a request the IDP refused, so the requester can tell bad credentials from an IDP outage
+func NewOAuthErrorResponse(requestID, code, errorMessage string) *TokenResponse {
+	response := NewErrorResponse(requestID, errorMessage)
+	response.ErrorCode = code
+	return response
+}
+
+// IntrospectionRequest asks the token service whether a token is active, authenticating
+// with the client's credentials. Revocation requests have the same fields. Like TokenRequest,
+// RequestID is only read when the Request-Id header is missing.
+type IntrospectionRequest struct {
+	RequestID     string `json:"request_id,omitempty"`
+	Realm         string `json:"realm,omitempty"`
+	ClientID      string `json:"client_id"`
+	ClientSecret  string `json:"client_secret"`
+	Token         string `json:"token"`
+	TokenTypeHint string `json:"token_type_hint,omitempty"` // e.g. access_token or refresh_token
+}
+
+// RevocationRequest asks the token service to revoke a token
+type RevocationRequest = IntrospectionRequest
+
+// IntrospectionResponse tells whether a token is active, with its claims if it is
+type IntrospectionResponse struct {
+	RequestID string                 `json:"request_id"`
+	Active    bool                   `json:"active"`
+	Claims    map[string]interface{} `json:"claims,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	ErrorCode string                 `json:"error_code,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// RevocationResponse confirms a revocation. Like the IDP, it does not tell whether the token
+// was valid.
+type RevocationResponse struct {
+	RequestID string    `json:"request_id"`
+	Revoked   bool      `json:"revoked"`
+	Error     string    `json:"error,omitempty"`
+	ErrorCode string    `json:"error_code,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
@@ -0,0 +1,136 @@
+// Package objectstore moves payloads too large for a NATS message through JetStream object
+// stores. The store splits an object into chunks of at most ChunkSize bytes, each one message
+// on the bucket's stream, and checks the SHA-256 digest of the whole object on download.
+// Messages then carry a reference to the object instead of the payload, as filewatch does with
+// models.ObjectRef.
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Progress is called after every read of a transfer, with the bytes moved so far and the size
+// of the object, 0 when unknown. It is called often; throttle what it prints.
+type Progress func(done, total int64)
+
+// Options configure an upload
+type Options struct {
+	Description string
+	Headers     nats.Header
+	// ChunkSize bounds the messages the object is split into, 128KB by default. Keep it below
+	// the server's max_payload.
+	ChunkSize uint32
+	Progress  Progress
+}
+
+// Open binds to an object store bucket, creating it with cfg on first use. An existing bucket
+// keeps its own configuration.
+func Open(js nats.JetStreamContext, cfg nats.ObjectStoreConfig) (nats.ObjectStore, error) {
+	obs, err := js.ObjectStore(cfg.Bucket)
+	if errors.Is(err, nats.ErrStreamNotFound) || errors.Is(err, nats.ErrBucketNotFound) {
+		obs, err = js.CreateObjectStore(&cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open object store %s: %w", cfg.Bucket, err)
+	}
+	return obs, nil
+}
+
+// Upload stores what r yields under name, replacing an object of the same name. size is only
+// passed to Progress and may be 0 when unknown.
+func Upload(ctx context.Context, obs nats.ObjectStore, name string, r io.Reader, size int64, opts Options) (*nats.ObjectInfo, error) {
+	meta := &nats.ObjectMeta{
+		Name:        name,
+		Description: opts.Description,
+		Headers:     opts.Headers,
+		Opts:        &nats.ObjectMetaOptions{ChunkSize: opts.ChunkSize},
+	}
+	info, err := obs.Put(meta, &progressReader{r: r, total: size, progress: opts.Progress}, nats.Context(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload %s: %w", name, err)
+	}
+	return info, nil
+}
+
+// UploadFile stores the file at path under name
+func UploadFile(ctx context.Context, obs nats.ObjectStore, name, path string, opts Options) (*nats.ObjectInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return Upload(ctx, obs, name, file, stat.Size(), opts)
+}
+
+// Download writes the object to w and returns its info. It fails with nats.ErrDigestMismatch
+// when the object arrives corrupted, after w has received the data.
+func Download(ctx context.Context, obs nats.ObjectStore, name string, w io.Writer, progress Progress) (*nats.ObjectInfo, error) {
+	result, err := obs.Get(name, nats.Context(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	defer result.Close()
+
+	info, err := result.Info()
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	if _, err := io.Copy(w, &progressReader{r: result, total: int64(info.Size), progress: progress}); err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	return info, nil
+}
+
+// DownloadFile writes the object to the file at path. The data goes to a temporary file next
+// to it first, so path only ever holds a complete object whose digest matched.
+func DownloadFile(ctx context.Context, obs nats.ObjectStore, name, path string, progress Progress) (*nats.ObjectInfo, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.part")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	info, err := Download(ctx, obs, name, tmp, progress)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// progressReader reports the bytes read through it
+type progressReader struct {
+	r        io.Reader
+	done     int64
+	total    int64
+	progress Progress
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 && p.progress != nil {
+		p.done += int64(n)
+		p.progress(p.done, p.total)
+	}
+	return n, err
+}
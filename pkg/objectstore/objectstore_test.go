@@ -0,0 +1,92 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kiquetal/nats-go-examples/internal/testutil"
+	"github.com/nats-io/nats.go"
+)
+
+// openTestStore runs an embedded NATS server with JetStream and opens an object store on it
+func openTestStore(t *testing.T) nats.ObjectStore {
+	t.Helper()
+	js := testutil.JetStream(t, testutil.Connect(t, testutil.StartServer(t)))
+
+	obs, err := Open(js, nats.ObjectStoreConfig{Bucket: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Opening again binds to the same bucket
+	if _, err := Open(js, nats.ObjectStoreConfig{Bucket: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	return obs
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	obs := openTestStore(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// Larger than the default max_payload of 1MB, so it only fits in chunks
+	data := make([]byte, 1500*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "upload.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var uploaded, totalSeen int64
+	info, err := UploadFile(ctx, obs, "payload", path, Options{
+		Description: "test payload",
+		ChunkSize:   64 * 1024,
+		Progress:    func(done, total int64) { uploaded, totalSeen = done, total },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != uint64(len(data)) || info.Chunks != 24 || uploaded != int64(len(data)) || totalSeen != int64(len(data)) {
+		t.Fatalf("expected %d bytes in 24 chunks, got %d in %d with progress %d/%d", len(data), info.Size, info.Chunks, uploaded, totalSeen)
+	}
+
+	var downloaded int64
+	out := filepath.Join(dir, "download.bin")
+	if _, err := DownloadFile(ctx, obs, "payload", out, func(done, _ int64) { downloaded = done }); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil || !bytes.Equal(got, data) || downloaded != int64(len(data)) {
+		t.Fatalf("expected the uploaded data back, got %d bytes with progress %d: %v", len(got), downloaded, err)
+	}
+
+	// A failed download leaves nothing behind
+	if _, err := DownloadFile(ctx, obs, "missing", filepath.Join(dir, "missing.bin"), nil); !errors.Is(err, nats.ErrObjectNotFound) {
+		t.Fatalf("expected a missing object, got %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected only the uploaded and downloaded files, got %v: %v", entries, err)
+	}
+}
+
+func TestUploadReader(t *testing.T) {
+	obs := openTestStore(t)
+	ctx := context.Background()
+
+	if _, err := Upload(ctx, obs, "greeting", bytes.NewReader([]byte("hello")), 0, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	info, err := Download(ctx, obs, "greeting", &out, nil)
+	if err != nil || out.String() != "hello" || info.Size != 5 {
+		t.Fatalf("expected hello, got %q: %v", out.String(), err)
+	}
+}
@@ -0,0 +1,115 @@
+package pubsub
+
+import (
+	"errors"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+// ackKind is what a durable subscription does with a handled message
+type ackKind int
+
+const (
+	ackKindAck ackKind = iota
+	ackKindNak
+	ackKindTerm
+)
+
+// AckDecision is an AckHandler's verdict on a message, created with Ack, Nak or Term
+type AckDecision struct {
+	kind  ackKind
+	delay time.Duration
+	err   error
+}
+
+// Ack marks the message as handled
+func Ack() AckDecision {
+	return AckDecision{kind: ackKindAck}
+}
+
+// Nak asks for the message to be redelivered after delay, or right away if delay is 0. On its
+// last delivery attempt the message is dead-lettered with err instead.
+func Nak(err error, delay time.Duration) AckDecision {
+	return AckDecision{kind: ackKindNak, delay: delay, err: err}
+}
+
+// Term gives up on the message without redelivery and dead-letters it with err, e.g. for a
+// message that can never succeed
+func Term(err error) AckDecision {
+	return AckDecision{kind: ackKindTerm, err: err}
+}
+
+// AckableMessage is a message received through a durable consumer, with its delivery
+// metadata and the means to extend the time the handler has to decide on it
+type AckableMessage struct {
+	*models.Message
+
+	msg  *nats.Msg
+	meta *nats.MsgMetadata
+}
+
+// AckHandler handles a message from a durable consumer and decides whether it is acked,
+// redelivered or terminated
+type AckHandler func(*AckableMessage) AckDecision
+
+// InProgress tells the server the message is still being worked on, resetting its ack wait so
+// it is not redelivered to another subscriber in the meantime
+func (m *AckableMessage) InProgress() error {
+	return m.msg.InProgress()
+}
+
+// NumDelivered is how often the message has been delivered, 1 on the first attempt
+func (m *AckableMessage) NumDelivered() uint64 {
+	if m.meta == nil {
+		return 1
+	}
+	return m.meta.NumDelivered
+}
+
+// Metadata returns the message's stream and consumer sequences and delivery count, nil if
+// the message did not come from JetStream
+func (m *AckableMessage) Metadata() *nats.MsgMetadata {
+	return m.meta
+}
+
+// Msg returns the received NATS message
+func (m *AckableMessage) Msg() *nats.Msg {
+	return m.msg
+}
+
+// errRedeliveryLimit is the dead-letter reason of a message naked without an error on its
+// last delivery attempt
+var errRedeliveryLimit = errors.New("delivery attempts exhausted")
+
+// settle carries out a handler's decision on a message. Naks on the last delivery attempt
+// and terms are dead-lettered, so a message never disappears silently.
+func (s *NATSSubscriber) settle(m *AckableMessage, decision AckDecision) {
+	switch decision.kind {
+	case ackKindAck:
+		m.msg.Ack()
+	case ackKindNak:
+		if !s.lastDelivery(m.NumDelivered()) {
+			if decision.delay > 0 {
+				m.msg.NakWithDelay(decision.delay)
+			} else {
+				m.msg.Nak()
+			}
+			return
+		}
+		cause := decision.err
+		if cause == nil {
+			cause = errRedeliveryLimit
+		}
+		s.fail(m.msg, cause, int(m.NumDelivered()))
+		m.msg.Term()
+	case ackKindTerm:
+		cause := decision.err
+		if cause == nil {
+			cause = errors.New("terminated by handler")
+		}
+		s.fail(m.msg, cause, int(m.NumDelivered()))
+		m.msg.Term()
+	}
+}
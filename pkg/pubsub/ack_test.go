@@ -0,0 +1,74 @@
+package pubsub
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+func TestSubscribeDurableAckDecisions(t *testing.T) {
+	nc := connectTestServer(t)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.>"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber := NewSubscriberFromConn(nc, WithDeadLetter("dead.orders"))
+	subscriber.SetDurableOptions(DurableOptions{FilterSubject: "orders.>", MaxDeliver: 2})
+	letters, err := nc.SubscribeSync("dead.orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acked := make(chan string, 1)
+	if _, err := subscriber.SubscribeDurableAck("ORDERS", "reader", func(m *AckableMessage) AckDecision {
+		switch m.Body {
+		case "retry":
+			return Nak(errors.New("busy"), 0)
+		case "bad":
+			return Term(errors.New("unknown product"))
+		}
+		if err := m.InProgress(); err != nil {
+			t.Errorf("InProgress failed: %v", err)
+		}
+		acked <- m.Body
+		return Ack()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := NewPublisherFromConn(nc)
+	for _, body := range []string{"retry", "bad", "ok"} {
+		if err := publisher.PublishMessage(models.NewMessage("orders.new", body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case body := <-acked:
+		if body != "ok" {
+			t.Fatalf("expected only the ok message to be acked, got %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the ok message to be acked")
+	}
+
+	// The terminated message is dead-lettered on its first attempt, the naked one on its last
+	got := map[string]string{}
+	for i := 0; i < 2; i++ {
+		letter, err := letters.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("expected two dead letters: %v", err)
+		}
+		got[letter.Header.Get(models.DeadLetterError)] = letter.Header.Get(models.DeadLetterAttempts)
+	}
+	if got["unknown product"] != "1" || got["busy"] != "2" {
+		t.Fatalf("expected the terminated message after 1 attempt and the naked one after 2, got %v", got)
+	}
+}
@@ -0,0 +1,206 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+)
+
+// Defaults for BatchOptions fields that are not set
+const (
+	DefaultBatchSize     = 100
+	DefaultBatchInterval = 10 * time.Millisecond
+)
+
+// ErrBatchPublisherClosed is returned when publishing to a closed BatchPublisher
+var ErrBatchPublisherClosed = errors.New("batch publisher closed")
+
+// PublishResult is the outcome of publishing one message of a batch
+type PublishResult struct {
+	ID  string
+	Err error
+}
+
+// PublishBatch publishes the messages and waits once for the server to process all of them,
+// instead of once per message. It returns a result per message in the same order; messages
+// whose publish failed, or that were published before a failed flush, carry the error.
+func (p *NATSPublisher) PublishBatch(msgs []*models.Message) []PublishResult {
+	return p.PublishBatchCtx(context.Background(), msgs)
+}
+
+// PublishBatchCtx publishes the messages unless ctx is done, then flushes within ctx, bounded
+// by DefaultFlushTimeout when ctx has no deadline. Messages not handed over before ctx ended
+// carry the context's error.
+func (p *NATSPublisher) PublishBatchCtx(ctx context.Context, msgs []*models.Message) []PublishResult {
+	results := make([]PublishResult, len(msgs))
+	published := 0
+	for i, msg := range msgs {
+		results[i].ID = msg.ID
+		if results[i].Err = p.PublishMessageCtx(ctx, msg); results[i].Err == nil {
+			published++
+		}
+	}
+	if published == 0 {
+		return results
+	}
+
+	// Anything in the connection's buffer may be lost if the flush fails
+	if err := p.FlushCtx(ctx); err != nil {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i].Err = fmt.Errorf("flush failed: %w", err)
+			}
+		}
+	}
+	return results
+}
+
+// BatchErrorHandler is called for each message of a BatchPublisher that could not be published
+type BatchErrorHandler func(msg *models.Message, err error)
+
+// BatchOptions configures a BatchPublisher
+type BatchOptions struct {
+	// Size is the number of buffered messages that triggers a flush, DefaultBatchSize if not set
+	Size int
+	// Interval is the longest a message waits in the buffer, DefaultBatchInterval if not set
+	Interval time.Duration
+	// OnError is called for every message that failed, including those flushed in the background
+	OnError BatchErrorHandler
+}
+
+// BatchPublisher buffers messages and publishes them with PublishBatch once Size messages
+// are waiting or Interval has passed, whichever comes first. Failures are reported per
+// message to OnError, as the publish that buffered a message has already returned by then.
+type BatchPublisher struct {
+	publisher *NATSPublisher
+	size      int
+	onError   BatchErrorHandler
+
+	mu     sync.Mutex
+	buffer []*models.Message
+	closed bool
+
+	// flushMu keeps flushes in order, so messages reach the server in the order they were buffered
+	flushMu sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewBatchPublisher starts buffering publishes on publisher, flushing in the background every
+// Interval until Close
+func NewBatchPublisher(publisher *NATSPublisher, opts BatchOptions) *BatchPublisher {
+	if opts.Size <= 0 {
+		opts.Size = DefaultBatchSize
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultBatchInterval
+	}
+
+	b := &BatchPublisher{
+		publisher: publisher,
+		size:      opts.Size,
+		onError:   opts.OnError,
+		buffer:    make([]*models.Message, 0, opts.Size),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go b.run(opts.Interval)
+	return b
+}
+
+// run flushes the buffer every interval until Close
+func (b *BatchPublisher) run(interval time.Duration) {
+	defer close(b.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.Flush()
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// PublishMessage buffers a message. The publish that fills the buffer flushes it before
+// returning, which holds back producers that are faster than the connection.
+func (b *BatchPublisher) PublishMessage(msg *models.Message) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrBatchPublisherClosed
+	}
+	b.buffer = append(b.buffer, msg)
+	full := len(b.buffer) >= b.size
+	b.mu.Unlock()
+
+	if full {
+		b.Flush()
+	}
+	return nil
+}
+
+// Buffered returns the number of messages waiting for the next flush
+func (b *BatchPublisher) Buffered() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.buffer)
+}
+
+// Flush publishes the buffered messages now and waits for the server to process them. Each
+// failed message is reported to OnError; the returned error summarizes the failures.
+func (b *BatchPublisher) Flush() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	msgs := b.buffer
+	b.buffer = make([]*models.Message, 0, b.size)
+	b.mu.Unlock()
+
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	var failed int
+	var first error
+	for i, result := range b.publisher.PublishBatch(msgs) {
+		if result.Err == nil {
+			continue
+		}
+		failed++
+		if first == nil {
+			first = result.Err
+		}
+		if b.onError != nil {
+			b.onError(msgs[i], result.Err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d messages not published: %w", failed, len(msgs), first)
+	}
+	return nil
+}
+
+// Close stops the background flushes and flushes the remaining messages. It does not close
+// the wrapped publisher.
+func (b *BatchPublisher) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.mu.Unlock()
+
+	close(b.stop)
+	<-b.done
+	return b.Flush()
+}
@@ -0,0 +1,112 @@
+package pubsub
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+func TestPublishBatch(t *testing.T) {
+	nc := connectTestServer(t)
+	sub, err := nc.SubscribeSync("orders.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher := NewPublisherFromConn(nc)
+
+	// A message over the server's max payload fails on its own, the others still go out
+	oversized := models.NewMessage("orders.big", strings.Repeat("x", int(nc.MaxPayload())))
+	results := publisher.PublishBatch([]*models.Message{
+		models.NewMessage("orders.1", "first"),
+		oversized,
+		models.NewMessage("orders.2", "second"),
+	})
+	if len(results) != 3 || results[0].Err != nil || results[2].Err != nil {
+		t.Fatalf("expected the small messages to be published, got %+v", results)
+	}
+	if results[1].ID != oversized.ID || results[1].Err == nil {
+		t.Fatalf("expected the oversized message to fail, got %+v", results[1])
+	}
+	for _, subject := range []string{"orders.1", "orders.2"} {
+		msg, err := sub.NextMsg(time.Second)
+		if err != nil || msg.Subject != subject {
+			t.Fatalf("expected a message on %s, got %v, %v", subject, msg, err)
+		}
+	}
+}
+
+func TestBatchPublisherFlushesOnSizeAndClose(t *testing.T) {
+	nc := connectTestServer(t)
+	sub, err := nc.SubscribeSync("orders.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failed []string
+	batch := NewBatchPublisher(NewPublisherFromConn(nc), BatchOptions{
+		Size:     2,
+		Interval: time.Hour,
+		OnError:  func(msg *models.Message, err error) { failed = append(failed, msg.Subject) },
+	})
+
+	// The second message fills the buffer and flushes both
+	for _, subject := range []string{"orders.1", "orders.2", "orders.3"} {
+		if err := batch.PublishMessage(models.NewMessage(subject, subject)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if batch.Buffered() != 1 {
+		t.Fatalf("expected one buffered message, got %d", batch.Buffered())
+	}
+	assertPending(t, sub, 2)
+
+	// Failures are reported per message, the rest of the batch still goes out
+	big := strings.Repeat("x", int(nc.MaxPayload()))
+	if err := batch.PublishMessage(models.NewMessage("orders.big", big)); err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0] != "orders.big" {
+		t.Fatalf("expected the oversized message to be reported, got %v", failed)
+	}
+	assertPending(t, sub, 3)
+
+	// Flush summarizes the failures of the messages it published
+	if err := batch.PublishMessage(models.NewMessage("orders.big", big)); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Flush(); err == nil || !strings.Contains(err.Error(), "1 of 1 messages not published") {
+		t.Fatalf("expected one failed message, got %v", err)
+	}
+
+	// Close flushes the rest
+	if err := batch.PublishMessage(models.NewMessage("orders.4", "last")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertPending(t, sub, 4)
+
+	if err := batch.PublishMessage(models.NewMessage("orders.5", "late")); err != ErrBatchPublisherClosed {
+		t.Fatalf("expected publishing after Close to fail, got %v", err)
+	}
+}
+
+// assertPending checks how many messages the subscription has received so far
+func assertPending(t *testing.T, sub *nats.Subscription, want int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		n, _, _ := sub.Pending()
+		if n == want {
+			return
+		}
+		if n > want || time.Now().After(deadline) {
+			t.Fatalf("expected %d messages, got %d", want, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,248 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+// Headers of the chunks a message too large for the server's max_payload is split into
+const (
+	ChunkIDHeader    = "Chunk-Id"    // shared by the chunks of one message
+	ChunkIndexHeader = "Chunk-Index" // position of the chunk, from 0
+	ChunkCountHeader = "Chunk-Count" // number of chunks of the message
+)
+
+// Reassembly defaults
+const (
+	DefaultReassemblyTimeout  = 30 * time.Second
+	DefaultReassemblyMaxBytes = 64 << 20
+)
+
+// chunkHeaderReserve is the room left in each chunk for the chunk headers
+const chunkHeaderReserve = 128
+
+// maxChunks bounds the chunks a message may claim
+const maxChunks = 1 << 16
+
+// chunkOverhead is charged against the reassembly byte limit for every buffered chunk, on top
+// of its payload, for the message, its headers and the bookkeeping. Chunk slots are only
+// allocated as chunks arrive, so tiny bogus chunks with unique IDs cannot grow memory past the
+// limit either.
+const chunkOverhead = 1 << 10
+
+// Errors of reassembly
+var (
+	ErrMalformedChunk    = errors.New("malformed chunk")
+	ErrIncompleteMessage = errors.New("chunked message incomplete")
+	ErrReassemblyFull    = errors.New("reassembly buffer full")
+)
+
+// SplitMsg splits a message larger than maxSize bytes, payload and headers, into chunks of at
+// most maxSize bytes sharing a ChunkIDHeader. The first chunk carries the message's headers,
+// the last one its reply subject; the message is returned as it is when it fits. Seal the
+// message before splitting it, so signatures and encryption cover the whole payload.
+func SplitMsg(msg *nats.Msg, maxSize int) ([]*nats.Msg, error) {
+	headers := headerSize(msg.Header)
+	if headers+len(msg.Data) <= maxSize {
+		return []*nats.Msg{msg}, nil
+	}
+
+	first := maxSize - headers - chunkHeaderReserve
+	rest := maxSize - chunkHeaderReserve
+	if first <= 0 {
+		return nil, fmt.Errorf("headers of %d bytes leave no room for chunks of %d bytes", headers, maxSize)
+	}
+	count := 1
+	if remaining := len(msg.Data) - first; remaining > 0 {
+		count += (remaining + rest - 1) / rest
+	}
+
+	id := models.NewRequestID()
+	chunks := make([]*nats.Msg, 0, count)
+	data := msg.Data
+	for i := 0; i < count; i++ {
+		chunk := nats.NewMsg(msg.Subject)
+		size := rest
+		if i == 0 {
+			size = first
+			for key, values := range msg.Header {
+				chunk.Header[key] = values
+			}
+		}
+		if i == count-1 {
+			chunk.Reply = msg.Reply
+		}
+		size = min(size, len(data))
+		chunk.Data, data = data[:size], data[size:]
+		chunk.Header.Set(ChunkIDHeader, id)
+		chunk.Header.Set(ChunkIndexHeader, strconv.Itoa(i))
+		chunk.Header.Set(ChunkCountHeader, strconv.Itoa(count))
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+// headerSize returns the size of the headers as NATS encodes them
+func headerSize(header nats.Header) int {
+	if len(header) == 0 {
+		return 0
+	}
+	size := len("NATS/1.0\r\n\r\n")
+	for key, values := range header {
+		for _, value := range values {
+			size += len(key) + len(": ") + len(value) + len("\r\n")
+		}
+	}
+	return size
+}
+
+// Reassembler puts chunked messages back together. Chunks may arrive in any order and more
+// than once; messages whose chunks do not all arrive within the timeout are dropped and
+// reported to the expiry handler. The chunks of a message must reach the same subscription,
+// so queue groups, which spread messages over their members, cannot reassemble.
+type Reassembler struct {
+	timeout  time.Duration
+	maxBytes int
+	onExpire func(first *nats.Msg, err error)
+
+	mu       sync.Mutex
+	pending  map[string]*partialMsg
+	buffered int
+}
+
+// partialMsg is a message whose chunks are still arriving
+type partialMsg struct {
+	count  int
+	chunks map[int]*nats.Msg
+	size   int // payload bytes received
+	timer  *time.Timer
+}
+
+// charged returns the bytes the message counts for against the byte limit
+func (p *partialMsg) charged() int {
+	return p.size + len(p.chunks)*chunkOverhead
+}
+
+// NewReassembler creates a reassembler dropping incomplete messages after timeout, and
+// refusing chunks while maxBytes are buffered; the defaults apply when they are not positive.
+// onExpire, if not nil, receives the first chunk that arrived of every dropped message.
+func NewReassembler(timeout time.Duration, maxBytes int, onExpire func(first *nats.Msg, err error)) *Reassembler {
+	if timeout <= 0 {
+		timeout = DefaultReassemblyTimeout
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultReassemblyMaxBytes
+	}
+	return &Reassembler{timeout: timeout, maxBytes: maxBytes, onExpire: onExpire, pending: make(map[string]*partialMsg)}
+}
+
+// Add takes a received message. It returns messages that are not chunks as they are, nil
+// while a chunked message is incomplete, and the whole message with its headers, without the
+// chunk headers, and reply subject once its last chunk arrived.
+func (r *Reassembler) Add(msg *nats.Msg) (*nats.Msg, error) {
+	id := header(msg, ChunkIDHeader)
+	if id == "" {
+		return msg, nil
+	}
+	index, err1 := strconv.Atoi(header(msg, ChunkIndexHeader))
+	count, err2 := strconv.Atoi(header(msg, ChunkCountHeader))
+	if err1 != nil || err2 != nil || count < 1 || count > maxChunks || index < 0 || index >= count {
+		return nil, fmt.Errorf("%w %s: index %q of %q", ErrMalformedChunk, id, header(msg, ChunkIndexHeader), header(msg, ChunkCountHeader))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	partial, ok := r.pending[id]
+	if !ok {
+		partial = &partialMsg{count: count, chunks: make(map[int]*nats.Msg)}
+		partial.timer = time.AfterFunc(r.timeout, func() { r.expire(id) })
+		r.pending[id] = partial
+	}
+	if partial.count != count {
+		return nil, fmt.Errorf("%w %s: %d chunks, earlier chunks said %d", ErrMalformedChunk, id, count, partial.count)
+	}
+	if _, dup := partial.chunks[index]; dup {
+		// A duplicate, e.g. after a redelivery
+		return nil, nil
+	}
+	if r.buffered+len(msg.Data)+chunkOverhead > r.maxBytes {
+		r.drop(id, partial)
+		return nil, fmt.Errorf("%w: %d bytes buffered, dropping chunked message %s", ErrReassemblyFull, r.buffered, id)
+	}
+	partial.chunks[index] = msg
+	partial.size += len(msg.Data)
+	r.buffered += len(msg.Data) + chunkOverhead
+	if len(partial.chunks) < count {
+		return nil, nil
+	}
+
+	r.drop(id, partial)
+	return join(partial), nil
+}
+
+// Pending returns the number of incomplete messages
+func (r *Reassembler) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending)
+}
+
+// expire drops a message whose chunks did not all arrive in time
+func (r *Reassembler) expire(id string) {
+	r.mu.Lock()
+	partial, ok := r.pending[id]
+	if ok {
+		r.drop(id, partial)
+	}
+	r.mu.Unlock()
+
+	if !ok || r.onExpire == nil || len(partial.chunks) == 0 {
+		return
+	}
+	first := -1
+	for index := range partial.chunks {
+		if first < 0 || index < first {
+			first = index
+		}
+	}
+	r.onExpire(partial.chunks[first], fmt.Errorf("%w: %d of %d chunks of %s arrived within %s", ErrIncompleteMessage, len(partial.chunks), partial.count, id, r.timeout))
+}
+
+// drop forgets a message; r.mu must be held
+func (r *Reassembler) drop(id string, partial *partialMsg) {
+	partial.timer.Stop()
+	r.buffered -= partial.charged()
+	delete(r.pending, id)
+}
+
+// join concatenates the chunks of a complete message
+func join(partial *partialMsg) *nats.Msg {
+	first := partial.chunks[0]
+	msg := nats.NewMsg(first.Subject)
+	for key, values := range first.Header {
+		msg.Header[key] = values
+	}
+	msg.Header.Del(ChunkIDHeader)
+	msg.Header.Del(ChunkIndexHeader)
+	msg.Header.Del(ChunkCountHeader)
+
+	msg.Data = make([]byte, 0, partial.size)
+	for i := 0; i < partial.count; i++ {
+		chunk := partial.chunks[i]
+		msg.Data = append(msg.Data, chunk.Data...)
+		if chunk.Reply != "" {
+			msg.Reply, msg.Sub = chunk.Reply, chunk.Sub
+		}
+	}
+	if msg.Sub == nil {
+		msg.Sub = first.Sub
+	}
+	return msg
+}
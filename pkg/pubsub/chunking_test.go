@@ -0,0 +1,178 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/testutil"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+func TestSplitAndReassemble(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 100)
+	msg := nats.NewMsg("files.upload")
+	msg.Header.Set("Trace-Id", "t-1")
+	msg.Reply = "_INBOX.reply"
+	msg.Data = payload
+
+	chunks, err := SplitMsg(msg, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) < 4 {
+		t.Fatalf("expected the payload in at least 4 chunks, got %d", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if size := headerSize(chunk.Header) + len(chunk.Data); size > 300 {
+			t.Fatalf("chunk %d is %d bytes", i, size)
+		}
+		if (chunk.Header.Get("Trace-Id") != "") != (i == 0) || (chunk.Reply != "") != (i == len(chunks)-1) {
+			t.Fatalf("expected the headers on the first chunk and the reply on the last, got %v %q on chunk %d", chunk.Header, chunk.Reply, i)
+		}
+	}
+
+	// Chunks put back together in any order, duplicates ignored
+	r := NewReassembler(time.Minute, 0, nil)
+	last := len(chunks) - 1
+	order := append([]*nats.Msg{chunks[last], chunks[0], chunks[0]}, chunks[1:last]...)
+	var whole *nats.Msg
+	for i, chunk := range order {
+		got, err := r.Add(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got != nil) != (i == len(order)-1) {
+			t.Fatalf("expected the message after the last chunk only, got %v after %d", got != nil, i)
+		}
+		whole = got
+	}
+	if !bytes.Equal(whole.Data, payload) || whole.Reply != msg.Reply || whole.Header.Get("Trace-Id") != "t-1" || whole.Header.Get(ChunkIDHeader) != "" {
+		t.Fatalf("expected the original message back, got %d bytes, reply %q, headers %v", len(whole.Data), whole.Reply, whole.Header)
+	}
+	if r.Pending() != 0 {
+		t.Fatalf("expected nothing pending, got %d", r.Pending())
+	}
+	if got, err := r.Add(chunks[1]); got != nil || err != nil || r.Pending() != 1 {
+		t.Fatalf("expected a late chunk to start over, got %v, %v", got, err)
+	}
+
+	// Messages that fit pass as they are
+	small := &nats.Msg{Subject: "files.upload", Data: []byte("small")}
+	if chunks, err := SplitMsg(small, 300); err != nil || len(chunks) != 1 || chunks[0] != small {
+		t.Fatalf("expected a small message unchanged, got %d chunks: %v", len(chunks), err)
+	}
+	if got, err := r.Add(small); got != small || err != nil {
+		t.Fatalf("expected a plain message to pass, got %v: %v", got, err)
+	}
+
+	bad := nats.NewMsg("files.upload")
+	bad.Header.Set(ChunkIDHeader, "x")
+	bad.Header.Set(ChunkIndexHeader, "3")
+	bad.Header.Set(ChunkCountHeader, "2")
+	if _, err := r.Add(bad); !errors.Is(err, ErrMalformedChunk) {
+		t.Fatalf("expected a malformed chunk, got %v", err)
+	}
+}
+
+func TestReassemblyLimits(t *testing.T) {
+	msg := &nats.Msg{Subject: "files.upload", Data: bytes.Repeat([]byte("x"), 1000)}
+	chunks, err := SplitMsg(msg, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Incomplete messages are dropped after the timeout
+	expired := make(chan error, 1)
+	r := NewReassembler(20*time.Millisecond, 0, func(first *nats.Msg, err error) {
+		expired <- err
+	})
+	if _, err := r.Add(chunks[0]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-expired:
+		if !errors.Is(err, ErrIncompleteMessage) {
+			t.Fatalf("expected an incomplete message, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("incomplete message not expired")
+	}
+	if r.Pending() != 0 {
+		t.Fatalf("expected the message dropped, %d pending", r.Pending())
+	}
+
+	// Messages that would not fit in the buffer are dropped at once
+	r = NewReassembler(time.Minute, 400, nil)
+	var full error
+	for _, chunk := range chunks {
+		if _, full = r.Add(chunk); full != nil {
+			break
+		}
+	}
+	if !errors.Is(full, ErrReassemblyFull) || r.Pending() != 0 {
+		t.Fatalf("expected the buffer to refuse the message, got %v with %d pending", full, r.Pending())
+	}
+}
+
+func TestReassemblyBogusChunks(t *testing.T) {
+	// Tiny first chunks claiming the most chunks each count against the byte limit, so they
+	// cannot pile up until the timeout
+	r := NewReassembler(time.Minute, 64*chunkOverhead, nil)
+	refused := 0
+	for i := 0; i < 1000; i++ {
+		chunk := nats.NewMsg("files.upload")
+		chunk.Data = []byte("x")
+		chunk.Header.Set(ChunkIDHeader, fmt.Sprintf("bogus-%d", i))
+		chunk.Header.Set(ChunkIndexHeader, "0")
+		chunk.Header.Set(ChunkCountHeader, strconv.Itoa(maxChunks))
+		if _, err := r.Add(chunk); errors.Is(err, ErrReassemblyFull) {
+			refused++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.Pending() >= 64 || refused == 0 {
+		t.Fatalf("expected the bogus messages bounded by the byte limit, %d pending and %d refused", r.Pending(), refused)
+	}
+}
+
+func TestChunkedRequestReply(t *testing.T) {
+	// A server with a small max_payload, so the request only gets through in chunks
+	nc := testutil.Connect(t, testutil.StartServer(t, testutil.WithoutJetStream(), testutil.WithMaxPayload(4096)))
+
+	subscriber := NewSubscriberFromConn(nc)
+	subscriber.SetEncrypter(newTestEncrypter(t, "2026-10", true))
+	subscriber.EnableReassembly(time.Second, 0)
+	if _, err := subscriber.SubscribeReply("files.check", func(msg *models.Message) (*models.Message, error) {
+		return models.NewMessage(msg.Subject, fmt.Sprintf("received %s with %d", msg.Body[:5], len(msg.Body))), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := NewPublisherFromConn(nc)
+	publisher.SetEncrypter(newTestEncrypter(t, "2026-09", true))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request := models.NewMessage("files.check", "large"+strings.Repeat("x", 20000))
+	request.Headers = nats.Header{RequestIDHeader: []string{"req-1"}}
+
+	if _, err := publisher.RequestMessageCtx(ctx, request); !errors.Is(err, nats.ErrMaxPayload) {
+		t.Fatalf("expected the request to exceed max_payload without chunking, got %v", err)
+	}
+
+	publisher.EnableChunking(0)
+	reply, err := publisher.RequestMessageCtx(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Body != "received large with 20005" {
+		t.Fatalf("expected the reassembled request to be answered, got %q", reply.Body)
+	}
+}
@@ -0,0 +1,59 @@
+package pubsub
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+// FuzzFromNATSMsg feeds arbitrary payloads and headers, as received from NATS, through the
+// message codec: decoding must not panic, and a decoded message must survive re-encoding
+func FuzzFromNATSMsg(f *testing.F) {
+	f.Add([]byte(`{"id":"1","subject":"orders.new","body":"hello","timestamp":"2024-01-01T00:00:00Z"}`), "Trace-Id", "abc")
+	f.Add([]byte(`{"metadata":{"k":"v"},"Headers":{"X":["smuggled"]}}`), "", "")
+	f.Add([]byte(`{"body":`), "X", "")
+	f.Add([]byte(`[]`), "X-Multi", "a\r\nb")
+
+	f.Fuzz(func(t *testing.T, data []byte, key, value string) {
+		in := nats.NewMsg("fuzz")
+		in.Data = data
+		if key != "" {
+			in.Header.Add(key, value)
+		}
+
+		msg, err := fromNATSMsg(in)
+		if err != nil {
+			return
+		}
+
+		out, err := toNATSMsg(msg)
+		if err != nil {
+			t.Fatalf("decoded message does not encode: %v", err)
+		}
+		decoded, err := fromNATSMsg(out)
+		if err != nil {
+			t.Fatalf("encoded message does not decode: %v", err)
+		}
+
+		assertSameMessage(t, msg, decoded)
+	})
+}
+
+// assertSameMessage compares the fields the codec carries, ignoring the timestamp's location
+func assertSameMessage(t *testing.T, want, got *models.Message) {
+	t.Helper()
+	if want.ID != got.ID || want.Subject != got.Subject || want.Body != got.Body {
+		t.Fatalf("round trip changed the message: %+v -> %+v", want, got)
+	}
+	if !want.Timestamp.Equal(got.Timestamp) {
+		t.Fatalf("round trip changed the timestamp: %s -> %s", want.Timestamp, got.Timestamp)
+	}
+	if len(want.Metadata) > 0 && !reflect.DeepEqual(want.Metadata, got.Metadata) {
+		t.Fatalf("round trip changed the metadata: %v -> %v", want.Metadata, got.Metadata)
+	}
+	if len(want.Headers) > 0 && !reflect.DeepEqual(want.Headers, got.Headers) {
+		t.Fatalf("round trip changed the headers: %v -> %v", want.Headers, got.Headers)
+	}
+}
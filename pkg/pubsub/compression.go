@@ -0,0 +1,148 @@
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/nats-io/nats.go"
+)
+
+// ContentEncodingHeader names the compression of a message's payload, absent for payloads
+// sent as they are
+const ContentEncodingHeader = "Content-Encoding"
+
+// Content encodings
+const (
+	EncodingGzip = "gzip" // smallest payloads
+	EncodingS2   = "s2"   // much faster, somewhat larger payloads
+)
+
+// Compression defaults
+const (
+	DefaultCompressionThreshold = 1024
+	DefaultMaxDecompressedSize  = 64 << 20
+)
+
+// Errors of Decompress
+var (
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+	ErrDecompression       = errors.New("payload decompression failed")
+)
+
+// gzipWriters reuses gzip writers, which allocate large tables
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// Compressor compresses message payloads of at least a threshold size and decompresses
+// received ones. The encoding travels in ContentEncodingHeader, so receivers decode whatever
+// encoding a sender chose, and payloads that do not shrink are sent as they are.
+type Compressor struct {
+	encoding  string
+	threshold int
+	maxSize   int
+}
+
+// NewCompressor creates a compressor encoding payloads of at least threshold bytes with
+// encoding, EncodingGzip or EncodingS2, or only decompressing with an empty encoding;
+// DefaultCompressionThreshold applies when threshold is not positive. Decompressed payloads
+// are limited to DefaultMaxDecompressedSize.
+func NewCompressor(encoding string, threshold int) (*Compressor, error) {
+	switch encoding {
+	case "", EncodingGzip, EncodingS2:
+	default:
+		return nil, fmt.Errorf("%w %q, expected %s or %s", ErrUnsupportedEncoding, encoding, EncodingGzip, EncodingS2)
+	}
+	if threshold <= 0 {
+		threshold = DefaultCompressionThreshold
+	}
+	return &Compressor{encoding: encoding, threshold: threshold, maxSize: DefaultMaxDecompressedSize}, nil
+}
+
+// Encoding returns the encoding payloads are compressed with, empty for compressors that only
+// decompress
+func (c *Compressor) Encoding() string {
+	return c.encoding
+}
+
+// Compress replaces a payload of at least the threshold size with its compressed form and
+// sets ContentEncodingHeader, unless the message is already encoded or would not shrink.
+// Compress after signing, so signatures cover the original payload, and before encrypting, as
+// ciphertexts do not compress.
+func (c *Compressor) Compress(msg *nats.Msg) error {
+	if c.encoding == "" || len(msg.Data) < c.threshold || ContentEncoding(msg) != "" {
+		return nil
+	}
+	var compressed []byte
+	switch c.encoding {
+	case EncodingGzip:
+		var buf bytes.Buffer
+		w := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(w)
+		w.Reset(&buf)
+		if _, err := w.Write(msg.Data); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		compressed = buf.Bytes()
+	case EncodingS2:
+		compressed = s2.Encode(nil, msg.Data)
+	}
+	if len(compressed) >= len(msg.Data) {
+		return nil
+	}
+	msg.Data = compressed
+	SetHeader(msg, ContentEncodingHeader, c.encoding)
+	return nil
+}
+
+// Decompress replaces a compressed payload with the original and removes
+// ContentEncodingHeader, whichever supported encoding the sender used. Payloads without the
+// header are left alone.
+func (c *Compressor) Decompress(msg *nats.Msg) error {
+	encoding := ContentEncoding(msg)
+	var data []byte
+	switch encoding {
+	case "":
+		return nil
+	case EncodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(msg.Data))
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrDecompression, err)
+		}
+		// Read one byte past the limit to tell a payload of exactly the limit from a larger one
+		if data, err = io.ReadAll(io.LimitReader(r, int64(c.maxSize)+1)); err != nil {
+			return fmt.Errorf("%w: %v", ErrDecompression, err)
+		}
+	case EncodingS2:
+		size, err := s2.DecodedLen(msg.Data)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrDecompression, err)
+		}
+		if size > c.maxSize {
+			return fmt.Errorf("%w: payload of %d bytes exceeds %d", ErrDecompression, size, c.maxSize)
+		}
+		if data, err = s2.Decode(nil, msg.Data); err != nil {
+			return fmt.Errorf("%w: %v", ErrDecompression, err)
+		}
+	default:
+		return fmt.Errorf("%w %q", ErrUnsupportedEncoding, encoding)
+	}
+	if len(data) > c.maxSize {
+		return fmt.Errorf("%w: payload exceeds %d bytes", ErrDecompression, c.maxSize)
+	}
+	msg.Data = data
+	msg.Header.Del(ContentEncodingHeader)
+	return nil
+}
+
+// ContentEncoding returns the ContentEncodingHeader, or an empty string for payloads sent as
+// they are
+func ContentEncoding(msg *nats.Msg) string {
+	return header(msg, ContentEncodingHeader)
+}
@@ -0,0 +1,183 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+func TestCompressAndDecompress(t *testing.T) {
+	payload := bytes.Repeat([]byte(`{"sensor":"t-1","reading":21.5}`), 100)
+
+	for _, encoding := range []string{EncodingGzip, EncodingS2} {
+		c, err := NewCompressor(encoding, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := &nats.Msg{Subject: "sensors.readings", Data: append([]byte(nil), payload...)}
+		if err := c.Compress(msg); err != nil {
+			t.Fatal(err)
+		}
+		if ContentEncoding(msg) != encoding || len(msg.Data) >= len(payload) {
+			t.Fatalf("expected a smaller %s payload, got %q with %d bytes", encoding, ContentEncoding(msg), len(msg.Data))
+		}
+		// Compressing twice leaves the payload alone
+		compressed := msg.Data
+		if err := c.Compress(msg); err != nil || !bytes.Equal(msg.Data, compressed) {
+			t.Fatalf("expected an encoded message unchanged, got %v", err)
+		}
+
+		// Receivers decode whichever encoding the sender chose
+		other, _ := NewCompressor(EncodingGzip, 0)
+		if err := other.Decompress(msg); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg.Data, payload) || ContentEncoding(msg) != "" {
+			t.Fatalf("expected the original %s payload back, got %d bytes, encoding %q", encoding, len(msg.Data), ContentEncoding(msg))
+		}
+	}
+
+	c, _ := NewCompressor(EncodingS2, 0)
+
+	// Small payloads and payloads that do not shrink are sent as they are
+	small := &nats.Msg{Subject: "sensors.readings", Data: []byte(`{"reading":21.5}`)}
+	noise := &nats.Msg{Subject: "sensors.readings", Data: make([]byte, 4096)}
+	if _, err := rand.Read(noise.Data); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []*nats.Msg{small, noise} {
+		before := append([]byte(nil), msg.Data...)
+		if err := c.Compress(msg); err != nil || ContentEncoding(msg) != "" || !bytes.Equal(msg.Data, before) {
+			t.Fatalf("expected a %d byte payload unchanged, got %q: %v", len(before), ContentEncoding(msg), err)
+		}
+	}
+
+	// Plain payloads pass, unknown and corrupt ones fail
+	if err := c.Decompress(small); err != nil {
+		t.Fatal(err)
+	}
+	unknown := nats.NewMsg("sensors.readings")
+	unknown.Header.Set(ContentEncodingHeader, "br")
+	if err := c.Decompress(unknown); !errors.Is(err, ErrUnsupportedEncoding) {
+		t.Fatalf("expected an unsupported encoding, got %v", err)
+	}
+	corrupt := nats.NewMsg("sensors.readings")
+	corrupt.Header.Set(ContentEncodingHeader, EncodingGzip)
+	corrupt.Data = []byte("not gzip")
+	if err := c.Decompress(corrupt); !errors.Is(err, ErrDecompression) {
+		t.Fatalf("expected a decompression error, got %v", err)
+	}
+	// Compressors without an encoding only decompress
+	plain, _ := NewCompressor("", 0)
+	large := &nats.Msg{Subject: "sensors.readings", Data: append([]byte(nil), payload...)}
+	if err := plain.Compress(large); err != nil || ContentEncoding(large) != "" {
+		t.Fatalf("expected no compression without an encoding, got %q: %v", ContentEncoding(large), err)
+	}
+	if _, err := NewCompressor("zstd", 0); !errors.Is(err, ErrUnsupportedEncoding) {
+		t.Fatalf("expected an unsupported encoding, got %v", err)
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 10000)
+	for _, encoding := range []string{EncodingGzip, EncodingS2} {
+		c, _ := NewCompressor(encoding, 0)
+		msg := &nats.Msg{Subject: "files.upload", Data: append([]byte(nil), payload...)}
+		if err := c.Compress(msg); err != nil {
+			t.Fatal(err)
+		}
+		small := &Compressor{encoding: encoding, threshold: DefaultCompressionThreshold, maxSize: len(payload) - 1}
+		if err := small.Decompress(msg); !errors.Is(err, ErrDecompression) {
+			t.Fatalf("expected %s payloads over the limit to fail, got %v", encoding, err)
+		}
+	}
+}
+
+// keySigner and keyVerifier sign and verify with fixed nkeys
+type keySigner struct{ kp nkeys.KeyPair }
+
+func (s keySigner) Sign(msg *nats.Msg) error { return Sign(msg, s.kp) }
+
+type keyVerifier struct{ trusted []string }
+
+func (v keyVerifier) Verify(msg *nats.Msg) error {
+	_, err := Verify(msg, v.trusted)
+	return err
+}
+
+func TestCompressedRequestReply(t *testing.T) {
+	nc := connectTestServer(t)
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := kp.PublicKey()
+	gzipCompressor, _ := NewCompressor(EncodingGzip, 0)
+	s2Compressor, _ := NewCompressor(EncodingS2, 0)
+
+	// The payload on the wire is compressed before it is encrypted
+	wire := make(chan *nats.Msg, 1)
+	if _, err := nc.Subscribe("reports.render", func(msg *nats.Msg) {
+		wire <- msg
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber := NewSubscriberFromConn(nc)
+	subscriber.SetEncrypter(newTestEncrypter(t, "2026-10", true))
+	subscriber.SetCompressor(gzipCompressor)
+	subscriber.SetVerifier(keyVerifier{[]string{signer}})
+	if _, err := subscriber.SubscribeReply("reports.render", func(msg *models.Message) (*models.Message, error) {
+		return models.NewMessage(msg.Subject, strings.ToUpper(msg.Body)), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := NewPublisherFromConn(nc)
+	publisher.SetSigner(keySigner{kp})
+	publisher.SetCompressor(s2Compressor)
+	publisher.SetEncrypter(newTestEncrypter(t, "2026-09", true))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	body := strings.Repeat("quarterly totals ", 500)
+
+	reply, err := publisher.RequestMessageCtx(ctx, models.NewMessage("reports.render", body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Body != strings.ToUpper(body) {
+		t.Fatalf("expected the signed, compressed and encrypted request to be answered, got %d bytes", len(reply.Body))
+	}
+	select {
+	case msg := <-wire:
+		if ContentEncoding(msg) != EncodingS2 || EncryptionKeyID(msg) != "2026-09" || len(msg.Data) >= len(body)/4 {
+			t.Fatalf("expected an encrypted s2 payload on the wire, got %q under %q with %d bytes", ContentEncoding(msg), EncryptionKeyID(msg), len(msg.Data))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not seen on the wire")
+	}
+
+	// Requesters that do not compress get plain replies
+	plainSubscriber := NewSubscriberFromConn(nc)
+	plainSubscriber.SetCompressor(gzipCompressor)
+	if _, err := plainSubscriber.SubscribeReply("reports.echo", func(msg *models.Message) (*models.Message, error) {
+		return models.NewMessage(msg.Subject, msg.Body), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := NewPublisherFromConn(nc).RequestMessageCtx(ctx, models.NewMessage("reports.echo", body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.Body != body || plain.Headers[ContentEncodingHeader] != nil {
+		t.Fatalf("expected an uncompressed reply, got %d bytes, encoding %v", len(plain.Body), plain.Headers[ContentEncodingHeader])
+	}
+}
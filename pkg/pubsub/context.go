@@ -0,0 +1,52 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// DeadlineHeader carries the requester's deadline, so responders can stop working on a
+// request nobody is waiting for anymore
+const DeadlineHeader = "Request-Deadline"
+
+// DefaultFlushTimeout bounds flushes and subscription setup whose context has no deadline
+const DefaultFlushTimeout = 10 * time.Second
+
+// SetDeadline copies the context's deadline, if any, into the message headers
+func SetDeadline(ctx context.Context, msg *nats.Msg) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	SetHeader(msg, DeadlineHeader, deadline.UTC().Format(time.RFC3339Nano))
+}
+
+// ContextFromMsg derives a context from parent that ends at the deadline set by the requester
+// with SetDeadline. Messages without a valid deadline get a plain cancellable context.
+func ContextFromMsg(parent context.Context, msg *nats.Msg) (context.Context, context.CancelFunc) {
+	if msg.Header != nil {
+		if deadline, err := time.Parse(time.RFC3339Nano, msg.Header.Get(DeadlineHeader)); err == nil {
+			return context.WithDeadline(parent, deadline)
+		}
+	}
+	return context.WithCancel(parent)
+}
+
+// boundedContext gives ctx a DefaultFlushTimeout deadline unless it already has one, as
+// NATS flushes require a deadline
+func boundedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, DefaultFlushTimeout)
+}
+
+// flushContext waits for the server to process everything sent so far, bounded by ctx or,
+// when ctx has no deadline, by DefaultFlushTimeout
+func flushContext(ctx context.Context, nc *nats.Conn) error {
+	ctx, cancel := boundedContext(ctx)
+	defer cancel()
+	return nc.FlushWithContext(ctx)
+}
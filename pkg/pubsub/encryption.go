@@ -0,0 +1,138 @@
+package pubsub
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/nats-io/nats.go"
+)
+
+// EncryptionKeyIDHeader names the key the payload of an encrypted message was sealed with, so
+// receivers holding several keys during a rotation pick the right one
+const EncryptionKeyIDHeader = "Encryption-Key-Id"
+
+// Errors of Decrypt
+var (
+	ErrNotEncrypted         = errors.New("message is not encrypted")
+	ErrUnknownEncryptionKey = errors.New("unknown encryption key")
+	ErrDecryption           = errors.New("payload decryption failed")
+)
+
+// Encrypter seals message payloads with AES-GCM under shared keys, for NATS clusters shared
+// with other teams, whose subscribers should not read the payloads. Each payload gets a random
+// nonce and is bound to the message's Request-Id, so a reply cannot pass for the reply to
+// another request. Headers are not encrypted.
+//
+// Messages are encrypted with the current key and decrypted with whichever key their
+// EncryptionKeyIDHeader names. To rotate, add the new key to every receiver first, then make
+// it the current key of the senders, and drop the old one once no message uses it.
+type Encrypter struct {
+	current  string
+	keys     map[string]cipher.AEAD
+	required bool
+}
+
+// NewEncrypter creates an encrypter with keys by ID, each 16, 24 or 32 bytes long for
+// AES-128, AES-192 or AES-256, encrypting with the current one. With required set, messages
+// without EncryptionKeyIDHeader are refused; otherwise they pass as they are, e.g. while
+// senders are being switched to encryption.
+func NewEncrypter(current string, keys map[string][]byte, required bool) (*Encrypter, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("%w: no key with the current ID %q", ErrUnknownEncryptionKey, current)
+	}
+	e := &Encrypter{current: current, keys: make(map[string]cipher.AEAD, len(keys)), required: required}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		e.keys[id] = aead
+	}
+	return e, nil
+}
+
+// KeyID returns the ID of the key new messages are encrypted with
+func (e *Encrypter) KeyID() string {
+	return e.current
+}
+
+// KeyIDs returns the IDs of the keys messages can be decrypted with, sorted
+func (e *Encrypter) KeyIDs() []string {
+	ids := make([]string, 0, len(e.keys))
+	for id := range e.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Encrypt replaces the payload with its ciphertext under the current key and sets
+// EncryptionKeyIDHeader. Set the Request-Id header first, as the ciphertext is bound to it, and
+// sign the message before, so the signature covers the plaintext.
+func (e *Encrypter) Encrypt(msg *nats.Msg) error {
+	return e.EncryptWithKey(msg, e.current)
+}
+
+// EncryptWithKey encrypts the payload like Encrypt, under the key with the given ID, e.g. a
+// reply under the key of its request, which the requester is sure to hold
+func (e *Encrypter) EncryptWithKey(msg *nats.Msg, keyID string) error {
+	aead, ok := e.keys[keyID]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownEncryptionKey, keyID)
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(msg.Data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	msg.Data = aead.Seal(nonce, nonce, msg.Data, additionalData(msg, keyID))
+	SetHeader(msg, EncryptionKeyIDHeader, keyID)
+	return nil
+}
+
+// Decrypt replaces the ciphertext of an encrypted message with its payload and removes
+// EncryptionKeyIDHeader, so the message can be handled, and dead-lettered, as if it had never
+// been encrypted. It returns the ID of the key, empty for messages passed as they are.
+func (e *Encrypter) Decrypt(msg *nats.Msg) (string, error) {
+	keyID := EncryptionKeyID(msg)
+	if keyID == "" {
+		if e.required {
+			return "", ErrNotEncrypted
+		}
+		return "", nil
+	}
+	aead, ok := e.keys[keyID]
+	if !ok {
+		return keyID, fmt.Errorf("%w %q", ErrUnknownEncryptionKey, keyID)
+	}
+	if len(msg.Data) < aead.NonceSize() {
+		return keyID, ErrDecryption
+	}
+	nonce, ciphertext := msg.Data[:aead.NonceSize()], msg.Data[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, ciphertext, additionalData(msg, keyID))
+	if err != nil {
+		return keyID, ErrDecryption
+	}
+	msg.Data = data
+	msg.Header.Del(EncryptionKeyIDHeader)
+	return keyID, nil
+}
+
+// EncryptionKeyID returns the EncryptionKeyIDHeader, or an empty string for messages that are
+// not encrypted
+func EncryptionKeyID(msg *nats.Msg) string {
+	return header(msg, EncryptionKeyIDHeader)
+}
+
+// additionalData returns what the ciphertext of a message is bound to besides its payload
+func additionalData(msg *nats.Msg, keyID string) []byte {
+	return []byte(keyID + "\n" + RequestID(msg))
+}
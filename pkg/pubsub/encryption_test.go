@@ -0,0 +1,125 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+func newTestEncrypter(t *testing.T, current string, required bool) *Encrypter {
+	t.Helper()
+	e, err := NewEncrypter(current, map[string][]byte{
+		"2026-09": bytes.Repeat([]byte{1}, 32),
+		"2026-10": bytes.Repeat([]byte{2}, 32),
+	}, required)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEncryptAndDecrypt(t *testing.T) {
+	sender := newTestEncrypter(t, "2026-09", false)
+	receiver := newTestEncrypter(t, "2026-10", true)
+	payload := []byte(`{"client_id":"a","client_secret":"s3cret"}`)
+
+	newEncrypted := func() *nats.Msg {
+		msg := NewRequestMsg(&nats.Conn{}, "token.request", "req-1", append([]byte(nil), payload...))
+		if err := sender.Encrypt(msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	// Receivers holding the previous key still read messages encrypted with it
+	msg := newEncrypted()
+	if bytes.Contains(msg.Data, []byte("s3cret")) || EncryptionKeyID(msg) != "2026-09" {
+		t.Fatalf("expected a ciphertext under 2026-09, got %q with key %q", msg.Data, EncryptionKeyID(msg))
+	}
+	keyID, err := receiver.Decrypt(msg)
+	if err != nil || keyID != "2026-09" || !bytes.Equal(msg.Data, payload) {
+		t.Fatalf("expected the payload back, got %q with key %q: %v", msg.Data, keyID, err)
+	}
+	if EncryptionKeyID(msg) != "" {
+		t.Fatal("expected the key ID header to be removed")
+	}
+
+	// The ciphertext is bound to its payload, key and request ID
+	for name, tamper := range map[string]func(*nats.Msg){
+		"payload":    func(m *nats.Msg) { m.Data[len(m.Data)-1] ^= 1 },
+		"request ID": func(m *nats.Msg) { SetRequestID(m, "req-2") },
+		"key":        func(m *nats.Msg) { m.Header.Set(EncryptionKeyIDHeader, "2026-10") },
+	} {
+		msg := newEncrypted()
+		tamper(msg)
+		if _, err := receiver.Decrypt(msg); !errors.Is(err, ErrDecryption) {
+			t.Errorf("%s: expected decryption to fail, got %v", name, err)
+		}
+	}
+
+	msg = newEncrypted()
+	msg.Header.Set(EncryptionKeyIDHeader, "2026-08")
+	if _, err := receiver.Decrypt(msg); !errors.Is(err, ErrUnknownEncryptionKey) {
+		t.Fatalf("expected an unknown key, got %v", err)
+	}
+
+	// Plain messages pass unless encryption is required
+	plain := &nats.Msg{Subject: "token.request", Data: payload}
+	if _, err := sender.Decrypt(plain); err != nil || !bytes.Equal(plain.Data, payload) {
+		t.Fatalf("expected a plain message to pass, got %v", err)
+	}
+	if _, err := receiver.Decrypt(plain); !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("expected a plain message to be refused, got %v", err)
+	}
+
+	if _, err := NewEncrypter("missing", map[string][]byte{"a": make([]byte, 32)}, false); !errors.Is(err, ErrUnknownEncryptionKey) {
+		t.Fatalf("expected a missing current key to be refused, got %v", err)
+	}
+	if _, err := NewEncrypter("a", map[string][]byte{"a": make([]byte, 10)}, false); err == nil {
+		t.Fatal("expected a 10-byte key to be refused")
+	}
+}
+
+func TestEncryptedRequestReply(t *testing.T) {
+	nc := connectTestServer(t)
+	observed, err := nc.SubscribeSync("orders.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber := NewSubscriberFromConn(nc)
+	subscriber.SetEncrypter(newTestEncrypter(t, "2026-10", true))
+	if _, err := subscriber.SubscribeReply("orders.check", func(msg *models.Message) (*models.Message, error) {
+		return models.NewMessage(msg.Subject, "ok:"+msg.Body), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := NewPublisherFromConn(nc)
+	publisher.SetEncrypter(newTestEncrypter(t, "2026-09", true))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request := models.NewMessage("orders.check", "secret order")
+	request.Headers = nats.Header{RequestIDHeader: []string{"req-1"}}
+	reply, err := publisher.RequestMessageCtx(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Body != "ok:secret order" {
+		t.Fatalf("expected the decrypted reply, got %+v", reply)
+	}
+
+	// Other subscribers on the subject only see the ciphertext
+	seen, err := observed.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(seen.Data, []byte("secret order")) || EncryptionKeyID(seen) != "2026-09" {
+		t.Fatalf("expected an encrypted request, got %q", seen.Data)
+	}
+}
@@ -0,0 +1,79 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Gather sends a request to every responder on subject and collects their replies on a unique
+// inbox until maxResponses arrived, the window closed or ctx is done, e.g. to ask each
+// instance of a service for its status. A maxResponses of 0 collects every reply within the
+// window. msg carries the payload and headers and may be nil for an empty request; its
+// subject and reply are set by Gather. The window's end is passed to the responders in the
+// DeadlineHeader.
+//
+// Reaching the count or the end of the window is not an error. When ctx ends first, the
+// replies received so far are returned with the context's error, and when nobody is
+// subscribed to subject, the error is nats.ErrNoResponders.
+func Gather(ctx context.Context, nc *nats.Conn, subject string, msg *nats.Msg, maxResponses int, window time.Duration) ([]*nats.Msg, error) {
+	return gather(ctx, nc, nil, subject, msg, maxResponses, window)
+}
+
+// Gather sends a request to every responder on subject and collects their replies, signing the
+// request if a signer is set; see the Gather function
+func (p *NATSPublisher) Gather(ctx context.Context, subject string, msg *nats.Msg, maxResponses int, window time.Duration) ([]*nats.Msg, error) {
+	return gather(ctx, p.conn, p.signer, subject, msg, maxResponses, window)
+}
+
+// gather implements Gather with an optional signer
+func gather(ctx context.Context, nc *nats.Conn, signer MessageSigner, subject string, msg *nats.Msg, maxResponses int, window time.Duration) ([]*nats.Msg, error) {
+	if msg == nil {
+		msg = &nats.Msg{}
+	}
+	windowCtx, cancel := context.WithTimeout(ctx, window)
+	defer cancel()
+
+	inbox := nc.NewRespInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to reply inbox: %w", err)
+	}
+	defer sub.Unsubscribe()
+
+	msg.Subject = subject
+	msg.Reply = inbox
+	SetDeadline(windowCtx, msg)
+	if signer != nil {
+		if err := signer.Sign(msg); err != nil {
+			return nil, err
+		}
+	}
+	if err := nc.PublishMsg(msg); err != nil {
+		return nil, fmt.Errorf("failed to publish request: %w", err)
+	}
+
+	var replies []*nats.Msg
+	for maxResponses <= 0 || len(replies) < maxResponses {
+		reply, err := sub.NextMsgWithContext(windowCtx)
+		if err != nil {
+			// The window closing ends the collection, the caller's context ending cuts it short
+			if ctx.Err() != nil {
+				return replies, ctx.Err()
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				break
+			}
+			// The server's no-responders status means nobody is subscribed to the subject
+			if errors.Is(err, nats.ErrNoResponders) {
+				return replies, nats.ErrNoResponders
+			}
+			return replies, fmt.Errorf("failed to receive reply: %w", err)
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
@@ -0,0 +1,63 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestGather(t *testing.T) {
+	nc := connectTestServer(t)
+	for i := 1; i <= 3; i++ {
+		name := fmt.Sprintf("worker-%d", i)
+		if _, err := nc.Subscribe("status.workers", func(msg *nats.Msg) {
+			if msg.Header.Get(DeadlineHeader) == "" {
+				name = "no deadline"
+			}
+			msg.Respond([]byte(name))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Without a count every reply within the window is collected
+	replies, err := Gather(ctx, nc, "status.workers", nil, 0, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, reply := range replies {
+		seen[string(reply.Data)] = true
+	}
+	if len(replies) != 3 || !seen["worker-1"] || !seen["worker-2"] || !seen["worker-3"] {
+		t.Fatalf("expected a reply from each worker, got %d: %v", len(replies), seen)
+	}
+
+	// Reaching the count returns without waiting for the window
+	start := time.Now()
+	replies, err = NewPublisherFromConn(nc).Gather(ctx, "status.workers", &nats.Msg{Data: []byte("?")}, 2, 10*time.Second)
+	if err != nil || len(replies) != 2 {
+		t.Fatalf("expected 2 replies, got %d, %v", len(replies), err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("expected Gather to return once the count was reached")
+	}
+
+	if _, err := Gather(ctx, nc, "status.nobody", nil, 0, time.Second); !errors.Is(err, nats.ErrNoResponders) {
+		t.Fatalf("expected no responders, got %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := Gather(cancelled, nc, "status.workers", nil, 0, time.Second); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the context's error, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package pubsub
+
+import "github.com/nats-io/nats.go"
+
+// Standard headers of requests between the binaries. They carry the request's metadata
+// outside the payload, so intermediaries such as tap, the monitor or `nats sub` can show and
+// filter on it without decoding the body.
+const (
+	// RequestIDHeader identifies a request in the logs of every binary that handles it. Replies
+	// carry the ID of their request.
+	RequestIDHeader = "Request-Id"
+	// ClientNameHeader names the application that sent the request, e.g. brain-app/v1.2.0
+	ClientNameHeader = "Client-Name"
+	// TraceParentHeader is the W3C trace context of the request, written by the tracing
+	// package's propagators
+	TraceParentHeader = "traceparent"
+)
+
+// SetHeader sets a header, creating the message's headers if needed. Empty values are not set.
+func SetHeader(msg *nats.Msg, key, value string) {
+	if value == "" {
+		return
+	}
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	msg.Header.Set(key, value)
+}
+
+// header returns the first value of a header, or an empty string
+func header(msg *nats.Msg, key string) string {
+	if msg.Header == nil {
+		return ""
+	}
+	return msg.Header.Get(key)
+}
+
+// SetRequestID sets the Request-Id header
+func SetRequestID(msg *nats.Msg, id string) {
+	SetHeader(msg, RequestIDHeader, id)
+}
+
+// RequestID returns the Request-Id header, or an empty string
+func RequestID(msg *nats.Msg) string {
+	return header(msg, RequestIDHeader)
+}
+
+// SetClientName sets the Client-Name header
+func SetClientName(msg *nats.Msg, name string) {
+	SetHeader(msg, ClientNameHeader, name)
+}
+
+// ClientName returns the Client-Name header, or an empty string
+func ClientName(msg *nats.Msg) string {
+	return header(msg, ClientNameHeader)
+}
+
+// TraceParent returns the traceparent header, or an empty string
+func TraceParent(msg *nats.Msg) string {
+	return header(msg, TraceParentHeader)
+}
+
+// NewRequestMsg creates a request carrying the request ID and the name of the connection it
+// is sent on, which natsutil.Connect sets to the binary's name and version
+func NewRequestMsg(nc *nats.Conn, subject, requestID string, data []byte) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	SetRequestID(msg, requestID)
+	SetClientName(msg, nc.Opts.Name)
+	return msg
+}
+
+// NewReplyMsg creates a reply to request, carrying its request ID
+func NewReplyMsg(request *nats.Msg, data []byte) *nats.Msg {
+	reply := &nats.Msg{Data: data}
+	SetRequestID(reply, RequestID(request))
+	return reply
+}
@@ -0,0 +1,29 @@
+package pubsub
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestRequestMetadataHeaders(t *testing.T) {
+	nc := &nats.Conn{Opts: nats.Options{Name: "brain-app/v1.0.0"}}
+	request := NewRequestMsg(nc, "token.request", "req-1", []byte(`{}`))
+	if RequestID(request) != "req-1" || ClientName(request) != "brain-app/v1.0.0" {
+		t.Fatalf("expected the request ID and client name in the headers, got %v", request.Header)
+	}
+
+	reply := NewReplyMsg(request, []byte(`{}`))
+	if RequestID(reply) != "req-1" || ClientName(reply) != "" {
+		t.Fatalf("expected the reply to carry only the request ID, got %v", reply.Header)
+	}
+
+	// Messages without headers, e.g. from requesters that put the ID in the body
+	bare := &nats.Msg{Subject: "token.request"}
+	if RequestID(bare) != "" || TraceParent(bare) != "" {
+		t.Fatal("expected empty values for missing headers")
+	}
+	if reply := NewReplyMsg(bare, nil); reply.Header != nil {
+		t.Fatalf("expected no headers on the reply, got %v", reply.Header)
+	}
+}
@@ -0,0 +1,224 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+// JetStreamOptions configures a JetStreamPublisher
+type JetStreamOptions struct {
+	// Stream is created with Subjects when it does not exist yet; empty skips auto-creation
+	Stream   string
+	Subjects []string
+	Storage  nats.StorageType
+	MaxAge   time.Duration
+
+	// AckWait bounds how long a synchronous publish waits for the stream's ack
+	AckWait time.Duration
+	// MaxPending limits async publishes awaiting an ack; further publishes block until acks arrive
+	MaxPending int
+}
+
+// DefaultAckWait is used when JetStreamOptions.AckWait is not set
+const DefaultAckWait = 5 * time.Second
+
+// AckResult is the outcome of an async publish once the stream answered
+type AckResult struct {
+	ID  string
+	Ack *nats.PubAck
+	Err error
+}
+
+// JetStreamPublisher publishes through JetStream, so messages are stored in a stream and
+// acknowledged by the server instead of being dropped when no subscriber is online. Publishing
+// a Message sets its ID as Nats-Msg-Id, which lets the stream discard retried duplicates.
+type JetStreamPublisher struct {
+	*NATSPublisher
+	js      nats.JetStreamContext
+	ackWait time.Duration
+
+	mu      sync.Mutex
+	pending map[string]nats.PubAckFuture
+}
+
+// NewJetStreamPublisher wraps a publisher, sending its publishes to JetStream. Requests,
+// signing, encryption, Flush and Close are those of the wrapped publisher.
+func NewJetStreamPublisher(publisher *NATSPublisher, opts JetStreamOptions) (*JetStreamPublisher, error) {
+	var jsOpts []nats.JSOpt
+	if opts.MaxPending > 0 {
+		jsOpts = append(jsOpts, nats.PublishAsyncMaxPending(opts.MaxPending))
+	}
+	js, err := publisher.Conn().JetStream(jsOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JetStream context: %w", err)
+	}
+
+	p := &JetStreamPublisher{
+		NATSPublisher: publisher,
+		js:            js,
+		ackWait:       opts.AckWait,
+		pending:       make(map[string]nats.PubAckFuture),
+	}
+	if p.ackWait <= 0 {
+		p.ackWait = DefaultAckWait
+	}
+
+	if opts.Stream != "" {
+		if err := p.ensureStream(opts); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// ensureStream creates the configured stream unless it already exists
+func (p *JetStreamPublisher) ensureStream(opts JetStreamOptions) error {
+	_, err := p.js.StreamInfo(opts.Stream)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		return fmt.Errorf("failed to look up stream %s: %w", opts.Stream, err)
+	}
+
+	_, err = p.js.AddStream(&nats.StreamConfig{
+		Name:     opts.Stream,
+		Subjects: opts.Subjects,
+		Storage:  opts.Storage,
+		MaxAge:   opts.MaxAge,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create stream %s: %w", opts.Stream, err)
+	}
+	return nil
+}
+
+// JetStream returns the underlying JetStream context
+func (p *JetStreamPublisher) JetStream() nats.JetStreamContext {
+	return p.js
+}
+
+// Publish stores a raw byte message in the stream bound to the subject and waits for the ack
+func (p *JetStreamPublisher) Publish(subject string, data []byte) error {
+	return p.PublishCtx(context.Background(), subject, data)
+}
+
+// PublishCtx stores a raw byte message and waits for the ack until ctx is done
+func (p *JetStreamPublisher) PublishCtx(ctx context.Context, subject string, data []byte) error {
+	return p.PublishMsgCtx(ctx, &nats.Msg{Subject: subject, Data: data})
+}
+
+// PublishMsg stores a NATS message and waits for the ack, signing and encrypting it if a
+// signer and an encrypter are set
+func (p *JetStreamPublisher) PublishMsg(msg *nats.Msg) error {
+	return p.PublishMsgCtx(context.Background(), msg)
+}
+
+// PublishMsgCtx stores a NATS message and waits for the ack until ctx is done
+func (p *JetStreamPublisher) PublishMsgCtx(ctx context.Context, msg *nats.Msg) error {
+	_, err := p.PublishMsgAckCtx(ctx, msg)
+	return err
+}
+
+// PublishMessage stores a Message, deduplicated by its ID, and waits for the ack
+func (p *JetStreamPublisher) PublishMessage(msg *models.Message) error {
+	return p.PublishMessageCtx(context.Background(), msg)
+}
+
+// PublishMessageCtx stores a Message, deduplicated by its ID, and waits for the ack until ctx is done
+func (p *JetStreamPublisher) PublishMessageCtx(ctx context.Context, msg *models.Message) error {
+	_, err := p.PublishMessageAckCtx(ctx, msg)
+	return err
+}
+
+// PublishMsgAck stores a NATS message and returns the stream's ack
+func (p *JetStreamPublisher) PublishMsgAck(msg *nats.Msg) (*nats.PubAck, error) {
+	return p.PublishMsgAckCtx(context.Background(), msg)
+}
+
+// PublishMsgAckCtx stores a NATS message and returns the stream's ack, waiting until ctx is
+// done or, when ctx has no deadline, for AckWait
+func (p *JetStreamPublisher) PublishMsgAckCtx(ctx context.Context, msg *nats.Msg) (*nats.PubAck, error) {
+	if err := p.seal(msg); err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.ackWait)
+		defer cancel()
+	}
+	return p.js.PublishMsg(msg, nats.Context(ctx))
+}
+
+// PublishMessageAck stores a Message and returns the stream's ack, which reports a
+// duplicate when the ID was already stored within the stream's duplicate window
+func (p *JetStreamPublisher) PublishMessageAck(msg *models.Message) (*nats.PubAck, error) {
+	return p.PublishMessageAckCtx(context.Background(), msg)
+}
+
+// PublishMessageAckCtx stores a Message and returns the stream's ack, waiting until ctx is done
+func (p *JetStreamPublisher) PublishMessageAckCtx(ctx context.Context, msg *models.Message) (*nats.PubAck, error) {
+	natsMsg, err := toNATSMsg(msg)
+	if err != nil {
+		return nil, err
+	}
+	natsMsg.Header.Set(nats.MsgIdHdr, msg.ID)
+	return p.PublishMsgAckCtx(ctx, natsMsg)
+}
+
+// PublishMessageAsync stores a Message without waiting for the ack. The ack is tracked under
+// the message ID until it is collected by WaitForAcks.
+func (p *JetStreamPublisher) PublishMessageAsync(msg *models.Message) error {
+	natsMsg, err := toNATSMsg(msg)
+	if err != nil {
+		return err
+	}
+	natsMsg.Header.Set(nats.MsgIdHdr, msg.ID)
+	if err := p.seal(natsMsg); err != nil {
+		return err
+	}
+
+	future, err := p.js.PublishMsgAsync(natsMsg)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.pending[msg.ID] = future
+	p.mu.Unlock()
+	return nil
+}
+
+// Pending returns the number of async publishes still waiting for the stream's ack
+func (p *JetStreamPublisher) Pending() int {
+	return p.js.PublishAsyncPending()
+}
+
+// WaitForAcks collects the acks of all tracked async publishes, waiting until each one is
+// acked or failed or ctx is done. Publishes still unanswered when ctx ends are reported with
+// the context's error and are no longer tracked.
+func (p *JetStreamPublisher) WaitForAcks(ctx context.Context) []AckResult {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = make(map[string]nats.PubAckFuture)
+	p.mu.Unlock()
+
+	results := make([]AckResult, 0, len(pending))
+	for id, future := range pending {
+		result := AckResult{ID: id}
+		select {
+		case result.Ack = <-future.Ok():
+		case result.Err = <-future.Err():
+		case <-ctx.Done():
+			result.Err = ctx.Err()
+		}
+		results = append(results, result)
+	}
+	return results
+}
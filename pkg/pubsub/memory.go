@@ -0,0 +1,459 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+// Requester sends a request and waits for its reply until ctx is done. *nats.Conn implements
+// it, and so does MemoryBus, so code that only sends requests can be tested without a server.
+type Requester interface {
+	RequestMsgWithContext(ctx context.Context, msg *nats.Msg) (*nats.Msg, error)
+}
+
+// The NATS connection and the in-memory bus satisfy Requester, and the bus Publisher
+var (
+	_ Requester = (*nats.Conn)(nil)
+	_ Requester = (*MemoryBus)(nil)
+	_ Publisher = (*MemoryBus)(nil)
+)
+
+// memoryInboxPrefix starts the reply subjects of the requests sent on a MemoryBus
+const memoryInboxPrefix = "_INBOX.memory."
+
+// MemoryBus is an in-process message bus for unit tests of publishers, subscribers and request
+// handlers, with no NATS server. Subjects, wildcards, queue groups and request/reply behave
+// like core NATS, and delivery is deterministic: a publish runs the handlers of every matching
+// subscription, in the order they subscribed, before it returns, and each queue group takes
+// turns between its members in the same order. Handlers may publish and send requests
+// themselves. Signing, encryption, compression, chunking, middleware and JetStream are not
+// supported.
+//
+// MemoryBus implements Publisher and Requester. It does not implement Subscriber, whose
+// methods return *nats.Subscription, which only a connection can create; it offers the core
+// NATS subscriptions with the same handlers instead, returning a *MemorySubscription.
+type MemoryBus struct {
+	mu      sync.Mutex
+	subs    []*MemorySubscription
+	turns   map[string]int // next member of each queue group, by subject and queue
+	inboxes int
+	closed  bool
+	onError ErrorHandler
+}
+
+// MemorySubscription is a subscription on a MemoryBus
+type MemorySubscription struct {
+	Subject string
+	Queue   string
+
+	bus       *MemoryBus
+	pattern   []string
+	handler   nats.MsgHandler
+	delivered int64 // guarded by bus.mu
+	closed    bool  // guarded by bus.mu
+}
+
+// NewMemoryBus creates an empty in-memory bus
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{turns: make(map[string]int)}
+}
+
+// SetErrorHandler receives the errors of the handlers and the messages that could not be
+// decoded, which are otherwise dropped
+func (b *MemoryBus) SetErrorHandler(handler ErrorHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onError = handler
+}
+
+// Publish delivers a raw byte message to the subscriptions matching subject
+func (b *MemoryBus) Publish(subject string, data []byte) error {
+	return b.PublishCtx(context.Background(), subject, data)
+}
+
+// PublishCtx delivers a raw byte message unless ctx is already done
+func (b *MemoryBus) PublishCtx(ctx context.Context, subject string, data []byte) error {
+	return b.PublishMsgCtx(ctx, &nats.Msg{Subject: subject, Data: data})
+}
+
+// PublishMsg delivers a NATS message including its headers
+func (b *MemoryBus) PublishMsg(msg *nats.Msg) error {
+	return b.PublishMsgCtx(context.Background(), msg)
+}
+
+// PublishMsgCtx delivers a NATS message unless ctx is already done. Like a core NATS publish,
+// it succeeds whether or not anyone is subscribed.
+func (b *MemoryBus) PublishMsgCtx(ctx context.Context, msg *nats.Msg) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := b.deliver(msg)
+	return err
+}
+
+// PublishMessage serializes and delivers a Message, its headers as NATS headers
+func (b *MemoryBus) PublishMessage(msg *models.Message) error {
+	return b.PublishMessageCtx(context.Background(), msg)
+}
+
+// PublishMessageCtx serializes and delivers a Message unless ctx is already done
+func (b *MemoryBus) PublishMessageCtx(ctx context.Context, msg *models.Message) error {
+	natsMsg, err := toNATSMsg(msg)
+	if err != nil {
+		return err
+	}
+	return b.PublishMsgCtx(ctx, natsMsg)
+}
+
+// RequestMsg sends a request and waits for the reply within the timeout, like
+// nats.Conn.RequestMsg
+func (b *MemoryBus) RequestMsg(msg *nats.Msg, timeout time.Duration) (*nats.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	reply, err := b.RequestMsgWithContext(ctx, msg)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, nats.ErrTimeout
+	}
+	return reply, err
+}
+
+// RequestMsgWithContext sends a request and waits for the first reply until ctx is done. The
+// error is nats.ErrNoResponders when nothing is subscribed to the request's subject.
+func (b *MemoryBus) RequestMsgWithContext(ctx context.Context, msg *nats.Msg) (*nats.Msg, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	replies := make(chan *nats.Msg, 1)
+	inbox, err := b.subscribe(b.newInbox(), "", func(reply *nats.Msg) {
+		select {
+		case replies <- reply:
+		default:
+			// Only the first reply is returned
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer inbox.Unsubscribe()
+
+	request := copyMsg(msg)
+	request.Reply = inbox.Subject
+	responders, err := b.deliver(request)
+	if err != nil {
+		return nil, err
+	}
+	if responders == 0 {
+		return nil, nats.ErrNoResponders
+	}
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// RequestMessage sends a Message as a request and waits for a reply within the timeout
+func (b *MemoryBus) RequestMessage(msg *models.Message, timeout time.Duration) (*models.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	reply, err := b.RequestMessageCtx(ctx, msg)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, nats.ErrTimeout
+	}
+	return reply, err
+}
+
+// RequestMessageCtx sends a Message as a request and waits for a reply until ctx is done. The
+// context's deadline is passed to the responder in the DeadlineHeader.
+func (b *MemoryBus) RequestMessageCtx(ctx context.Context, msg *models.Message) (*models.Message, error) {
+	natsMsg, err := toNATSMsg(msg)
+	if err != nil {
+		return nil, err
+	}
+	SetDeadline(ctx, natsMsg)
+	resp, err := b.RequestMsgWithContext(ctx, natsMsg)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := fromNATSMsg(resp)
+	if err != nil {
+		// Non-JSON replies are still confirmations, keep the raw payload as the body
+		reply = &models.Message{Subject: resp.Subject, Body: string(resp.Data), Headers: resp.Header}
+	}
+	return reply, nil
+}
+
+// RespondMsg sends reply to the reply subject of request, standing in for
+// nats.Msg.RespondMsg, which needs a connection, in handlers under test
+func (b *MemoryBus) RespondMsg(request, reply *nats.Msg) error {
+	if request.Reply == "" {
+		return nats.ErrMsgNoReply
+	}
+	reply = copyMsg(reply)
+	reply.Subject = request.Reply
+	return b.PublishMsg(reply)
+}
+
+// Flush returns at once, as every publish is delivered before it returns, unless the bus is
+// closed
+func (b *MemoryBus) Flush(timeout time.Duration) error {
+	return b.FlushCtx(context.Background())
+}
+
+// FlushCtx is Flush unless ctx is already done
+func (b *MemoryBus) FlushCtx(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nats.ErrConnectionClosed
+	}
+	return nil
+}
+
+// Close ends every subscription; later publishes and subscriptions fail with
+// nats.ErrConnectionClosed
+func (b *MemoryBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.subs {
+		sub.closed = true
+	}
+	b.subs = nil
+	b.closed = true
+}
+
+// SubscribeMsg passes the messages on subject to a NATS message handler, e.g. a request
+// handler answering with RespondMsg
+func (b *MemoryBus) SubscribeMsg(subject string, handler nats.MsgHandler) (*MemorySubscription, error) {
+	return b.subscribe(subject, "", handler)
+}
+
+// QueueSubscribeMsg is SubscribeMsg as a member of a queue group
+func (b *MemoryBus) QueueSubscribeMsg(subject, queue string, handler nats.MsgHandler) (*MemorySubscription, error) {
+	return b.subscribe(subject, queue, handler)
+}
+
+// Subscribe passes the subject and payload of the messages on subject to handler, and its
+// errors to the error handler
+func (b *MemoryBus) Subscribe(subject string, handler RawMessageHandler) (*MemorySubscription, error) {
+	return b.subscribe(subject, "", b.rawCallback(handler))
+}
+
+// QueueSubscribe is Subscribe as a member of a queue group
+func (b *MemoryBus) QueueSubscribe(subject, queue string, handler RawMessageHandler) (*MemorySubscription, error) {
+	return b.subscribe(subject, queue, b.rawCallback(handler))
+}
+
+// SubscribeMessage decodes the messages on subject into Messages for handler. Messages that
+// cannot be decoded go to the error handler.
+func (b *MemoryBus) SubscribeMessage(subject string, handler MessageHandler) (*MemorySubscription, error) {
+	return b.subscribe(subject, "", b.messageCallback(handler))
+}
+
+// QueueSubscribeMessage is SubscribeMessage as a member of a queue group
+func (b *MemoryBus) QueueSubscribeMessage(subject, queue string, handler MessageHandler) (*MemorySubscription, error) {
+	return b.subscribe(subject, queue, b.messageCallback(handler))
+}
+
+// SubscribeReply decodes the requests on subject for handler and sends back the Message it
+// returns
+func (b *MemoryBus) SubscribeReply(subject string, handler ReplyHandler) (*MemorySubscription, error) {
+	return b.subscribe(subject, "", b.replyCallback(handler))
+}
+
+// QueueSubscribeReply is SubscribeReply as a member of a queue group
+func (b *MemoryBus) QueueSubscribeReply(subject, queue string, handler ReplyHandler) (*MemorySubscription, error) {
+	return b.subscribe(subject, queue, b.replyCallback(handler))
+}
+
+// rawCallback adapts a RawMessageHandler
+func (b *MemoryBus) rawCallback(handler RawMessageHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		if err := handler(msg.Subject, msg.Data); err != nil {
+			b.fail(msg, err)
+		}
+	}
+}
+
+// messageCallback adapts a MessageHandler
+func (b *MemoryBus) messageCallback(handler MessageHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		message, err := fromNATSMsg(msg)
+		if err != nil {
+			b.fail(msg, fmt.Errorf("invalid message: %w", err))
+			return
+		}
+		if err := handler(message); err != nil {
+			b.fail(msg, err)
+		}
+	}
+}
+
+// replyCallback adapts a ReplyHandler
+func (b *MemoryBus) replyCallback(handler ReplyHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		message, err := fromNATSMsg(msg)
+		if err != nil {
+			b.fail(msg, fmt.Errorf("invalid message: %w", err))
+			return
+		}
+		reply, err := handler(message)
+		if err != nil {
+			b.fail(msg, err)
+			return
+		}
+		if reply == nil || msg.Reply == "" {
+			// Nothing to send back
+			return
+		}
+		reply.Subject = msg.Reply
+		replyMsg, err := toNATSMsg(reply)
+		if err != nil {
+			b.fail(msg, err)
+			return
+		}
+		if err := b.PublishMsg(replyMsg); err != nil {
+			b.fail(msg, err)
+		}
+	}
+}
+
+// fail passes a message that could not be handled to the error handler, if any
+func (b *MemoryBus) fail(msg *nats.Msg, err error) {
+	b.mu.Lock()
+	onError := b.onError
+	b.mu.Unlock()
+	if onError != nil {
+		onError(msg, err)
+	}
+}
+
+// subscribe adds a subscription, in a queue group if queue is not empty
+func (b *MemoryBus) subscribe(subject, queue string, handler nats.MsgHandler) (*MemorySubscription, error) {
+	pattern, err := parsePattern(subject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", nats.ErrBadSubject, err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, nats.ErrConnectionClosed
+	}
+	sub := &MemorySubscription{Subject: subject, Queue: queue, bus: b, pattern: pattern, handler: handler}
+	b.subs = append(b.subs, sub)
+	return sub, nil
+}
+
+// deliver runs the handlers of the subscriptions matching the message's subject, one member
+// of each queue group, and returns how many ran
+func (b *MemoryBus) deliver(msg *nats.Msg) (int, error) {
+	if _, err := parsePattern(msg.Subject); err != nil || strings.ContainsAny(msg.Subject, "*>") {
+		return 0, nats.ErrBadSubject
+	}
+	subject := strings.Split(msg.Subject, ".")
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return 0, nats.ErrConnectionClosed
+	}
+	var targets []*MemorySubscription
+	groups := make(map[string][]*MemorySubscription)
+	var order []string
+	for _, sub := range b.subs {
+		if !matchTokens(sub.pattern, subject) {
+			continue
+		}
+		if sub.Queue == "" {
+			targets = append(targets, sub)
+			continue
+		}
+		key := sub.Subject + " " + sub.Queue
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], sub)
+	}
+	for _, key := range order {
+		members := groups[key]
+		targets = append(targets, members[b.turns[key]%len(members)])
+		b.turns[key]++
+	}
+	for _, sub := range targets {
+		sub.delivered++
+	}
+	b.mu.Unlock()
+
+	// Handlers run without the lock, so they can publish and subscribe
+	for _, sub := range targets {
+		sub.handler(copyMsg(msg))
+	}
+	return len(targets), nil
+}
+
+// newInbox returns a unique reply subject
+func (b *MemoryBus) newInbox() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inboxes++
+	return memoryInboxPrefix + strconv.Itoa(b.inboxes)
+}
+
+// Unsubscribe ends the subscription
+func (s *MemorySubscription) Unsubscribe() error {
+	b := s.bus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s.closed {
+		return nats.ErrBadSubscription
+	}
+	s.closed = true
+	for i, sub := range b.subs {
+		if sub == s {
+			b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// IsValid reports whether the subscription is still active
+func (s *MemorySubscription) IsValid() bool {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	return !s.closed
+}
+
+// Delivered returns the number of messages handed to the subscription's handler
+func (s *MemorySubscription) Delivered() int64 {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	return s.delivered
+}
+
+// copyMsg copies a message's subject, reply subject, headers and payload, so every handler
+// gets its own, like it would from a server
+func copyMsg(msg *nats.Msg) *nats.Msg {
+	c := &nats.Msg{Subject: msg.Subject, Reply: msg.Reply, Data: append([]byte(nil), msg.Data...)}
+	if msg.Header != nil {
+		c.Header = make(nats.Header, len(msg.Header))
+		for key, values := range msg.Header {
+			c.Header[key] = append([]string(nil), values...)
+		}
+	}
+	return c
+}
@@ -0,0 +1,145 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+func TestMemoryBusDelivery(t *testing.T) {
+	bus := NewMemoryBus()
+	var got []string
+	record := func(name string) RawMessageHandler {
+		return func(subject string, data []byte) error {
+			got = append(got, name+" "+subject+" "+string(data))
+			return nil
+		}
+	}
+	bus.Subscribe("orders.*", record("star"))
+	bus.Subscribe("orders.>", record("tail"))
+	bus.QueueSubscribe("orders.new", "workers", record("w1"))
+	bus.QueueSubscribe("orders.new", "workers", record("w2"))
+	bus.Subscribe("payments.new", record("payments"))
+
+	// Every publish is delivered before it returns, in subscription order, with the queue
+	// group taking turns
+	for _, data := range []string{"1", "2", "3"} {
+		if err := bus.Publish("orders.new", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bus.Publish("orders.eu.new", []byte("4"))
+
+	want := []string{
+		"star orders.new 1", "tail orders.new 1", "w1 orders.new 1",
+		"star orders.new 2", "tail orders.new 2", "w2 orders.new 2",
+		"star orders.new 3", "tail orders.new 3", "w1 orders.new 3",
+		"tail orders.eu.new 4",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected deliveries:\n%s", strings.Join(got, "\n"))
+	}
+
+	if err := bus.Publish("orders.*", nil); !errors.Is(err, nats.ErrBadSubject) {
+		t.Fatalf("expected publishing to a wildcard to fail, got %v", err)
+	}
+}
+
+func TestMemoryBusMessages(t *testing.T) {
+	bus := NewMemoryBus()
+	var failures []string
+	bus.SetErrorHandler(func(msg *nats.Msg, err error) {
+		failures = append(failures, msg.Subject+": "+err.Error())
+	})
+
+	var received *models.Message
+	sub, err := bus.SubscribeMessage("events.>", func(m *models.Message) error {
+		received = m
+		if m.Body == "bad" {
+			return errors.New("rejected")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := models.NewMessage("events.created", "hello")
+	msg.Headers = map[string][]string{"Request-Id": {"req-1"}}
+	if err := bus.PublishMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if received == nil || received.Body != "hello" || received.Headers["Request-Id"][0] != "req-1" {
+		t.Fatalf("expected the message with its headers, got %+v", received)
+	}
+
+	bus.PublishMessage(models.NewMessage("events.created", "bad"))
+	bus.Publish("events.created", []byte("not a message"))
+	if len(failures) != 2 || failures[0] != "events.created: rejected" || !strings.HasPrefix(failures[1], "events.created: invalid message") {
+		t.Fatalf("expected the handler error and the undecodable message, got %q", failures)
+	}
+
+	if err := sub.Unsubscribe(); err != nil || sub.IsValid() || sub.Delivered() != 3 {
+		t.Fatalf("expected an ended subscription after 3 messages, got %d: %v", sub.Delivered(), err)
+	}
+	received = nil
+	bus.PublishMessage(msg)
+	if received != nil {
+		t.Fatal("expected no delivery after Unsubscribe")
+	}
+
+	bus.Close()
+	if err := bus.PublishMessage(msg); !errors.Is(err, nats.ErrConnectionClosed) {
+		t.Fatalf("expected a closed bus, got %v", err)
+	}
+}
+
+func TestMemoryBusRequestReply(t *testing.T) {
+	bus := NewMemoryBus()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := bus.RequestMsgWithContext(ctx, nats.NewMsg("echo")); !errors.Is(err, nats.ErrNoResponders) {
+		t.Fatalf("expected no responders, got %v", err)
+	}
+
+	bus.SubscribeReply("echo", func(m *models.Message) (*models.Message, error) {
+		reply := models.NewMessage("", "echo: "+m.Body)
+		reply.Headers = map[string][]string{DeadlineHeader: m.Headers[DeadlineHeader]}
+		return reply, nil
+	})
+	reply, err := bus.RequestMessageCtx(ctx, models.NewMessage("echo", "hi"))
+	if err != nil || reply.Body != "echo: hi" {
+		t.Fatalf("expected the echo, got %+v: %v", reply, err)
+	}
+	if reply.Headers[DeadlineHeader] == nil {
+		t.Fatal("expected the request to carry its deadline")
+	}
+
+	// Raw handlers answer with RespondMsg, like request handlers do with msg.RespondMsg
+	var requester Requester = bus
+	bus.QueueSubscribeMsg("token.request", "workers", func(msg *nats.Msg) {
+		reply := &nats.Msg{Data: []byte(`{"access_token":"t"}`)}
+		SetRequestID(reply, RequestID(msg))
+		if err := bus.RespondMsg(msg, reply); err != nil {
+			t.Error(err)
+		}
+	})
+	request := nats.NewMsg("token.request")
+	SetRequestID(request, "req-1")
+	resp, err := requester.RequestMsgWithContext(ctx, request)
+	if err != nil || string(resp.Data) != `{"access_token":"t"}` || RequestID(resp) != "req-1" {
+		t.Fatalf("expected the token reply, got %+v: %v", resp, err)
+	}
+
+	// A responder that never answers times out
+	bus.SubscribeMsg("silent", func(*nats.Msg) {})
+	if _, err := bus.RequestMsg(nats.NewMsg("silent"), 20*time.Millisecond); !errors.Is(err, nats.ErrTimeout) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+)
+
+// Middleware wraps a MessageHandler, e.g. to log, time or authorize the messages it handles
+type Middleware func(MessageHandler) MessageHandler
+
+// ErrHandlerPanic matches the PanicError of a message whose handler panicked
+var ErrHandlerPanic = errors.New("handler panicked")
+
+// PanicError is the reason a message fails when handling it panicked, with the panic value and
+// the stack of the panicking goroutine
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+// Error describes the panic without the stack, which is too long for log lines and headers
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrHandlerPanic, e.Value)
+}
+
+// Unwrap makes errors.Is(err, ErrHandlerPanic) match
+func (e *PanicError) Unwrap() error {
+	return ErrHandlerPanic
+}
+
+// Chain composes middleware into one, the first one outermost
+func Chain(middleware ...Middleware) Middleware {
+	return func(handler MessageHandler) MessageHandler {
+		return chain(handler, middleware)
+	}
+}
+
+// chain wraps handler in middleware, the first one outermost
+func chain(handler MessageHandler, middleware []Middleware) MessageHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Recover turns a panicking handler into a *PanicError, so the middleware around it sees the
+// failure. Subscribers recover from panics in their callbacks anyway; Recover is for handlers
+// used elsewhere, e.g. called directly through a SubjectMux.
+func Recover() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(msg *models.Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = &PanicError{Value: r, Stack: debug.Stack()}
+				}
+			}()
+			return next(msg)
+		}
+	}
+}
+
+// Logging logs each handled message with how long its handler took and the error, if any,
+// through logf, e.g. a logger's Debug method
+func Logging(logf func(format string, args ...interface{})) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(msg *models.Message) error {
+			start := time.Now()
+			err := next(msg)
+			if err != nil {
+				logf("Message %s on %s failed after %s: %v", msg.ID, msg.Subject, time.Since(start), err)
+			} else {
+				logf("Message %s on %s handled in %s", msg.ID, msg.Subject, time.Since(start))
+			}
+			return err
+		}
+	}
+}
+
+// MessageObserver receives the subject, handling time and outcome of each handled message
+type MessageObserver func(subject string, elapsed time.Duration, err error)
+
+// Metrics reports every handled message to observe, e.g. to count failures and record a
+// latency histogram by subject
+func Metrics(observe MessageObserver) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(msg *models.Message) error {
+			start := time.Now()
+			err := next(msg)
+			observe(msg.Subject, time.Since(start), err)
+			return err
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package pubsub
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+func TestMiddlewareChain(t *testing.T) {
+	var calls []string
+	tag := func(name string) Middleware {
+		return func(next MessageHandler) MessageHandler {
+			return func(msg *models.Message) error {
+				calls = append(calls, name)
+				return next(msg)
+			}
+		}
+	}
+
+	var observed error
+	handler := Chain(tag("outer"), Recover(), Metrics(func(subject string, elapsed time.Duration, err error) {
+		observed = err
+	}), tag("inner"))(func(*models.Message) error {
+		panic("boom")
+	})
+
+	err := handler(models.NewMessage("orders.new", "x"))
+	if !errors.Is(err, ErrHandlerPanic) || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("expected the panic as an error, got %v", err)
+	}
+	if strings.Join(calls, ",") != "outer,inner" {
+		t.Fatalf("expected the first middleware outermost, got %v", calls)
+	}
+	// Metrics sits inside Recover, so the panic passed through it unobserved
+	if observed != nil {
+		t.Fatalf("expected no observation, got %v", observed)
+	}
+}
+
+func TestSubscriberRecoversPanics(t *testing.T) {
+	nc := connectTestServer(t)
+	dead, err := nc.SubscribeSync("dead.orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber := NewSubscriberFromConn(nc, WithDeadLetter("dead.orders"), WithMiddleware(Recover()))
+	handled := make(chan string, 1)
+	if _, err := subscriber.Subscribe("orders.raw", func(subject string, data []byte) error {
+		if string(data) == "panic" {
+			panic("bad payload")
+		}
+		handled <- string(data)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range []string{"panic", "ok"} {
+		if err := nc.Publish("orders.raw", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The subscription survives the panic and keeps handling messages
+	select {
+	case data := <-handled:
+		if data != "ok" {
+			t.Fatalf("expected the second message, got %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the message after the panic to be handled")
+	}
+	letter, err := dead.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("expected the panicking message to be dead-lettered: %v", err)
+	}
+	if cause := letter.Header.Get(models.DeadLetterError); !strings.Contains(cause, "handler panicked: bad payload") {
+		t.Fatalf("expected the panic as the dead-letter reason, got %q", cause)
+	}
+	if string(letter.Data) != "panic" || letter.Header.Get(models.DeadLetterOriginalSubject) != "orders.raw" {
+		t.Fatalf("expected the original message, got %q on %v", letter.Data, letter.Header)
+	}
+}
+
+func TestSubscriberCallbacksRecoverPanics(t *testing.T) {
+	nc := connectTestServer(t)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	letters, err := nc.SubscribeSync("dead.orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The panic handler answers requests, so requesters do not wait for their timeout
+	var stacks atomic.Int64
+	subscriber := NewSubscriberFromConn(nc, WithDeadLetter("dead.orders"), WithPanicHandler(func(msg *nats.Msg, err *PanicError) {
+		if strings.Contains(string(err.Stack), "panic") {
+			stacks.Add(1)
+		}
+		if msg.Reply != "" {
+			msg.Respond([]byte("internal error"))
+		}
+	}))
+	subscriber.SetDurableOptions(DurableOptions{FilterSubject: "orders.>", MaxDeliver: 2})
+
+	if _, err := subscriber.SubscribeReply("prices.get", func(*models.Message) (*models.Message, error) {
+		var prices map[string]int
+		prices["unknown"]++ // nil map
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := NewPublisherFromConn(nc).RequestMessage(models.NewMessage("prices.get", "x"), time.Second)
+	if err != nil || reply.Body != "internal error" {
+		t.Fatalf("expected the panic handler's reply, got %v, %v", reply, err)
+	}
+
+	// A durable handler that keeps panicking is redelivered and then dead-lettered
+	var deliveries atomic.Int64
+	if _, err := subscriber.SubscribeDurableAck("ORDERS", "reader", func(m *AckableMessage) AckDecision {
+		deliveries.Add(1)
+		panic("malformed order")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewPublisherFromConn(nc).PublishMessage(models.NewMessage("orders.new", "x")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, subject := range []string{"prices.get", "orders.new"} {
+		letter, err := letters.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("expected a dead letter from %s: %v", subject, err)
+		}
+		if letter.Header.Get(models.DeadLetterOriginalSubject) != subject || !strings.Contains(letter.Header.Get(models.DeadLetterError), "handler panicked") {
+			t.Fatalf("expected the panic of %s as the dead-letter reason, got %v", subject, letter.Header)
+		}
+	}
+	if deliveries.Load() != 2 || subscriber.Panics() != 3 || stacks.Load() != 3 {
+		t.Fatalf("expected 2 deliveries and 3 panics with stacks, got %d, %d and %d", deliveries.Load(), subscriber.Panics(), stacks.Load())
+	}
+}
@@ -0,0 +1,238 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+// ErrNoRoute is the reason a message whose subject matches no route of a SubjectMux fails
+var ErrNoRoute = errors.New("no handler for subject")
+
+// SubjectMux routes messages received on a single wildcard subscription to handlers by subject
+// pattern, e.g. orders.*.created or telemetry.>. When several patterns match a subject, the
+// most specific one handles it: literal tokens win over *, and * wins over >, compared from
+// the first token on.
+type SubjectMux struct {
+	mu         sync.RWMutex
+	routes     []muxRoute
+	middleware []Middleware
+	notFound   MessageHandler
+}
+
+// muxRoute is a registered pattern with its handler, already wrapped in its own middleware
+type muxRoute struct {
+	pattern string
+	tokens  []string
+	handler MessageHandler
+}
+
+// NewSubjectMux creates a mux without routes
+func NewSubjectMux() *SubjectMux {
+	return &SubjectMux{}
+}
+
+// Use adds middleware that wraps every route, including those registered before, outside the
+// middleware of the route itself. The first middleware added is the outermost.
+func (m *SubjectMux) Use(middleware ...Middleware) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.middleware = append(m.middleware, middleware...)
+}
+
+// Handle routes messages whose subject matches pattern to handler, wrapped in the given
+// middleware, the first one outermost. Each pattern can be registered once.
+func (m *SubjectMux) Handle(pattern string, handler MessageHandler, middleware ...Middleware) error {
+	tokens, err := parsePattern(pattern)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, route := range m.routes {
+		if route.pattern == pattern {
+			return fmt.Errorf("pattern %q is already registered", pattern)
+		}
+	}
+	m.routes = append(m.routes, muxRoute{
+		pattern: pattern,
+		tokens:  tokens,
+		handler: chain(handler, middleware),
+	})
+	return nil
+}
+
+// NotFound handles messages that match no route, which otherwise fail with ErrNoRoute
+func (m *SubjectMux) NotFound(handler MessageHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notFound = handler
+}
+
+// Patterns returns the registered patterns in the order they were registered
+func (m *SubjectMux) Patterns() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	patterns := make([]string, len(m.routes))
+	for i, route := range m.routes {
+		patterns[i] = route.pattern
+	}
+	return patterns
+}
+
+// Subject returns a subject to subscribe to that covers every route: the tokens all patterns
+// share, followed by > where they differ, e.g. orders.> for orders.*.created and
+// orders.paid. A mux without routes returns >.
+func (m *SubjectMux) Subject() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.routes) == 0 {
+		return ">"
+	}
+
+	// The literal tokens every pattern starts with
+	prefix := m.routes[0].tokens
+	same := true
+	for _, route := range m.routes[1:] {
+		n := 0
+		for n < len(prefix) && n < len(route.tokens) && prefix[n] == route.tokens[n] {
+			n++
+		}
+		same = same && n == len(prefix) && n == len(route.tokens)
+		prefix = prefix[:n]
+	}
+	if same {
+		return m.routes[0].pattern
+	}
+	for i, token := range prefix {
+		if token == "*" || token == ">" {
+			prefix = prefix[:i]
+			break
+		}
+	}
+
+	// > needs at least one more token, so a pattern ending at the prefix needs a shorter one
+	for _, route := range m.routes {
+		if len(route.tokens) == len(prefix) && len(prefix) > 0 {
+			prefix = prefix[:len(prefix)-1]
+			break
+		}
+	}
+	if len(prefix) == 0 {
+		return ">"
+	}
+	return strings.Join(prefix, ".") + ".>"
+}
+
+// Dispatch hands a message received on subject to the handler of the most specific matching
+// route, wrapped in the mux's middleware
+func (m *SubjectMux) Dispatch(subject string, msg *models.Message) error {
+	m.mu.RLock()
+	handler := m.notFound
+	var best []string
+	subjectTokens := strings.Split(subject, ".")
+	for _, route := range m.routes {
+		if matchTokens(route.tokens, subjectTokens) && (best == nil || moreSpecific(route.tokens, best)) {
+			handler, best = route.handler, route.tokens
+		}
+	}
+	middleware := m.middleware
+	m.mu.RUnlock()
+
+	if handler == nil {
+		return fmt.Errorf("%w %s", ErrNoRoute, subject)
+	}
+	return chain(handler, middleware)(msg)
+}
+
+// SubscribeMux subscribes to subject, e.g. mux.Subject(), and routes every message to the
+// mux. Messages that match no route, fail validation or whose handler returns an error are
+// handled like those of SubscribeMessage.
+func (s *NATSSubscriber) SubscribeMux(subject string, mux *SubjectMux) (*nats.Subscription, error) {
+	return s.limit(s.conn.Subscribe(subject, s.muxCallback(mux)))
+}
+
+// QueueSubscribeMux subscribes to subject with a queue group and routes every message to the mux
+func (s *NATSSubscriber) QueueSubscribeMux(subject, queue string, mux *SubjectMux) (*nats.Subscription, error) {
+	return s.limit(s.conn.QueueSubscribe(subject, queue, s.muxCallback(mux)))
+}
+
+// muxCallback decodes messages and dispatches them by the subject they were received on
+func (s *NATSSubscriber) muxCallback(mux *SubjectMux) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		defer s.recoverPanic(msg, nil)
+		msg, ok := s.reassemble(msg)
+		if !ok || !s.accept(msg) {
+			return
+		}
+		message, ok := s.decode(msg)
+		if !ok {
+			return
+		}
+
+		dispatch := func(m *models.Message) error {
+			return mux.Dispatch(msg.Subject, m)
+		}
+		if err := s.handle(dispatch, message); err != nil {
+			s.fail(msg, err, 1)
+		}
+	}
+}
+
+// parsePattern splits a subject pattern into its tokens, checking that * and > are whole
+// tokens and that > is the last one
+func parsePattern(pattern string) ([]string, error) {
+	tokens := strings.Split(pattern, ".")
+	for i, token := range tokens {
+		switch {
+		case token == "" || strings.ContainsAny(token, " \t\r\n"):
+			return nil, fmt.Errorf("invalid subject pattern %q", pattern)
+		case token == ">" && i != len(tokens)-1:
+			return nil, fmt.Errorf("invalid subject pattern %q: > must be the last token", pattern)
+		case token != "*" && token != ">" && strings.ContainsAny(token, "*>"):
+			return nil, fmt.Errorf("invalid subject pattern %q: wildcards must be whole tokens", pattern)
+		}
+	}
+	return tokens, nil
+}
+
+// matchTokens reports whether a subject matches a pattern
+func matchTokens(pattern, subject []string) bool {
+	for i, token := range pattern {
+		if token == ">" {
+			return len(subject) > i
+		}
+		if i >= len(subject) || (token != "*" && token != subject[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(subject)
+}
+
+// moreSpecific reports whether pattern a is more specific than pattern b, both matching the
+// same subject
+func moreSpecific(a, b []string) bool {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		if ra, rb := tokenRank(a, i), tokenRank(b, i); ra != rb {
+			return ra > rb
+		}
+	}
+	return false
+}
+
+// tokenRank ranks the pattern token matching the i-th subject token: literal 2, * 1 and
+// > (including the tokens it covers) 0
+func tokenRank(pattern []string, i int) int {
+	if i >= len(pattern) || pattern[i] == ">" {
+		return 0
+	}
+	if pattern[i] == "*" {
+		return 1
+	}
+	return 2
+}
@@ -0,0 +1,145 @@
+package pubsub
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+)
+
+func TestSubjectMuxRouting(t *testing.T) {
+	mux := NewSubjectMux()
+	var routed string
+	for _, pattern := range []string{"orders.*.created", "orders.eu.created", "orders.>", "telemetry.>", "*.*.created"} {
+		pattern := pattern
+		if err := mux.Handle(pattern, func(*models.Message) error {
+			routed = pattern
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for subject, want := range map[string]string{
+		"orders.us.created":    "orders.*.created",
+		"orders.eu.created":    "orders.eu.created",
+		"orders.us.paid":       "orders.>",
+		"orders.us":            "orders.>",
+		"telemetry.cpu.host-1": "telemetry.>",
+		"users.us.created":     "*.*.created",
+	} {
+		routed = ""
+		if err := mux.Dispatch(subject, &models.Message{}); err != nil || routed != want {
+			t.Errorf("%s: expected %s, got %q, %v", subject, want, routed, err)
+		}
+	}
+
+	if err := mux.Dispatch("telemetry", &models.Message{}); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("expected no route for telemetry, got %v", err)
+	}
+	if err := mux.Handle("orders.>", func(*models.Message) error { return nil }); err == nil {
+		t.Error("expected a duplicate pattern to be refused")
+	}
+	for _, pattern := range []string{"orders..new", "orders.>.new", "orders.new*", ""} {
+		if err := mux.Handle(pattern, func(*models.Message) error { return nil }); err == nil {
+			t.Errorf("expected %q to be refused", pattern)
+		}
+	}
+}
+
+func TestSubjectMuxSubject(t *testing.T) {
+	for _, tc := range []struct {
+		patterns []string
+		want     string
+	}{
+		{nil, ">"},
+		{[]string{"orders.*.created"}, "orders.*.created"},
+		{[]string{"orders.*.created", "orders.*.paid"}, "orders.>"},
+		{[]string{"orders.eu.created", "orders.eu.paid"}, "orders.eu.>"},
+		{[]string{"orders.new", "orders"}, ">"},
+		{[]string{"orders.*.created", "telemetry.>"}, ">"},
+	} {
+		mux := NewSubjectMux()
+		for _, pattern := range tc.patterns {
+			if err := mux.Handle(pattern, func(*models.Message) error { return nil }); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := mux.Subject(); got != tc.want {
+			t.Errorf("%v: expected %s, got %s", tc.patterns, tc.want, got)
+		}
+	}
+}
+
+func TestSubscribeMux(t *testing.T) {
+	nc := connectTestServer(t)
+	dead, err := nc.SubscribeSync("dead.orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Record the order middleware runs in, around the handler of each route
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next MessageHandler) MessageHandler {
+			return func(msg *models.Message) error {
+				mu.Lock()
+				calls = append(calls, name)
+				mu.Unlock()
+				return next(msg)
+			}
+		}
+	}
+	handled := make(chan string, 2)
+
+	mux := NewSubjectMux()
+	mux.Use(record("log"))
+	if err := mux.Handle("orders.*.created", func(msg *models.Message) error {
+		handled <- msg.Body
+		return nil
+	}, record("auth")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mux.Handle("orders.*.paid", func(msg *models.Message) error {
+		handled <- msg.Body
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber := NewSubscriberFromConn(nc, WithDeadLetter("dead.orders"))
+	if _, err := subscriber.SubscribeMux(mux.Subject(), mux); err != nil {
+		t.Fatal(err)
+	}
+	publisher := NewPublisherFromConn(nc)
+	for _, subject := range []string{"orders.eu.created", "orders.eu.paid", "orders.eu.lost"} {
+		if err := publisher.PublishMessage(models.NewMessage(subject, subject)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("expected the created and paid messages to be handled")
+		}
+	}
+	letter, err := dead.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("expected the unrouted message to be dead-lettered: %v", err)
+	}
+	if cause := letter.Header.Get(models.DeadLetterError); !strings.Contains(cause, "orders.eu.lost") {
+		t.Fatalf("expected the dead letter to name the subject, got %q", cause)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(calls, ",") != "log,auth,log" {
+		t.Fatalf("expected the mux middleware around the route's, got %v", calls)
+	}
+}
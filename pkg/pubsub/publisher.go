@@ -2,7 +2,10 @@
 package pubsub
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/kiquetal/nats-go-examples/pkg/models"
@@ -13,12 +16,30 @@ import (
 type Publisher interface {
 	Publish(subject string, data []byte) error
 	PublishMessage(msg *models.Message) error
+	PublishMsg(msg *nats.Msg) error
+	RequestMessage(msg *models.Message, timeout time.Duration) (*models.Message, error)
+	Flush(timeout time.Duration) error
+	PublishCtx(ctx context.Context, subject string, data []byte) error
+	PublishMessageCtx(ctx context.Context, msg *models.Message) error
+	PublishMsgCtx(ctx context.Context, msg *nats.Msg) error
+	RequestMessageCtx(ctx context.Context, msg *models.Message) (*models.Message, error)
+	FlushCtx(ctx context.Context) error
 	Close()
 }
 
+// MessageSigner adds signature headers to outgoing messages
+type MessageSigner interface {
+	Sign(msg *nats.Msg) error
+}
+
 // NATSPublisher implements the Publisher interface using NATS
 type NATSPublisher struct {
-	conn *nats.Conn
+	conn       *nats.Conn
+	signer     MessageSigner
+	compressor *Compressor
+	encrypter  *Encrypter
+	chunking   bool
+	chunkSize  int // 0 for the server's max_payload
 }
 
 // NewPublisher creates a new NATS publisher
@@ -35,18 +56,216 @@ func NewPublisher(natsURL string, options ...nats.Option) (*NATSPublisher, error
 	return &NATSPublisher{conn: nc}, nil
 }
 
+// NewPublisherFromConn creates a publisher on an existing connection, which it closes on Close
+func NewPublisherFromConn(nc *nats.Conn) *NATSPublisher {
+	return &NATSPublisher{conn: nc}
+}
+
+// Conn returns the underlying NATS connection, e.g. to obtain a JetStream context
+func (p *NATSPublisher) Conn() *nats.Conn {
+	return p.conn
+}
+
+// SetSigner signs every outgoing message with the given signer
+func (p *NATSPublisher) SetSigner(signer MessageSigner) {
+	p.signer = signer
+}
+
+// SetEncrypter encrypts the payload of every outgoing message, after signing it, and
+// decrypts the replies to requests
+func (p *NATSPublisher) SetEncrypter(encrypter *Encrypter) {
+	p.encrypter = encrypter
+}
+
+// SetCompressor compresses the payload of every outgoing message above the compressor's
+// threshold, after signing and before encrypting it, and decompresses the replies to requests
+func (p *NATSPublisher) SetCompressor(compressor *Compressor) {
+	p.compressor = compressor
+}
+
+// EnableChunking splits messages larger than size bytes, or than the server's max_payload when
+// size is not positive, into chunks a subscriber with EnableReassembly puts back together.
+// Requests are chunked too, replies and JetStream publishes are not.
+func (p *NATSPublisher) EnableChunking(size int) {
+	p.chunking = true
+	p.chunkSize = size
+}
+
 // Publish sends a raw byte message to the specified subject
 func (p *NATSPublisher) Publish(subject string, data []byte) error {
+	return p.PublishCtx(context.Background(), subject, data)
+}
+
+// PublishCtx sends a raw byte message unless ctx is already done
+func (p *NATSPublisher) PublishCtx(ctx context.Context, subject string, data []byte) error {
+	if p.signer != nil || p.compressor != nil || p.encrypter != nil || p.chunking {
+		// Signatures, encodings, key IDs and chunk numbers travel in headers, so go through a full NATS message
+		return p.PublishMsgCtx(ctx, &nats.Msg{Subject: subject, Data: data})
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return p.conn.Publish(subject, data)
 }
 
-// PublishMessage serializes and publishes a Message
+// PublishMsg sends a NATS message including its headers, signing and encrypting it if a
+// signer and an encrypter are set
+func (p *NATSPublisher) PublishMsg(msg *nats.Msg) error {
+	return p.PublishMsgCtx(context.Background(), msg)
+}
+
+// PublishMsgCtx sends a NATS message unless ctx is already done. Core NATS publishes do not
+// wait for the server, so the context cannot interrupt a publish once it is handed over.
+func (p *NATSPublisher) PublishMsgCtx(ctx context.Context, msg *nats.Msg) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := p.seal(msg); err != nil {
+		return err
+	}
+	chunks, err := p.split(msg)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if err := p.conn.PublishMsg(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seal signs, compresses and then encrypts an outgoing message, with the signer, compressor
+// and encrypter if set
+func (p *NATSPublisher) seal(msg *nats.Msg) error {
+	if p.signer != nil {
+		if err := p.signer.Sign(msg); err != nil {
+			return err
+		}
+	}
+	if p.compressor != nil {
+		if err := p.compressor.Compress(msg); err != nil {
+			return err
+		}
+	}
+	if p.encrypter != nil {
+		return p.encrypter.Encrypt(msg)
+	}
+	return nil
+}
+
+// split returns the chunks of a sealed message with chunking enabled, the message itself
+// otherwise
+func (p *NATSPublisher) split(msg *nats.Msg) ([]*nats.Msg, error) {
+	if !p.chunking {
+		return []*nats.Msg{msg}, nil
+	}
+	size := p.chunkSize
+	if size <= 0 {
+		size = int(p.conn.MaxPayload())
+	}
+	return SplitMsg(msg, size)
+}
+
+// PublishMessage serializes and publishes a Message, sending its headers as NATS headers
 func (p *NATSPublisher) PublishMessage(msg *models.Message) error {
-	data, err := json.Marshal(msg)
+	return p.PublishMessageCtx(context.Background(), msg)
+}
+
+// PublishMessageCtx serializes and publishes a Message unless ctx is already done
+func (p *NATSPublisher) PublishMessageCtx(ctx context.Context, msg *models.Message) error {
+	natsMsg, err := toNATSMsg(msg)
 	if err != nil {
 		return err
 	}
-	return p.Publish(msg.Subject, data)
+	return p.PublishMsgCtx(ctx, natsMsg)
+}
+
+// RequestMessage publishes a Message as a request and waits for a reply within the timeout
+func (p *NATSPublisher) RequestMessage(msg *models.Message, timeout time.Duration) (*models.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	reply, err := p.RequestMessageCtx(ctx, msg)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, nats.ErrTimeout
+	}
+	return reply, err
+}
+
+// RequestMessageCtx publishes a Message as a request and waits for a reply until ctx is done.
+// The context's deadline is passed to the responder in the DeadlineHeader.
+func (p *NATSPublisher) RequestMessageCtx(ctx context.Context, msg *models.Message) (*models.Message, error) {
+	natsMsg, err := toNATSMsg(msg)
+	if err != nil {
+		return nil, err
+	}
+	SetDeadline(ctx, natsMsg)
+
+	// Request signatures cover the reply subject, so signed requests wait on an inbox of their
+	// own, known before they are sealed
+	var inbox *nats.Subscription
+	if p.signer != nil {
+		natsMsg.Reply = p.conn.NewInbox()
+		if inbox, err = p.conn.SubscribeSync(natsMsg.Reply); err != nil {
+			return nil, fmt.Errorf("failed to subscribe to reply inbox: %w", err)
+		}
+		defer inbox.Unsubscribe()
+	}
+	if err := p.seal(natsMsg); err != nil {
+		return nil, err
+	}
+
+	// The last chunk of a chunked request carries the reply subject
+	chunks, err := p.split(natsMsg)
+	if err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunks[:len(chunks)-1] {
+		if err := p.conn.PublishMsg(chunk); err != nil {
+			return nil, err
+		}
+	}
+	var resp *nats.Msg
+	if inbox != nil {
+		if err = p.conn.PublishMsg(chunks[len(chunks)-1]); err == nil {
+			resp, err = inbox.NextMsgWithContext(ctx)
+		}
+	} else {
+		resp, err = p.conn.RequestMsgWithContext(ctx, chunks[len(chunks)-1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.encrypter != nil {
+		if _, err := p.encrypter.Decrypt(resp); err != nil {
+			return nil, fmt.Errorf("reply: %w", err)
+		}
+	}
+	if p.compressor != nil {
+		if err := p.compressor.Decompress(resp); err != nil {
+			return nil, fmt.Errorf("reply: %w", err)
+		}
+	}
+
+	reply, err := fromNATSMsg(resp)
+	if err != nil {
+		// Non-JSON replies are still confirmations, keep the raw payload as the body
+		reply = &models.Message{Subject: resp.Subject, Body: string(resp.Data), Headers: resp.Header}
+	}
+
+	return reply, nil
+}
+
+// Flush waits until the server has processed all published messages or the timeout expires
+func (p *NATSPublisher) Flush(timeout time.Duration) error {
+	return p.conn.FlushTimeout(timeout)
+}
+
+// FlushCtx waits until the server has processed all published messages or ctx is done,
+// bounded by DefaultFlushTimeout when ctx has no deadline
+func (p *NATSPublisher) FlushCtx(ctx context.Context) error {
+	return flushContext(ctx, p.conn)
 }
 
 // Close closes the NATS connection
@@ -55,3 +274,32 @@ func (p *NATSPublisher) Close() {
 		p.conn.Close()
 	}
 }
+
+// toNATSMsg serializes a Message into a NATS message with its headers
+func toNATSMsg(msg *models.Message) (*nats.Msg, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	natsMsg := nats.NewMsg(msg.Subject)
+	natsMsg.Data = data
+	for key, values := range msg.Headers {
+		for _, value := range values {
+			natsMsg.Header.Add(key, value)
+		}
+	}
+	return natsMsg, nil
+}
+
+// fromNATSMsg deserializes a NATS message into a Message, carrying over its headers
+func fromNATSMsg(natsMsg *nats.Msg) (*models.Message, error) {
+	var msg models.Message
+	if err := json.Unmarshal(natsMsg.Data, &msg); err != nil {
+		return nil, err
+	}
+	if len(natsMsg.Header) > 0 {
+		msg.Headers = natsMsg.Header
+	}
+	return &msg, nil
+}
@@ -0,0 +1,136 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Defaults of pull consumers
+const (
+	DefaultFetchBatch   = 10
+	DefaultFetchMaxWait = 5 * time.Second
+)
+
+// fetchRetryDelay is how long Run waits after a failed fetch before trying again
+const fetchRetryDelay = time.Second
+
+// PullConsumer fetches messages from a durable pull consumer in batches, so a slow handler
+// takes messages at its own pace instead of having the server push them as they arrive. The
+// consumer is configured like those of SubscribeDurable, with SetDurableOptions.
+type PullConsumer struct {
+	s   *NATSSubscriber
+	sub *nats.Subscription
+}
+
+// PullSubscribe binds to a durable pull consumer on the stream, creating it when it does not
+// exist and updating its settings otherwise. Like push consumers, it outlives the
+// subscription, so a restarted worker resumes after the last acked message, and workers
+// sharing the consumer share its messages.
+func (s *NATSSubscriber) PullSubscribe(stream, consumer string) (*PullConsumer, error) {
+	return s.PullSubscribeCtx(context.Background(), stream, consumer)
+}
+
+// PullSubscribeCtx is PullSubscribe with the consumer setup bounded by ctx, or by
+// DefaultFlushTimeout when ctx has no deadline
+func (s *NATSSubscriber) PullSubscribeCtx(ctx context.Context, stream, consumer string) (*PullConsumer, error) {
+	ctx, cancel := boundedContext(ctx)
+	defer cancel()
+
+	setup, err := s.conn.JetStream(nats.Context(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JetStream context: %w", err)
+	}
+	if err := s.ensureConsumer(setup, stream, consumer, false); err != nil {
+		return nil, err
+	}
+	js, err := s.conn.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JetStream context: %w", err)
+	}
+	sub, err := js.PullSubscribe(s.durable.FilterSubject, consumer, nats.Bind(stream, consumer))
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind to consumer %s on stream %s: %w", consumer, stream, err)
+	}
+	return &PullConsumer{s: s, sub: sub}, nil
+}
+
+// Subscription returns the underlying pull subscription, e.g. for health checks
+func (c *PullConsumer) Subscription() *nats.Subscription {
+	return c.sub
+}
+
+// Fetch waits up to maxWait for up to batch messages and returns those that arrived, none if
+// maxWait passed without any. Messages that cannot be decrypted, verified or decoded are
+// terminated and not returned. The middleware does not run; settle every returned message
+// with Settle before its ack wait ends, or it is redelivered.
+func (c *PullConsumer) Fetch(batch int, maxWait time.Duration) ([]*AckableMessage, error) {
+	if maxWait <= 0 {
+		maxWait = DefaultFetchMaxWait
+	}
+	msgs, err := c.fetch(nats.MaxWait(maxWait), batch)
+	if err != nil {
+		return nil, err
+	}
+	fetched := make([]*AckableMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		if m, ok := c.s.ackable(msg); ok {
+			fetched = append(fetched, m)
+		}
+	}
+	return fetched, nil
+}
+
+// Settle acks, naks or terminates a fetched message. Like with SubscribeDurableAck, naks on the
+// last delivery attempt and terms are dead-lettered.
+func (c *PullConsumer) Settle(m *AckableMessage, decision AckDecision) {
+	c.s.settle(m, decision)
+}
+
+// Run fetches batches of up to batch messages and passes each message through the middleware
+// to the handler, settling it with the handler's decision like SubscribeDurableAck, until ctx
+// is done. The next batch is only fetched once the previous one is settled, so no more than
+// batch messages are ever in flight. Failed fetches go to the error handler and are retried;
+// Run returns nil once ctx is done, after settling the batch in progress, and an error if the
+// subscription is closed.
+func (c *PullConsumer) Run(ctx context.Context, batch int, handler AckHandler) error {
+	callback := c.s.ackCallback(handler)
+	for ctx.Err() == nil {
+		fetchCtx, cancel := context.WithTimeout(ctx, DefaultFetchMaxWait)
+		msgs, err := c.fetch(nats.Context(fetchCtx), batch)
+		cancel()
+		switch {
+		case ctx.Err() != nil:
+			// Messages fetched as ctx ended are still handled below
+		case !c.sub.IsValid():
+			return fmt.Errorf("pull subscription closed: %w", nats.ErrBadSubscription)
+		case err != nil:
+			if c.s.onError != nil {
+				c.s.onError(&nats.Msg{Subject: c.sub.Subject}, fmt.Errorf("fetch failed: %w", err))
+			}
+			select {
+			case <-time.After(fetchRetryDelay):
+			case <-ctx.Done():
+			}
+		}
+		for _, msg := range msgs {
+			callback(msg)
+		}
+	}
+	return nil
+}
+
+// fetch pulls up to batch messages, treating a wait without messages as an empty batch
+func (c *PullConsumer) fetch(wait nats.PullOpt, batch int) ([]*nats.Msg, error) {
+	if batch <= 0 {
+		batch = DefaultFetchBatch
+	}
+	msgs, err := c.sub.Fetch(batch, wait)
+	if errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return msgs, nil
+	}
+	return msgs, err
+}
@@ -0,0 +1,130 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+func TestPullFetchAndSettle(t *testing.T) {
+	nc := connectTestServer(t)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.>"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber := NewSubscriberFromConn(nc, WithDeadLetter("dead.orders"))
+	subscriber.SetDurableOptions(DurableOptions{FilterSubject: "orders.>", MaxDeliver: 2})
+	consumer, err := subscriber.PullSubscribe("ORDERS", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	letters, err := nc.SubscribeSync("dead.orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing stored yet: the fetch waits, then comes back empty
+	if msgs, err := consumer.Fetch(5, 50*time.Millisecond); err != nil || len(msgs) != 0 {
+		t.Fatalf("expected an empty batch, got %d: %v", len(msgs), err)
+	}
+
+	publisher := NewPublisherFromConn(nc)
+	for i := 1; i <= 3; i++ {
+		if err := publisher.PublishMessage(models.NewMessage("orders.new", fmt.Sprintf("order %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nc.Publish("orders.new", []byte("not a message"))
+
+	// The undecodable message is dead-lettered, terminated and left out of the batch
+	msgs, err := consumer.Fetch(10, time.Second)
+	if err != nil || len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d: %v", len(msgs), err)
+	}
+	if letter, err := letters.NextMsg(5 * time.Second); err != nil || !strings.HasPrefix(letter.Header.Get(models.DeadLetterError), "invalid message") {
+		t.Fatalf("expected the undecodable message dead-lettered, got %v", err)
+	}
+	consumer.Settle(msgs[0], Ack())
+	consumer.Settle(msgs[1], Nak(errors.New("busy"), 0))
+	consumer.Settle(msgs[2], Ack())
+
+	// The naked message comes back, and is dead-lettered on its last attempt
+	msgs, err = consumer.Fetch(10, time.Second)
+	if err != nil || len(msgs) != 1 || msgs[0].Body != "order 2" || msgs[0].NumDelivered() != 2 {
+		t.Fatalf("expected order 2 redelivered, got %d messages: %v", len(msgs), err)
+	}
+	consumer.Settle(msgs[0], Nak(errors.New("still busy"), 0))
+	if letter, err := letters.NextMsg(5 * time.Second); err != nil || letter.Header.Get(models.DeadLetterError) != "still busy" {
+		t.Fatalf("expected order 2 dead-lettered, got %v", err)
+	}
+
+	info, err := consumer.Subscription().ConsumerInfo()
+	if err != nil || info.NumPending != 0 || info.NumAckPending != 0 {
+		t.Fatalf("expected every message settled, got %+v: %v", info, err)
+	}
+}
+
+func TestPullRun(t *testing.T) {
+	nc := connectTestServer(t)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.>"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber := NewSubscriberFromConn(nc)
+	subscriber.SetDurableOptions(DurableOptions{FilterSubject: "orders.>"})
+	consumer, err := subscriber.PullSubscribe("ORDERS", "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := NewPublisherFromConn(nc)
+	for i := 0; i < 10; i++ {
+		if err := publisher.PublishMessage(models.NewMessage("orders.new", "order")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The handler sees no more than a batch of unacked messages at a time
+	var handled, maxInFlight atomic.Int64
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- consumer.Run(ctx, 3, func(m *AckableMessage) AckDecision {
+			info, err := consumer.Subscription().ConsumerInfo()
+			if err == nil && int64(info.NumAckPending) > maxInFlight.Load() {
+				maxInFlight.Store(int64(info.NumAckPending))
+			}
+			if handled.Add(1) == 10 {
+				cancel()
+			}
+			return Ack()
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after ctx was cancelled")
+	}
+	if handled.Load() != 10 || maxInFlight.Load() > 3 {
+		t.Fatalf("expected 10 messages in batches of at most 3, got %d with up to %d in flight", handled.Load(), maxInFlight.Load())
+	}
+}
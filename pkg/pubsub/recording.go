@@ -0,0 +1,96 @@
+// Package pubsub provides NATS publish/subscribe functionality
+package pubsub
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+// maxRecordLineSize bounds a single recorded line, leaving room for base64 encoded payloads
+const maxRecordLineSize = 8 * 1024 * 1024
+
+// Recorder captures NATS messages to a file as JSON lines
+type Recorder struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewRecorder creates a recorder that writes to the specified file path, truncating it
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording file: %w", err)
+	}
+
+	return &Recorder{
+		file: file,
+		enc:  json.NewEncoder(file),
+	}, nil
+}
+
+// Record appends a message to the recording
+func (r *Recorder) Record(msg *nats.Msg) error {
+	entry := &models.RecordedMessage{
+		Subject:   msg.Subject,
+		Data:      msg.Data,
+		Timestamp: time.Now(),
+	}
+	if len(msg.Header) > 0 {
+		entry.Headers = msg.Header
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.enc.Encode(entry); err != nil {
+		return fmt.Errorf("failed to write recorded message: %w", err)
+	}
+	return nil
+}
+
+// Close flushes and closes the recording file
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.file.Close()
+}
+
+// ReadRecording loads all messages from a recording file in the order they were captured
+func ReadRecording(path string) ([]*models.RecordedMessage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording file: %w", err)
+	}
+	defer file.Close()
+
+	var messages []*models.RecordedMessage
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxRecordLineSize)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var msg models.RecordedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return nil, fmt.Errorf("failed to parse recording line %d: %w", line, err)
+		}
+		messages = append(messages, &msg)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recording file: %w", err)
+	}
+
+	return messages, nil
+}
@@ -0,0 +1,66 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ReplayOptions selects where a replay starts. Without Since or StartSeq it starts with the
+// first message of the stream.
+type ReplayOptions struct {
+	Since    time.Time // first message stored at or after this time
+	StartSeq uint64    // first stream sequence
+	Stream   string    // stream holding the subject, looked up from the subject if empty
+
+	// OnCaughtUp, if not nil, is called once, after handling the message that was the last in
+	// the stream when it was delivered; later messages arrive as they are stored
+	OnCaughtUp func()
+}
+
+// Replay delivers the messages stored for a subject in a JetStream stream from the start
+// ReplayOptions select, then the new ones as they arrive, e.g. to see the history behind an
+// incident. It creates an ephemeral ordered consumer, which the server deletes once the
+// subscription is gone, so nothing is acked and no durable state is left behind. Messages are
+// decrypted, verified and decoded like those of SubscribeMessage, and failures go to the error
+// handler and dead-letter subject in the same way.
+func (s *NATSSubscriber) Replay(subject string, opts ReplayOptions, handler MessageHandler) (*nats.Subscription, error) {
+	subOpts := []nats.SubOpt{nats.OrderedConsumer()}
+	switch {
+	case !opts.Since.IsZero() && opts.StartSeq > 0:
+		return nil, errors.New("replay starts at a time or a sequence, not both")
+	case !opts.Since.IsZero():
+		subOpts = append(subOpts, nats.StartTime(opts.Since))
+	case opts.StartSeq > 0:
+		subOpts = append(subOpts, nats.StartSequence(opts.StartSeq))
+	default:
+		subOpts = append(subOpts, nats.DeliverAll())
+	}
+	if opts.Stream != "" {
+		subOpts = append(subOpts, nats.BindStream(opts.Stream))
+	}
+
+	js, err := s.conn.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JetStream context: %w", err)
+	}
+
+	callback := s.messageCallback(handler)
+	var caughtUp sync.Once
+	sub, err := js.Subscribe(subject, func(msg *nats.Msg) {
+		callback(msg)
+		if opts.OnCaughtUp == nil {
+			return
+		}
+		if meta, err := msg.Metadata(); err == nil && meta.NumPending == 0 {
+			caughtUp.Do(opts.OnCaughtUp)
+		}
+	}, subOpts...)
+	if sub, err = s.limit(sub, err); err != nil {
+		return nil, fmt.Errorf("failed to replay %s: %w", subject, err)
+	}
+	return sub, nil
+}
@@ -0,0 +1,83 @@
+package pubsub
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+func TestReplay(t *testing.T) {
+	nc := connectTestServer(t)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.>"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Five messages, with a gap before the last two so they can be replayed by time
+	publisher := NewPublisherFromConn(nc)
+	var since time.Time
+	for i := 1; i <= 5; i++ {
+		if i == 4 {
+			time.Sleep(50 * time.Millisecond)
+			since = time.Now()
+			time.Sleep(50 * time.Millisecond)
+		}
+		if err := publisher.PublishMessage(models.NewMessage("orders.new", fmt.Sprintf("order %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := publisher.Flush(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	replay := func(opts ReplayOptions) []string {
+		t.Helper()
+		received := make(chan string, 10)
+		caughtUp := make(chan struct{})
+		opts.OnCaughtUp = func() { close(caughtUp) }
+		sub, err := NewSubscriberFromConn(nc).Replay("orders.new", opts, func(msg *models.Message) error {
+			received <- msg.Body
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Unsubscribe()
+
+		select {
+		case <-caughtUp:
+		case <-time.After(5 * time.Second):
+			t.Fatal("replay did not catch up")
+		}
+		var bodies []string
+		for len(received) > 0 {
+			bodies = append(bodies, <-received)
+		}
+		return bodies
+	}
+
+	for name, tc := range map[string]struct {
+		opts ReplayOptions
+		want string
+	}{
+		"all":      {ReplayOptions{}, "[order 1 order 2 order 3 order 4 order 5]"},
+		"sequence": {ReplayOptions{StartSeq: 3}, "[order 3 order 4 order 5]"},
+		"time":     {ReplayOptions{Since: since, Stream: "ORDERS"}, "[order 4 order 5]"},
+	} {
+		if got := fmt.Sprint(replay(tc.opts)); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", name, tc.want, got)
+		}
+	}
+
+	if _, err := NewSubscriberFromConn(nc).Replay("orders.new", ReplayOptions{Since: since, StartSeq: 3}, func(*models.Message) error {
+		return nil
+	}); err == nil {
+		t.Fatal("expected a time and a sequence together to fail")
+	}
+}
@@ -0,0 +1,308 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// PayloadValidator checks the payload of incoming messages before they are decoded
+type PayloadValidator interface {
+	Validate(data []byte) error
+}
+
+// Schema validates JSON payloads against a subset of JSON Schema: type, enum, properties,
+// required, additionalProperties (as a boolean), items, minLength, maxLength, pattern,
+// minimum, maximum, minItems and maxItems. Annotations such as title and description are
+// ignored. ParseSchema refuses schemas using any other keyword, such as $ref, allOf, oneOf,
+// const or format, since ignoring them would accept payloads the schema rejects.
+type Schema struct {
+	Type                 schemaTypes        `json:"type,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// schemaTypes is the type keyword, a single type name or a list of them
+type schemaTypes []string
+
+// UnmarshalJSON accepts "string" as well as ["string", "null"]
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = schemaTypes{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("type must be a string or an array of strings")
+	}
+	*t = list
+	return nil
+}
+
+// schemaKeywords are the keywords a Schema validates or, for annotations, may ignore
+var schemaKeywords = map[string]bool{
+	"type": true, "enum": true, "properties": true, "required": true, "additionalProperties": true,
+	"items": true, "minLength": true, "maxLength": true, "pattern": true, "minimum": true,
+	"maximum": true, "minItems": true, "maxItems": true,
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true, "deprecated": true, "readOnly": true, "writeOnly": true,
+}
+
+// ParseSchema parses a JSON Schema document, refusing keywords Schema does not support
+func ParseSchema(data []byte) (*Schema, error) {
+	if err := checkKeywords(data, "#"); err != nil {
+		return nil, err
+	}
+	var schema Schema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	if err := schema.compile("#"); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// LoadSchema reads a JSON Schema document from a file
+func LoadSchema(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema: %w", err)
+	}
+	return ParseSchema(data)
+}
+
+// checkKeywords refuses the keywords of the schema and its subschemas that are not in
+// schemaKeywords. Malformed documents are left to json.Unmarshal to report.
+func checkKeywords(data []byte, path string) error {
+	var keywords map[string]json.RawMessage
+	if json.Unmarshal(data, &keywords) != nil {
+		return nil
+	}
+	var unsupported []string
+	for keyword := range keywords {
+		if !schemaKeywords[keyword] {
+			unsupported = append(unsupported, keyword)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("invalid schema at %s: unsupported keywords %s", path, strings.Join(unsupported, ", "))
+	}
+
+	var properties map[string]json.RawMessage
+	if json.Unmarshal(keywords["properties"], &properties) == nil {
+		names := make([]string, 0, len(properties))
+		for name := range properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := checkKeywords(properties[name], path+"/properties/"+name); err != nil {
+				return err
+			}
+		}
+	}
+	if items, ok := keywords["items"]; ok {
+		return checkKeywords(items, path+"/items")
+	}
+	return nil
+}
+
+// compile checks the type names and compiles the patterns of the schema and its subschemas
+func (s *Schema) compile(path string) error {
+	for _, t := range s.Type {
+		switch t {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return fmt.Errorf("invalid schema at %s: unknown type %q", path, t)
+		}
+	}
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid schema at %s: %w", path, err)
+		}
+		s.pattern = pattern
+	}
+	for name, property := range s.Properties {
+		if property == nil {
+			return fmt.Errorf("invalid schema at %s/properties/%s: empty schema", path, name)
+		}
+		if err := property.compile(path + "/properties/" + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile(path + "/items")
+	}
+	return nil
+}
+
+// Validate checks that data is a JSON document matching the schema. The error names the
+// location of the first mismatch as a JSON pointer, e.g. /items/0/id.
+func (s *Schema) Validate(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	if decoder.More() {
+		return errors.New("invalid JSON: data after the document")
+	}
+	return s.validate(value, "")
+}
+
+// validate checks a decoded value at the given JSON pointer
+func (s *Schema) validate(value interface{}, path string) error {
+	fail := func(format string, args ...interface{}) error {
+		location := path
+		if location == "" {
+			location = "/"
+		}
+		return fmt.Errorf("%s: %s", location, fmt.Sprintf(format, args...))
+	}
+
+	if len(s.Type) > 0 && !s.hasType(value) {
+		return fail("expected %s, got %s", strings.Join(s.Type, " or "), typeOf(value))
+	}
+	if len(s.Enum) > 0 && !s.inEnum(value) {
+		return fail("value is not one of the allowed values")
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fail("missing required property %q", name)
+			}
+		}
+		// Sorted, so the same payload always reports the same error
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fail("unexpected property %q", name)
+				}
+				continue
+			}
+			if err := property.validate(v[name], path+"/"+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fail("expected at least %d items, got %d", *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fail("expected at most %d items, got %d", *s.MaxItems, len(v))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(item, fmt.Sprintf("%s/%d", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			return fail("expected at least %d characters, got %d", *s.MinLength, length)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fail("expected at most %d characters, got %d", *s.MaxLength, length)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fail("does not match pattern %q", s.Pattern)
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		if s.Minimum != nil && n < *s.Minimum {
+			return fail("expected at least %v, got %v", *s.Minimum, n)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return fail("expected at most %v, got %v", *s.Maximum, n)
+		}
+	}
+	return nil
+}
+
+// hasType reports whether the value has one of the schema's types
+func (s *Schema) hasType(value interface{}) bool {
+	actual := typeOf(value)
+	for _, t := range s.Type {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// inEnum reports whether the value equals one of the enum values
+func (s *Schema) inEnum(value interface{}) bool {
+	for _, allowed := range s.Enum {
+		if equalJSON(value, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf names the JSON Schema type of a decoded value; whole numbers are integers
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if n, err := v.Float64(); err == nil && n == math.Trunc(n) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// equalJSON compares a decoded payload value with an enum value of the schema, which was
+// decoded without UseNumber
+func equalJSON(value, allowed interface{}) bool {
+	if n, ok := value.(json.Number); ok {
+		f, err := n.Float64()
+		return err == nil && reflect.DeepEqual(f, allowed)
+	}
+	return reflect.DeepEqual(value, allowed)
+}
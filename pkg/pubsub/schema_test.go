@@ -0,0 +1,85 @@
+package pubsub
+
+import (
+	"strings"
+	"testing"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "items"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "string", "pattern": "^ord-[0-9]+$"},
+		"status": {"enum": ["new", "paid"]},
+		"note": {"type": ["string", "null"], "maxLength": 5},
+		"items": {
+			"type": "array",
+			"minItems": 1,
+			"items": {
+				"type": "object",
+				"required": ["qty"],
+				"properties": {"qty": {"type": "integer", "minimum": 1}}
+			}
+		}
+	}
+}`
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := ParseSchema([]byte(orderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		payload string
+		err     string // substring of the error, empty if valid
+	}{
+		{`{"id":"ord-1","status":"paid","note":null,"items":[{"qty":2}]}`, ""},
+		{`{"id":"ord-1","items":[{"qty":2}]} trailing`, "invalid JSON"},
+		{`[]`, "/: expected object, got array"},
+		{`{"items":[{"qty":1}]}`, `missing required property "id"`},
+		{`{"id":"order-1","items":[{"qty":1}]}`, "/id: does not match pattern"},
+		{`{"id":"ord-1","status":"lost","items":[{"qty":1}]}`, "/status: value is not one of"},
+		{`{"id":"ord-1","note":"too long","items":[{"qty":1}]}`, "/note: expected at most 5 characters"},
+		{`{"id":"ord-1","items":[]}`, "/items: expected at least 1 items"},
+		{`{"id":"ord-1","items":[{"qty":1.5}]}`, "/items/0/qty: expected integer, got number"},
+		{`{"id":"ord-1","items":[{"qty":0}]}`, "/items/0/qty: expected at least 1"},
+		{`{"id":"ord-1","items":[{"qty":1}],"extra":true}`, `unexpected property "extra"`},
+	} {
+		err := schema.Validate([]byte(tc.payload))
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: expected no error, got %v", tc.payload, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected an error containing %q, got %v", tc.payload, tc.err, err)
+		}
+	}
+
+	if _, err := ParseSchema([]byte(`{"properties":{"a":{"type":"text"}}}`)); err == nil {
+		t.Error("expected an unknown type to be refused")
+	}
+}
+
+func TestParseSchemaRefusesUnsupportedKeywords(t *testing.T) {
+	for _, tc := range []struct {
+		schema string
+		err    string // substring of the error
+	}{
+		{`{"$ref":"#/$defs/order","$defs":{"order":{"type":"object"}}}`, "at #: unsupported keywords $defs, $ref"},
+		{`{"oneOf":[{"type":"string"},{"type":"integer"}]}`, "at #: unsupported keywords oneOf"},
+		{`{"properties":{"id":{"type":"string","format":"uuid"}}}`, "at #/properties/id: unsupported keywords format"},
+		{`{"items":{"allOf":[{"minimum":1}],"const":2}}`, "at #/items: unsupported keywords allOf, const"},
+	} {
+		if _, err := ParseSchema([]byte(tc.schema)); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.schema, tc.err, err)
+		}
+	}
+
+	// Annotations do not constrain payloads, so they are accepted
+	annotated := `{"$schema":"https://json-schema.org/draft/2020-12/schema","title":"Order",
+		"properties":{"id":{"type":"string","description":"Order ID","examples":["ord-1"]}}}`
+	if _, err := ParseSchema([]byte(annotated)); err != nil {
+		t.Fatalf("expected annotations to be accepted, got %v", err)
+	}
+}
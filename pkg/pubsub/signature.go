@@ -0,0 +1,198 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// Headers of signed requests
+const (
+	// SignatureHeader is the base64url Ed25519 signature of the request
+	SignatureHeader = "Payload-Signature"
+	// SignerHeader is the public NKey the request was signed with
+	SignerHeader = "Payload-Signer"
+)
+
+// Errors of Verify
+var (
+	ErrUnsigned        = errors.New("request is not signed")
+	ErrUntrustedSigner = errors.New("request is signed by an untrusted key")
+	ErrBadSignature    = errors.New("request signature does not match")
+	ErrStale           = errors.New("signed request has no valid deadline")
+	ErrNoRequestID     = errors.New("signed request has no request ID")
+	ErrReplayed        = errors.New("signed request was already served")
+)
+
+// DefaultReplayWindow is how far ahead the deadline of a signed request may be by default
+const DefaultReplayWindow = 5 * time.Minute
+
+// Sign signs the request with an NKey, so the responder can tell it comes from a trusted
+// requester and was not altered on the way. The signature covers the subject, the reply
+// subject, the Request-Id and Request-Deadline headers and the payload, so a copied request
+// cannot be answered to another inbox; call it after SetDeadline, once the reply subject is
+// set, or use RequestSigned, which does both. Responders refuse copies sent again with a
+// ReplayGuard.
+//
+// Unlike the message signatures of pkg/signing, whose publishers share a key rotated through
+// JetStream KV, each requester signs with its own NKey pinned in the responders' config, and
+// checking it needs no JetStream. Use Sign to restrict who may call a service, and pkg/signing
+// to check that messages fanned out to subscribers are authentic.
+func Sign(msg *nats.Msg, kp nkeys.KeyPair) error {
+	signer, err := kp.PublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to read the signing key: %w", err)
+	}
+	signature, err := kp.Sign(signedContent(msg))
+	if err != nil {
+		return fmt.Errorf("failed to sign request: %w", err)
+	}
+	SetHeader(msg, SignerHeader, signer)
+	SetHeader(msg, SignatureHeader, base64.RawURLEncoding.EncodeToString(signature))
+	return nil
+}
+
+// RequestSigned sends msg as a request signed with kp and waits for its reply until ctx is
+// done. Unlike a request on the connection's shared inbox, it subscribes to a reply inbox of
+// its own first, so the signature covers the reply subject. ctx must have a deadline, which is
+// passed to the responder in the DeadlineHeader. seal, if not nil, runs after signing, e.g. an
+// Encrypter's Encrypt.
+func RequestSigned(ctx context.Context, nc *nats.Conn, msg *nats.Msg, kp nkeys.KeyPair, seal func(*nats.Msg) error) (*nats.Msg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return nil, errors.New("signed requests need a context with a deadline")
+	}
+	inbox := nc.NewInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to reply inbox: %w", err)
+	}
+	defer sub.Unsubscribe()
+
+	msg.Reply = inbox
+	SetDeadline(ctx, msg)
+	if err := Sign(msg, kp); err != nil {
+		return nil, err
+	}
+	if seal != nil {
+		if err := seal(msg); err != nil {
+			return nil, err
+		}
+	}
+	if err := nc.PublishMsg(msg); err != nil {
+		return nil, fmt.Errorf("failed to publish request: %w", err)
+	}
+	return sub.NextMsgWithContext(ctx)
+}
+
+// Verify checks that the request was signed by one of the trusted public NKeys and returns
+// the signer
+func Verify(msg *nats.Msg, trusted []string) (string, error) {
+	signer, encoded := header(msg, SignerHeader), header(msg, SignatureHeader)
+	if signer == "" || encoded == "" {
+		return "", ErrUnsigned
+	}
+	known := false
+	for _, key := range trusted {
+		if key == signer {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return signer, ErrUntrustedSigner
+	}
+
+	kp, err := nkeys.FromPublicKey(signer)
+	if err != nil {
+		return signer, fmt.Errorf("%w: %v", ErrUntrustedSigner, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || kp.Verify(signedContent(msg), signature) != nil {
+		return signer, ErrBadSignature
+	}
+	return signer, nil
+}
+
+// signedContent returns the bytes a request signature covers
+func signedContent(msg *nats.Msg) []byte {
+	content := make([]byte, 0, len(msg.Subject)+len(msg.Data)+64)
+	content = append(content, msg.Subject...)
+	content = append(content, '\n')
+	content = append(content, msg.Reply...)
+	content = append(content, '\n')
+	content = append(content, RequestID(msg)...)
+	content = append(content, '\n')
+	content = append(content, header(msg, DeadlineHeader)...)
+	content = append(content, '\n')
+	return append(content, msg.Data...)
+}
+
+// ReplayGuard refuses signed requests sent again, remembering the request IDs it has seen
+// until their deadline. Requests without a deadline, past it, or with one further ahead than
+// the window are refused too, which bounds how long a request ID is remembered.
+type ReplayGuard struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time // deadlines by signer and request ID
+	nextSweep time.Time
+}
+
+// NewReplayGuard creates a guard accepting deadlines up to window ahead, or
+// DefaultReplayWindow when window is not positive
+func NewReplayGuard(window time.Duration) *ReplayGuard {
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+	return &ReplayGuard{window: window, seen: make(map[string]time.Time)}
+}
+
+// Check refuses a verified request whose deadline is missing, passed or too far ahead, or
+// whose request ID it has seen before from the same signer, and remembers it otherwise
+func (g *ReplayGuard) Check(msg *nats.Msg) error {
+	requestID := RequestID(msg)
+	if requestID == "" {
+		return ErrNoRequestID
+	}
+	deadline, err := time.Parse(time.RFC3339Nano, header(msg, DeadlineHeader))
+	if err != nil {
+		return ErrStale
+	}
+	now := time.Now()
+	if !deadline.After(now) {
+		return fmt.Errorf("%w: deadline %s has passed", ErrStale, deadline.Format(time.RFC3339))
+	}
+	if deadline.Sub(now) > g.window {
+		return fmt.Errorf("%w: deadline %s is more than %s away", ErrStale, deadline.Format(time.RFC3339), g.window)
+	}
+
+	key := header(msg, SignerHeader) + "\n" + requestID
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sweep(now)
+	if _, found := g.seen[key]; found {
+		return ErrReplayed
+	}
+	g.seen[key] = deadline
+	return nil
+}
+
+// sweep forgets the requests past their deadline, at most once per second. It must be called
+// with g.mu held.
+func (g *ReplayGuard) sweep(now time.Time) {
+	if now.Before(g.nextSweep) {
+		return
+	}
+	g.nextSweep = now.Add(time.Second)
+	for key, deadline := range g.seen {
+		if !deadline.After(now) {
+			delete(g.seen, key)
+		}
+	}
+}
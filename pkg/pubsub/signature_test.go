@@ -0,0 +1,153 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := kp.PublicKey()
+	other, _ := nkeys.CreateUser()
+	otherKey, _ := other.PublicKey()
+
+	newSigned := func() *nats.Msg {
+		msg := NewRequestMsg(&nats.Conn{}, "token.request", "req-1", []byte(`{"client_id":"a"}`))
+		if err := Sign(msg, kp); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	if got, err := Verify(newSigned(), []string{otherKey, signer}); err != nil || got != signer {
+		t.Fatalf("expected the signature to verify, got %q: %v", got, err)
+	}
+	if _, err := Verify(newSigned(), []string{otherKey}); !errors.Is(err, ErrUntrustedSigner) {
+		t.Fatalf("expected an untrusted signer, got %v", err)
+	}
+	if _, err := Verify(&nats.Msg{Subject: "token.request"}, []string{signer}); !errors.Is(err, ErrUnsigned) {
+		t.Fatalf("expected an unsigned request, got %v", err)
+	}
+
+	// Changing the payload, the subject, the reply subject or the request ID breaks the signature
+	for name, tamper := range map[string]func(*nats.Msg){
+		"payload":    func(m *nats.Msg) { m.Data = []byte(`{"client_id":"b"}`) },
+		"subject":    func(m *nats.Msg) { m.Subject = "token.introspect" },
+		"reply":      func(m *nats.Msg) { m.Reply = "_INBOX.eavesdropper" },
+		"request ID": func(m *nats.Msg) { SetRequestID(m, "req-2") },
+	} {
+		msg := newSigned()
+		tamper(msg)
+		if _, err := Verify(msg, []string{signer}); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("%s: expected a bad signature, got %v", name, err)
+		}
+	}
+}
+
+func TestReplayGuard(t *testing.T) {
+	guard := NewReplayGuard(time.Minute)
+	newRequest := func(id string, deadline time.Duration) *nats.Msg {
+		msg := NewRequestMsg(&nats.Conn{}, "token.request", id, nil)
+		if deadline != 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), deadline)
+			defer cancel()
+			SetDeadline(ctx, msg)
+		}
+		return msg
+	}
+
+	if err := guard.Check(newRequest("req-1", time.Second)); err != nil {
+		t.Fatalf("expected the first request accepted, got %v", err)
+	}
+	if err := guard.Check(newRequest("req-1", time.Second)); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("expected the copy refused, got %v", err)
+	}
+	if err := guard.Check(newRequest("req-2", time.Second)); err != nil {
+		t.Fatalf("expected another request accepted, got %v", err)
+	}
+
+	tests := []struct {
+		name string
+		msg  *nats.Msg
+		want error
+	}{
+		{"no request ID", newRequest("", time.Second), ErrNoRequestID},
+		{"no deadline", newRequest("req-3", 0), ErrStale},
+		{"past deadline", newRequest("req-4", -time.Second), ErrStale},
+		{"deadline beyond the window", newRequest("req-5", time.Hour), ErrStale},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := guard.Check(tt.msg); !errors.Is(err, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestRequestSigned(t *testing.T) {
+	nc := connectTestServer(t)
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := kp.PublicKey()
+	guard := NewReplayGuard(0)
+	served := make(chan *nats.Msg, 1)
+	if _, err := nc.Subscribe("token.request", func(msg *nats.Msg) {
+		if _, err := Verify(msg, []string{signer}); err != nil {
+			msg.Respond([]byte(err.Error()))
+			return
+		}
+		if err := guard.Check(msg); err != nil {
+			msg.Respond([]byte(err.Error()))
+			return
+		}
+		served <- msg
+		msg.Respond([]byte("ok"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sealed := false
+	msg := NewRequestMsg(nc, "token.request", "req-1", []byte("request"))
+	reply, err := RequestSigned(ctx, nc, msg, kp, func(*nats.Msg) error {
+		sealed = true
+		return nil
+	})
+	if err != nil || string(reply.Data) != "ok" || !sealed {
+		t.Fatalf("expected the signed request served, got %v", err)
+	}
+
+	// A copy sent to another inbox fails the signature, and an exact copy is refused as a replay
+	copied := <-served
+	redirected := &nats.Msg{Subject: copied.Subject, Data: copied.Data, Header: copied.Header}
+	if reply, err := nc.RequestMsgWithContext(ctx, redirected); err != nil || string(reply.Data) != ErrBadSignature.Error() {
+		t.Fatalf("expected the redirected copy refused, got %v", err)
+	}
+	replayed := &nats.Msg{Subject: copied.Subject, Reply: copied.Reply, Data: copied.Data, Header: copied.Header}
+	sub, err := nc.SubscribeSync(copied.Reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.PublishMsg(replayed); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := sub.NextMsgWithContext(ctx); err != nil || string(reply.Data) != ErrReplayed.Error() {
+		t.Fatalf("expected the replayed copy refused, got %v", err)
+	}
+
+	if _, err := RequestSigned(context.Background(), nc, NewRequestMsg(nc, "token.request", "req-2", nil), kp, nil); err == nil {
+		t.Fatal("expected a request without deadline refused")
+	}
+}
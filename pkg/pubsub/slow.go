@@ -0,0 +1,74 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// SlowConsumerHandler is told when a subscription falls so far behind that the client starts
+// dropping its messages, with the number of messages dropped so far
+type SlowConsumerHandler func(sub *nats.Subscription, dropped int)
+
+// WithPendingLimits bounds the messages and bytes each subscription buffers, see SetPendingLimits
+func WithPendingLimits(msgs, bytes int) SubscriberOption {
+	return func(s *NATSSubscriber) {
+		s.SetPendingLimits(msgs, bytes)
+	}
+}
+
+// WithSlowConsumerHandler calls fn when a subscription drops messages, see SetSlowConsumerHandler
+func WithSlowConsumerHandler(fn SlowConsumerHandler) SubscriberOption {
+	return func(s *NATSSubscriber) {
+		s.SetSlowConsumerHandler(fn)
+	}
+}
+
+// SetPendingLimits bounds the messages and bytes buffered by the subscriptions created after
+// the call while their handler is busy. Messages arriving over a limit are dropped and reported
+// to the slow consumer handler. 0 keeps the NATS default of 512k messages or 64MB, -1 removes
+// the limit. Pull subscriptions only buffer the batches they fetch and keep the defaults.
+func (s *NATSSubscriber) SetPendingLimits(msgs, bytes int) {
+	s.pendingMsgs, s.pendingBytes = msgs, bytes
+}
+
+// SetSlowConsumerHandler calls fn every time a subscription on the subscriber's connection
+// starts dropping messages; NATS reports each episode once, until the subscription catches up.
+// The connection's own error handler, e.g. one that logs, still receives the error.
+func (s *NATSSubscriber) SetSlowConsumerHandler(fn SlowConsumerHandler) {
+	hooked := s.onSlow != nil
+	s.onSlow = fn
+	if hooked || fn == nil {
+		return
+	}
+	previous := s.conn.ErrorHandler()
+	s.conn.SetErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
+		if errors.Is(err, nats.ErrSlowConsumer) && sub != nil && s.onSlow != nil {
+			dropped, _ := sub.Dropped()
+			s.onSlow(sub, dropped)
+		}
+		if previous != nil {
+			previous(nc, sub, err)
+		}
+	})
+}
+
+// limit applies the pending limits to a new subscription, unsubscribing it when they are invalid
+func (s *NATSSubscriber) limit(sub *nats.Subscription, err error) (*nats.Subscription, error) {
+	if err != nil || (s.pendingMsgs == 0 && s.pendingBytes == 0) {
+		return sub, err
+	}
+	msgs, bytes := s.pendingMsgs, s.pendingBytes
+	if msgs == 0 {
+		msgs = nats.DefaultSubPendingMsgsLimit
+	}
+	if bytes == 0 {
+		bytes = nats.DefaultSubPendingBytesLimit
+	}
+	if err := sub.SetPendingLimits(msgs, bytes); err != nil {
+		sub.Unsubscribe()
+		return nil, fmt.Errorf("failed to set pending limits of %d messages and %d bytes: %w", msgs, bytes, err)
+	}
+	return sub, nil
+}
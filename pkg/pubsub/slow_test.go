@@ -0,0 +1,69 @@
+package pubsub
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestSlowConsumer(t *testing.T) {
+	nc := connectTestServer(t)
+	connErrors := make(chan error, 10)
+	nc.SetErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		connErrors <- err
+	})
+
+	type report struct {
+		subject string
+		dropped int
+	}
+	reports := make(chan report, 10)
+	subscriber := NewSubscriberFromConn(nc,
+		WithPendingLimits(2, -1),
+		WithSlowConsumerHandler(func(sub *nats.Subscription, dropped int) {
+			reports <- report{sub.Subject, dropped}
+		}))
+
+	// A stuck handler lets no more than 2 messages wait, the rest is dropped
+	release := make(chan struct{})
+	sub, err := subscriber.Subscribe("sensors.readings", func(string, []byte) error {
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs, bytes, err := sub.PendingLimits(); err != nil || msgs != 2 || bytes != -1 {
+		t.Fatalf("expected limits of 2 messages and no bytes limit, got %d and %d: %v", msgs, bytes, err)
+	}
+	for i := 0; i < 10; i++ {
+		nc.Publish("sensors.readings", []byte("21.5"))
+	}
+	nc.Flush()
+
+	select {
+	case r := <-reports:
+		if r.subject != "sensors.readings" || r.dropped < 1 {
+			t.Fatalf("expected dropped messages on sensors.readings, got %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow consumer not reported")
+	}
+	select {
+	case err := <-connErrors:
+		if !errors.Is(err, nats.ErrSlowConsumer) {
+			t.Fatalf("expected the connection's handler to see the slow consumer, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection error handler not called")
+	}
+
+	// The message being handled counts as pending
+	stats, err := Stats(sub)
+	if err != nil || stats.Pending != 2 || stats.Dropped != 8 {
+		t.Fatalf("expected 2 messages pending and 8 dropped, got %+v: %v", stats, err)
+	}
+	close(release)
+}
@@ -0,0 +1,58 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// SubscriptionStats shows whether a subscription keeps up with its messages. Delivered,
+// Pending and Dropped are counted by the client; the consumer fields come from the server and
+// are only set for JetStream subscriptions.
+type SubscriptionStats struct {
+	Delivered    int64 // messages handed to the subscription's handler
+	Pending      int   // messages received and not yet handled, including the one being handled
+	PendingBytes int
+	Dropped      int // messages discarded because the pending limits were reached
+
+	JetStream       bool
+	ConsumerPending uint64 // messages in the stream not yet delivered to the consumer, its lag
+	AckPending      int    // messages delivered but not yet acked
+	Redelivered     int    // messages delivered more than once and not yet acked
+}
+
+// Stats returns the current statistics of a subscription. For JetStream subscriptions it asks
+// the server for the consumer's state, so it may block up to the JetStream request timeout.
+func Stats(sub *nats.Subscription) (SubscriptionStats, error) {
+	var stats SubscriptionStats
+	var err error
+	if stats.Delivered, err = sub.Delivered(); err != nil {
+		return stats, err
+	}
+	stats.Pending, stats.PendingBytes, err = sub.Pending()
+	switch {
+	case errors.Is(err, nats.ErrTypeSubscription):
+		// Channel subscriptions leave their pending messages in the channel
+		stats.Pending, stats.PendingBytes = 0, 0
+	case err != nil:
+		return stats, err
+	}
+	if stats.Dropped, err = sub.Dropped(); err != nil {
+		return stats, err
+	}
+
+	// Core NATS subscriptions have no consumer
+	info, err := sub.ConsumerInfo()
+	switch {
+	case errors.Is(err, nats.ErrTypeSubscription):
+		return stats, nil
+	case err != nil:
+		return stats, fmt.Errorf("failed to get consumer info: %w", err)
+	}
+	stats.JetStream = true
+	stats.ConsumerPending = info.NumPending
+	stats.AckPending = info.NumAckPending
+	stats.Redelivered = info.NumRedelivered
+	return stats, nil
+}
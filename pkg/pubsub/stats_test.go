@@ -0,0 +1,78 @@
+package pubsub
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestStats(t *testing.T) {
+	nc := connectTestServer(t)
+
+	// A core subscription whose handler is stuck reports the messages piling up
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	sub, err := nc.Subscribe("metrics.core", func(*nats.Msg) { <-release })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		nc.Publish("metrics.core", []byte("reading"))
+	}
+	nc.Flush()
+	var stats SubscriptionStats
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if stats, err = Stats(sub); err != nil {
+			t.Fatal(err)
+		}
+		if stats.Delivered == 1 && stats.Pending == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats.Delivered != 1 || stats.Pending != 3 || stats.Dropped != 0 || stats.JetStream {
+		t.Fatalf("expected 1 message delivered and 3 pending, got %+v", stats)
+	}
+
+	// A JetStream subscription also reports its consumer
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "METRICS", Subjects: []string{"metrics.js"}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := js.Publish("metrics.js", []byte("reading")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pull, err := js.PullSubscribe("metrics.js", "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := pull.Fetch(2, nats.MaxWait(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs[0].Ack()
+	msgs[1].Nak()
+	nc.Flush()
+	if _, err := pull.Fetch(1, nats.MaxWait(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = Stats(pull); err != nil {
+		t.Fatal(err)
+	}
+	if !stats.JetStream || stats.ConsumerPending != 3 || stats.AckPending != 1 || stats.Redelivered != 1 {
+		t.Fatalf("expected 3 messages left, 1 awaiting its ack after a redelivery, got %+v", stats)
+	}
+
+	pull.Unsubscribe()
+	if _, err := Stats(pull); !errors.Is(err, nats.ErrBadSubscription) {
+		t.Fatalf("expected a closed subscription to fail, got %v", err)
+	}
+}
@@ -2,7 +2,12 @@
 package pubsub
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/kiquetal/nats-go-examples/pkg/models"
@@ -15,18 +20,117 @@ type MessageHandler func(*models.Message) error
 // RawMessageHandler is a function type for handling raw message data
 type RawMessageHandler func(subject string, data []byte) error
 
+// ReplyHandler is a function type for handling request messages.
+// The returned message is sent back to the requester when the incoming message has a reply subject.
+type ReplyHandler func(*models.Message) (*models.Message, error)
+
 // Subscriber defines the interface for subscribing to messages
 type Subscriber interface {
 	Subscribe(subject string, handler RawMessageHandler) (*nats.Subscription, error)
 	SubscribeMessage(subject string, handler MessageHandler) (*nats.Subscription, error)
 	QueueSubscribe(subject, queue string, handler RawMessageHandler) (*nats.Subscription, error)
 	QueueSubscribeMessage(subject, queue string, handler MessageHandler) (*nats.Subscription, error)
+	SubscribeReply(subject string, handler ReplyHandler) (*nats.Subscription, error)
+	QueueSubscribeReply(subject, queue string, handler ReplyHandler) (*nats.Subscription, error)
+	SubscribeDurable(stream, consumer string, handler MessageHandler) (*nats.Subscription, error)
+	SubscribeCtx(ctx context.Context, subject string, handler RawMessageHandler) (*nats.Subscription, error)
+	SubscribeMessageCtx(ctx context.Context, subject string, handler MessageHandler) (*nats.Subscription, error)
+	QueueSubscribeCtx(ctx context.Context, subject, queue string, handler RawMessageHandler) (*nats.Subscription, error)
+	QueueSubscribeMessageCtx(ctx context.Context, subject, queue string, handler MessageHandler) (*nats.Subscription, error)
+	SubscribeReplyCtx(ctx context.Context, subject string, handler ReplyHandler) (*nats.Subscription, error)
+	QueueSubscribeReplyCtx(ctx context.Context, subject, queue string, handler ReplyHandler) (*nats.Subscription, error)
+	SubscribeDurableCtx(ctx context.Context, stream, consumer string, handler MessageHandler) (*nats.Subscription, error)
+	SubscribeDurableAck(stream, consumer string, handler AckHandler) (*nats.Subscription, error)
+	SubscribeDurableAckCtx(ctx context.Context, stream, consumer string, handler AckHandler) (*nats.Subscription, error)
+	SubscribeMux(subject string, mux *SubjectMux) (*nats.Subscription, error)
+	QueueSubscribeMux(subject, queue string, mux *SubjectMux) (*nats.Subscription, error)
 	Close()
 }
 
+// DurableOptions configures the consumers created by SubscribeDurable
+type DurableOptions struct {
+	// FilterSubject limits the consumer to part of the stream, all of it when empty
+	FilterSubject string
+	// AckWait is how long the server waits for an ack before redelivering a message
+	AckWait time.Duration
+	// MaxDeliver bounds the delivery attempts of a message, -1 for no limit
+	MaxDeliver int
+}
+
+// Default durable consumer settings, used when DurableOptions leaves them unset
+const (
+	DefaultConsumerAckWait = 30 * time.Second
+	DefaultMaxDeliver      = 5
+)
+
+// MessageVerifier checks incoming messages, returning an error for messages that must not be handled
+type MessageVerifier interface {
+	Verify(msg *nats.Msg) error
+}
+
+// DeadLetterSuffix is appended to a message's subject to form its dead-letter subject, unless
+// the subscriber has a fixed one
+const DeadLetterSuffix = ".dlq"
+
+// ErrorHandler receives a message that could not be handled and the reason
+type ErrorHandler func(msg *nats.Msg, err error)
+
+// PanicHandler receives a message whose handling panicked, e.g. to log the stack or to answer
+// the request with an error
+type PanicHandler func(msg *nats.Msg, err *PanicError)
+
 // NATSSubscriber implements the Subscriber interface using NATS
 type NATSSubscriber struct {
-	conn *nats.Conn
+	conn       *nats.Conn
+	recorder   *Recorder
+	verifier   MessageVerifier
+	encrypter  *Encrypter
+	compressor *Compressor
+	chunks     *Reassembler
+	validator  PayloadValidator
+	deadLetter bool
+	dlqSubject string // fixed dead-letter subject, the message's subject plus DeadLetterSuffix if empty
+	onError    ErrorHandler
+	onPanic    PanicHandler
+	panics     atomic.Int64
+	middleware []Middleware
+	durable    DurableOptions
+
+	pendingMsgs  int // pending limits of new subscriptions, the NATS defaults when both are 0
+	pendingBytes int
+	onSlow       SlowConsumerHandler
+}
+
+// SubscriberOption configures a subscriber created by NewSubscriberFromConn
+type SubscriberOption func(*NATSSubscriber)
+
+// WithErrorHandler calls fn with every message that could not be decoded, failed validation,
+// whose handler returned an error or whose reply could not be sent, e.g. to log it
+func WithErrorHandler(fn ErrorHandler) SubscriberOption {
+	return func(s *NATSSubscriber) {
+		s.onError = fn
+	}
+}
+
+// WithDeadLetter forwards failed messages to a dead-letter subject, see SetDeadLetter
+func WithDeadLetter(subject string) SubscriberOption {
+	return func(s *NATSSubscriber) {
+		s.SetDeadLetter(subject)
+	}
+}
+
+// WithPanicHandler calls fn with every message whose handling panicked, see SetPanicHandler
+func WithPanicHandler(fn PanicHandler) SubscriberOption {
+	return func(s *NATSSubscriber) {
+		s.onPanic = fn
+	}
+}
+
+// WithMiddleware wraps every handler of the subscriber, see Use
+func WithMiddleware(middleware ...Middleware) SubscriberOption {
+	return func(s *NATSSubscriber) {
+		s.Use(middleware...)
+	}
 }
 
 // NewSubscriber creates a new NATS subscriber
@@ -43,54 +147,614 @@ func NewSubscriber(natsURL string, options ...nats.Option) (*NATSSubscriber, err
 	return &NATSSubscriber{conn: nc}, nil
 }
 
-// Subscribe subscribes to a subject with a raw message handler
-func (s *NATSSubscriber) Subscribe(subject string, handler RawMessageHandler) (*nats.Subscription, error) {
-	return s.conn.Subscribe(subject, func(msg *nats.Msg) {
-		if err := handler(msg.Subject, msg.Data); err != nil {
-			// Handle error (could log here)
+// NewSubscriberFromConn creates a subscriber on an existing connection, which it closes on Close
+func NewSubscriberFromConn(nc *nats.Conn, opts ...SubscriberOption) *NATSSubscriber {
+	s := &NATSSubscriber{conn: nc}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// SetRecorder captures every received message with the given recorder before it is handled
+func (s *NATSSubscriber) SetRecorder(recorder *Recorder) {
+	s.recorder = recorder
+}
+
+// Conn returns the underlying NATS connection, e.g. to obtain a JetStream context
+func (s *NATSSubscriber) Conn() *nats.Conn {
+	return s.conn
+}
+
+// SetVerifier drops every received message that fails verification before it reaches the handler
+func (s *NATSSubscriber) SetVerifier(verifier MessageVerifier) {
+	s.verifier = verifier
+}
+
+// SetEncrypter decrypts every received message before it is verified and handled, and
+// encrypts the replies to encrypted requests under the key of the request. Messages that
+// cannot be decrypted are dropped like those failing verification.
+func (s *NATSSubscriber) SetEncrypter(encrypter *Encrypter) {
+	s.encrypter = encrypter
+}
+
+// SetCompressor decompresses every received message with a ContentEncodingHeader after
+// decrypting it, and compresses dead letters and the replies to compressed requests above the
+// compressor's threshold. Messages that cannot be decompressed are dropped like those failing
+// verification.
+func (s *NATSSubscriber) SetCompressor(compressor *Compressor) {
+	s.compressor = compressor
+}
+
+// EnableReassembly puts messages chunked by a publisher with EnableChunking back together
+// before they are decrypted, verified and handled. Messages whose chunks do not all arrive
+// within timeout, or that would take the chunks buffered past maxBytes, go to the error
+// handler but are not dead-lettered; the defaults apply when they are not positive. Only
+// plain and reply subscriptions reassemble: queue groups spread the chunks of a message over
+// their members, and durable consumers do not.
+func (s *NATSSubscriber) EnableReassembly(timeout time.Duration, maxBytes int) {
+	s.chunks = NewReassembler(timeout, maxBytes, func(first *nats.Msg, err error) {
+		if s.onError != nil {
+			s.onError(first, err)
 		}
 	})
 }
 
-// SubscribeMessage subscribes to a subject with a structured message handler
-func (s *NATSSubscriber) SubscribeMessage(subject string, handler MessageHandler) (*nats.Subscription, error) {
-	return s.conn.Subscribe(subject, func(msg *nats.Msg) {
-		var message models.Message
-		if err := json.Unmarshal(msg.Data, &message); err != nil {
-			// Handle error (could log here)
-			return
+// SetValidator checks the payload of every received message, e.g. against a Schema, before
+// it is decoded or passed to a raw handler. Messages that fail are rejected.
+func (s *NATSSubscriber) SetValidator(validator PayloadValidator) {
+	s.validator = validator
+}
+
+// SetDeadLetter forwards failed messages, those that fail validation, cannot be decoded or
+// whose handler returns an error, to subject with their payload, headers and the Dlq-*
+// headers of models.DeadLetterError and friends. An empty subject sends each message to its
+// own subject plus DeadLetterSuffix, e.g. orders.new.dlq. Without a dead-letter subject
+// failed messages are only passed to the error handler.
+func (s *NATSSubscriber) SetDeadLetter(subject string) {
+	s.deadLetter = true
+	s.dlqSubject = subject
+}
+
+// SetErrorHandler calls fn with every failed message and the reason, see WithErrorHandler
+func (s *NATSSubscriber) SetErrorHandler(fn ErrorHandler) {
+	s.onError = fn
+}
+
+// Use wraps the handlers of later subscriptions in middleware, the first one outermost, e.g.
+// Recover, Logging and Metrics. Raw handlers are presented to the middleware as a Message with
+// the subject, headers and payload as body; reply and durable handlers fail with the error
+// the middleware returns.
+func (s *NATSSubscriber) Use(middleware ...Middleware) {
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// SetPanicHandler calls fn with every message whose handling panicked. Every callback of the
+// subscriber recovers from panics, so one malformed message cannot take the process down: the
+// message fails with a *PanicError like with a handler error, after fn was called.
+func (s *NATSSubscriber) SetPanicHandler(fn PanicHandler) {
+	s.onPanic = fn
+}
+
+// Panics returns how many messages panicked since the subscriber was created
+func (s *NATSSubscriber) Panics() int64 {
+	return s.panics.Load()
+}
+
+// SetDurableOptions configures the consumers created by later SubscribeDurable calls
+func (s *NATSSubscriber) SetDurableOptions(opts DurableOptions) {
+	s.durable = opts
+}
+
+// accept records the message if a recorder is configured, decrypts and decompresses it if an
+// encrypter and a compressor are, and reports whether it passes verification. Messages
+// failing any of these go to the error handler but are not dead-lettered, as they may not come from a legitimate
+// publisher.
+func (s *NATSSubscriber) accept(msg *nats.Msg) bool {
+	if s.recorder != nil {
+		if err := s.recorder.Record(msg); err != nil && s.onError != nil {
+			s.onError(msg, fmt.Errorf("failed to record message: %w", err))
 		}
+	}
+	if s.encrypter != nil {
+		if _, err := s.encrypter.Decrypt(msg); err != nil {
+			if s.onError != nil {
+				s.onError(msg, fmt.Errorf("decryption failed: %w", err))
+			}
+			return false
+		}
+	}
+	if s.compressor != nil {
+		if err := s.compressor.Decompress(msg); err != nil {
+			if s.onError != nil {
+				s.onError(msg, fmt.Errorf("decompression failed: %w", err))
+			}
+			return false
+		}
+	}
+	if s.verifier == nil {
+		return true
+	}
+	if err := s.verifier.Verify(msg); err != nil {
+		if s.onError != nil {
+			s.onError(msg, fmt.Errorf("verification failed: %w", err))
+		}
+		return false
+	}
+	return true
+}
 
-		if err := handler(&message); err != nil {
-			// Handle error (could log here)
+// reassemble passes chunks to the reassembler, if reassembly is enabled, and returns the
+// whole message once its last chunk arrived. Messages that are not chunks pass as they are.
+func (s *NATSSubscriber) reassemble(msg *nats.Msg) (*nats.Msg, bool) {
+	if s.chunks == nil {
+		return msg, true
+	}
+	whole, err := s.chunks.Add(msg)
+	if err != nil {
+		if s.onError != nil {
+			s.onError(msg, err)
 		}
-	})
+		return nil, false
+	}
+	return whole, whole != nil
+}
+
+// check validates the payload, rejecting the message when it fails
+func (s *NATSSubscriber) check(msg *nats.Msg) bool {
+	if s.validator == nil {
+		return true
+	}
+	if err := s.validator.Validate(msg.Data); err != nil {
+		s.fail(msg, fmt.Errorf("invalid payload: %w", err), 1)
+		return false
+	}
+	return true
+}
+
+// decode validates and decodes a structured message, rejecting it when either fails
+func (s *NATSSubscriber) decode(msg *nats.Msg) (*models.Message, bool) {
+	if !s.check(msg) {
+		return nil, false
+	}
+	message, err := fromNATSMsg(msg)
+	if err != nil {
+		s.fail(msg, fmt.Errorf("invalid message: %w", err), 1)
+		return nil, false
+	}
+	return message, true
+}
+
+// recoverPanic is deferred by every callback. It turns a panic into a *PanicError, reports it
+// to the panic handler and passes it to failed, or fails the message when failed is nil.
+func (s *NATSSubscriber) recoverPanic(msg *nats.Msg, failed func(error)) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	err, ok := r.(*PanicError)
+	if !ok {
+		err = &PanicError{Value: r, Stack: debug.Stack()}
+	}
+	s.panics.Add(1)
+	if s.onPanic != nil {
+		s.onPanic(msg, err)
+	}
+	if failed == nil {
+		s.fail(msg, err, 1)
+		return
+	}
+	failed(err)
+}
+
+// handle runs a decoded message through the middleware and handler
+func (s *NATSSubscriber) handle(handler MessageHandler, message *models.Message) error {
+	return chain(handler, s.middleware)(message)
+}
+
+// handleRaw runs a raw message through the middleware and handler, decoding it only when
+// there is middleware to present it to
+func (s *NATSSubscriber) handleRaw(handler RawMessageHandler, msg *nats.Msg) error {
+	if len(s.middleware) == 0 {
+		return handler(msg.Subject, msg.Data)
+	}
+	message := &models.Message{Subject: msg.Subject, Body: string(msg.Data), Headers: msg.Header}
+	return s.handle(func(*models.Message) error {
+		return handler(msg.Subject, msg.Data)
+	}, message)
+}
+
+// fail reports a message that could not be handled after the given delivery attempts and
+// parks it on the dead-letter subject, keeping its payload and headers so it can be
+// re-published once the cause is fixed. With a compressor and an encrypter, the payload is
+// compressed and encrypted again.
+func (s *NATSSubscriber) fail(msg *nats.Msg, cause error, attempts int) {
+	if s.onError != nil {
+		s.onError(msg, cause)
+	}
+	if !s.deadLetter {
+		return
+	}
+
+	subject := s.dlqSubject
+	if subject == "" {
+		subject = msg.Subject + DeadLetterSuffix
+	}
+	letter := nats.NewMsg(subject)
+	letter.Data = msg.Data
+	for key, values := range msg.Header {
+		letter.Header[key] = values
+	}
+	source := s.conn.Opts.Name
+	if source == "" {
+		source = "pubsub"
+	}
+	letter.Header.Set(models.DeadLetterOriginalSubject, msg.Subject)
+	letter.Header.Set(models.DeadLetterError, cause.Error())
+	letter.Header.Set(models.DeadLetterAttempts, strconv.Itoa(attempts))
+	letter.Header.Set(models.DeadLetterSource, source)
+	if s.compressor != nil {
+		if err := s.compressor.Compress(letter); err != nil {
+			if s.onError != nil {
+				s.onError(msg, fmt.Errorf("failed to dead-letter message: %w", err))
+			}
+			return
+		}
+	}
+	if s.encrypter != nil {
+		if err := s.encrypter.Encrypt(letter); err != nil {
+			if s.onError != nil {
+				s.onError(msg, fmt.Errorf("failed to dead-letter message: %w", err))
+			}
+			return
+		}
+	}
+	if err := s.conn.PublishMsg(letter); err != nil && s.onError != nil {
+		s.onError(msg, fmt.Errorf("failed to dead-letter message: %w", err))
+	}
+}
+
+// Subscribe subscribes to a subject with a raw message handler
+func (s *NATSSubscriber) Subscribe(subject string, handler RawMessageHandler) (*nats.Subscription, error) {
+	return s.limit(s.conn.Subscribe(subject, s.rawCallback(handler)))
+}
+
+// SubscribeMessage subscribes to a subject with a structured message handler
+func (s *NATSSubscriber) SubscribeMessage(subject string, handler MessageHandler) (*nats.Subscription, error) {
+	return s.limit(s.conn.Subscribe(subject, s.messageCallback(handler)))
 }
 
 // QueueSubscribe subscribes to a subject with a queue group and raw message handler
 func (s *NATSSubscriber) QueueSubscribe(subject, queue string, handler RawMessageHandler) (*nats.Subscription, error) {
-	return s.conn.QueueSubscribe(subject, queue, func(msg *nats.Msg) {
-		if err := handler(msg.Subject, msg.Data); err != nil {
-			// Handle error (could log here)
-		}
-	})
+	return s.limit(s.conn.QueueSubscribe(subject, queue, s.rawCallback(handler)))
 }
 
 // QueueSubscribeMessage subscribes to a subject with a queue group and structured message handler
 func (s *NATSSubscriber) QueueSubscribeMessage(subject, queue string, handler MessageHandler) (*nats.Subscription, error) {
-	return s.conn.QueueSubscribe(subject, queue, func(msg *nats.Msg) {
-		var message models.Message
-		if err := json.Unmarshal(msg.Data, &message); err != nil {
-			// Handle error (could log here)
+	return s.limit(s.conn.QueueSubscribe(subject, queue, s.messageCallback(handler)))
+}
+
+// rawCallback wraps a RawMessageHandler into a NATS message callback
+func (s *NATSSubscriber) rawCallback(handler RawMessageHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		defer s.recoverPanic(msg, nil)
+		msg, ok := s.reassemble(msg)
+		if !ok || !s.accept(msg) || !s.check(msg) {
+			return
+		}
+		if err := s.handleRaw(handler, msg); err != nil {
+			s.fail(msg, err, 1)
+		}
+	}
+}
+
+// messageCallback wraps a MessageHandler into a NATS message callback
+func (s *NATSSubscriber) messageCallback(handler MessageHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		defer s.recoverPanic(msg, nil)
+		msg, ok := s.reassemble(msg)
+		if !ok || !s.accept(msg) {
+			return
+		}
+		message, ok := s.decode(msg)
+		if !ok {
+			return
+		}
+
+		if err := s.handle(handler, message); err != nil {
+			s.fail(msg, err, 1)
+		}
+	}
+}
+
+// SubscribeReply subscribes to a subject and replies to request messages with the handler's result
+func (s *NATSSubscriber) SubscribeReply(subject string, handler ReplyHandler) (*nats.Subscription, error) {
+	return s.limit(s.conn.Subscribe(subject, s.replyCallback(handler)))
+}
+
+// QueueSubscribeReply subscribes to a subject with a queue group and replies to request messages
+func (s *NATSSubscriber) QueueSubscribeReply(subject, queue string, handler ReplyHandler) (*nats.Subscription, error) {
+	return s.limit(s.conn.QueueSubscribe(subject, queue, s.replyCallback(handler)))
+}
+
+// replyCallback wraps a ReplyHandler into a NATS message callback
+func (s *NATSSubscriber) replyCallback(handler ReplyHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		defer s.recoverPanic(msg, nil)
+		msg, ok := s.reassemble(msg)
+		if !ok {
+			return
+		}
+		keyID, encoding := EncryptionKeyID(msg), ContentEncoding(msg)
+		if !s.accept(msg) {
+			return
+		}
+		message, ok := s.decode(msg)
+		if !ok {
+			return
+		}
+
+		var reply *models.Message
+		err := s.handle(func(m *models.Message) error {
+			var err error
+			reply, err = handler(m)
+			return err
+		}, message)
+		if err != nil {
+			s.fail(msg, err, 1)
+			return
+		}
+		if reply == nil || msg.Reply == "" {
+			// Nothing to send back
 			return
 		}
 
-		if err := handler(&message); err != nil {
-			// Handle error (could log here)
+		if err := s.respond(msg, reply, keyID, encoding); err != nil && s.onError != nil {
+			s.onError(msg, fmt.Errorf("failed to reply: %w", err))
+		}
+	}
+}
+
+// respond sends the reply to a request, compressed and encrypted like the request was
+func (s *NATSSubscriber) respond(msg *nats.Msg, reply *models.Message, keyID, encoding string) error {
+	reply.Subject = msg.Reply
+	replyMsg, err := toNATSMsg(reply)
+	if err != nil {
+		return err
+	}
+	if s.compressor != nil && encoding != "" {
+		// Compress only for requesters that compress, and so can decompress
+		if err := s.compressor.Compress(replyMsg); err != nil {
+			return fmt.Errorf("compression failed: %w", err)
+		}
+	}
+	if s.encrypter != nil && keyID != "" {
+		// Answer under the key of the request, which the requester is sure to hold
+		SetRequestID(replyMsg, RequestID(msg))
+		if err := s.encrypter.EncryptWithKey(replyMsg, keyID); err != nil {
+			return fmt.Errorf("encryption failed: %w", err)
+		}
+	}
+	return msg.RespondMsg(replyMsg)
+}
+
+// SubscribeDurable binds to a durable JetStream consumer on the stream, creating it when it
+// does not exist and updating its settings otherwise. Messages are acked once the handler
+// succeeds and redelivered after a handler error, up to MaxDeliver attempts after which they
+// are dead-lettered; messages that cannot be verified are terminated, and those that cannot
+// be validated or decoded are dead-lettered as well. The consumer outlives the subscription,
+// so a restarted subscriber resumes after the last acked message.
+func (s *NATSSubscriber) SubscribeDurable(stream, consumer string, handler MessageHandler) (*nats.Subscription, error) {
+	return s.SubscribeDurableCtx(context.Background(), stream, consumer, handler)
+}
+
+// SubscribeDurableCtx is SubscribeDurable with the consumer setup bounded by ctx, or by
+// DefaultFlushTimeout when ctx has no deadline
+func (s *NATSSubscriber) SubscribeDurableCtx(ctx context.Context, stream, consumer string, handler MessageHandler) (*nats.Subscription, error) {
+	return s.SubscribeDurableAckCtx(ctx, stream, consumer, func(m *AckableMessage) AckDecision {
+		if err := handler(m.Message); err != nil {
+			return Nak(err, 0)
 		}
+		return Ack()
 	})
 }
 
+// SubscribeDurableAck is SubscribeDurable with a handler that decides itself whether each
+// message is acked, redelivered, possibly after a delay, or terminated, and that can extend
+// its ack wait with InProgress. Naks on the last of MaxDeliver attempts and terms are
+// dead-lettered.
+func (s *NATSSubscriber) SubscribeDurableAck(stream, consumer string, handler AckHandler) (*nats.Subscription, error) {
+	return s.SubscribeDurableAckCtx(context.Background(), stream, consumer, handler)
+}
+
+// SubscribeDurableAckCtx is SubscribeDurableAck with the consumer setup bounded by ctx, or by
+// DefaultFlushTimeout when ctx has no deadline
+func (s *NATSSubscriber) SubscribeDurableAckCtx(ctx context.Context, stream, consumer string, handler AckHandler) (*nats.Subscription, error) {
+	ctx, cancel := boundedContext(ctx)
+	defer cancel()
+
+	// Only the setup is bound to ctx, the subscription keeps its JetStream context for acks
+	setup, err := s.conn.JetStream(nats.Context(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JetStream context: %w", err)
+	}
+	if err := s.ensureConsumer(setup, stream, consumer, true); err != nil {
+		return nil, err
+	}
+	js, err := s.conn.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JetStream context: %w", err)
+	}
+
+	// Binding keeps the library from deleting the consumer on Unsubscribe or Drain
+	return s.limit(js.Subscribe(s.durable.FilterSubject, s.ackCallback(handler), nats.Bind(stream, consumer), nats.ManualAck()))
+}
+
+// ackCallback wraps an AckHandler into a callback for messages from a durable consumer, which
+// settles every message it is given
+func (s *NATSSubscriber) ackCallback(handler AckHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		// A panicking handler has the message redelivered like a handler error, a panic before the
+		// handler runs terminates it
+		var m *AckableMessage
+		defer s.recoverPanic(msg, func(err error) {
+			if m == nil {
+				s.fail(msg, err, 1)
+				msg.Term()
+				return
+			}
+			s.settle(m, Nak(err, 0))
+		})
+
+		var ok bool
+		if m, ok = s.ackable(msg); !ok {
+			return
+		}
+
+		// Middleware that fails the message without the handler deciding, e.g. Recover after
+		// a panic, asks for redelivery
+		var decision AckDecision
+		decided := false
+		err := s.handle(func(*models.Message) error {
+			decision, decided = handler(m), true
+			return decision.err
+		}, m.Message)
+		if !decided {
+			decision = Ack()
+			if err != nil {
+				decision = Nak(err, 0)
+			}
+		}
+		s.settle(m, decision)
+	}
+}
+
+// ackable decrypts, verifies and decodes a message from a durable consumer, terminating it
+// when any of these fails
+func (s *NATSSubscriber) ackable(msg *nats.Msg) (*AckableMessage, bool) {
+	if !s.accept(msg) {
+		msg.Term()
+		return nil, false
+	}
+	message, ok := s.decode(msg)
+	if !ok {
+		msg.Term()
+		return nil, false
+	}
+	m := &AckableMessage{Message: message, msg: msg}
+	if meta, err := msg.Metadata(); err == nil {
+		m.meta = meta
+	}
+	return m, true
+}
+
+// lastDelivery reports whether a message delivered this many times will not be redelivered
+func (s *NATSSubscriber) lastDelivery(delivered uint64) bool {
+	maxDeliver := s.durable.MaxDeliver
+	if maxDeliver == 0 {
+		maxDeliver = DefaultMaxDeliver
+	}
+	return maxDeliver > 0 && delivered >= uint64(maxDeliver)
+}
+
+// ensureConsumer creates the durable push or pull consumer or brings an existing one up to date
+func (s *NATSSubscriber) ensureConsumer(js nats.JetStreamContext, stream, consumer string, push bool) error {
+	cfg := &nats.ConsumerConfig{
+		Durable:       consumer,
+		FilterSubject: s.durable.FilterSubject,
+		DeliverPolicy: nats.DeliverAllPolicy,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       s.durable.AckWait,
+		MaxDeliver:    s.durable.MaxDeliver,
+	}
+	if cfg.AckWait <= 0 {
+		cfg.AckWait = DefaultConsumerAckWait
+	}
+	if cfg.MaxDeliver == 0 {
+		cfg.MaxDeliver = DefaultMaxDeliver
+	}
+
+	info, err := js.ConsumerInfo(stream, consumer)
+	switch {
+	case errors.Is(err, nats.ErrConsumerNotFound):
+		if push {
+			cfg.DeliverSubject = s.conn.NewInbox()
+		}
+		_, err = js.AddConsumer(stream, cfg)
+	case err == nil:
+		cfg.DeliverSubject = info.Config.DeliverSubject
+		_, err = js.UpdateConsumer(stream, cfg)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set up consumer %s on stream %s: %w", consumer, stream, err)
+	}
+	return nil
+}
+
+// SubscribeCtx is Subscribe, returning once the server has registered the subscription or
+// failing when that does not happen before ctx is done
+func (s *NATSSubscriber) SubscribeCtx(ctx context.Context, subject string, handler RawMessageHandler) (*nats.Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.confirm(ctx)(s.Subscribe(subject, handler))
+}
+
+// SubscribeMessageCtx is SubscribeMessage, returning once the server has registered the subscription
+func (s *NATSSubscriber) SubscribeMessageCtx(ctx context.Context, subject string, handler MessageHandler) (*nats.Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.confirm(ctx)(s.SubscribeMessage(subject, handler))
+}
+
+// QueueSubscribeCtx is QueueSubscribe, returning once the server has registered the subscription
+func (s *NATSSubscriber) QueueSubscribeCtx(ctx context.Context, subject, queue string, handler RawMessageHandler) (*nats.Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.confirm(ctx)(s.QueueSubscribe(subject, queue, handler))
+}
+
+// QueueSubscribeMessageCtx is QueueSubscribeMessage, returning once the server has registered the subscription
+func (s *NATSSubscriber) QueueSubscribeMessageCtx(ctx context.Context, subject, queue string, handler MessageHandler) (*nats.Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.confirm(ctx)(s.QueueSubscribeMessage(subject, queue, handler))
+}
+
+// SubscribeReplyCtx is SubscribeReply, returning once the server has registered the subscription
+func (s *NATSSubscriber) SubscribeReplyCtx(ctx context.Context, subject string, handler ReplyHandler) (*nats.Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.confirm(ctx)(s.SubscribeReply(subject, handler))
+}
+
+// QueueSubscribeReplyCtx is QueueSubscribeReply, returning once the server has registered the subscription
+func (s *NATSSubscriber) QueueSubscribeReplyCtx(ctx context.Context, subject, queue string, handler ReplyHandler) (*nats.Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.confirm(ctx)(s.QueueSubscribeReply(subject, queue, handler))
+}
+
+// confirm returns a function that flushes a new subscription to the server within ctx,
+// removing it again when the flush fails
+func (s *NATSSubscriber) confirm(ctx context.Context) func(*nats.Subscription, error) (*nats.Subscription, error) {
+	return func(sub *nats.Subscription, err error) (*nats.Subscription, error) {
+		if err != nil {
+			return nil, err
+		}
+		if err := flushContext(ctx, s.conn); err != nil {
+			sub.Unsubscribe()
+			return nil, fmt.Errorf("subscription to %s not confirmed: %w", sub.Subject, err)
+		}
+		return sub, nil
+	}
+}
+
 // Close closes the NATS connection
 func (s *NATSSubscriber) Close() {
 	if s.conn != nil {
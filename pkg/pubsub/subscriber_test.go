@@ -0,0 +1,133 @@
+package pubsub
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/testutil"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/nats-io/nats.go"
+)
+
+// connectTestServer starts an embedded NATS server with JetStream and connects to it as
+// test-subscriber
+func connectTestServer(t *testing.T) *nats.Conn {
+	t.Helper()
+	return testutil.Connect(t, testutil.StartServer(t), nats.Name("test-subscriber"))
+}
+
+func TestSubscriberDeadLettersRejectedMessages(t *testing.T) {
+	nc := connectTestServer(t)
+
+	schema, err := ParseSchema([]byte(`{"type":"object","required":["body"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscriber := NewSubscriberFromConn(nc)
+	subscriber.SetValidator(schema)
+	subscriber.SetDeadLetter("orders.dlq")
+
+	letters, err := nc.SubscribeSync("orders.dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan *models.Message, 1)
+	if _, err := subscriber.SubscribeMessage("orders.new", func(msg *models.Message) error {
+		handled <- msg
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	nc.Publish("orders.new", []byte(`{"subject":"orders.new"}`))
+	nc.Publish("orders.new", []byte(`{"body":"ok"}`))
+
+	letter, err := letters.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("expected the message without a body on the dead-letter subject: %v", err)
+	}
+	if letter.Header.Get(models.DeadLetterOriginalSubject) != "orders.new" ||
+		!strings.Contains(letter.Header.Get(models.DeadLetterError), "missing required property") ||
+		letter.Header.Get(models.DeadLetterSource) != "test-subscriber" {
+		t.Fatalf("unexpected dead-letter headers %v", letter.Header)
+	}
+
+	select {
+	case msg := <-handled:
+		if msg.Body != "ok" {
+			t.Fatalf("expected the valid message to be handled, got %q", msg.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the valid message to be handled")
+	}
+}
+
+func TestSubscriberDeadLettersHandlerErrors(t *testing.T) {
+	nc := connectTestServer(t)
+
+	failures := make(chan error, 2)
+	subscriber := NewSubscriberFromConn(nc,
+		WithErrorHandler(func(msg *nats.Msg, err error) { failures <- err }),
+		WithDeadLetter(""))
+
+	letters, err := nc.SubscribeSync("orders.new" + DeadLetterSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := subscriber.SubscribeMessage("orders.new", func(msg *models.Message) error {
+		return errors.New("out of stock")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := nats.NewMsg("orders.new")
+	msg.Data = []byte(`{"id":"1","body":"order"}`)
+	msg.Header.Set("Request-Id", "req-1")
+	nc.PublishMsg(msg)
+
+	letter, err := letters.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("expected the failed message on orders.new.dlq: %v", err)
+	}
+	if letter.Header.Get(models.DeadLetterError) != "out of stock" || letter.Header.Get("Request-Id") != "req-1" ||
+		string(letter.Data) != string(msg.Data) {
+		t.Fatalf("expected the original message with the error, got %v %s", letter.Header, letter.Data)
+	}
+	select {
+	case err := <-failures:
+		if err.Error() != "out of stock" {
+			t.Fatalf("expected the handler error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the error handler to be called")
+	}
+}
+
+func TestSubscriberReportsFailedReplies(t *testing.T) {
+	nc := testutil.Connect(t, testutil.StartServer(t, testutil.WithoutJetStream(), testutil.WithMaxPayload(1024)))
+
+	failures := make(chan error, 1)
+	subscriber := NewSubscriberFromConn(nc, WithErrorHandler(func(msg *nats.Msg, err error) {
+		failures <- err
+	}))
+	// The reply is larger than the server accepts
+	if _, err := subscriber.SubscribeReply("reports.render", func(msg *models.Message) (*models.Message, error) {
+		return models.NewMessage("", strings.Repeat("x", 2048)), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := nc.Request("reports.render", []byte(`{"body":"q1"}`), 100*time.Millisecond); !errors.Is(err, nats.ErrTimeout) {
+		t.Fatalf("expected the request to time out, got %v", err)
+	}
+	select {
+	case err := <-failures:
+		if !errors.Is(err, nats.ErrMaxPayload) || !strings.Contains(err.Error(), "failed to reply") {
+			t.Fatalf("expected the oversized reply to be reported, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the failed reply to reach the error handler")
+	}
+}
@@ -0,0 +1,173 @@
+package signing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Signer signs messages with the active private key, following rotations live
+type Signer struct {
+	mu      sync.RWMutex
+	secret  *SecretRecord
+	watcher nats.KeyWatcher
+}
+
+// NewSigner loads the active key from SecretsBucket and watches it for rotations
+func NewSigner(js nats.JetStreamContext) (*Signer, error) {
+	kv, err := js.KeyValue(SecretsBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s bucket: %w", SecretsBucket, err)
+	}
+
+	watcher, err := kv.Watch(ActiveKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch active key: %w", err)
+	}
+
+	s := &Signer{watcher: watcher}
+
+	// The watcher first delivers the current value, then nil once it is up to date
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		s.apply(entry)
+	}
+	if s.current() == nil {
+		watcher.Stop()
+		return nil, errors.New("no active signing key, run key-rotator first")
+	}
+
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry != nil {
+				s.apply(entry)
+			}
+		}
+	}()
+	return s, nil
+}
+
+// apply switches to the key in the entry. Malformed records are ignored, so signing goes on
+// with the previous key.
+func (s *Signer) apply(entry nats.KeyValueEntry) {
+	if entry.Operation() != nats.KeyValuePut {
+		return
+	}
+	var secret SecretRecord
+	if err := json.Unmarshal(entry.Value(), &secret); err != nil || !secret.valid() {
+		return
+	}
+	s.mu.Lock()
+	s.secret = &secret
+	s.mu.Unlock()
+}
+
+// current returns the active key
+func (s *Signer) current() *SecretRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.secret
+}
+
+// KeyID returns the ID of the key new messages are signed with
+func (s *Signer) KeyID() string {
+	return s.current().ID
+}
+
+// Sign adds signature headers to the message
+func (s *Signer) Sign(msg *nats.Msg) error {
+	secret := s.current()
+	Sign(msg, secret.ID, secret.PrivateKey)
+	return nil
+}
+
+// Stop stops following key rotations
+func (s *Signer) Stop() error {
+	return s.watcher.Stop()
+}
+
+// Verifier checks signatures against the public keys in PublicKeysBucket
+type Verifier struct {
+	mu      sync.RWMutex
+	keys    map[string]*KeyRecord
+	watcher nats.KeyWatcher
+}
+
+// NewVerifier loads all published public keys and keeps them up to date
+func NewVerifier(js nats.JetStreamContext) (*Verifier, error) {
+	kv, err := js.KeyValue(PublicKeysBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s bucket: %w", PublicKeysBucket, err)
+	}
+
+	watcher, err := kv.WatchAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch public keys: %w", err)
+	}
+
+	v := &Verifier{keys: make(map[string]*KeyRecord), watcher: watcher}
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		v.apply(entry)
+	}
+
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry != nil {
+				v.apply(entry)
+			}
+		}
+	}()
+	return v, nil
+}
+
+// apply adds, updates or removes the key in the entry. Malformed records remove the key, so
+// messages signed with it are refused as signed with an unknown key.
+func (v *Verifier) apply(entry nats.KeyValueEntry) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if entry.Operation() != nats.KeyValuePut {
+		delete(v.keys, entry.Key())
+		return
+	}
+	var record KeyRecord
+	if err := json.Unmarshal(entry.Value(), &record); err != nil || !record.valid() {
+		delete(v.keys, entry.Key())
+		return
+	}
+	v.keys[entry.Key()] = &record
+}
+
+// Verify checks that the message was signed with a published key that is still valid
+func (v *Verifier) Verify(msg *nats.Msg) error {
+	keyID := msg.Header.Get(KeyIDHeader)
+	if keyID == "" {
+		return ErrUnsigned
+	}
+
+	v.mu.RLock()
+	record, found := v.keys[keyID]
+	v.mu.RUnlock()
+
+	if !found {
+		return ErrUnknownKey
+	}
+	if !record.ValidAt(time.Now()) {
+		return ErrKeyExpired
+	}
+	return Verify(msg, record.PublicKey)
+}
+
+// Stop stops following key updates
+func (v *Verifier) Stop() error {
+	return v.watcher.Stop()
+}
@@ -0,0 +1,120 @@
+// Package signing provides Ed25519 message signatures with keys distributed through JetStream KV.
+// Publishers share the active key, which key-rotator rotates, and subscribers verify against
+// every published key. To authenticate requesters to a service instead, use the NKey request
+// signatures of pubsub.Sign and pubsub.Verify, which identify each requester by its own key.
+package signing
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// PublicKeysBucket holds one KeyRecord per key ID, readable by every verifier
+	PublicKeysBucket = "signing-keys"
+	// SecretsBucket holds the active private key under ActiveKey and should be readable by signers only
+	SecretsBucket = "signing-secrets"
+	// ActiveKey is the key in SecretsBucket that stores the current private key
+	ActiveKey = "active"
+
+	// KeyIDHeader names the key a message was signed with
+	KeyIDHeader = "Signature-Key-Id"
+	// SignatureHeader carries the base64-encoded Ed25519 signature
+	SignatureHeader = "Signature"
+)
+
+var (
+	// ErrUnsigned is returned when a message carries no signature headers
+	ErrUnsigned = errors.New("message is not signed")
+	// ErrUnknownKey is returned when the signing key is not (or no longer) published
+	ErrUnknownKey = errors.New("unknown signing key")
+	// ErrKeyExpired is returned when the signing key has been retired and its grace period is over
+	ErrKeyExpired = errors.New("signing key expired")
+	// ErrBadSignature is returned when the signature does not match the message
+	ErrBadSignature = errors.New("invalid signature")
+	// ErrInvalidKey is returned for keys that are not the size of Ed25519 keys
+	ErrInvalidKey = errors.New("invalid signing key")
+)
+
+// KeyRecord is the public part of a signing key as stored in PublicKeysBucket
+type KeyRecord struct {
+	ID        string            `json:"id"`
+	Version   int               `json:"version"`
+	PublicKey ed25519.PublicKey `json:"public_key"`
+	CreatedAt time.Time         `json:"created_at"`
+	// RetiredAt is set when a newer key takes over
+	RetiredAt time.Time `json:"retired_at,omitempty"`
+	// NotAfter ends the grace period of a retired key; zero while the key is active
+	NotAfter time.Time `json:"not_after,omitempty"`
+}
+
+// ValidAt reports whether signatures made with the key are accepted at the given time
+func (r *KeyRecord) ValidAt(t time.Time) bool {
+	return r.NotAfter.IsZero() || t.Before(r.NotAfter)
+}
+
+// valid reports whether the public key has the size of an Ed25519 key, which ed25519.Verify
+// needs to not panic
+func (r *KeyRecord) valid() bool {
+	return len(r.PublicKey) == ed25519.PublicKeySize
+}
+
+// SecretRecord is the private part of the active signing key as stored in SecretsBucket
+type SecretRecord struct {
+	ID         string             `json:"id"`
+	PrivateKey ed25519.PrivateKey `json:"private_key"`
+}
+
+// valid reports whether the private key has the size of an Ed25519 key, which ed25519.Sign
+// needs to not panic
+func (r *SecretRecord) valid() bool {
+	return len(r.PrivateKey) == ed25519.PrivateKeySize
+}
+
+// KeyID returns the key ID used for the given version
+func KeyID(version int) string {
+	return fmt.Sprintf("v%d", version)
+}
+
+// signedPayload binds the signature to the subject as well as the data, so a signed
+// message cannot be replayed on another subject
+func signedPayload(subject string, data []byte) []byte {
+	payload := make([]byte, 0, len(subject)+1+len(data))
+	payload = append(payload, subject...)
+	payload = append(payload, '\n')
+	return append(payload, data...)
+}
+
+// Sign adds the key ID and signature headers to the message
+func Sign(msg *nats.Msg, keyID string, key ed25519.PrivateKey) {
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	signature := ed25519.Sign(key, signedPayload(msg.Subject, msg.Data))
+	msg.Header.Set(KeyIDHeader, keyID)
+	msg.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(signature))
+}
+
+// Verify checks the message signature against the given public key
+func Verify(msg *nats.Msg, key ed25519.PublicKey) error {
+	encoded := msg.Header.Get(SignatureHeader)
+	if encoded == "" {
+		return ErrUnsigned
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return ErrInvalidKey
+	}
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if !ed25519.Verify(key, signedPayload(msg.Subject, msg.Data), signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
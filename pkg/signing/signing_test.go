@@ -0,0 +1,196 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/testutil"
+	"github.com/nats-io/nats.go"
+)
+
+// entry is a KV entry as delivered by a watcher
+type entry struct {
+	key   string
+	value []byte
+	op    nats.KeyValueOp
+}
+
+func (e entry) Bucket() string             { return "" }
+func (e entry) Key() string                { return e.key }
+func (e entry) Value() []byte              { return e.value }
+func (e entry) Revision() uint64           { return 0 }
+func (e entry) Created() time.Time         { return time.Time{} }
+func (e entry) Delta() uint64              { return 0 }
+func (e entry) Operation() nats.KeyValueOp { return e.op }
+
+func put(t *testing.T, key string, record interface{}) entry {
+	t.Helper()
+	value, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry{key: key, value: value, op: nats.KeyValuePut}
+}
+
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+func TestSignVerify(t *testing.T) {
+	public, private := newKey(t)
+	msg := &nats.Msg{Subject: "orders.created", Data: []byte(`{"id":1}`)}
+	Sign(msg, "v1", private)
+
+	if msg.Header.Get(KeyIDHeader) != "v1" {
+		t.Fatalf("expected key ID v1, got %q", msg.Header.Get(KeyIDHeader))
+	}
+	if err := Verify(msg, public); err != nil {
+		t.Fatalf("expected a valid signature, got %v", err)
+	}
+
+	tests := []struct {
+		name string
+		msg  *nats.Msg
+		key  ed25519.PublicKey
+		want error
+	}{
+		{"other subject", &nats.Msg{Subject: "orders.deleted", Data: msg.Data, Header: msg.Header}, public, ErrBadSignature},
+		{"other data", &nats.Msg{Subject: msg.Subject, Data: []byte(`{"id":2}`), Header: msg.Header}, public, ErrBadSignature},
+		{"unsigned", &nats.Msg{Subject: msg.Subject, Data: msg.Data}, public, ErrUnsigned},
+		{"short key", msg, public[:16], ErrInvalidKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Verify(tt.msg, tt.key); !errors.Is(err, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestKeyRecordValidAt(t *testing.T) {
+	now := time.Now()
+	active := &KeyRecord{ID: "v2"}
+	retired := &KeyRecord{ID: "v1", RetiredAt: now.Add(-time.Minute), NotAfter: now.Add(time.Minute)}
+
+	if !active.ValidAt(now.Add(24 * time.Hour)) {
+		t.Fatal("expected the active key valid")
+	}
+	if !retired.ValidAt(now) {
+		t.Fatal("expected the retired key valid during its grace period")
+	}
+	if retired.ValidAt(now.Add(2 * time.Minute)) {
+		t.Fatal("expected the retired key invalid after its grace period")
+	}
+}
+
+func TestVerifierKeys(t *testing.T) {
+	public1, private1 := newKey(t)
+	public2, private2 := newKey(t)
+	public3, private3 := newKey(t)
+	v := &Verifier{keys: make(map[string]*KeyRecord)}
+	v.apply(put(t, "v1", &KeyRecord{ID: "v1", PublicKey: public1, NotAfter: time.Now().Add(-time.Second)}))
+	v.apply(put(t, "v2", &KeyRecord{ID: "v2", PublicKey: public2}))
+	v.apply(put(t, "v3", &KeyRecord{ID: "v3", PublicKey: public3}))
+
+	signed := func(keyID string, key ed25519.PrivateKey) *nats.Msg {
+		msg := &nats.Msg{Subject: "orders.created", Data: []byte("data")}
+		Sign(msg, keyID, key)
+		return msg
+	}
+	if err := v.Verify(signed("v2", private2)); err != nil {
+		t.Fatalf("expected a valid signature, got %v", err)
+	}
+	if err := v.Verify(signed("v1", private1)); !errors.Is(err, ErrKeyExpired) {
+		t.Fatalf("expected %v, got %v", ErrKeyExpired, err)
+	}
+	if err := v.Verify(signed("v9", private2)); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected %v, got %v", ErrUnknownKey, err)
+	}
+	if err := v.Verify(signed("v3", private2)); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("expected %v, got %v", ErrBadSignature, err)
+	}
+
+	// A malformed update removes the key instead of making every verification panic
+	v.apply(put(t, "v3", &KeyRecord{ID: "v3", PublicKey: public3[:8]}))
+	if err := v.Verify(signed("v3", private3)); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected %v, got %v", ErrUnknownKey, err)
+	}
+
+	// Deleted keys are unknown
+	v.apply(entry{key: "v2", op: nats.KeyValueDelete})
+	if err := v.Verify(signed("v2", private2)); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected %v, got %v", ErrUnknownKey, err)
+	}
+}
+
+func TestSignerIgnoresMalformedKeys(t *testing.T) {
+	public, private := newKey(t)
+	s := &Signer{}
+	s.apply(put(t, ActiveKey, &SecretRecord{ID: "v1", PrivateKey: private}))
+	s.apply(put(t, ActiveKey, &SecretRecord{ID: "v2", PrivateKey: private[:16]}))
+	s.apply(entry{key: ActiveKey, value: []byte("not json"), op: nats.KeyValuePut})
+
+	msg := &nats.Msg{Subject: "orders.created", Data: []byte("data")}
+	if err := s.Sign(msg); err != nil {
+		t.Fatal(err)
+	}
+	if s.KeyID() != "v1" {
+		t.Fatalf("expected the signer to keep v1, got %s", s.KeyID())
+	}
+	if err := Verify(msg, public); err != nil {
+		t.Fatalf("expected a valid signature, got %v", err)
+	}
+}
+
+func TestSignerVerifierFromKV(t *testing.T) {
+	srv := testutil.StartServer(t)
+	js := testutil.JetStream(t, testutil.Connect(t, srv))
+
+	public, private := newKey(t)
+	keys, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: PublicKeysBucket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: SecretsBucket})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewSigner(js); err == nil {
+		t.Fatal("expected the signer to need an active key")
+	}
+	if _, err := keys.Put("v1", put(t, "v1", &KeyRecord{ID: "v1", Version: 1, PublicKey: public}).value); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secrets.Put(ActiveKey, put(t, ActiveKey, &SecretRecord{ID: "v1", PrivateKey: private}).value); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := NewSigner(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signer.Stop()
+	verifier, err := NewVerifier(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer verifier.Stop()
+
+	msg := &nats.Msg{Subject: "orders.created", Data: []byte("data")}
+	if err := signer.Sign(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(msg); err != nil {
+		t.Fatalf("expected a valid signature, got %v", err)
+	}
+}
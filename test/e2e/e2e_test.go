@@ -0,0 +1,351 @@
+//go:build e2e
+
+// Package e2e runs the token flow against real infrastructure: a nats-server container with
+// JetStream and a container built from the mock IDP's Dockerfile, with the token-worker and
+// brain-app binaries in between. It needs Docker and is only built with the e2e tag:
+//
+//	make e2e
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/health"
+	"github.com/nats-io/nats.go"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const (
+	natsImage    = "nats:2.10-alpine"
+	clientID     = "e2e-client"
+	clientSecret = "e2e-secret"
+	realmPath    = "/realms/phoenix"
+)
+
+// env is the environment shared by all tests, started once in TestMain
+var env struct {
+	natsURL  string
+	idpURL   string
+	brainURL string
+}
+
+func TestMain(m *testing.M) {
+	code, err := run(m)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to set up the e2e environment: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(code)
+}
+
+// run starts the containers and binaries, runs the tests and tears everything down
+func run(m *testing.M) (int, error) {
+	ctx := context.Background()
+	if !dockerAvailable(ctx) {
+		return 0, fmt.Errorf("no Docker daemon available, the e2e tests need one to start containers")
+	}
+
+	binDir, err := os.MkdirTemp("", "e2e-bin")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(binDir)
+	for _, name := range []string{"token-worker", "brain-app"} {
+		cmd := exec.Command("go", "build", "-o", filepath.Join(binDir, name), "../../cmd/"+name)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return 0, fmt.Errorf("failed to build %s: %w", name, err)
+		}
+	}
+
+	natsContainer, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        natsImage,
+			Cmd:          []string{"-js"},
+			ExposedPorts: []string{"4222/tcp"},
+			WaitingFor:   wait.ForLog("Server is ready"),
+		},
+		Started: true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to start NATS: %w", err)
+	}
+	defer testcontainers.TerminateContainer(natsContainer)
+	if env.natsURL, err = natsContainer.PortEndpoint(ctx, "4222/tcp", "nats"); err != nil {
+		return 0, err
+	}
+
+	idpContainer, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			FromDockerfile: testcontainers.FromDockerfile{
+				Context:    "../..",
+				Dockerfile: "cmd/mock-idp/Dockerfile",
+			},
+			Cmd:          []string{"-port", "9000", "-clients", clientID + ":" + clientSecret},
+			ExposedPorts: []string{"9000/tcp"},
+			WaitingFor:   wait.ForHTTP("/health").WithPort("9000/tcp"),
+		},
+		Started: true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to start the mock IDP: %w", err)
+	}
+	defer testcontainers.TerminateContainer(idpContainer)
+	if env.idpURL, err = idpContainer.PortEndpoint(ctx, "9000/tcp", "http"); err != nil {
+		return 0, err
+	}
+
+	configPath := filepath.Join(binDir, "app.json")
+	configData := fmt.Sprintf(`{"environment":"e2e","logLevel":"debug","nats":{"url":%q}}`, env.natsURL)
+	if err := os.WriteFile(configPath, []byte(configData), 0644); err != nil {
+		return 0, err
+	}
+
+	worker, err := startProcess(filepath.Join(binDir, "token-worker"), "-config", configPath, "-idp-url", env.idpURL, "-name-suffix", "e2e", "-metrics-addr", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer worker.stop()
+
+	port, err := freePort()
+	if err != nil {
+		return 0, err
+	}
+	brain, err := startProcess(filepath.Join(binDir, "brain-app"), "-config", configPath, "-port", fmt.Sprint(port))
+	if err != nil {
+		return 0, err
+	}
+	defer brain.stop()
+	env.brainURL = fmt.Sprintf("http://127.0.0.1:%d", port)
+
+	// Both binaries report ready once they are connected and, for the worker, reach the IDP
+	if err := waitReady("token-worker", func() bool { return healthUp("token-worker") }); err != nil {
+		return 0, worker.fail(err)
+	}
+	if err := waitReady("brain-app", func() bool { return httpOK(env.brainURL + "/readyz") }); err != nil {
+		return 0, brain.fail(err)
+	}
+
+	code := m.Run()
+	if code != 0 {
+		worker.dump()
+		brain.dump()
+	}
+	return code, nil
+}
+
+// dockerAvailable reports whether a Docker daemon can be reached. testcontainers panics
+// when it cannot find one, which is turned into false here.
+func dockerAvailable(ctx context.Context) (available bool) {
+	defer func() {
+		if recover() != nil {
+			available = false
+		}
+	}()
+
+	provider, err := testcontainers.NewDockerProvider()
+	if err != nil {
+		return false
+	}
+	defer provider.Close()
+	return provider.Health(ctx) == nil
+}
+
+// process is a binary running for the whole suite
+type process struct {
+	name   string
+	cmd    *exec.Cmd
+	output *bytes.Buffer
+}
+
+// startProcess runs a binary with a clean IDP and NATS environment
+func startProcess(path string, args ...string) (*process, error) {
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), "IDP_URL=", "IDP_TOKEN_PATH=", "NATS_URL=")
+	output := &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = output, output
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", path, err)
+	}
+	return &process{name: filepath.Base(path), cmd: cmd, output: output}, nil
+}
+
+func (p *process) stop() {
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+}
+
+// dump prints the process output, to explain failures
+func (p *process) dump() {
+	fmt.Fprintf(os.Stderr, "%s output:\n%s\n", p.name, p.output.String())
+}
+
+// fail dumps the output and passes err on
+func (p *process) fail(err error) error {
+	p.dump()
+	return err
+}
+
+// waitReady polls ready for up to 30 seconds, long enough for a cold container
+func waitReady(name string, ready func() bool) error {
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if ready() {
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return fmt.Errorf("%s did not become ready", name)
+}
+
+// healthUp asks a service for its health report over NATS
+func healthUp(service string) bool {
+	report, err := requestHealth(service)
+	return err == nil && report.Status == health.StatusUp
+}
+
+// requestHealth sends a request to health.<service> and decodes the reply
+func requestHealth(service string) (*health.Report, error) {
+	nc, err := nats.Connect(env.natsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer nc.Close()
+
+	msg, err := nc.Request(health.SubjectPrefix+service, nil, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	var report health.Report
+	if err := json.Unmarshal(msg.Data, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// httpOK reports whether the URL answers with 200
+func httpOK(url string) bool {
+	resp, err := http.Get(url)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// freePort returns a TCP port that is currently unused
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// requestToken calls the brain-app token endpoint and returns the status and decoded body
+func requestToken(t *testing.T, id, secret, query string) (int, map[string]string, string) {
+	t.Helper()
+
+	body := fmt.Sprintf(`{"client_id":%q,"client_secret":%q}`, id, secret)
+	resp, err := http.Post(env.brainURL+"/token"+query, "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	raw, _ := io.ReadAll(resp.Body)
+	var payload map[string]string
+	json.Unmarshal(raw, &payload)
+	return resp.StatusCode, payload, string(raw)
+}
+
+// introspect asks the mock IDP whether it issued the token
+func introspect(t *testing.T, token string) map[string]interface{} {
+	t.Helper()
+
+	form := url.Values{"token": {token}}
+	resp, err := http.Post(env.idpURL+realmPath+"/protocol/openid-connect/token/introspect",
+		"application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatalf("introspection failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var claims map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		t.Fatalf("failed to decode introspection: %v", err)
+	}
+	return claims
+}
+
+func TestTokenIsIssuedByIDPAndCached(t *testing.T) {
+	status, first, raw := requestToken(t, clientID, clientSecret, "?skip_cache=true")
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", status, raw)
+	}
+	if first["access_token"] == "" || first["source"] == "cache" {
+		t.Fatalf("expected a fresh token, got %s", raw)
+	}
+
+	// The token went HTTP -> NATS -> token-worker -> IDP, which recognizes it
+	claims := introspect(t, first["access_token"])
+	if claims["active"] != true || claims["client_id"] != clientID {
+		t.Fatalf("IDP does not recognize the token: %v", claims)
+	}
+
+	status, second, raw := requestToken(t, clientID, clientSecret, "")
+	if status != http.StatusOK {
+		t.Fatalf("expected 200 for cached token, got %d: %s", status, raw)
+	}
+	if second["source"] != "cache" || second["access_token"] != first["access_token"] {
+		t.Fatalf("expected the cached token, got %s", raw)
+	}
+}
+
+func TestUnknownClientIsRejected(t *testing.T) {
+	status, _, raw := requestToken(t, clientID, "wrong-secret", "?skip_cache=true")
+	if status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for wrong credentials, got %d: %s", status, raw)
+	}
+}
+
+func TestServicesReportHealthy(t *testing.T) {
+	report, err := requestHealth("token-worker")
+	if err != nil {
+		t.Fatalf("health request failed: %v", err)
+	}
+	for _, name := range []string{"nats", "subscription", "idp"} {
+		if check, ok := report.Checks[name]; !ok || check.Status != health.StatusUp {
+			t.Fatalf("expected check %s to be up: %+v", name, report.Checks)
+		}
+	}
+
+	// The container runs with JetStream, which the KV-backed components rely on
+	nc, err := nats.Connect(env.natsURL)
+	if err != nil {
+		t.Fatalf("failed to connect to NATS: %v", err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("failed to create JetStream context: %v", err)
+	}
+	if _, err := js.AccountInfo(); err != nil {
+		t.Fatalf("JetStream is not available: %v", err)
+	}
+}
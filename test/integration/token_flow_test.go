@@ -0,0 +1,795 @@
+// Package integration exercises the token flow end to end: an embedded NATS server,
+// a mock IDP, the token-worker and brain-app binaries talking to each other.
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/nats-go-examples/internal/idp"
+	"github.com/kiquetal/nats-go-examples/internal/testutil"
+	"github.com/kiquetal/nats-go-examples/pkg/models"
+	"github.com/kiquetal/nats-go-examples/pkg/pubsub"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// binDir holds the binaries built once for the whole suite
+var binDir string
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if testing.Short() {
+		fmt.Println("skipping integration tests in short mode")
+		os.Exit(0)
+	}
+
+	dir, err := os.MkdirTemp("", "token-flow-bin")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create bin dir: %v\n", err)
+		os.Exit(1)
+	}
+	binDir = dir
+
+	for _, name := range []string{"token-worker", "brain-app"} {
+		cmd := exec.Command("go", "build", "-o", filepath.Join(binDir, name), "../../cmd/"+name)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to build %s: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+
+	code := m.Run()
+	os.RemoveAll(binDir)
+	os.Exit(code)
+}
+
+// mockIDP is a controllable identity provider that counts token calls
+type mockIDP struct {
+	*httptest.Server
+	calls     atomic.Int64
+	status    atomic.Int64
+	delay     atomic.Int64 // nanoseconds
+	expiresIn atomic.Int64 // seconds
+	lastForm  atomic.Value // url.Values of the last successful token call
+}
+
+func newMockIDP(t *testing.T) *mockIDP {
+	t.Helper()
+
+	m := &mockIDP{}
+	m.status.Store(http.StatusOK)
+	m.expiresIn.Store(3600)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(idp.DefaultTokenEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		n := m.calls.Add(1)
+		time.Sleep(time.Duration(m.delay.Load()))
+
+		switch status := int(m.status.Load()); status {
+		case http.StatusOK:
+		case http.StatusUnauthorized:
+			w.WriteHeader(status)
+			w.Write([]byte(`{"error":"invalid_client","error_description":"Invalid client credentials"}`))
+			return
+		case http.StatusBadRequest:
+			w.WriteHeader(status)
+			w.Write([]byte(`{"error":"invalid_scope"}`))
+			return
+		default:
+			// Outages rarely answer with an OAuth error body
+			http.Error(w, "upstream unavailable", status)
+			return
+		}
+
+		r.ParseForm()
+		m.lastForm.Store(r.PostForm)
+		json.NewEncoder(w).Encode(idp.TokenResponse{
+			AccessToken: fmt.Sprintf("token-%s-%d", r.PostForm.Get("client_id"), n),
+			TokenType:   "Bearer",
+			ExpiresIn:   int(m.expiresIn.Load()),
+			Scope:       r.PostForm.Get("scope"),
+		})
+	})
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// stack is a running NATS server, mock IDP, token worker and brain-app
+type stack struct {
+	idp      *mockIDP
+	realmIDP *mockIDP // the IDP of the workers' partners realm
+	natsURL  string
+	brainURL string
+}
+
+// startNATS runs an embedded NATS server on a random port
+func startNATS(t *testing.T) *server.Server {
+	t.Helper()
+	return testutil.StartServer(t, testutil.WithoutJetStream())
+}
+
+// startStack wires all components together; withWorker=false leaves token.request without responders.
+// brainArgs are extra brain-app flags.
+func startStack(t *testing.T, withWorker bool, requestTimeout int, brainArgs ...string) *stack {
+	t.Helper()
+
+	srv := startNATS(t)
+	s := &stack{idp: newMockIDP(t), realmIDP: newMockIDP(t), natsURL: srv.ClientURL()}
+
+	configPath := filepath.Join(t.TempDir(), "app.json")
+	configData := fmt.Sprintf(`{"environment":"test","logLevel":"debug","nats":{"url":%q},"idp":{"realms":{"partners":{"url":%q}}}}`,
+		s.natsURL, s.realmIDP.URL)
+	if err := os.WriteFile(configPath, []byte(configData), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	if withWorker {
+		startProcess(t, "token-worker", "-config", configPath, "-idp-url", s.idp.URL, "-name-suffix", "test", "-metrics-addr", "127.0.0.1:0")
+		waitForWorker(t, s.natsURL)
+	}
+
+	port := freePort(t)
+	args := append([]string{"-config", configPath, "-port", fmt.Sprint(port),
+		"-request-timeout", fmt.Sprint(requestTimeout)}, brainArgs...)
+	startProcess(t, "brain-app", args...)
+	s.brainURL = fmt.Sprintf("http://127.0.0.1:%d", port)
+	waitForHTTP(t, s.brainURL+"/health")
+
+	return s
+}
+
+// startProcess runs one of the built binaries until the test ends
+func startProcess(t *testing.T, name string, args ...string) {
+	t.Helper()
+
+	cmd := exec.Command(filepath.Join(binDir, name), args...)
+	cmd.Env = append(os.Environ(), "IDP_URL=", "IDP_TOKEN_PATH=", "NATS_URL=")
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start %s: %v", name, err)
+	}
+
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("%s output:\n%s", name, output.String())
+		}
+	})
+}
+
+// waitForWorker blocks until a token worker answers on token.request
+func waitForWorker(t *testing.T, natsURL string) {
+	t.Helper()
+
+	nc, err := nats.Connect(natsURL)
+	if err != nil {
+		t.Fatalf("failed to connect to NATS: %v", err)
+	}
+	defer nc.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		// An invalid payload gets an immediate error reply without reaching the IDP
+		if _, err := nc.Request("token.request", []byte("ping"), 200*time.Millisecond); err == nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("token worker did not start")
+}
+
+// waitForHTTP blocks until the URL answers with 200
+func waitForHTTP(t *testing.T, url string) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("%s did not become ready", url)
+}
+
+// freePort returns a TCP port that is currently unused
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// requestToken calls the brain-app token endpoint and returns the status and decoded body
+func (s *stack) requestToken(t *testing.T, clientID, query string) (int, map[string]string, string) {
+	t.Helper()
+
+	body := fmt.Sprintf(`{"client_id":%q,"client_secret":"secret"}`, clientID)
+	resp, err := http.Post(s.brainURL+"/token"+query, "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	raw, _ := io.ReadAll(resp.Body)
+	var payload map[string]string
+	json.Unmarshal(raw, &payload)
+	return resp.StatusCode, payload, string(raw)
+}
+
+func TestTokenIsIssuedAndCached(t *testing.T) {
+	s := startStack(t, true, 5)
+
+	status, first, raw := s.requestToken(t, "client-a", "")
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", status, raw)
+	}
+	if first["access_token"] == "" || first["token_type"] != "Bearer" {
+		t.Fatalf("unexpected token response: %s", raw)
+	}
+
+	status, second, raw := s.requestToken(t, "client-a", "")
+	if status != http.StatusOK {
+		t.Fatalf("expected 200 for cached token, got %d: %s", status, raw)
+	}
+	if second["source"] != "cache" || second["access_token"] != first["access_token"] {
+		t.Fatalf("expected the cached token, got %s", raw)
+	}
+	if calls := s.idp.calls.Load(); calls != 1 {
+		t.Fatalf("expected 1 IDP call, got %d", calls)
+	}
+
+	// skip_cache always goes to the IDP
+	status, third, raw := s.requestToken(t, "client-a", "?skip_cache=true")
+	if status != http.StatusOK {
+		t.Fatalf("expected 200 with skip_cache, got %d: %s", status, raw)
+	}
+	if third["source"] == "cache" || third["access_token"] == first["access_token"] {
+		t.Fatalf("expected a fresh token with skip_cache, got %s", raw)
+	}
+	if calls := s.idp.calls.Load(); calls != 2 {
+		t.Fatalf("expected 2 IDP calls, got %d", calls)
+	}
+}
+
+func TestCachedTokenExpiresWithIDPLifetime(t *testing.T) {
+	s := startStack(t, true, 5, "-token-ttl-margin", "1")
+	s.idp.expiresIn.Store(2)
+
+	_, first, _ := s.requestToken(t, "client-a", "")
+	_, second, raw := s.requestToken(t, "client-a", "")
+	if second["source"] != "cache" || second["access_token"] != first["access_token"] {
+		t.Fatalf("expected the cached token, got %s", raw)
+	}
+
+	// 2s lifetime minus the 1s margin: the token is gone from the cache well before it expires
+	time.Sleep(1200 * time.Millisecond)
+	_, third, raw := s.requestToken(t, "client-a", "")
+	if third["source"] == "cache" || third["access_token"] == first["access_token"] {
+		t.Fatalf("expected a fresh token after the cache TTL, got %s", raw)
+	}
+	if calls := s.idp.calls.Load(); calls != 2 {
+		t.Fatalf("expected 2 IDP calls, got %d", calls)
+	}
+}
+
+func TestCachedTokenIsRefreshedAhead(t *testing.T) {
+	s := startStack(t, true, 5, "-token-ttl-margin", "0", "-refresh-ahead", "0.5", "-refresh-jitter", "0")
+	s.idp.expiresIn.Store(3)
+
+	_, first, _ := s.requestToken(t, "client-a", "")
+
+	// In the last half of the 3s TTL, the cached token is served and replaced in the background
+	time.Sleep(1700 * time.Millisecond)
+	_, second, raw := s.requestToken(t, "client-a", "")
+	if second["source"] != "cache" || second["access_token"] != first["access_token"] {
+		t.Fatalf("expected the cached token while refreshing, got %s", raw)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.idp.calls.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	_, third, raw := s.requestToken(t, "client-a", "")
+	if third["source"] != "cache" || third["access_token"] == first["access_token"] {
+		t.Fatalf("expected the refreshed token from the cache, got %s", raw)
+	}
+	if calls := s.idp.calls.Load(); calls != 2 {
+		t.Fatalf("expected 2 IDP calls, got %d", calls)
+	}
+}
+
+func TestTokenExpiringWithinMarginIsNotCached(t *testing.T) {
+	s := startStack(t, true, 5)
+	s.idp.expiresIn.Store(30) // below the default 60s margin
+
+	s.requestToken(t, "client-a", "")
+	_, second, raw := s.requestToken(t, "client-a", "")
+	if second["source"] == "cache" {
+		t.Fatalf("a token expiring within the margin must not be cached, got %s", raw)
+	}
+	if calls := s.idp.calls.Load(); calls != 2 {
+		t.Fatalf("expected 2 IDP calls, got %d", calls)
+	}
+}
+
+func TestCacheIsPerClient(t *testing.T) {
+	s := startStack(t, true, 5)
+
+	_, a, _ := s.requestToken(t, "client-a", "")
+	_, b, _ := s.requestToken(t, "client-b", "")
+	if a["access_token"] == b["access_token"] {
+		t.Fatalf("clients must not share tokens: %s", a["access_token"])
+	}
+	if calls := s.idp.calls.Load(); calls != 2 {
+		t.Fatalf("expected 2 IDP calls, got %d", calls)
+	}
+}
+
+func TestScopeAndAudienceArePassedAndCachedApart(t *testing.T) {
+	s := startStack(t, true, 5)
+
+	post := func(body string) map[string]string {
+		t.Helper()
+		resp, err := http.Post(s.brainURL+"/token", "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("token request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var payload map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected a token, got %d: %v", resp.StatusCode, err)
+		}
+		return payload
+	}
+
+	scoped := post(`{"client_id":"client-a","client_secret":"secret","scope":"orders:read","audience":"orders-api"}`)
+	form := s.idp.lastForm.Load().(url.Values)
+	if form.Get("scope") != "orders:read" || form.Get("audience") != "orders-api" {
+		t.Fatalf("expected the scope and audience to reach the IDP, got %v", form)
+	}
+	if scoped["scope"] != "orders:read" {
+		t.Fatalf("expected the granted scope in the response, got %v", scoped)
+	}
+
+	// The default scope has a token of its own, and the scoped one is served from the cache
+	if plain := post(`{"client_id":"client-a","client_secret":"secret"}`); plain["access_token"] == scoped["access_token"] {
+		t.Fatal("tokens of different scopes must not be shared")
+	}
+	again := post(`{"client_id":"client-a","client_secret":"secret","scope":"orders:read","audience":"orders-api"}`)
+	if again["source"] != "cache" || again["access_token"] != scoped["access_token"] {
+		t.Fatalf("expected the cached scoped token, got %v", again)
+	}
+	if calls := s.idp.calls.Load(); calls != 2 {
+		t.Fatalf("expected 2 IDP calls, got %d", calls)
+	}
+}
+
+func TestIDPErrorsMapToStatuses(t *testing.T) {
+	s := startStack(t, true, 5)
+
+	for _, tc := range []struct {
+		idpStatus int
+		want      int
+		message   string
+	}{
+		{http.StatusUnauthorized, http.StatusUnauthorized, "invalid_client (status 401): Invalid client credentials"},
+		{http.StatusBadRequest, http.StatusBadRequest, "invalid_scope"},
+		{http.StatusBadGateway, http.StatusServiceUnavailable, "server_error (status 502): upstream unavailable"},
+		{http.StatusTooManyRequests, http.StatusTooManyRequests, "(status 429): upstream unavailable"},
+	} {
+		s.idp.status.Store(int64(tc.idpStatus))
+		status, _, raw := s.requestToken(t, "client-a", "?skip_cache=true")
+		if status != tc.want {
+			t.Fatalf("IDP status %d: expected %d, got %d: %s", tc.idpStatus, tc.want, status, raw)
+		}
+		if !bytes.Contains([]byte(raw), []byte(tc.message)) {
+			t.Fatalf("IDP status %d: expected %q in the error, got %s", tc.idpStatus, tc.message, raw)
+		}
+	}
+
+	// Failures must not be cached
+	s.idp.status.Store(http.StatusOK)
+	if status, _, raw := s.requestToken(t, "client-a", ""); status != http.StatusOK {
+		t.Fatalf("expected 200 after the IDP recovered, got %d: %s", status, raw)
+	}
+}
+
+func TestWorkerDispatchesGrantTypes(t *testing.T) {
+	s := startStack(t, true, 5)
+	nc, err := nats.Connect(s.natsURL)
+	if err != nil {
+		t.Fatalf("failed to connect to NATS: %v", err)
+	}
+	defer nc.Close()
+
+	request := func(req *models.TokenRequest) *models.TokenResponse {
+		t.Helper()
+		data, _ := json.Marshal(req)
+		msg, err := nc.Request("token.request", data, 5*time.Second)
+		if err != nil {
+			t.Fatalf("token request failed: %v", err)
+		}
+		var response models.TokenResponse
+		if err := json.Unmarshal(msg.Data, &response); err != nil {
+			t.Fatalf("invalid token response: %v", err)
+		}
+		return &response
+	}
+
+	for _, tc := range []struct {
+		req  models.TokenRequest
+		form map[string]string
+	}{
+		{
+			models.TokenRequest{ClientID: "client-a", ClientSecret: "secret"},
+			map[string]string{"grant_type": "client_credentials", "scope": "openid profile"},
+		},
+		{
+			models.TokenRequest{GrantType: models.GrantPassword, ClientID: "client-a", Username: "alice", Password: "pw", Scope: "email"},
+			map[string]string{"grant_type": "password", "username": "alice", "password": "pw", "scope": "email"},
+		},
+		{
+			models.TokenRequest{GrantType: models.GrantRefreshToken, ClientID: "client-a", ClientSecret: "secret", RefreshToken: "rt-1"},
+			map[string]string{"grant_type": "refresh_token", "refresh_token": "rt-1", "client_secret": "secret"},
+		},
+		{
+			models.TokenRequest{GrantType: models.GrantTokenExchange, ClientID: "client-a", ClientSecret: "secret", SubjectToken: "st-1", Audience: "orders"},
+			map[string]string{
+				"grant_type":         idp.GrantTokenExchange,
+				"subject_token":      "st-1",
+				"subject_token_type": idp.TokenTypeAccessToken,
+				"audience":           "orders",
+			},
+		},
+	} {
+		response := request(&tc.req)
+		if response.Error != "" || response.AccessToken == "" {
+			t.Fatalf("grant %q failed: %+v", tc.req.GrantType, response)
+		}
+		form := s.idp.lastForm.Load().(url.Values)
+		for key, want := range tc.form {
+			if got := form.Get(key); got != want {
+				t.Fatalf("grant %q: IDP received %s=%q, expected %q", tc.req.GrantType, key, got, want)
+			}
+		}
+	}
+
+	calls := s.idp.calls.Load()
+	for _, req := range []models.TokenRequest{
+		{GrantType: "implicit", ClientID: "client-a"},
+		{GrantType: models.GrantRefreshToken, ClientID: "client-a"},
+	} {
+		response := request(&req)
+		if response.ErrorCode == "" || response.AccessToken != "" {
+			t.Fatalf("expected grant %q without its parameters to fail, got %+v", req.GrantType, response)
+		}
+	}
+	if s.idp.calls.Load() != calls {
+		t.Fatal("invalid grants must be rejected without calling the IDP")
+	}
+}
+
+func TestWorkerRoutesRealms(t *testing.T) {
+	s := startStack(t, true, 5)
+	nc, err := nats.Connect(s.natsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	request := func(realm string) *models.TokenResponse {
+		req := models.NewTokenRequest("client-a", "secret")
+		req.Realm = realm
+		data, _ := json.Marshal(req)
+		msg, err := nc.Request("token.request", data, 5*time.Second)
+		if err != nil {
+			t.Fatalf("realm %q: request failed: %v", realm, err)
+		}
+		var response models.TokenResponse
+		if err := json.Unmarshal(msg.Data, &response); err != nil {
+			t.Fatalf("realm %q: invalid response %s", realm, msg.Data)
+		}
+		return &response
+	}
+
+	if response := request("partners"); response.AccessToken == "" || s.realmIDP.calls.Load() != 1 || s.idp.calls.Load() != 0 {
+		t.Fatalf("expected the partners realm's IDP to issue the token, got %+v", response)
+	}
+	if response := request(""); response.AccessToken == "" || s.idp.calls.Load() != 1 {
+		t.Fatalf("expected the default IDP to issue the token, got %+v", response)
+	}
+	if response := request("unknown"); response.ErrorCode != models.ErrCodeInvalidRequest {
+		t.Fatalf("expected an unknown realm to be refused, got %+v", response)
+	}
+}
+
+func TestWorkerUsesStoredSecretsForSignedRequests(t *testing.T) {
+	srv := startNATS(t)
+	mock := newMockIDP(t)
+	signer, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, _ := signer.PublicKey()
+
+	dir := t.TempDir()
+	secretPath := filepath.Join(dir, "client-a")
+	if err := os.WriteFile(secretPath, []byte("stored-secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "app.json")
+	configData := fmt.Sprintf(`{"nats":{"url":%q},"credentials":{"mode":"reference","clients":{"client-a":"file://%s"},"trustedKeys":[%q]}}`,
+		srv.ClientURL(), secretPath, trusted)
+	if err := os.WriteFile(configPath, []byte(configData), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	startProcess(t, "token-worker", "-config", configPath, "-idp-url", mock.URL, "-name-suffix", "test", "-metrics-addr", "")
+	waitForWorker(t, srv.ClientURL())
+
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	decode := func(reply *nats.Msg) *models.TokenResponse {
+		var response models.TokenResponse
+		if err := json.Unmarshal(reply.Data, &response); err != nil {
+			t.Fatalf("invalid response %s", reply.Data)
+		}
+		return &response
+	}
+	request := func(clientID string, kp nkeys.KeyPair) *models.TokenResponse {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		data, _ := json.Marshal(models.NewTokenRequest(clientID, ""))
+		msg := pubsub.NewRequestMsg(nc, "token.request", models.NewRequestID(), data)
+		var reply *nats.Msg
+		var err error
+		if kp != nil {
+			reply, err = pubsub.RequestSigned(ctx, nc, msg, kp, nil)
+		} else {
+			reply, err = nc.RequestMsgWithContext(ctx, msg)
+		}
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return decode(reply)
+	}
+
+	// Any subscriber to the subject sees the signed requests
+	eavesdropped := make(chan *nats.Msg, 1)
+	eavesdropper, err := nc.Subscribe("token.request", func(msg *nats.Msg) {
+		select {
+		case eavesdropped <- msg:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response := request("client-a", signer); response.AccessToken == "" {
+		t.Fatalf("expected a token for the stored client, got %+v", response)
+	}
+	if secret := mock.lastForm.Load().(url.Values).Get("client_secret"); secret != "stored-secret" {
+		t.Fatalf("expected the stored secret to reach the IDP, got %q", secret)
+	}
+
+	// A copy of the signed request sent with another inbox, or sent again, gets no token
+	copied := <-eavesdropped
+	eavesdropper.Unsubscribe()
+	redirected := &nats.Msg{Subject: copied.Subject, Data: copied.Data, Header: copied.Header}
+	reply, err := nc.RequestMsg(redirected, 5*time.Second)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if response := decode(reply); response.ErrorCode != idp.ErrCodeUnauthorizedClient {
+		t.Fatalf("expected the redirected copy to be refused, got %+v", response)
+	}
+	inbox, err := nc.SubscribeSync(copied.Reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.PublishMsg(&nats.Msg{Subject: copied.Subject, Reply: copied.Reply, Data: copied.Data, Header: copied.Header}); err != nil {
+		t.Fatal(err)
+	}
+	reply, err = inbox.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if response := decode(reply); response.ErrorCode != idp.ErrCodeUnauthorizedClient {
+		t.Fatalf("expected the replayed request to be refused, got %+v", response)
+	}
+
+	if response := request("client-b", signer); response.ErrorCode != idp.ErrCodeInvalidClient {
+		t.Fatalf("expected a client without stored secret to be refused, got %+v", response)
+	}
+
+	stranger, _ := nkeys.CreateUser()
+	for name, kp := range map[string]nkeys.KeyPair{"unsigned": nil, "untrusted": stranger} {
+		if response := request("client-a", kp); response.ErrorCode != idp.ErrCodeUnauthorizedClient {
+			t.Fatalf("expected the %s request to be refused, got %+v", name, response)
+		}
+	}
+	if calls := mock.calls.Load(); calls != 1 {
+		t.Fatalf("expected refused requests not to reach the IDP, got %d calls", calls)
+	}
+}
+
+func TestTokenRequestsAreEncrypted(t *testing.T) {
+	srv := startNATS(t)
+	s := &stack{idp: newMockIDP(t), natsURL: srv.ClientURL()}
+
+	// The workers still accept the previous key, brain-app encrypts with the new one
+	configPath := filepath.Join(t.TempDir(), "app.json")
+	writeConfig := func(keyID string) {
+		configData := fmt.Sprintf(`{"nats":{"url":%q,"encryption":{"keyId":%q,"required":true,"keys":[
+			{"id":"2026-09","key":"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="},
+			{"id":"2026-10","key":"ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="}]}}}`, s.natsURL, keyID)
+		if err := os.WriteFile(configPath, []byte(configData), 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+	writeConfig("2026-09")
+	startProcess(t, "token-worker", "-config", configPath, "-idp-url", s.idp.URL, "-name-suffix", "test", "-metrics-addr", "")
+	waitForWorker(t, s.natsURL)
+	writeConfig("2026-10")
+	port := freePort(t)
+	startProcess(t, "brain-app", "-config", configPath, "-port", fmt.Sprint(port), "-request-timeout", "5")
+	s.brainURL = fmt.Sprintf("http://127.0.0.1:%d", port)
+	waitForHTTP(t, s.brainURL+"/health")
+
+	// Another team's subscriber sees neither the secret nor the token
+	nc, err := nats.Connect(s.natsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	sniffed, err := nc.SubscribeSync(">")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc.Flush()
+
+	status, payload, raw := s.requestToken(t, "client-a", "")
+	if status != http.StatusOK || payload["access_token"] == "" {
+		t.Fatalf("expected a token, got %d: %s", status, raw)
+	}
+	var request, reply bool
+	for {
+		msg, err := sniffed.NextMsg(200 * time.Millisecond)
+		if err != nil {
+			break
+		}
+		if bytes.Contains(msg.Data, []byte("secret")) || bytes.Contains(msg.Data, []byte(payload["access_token"])) {
+			t.Fatalf("expected only ciphertexts on %s, got %s", msg.Subject, msg.Data)
+		}
+		if msg.Subject == "token.request" {
+			request = msg.Header.Get("Encryption-Key-Id") == "2026-10"
+		} else if strings.HasPrefix(msg.Subject, "_INBOX.") {
+			reply = msg.Header.Get("Encryption-Key-Id") == "2026-10"
+		}
+	}
+	if !request || !reply {
+		t.Fatalf("expected the request and its reply encrypted with 2026-10, got %t and %t", request, reply)
+	}
+}
+
+func TestSlowIDPTimesOut(t *testing.T) {
+	s := startStack(t, true, 1)
+	s.idp.delay.Store(int64(2 * time.Second))
+
+	status, _, raw := s.requestToken(t, "client-a", "")
+	if status != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d: %s", status, raw)
+	}
+}
+
+func TestNoWorkersAvailable(t *testing.T) {
+	s := startStack(t, false, 1)
+
+	status, _, raw := s.requestToken(t, "client-a", "")
+	if status != http.StatusInternalServerError {
+		t.Fatalf("expected 500 without workers, got %d: %s", status, raw)
+	}
+}
+
+func TestInvalidRequestsAreRejected(t *testing.T) {
+	s := startStack(t, true, 5)
+
+	resp, err := http.Post(s.brainURL+"/token", "application/json", bytes.NewBufferString(`{"client_id":"a"}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for missing secret, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(s.brainURL + "/token")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for GET, got %d", resp.StatusCode)
+	}
+
+	if calls := s.idp.calls.Load(); calls != 0 {
+		t.Fatalf("invalid requests must not reach the IDP, got %d calls", calls)
+	}
+}
+
+func TestConcurrentRequestsForSameClient(t *testing.T) {
+	s := startStack(t, true, 5)
+	s.idp.delay.Store(int64(200 * time.Millisecond))
+
+	const n = 20
+	var wg sync.WaitGroup
+	statuses := make([]int, n)
+	tokens := make([]string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			status, payload, _ := s.requestToken(t, "client-a", "")
+			statuses[i], tokens[i] = status, payload["access_token"]
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if statuses[i] != http.StatusOK || tokens[i] == "" {
+			t.Fatalf("request %d failed with status %d", i, statuses[i])
+		}
+	}
+
+	// The requests are coalesced into one request to the workers
+	if calls := s.idp.calls.Load(); calls != 1 {
+		t.Fatalf("expected %d concurrent requests to cause 1 IDP call, got %d", n, calls)
+	}
+	for i := 1; i < n; i++ {
+		if tokens[i] != tokens[0] {
+			t.Fatalf("expected every request to receive the same token, got %q and %q", tokens[0], tokens[i])
+		}
+	}
+
+	// Once the burst is over, the cache serves everyone
+	_, payload, raw := s.requestToken(t, "client-a", "")
+	if payload["source"] != "cache" {
+		t.Fatalf("expected a cached token after the burst, got %s", raw)
+	}
+}